@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/cli"
+	"github.com/xplshn/gbc/pkg/codegen"
+)
+
+// lineHits maps source files to per-line execution counts
+type lineHits map[string]map[int]int64
+
+// runCover implements `gbc cover`, merging gbc.cov dumps into an lcov tracefile or an HTML report
+func runCover(args []string) error {
+	app := cli.NewApp("gbc cover")
+	app.Synopsis = "[options] [gbc.cov ...]"
+	app.Description = "Merge the coverage dumps of programs built with -Fcoverage into an lcov tracefile or an annotated HTML report."
+	app.Authors = []string{"xplshn"}
+	app.Repository = "<https://github.com/xplshn/gbc>"
+	app.Since = 2025
+
+	var outFile, htmlFile string
+	app.FlagSet.String(&outFile, "output", "o", "-", "Write the lcov tracefile to <file>.", "file")
+	app.FlagSet.String(&htmlFile, "html", "", "", "Write an annotated-source HTML report to <file> instead.", "file")
+
+	app.Action = func(inputs []string) error {
+		if len(inputs) == 0 { inputs = []string{codegen.CoverageFileName} }
+		hits := make(lineHits)
+		for _, path := range inputs {
+			if err := readCoverage(path, hits); err != nil { return err }
+		}
+
+		var w io.Writer = os.Stdout
+		target := outFile
+		if htmlFile != "" { target = htmlFile }
+		if target != "-" {
+			f, err := os.Create(target)
+			if err != nil { return err }
+			defer f.Close()
+			w = f
+		}
+		if htmlFile != "" { return writeCoverageHTML(w, hits) }
+		writeLcov(w, hits)
+		return nil
+	}
+	return app.Run(args)
+}
+
+// readCoverage adds the runs recorded in path to hits
+// Within a run a line's count is the maximum over its blocks; counts of separate runs are summed
+func readCoverage(path string, hits lineHits) error {
+	f, err := os.Open(path)
+	if err != nil { return fmt.Errorf("could not read coverage data: %w", err) }
+	defer f.Close()
+
+	run := make(lineHits)
+	flush := func() {
+		for file, lines := range run {
+			if hits[file] == nil { hits[file] = make(map[int]int64) }
+			for line, n := range lines { hits[file][line] += n }
+		}
+		run = make(lineHits)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == codegen.CoverageHeader {
+			flush()
+			continue
+		}
+		if text == "" || strings.HasPrefix(text, "#") { continue }
+
+		// File names may contain spaces, so the two counts are split off the end
+		countSep := strings.LastIndexByte(text, ' ')
+		lineSep := -1
+		if countSep > 0 { lineSep = strings.LastIndexByte(text[:countSep], ' ') }
+		if lineSep <= 0 { return fmt.Errorf("%s:%d: malformed coverage line", path, lineNo) }
+		file := text[:lineSep]
+		line, err1 := strconv.Atoi(text[lineSep+1 : countSep])
+		count, err2 := strconv.ParseInt(text[countSep+1:], 10, 64)
+		if err1 != nil || err2 != nil { return fmt.Errorf("%s:%d: malformed coverage line", path, lineNo) }
+
+		if run[file] == nil { run[file] = make(map[int]int64) }
+		if old, ok := run[file][line]; !ok || count > old { run[file][line] = count }
+	}
+	flush()
+	return scanner.Err()
+}
+
+func (h lineHits) sortedFiles() []string {
+	files := make([]string, 0, len(h))
+	for f := range h { files = append(files, f) }
+	sort.Strings(files)
+	return files
+}
+
+func sortedLines(lines map[int]int64) []int {
+	nums := make([]int, 0, len(lines))
+	for l := range lines { nums = append(nums, l) }
+	sort.Ints(nums)
+	return nums
+}
+
+func writeLcov(w io.Writer, hits lineHits) {
+	fmt.Fprintln(w, "TN:")
+	for _, file := range hits.sortedFiles() {
+		lines := hits[file]
+		fmt.Fprintf(w, "SF:%s\n", file)
+		covered := 0
+		for _, l := range sortedLines(lines) {
+			fmt.Fprintf(w, "DA:%d,%d\n", l, lines[l])
+			if lines[l] > 0 { covered++ }
+		}
+		fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", len(lines), covered)
+	}
+}
+
+func writeCoverageHTML(w io.Writer, hits lineHits) error {
+	fmt.Fprint(w, `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>gbc coverage</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; font-family: monospace; white-space: pre; }
+td { padding: 0 0.5em; }
+td.n, td.c { text-align: right; color: #888; }
+tr.hit { background: #dfd; }
+tr.miss { background: #fdd; }
+</style></head><body>
+<h1>gbc coverage</h1>
+`)
+	files := hits.sortedFiles()
+	fmt.Fprintln(w, "<ul>")
+	for i, file := range files {
+		covered := 0
+		for _, n := range hits[file] {
+			if n > 0 { covered++ }
+		}
+		fmt.Fprintf(w, "<li><a href=\"#f%d\">%s</a>: %d/%d lines (%.1f%%)</li>\n",
+			i, html.EscapeString(file), covered, len(hits[file]), 100*float64(covered)/float64(max(len(hits[file]), 1)))
+	}
+	fmt.Fprintln(w, "</ul>")
+
+	for i, file := range files {
+		fmt.Fprintf(w, "<h2 id=\"f%d\">%s</h2>\n<table>\n", i, html.EscapeString(file))
+		src, err := os.ReadFile(file)
+		if err != nil { return fmt.Errorf("could not read source for report: %w", err) }
+		for n, text := range strings.Split(strings.TrimRight(string(src), "\n"), "\n") {
+			count, instrumented := hits[file][n+1]
+			class, countStr := "", ""
+			if instrumented {
+				class, countStr = "miss", "0"
+				if count > 0 { class, countStr = "hit", strconv.FormatInt(count, 10) }
+			}
+			fmt.Fprintf(w, "<tr class=\"%s\"><td class=\"n\">%d</td><td class=\"c\">%s</td><td>%s</td></tr>\n",
+				class, n+1, countStr, html.EscapeString(text))
+		}
+		fmt.Fprintln(w, "</table>")
+	}
+	fmt.Fprintln(w, "</body></html>")
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/xplshn/gbc/pkg/cli"
+	"github.com/xplshn/gbc/pkg/codegen"
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/interp"
+)
+
+// runInterp implements `gbc interp`, running a program on the AST interpreter, or with --ir on the IR virtual
+// machine, instead of compiling it
+// Arguments after `--` are passed to the program
+func runInterp(args []string) error {
+	app := cli.NewApp("gbc interp")
+	app.Synopsis = "[options] <input.b> ... [-- program arguments]"
+	app.Description = "Run a B program directly on the AST interpreter or the IR virtual machine, without QBE, llc or a C toolchain."
+	app.Authors = []string{"xplshn"}
+	app.Repository = "<https://github.com/xplshn/gbc>"
+	app.Since = 2025
+
+	var (
+		std              string
+		pedantic         bool
+		noWarnings       bool
+		runIR            bool
+		userIncludePaths []string
+		libRequests      []string
+	)
+	fs := app.FlagSet
+	fs.List(&userIncludePaths, "include", "I", []string{}, "Add a directory to the include path.", "path")
+	fs.Special(&libRequests, "l", "Link with a library (e.g., -lb for 'b')", "lib")
+	fs.String(&std, "std", "", "Bx", "Specify language standard (B, Bx)", "std")
+	fs.Bool(&pedantic, "pedantic", "", false, "Issue all warnings demanded by the current B std.")
+	fs.Bool(&noWarnings, "no-warnings", "w", false, "Inhibit all warnings, so that stderr only carries the program's output.")
+	fs.Bool(&runIR, "ir", "", false, "Execute the IR generated by codegen instead of walking the AST.")
+
+	cfg := config.NewConfig()
+	warningFlags, featureFlags := cfg.SetupFlagGroups(fs)
+
+	var programArgs []string
+	for i, a := range args {
+		if a == "--" {
+			args, programArgs = args[:i], args[i+1:]
+			break
+		}
+	}
+
+	app.Action = func(inputFiles []string) error {
+		if len(inputFiles) == 0 { return fmt.Errorf("no input files specified") }
+		applyFlags(cfg, fs, std, pedantic, warningFlags, featureFlags)
+		if noWarnings {
+			for i := config.Warning(0); i < config.WarnCount; i++ {
+				cfg.SetWarning(i, false)
+			}
+		}
+		cfg.GOOS, cfg.GOARCH = runtime.GOOS, runtime.GOARCH
+		interp.Configure(cfg)
+		cfg.LibRequests = append(cfg.LibRequests, libRequests...)
+		cfg.UserIncludePaths = append(cfg.UserIncludePaths, userIncludePaths...)
+
+		root := parseProgram(inputFiles, cfg, io.Discard)
+		in := interp.New(cfg, os.Stdin, os.Stdout, os.Stderr)
+		if fi, err := os.Stdout.Stat(); err == nil { in.Interactive = fi.Mode()&os.ModeCharDevice != 0 }
+		argv := append([]string{inputFiles[0]}, programArgs...)
+		var status int
+		var err error
+		if runIR {
+			// Functions written in assembly are left to the builtins, as on the AST interpreter
+			prog, _ := codegen.NewContext(cfg).GenerateIR(root)
+			status, err = in.RunIR(prog, argv)
+		} else {
+			status, err = in.Run(root, argv)
+		}
+		if fault, ok := err.(*interp.Fault); ok {
+			if fault.Msg != "" { fmt.Fprintln(os.Stderr, fault) }
+			os.Exit(fault.ExitCode())
+		}
+		os.Exit(status)
+		return nil
+	}
+	return app.Run(args)
+}
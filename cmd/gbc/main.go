@@ -2,24 +2,50 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"text/tabwriter"
 
+	"github.com/xplshn/gbc/pkg/amd64"
 	"github.com/xplshn/gbc/pkg/ast"
 	"github.com/xplshn/gbc/pkg/cli"
 	"github.com/xplshn/gbc/pkg/codegen"
 	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/elf"
 	"github.com/xplshn/gbc/pkg/lexer"
+	"github.com/xplshn/gbc/pkg/mos6502"
+	"github.com/xplshn/gbc/pkg/sm83"
+	"github.com/xplshn/gbc/pkg/uxn"
 	"github.com/xplshn/gbc/pkg/parser"
 	"github.com/xplshn/gbc/pkg/token"
 	"github.com/xplshn/gbc/pkg/typeChecker"
 	"github.com/xplshn/gbc/pkg/util"
 )
 
+// subcommands are dispatched on the first argument before regular flag parsing
+var subcommands = map[string]func(args []string) error{
+	"prof":   runProf,
+	"cover":  runCover,
+	"interp": runInterp,
+	"repl":   runRepl,
+	"run":    runRun,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "gbc %s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	app := cli.NewApp("gbc")
 	app.Synopsis = "[options] <input.b> ..."
 	app.Description = "A compiler for the B programming language with modern extensions. Like stepping into a time machine, but with better error messages."
@@ -37,12 +63,22 @@ func main() {
 		libRequests      []string
 		pedantic         bool
 		dumpIR           bool
+		debugInfo        bool
+		listTargets      bool
+		optLevel         string
+		cpu              string
+		emit             string
 	)
 
 	fs := app.FlagSet
 	fs.String(&outFile, "output", "o", "a.out", "Place the output into <file>.", "file")
 	fs.String(&target, "target", "t", "qbe", "Set the backend and target ABI.", "backend/target")
 	fs.Bool(&dumpIR, "dump-ir", "d", false, "Dump the intermediate representation and exit.")
+	fs.Bool(&debugInfo, "debug", "g", false, "Emit source-level debug information.")
+	fs.Bool(&listTargets, "list-targets", "", false, "List the backends, their targets and what they support, and exit.")
+	fs.String(&optLevel, "optimize", "O", "", "Optimization level of the llvm backend, 0 to 3 (default 2, or 0 with -g).", "level")
+	fs.String(&cpu, "mcpu", "", "", "Generate code for the given CPU (llvm backend).", "cpu")
+	fs.String(&emit, "emit", "", "exe", "What to write: exe, or with the llvm backend obj, asm, llvm-ir or llvm-bc.", "kind")
 	fs.List(&userIncludePaths, "include", "I", []string{}, "Add a directory to the include path.", "path")
 	fs.List(&linkerArgs, "linker-arg", "L", []string{}, "Pass an argument to the linker.", "arg")
 	fs.List(&compilerArgs, "compiler-arg", "C", []string{}, "Pass a compiler-specific argument (e.g., -C linker_args='-s').", "arg")
@@ -55,43 +91,25 @@ func main() {
 
 	// Main compilation pipeline
 	app.Action = func(inputFiles []string) error {
-		// Pedantic flag affects everything else
-		if pedantic {
-			cfg.SetWarning(config.WarnPedantic, true)
-		}
-
-		// Apply language standard first
-		if err := cfg.ApplyStd(std); err != nil {
-			util.Error(token.Token{}, err.Error())
+		if listTargets {
+			printTargets(os.Stdout)
+			return nil
 		}
 
-		// Apply warning flags (override standard settings)
-		for i, entry := range warningFlags {
-			if entry.Enabled != nil && *entry.Enabled {
-				cfg.SetWarning(config.Warning(i), true)
-			}
-			if entry.Disabled != nil && *entry.Disabled {
-				cfg.SetWarning(config.Warning(i), false)
-			}
-		}
-
-		// Apply feature flags (override standard settings)
-		for i, entry := range featureFlags {
-			if entry.Enabled != nil && *entry.Enabled {
-				cfg.SetFeature(config.Feature(i), true)
-			}
-			if entry.Disabled != nil && *entry.Disabled {
-				cfg.SetFeature(config.Feature(i), false)
-			}
-		}
+		applyFlags(cfg, fs, std, pedantic, warningFlags, featureFlags)
 
 		// Set target architecture
-		cfg.SetTarget(runtime.GOOS, runtime.GOARCH, target)
+		if err := cfg.SetTarget(runtime.GOOS, runtime.GOARCH, target, codegen.LookupTargets); err != nil {
+			util.Error(token.Token{}, "%v", err)
+		}
+		backendInfo, _ := codegen.LookupBackend(cfg.BackendName)
 
 		// Copy over command line settings
 		cfg.LinkerArgs = append(cfg.LinkerArgs, linkerArgs...)
 		cfg.LibRequests = append(cfg.LibRequests, libRequests...)
 		cfg.UserIncludePaths = append(cfg.UserIncludePaths, userIncludePaths...)
+		cfg.DebugInfo = cfg.DebugInfo || debugInfo
+		cfg.OptLevel, cfg.CPU = optLevel, cpu
 
 		// Handle compiler args (-C)
 		for _, carg := range compilerArgs {
@@ -104,46 +122,33 @@ func main() {
 			}
 		}
 
-		// First pass: scan for directives
-		fmt.Println("----------------------")
-		records, allTokens := readAndTokenizeFiles(inputFiles, cfg)
-		util.SetSourceFiles(records)
-		p := parser.NewParser(allTokens, cfg)
-		p.Parse() // picks up directives
-
-		// Now that all directives are processed, determine the final list of source files.
-		finalInputFiles := processInputFiles(inputFiles, cfg)
-		if len(finalInputFiles) == 0 {
-			util.Error(token.Token{}, "no input files specified.")
+		// Reject what the backend cannot compile now, rather than deep inside it
+		if err := backendInfo.Check(cfg); err != nil {
+			util.Error(token.Token{}, "%v", err)
 		}
-
-		// Second pass: compile everything
-		isTyped := cfg.IsFeatureEnabled(config.FeatTyped)
-		fmt.Printf("Tokenizing %d source file(s) (Typed Pass: %v)...\n", len(finalInputFiles), isTyped)
-		fullRecords, fullTokens := readAndTokenizeFiles(finalInputFiles, cfg)
-		util.SetSourceFiles(fullRecords)
-
-		fmt.Println("Parsing tokens into AST...")
-		fullParser := parser.NewParser(fullTokens, cfg)
-		astRoot := fullParser.Parse()
-
-		fmt.Println("Folding constants...")
-		astRoot = ast.FoldConstants(astRoot)
-
-		if cfg.IsFeatureEnabled(config.FeatTyped) { // recheck after directive processing
-			fmt.Println("Type checking...")
-			tc := typeChecker.NewTypeChecker(cfg)
-			tc.Check(astRoot)
+		switch {
+		case optLevel != "" && (len(optLevel) != 1 || optLevel[0] < '0' || optLevel[0] > '3'):
+			util.Error(token.Token{}, "invalid optimization level '-O%s'; use -O0 to -O3", optLevel)
+		case emit != "exe" && emit != "obj" && emit != "asm" && emit != "llvm-ir" && emit != "llvm-bc":
+			util.Error(token.Token{}, "invalid --emit value '%s'; use exe, obj, asm, llvm-ir or llvm-bc", emit)
+		case emit != "exe" && cfg.BackendName != "llvm":
+			util.Error(token.Token{}, "--emit=%s needs the llvm backend (-t llvm)", emit)
+		case cpu != "" && cfg.BackendName != "llvm":
+			util.Error(token.Token{}, "-mcpu needs the llvm backend (-t llvm)")
 		}
 
+		fmt.Println("----------------------")
+		astRoot := parseProgram(inputFiles, cfg, os.Stdout)
+
 		fmt.Println("Creating intermediate representation...")
 		cg := codegen.NewContext(cfg)
 		irProg, inlineAsm := cg.GenerateIR(astRoot)
+		backendInfo.CheckProgram(cfg, irProg, inlineAsm)
 
 		// Handle --dump-ir/-d flag
 		if dumpIR {
 			fmt.Printf("Dumping IR for '%s' backend...\n", cfg.BackendName)
-			backend := selectBackend(cfg.BackendName)
+			backend := backendInfo.New()
 			irText, err := backend.GenerateIR(irProg, cfg)
 			if err != nil {
 				util.Error(token.Token{}, "backend IR generation failed: %v", err)
@@ -152,16 +157,100 @@ func main() {
 			return nil
 		}
 
-		fmt.Printf("Generating code with '%s' backend...\n", cfg.BackendName)
-		backend := selectBackend(cfg.BackendName)
-		backendOutput, err := backend.Generate(irProg, cfg)
-		if err != nil {
-			util.Error(token.Token{}, "backend code generation failed: %v", err)
-		}
+		// LLVM IR is compiled to an object, with the `__asm__` functions in it as module-level assembly, that cc links
+		if cfg.BackendName == "llvm" {
+			fmt.Printf("Generating code with '%s' backend...\n", cfg.BackendName)
+			llvmIR, err := backendInfo.New().GenerateIR(irProg, cfg)
+			if err != nil {
+				util.Error(token.Token{}, "backend code generation failed: %v", err)
+			}
+			llvmIR += codegen.LLVMModuleAsm(inlineAsm)
+			var output []byte
+			switch emit {
+			case "llvm-ir": output = []byte(llvmIR)
+			case "llvm-bc": output, err = codegen.LLVMBitcode(llvmIR)
+			case "obj", "asm": output, err = codegen.CompileLLVM(llvmIR, cfg, emit)
+			default:
+				var obj []byte
+				if obj, err = codegen.CompileLLVM(llvmIR, cfg, "obj"); err == nil {
+					fmt.Printf("Linking to create '%s'...\n", outFile)
+					if err := linkObjects(outFile, [][]byte{obj}, cfg.LinkerArgs); err != nil {
+						util.Error(token.Token{}, "linker failed: %v", err)
+					}
+				}
+			}
+			if err != nil {
+				util.Error(token.Token{}, "backend code generation failed: %v", err)
+			}
+			if output != nil {
+				fmt.Printf("Writing '%s'...\n", outFile)
+				if err := os.WriteFile(outFile, output, 0644); err != nil {
+					util.Error(token.Token{}, "failed to write output: %v", err)
+				}
+			}
+		} else {
+			fmt.Printf("Generating code with '%s' backend...\n", cfg.BackendName)
+			backend := backendInfo.New()
+			backendOutput, err := backend.Generate(irProg, cfg)
+			if err != nil {
+				util.Error(token.Token{}, "backend code generation failed: %v", err)
+			}
 
-		fmt.Printf("Linking to create '%s'...\n", outFile)
-		if err := assembleAndLink(outFile, backendOutput.String(), inlineAsm, cfg.LinkerArgs); err != nil {
-			util.Error(token.Token{}, "assembler/linker failed: %v", err)
+			switch cfg.BackendName {
+			// A WebAssembly module is complete as generated, with nothing to assemble or link
+			case "wasm":
+				fmt.Printf("Writing module '%s'...\n", outFile)
+				if err := os.WriteFile(outFile, backendOutput.Bytes(), 0755); err != nil {
+					util.Error(token.Token{}, "failed to write output: %v", err)
+				}
+			// The 6502 assembly, with any `__asm__` functions after it, becomes a raw image with no linking to do
+			case "6502":
+				fmt.Printf("Assembling '%s'...\n", outFile)
+				img, err := mos6502.Assemble(backendOutput.String() + "\n" + inlineAsm)
+				if err != nil {
+					util.Error(token.Token{}, "assembler failed: %v", err)
+				}
+				if err := os.WriteFile(outFile, img.Bytes, 0644); err != nil {
+					util.Error(token.Token{}, "failed to write output: %v", err)
+				}
+			// Likewise the Uxntal, with the `__asm__` functions of lib/b/uxn.b rewritten after it, becomes a ROM
+			case "uxn":
+				fmt.Printf("Assembling '%s'...\n", outFile)
+				asm, err := codegen.UxnInlineAsm(inlineAsm)
+				if err != nil {
+					util.Error(token.Token{}, "assembler failed: %v", err)
+				}
+				rom, err := uxn.Assemble(backendOutput.String() + asm)
+				if err != nil {
+					util.Error(token.Token{}, "assembler failed: %v", err)
+				}
+				if err := os.WriteFile(outFile, rom.Bytes, 0644); err != nil {
+					util.Error(token.Token{}, "failed to write output: %v", err)
+				}
+			// The SM83 assembly, with the `__asm__` functions of lib/b/gb.b after it, becomes a 32 KiB cartridge
+			case "gb":
+				fmt.Printf("Assembling '%s'...\n", outFile)
+				img, err := sm83.Assemble(backendOutput.String() + "\n" + inlineAsm)
+				if err != nil {
+					util.Error(token.Token{}, "assembler failed: %v", err)
+				}
+				if err := os.WriteFile(outFile, img.Bytes, 0644); err != nil {
+					util.Error(token.Token{}, "failed to write output: %v", err)
+				}
+			default:
+				fmt.Printf("Linking to create '%s'...\n", outFile)
+				done := false
+				if cfg.BackendName == "qbe" && cfg.BackendTarget == "amd64_sysv" && cfg.GOOS == "linux" {
+					if done, err = assembleInternally(outFile, backendOutput.String(), inlineAsm, cfg.LinkerArgs); err != nil {
+						util.Error(token.Token{}, "assembler/linker failed: %v", err)
+					}
+				}
+				if !done {
+					if err := assembleAndLink(outFile, backendOutput.String(), inlineAsm, cfg.LinkerArgs); err != nil {
+						util.Error(token.Token{}, "assembler/linker failed: %v", err)
+					}
+				}
+			}
 		}
 
 		fmt.Println("----------------------")
@@ -174,6 +263,76 @@ func main() {
 	}
 }
 
+// applyFlags settles cfg from the language standard, then the -W and -F flags of fs that override it. Only the
+// flags the command line set apply: the others hold the defaults, which would undo the standard
+func applyFlags(cfg *config.Config, fs *cli.FlagSet, std string, pedantic bool, warningFlags, featureFlags []cli.FlagGroupEntry) {
+	// Pedantic flag affects everything else
+	if pedantic {
+		cfg.SetWarning(config.WarnPedantic, true)
+	}
+
+	// Apply language standard first
+	if err := cfg.ApplyStd(std); err != nil {
+		util.Error(token.Token{}, "%s", err.Error())
+	}
+
+	// Apply warning flags (override standard settings)
+	for i, entry := range warningFlags {
+		if fs.Changed(entry.Prefix+entry.Name) && *entry.Enabled {
+			cfg.SetWarning(config.Warning(i), true)
+		}
+		if fs.Changed(entry.Prefix+"no-"+entry.Name) && *entry.Disabled {
+			cfg.SetWarning(config.Warning(i), false)
+		}
+	}
+
+	// Apply feature flags (override standard settings)
+	for i, entry := range featureFlags {
+		if fs.Changed(entry.Prefix+entry.Name) && *entry.Enabled {
+			cfg.SetFeature(config.Feature(i), true)
+		}
+		if fs.Changed(entry.Prefix+"no-"+entry.Name) && *entry.Disabled {
+			cfg.SetFeature(config.Feature(i), false)
+		}
+	}
+}
+
+// parseProgram runs the front end over inputFiles and returns the checked AST, reporting progress to w
+func parseProgram(inputFiles []string, cfg *config.Config, w io.Writer) *ast.Node {
+	// First pass: scan for directives
+	records, allTokens := readAndTokenizeFiles(inputFiles, cfg)
+	util.SetSourceFiles(records)
+	p := parser.NewParser(allTokens, cfg)
+	p.Parse() // picks up directives
+
+	// Now that all directives are processed, determine the final list of source files.
+	finalInputFiles := processInputFiles(inputFiles, cfg)
+	if len(finalInputFiles) == 0 {
+		util.Error(token.Token{}, "no input files specified.")
+	}
+
+	// Second pass: compile everything
+	isTyped := cfg.IsFeatureEnabled(config.FeatTyped)
+	fmt.Fprintf(w, "Tokenizing %d source file(s) (Typed Pass: %v)...\n", len(finalInputFiles), isTyped)
+	fullRecords, fullTokens := readAndTokenizeFiles(finalInputFiles, cfg)
+	util.SetSourceFiles(fullRecords)
+
+	fmt.Fprintln(w, "Parsing tokens into AST...")
+	fullParser := parser.NewParser(fullTokens, cfg)
+	astRoot := fullParser.Parse()
+
+	fmt.Fprintln(w, "Folding constants...")
+	astRoot = ast.FoldConstants(astRoot)
+
+	if cfg.IsFeatureEnabled(config.FeatTyped) { // recheck after directive processing
+		fmt.Fprintln(w, "Type checking...")
+		tc := typeChecker.NewTypeChecker(cfg)
+		tc.Check(astRoot)
+	}
+
+	return astRoot
+}
+
 func processInputFiles(args []string, cfg *config.Config) []string {
 	// Use a map to avoid duplicate library entries
 	uniqueLibs := make(map[string]bool)
@@ -184,6 +343,7 @@ func processInputFiles(args []string, cfg *config.Config) []string {
 	inputFiles := args
 	for libName := range uniqueLibs {
 		if libPath := findLibrary(libName, cfg.UserIncludePaths, cfg); libPath != "" {
+			cfg.LibraryFiles = append(cfg.LibraryFiles, libPath)
 			// Avoid adding the same library file path multiple times
 			found := false
 			for _, inFile := range inputFiles {
@@ -202,16 +362,31 @@ func processInputFiles(args []string, cfg *config.Config) []string {
 	return inputFiles
 }
 
-func selectBackend(name string) codegen.Backend {
-	switch name {
-	case "qbe":
-		return codegen.NewQBEBackend()
-	case "llvm":
-		return codegen.NewLLVMBackend()
-	default:
-		util.Error(token.Token{}, "unsupported backend '%s'", name)
-		return nil
+// printTargets prints the backend registry for --list-targets
+func printTargets(w io.Writer) {
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BACKEND\tTARGETS\tWORD\tFLOATS\tASM\tASM-STMT\tVARARGS\tLIBC\tPIE\tDESCRIPTION")
+	for _, b := range codegen.Backends() {
+		var targets, words []string
+		def := b.Default(runtime.GOOS, runtime.GOARCH)
+		for _, t := range b.Targets {
+			if t.Name == def { targets = append(targets, t.Name+"*") } else { targets = append(targets, t.Name) }
+		}
+		if b.Triples {
+			if def == "" { targets = append(targets, config.HostTriple(runtime.GOOS, runtime.GOARCH)+"*") }
+			targets = append(targets, "<triple>")
+		}
+		for _, size := range b.WordSizes {
+			words = append(words, fmt.Sprint(size))
+		}
+		asm := b.Asm
+		if asm == "" { asm = "-" }
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", b.Name, strings.Join(targets, ","), strings.Join(words, ","),
+			yesNo[b.Floats], asm, yesNo[b.AsmStmt], yesNo[b.Varargs], yesNo[b.Libc], yesNo[b.PIE], b.Description)
 	}
+	tw.Flush()
+	fmt.Fprintln(w, "\n* is the default target on this host; -t backend/target selects one")
 }
 
 func findLibrary(libName string, userPaths []string, cfg *config.Config) string {
@@ -242,6 +417,61 @@ func findLibrary(libName string, userPaths []string, cfg *config.Config) string
 	return ""
 }
 
+// assembleInternally assembles the x86-64 QBE emits and the inline assembly into objects. A program that defines
+// its own _start, as those built with -lnolibc do, and that has no linker arguments is then linked statically,
+// without any external tool; any other is linked by cc. It reports false, leaving it all to cc, for assembly the
+// internal assembler does not know, such as the debug information of -g
+func assembleInternally(outFile, mainAsm, inlineAsm string, linkerArgs []string) (bool, error) {
+	var objs []*elf.Object
+	for _, src := range []string{mainAsm, inlineAsm} {
+		if strings.TrimSpace(src) == "" { continue }
+		obj, err := amd64.Assemble(src)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gbc: info: internal assembler: %v; assembling with cc instead\n", err)
+			return false, nil
+		}
+		objs = append(objs, obj)
+	}
+
+	if len(linkerArgs) == 0 && elf.Defines(objs, elf.EntrySymbol) {
+		exe, err := elf.Link(objs)
+		if err != nil { return false, err }
+		return true, os.WriteFile(outFile, exe, 0755)
+	}
+
+	var data [][]byte
+	for _, obj := range objs {
+		b, err := obj.Bytes()
+		if err != nil { return false, err }
+		data = append(data, b)
+	}
+	return true, linkObjects(outFile, data, linkerArgs)
+}
+
+// linkObjects links objects into an executable with cc
+func linkObjects(outFile string, objs [][]byte, linkerArgs []string) error {
+	ccArgs := []string{"-no-pie", "-o", outFile}
+	for _, obj := range objs {
+		objFile, err := os.CreateTemp("", "gbc-*.o")
+		if err != nil {
+			return fmt.Errorf("failed to create temp file for object: %w", err)
+		}
+		defer os.Remove(objFile.Name())
+		if _, err := objFile.Write(obj); err != nil {
+			return fmt.Errorf("failed to write to temp file for object: %w", err)
+		}
+		objFile.Close()
+		ccArgs = append(ccArgs, objFile.Name())
+	}
+	ccArgs = append(ccArgs, linkerArgs...)
+
+	cmd := exec.Command("cc", ccArgs...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cc command failed: %w\nOutput:\n%s", err, string(output))
+	}
+	return nil
+}
+
 func assembleAndLink(outFile, mainAsm, inlineAsm string, linkerArgs []string) error {
 	mainAsmFile, err := os.CreateTemp("", "gbc-main-*.s")
 	if err != nil {
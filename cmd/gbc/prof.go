@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/codegen"
+)
+
+type profEntry struct {
+	name             string
+	calls, self, tot int64
+}
+
+// runProf implements `gbc prof [file...]`, printing a flat profile of one or more merged gbc.prof files
+func runProf(args []string) error {
+	if len(args) == 0 { args = []string{codegen.ProfileFileName} }
+
+	entries := make(map[string]*profEntry)
+	for _, path := range args {
+		if err := readProfile(path, entries); err != nil { return err }
+	}
+
+	var list []*profEntry
+	var totalSelf int64
+	for _, e := range entries {
+		list = append(list, e)
+		totalSelf += e.self
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].self != list[j].self { return list[i].self > list[j].self }
+		if list[i].calls != list[j].calls { return list[i].calls > list[j].calls }
+		return list[i].name < list[j].name
+	})
+
+	printFlatProfile(os.Stdout, list, totalSelf)
+	return nil
+}
+
+func readProfile(path string, entries map[string]*profEntry) error {
+	f, err := os.Open(path)
+	if err != nil { return fmt.Errorf("could not read profile: %w", err) }
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") { continue }
+		fields := strings.Fields(line)
+		if len(fields) != 4 { return fmt.Errorf("%s:%d: malformed profile line", path, lineNo) }
+
+		var nums [3]int64
+		for i := range nums {
+			if nums[i], err = strconv.ParseInt(fields[i+1], 10, 64); err != nil {
+				return fmt.Errorf("%s:%d: malformed profile line: %w", path, lineNo, err)
+			}
+		}
+		e := entries[fields[0]]
+		if e == nil {
+			e = &profEntry{name: fields[0]}
+			entries[e.name] = e
+		}
+		e.calls += nums[0]
+		e.self += nums[1]
+		e.tot += nums[2]
+	}
+	return scanner.Err()
+}
+
+func printFlatProfile(w io.Writer, list []*profEntry, totalSelf int64) {
+	fmt.Fprintln(w, "Flat profile (times in milliseconds, total includes callees):")
+	fmt.Fprintf(w, "%7s %10s %10s %10s %12s %12s  %s\n", "%time", "cumul", "self", "calls", "self/call", "total/call", "name")
+
+	var cumulative int64
+	for _, e := range list {
+		cumulative += e.self
+		percent := 0.0
+		if totalSelf > 0 { percent = 100 * float64(e.self) / float64(totalSelf) }
+		selfPerCall, totPerCall := 0.0, 0.0
+		if e.calls > 0 {
+			selfPerCall = float64(e.self) / float64(e.calls) / 1000
+			totPerCall = float64(e.tot) / float64(e.calls) / 1000
+		}
+		fmt.Fprintf(w, "%7.2f %10.2f %10.2f %10d %12.4f %12.4f  %s\n",
+			percent, float64(cumulative)/1000, float64(e.self)/1000, e.calls, selfPerCall, totPerCall, e.name)
+	}
+}
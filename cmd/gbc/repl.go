@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/ast"
+	"github.com/xplshn/gbc/pkg/cli"
+	"github.com/xplshn/gbc/pkg/codegen"
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/interp"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/lexer"
+	"github.com/xplshn/gbc/pkg/parser"
+	"github.com/xplshn/gbc/pkg/token"
+	"github.com/xplshn/gbc/pkg/typeChecker"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+const replHelp = `Enter declarations to add them to the program, or statements to run them.
+The value of a trailing expression is printed with its type.
+  :ast <input>   show the syntax tree of an input
+  :type <expr>   show the type of an expression
+  :ir <input>    show the QBE IR generated for an input
+  :help          show this help
+  :quit          leave (as does end of input)
+`
+
+// runRepl implements `gbc repl`, an interactive session on the AST interpreter
+func runRepl(args []string) error {
+	app := cli.NewApp("gbc repl")
+	app.Synopsis = "[options] [input.b] ..."
+	app.Description = "Enter B declarations and statements and see their values immediately. Input files are loaded first."
+	app.Authors = []string{"xplshn"}
+	app.Repository = "<https://github.com/xplshn/gbc>"
+	app.Since = 2025
+
+	var (
+		std              string
+		pedantic         bool
+		noWarnings       bool
+		userIncludePaths []string
+		libRequests      []string
+	)
+	fs := app.FlagSet
+	fs.List(&userIncludePaths, "include", "I", []string{}, "Add a directory to the include path.", "path")
+	fs.Special(&libRequests, "l", "Link with a library (e.g., -lb for 'b')", "lib")
+	fs.String(&std, "std", "", "Bx", "Specify language standard (B, Bx)", "std")
+	fs.Bool(&pedantic, "pedantic", "", false, "Issue all warnings demanded by the current B std.")
+	fs.Bool(&noWarnings, "no-warnings", "w", false, "Inhibit all warnings.")
+
+	cfg := config.NewConfig()
+	warningFlags, featureFlags := cfg.SetupFlagGroups(fs)
+
+	app.Action = func(inputFiles []string) error {
+		applyFlags(cfg, fs, std, pedantic, warningFlags, featureFlags)
+		if noWarnings {
+			for i := config.Warning(0); i < config.WarnCount; i++ {
+				cfg.SetWarning(i, false)
+			}
+		}
+		cfg.GOOS, cfg.GOARCH = runtime.GOOS, runtime.GOARCH
+		interp.Configure(cfg)
+		cfg.LibRequests = append(cfg.LibRequests, libRequests...)
+		cfg.UserIncludePaths = append(cfg.UserIncludePaths, userIncludePaths...)
+
+		stdin := bufio.NewReader(os.Stdin)
+		r := &repl{cfg: cfg, stdin: stdin, in: interp.New(cfg, stdin, os.Stdout, os.Stderr)}
+		r.in.Interactive = true
+		if fi, err := os.Stdin.Stat(); err == nil { r.prompt = fi.Mode()&os.ModeCharDevice != 0 }
+
+		if len(inputFiles) > 0 || len(cfg.LibRequests) > 0 {
+			root := parseProgram(inputFiles, cfg, io.Discard)
+			r.in.Load(root)
+			r.program = root.Data.(ast.BlockNode).Stmts
+		}
+		if r.prompt { fmt.Fprintln(os.Stderr, "gbc repl: type :help for help") }
+		os.Exit(r.loop())
+		return nil
+	}
+	return app.Run(args)
+}
+
+// repl holds a session: the declarations entered so far, and the interpreter they are loaded into
+type repl struct {
+	cfg     *config.Config
+	in      *interp.Interpreter
+	stdin   *bufio.Reader
+	prompt  bool
+	program []*ast.Node // latest declaration of every global, in the order entered
+	count   int
+}
+
+// unit is one parsed input: global declarations, or statements wrapped in a function of their own
+type unit struct {
+	decls   []*ast.Node
+	wrapper *ast.Node
+	valued  bool // the wrapper returns the value of a trailing expression
+}
+
+// last returns the trailing expression of the statements, if they end with one
+func (u *unit) last() *ast.Node {
+	if !u.valued { return nil }
+	stmts := u.wrapper.Data.(ast.FuncDeclNode).Body.Data.(ast.BlockNode).Stmts
+	return stmts[len(stmts)-1].Data.(ast.ReturnNode).Expr
+}
+
+// loop reads and evaluates inputs until the end of input or an exit, returning the exit status
+func (r *repl) loop() int {
+	for {
+		src, ok := r.read()
+		if !ok {
+			if r.prompt { fmt.Fprintln(os.Stderr) }
+			return 0
+		}
+		cmd, rest := "", src
+		if trimmed := strings.TrimSpace(src); strings.HasPrefix(trimmed, ":") {
+			cmd, rest, _ = strings.Cut(trimmed[1:], " ")
+		}
+		switch cmd {
+		case "": if status, exited := r.eval(rest); exited { return status }
+		case "q", "quit": return 0
+		case "help": fmt.Fprint(os.Stderr, replHelp)
+		case "ast", "type", "ir": r.inspect(cmd, rest)
+		default: fmt.Fprintf(os.Stderr, "unknown command ':%s', try :help\n", cmd)
+		}
+	}
+}
+
+// read returns the next input, reading more lines while its brackets are unbalanced
+func (r *repl) read() (string, bool) {
+	var sb strings.Builder
+	for {
+		if r.prompt {
+			if sb.Len() == 0 { fmt.Fprint(os.Stderr, "b> ") } else { fmt.Fprint(os.Stderr, "... ") }
+		}
+		line, err := r.stdin.ReadString('\n')
+		if line == "" && err != nil {
+			if sb.Len() == 0 { return "", false }
+			return sb.String(), true
+		}
+		sb.WriteString(line)
+		// A blank line ends an input that will never balance
+		if strings.TrimSpace(line) == "" || r.depth(sb.String()) <= 0 {
+			if strings.TrimSpace(sb.String()) == "" { sb.Reset(); continue }
+			return sb.String(), true
+		}
+	}
+}
+
+// depth counts the brackets src leaves open
+func (r *repl) depth(src string) int {
+	var toks []token.Token
+	util.Catch(io.Discard, func() { toks = r.tokenize(src, -1) })
+	depth := 0
+	for _, tok := range toks {
+		switch tok.Type {
+		case token.LParen, token.LBrace, token.LBracket: depth++
+		case token.RParen, token.RBrace, token.RBracket: depth--
+		}
+	}
+	return depth
+}
+
+func (r *repl) tokenize(src string, fileIndex int) []token.Token {
+	var toks []token.Token
+	l := lexer.NewLexer([]rune(src), fileIndex, r.cfg)
+	for {
+		tok := l.Next()
+		if tok.Type == token.EOF { return toks }
+		toks = append(toks, tok)
+	}
+}
+
+// eval runs one input, reporting whether the program called exit
+func (r *repl) eval(src string) (int, bool) {
+	u := r.parse(src)
+	if u == nil || !r.check(u, os.Stderr) { return 0, false }
+	if u.wrapper == nil {
+		if abort := util.Catch(os.Stderr, func() { r.in.Load(ast.NewBlock(u.decls[0].Tok, u.decls, true)) }); abort != nil { return 0, false }
+		r.define(u.decls)
+		return 0, false
+	}
+
+	name := u.wrapper.Data.(ast.FuncDeclNode).Name
+	if abort := util.Catch(os.Stderr, func() { r.in.Load(ast.NewBlock(u.wrapper.Tok, []*ast.Node{u.wrapper}, true)) }); abort != nil { return 0, false }
+	ret, err := r.in.Call(name)
+	switch err := err.(type) {
+	case *interp.Exit: return err.Status, true
+	case *interp.Fault:
+		if err.Msg != "" { fmt.Fprintln(os.Stderr, err) }
+		return 0, false
+	}
+	if last := u.last(); last != nil {
+		if typ := exprType(last); typ.Kind != ast.TYPE_VOID {
+			fmt.Printf("%s : %s\n", r.in.FormatValue(ret, typ), ast.TypeToString(typ))
+		}
+	}
+	return 0, false
+}
+
+// inspect implements the commands that look at an input without running it
+func (r *repl) inspect(cmd, src string) {
+	u := r.parse(src)
+	if u == nil || !r.check(u, os.Stderr) { return }
+	switch cmd {
+	case "ast":
+		if u.wrapper == nil {
+			for _, decl := range u.decls {
+				ast.Dump(os.Stdout, decl)
+			}
+			return
+		}
+		stmts := u.wrapper.Data.(ast.FuncDeclNode).Body.Data.(ast.BlockNode).Stmts
+		if u.valued { stmts = append(stmts[:len(stmts)-1:len(stmts)-1], u.last()) }
+		for _, stmt := range stmts {
+			ast.Dump(os.Stdout, stmt)
+		}
+	case "type":
+		if !u.valued {
+			fmt.Fprintln(os.Stderr, "input is not an expression")
+			return
+		}
+		fmt.Println(ast.TypeToString(exprType(u.last())))
+	case "ir":
+		nodes := u.decls
+		if u.wrapper != nil { nodes = []*ast.Node{u.wrapper} }
+		var prog *ir.Program
+		var buf bytes.Buffer
+		root := ast.NewBlock(nodes[0].Tok, append(r.kept(u), nodes...), true)
+		if abort := util.Catch(&buf, func() { prog, _ = codegen.NewContext(r.cfg).GenerateIR(root) }); abort != nil {
+			os.Stderr.Write(buf.Bytes())
+			return
+		}
+		text, err := codegen.NewQBEBackend().GenerateIR(onlyDefined(prog, declNames(nodes)), r.cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		fmt.Print(text)
+	}
+}
+
+// parse reads src as global declarations if it is made of nothing else, and as statements otherwise
+func (r *repl) parse(src string) *unit {
+	fileIndex := util.AddSourceFile(util.SourceFileRecord{Name: "<stdin>", Content: []rune(src)})
+	var toks []token.Token
+	if abort := util.Catch(os.Stderr, func() { toks = r.tokenize(src, fileIndex) }); abort != nil || len(toks) == 0 { return nil }
+	end := toks[len(toks)-1]
+	synth := func(typ token.Type, value string) token.Token {
+		return token.Token{Type: typ, Value: value, FileIndex: end.FileIndex, Line: end.Line, Column: end.Column + len(end.Value)}
+	}
+	if end.Type != token.Semi && end.Type != token.RBrace { toks = append(toks, synth(token.Semi, ";")) }
+
+	var declRoot, stmtRoot *ast.Node
+	var declOut, stmtOut bytes.Buffer
+	declErr := util.Catch(&declOut, func() { declRoot = r.newParser(append(toks, synth(token.EOF, ""))).Parse() })
+	if declErr == nil && r.allDecls(declRoot) {
+		os.Stderr.Write(declOut.Bytes())
+		return &unit{decls: declRoot.Data.(ast.BlockNode).Stmts}
+	}
+
+	r.count++
+	name := fmt.Sprintf("__repl_%d", r.count)
+	wrapped := append([]token.Token{synth(token.Ident, name), synth(token.LParen, "("), synth(token.RParen, ")"), synth(token.LBrace, "{")}, toks...)
+	wrapped = append(wrapped, synth(token.RBrace, "}"), synth(token.EOF, ""))
+	stmtErr := util.Catch(&stmtOut, func() { stmtRoot = r.newParser(wrapped).Parse() })
+	if stmtErr != nil && declErr == nil {
+		os.Stderr.Write(declOut.Bytes())
+		return &unit{decls: declRoot.Data.(ast.BlockNode).Stmts}
+	}
+	if stmtErr != nil {
+		// Report the attempt that got further
+		if declErr != nil && later(declErr.Tok, stmtErr.Tok) { os.Stderr.Write(declOut.Bytes()) } else { os.Stderr.Write(stmtOut.Bytes()) }
+		return nil
+	}
+	os.Stderr.Write(stmtOut.Bytes())
+
+	u := &unit{wrapper: stmtRoot.Data.(ast.BlockNode).Stmts[0]}
+	body := u.wrapper.Data.(ast.FuncDeclNode).Body
+	if stmts := body.Data.(ast.BlockNode).Stmts; len(stmts) > 0 && isExpr(stmts[len(stmts)-1]) {
+		last := stmts[len(stmts)-1]
+		stmts[len(stmts)-1], u.valued = ast.NewReturn(last.Tok, last), true
+	}
+	return u
+}
+
+func (r *repl) newParser(toks []token.Token) *parser.Parser {
+	p := parser.NewParser(toks, r.cfg)
+	p.DeclareTypes(ast.NewBlock(token.Token{}, r.program, true))
+	return p
+}
+
+// allDecls reports whether root holds only declarations. Some untyped definitions of B look like expressions:
+// `f(x);` is taken as a call unless a braced body follows, and `x;` or `x -1;` as uses of x once x is defined
+func (r *repl) allDecls(root *ast.Node) bool {
+	stmts := root.Data.(ast.BlockNode).Stmts
+	if len(stmts) == 0 { return false }
+	defined := declNames(r.program)
+	for _, stmt := range stmts {
+		switch stmt.Type {
+		case ast.VarDecl:
+			d := stmt.Data.(ast.VarDeclNode)
+			if defined[d.Name] && !d.IsDefine && (d.Type == nil || d.Type.Kind == ast.TYPE_UNTYPED) { return false }
+		case ast.FuncDecl:
+			d := stmt.Data.(ast.FuncDeclNode)
+			hasBlock := d.Body != nil && d.Body.Type == ast.Block && !d.Body.Data.(ast.BlockNode).IsSynthetic
+			if !hasBlock && (d.ReturnType == nil || d.ReturnType.Kind == ast.TYPE_UNTYPED) { return false }
+		case ast.MultiVarDecl, ast.TypeDecl, ast.EnumDecl, ast.ExtrnDecl, ast.Directive:
+		default: return false
+		}
+	}
+	return true
+}
+
+// check type checks an input against the program entered so far, writing its diagnostics to w
+func (r *repl) check(u *unit, w io.Writer) bool {
+	nodes := u.decls
+	if u.wrapper != nil { nodes = []*ast.Node{u.wrapper} }
+	for i, node := range nodes {
+		nodes[i] = ast.FoldConstants(node)
+	}
+	if u.wrapper != nil { u.wrapper = nodes[0] }
+	if !r.cfg.IsFeatureEnabled(config.FeatTyped) { return true }
+
+	// The program was checked as it was entered; this only rebuilds the symbols it defines
+	tc := typeChecker.NewTypeChecker(r.cfg)
+	util.Catch(io.Discard, func() { tc.Check(ast.NewBlock(token.Token{}, r.program, true)) })
+	tc.Redefine = true
+	return util.Catch(w, func() { tc.Check(ast.NewBlock(nodes[0].Tok, nodes, true)) }) == nil
+}
+
+// define records the declarations of an input, replacing earlier declarations of the same names
+func (r *repl) define(decls []*ast.Node) {
+	r.program = append(r.kept(&unit{decls: decls}), decls...)
+}
+
+// kept returns the program without the declarations that the input u replaces
+func (r *repl) kept(u *unit) []*ast.Node {
+	replaced := declNames(u.decls)
+	var kept []*ast.Node
+	for _, node := range r.program {
+		if name := declName(node); name == "" || !replaced[name] { kept = append(kept, node) }
+	}
+	return kept
+}
+
+func declName(node *ast.Node) string {
+	switch d := node.Data.(type) {
+	case ast.VarDeclNode: return d.Name
+	case ast.FuncDeclNode: return d.Name
+	case ast.TypeDeclNode: return d.Name
+	case ast.EnumDeclNode: return d.Name
+	}
+	return ""
+}
+
+func declNames(nodes []*ast.Node) map[string]bool {
+	names := make(map[string]bool)
+	for _, node := range nodes {
+		if name := declName(node); name != "" { names[name] = true }
+	}
+	return names
+}
+
+func isExpr(node *ast.Node) bool {
+	switch node.Type {
+	case ast.Number, ast.FloatNumber, ast.String, ast.Ident, ast.Nil, ast.BinaryOp, ast.UnaryOp, ast.PostfixOp,
+		ast.FuncCall, ast.Indirection, ast.AddressOf, ast.Ternary, ast.Subscript, ast.MemberAccess, ast.TypeCast,
+		ast.TypeOf, ast.StructLiteral, ast.ArrayLiteral:
+		return true
+	}
+	return false
+}
+
+func exprType(node *ast.Node) *ast.BxType {
+	if node.Typ == nil { return ast.TypeUntyped }
+	return node.Typ
+}
+
+func later(a, b token.Token) bool { return a.Line > b.Line || a.Line == b.Line && a.Column > b.Column }
+
+// onlyDefined returns the part of prog defined by the given names, with the strings its functions use
+func onlyDefined(prog *ir.Program, names map[string]bool) *ir.Program {
+	sub := *prog
+	sub.Globals, sub.Funcs, sub.Strings = nil, nil, make(map[string]string)
+	for _, g := range prog.Globals {
+		if names[g.Name] { sub.Globals = append(sub.Globals, g) }
+	}
+	used := make(map[string]bool)
+	for _, fn := range prog.Funcs {
+		if !names[fn.Name] { continue }
+		sub.Funcs = append(sub.Funcs, fn)
+		for _, block := range fn.Blocks {
+			for _, instr := range block.Instructions {
+				for _, arg := range instr.Args {
+					if g, ok := arg.(*ir.Global); ok { used[g.Name] = true }
+				}
+			}
+		}
+	}
+	for s, label := range prog.Strings {
+		if used[label] { sub.Strings[s] = label }
+	}
+	return &sub
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/xplshn/gbc/pkg/cli"
+	"github.com/xplshn/gbc/pkg/runner"
+)
+
+// runRun implements `gbc run`, running a program built for a target with no host to run it on through pkg/runner
+// Arguments after `--` are passed to the program
+func runRun(args []string) error {
+	app := cli.NewApp("gbc run")
+	app.Synopsis = "[options] <program> [-- program arguments]"
+	app.Description = "Run a program built with -t wasm, -t 6502, -t uxn or -t gb, without a WebAssembly runtime, 6502 hardware, a Uxn emulator or a Game Boy."
+	app.Authors = []string{"xplshn"}
+	app.Repository = "<https://github.com/xplshn/gbc>"
+	app.Since = 2025
+
+	var target string
+	app.FlagSet.String(&target, "target", "t", "", "The backend the program was built with (wasm, 6502, uxn, gb); guessed from its contents, or a .rom extension for uxn, if not given.", "backend")
+
+	var programArgs []string
+	for i, a := range args {
+		if a == "--" {
+			args, programArgs = args[:i], args[i+1:]
+			break
+		}
+	}
+
+	app.Action = func(files []string) error {
+		if len(files) != 1 { return fmt.Errorf("expected one program to run") }
+		status, err := runner.Run(target, files[0], programArgs)
+		if err != nil { return err }
+		os.Exit(status)
+		return nil
+	}
+	return app.Run(args)
+}
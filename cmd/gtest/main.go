@@ -22,6 +22,7 @@ import (
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/google/go-cmp/cmp"
+	"github.com/xplshn/gbc/pkg/runner"
 )
 
 type Execution struct {
@@ -60,6 +61,7 @@ type TestSuiteResults map[string]*FileTestResult
 var (
 	refCompiler    = flag.String("ref-compiler", "b", "Path to the reference compiler.")
 	refArgs        = flag.String("ref-args", "", "Arguments for the reference compiler (space-separated).")
+	refInterp      = flag.String("ref-interp", "", "Path to a gbc whose AST interpreter (`gbc interp`) is used as the reference instead of a compiler.")
 	targetCompiler = flag.String("target-compiler", "./gbc", "Path to the target compiler to test.")
 	targetArgs     = flag.String("target-args", "", "Arguments for the target compiler (space-separated).")
 	generateGolden = flag.String("generate-golden", "", "Generate a golden .json file for a given source file.")
@@ -85,7 +87,30 @@ const (
 	cNone    = "\x1b[0m"
 )
 
+// runWasmFlag re-executes gtest as the runtime of a WebAssembly module: gtest -run-wasm <module> -- <args>
+const runWasmFlag = "-run-wasm"
+
+// run6502Flag re-executes gtest as the emulator of a raw 6502 image: gtest -run-6502 <image> -- <args>
+const run6502Flag = "-run-6502"
+
+// runUxnFlag re-executes gtest as the emulator of a Uxn ROM: gtest -run-uxn <rom> -- <args>
+const runUxnFlag = "-run-uxn"
+
+// runGBFlag re-executes gtest as the emulator of a Game Boy ROM: gtest -run-gb <rom> -- <args>
+const runGBFlag = "-run-gb"
+
 func main() {
+	if len(os.Args) > 2 && (os.Args[1] == runWasmFlag || os.Args[1] == run6502Flag || os.Args[1] == runUxnFlag || os.Args[1] == runGBFlag) {
+		args := os.Args[3:]
+		if len(args) > 0 && args[0] == "--" { args = args[1:] }
+		// Each flag names the target of pkg/runner after its -run- prefix
+		status, err := runner.Run(strings.TrimPrefix(os.Args[1], "-run-"), os.Args[2], args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gtest: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(status)
+	}
 	flag.Parse()
 	log.SetFlags(0)
 
@@ -178,7 +203,7 @@ func handleGenerateGolden(sourceFile, tempDir string) {
 func handleRunTestSuite(tempDir string) {
 	_, err := exec.LookPath(*refCompiler)
 	refCompilerFound := err == nil
-	if !refCompilerFound && !*useCache {
+	if !refCompilerFound && !*useCache && *refInterp == "" {
 		log.Printf("%s[WARN]%s Reference compiler '%s' not found. Will rely on golden files. Use --cached to suppress this warning.\n", cYellow, cNone, *refCompiler)
 	}
 
@@ -204,8 +229,13 @@ func handleRunTestSuite(tempDir string) {
 		}
 	}
 
+	// The test files are absolute paths, so the files to skip are expanded the same way
+	skipped, err := expandGlobPatterns(*skipFiles)
+	if err != nil {
+		log.Fatalf("%s[ERROR]%s Invalid glob pattern(s): %v\n", cRed, cNone, err)
+	}
 	skipList := make(map[string]bool)
-	for _, f := range strings.Fields(*skipFiles) {
+	for _, f := range skipped {
 		skipList[f] = true
 	}
 
@@ -274,6 +304,11 @@ func testFile(file, tempDir, fileHash string, refCompilerFound bool, previousRes
 	_, err := os.Stat(goldenFile)
 	hasGoldenFile := err == nil
 
+	// An interpreter reference was asked for explicitly, and it runs any source file
+	if *refInterp != "" {
+		return testWithReferenceCompiler(file, tempDir, fileHash)
+	}
+
 	// 1st try: Use golden file if --cached is set or for non-standard extensions
 	if (*useCache && hasGoldenFile) || !strings.HasSuffix(file, ".b") {
 		if hasGoldenFile {
@@ -349,7 +384,11 @@ func testWithReferenceCompiler(file, tempDir, fileHash string) *FileTestResult {
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		refResult, refErr = compileAndRun(*refCompiler, strings.Fields(*refArgs), file, tempDir, "ref-"+fileHash)
+		if *refInterp != "" {
+			refResult, refErr = interpretAndRun(*refInterp, strings.Fields(*refArgs), file)
+		} else {
+			refResult, refErr = compileAndRun(*refCompiler, strings.Fields(*refArgs), file, tempDir, "ref-"+fileHash)
+		}
 	}()
 	go func() {
 		defer wg.Done()
@@ -539,10 +578,71 @@ func compileAndRun(compiler string, compilerArgs []string, sourceFile, tempDir,
 		return &TargetResult{Compile: compileResult}, fmt.Errorf("compilation succeeded but binary was not created at %s", binaryPath)
 	}
 
+	// A raw 6502 image or a Uxn ROM has no header to tell it apart, so it is recognised by the arguments that built it
+	target := targetBackend(compilerArgs)
+	if image, err := os.ReadFile(binaryPath); err == nil {
+		if guess := runner.Guess(binaryPath, image); guess == "wasm" || guess == "gb" { target = guess }
+	}
+	runFlag := map[string]string{"wasm": runWasmFlag, "6502": run6502Flag, "uxn": runUxnFlag, "gb": runGBFlag}[target]
+	if runFlag != "" {
+		self, err := os.Executable()
+		if err != nil {
+			return &TargetResult{Compile: compileResult}, fmt.Errorf("cannot find gtest to run the program: %v", err)
+		}
+		runResults := runTestCases(self, []string{runFlag, binaryPath, "--"})
+		for i := range runResults {
+			// A trap stands for the signal that would kill a native program
+			if code := runResults[i].Result.ExitCode; code > 128 && code < 160 {
+				runResults[i].Result.ExitCode = -1
+			}
+		}
+		return &TargetResult{Compile: compileResult, Runs: runResults, BinaryPath: binaryPath}, nil
+	}
+
+	runResults := runTestCases(binaryPath, nil)
+	return &TargetResult{Compile: compileResult, Runs: runResults, BinaryPath: binaryPath}, nil
+}
+
+// targetBackend is the backend compiler arguments select with -t, or "" if they leave it to the compiler
+func targetBackend(args []string) string {
+	backend := ""
+	for i, a := range args {
+		switch {
+		case (a == "-t" || a == "--target") && i+1 < len(args): backend = args[i+1]
+		case strings.HasPrefix(a, "--target="): backend = strings.TrimPrefix(a, "--target=")
+		case strings.HasPrefix(a, "-t=") || strings.HasPrefix(a, "-t") && len(a) > 2 && a[2] != '-': backend = strings.TrimPrefix(strings.TrimPrefix(a, "-t"), "=")
+		}
+	}
+	// -t takes a backend/target pair
+	backend, _, _ = strings.Cut(backend, "/")
+	return backend
+}
+
+// interpretAndRun runs the test cases of sourceFile on the AST interpreter of gbc instead of a compiled binary
+// The interpreter parses the program on every run, so a program that does not compile fails each run instead
+func interpretAndRun(gbc string, gbcArgs []string, sourceFile string) (*TargetResult, error) {
+	prefix := append([]string{"interp", "-w"}, gbcArgs...)
+	prefix = append(prefix, sourceFile, "--")
+	if _, err := exec.LookPath(gbc); err != nil {
+		return &TargetResult{}, fmt.Errorf("interpreter '%s' not found: %v", gbc, err)
+	}
+
+	runResults := runTestCases(gbc, prefix)
+	for i := range runResults {
+		// The interpreter exits with 128+signal where a compiled program would be killed by the signal
+		if code := runResults[i].Result.ExitCode; code > 128 && code < 160 {
+			runResults[i].Result.ExitCode = -1
+		}
+	}
+	return &TargetResult{Runs: runResults}, nil
+}
+
+// runTestCases runs command, followed by prefixArgs and the arguments of each test case, and records the results
+func runTestCases(command string, prefixArgs []string) []TestRun {
 	// Quick test: does this program expect stdin?
 	probeCtx, probeCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer probeCancel()
-	probeResult := executeCommand(probeCtx, binaryPath, "")
+	probeResult := executeCommand(probeCtx, command, "", prefixArgs...)
 	readsStdin := probeResult.TimedOut
 
 	testCases := map[string][]string{
@@ -587,7 +687,7 @@ func compileAndRun(compiler string, compilerArgs []string, sourceFile, tempDir,
 
 		for i := 0; i < *runs; i++ {
 			runCtx, runCancel := context.WithTimeout(context.Background(), *timeout)
-			runResult := executeCommand(runCtx, binaryPath, inputData, args...)
+			runResult := executeCommand(runCtx, command, inputData, append(prefixArgs[:len(prefixArgs):len(prefixArgs)], args...)...)
 			runCancel()
 
 			if i == 0 {
@@ -627,7 +727,7 @@ func compileAndRun(compiler string, compilerArgs []string, sourceFile, tempDir,
 		}
 	}
 
-	return &TargetResult{Compile: compileResult, Runs: runResults, BinaryPath: binaryPath}, nil
+	return runResults
 }
 
 // Remove lines containing any of these substrings
@@ -115,20 +115,17 @@ _urem(a, b) {
 }
 
 printn(n, b, sign) {
-    auto a, c, d, __div, __rem;
-
-    /* use correct div/rem based on sign */
-    __div = sign ? &_div : &_udiv;
-    __rem = sign ? &_rem : &_urem;
+    auto a, c, d;
 
     if (sign & n < 0) {
         putchar('-');
         n = -n;
     }
 
-    if(a=__div(n, b)) /* assignment, not test for equality */
+    /* use correct div/rem based on sign */
+    if(a=(sign ? _div(n, b) : _udiv(n, b))) /* assignment, not test for equality */
         printn(a, b, 0); /* recursive */
-    c = __rem(n,b) + '0';
+    c = (sign ? _rem(n, b) : _urem(n, b)) + '0';
     if (c > '9') c += 7;
     putchar(c);
 }
@@ -44,6 +44,10 @@ fputc(c, fd) {
     putchar(c);
 }
 
+/* output is not buffered */
+fflush(fd) {
+}
+
 /* TODO: actually allocate something */
 __heap_ptr 0x0200;
 malloc(size) {
@@ -115,20 +119,17 @@ _urem(a, b) {
 }
 
 printn(n, b, sign) {
-    auto a, c, d, __div, __rem;
-
-    /* use correct div/rem based on sign */
-    __div = sign ? &_div : &_udiv;
-    __rem = sign ? &_rem : &_urem;
+    auto a, c, d;
 
     if (sign & n < 0) {
         putchar('-');
         n = -n;
     }
 
-    if(a=__div(n, b)) /* assignment, not test for equality */
+    /* use correct div/rem based on sign */
+    if(a=(sign ? _div(n, b) : _udiv(n, b))) /* assignment, not test for equality */
         printn(a, b, 0); /* recursive */
-    c = __rem(n,b) + '0';
+    c = (sign ? _rem(n, b) : _urem(n, b)) + '0';
     if (c > '9') c += 7;
     putchar(c);
 }
@@ -181,6 +182,11 @@ printf(str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12, x13, x14, x15) {
     }
 }
 
+/* TODO: fd not supported */
+dprintf(fd, str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12, x13, x14) {
+    printf(str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12, x13, x14);
+}
+
 strlen(s) {
     auto n;
     n = 0;
@@ -0,0 +1,181 @@
+/* Standard Library for the Game Boy target */
+
+/*
+Arguments are on the stack from SP+2, the first at the lowest address,
+and the result goes in HL; putchar, getchar and exit are in the runtime
+of the gb backend, which also draws the console.
+*/
+
+putchar __asm__("JP __putchar");
+getchar __asm__("JP __getchar");
+exit __asm__("JP __exit");
+
+/*
+ch = char(string, i);
+returns the ith character in a string pointed to by string, 0 based
+*/
+
+char __asm__(
+    "LD HL,SP+2",
+    "LD A,(HL+)", "LD E,A",
+    "LD A,(HL+)", "LD D,A", /* DE = string */
+    "LD A,(HL+)",
+    "LD H,(HL)", "LD L,A",  /* HL = i */
+    "ADD HL,DE",
+    "LD L,(HL)",
+    "LD H,0",
+    "RET"
+);
+
+/*
+ch = lchar(string, i, char);
+replaces the ith character in the string pointed to by string with the character char.
+*/
+
+lchar __asm__(
+    "LD HL,SP+2",
+    "LD A,(HL+)", "LD E,A",
+    "LD A,(HL+)", "LD D,A", /* DE = string */
+    "LD A,(HL+)", "LD C,A",
+    "LD A,(HL+)", "LD B,A", /* BC = i */
+    "LD A,(HL)",            /* char */
+    "LD H,B", "LD L,C",
+    "ADD HL,DE",
+    "LD (HL),A",
+    "LD L,A", "LD H,0",
+    "RET"
+);
+
+fputc(c, fd) {
+    putchar(c);
+}
+
+/* output is not buffered */
+fflush(fd) {
+}
+
+abort() {
+    printf("Aborted\n");
+    exit(1);
+}
+
+/* loosely based on the original code by Ken Thompson */
+
+printn(n, b) {
+    auto a, c;
+
+    if (a = n / b) /* assignment, not test for equality */
+        printn(a, b); /* recursive */
+    c = n % b + '0';
+    if (c > '9') c += 7;
+    putchar(c);
+}
+
+_printu(n, b) {
+    auto c;
+
+    /* halve first, so that no division sees the sign bit */
+    if (n < 0) {
+        printn((n >> 1) / (b >> 1), b);
+        c = (n >> 1) % (b >> 1) * 2 + '0';
+        if (n & 1) c++;
+        if (c > '9') c += 7;
+        putchar(c);
+        return;
+    }
+    printn(n, b);
+}
+
+printf(str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12) {
+    auto i, j, c, arg;
+    i = 0;
+    j = 0;
+    c = char(str, i);
+    arg = &x1;
+    while (c != 0) {
+        if (c == '%') {
+            i += 1;
+            c = char(str, i);
+            while (c == 'l' | c == 'z') { /* length modifiers: every argument is a word */
+                i += 1;
+                c = char(str, i);
+            }
+            if (c == 0) {
+                return;
+            } else if (c == 'd') {
+                if (*arg < 0) {
+                    putchar('-');
+                    _printu(-*arg, 10);
+                } else {
+                    printn(*arg, 10);
+                }
+            } else if (c == 'u') {
+                _printu(*arg, 10);
+            } else if (c == 'x') {
+                _printu(*arg, 16);
+            } else if (c == 'o') {
+                _printu(*arg, 8);
+            } else if (c == 'p') {
+                putchar('$');
+                _printu(*arg, 16);
+            } else if (c == 'c') {
+                putchar(*arg);
+            } else if (c == 's') { /* clobbers `c`, the last one */
+                while (c = char(*arg, j++)) {
+                    putchar(c);
+                }
+            } else {
+                putchar('%');
+                arg += 2; /* word size */
+            }
+            arg -= 2; /* word size */
+        } else {
+            putchar(c);
+        }
+        i += 1;
+        c = char(str, i);
+    }
+}
+
+/* there is only the one console */
+dprintf(fd, str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11) {
+    printf(str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11);
+}
+
+/* simple bump allocator, from the end of the data the runtime copies to WRAM */
+
+__heap_ptr;
+
+malloc(size) {
+    extrn __heap;
+    auto ptr;
+    if (__heap_ptr == 0) __heap_ptr = &__heap;
+    ptr = __heap_ptr;
+    __heap_ptr += size;
+    return (ptr);
+}
+
+realloc(ptr, size) {
+    return (malloc(size));
+}
+
+memset(addr, val, size) {
+    auto i;
+    i = 0;
+    while (i < size) {
+        lchar(addr, i, val);
+        i += 1;
+    }
+}
+
+strlen(s) {
+    auto n;
+    n = 0;
+    while (char(s, n)) n++;
+    return (n);
+}
+
+toupper(c) {
+    if ('a' <= c & c <= 'z') return (c - 'a' + 'A');
+    return (c);
+}
@@ -158,16 +158,16 @@ printn(n, b) _fprintn(n, b, 0);
 
 /* TODO: Consider adding support for negative numbers to Uxn's printf. */
 /* TODO: Consider adding support for %ul to Uxn's printf. */
-fprintf(fd, string, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12) {
+fprintf(fd, str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12) {
     auto i, j, c, arg;
     i = 0;
     j = 0;
-    c = char(string, i);
+    c = char(str, i);
     arg = &x1;
     while (c != 0) {
         if (c == '%') {
             i += 1;
-            c = char(string, i);
+            c = char(str, i);
             if (c == 0) {
                 return;
             } else if (c == 'x') {
@@ -200,13 +200,22 @@ fprintf(fd, string, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12) {
             fputc(c, fd);
         }
         i += 1;
-        c = char(string, i);
+        c = char(str, i);
         continue:;
     }
 }
 
-printf(string, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12) {
-    fprintf(0, string, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12);
+printf(str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12) {
+    fprintf(0, str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12);
+}
+
+/* takes a POSIX descriptor: 2 goes to Console/error, anything else to Console/write */
+dprintf(fd, str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11) {
+    fprintf(fd == 2, str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11);
+}
+
+/* output is not buffered */
+fflush(fd) {
 }
 
 // TODO: doesn't skip whitespace, doesn't handle negative numbers
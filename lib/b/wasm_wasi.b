@@ -0,0 +1,446 @@
+/* libb for WebAssembly under WASI
+   The module itself provides putchar, getchar, exit, read(fd, buf, n),
+   write(fd, buf, n) and sbrk(n); the rest is built here on __exit, __write
+   and __sbrk, their copies a program cannot replace by defining its own */
+
+extrn __exit;
+extrn __write;
+extrn __sbrk;
+
+char(s, i) {
+    auto p, sh;
+    p = s + i;
+    sh = (p & 7) * 8;
+    p = *(p & -8);
+    return ((p >> sh) & 0377);
+}
+
+lchar(s, i, c) {
+    auto p, w, sh, m;
+    p = s + i;
+    w = p & -8;
+    sh = (p & 7) * 8;
+    m = 0377 << sh;
+    p = *w;
+    p = p & ~m;
+    m = c & 0377;
+    *w = p | m << sh;
+    return (c);
+}
+
+sx64(x) {
+    return ((x & 0xFFFFFFFF) - ((x & 0x80000000) << 1));
+}
+
+abort() {
+    __exit(134);
+}
+
+/* printf writes nothing it leaves buffered, so there is nothing to flush */
+fflush(fd) {
+    return (0);
+}
+
+/* Formatted output goes through __emit, either to the buffer __out written
+   to __outfd or, for sprintf, into the string __outs */
+__out[64];
+__outn;
+__outfd;
+__outs;
+__count;
+
+/* Each conversion is built in __fld and then padded to its width */
+__fld[256];
+__fl;
+
+__emit(c) {
+    __count++;
+    if (__outs) {
+        lchar(__outs, __outn++, c);
+        return;
+    }
+    lchar(__out, __outn++, c);
+    if (__outn == 512) __flush();
+}
+
+__flush() {
+    if (__outn) __write(__outfd, __out, __outn);
+    __outn = 0;
+}
+
+__put(c) {
+    if (__fl < 2047) lchar(__fld, __fl++, c);
+}
+
+__field(width, left, zero) {
+    auto i, pad;
+    i = 0;
+    pad = width - __fl;
+    if (!left & zero & __fl > 0) {
+        if (char(__fld, 0) == '-') {
+            __emit('-');
+            i = 1;
+        }
+    }
+    if (!left) while (pad-- > 0) __emit(zero ? '0' : ' ');
+    while (i < __fl) __emit(char(__fld, i++));
+    while (pad-- > 0) __emit(' ');
+}
+
+/* __itoa converts n in base, dividing it as unsigned unless it is signed */
+__itoa(n, base, upper, sgn, prec) {
+    auto d 66, k, q, r, c;
+    if (sgn) if (n < 0) {
+        __put('-');
+        n = -n;
+    }
+    k = 0;
+    while (n != 0 | k == 0) {
+        if (base & 1) {
+            r = n % base;
+            q = n / base;
+        } else {
+            /* halved first, so that no division sees the sign bit */
+            r = (n >> 1) % (base >> 1) * 2;
+            if (n & 1) r++;
+            q = (n >> 1) / (base >> 1);
+        }
+        d[k++] = r;
+        n = q;
+    }
+    while (k < prec & k < 64) d[k++] = 0;
+    while (k) {
+        c = d[--k];
+        __put(c < 10 ? '0' + c : (upper ? 'A' : 'a') + c - 10);
+    }
+}
+
+/* __ftoa writes the double whose bits are x with prec decimals, exactly and
+   rounding half to even, as a decimal expansion of its mantissa and exponent */
+__ftoa(x, prec) {
+    auto m, e, k, i, n, c, up, rest, frac 1080, nf, ip 320, ni;
+    if (x < 0) __put('-');
+    e = (x >> 52) & 03777;
+    m = x & 0xFFFFFFFFFFFFF;
+    if (e == 03777) {
+        if (m) {
+            __put('n'); __put('a'); __put('n');
+        } else {
+            __put('i'); __put('n'); __put('f');
+        }
+        return;
+    }
+    if (e == 0) e = 1; else m = m | 1 << 52;
+    e -= 1075;
+    if (prec > 1700) prec = 1700;
+
+    /* The integer part, in decimal digits from the lowest */
+    k = 0;
+    n = m;
+    if (e < 0) {
+        k = -e;
+        n = k < 53 ? m >> k : 0;
+        m = k < 53 ? m - (n << k) : m;
+    }
+    ni = 0;
+    while (n != 0 | ni == 0) {
+        ip[ni++] = n % 10;
+        n = n / 10;
+    }
+    i = e;
+    while (i-- > 0) {
+        c = 0;
+        n = 0;
+        while (n < ni) {
+            c = ip[n] * 2 + c;
+            ip[n++] = c % 10;
+            c = c / 10;
+        }
+        if (c) ip[ni++] = c;
+    }
+
+    /* The fraction m / 2^k is m * 5^k / 10^k: its k digits, from the highest */
+    nf = 0;
+    if (k) {
+        while (m) {
+            frac[nf++] = m % 10;
+            m = m / 10;
+        }
+        i = k;
+        while (i-- > 0) {
+            c = 0;
+            n = 0;
+            while (n < nf) {
+                c = frac[n] * 5 + c;
+                frac[n++] = c % 10;
+                c = c / 10;
+            }
+            while (c) {
+                frac[nf++] = c % 10;
+                c = c / 10;
+            }
+        }
+        while (nf < k) frac[nf++] = 0;
+        i = 0;
+        while (i < nf / 2) {
+            c = frac[i];
+            frac[i] = frac[nf - 1 - i];
+            frac[nf - 1 - i] = c;
+            i++;
+        }
+    }
+
+    if (prec < nf) {
+        rest = 0;
+        i = prec + 1;
+        while (i < nf) if (frac[i++]) rest = 1;
+        c = prec > 0 ? frac[prec - 1] : ip[0];
+        up = frac[prec] > 5 | frac[prec] == 5 & (rest | c & 1);
+        i = prec - 1;
+        while (up & i >= 0) {
+            if (++frac[i] == 10) frac[i--] = 0; else up = 0;
+        }
+        i = 0;
+        while (up) {
+            if (i == ni) ip[ni++] = 0;
+            if (++ip[i] == 10) ip[i++] = 0; else up = 0;
+        }
+    }
+
+    while (ni) __put('0' + ip[--ni]);
+    if (prec > 0) __put('.');
+    i = 0;
+    while (i < prec) {
+        __put(i < nf ? '0' + frac[i] : '0');
+        i++;
+    }
+}
+
+/* __vprintf formats with the arguments from argp down, as the parameters
+   after the format are laid out */
+__vprintf(fmt, argp) {
+    auto i, c, s, n, left, zero, width, prec, long, arg;
+    __count = 0;
+    i = 0;
+    while (c = char(fmt, i++)) {
+        if (c != '%') {
+            __emit(c);
+        } else {
+            left = 0;
+            zero = 0;
+            c = char(fmt, i);
+            while (c == '-' | c == '0' | c == '+' | c == ' ' | c == '#') {
+                if (c == '-') left = 1;
+                if (c == '0') zero = 1;
+                c = char(fmt, ++i);
+            }
+            width = 0;
+            if (c == '*') {
+                width = *argp;
+                argp -= 8;
+                if (width < 0) {
+                    left = 1;
+                    width = -width;
+                }
+                c = char(fmt, ++i);
+            } else while (c >= '0' & c <= '9') {
+                width = width * 10 + c - '0';
+                c = char(fmt, ++i);
+            }
+            prec = -1;
+            if (c == '.') {
+                prec = 0;
+                c = char(fmt, ++i);
+                if (c == '*') {
+                    prec = *argp;
+                    argp -= 8;
+                    c = char(fmt, ++i);
+                } else while (c >= '0' & c <= '9') {
+                    prec = prec * 10 + c - '0';
+                    c = char(fmt, ++i);
+                }
+            }
+            /* Without a length, integers are ints of 32 bits as with libc */
+            long = 0;
+            while (c == 'h' | c == 'l' | c == 'L' | c == 'q' | c == 'z' | c == 'j' | c == 't') {
+                if (c != 'h') long = 1;
+                c = char(fmt, ++i);
+            }
+            if (c == 0) return (__count);
+            i++;
+
+            __fl = 0;
+            if (c == '%') {
+                __emit('%');
+            } else {
+                arg = *argp;
+                argp -= 8;
+                if (!long) {
+                    if (c == 'd' | c == 'i') arg = sx64(arg);
+                    else if (c == 'u' | c == 'x' | c == 'X' | c == 'o' | c == 'b') arg = arg & 0xFFFFFFFF;
+                }
+                if (c == 'd' | c == 'i') {
+                    __itoa(arg, 10, 0, 1, prec);
+                } else if (c == 'u') {
+                    __itoa(arg, 10, 0, 0, prec);
+                } else if (c == 'x' | c == 'X') {
+                    __itoa(arg, 16, c == 'X', 0, prec);
+                } else if (c == 'o') {
+                    __itoa(arg, 8, 0, 0, prec);
+                } else if (c == 'b') {
+                    __itoa(arg, 2, 0, 0, prec);
+                } else if (c == 'p') {
+                    if (arg) {
+                        __put('0');
+                        __put('x');
+                        __itoa(arg, 16, 0, 0, -1);
+                    } else {
+                        s = "(nil)";
+                        n = 0;
+                        while (char(s, n)) __put(char(s, n++));
+                    }
+                } else if (c == 'c') {
+                    __put(arg);
+                } else if (c == 's') {
+                    if (arg == 0) arg = "(null)";
+                    n = 0;
+                    while ((prec < 0 | n < prec) & (s = char(arg, n)) != 0) {
+                        __put(s);
+                        n++;
+                    }
+                    zero = 0;
+                } else if (c == 'f' | c == 'F') {
+                    __ftoa(arg, prec < 0 ? 6 : prec);
+                } else {
+                    __put('%');
+                    __put(c);
+                    argp += 8;
+                }
+                __field(width, left, zero);
+            }
+        }
+    }
+    return (__count);
+}
+
+printf(fmt, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12, x13, x14, x15) {
+    auto n;
+    __outfd = 1;
+    n = __vprintf(fmt, &x1);
+    __flush();
+    return (n);
+}
+
+dprintf(fd, fmt, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12, x13, x14) {
+    auto n;
+    __outfd = fd;
+    n = __vprintf(fmt, &x1);
+    __flush();
+    return (n);
+}
+
+sprintf(buf, fmt, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12, x13, x14) {
+    auto n;
+    __outs = buf;
+    __outn = 0;
+    n = __vprintf(fmt, &x1);
+    lchar(buf, __outn, 0);
+    __outs = 0;
+    __outn = 0;
+    return (n);
+}
+
+printn(n, b) {
+    __fl = 0;
+    __itoa(n, b, 0, 1, -1);
+    __write(1, __fld, __fl);
+}
+
+puts(s) {
+    __write(1, s, strlen(s));
+    __write(1, "\n", 1);
+    return (0);
+}
+
+strlen(s) {
+    auto n;
+    n = 0;
+    while (char(s, n)) n++;
+    return (n);
+}
+
+strcmp(a, b) {
+    auto i, c;
+    i = 0;
+    while ((c = char(a, i)) == char(b, i)) {
+        if (c == 0) return (0);
+        i++;
+    }
+    return (c - char(b, i));
+}
+
+strcpy(dst, src) {
+    auto i;
+    i = 0;
+    while (lchar(dst, i, char(src, i))) i++;
+    return (dst);
+}
+
+atoi(s) {
+    auto i, n, neg, c;
+    i = 0;
+    n = 0;
+    neg = 0;
+    while ((c = char(s, i)) == ' ' | c == '\t' | c == '\n') i++;
+    if (c == '-' | c == '+') {
+        neg = c == '-';
+        i++;
+    }
+    while ((c = char(s, i++)) >= '0' & c <= '9') n = n * 10 + c - '0';
+    return (neg ? -n : n);
+}
+
+memset(p, c, n) {
+    auto i;
+    i = 0;
+    while (i < n) lchar(p, i++, c);
+    return (p);
+}
+
+memcpy(dst, src, n) {
+    auto i;
+    i = 0;
+    while (i < n) {
+        lchar(dst, i, char(src, i));
+        i++;
+    }
+    return (dst);
+}
+
+memmove(dst, src, n) {
+    if (dst < src) return (memcpy(dst, src, n));
+    while (n-- > 0) lchar(dst, n, char(src, n));
+    return (dst);
+}
+
+/* Blocks keep their size in the word before them, and are never reused */
+malloc(n) {
+    auto p;
+    p = __sbrk(n + 8);
+    if (p == -1) return (0);
+    *p = n;
+    return (p + 8);
+}
+
+realloc(p, n) {
+    auto q, old;
+    q = malloc(n);
+    if (q == 0 | p == 0) return (q);
+    old = *(p - 8);
+    memcpy(q, p, old < n ? old : n);
+    return (q);
+}
+
+free(p) {
+    return (0);
+}
@@ -0,0 +1,222 @@
+/* libb for x86-64 Linux without libc
+
+Link with -lnolibc instead of -lb to get a program that needs nothing but
+the kernel: gbc assembles and links it itself, into a static executable.
+Everything below goes through the system calls, made by syscall(n, ...). */
+
+/* The kernel enters here with argc at the top of the stack and argv after it */
+_start __asm__(
+    "movq (%rsp), %rdi",
+    "leaq 8(%rsp), %rsi",
+    "andq $-16, %rsp",
+    "callq main",
+    "movq %rax, %rdi",
+    "movl $231, %eax", /* exit_group */
+    "syscall",
+    "hlt"
+);
+
+/* r = syscall(n, a1, a2, a3, a4, a5, a6); a negative r is -errno */
+syscall __asm__(
+    "movq %rdi, %rax",
+    "movq %rsi, %rdi",
+    "movq %rdx, %rsi",
+    "movq %rcx, %rdx",
+    "movq %r8, %r10",
+    "movq %r9, %r8",
+    "movq 8(%rsp), %r9",
+    "syscall",
+    "ret"
+);
+
+sx64 __asm__("movslq %edi, %rax", "ret");
+char  __asm__("xorq %rax, %rax", "movb (%rdi, %rsi), %al", "ret");
+lchar __asm__("movb %dl, (%rdi, %rsi)", "ret");
+
+exit(code) {
+    syscall(231, code);
+}
+
+abort() {
+    printf("Aborted\n");
+    exit(134);
+}
+
+read(fd, buf, n) {
+    return (syscall(0, fd, buf, n));
+}
+
+write(fd, buf, n) {
+    return (syscall(1, fd, buf, n));
+}
+
+putchar(c) {
+    write(1, &c, 1);
+    return (c);
+}
+
+fputc(c, fd) {
+    write(fd, &c, 1);
+    return (c);
+}
+
+/* output is not buffered */
+fflush(fd) {
+    return (0);
+}
+
+/* returns -1 at the end of the input, like getchar of libc */
+getchar() {
+    auto c;
+    c = 0;
+    if (read(0, &c, 1) <= 0) return (-1);
+    return (c);
+}
+
+/* The formatted output below goes to __outfd: the standard output, but for dprintf */
+__outfd 1;
+
+/* loosely based on the original code by Ken Thompson */
+
+printn(n, b) {
+    auto a, c;
+
+    if (a = n / b) /* assignment, not test for equality */
+        printn(a, b); /* recursive */
+    c = n % b + '0';
+    if (c > '9') c += 7;
+    fputc(c, __outfd);
+}
+
+_printu(n, b) {
+    auto c;
+
+    /* halve first, so that no division sees the sign bit */
+    if (n < 0) {
+        printn((n >> 1) / (b >> 1), b);
+        c = (n >> 1) % (b >> 1) * 2 + '0';
+        if (n & 1) c++;
+        if (c > '9') c += 7;
+        fputc(c, __outfd);
+        return;
+    }
+    printn(n, b);
+}
+
+printf(str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11, x12) {
+    auto i, j, c, arg;
+    i = 0;
+    j = 0;
+    c = char(str, i);
+    arg = &x1;
+    while (c != 0) {
+        if (c == '%') {
+            i += 1;
+            c = char(str, i);
+            while (c == 'l' | c == 'z') { /* length modifiers: every argument is a word */
+                i += 1;
+                c = char(str, i);
+            }
+            if (c == 0) {
+                return;
+            } else if (c == 'd') {
+                if (*arg < 0) {
+                    fputc('-', __outfd);
+                    _printu(-*arg, 10);
+                } else {
+                    printn(*arg, 10);
+                }
+            } else if (c == 'u') {
+                _printu(*arg, 10);
+            } else if (c == 'x') {
+                _printu(*arg, 16);
+            } else if (c == 'o') {
+                _printu(*arg, 8);
+            } else if (c == 'p') {
+                fputc('$', __outfd);
+                _printu(*arg, 16);
+            } else if (c == 'c') {
+                fputc(*arg, __outfd);
+            } else if (c == 's') { /* clobbers `c`, the last one */
+                j = 0;
+                while (c = char(*arg, j++)) {
+                    fputc(c, __outfd);
+                }
+            } else {
+                fputc('%', __outfd);
+                arg += 8; /* word size */
+            }
+            arg -= 8; /* word size */
+        } else {
+            fputc(c, __outfd);
+        }
+        i += 1;
+        c = char(str, i);
+    }
+}
+
+dprintf(fd, str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11) {
+    __outfd = fd;
+    printf(str, x1, x2, x3, x4, x5, x6, x7, x8, x9, x10, x11);
+    __outfd = 1;
+}
+
+/* A bump allocator on brk; each block starts with its size, for realloc */
+
+__brk;
+
+malloc(size) {
+    auto p, end;
+    if (__brk == 0) __brk = syscall(12, 0);
+    size = (size + 15) & -8;
+    p = __brk;
+    end = syscall(12, p + size);
+    if (end == p) return (0); /* brk gives back the old break when it fails */
+    __brk = end;
+    *p = size - 8;
+    return (p + 8);
+}
+
+free(ptr) {
+}
+
+realloc(ptr, size) {
+    auto new, old;
+    new = malloc(size);
+    if (ptr == 0 | new == 0) return (new);
+    old = *(ptr - 8);
+    memcpy(new, ptr, old < size ? old : size);
+    return (new);
+}
+
+memset(addr, val, size) {
+    auto i;
+    i = 0;
+    while (i < size) {
+        lchar(addr, i, val);
+        i += 1;
+    }
+    return (addr);
+}
+
+memcpy(dst, src, size) {
+    auto i;
+    i = 0;
+    while (i < size) {
+        lchar(dst, i, char(src, i));
+        i += 1;
+    }
+    return (dst);
+}
+
+strlen(s) {
+    auto n;
+    n = 0;
+    while (char(s, n)) n++;
+    return (n);
+}
+
+toupper(c) {
+    if ('a' <= c & c <= 'z') return (c - 'a' + 'A');
+    return (c);
+}
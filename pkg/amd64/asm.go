@@ -0,0 +1,616 @@
+// Package amd64 assembles x86-64 in the AT&T syntax of the GNU assembler into ELF relocatable objects: the subset
+// of it that QBE emits, and what `__asm__` functions usually hold
+package amd64
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/elf"
+)
+
+// expr is the value of an operand or of data: a symbol, if any, plus a constant
+type expr struct {
+	sym string
+	off int64
+}
+
+// fixup is a field of a statement's bytes that holds the value of an expression, filled in once the symbols are
+// known; for a pc-relative one, off is already made relative to the end of the instruction
+type fixup struct {
+	at   int
+	size int
+	typ  uint32
+	val  expr
+}
+
+// branch is a jump to a label, short when the label is close enough in the same section
+type branch struct {
+	cc     int // -1 for jmp
+	target expr
+	long   bool
+}
+
+// stmt is one statement of the source: a label, or the bytes of an instruction or of data, already encoded but for
+// the fixups, a relaxed branch or the padding of an alignment
+type stmt struct {
+	line   int
+	sec    *section
+	label  string
+	bytes  []byte
+	fixups []fixup
+	branch *branch
+	align  int
+	size   *sizeDirective
+	addr   int
+}
+
+type sizeDirective struct {
+	sym   string
+	start string // the label the size is counted from, for `.size sym, .-start`
+	value int64
+}
+
+type section struct {
+	*elf.Section
+	pc int
+}
+
+type label struct {
+	sec  *section
+	addr int
+}
+
+type assembler struct {
+	stmts    []*stmt
+	sections []*section
+	byName   map[string]*section
+	cur      *section
+	labels   map[string]*label
+	globals  map[string]bool
+	weak     map[string]bool
+	types    map[string]uint8
+	commons  []*elf.Symbol
+	numbered map[string]int // definitions so far of each numeric label
+	line     int
+}
+
+// Assemble assembles src into a relocatable object. It knows the instructions QBE emits for amd64 and the rest of
+// the integer and scalar SSE instructions of everyday code, the data, section, symbol and alignment directives of
+// the GNU assembler, and local numeric labels; anything else, such as the debug information of .loc, is an error
+func Assemble(src string) (*elf.Object, error) {
+	a := &assembler{
+		byName:   make(map[string]*section),
+		labels:   make(map[string]*label),
+		globals:  make(map[string]bool),
+		weak:     make(map[string]bool),
+		types:    make(map[string]uint8),
+		numbered: make(map[string]int),
+	}
+	a.cur = a.section(".text")
+	for i, text := range strings.Split(stripBlockComments(src), "\n") {
+		a.line = i + 1
+		if err := a.parseLine(text); err != nil { return nil, fmt.Errorf("line %d: %v", a.line, err) }
+	}
+	a.layout()
+	return a.object()
+}
+
+// stripBlockComments blanks out the /* */ comments of src, keeping its lines where they are
+func stripBlockComments(src string) string {
+	var sb strings.Builder
+	quoted := false
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(src):
+			sb.WriteByte(c)
+			i++
+			c = src[i]
+		case c == '"': quoted = !quoted
+		case !quoted && c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 { end = len(src) - i - 2 }
+			sb.WriteString(strings.Repeat("\n", strings.Count(src[i:i+2+end], "\n")))
+			i += end + 3
+			continue
+		case !quoted && c == '\n': quoted = false
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// splitStatements splits a line at the `;` outside quotes, dropping its `#` comment
+func splitStatements(text string) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quoted && c == '\\': i++
+		case c == '"': quoted = !quoted
+		case quoted:
+		case c == '#':
+			return append(parts, text[start:i])
+		case c == ';':
+			parts = append(parts, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, text[start:])
+}
+
+// splitArgs splits operands at the commas outside quotes and parentheses
+func splitArgs(text string) []string {
+	var args []string
+	start, depth, quoted := 0, 0, false
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quoted && c == '\\': i++
+		case c == '"': quoted = !quoted
+		case quoted:
+		case c == '(': depth++
+		case c == ')': depth--
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(text[start:]); rest != "" || len(args) > 0 { args = append(args, rest) }
+	return args
+}
+
+func isSymbolChar(c byte, first bool) bool {
+	return c == '_' || c == '.' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+// symbolLen is the length of the symbol text starts with, quoted or not
+func symbolLen(text string) int {
+	if strings.HasPrefix(text, "\"") {
+		if end := strings.IndexByte(text[1:], '"'); end >= 0 { return end + 2 }
+		return 0
+	}
+	n := 0
+	for n < len(text) && isSymbolChar(text[n], n == 0) {
+		n++
+	}
+	return n
+}
+
+func unquote(sym string) string { return strings.Trim(sym, "\"") }
+
+func (a *assembler) parseLine(text string) error {
+	for _, part := range splitStatements(text) {
+		part = strings.TrimSpace(part)
+		for part != "" {
+			n := symbolLen(part)
+			if n == 0 {
+				// A numeric label, which `1b` and `1f` refer to
+				for n < len(part) && part[n] >= '0' && part[n] <= '9' {
+					n++
+				}
+				if n > 0 && strings.HasPrefix(part[n:], ":") {
+					a.numbered[part[:n]]++
+					a.defineLabel(a.numericLabel(part[:n], 0))
+					part = strings.TrimSpace(part[n+1:])
+					continue
+				}
+				return fmt.Errorf("cannot parse %q", part)
+			}
+			if rest := strings.TrimSpace(part[n:]); strings.HasPrefix(rest, ":") {
+				a.defineLabel(unquote(part[:n]))
+				part = strings.TrimSpace(rest[1:])
+				continue
+			}
+			if err := a.parseStatement(part); err != nil { return err }
+			break
+		}
+	}
+	return nil
+}
+
+// numericLabel names the definition of a numeric label, delta definitions away from the latest one
+func (a *assembler) numericLabel(n string, delta int) string {
+	return fmt.Sprintf(".L%s\x02%d", n, a.numbered[n]+delta)
+}
+
+func (a *assembler) defineLabel(name string) {
+	a.stmts = append(a.stmts, &stmt{line: a.line, sec: a.cur, label: name})
+}
+
+func (a *assembler) add(s *stmt) {
+	s.line, s.sec = a.line, a.cur
+	a.stmts = append(a.stmts, s)
+}
+
+func (a *assembler) parseStatement(text string) error {
+	n := 0
+	for n < len(text) && text[n] != ' ' && text[n] != '\t' {
+		n++
+	}
+	op, rest := strings.ToLower(text[:n]), strings.TrimSpace(text[n:])
+	if strings.HasPrefix(op, ".") { return a.directive(op, rest) }
+	// The repeat prefixes stand before the string instruction they repeat
+	if prefix, ok := map[string]byte{"rep": 0xF3, "repe": 0xF3, "repz": 0xF3, "repne": 0xF2, "repnz": 0xF2, "lock": 0xF0}[op]; ok {
+		if rest == "" { return fmt.Errorf("'%s' needs an instruction after it", op) }
+		before := len(a.stmts)
+		if err := a.parseStatement(rest); err != nil { return err }
+		if s := a.stmts[len(a.stmts)-1]; len(a.stmts) == before+1 && s.branch == nil && len(s.bytes) > 0 {
+			s.bytes = append([]byte{prefix}, s.bytes...)
+			for i := range s.fixups {
+				s.fixups[i].at++
+			}
+			return nil
+		}
+		return fmt.Errorf("'%s' needs an instruction after it", op)
+	}
+	var ops []operand
+	for _, arg := range splitArgs(rest) {
+		o, err := a.parseOperand(arg)
+		if err != nil { return err }
+		ops = append(ops, o)
+	}
+	s, err := a.instruction(op, ops)
+	if err != nil { return err }
+	a.add(s)
+	return nil
+}
+
+func (a *assembler) section(name string) *section {
+	if sec, ok := a.byName[name]; ok { return sec }
+	es := &elf.Section{Name: name, Type: elf.SHT_PROGBITS, Align: 1}
+	switch {
+	case name == ".text" || strings.HasPrefix(name, ".text."): es.Flags = elf.SHF_ALLOC | elf.SHF_EXECINSTR
+	case name == ".bss" || strings.HasPrefix(name, ".bss."): es.Flags, es.Type = elf.SHF_ALLOC|elf.SHF_WRITE, elf.SHT_NOBITS
+	case name == ".rodata" || strings.HasPrefix(name, ".rodata."): es.Flags = elf.SHF_ALLOC
+	case strings.HasPrefix(name, ".note") || strings.HasPrefix(name, ".comment"):
+	default: es.Flags = elf.SHF_ALLOC | elf.SHF_WRITE
+	}
+	sec := &section{Section: es}
+	a.byName[name] = sec
+	a.sections = append(a.sections, sec)
+	return sec
+}
+
+func (a *assembler) directive(op, rest string) error {
+	args := splitArgs(rest)
+	switch op {
+	case ".text", ".data", ".bss":
+		a.cur = a.section(op)
+	case ".section":
+		if len(args) == 0 { return fmt.Errorf(".section needs a name") }
+		a.cur = a.section(unquote(args[0]))
+		if len(args) > 1 {
+			flags := uint64(0)
+			for _, c := range unquote(args[1]) {
+				switch c {
+				case 'a': flags |= elf.SHF_ALLOC
+				case 'w': flags |= elf.SHF_WRITE
+				case 'x': flags |= elf.SHF_EXECINSTR
+				case 'M', 'S', 'G', 'T', 'o', 'R':
+				default: return fmt.Errorf("unknown section flag '%c'", c)
+				}
+			}
+			a.cur.Flags = flags
+		}
+		if len(args) > 2 {
+			switch args[2] {
+			case "@progbits", "%progbits": a.cur.Type = elf.SHT_PROGBITS
+			case "@nobits", "%nobits": a.cur.Type = elf.SHT_NOBITS
+			default: return fmt.Errorf("unsupported section type %s", args[2])
+			}
+		}
+	case ".globl", ".global", ".weak", ".local":
+		for _, arg := range args {
+			name := unquote(arg)
+			switch op {
+			case ".weak": a.weak[name] = true
+			case ".local": delete(a.globals, name)
+			default: a.globals[name] = true
+			}
+		}
+	case ".hidden", ".protected", ".internal", ".ident", ".addrsig", ".addrsig_sym":
+	case ".type":
+		if len(args) != 2 { return fmt.Errorf(".type needs a symbol and a type") }
+		switch strings.TrimLeft(args[1], "@%") {
+		case "function": a.types[unquote(args[0])] = elf.STT_FUNC
+		case "object": a.types[unquote(args[0])] = elf.STT_OBJECT
+		case "notype":
+		default: return fmt.Errorf("unsupported symbol type %s", args[1])
+		}
+	case ".size":
+		if len(args) != 2 { return fmt.Errorf(".size needs a symbol and a size") }
+		sd := &sizeDirective{sym: unquote(args[0])}
+		if start, ok := strings.CutPrefix(strings.ReplaceAll(args[1], " ", ""), ".-"); ok {
+			sd.start = unquote(start)
+		} else {
+			e, err := a.parseExpr(args[1])
+			if err != nil || e.sym != "" { return fmt.Errorf("unsupported size %s", args[1]) }
+			sd.value = e.off
+		}
+		a.add(&stmt{size: sd})
+	case ".balign", ".p2align", ".align":
+		if len(args) == 0 { return fmt.Errorf("%s needs an alignment", op) }
+		e, err := a.parseExpr(args[0])
+		if err != nil || e.sym != "" { return fmt.Errorf("bad alignment %s", args[0]) }
+		align := int(e.off)
+		if op == ".p2align" { align = 1 << align }
+		if align <= 0 || align&(align-1) != 0 { return fmt.Errorf("alignment %d is not a power of 2", align) }
+		if uint64(align) > a.cur.Align { a.cur.Align = uint64(align) }
+		a.add(&stmt{align: align})
+	case ".byte", ".short", ".value", ".word", ".2byte", ".int", ".long", ".4byte", ".quad", ".8byte":
+		size := map[string]int{".byte": 1, ".short": 2, ".value": 2, ".word": 2, ".2byte": 2, ".int": 4, ".long": 4, ".4byte": 4, ".quad": 8, ".8byte": 8}[op]
+		s := &stmt{}
+		for _, arg := range args {
+			e, err := a.parseExpr(arg)
+			if err != nil { return err }
+			if e.sym == "" {
+				if err := fits(e.off, size); err != nil { return err }
+				s.bytes = binary.LittleEndian.AppendUint64(s.bytes, uint64(e.off))[:len(s.bytes)+size]
+				continue
+			}
+			typ := map[int]uint32{4: elf.R_X86_64_32, 8: elf.R_X86_64_64}[size]
+			if typ == 0 { return fmt.Errorf("a %d-byte value cannot hold the address of %s", size, e.sym) }
+			s.fixups = append(s.fixups, fixup{at: len(s.bytes), size: size, typ: typ, val: e})
+			s.bytes = append(s.bytes, make([]byte, size)...)
+		}
+		a.add(s)
+	case ".ascii", ".asciz", ".string":
+		s := &stmt{}
+		for _, arg := range args {
+			str, err := unescape(arg)
+			if err != nil { return err }
+			s.bytes = append(s.bytes, str...)
+			if op != ".ascii" { s.bytes = append(s.bytes, 0) }
+		}
+		a.add(s)
+	case ".fill", ".zero", ".skip", ".space":
+		if len(args) == 0 { return fmt.Errorf("%s needs a count", op) }
+		vals := []int64{0, 1, 0}
+		if op != ".fill" { vals[1] = 1 }
+		for i, arg := range args {
+			e, err := a.parseExpr(arg)
+			if err != nil || e.sym != "" || i > 2 { return fmt.Errorf("bad operands to %s", op) }
+			if op != ".fill" && i == 1 { i = 2 }
+			vals[i] = e.off
+		}
+		count, size, value := vals[0], min(vals[1], 8), vals[2]
+		if count < 0 || size < 0 { return fmt.Errorf("bad operands to %s", op) }
+		b := make([]byte, 0, count*size)
+		for i := int64(0); i < count; i++ {
+			b = binary.LittleEndian.AppendUint64(b, uint64(value))[:len(b)+int(size)]
+		}
+		a.add(&stmt{bytes: b})
+	case ".comm":
+		if len(args) < 2 { return fmt.Errorf(".comm needs a symbol and a size") }
+		vals := []int64{0, 1}
+		for i, arg := range args[1:] {
+			e, err := a.parseExpr(arg)
+			if err != nil || e.sym != "" || i > 1 { return fmt.Errorf("bad operands to .comm") }
+			vals[i] = e.off
+		}
+		a.commons = append(a.commons, &elf.Symbol{Name: unquote(args[0]), Size: uint64(vals[0]), Value: uint64(vals[1]), Global: true, Common: true, Type: elf.STT_OBJECT})
+	case ".file":
+		// The name of the source is fine to leave out, but numbered files are for the line tables of .loc
+		if len(args) > 1 || len(args) == 1 && !strings.HasPrefix(args[0], "\"") { return fmt.Errorf("debug information (.file) is not supported") }
+	default: return fmt.Errorf("unsupported directive %s", op)
+	}
+	return nil
+}
+
+// unescape reads a string literal with the escapes of C
+func unescape(lit string) ([]byte, error) {
+	if len(lit) < 2 || lit[0] != '"' || lit[len(lit)-1] != '"' { return nil, fmt.Errorf("bad string %s", lit) }
+	lit = lit[1 : len(lit)-1]
+	var out []byte
+	for i := 0; i < len(lit); i++ {
+		c := lit[i]
+		if c != '\\' || i+1 == len(lit) {
+			out = append(out, c)
+			continue
+		}
+		i++
+		switch c = lit[i]; c {
+		case 'n': out = append(out, '\n')
+		case 't': out = append(out, '\t')
+		case 'r': out = append(out, '\r')
+		case 'b': out = append(out, '\b')
+		case 'f': out = append(out, '\f')
+		case 'v': out = append(out, '\v')
+		case 'a': out = append(out, 7)
+		case 'e': out = append(out, 27)
+		case 'x':
+			n := 0
+			for i+1+n < len(lit) && strings.IndexByte("0123456789abcdefABCDEF", lit[i+1+n]) >= 0 {
+				n++
+			}
+			v, _ := strconv.ParseUint(lit[i+1:i+1+n], 16, 64)
+			out = append(out, byte(v))
+			i += n
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			n := 1
+			for n < 3 && i+n < len(lit) && lit[i+n] >= '0' && lit[i+n] <= '7' {
+				n++
+			}
+			v, _ := strconv.ParseUint(lit[i:i+n], 8, 64)
+			out = append(out, byte(v))
+			i += n - 1
+		default: out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// fits checks that v can be stored in size bytes, as a signed or an unsigned value
+func fits(v int64, size int) error {
+	if size < 8 && (v < -(1<<(8*size-1)) || v >= 1<<(8*size)) { return fmt.Errorf("value %d does not fit in %d bytes", v, size) }
+	return nil
+}
+
+// layout gives every statement its address, starting with all the branches that can be short, and making long
+// the ones that cannot until none change
+func (a *assembler) layout() {
+	for _, s := range a.stmts {
+		if _, ok := a.labels[s.label]; s.label != "" && !ok { a.labels[s.label] = &label{sec: s.sec} }
+	}
+	for _, s := range a.stmts {
+		if s.branch == nil { continue }
+		l, ok := a.labels[s.branch.target.sym]
+		s.branch.long = !ok || l.sec != s.sec
+	}
+	for {
+		for _, sec := range a.sections {
+			sec.pc = 0
+		}
+		for _, s := range a.stmts {
+			s.addr = s.sec.pc
+			s.sec.pc += s.len()
+			if s.label != "" {
+				if l, ok := a.labels[s.label]; ok && l.sec == s.sec {
+					l.addr = s.addr
+				} else {
+					a.labels[s.label] = &label{sec: s.sec, addr: s.addr}
+				}
+			}
+		}
+		// Only the first branch out of range is made long at a time, as that can shrink the padding of an
+		// alignment between a later one and its target enough for it to stay short
+		changed := false
+		for _, s := range a.stmts {
+			if b := s.branch; b != nil && !b.long {
+				l := a.labels[b.target.sym]
+				if d := int64(l.addr) + b.target.off - int64(s.addr+2); d != int64(int8(d)) {
+					b.long, changed = true, true
+					break
+				}
+			}
+		}
+		if !changed { return }
+	}
+}
+
+// len is the size of a statement at its address
+func (s *stmt) len() int {
+	switch {
+	case s.align > 0: return (s.align - s.addr%s.align) % s.align
+	case s.branch == nil: return len(s.bytes)
+	case !s.branch.long: return 2
+	case s.branch.cc < 0: return 5
+	}
+	return 6
+}
+
+// object writes the laid out statements into the sections, resolving what is known of the fixups and turning the
+// rest into relocations
+func (a *assembler) object() (*elf.Object, error) {
+	obj := &elf.Object{}
+	symbols := make(map[string]*elf.Symbol)
+	var undefined []*elf.Symbol
+	symbol := func(name string) *elf.Symbol {
+		if sym, ok := symbols[name]; ok { return sym }
+		sym := &elf.Symbol{Name: name, Global: true, Weak: a.weak[name]}
+		symbols[name] = sym
+		undefined = append(undefined, sym)
+		return sym
+	}
+	for _, sec := range a.sections {
+		obj.Sections = append(obj.Sections, sec.Section)
+	}
+	// The symbols of the labels, but those of the local .L labels, in order of definition
+	for _, s := range a.stmts {
+		if s.label == "" || strings.HasPrefix(s.label, ".L") { continue }
+		if _, dup := symbols[s.label]; dup { return nil, fmt.Errorf("line %d: label %q defined twice", s.line, s.label) }
+		sym := &elf.Symbol{Name: s.label, Section: s.sec.Section, Value: uint64(s.addr), Type: a.types[s.label],
+			Global: a.globals[s.label], Weak: a.weak[s.label]}
+		symbols[s.label] = sym
+		obj.Symbols = append(obj.Symbols, sym)
+	}
+	for _, sym := range a.commons {
+		if _, dup := symbols[sym.Name]; dup { return nil, fmt.Errorf("common symbol %q is also defined", sym.Name) }
+		symbols[sym.Name] = sym
+		obj.Symbols = append(obj.Symbols, sym)
+	}
+
+	for _, s := range a.stmts {
+		b := s.bytes
+		switch {
+		case s.align > 0:
+			fill := byte(0)
+			if s.sec.Flags&elf.SHF_EXECINSTR != 0 { fill = 0x90 }
+			b = make([]byte, s.len())
+			for i := range b {
+				b[i] = fill
+			}
+		case s.size != nil:
+			sym, ok := symbols[s.size.sym]
+			if !ok { continue }
+			sym.Size = uint64(s.size.value)
+			if s.size.start != "" {
+				l, ok := a.labels[s.size.start]
+				if !ok || l.sec != s.sec { return nil, fmt.Errorf("line %d: cannot size %s", s.line, s.size.sym) }
+				sym.Size = uint64(s.addr - l.addr)
+			}
+			continue
+		case s.branch != nil:
+			b = s.branch.encode()
+			typ := uint32(elf.R_X86_64_PLT32)
+			if !s.branch.long {
+				l, _ := a.labels[s.branch.target.sym]
+				b[1] = byte(int64(l.addr) + s.branch.target.off - int64(s.addr+2))
+				break
+			}
+			s.fixups = []fixup{{at: len(b) - 4, size: 4, typ: typ, val: expr{s.branch.target.sym, s.branch.target.off - 4}}}
+		}
+		if s.sec.Type == elf.SHT_NOBITS {
+			for _, c := range b {
+				if c != 0 { return nil, fmt.Errorf("line %d: data in %s, which holds only zeros", s.line, s.sec.Name) }
+			}
+			s.sec.Size += uint64(len(b))
+			continue
+		}
+		at := len(s.sec.Data)
+		s.sec.Data = append(s.sec.Data, b...)
+		for _, f := range s.fixups {
+			if err := a.resolve(obj, s, at, f, symbol); err != nil { return nil, fmt.Errorf("line %d: %v", s.line, err) }
+		}
+	}
+	// Symbols declared global but neither defined nor referenced are still part of the interface
+	var names []string
+	for name := range a.globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		symbol(name)
+	}
+	obj.Symbols = append(obj.Symbols, undefined...)
+	return obj, nil
+}
+
+// resolve fills in a fixup at offset at of the section of s: a pc-relative one to a label of the same section is
+// known already, and the rest become relocations, against the section for a local label
+func (a *assembler) resolve(obj *elf.Object, s *stmt, at int, f fixup, symbol func(string) *elf.Symbol) error {
+	field := s.sec.Data[at+f.at : at+f.at+f.size]
+	pcrel := f.typ == elf.R_X86_64_PC32 || f.typ == elf.R_X86_64_PLT32
+	l, local := a.labels[f.val.sym]
+	exported := a.globals[f.val.sym] || a.weak[f.val.sym]
+	if pcrel && local && !exported && l.sec == s.sec {
+		v := int64(l.addr) + f.val.off - int64(at+f.at)
+		if v != int64(int32(v)) { return fmt.Errorf("%s is out of range", f.val.sym) }
+		binary.LittleEndian.PutUint32(field, uint32(v))
+		return nil
+	}
+	r := elf.Reloc{Offset: uint64(at + f.at), Type: f.typ, Addend: f.val.off}
+	switch {
+	case local && (!exported || strings.HasPrefix(f.val.sym, ".L")):
+		r.Symbol, r.Addend = obj.SectionSymbol(l.sec.Section), int64(l.addr)+f.val.off
+	case strings.HasPrefix(f.val.sym, ".L"): return fmt.Errorf("undefined local label %s", f.val.sym)
+	default:
+		r.Symbol = symbol(f.val.sym)
+	}
+	s.sec.Relocs = append(s.sec.Relocs, r)
+	return nil
+}
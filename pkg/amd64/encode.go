@@ -0,0 +1,849 @@
+package amd64
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/elf"
+)
+
+// reg is a register: a general purpose one of 1 to 8 bytes, or an SSE one, of size 16
+type reg struct {
+	num  uint8
+	size int
+	high bool // %ah, %ch, %dh or %bh, which no instruction with a REX prefix can use
+}
+
+func (r reg) xmm() bool { return r.size == 16 }
+
+var registers = func() map[string]reg {
+	m := make(map[string]reg)
+	names64 := []string{"rax", "rcx", "rdx", "rbx", "rsp", "rbp", "rsi", "rdi"}
+	names32 := []string{"eax", "ecx", "edx", "ebx", "esp", "ebp", "esi", "edi"}
+	names16 := []string{"ax", "cx", "dx", "bx", "sp", "bp", "si", "di"}
+	names8 := []string{"al", "cl", "dl", "bl", "spl", "bpl", "sil", "dil"}
+	for i := 0; i < 8; i++ {
+		n := uint8(i)
+		m[names64[i]], m[names32[i]], m[names16[i]], m[names8[i]] = reg{n, 8, false}, reg{n, 4, false}, reg{n, 2, false}, reg{n, 1, false}
+	}
+	for i, name := range []string{"ah", "ch", "dh", "bh"} {
+		m[name] = reg{uint8(4 + i), 1, true}
+	}
+	for i := 8; i < 16; i++ {
+		n := uint8(i)
+		m[fmt.Sprintf("r%d", i)], m[fmt.Sprintf("r%dd", i)], m[fmt.Sprintf("r%dw", i)], m[fmt.Sprintf("r%db", i)] = reg{n, 8, false}, reg{n, 4, false}, reg{n, 2, false}, reg{n, 1, false}
+		m[fmt.Sprintf("r%dl", i)] = reg{n, 1, false}
+	}
+	for i := 0; i < 16; i++ {
+		m[fmt.Sprintf("xmm%d", i)] = reg{uint8(i), 16, false}
+	}
+	return m
+}()
+
+const (
+	kindReg = iota
+	kindImm
+	kindMem
+)
+
+// operand is an operand in AT&T syntax: %reg, $imm, or disp(base, index, scale), which without the parentheses
+// is an absolute address, or the target of a direct jump or call
+type operand struct {
+	kind  int
+	reg   reg
+	imm   expr
+	disp  expr
+	base  *reg
+	index *reg
+	scale int
+	rip   bool
+	star  bool // the target of an indirect jump or call
+	plt   bool // sym@PLT
+}
+
+func (o operand) isReg() bool   { return o.kind == kindReg }
+func (o operand) isXMM() bool   { return o.kind == kindReg && o.reg.xmm() }
+func (o operand) isGPR() bool   { return o.kind == kindReg && !o.reg.xmm() }
+func (o operand) isImm() bool   { return o.kind == kindImm }
+func (o operand) isMem() bool   { return o.kind == kindMem }
+func (o operand) isRM() bool    { return o.isGPR() || o.isMem() }
+func (o operand) isXMMRM() bool { return o.isXMM() || o.isMem() }
+
+func parseReg(text string) (reg, error) {
+	r, ok := registers[strings.ToLower(strings.TrimPrefix(strings.TrimSpace(text), "%"))]
+	if !ok { return reg{}, fmt.Errorf("unknown register %s", text) }
+	return r, nil
+}
+
+func (a *assembler) parseOperand(text string) (operand, error) {
+	var o operand
+	if rest, ok := strings.CutPrefix(text, "*"); ok {
+		o.star, text = true, strings.TrimSpace(rest)
+	}
+	switch {
+	case strings.HasPrefix(text, "%"):
+		if strings.Contains(text, ":") { return o, fmt.Errorf("segment overrides are not supported: %s", text) }
+		r, err := parseReg(text)
+		o.kind, o.reg = kindReg, r
+		return o, err
+	case strings.HasPrefix(text, "$"):
+		e, err := a.parseExpr(text[1:])
+		o.kind, o.imm = kindImm, e
+		return o, err
+	}
+	o.kind, o.scale = kindMem, 1
+	disp := text
+	if strings.HasSuffix(text, ")") {
+		open := strings.LastIndexByte(text, '(')
+		if open < 0 { return o, fmt.Errorf("bad operand %s", text) }
+		disp = strings.TrimSpace(text[:open])
+		parts := strings.Split(text[open+1:len(text)-1], ",")
+		if base := strings.TrimSpace(parts[0]); base != "" {
+			if strings.EqualFold(base, "%rip") {
+				o.rip = true
+			} else {
+				r, err := parseReg(base)
+				if err != nil { return o, err }
+				o.base = &r
+			}
+		}
+		if len(parts) > 1 {
+			r, err := parseReg(parts[1])
+			if err != nil { return o, err }
+			o.index = &r
+		}
+		if len(parts) > 2 {
+			s, err := strconv.Atoi(strings.TrimSpace(parts[2]))
+			if err != nil || s != 1 && s != 2 && s != 4 && s != 8 { return o, fmt.Errorf("bad scale in %s", text) }
+			o.scale = s
+		}
+		if len(parts) > 3 { return o, fmt.Errorf("bad operand %s", text) }
+		for _, r := range []*reg{o.base, o.index} {
+			if r != nil && (r.size != 8) { return o, fmt.Errorf("addresses need 64-bit registers: %s", text) }
+		}
+		if o.index != nil && o.index.num == 4 { return o, fmt.Errorf("%%rsp cannot be an index: %s", text) }
+		if o.rip && o.index != nil { return o, fmt.Errorf("%%rip cannot be used with an index: %s", text) }
+	}
+	if strings.Contains(disp, ":") { return o, fmt.Errorf("segment overrides are not supported: %s", text) }
+	if d, ok := strings.CutSuffix(disp, "@PLT"); ok {
+		disp, o.plt = d, true
+	}
+	if disp != "" {
+		e, err := a.parseExpr(disp)
+		if err != nil { return o, err }
+		o.disp = e
+	}
+	return o, nil
+}
+
+// parseExpr reads an expression of numbers, at most one symbol added to them, and the operators of the GNU
+// assembler with its precedences: * / % << >> first, then | & ^, then + -
+func (a *assembler) parseExpr(text string) (expr, error) {
+	p := &exprParser{a: a, text: strings.TrimSpace(text)}
+	e, err := p.sum()
+	if err == nil && p.pos < len(p.text) { err = fmt.Errorf("bad expression %q", text) }
+	return e, err
+}
+
+type exprParser struct {
+	a    *assembler
+	text string
+	pos  int
+}
+
+func (p *exprParser) skip() {
+	for p.pos < len(p.text) && (p.text[p.pos] == ' ' || p.text[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peekOp(ops ...string) string {
+	p.skip()
+	for _, op := range ops {
+		if strings.HasPrefix(p.text[p.pos:], op) { return op }
+	}
+	return ""
+}
+
+func (p *exprParser) sum() (expr, error) {
+	e, err := p.bitwise()
+	for err == nil {
+		op := p.peekOp("+", "-")
+		if op == "" { break }
+		p.pos++
+		var r expr
+		if r, err = p.bitwise(); err != nil { break }
+		switch {
+		case r.sym == "" && op == "+": e.off += r.off
+		case r.sym == "" && op == "-": e.off -= r.off
+		case e.sym == "" && op == "+": e = expr{r.sym, e.off + r.off}
+		default: err = fmt.Errorf("cannot compute %q", p.text)
+		}
+	}
+	return e, err
+}
+
+func (p *exprParser) bitwise() (expr, error) {
+	e, err := p.product()
+	for err == nil {
+		op := p.peekOp("|", "&", "^")
+		if op == "" { break }
+		p.pos++
+		var r expr
+		if r, err = p.product(); err != nil { break }
+		if e.sym != "" || r.sym != "" { return e, fmt.Errorf("cannot compute %q", p.text) }
+		e.off = map[string]int64{"|": e.off | r.off, "&": e.off & r.off, "^": e.off ^ r.off}[op]
+	}
+	return e, err
+}
+
+func (p *exprParser) product() (expr, error) {
+	e, err := p.unary()
+	for err == nil {
+		op := p.peekOp("<<", ">>", "*", "/", "%")
+		if op == "" { break }
+		p.pos += len(op)
+		var r expr
+		if r, err = p.unary(); err != nil { break }
+		if e.sym != "" || r.sym != "" { return e, fmt.Errorf("cannot compute %q", p.text) }
+		switch op {
+		case "<<": e.off <<= uint(r.off)
+		case ">>": e.off >>= uint(r.off)
+		case "*": e.off *= r.off
+		default:
+			if r.off == 0 { return e, fmt.Errorf("division by zero in %q", p.text) }
+			if op == "/" { e.off /= r.off } else { e.off %= r.off }
+		}
+	}
+	return e, err
+}
+
+func (p *exprParser) unary() (expr, error) {
+	p.skip()
+	if p.pos == len(p.text) { return expr{}, fmt.Errorf("missing operand in %q", p.text) }
+	switch c := p.text[p.pos]; {
+	case c == '-' || c == '~' || c == '+':
+		p.pos++
+		e, err := p.unary()
+		if err == nil && e.sym != "" && c != '+' { err = fmt.Errorf("cannot compute %q", p.text) }
+		if c == '-' { e.off = -e.off }
+		if c == '~' { e.off = ^e.off }
+		return e, err
+	case c == '(':
+		p.pos++
+		e, err := p.sum()
+		p.skip()
+		if err == nil && (p.pos == len(p.text) || p.text[p.pos] != ')') { err = fmt.Errorf("missing ) in %q", p.text) }
+		p.pos++
+		return e, err
+	case c == '\'':
+		if p.pos+1 >= len(p.text) { return expr{}, fmt.Errorf("bad character in %q", p.text) }
+		v := int64(p.text[p.pos+1])
+		p.pos += 2
+		if p.pos < len(p.text) && p.text[p.pos] == '\'' { p.pos++ }
+		return expr{off: v}, nil
+	case c >= '0' && c <= '9':
+		start := p.pos
+		for p.pos < len(p.text) && isSymbolChar(p.text[p.pos], false) {
+			p.pos++
+		}
+		lit := p.text[start:p.pos]
+		if n := strings.TrimRight(lit, "bf"); len(n) == len(lit)-1 && strings.Trim(n, "0123456789") == "" {
+			// A reference to a numeric label, backwards or forwards
+			delta := 0
+			if strings.HasSuffix(lit, "f") { delta = 1 }
+			return expr{sym: p.a.numericLabel(n, delta)}, nil
+		}
+		v, err := strconv.ParseInt(lit, 0, 64)
+		if err != nil {
+			u, uerr := strconv.ParseUint(lit, 0, 64)
+			if uerr != nil { return expr{}, fmt.Errorf("bad number %s", lit) }
+			v = int64(u)
+		}
+		return expr{off: v}, nil
+	}
+	n := symbolLen(p.text[p.pos:])
+	if n == 0 { return expr{}, fmt.Errorf("bad expression %q", p.text) }
+	sym := unquote(p.text[p.pos : p.pos+n])
+	p.pos += n
+	if sym == "." { return expr{}, fmt.Errorf("'.' is only supported in .size") }
+	return expr{sym: sym}, nil
+}
+
+// The condition codes, as in jcc, setcc and cmovcc
+var conditions = map[string]int{
+	"o": 0, "no": 1, "b": 2, "c": 2, "nae": 2, "ae": 3, "nb": 3, "nc": 3, "e": 4, "z": 4, "ne": 5, "nz": 5,
+	"be": 6, "na": 6, "a": 7, "nbe": 7, "s": 8, "ns": 9, "p": 10, "pe": 10, "np": 11, "po": 11,
+	"l": 12, "nge": 12, "ge": 13, "nl": 13, "le": 14, "ng": 14, "g": 15, "nle": 15,
+}
+
+var suffixSizes = map[byte]int{'b': 1, 'w': 2, 'l': 4, 'q': 8}
+
+// inst is an instruction to encode: prefixes, opcode, a ModRM byte with its reg field and r/m operand, and an
+// immediate
+type inst struct {
+	prefix  []byte
+	w       bool
+	opcode  []byte
+	reg     uint8
+	rm      *operand
+	plusReg *reg // the register added to the last byte of the opcode
+	imm     *expr
+	immSize int
+	immType uint32 // the relocation of a symbolic immediate
+	byteRegs []reg
+}
+
+func (in *inst) encode() (*stmt, error) {
+	rex := byte(0)
+	if in.w { rex |= 8 }
+	if in.reg >= 8 { rex |= 4 }
+	rm := in.rm
+	if rm != nil {
+		switch {
+		case rm.isReg(): if rm.reg.num >= 8 { rex |= 1 }
+		default:
+			if rm.index != nil && rm.index.num >= 8 { rex |= 2 }
+			if rm.base != nil && rm.base.num >= 8 { rex |= 1 }
+		}
+	}
+	if in.plusReg != nil && in.plusReg.num >= 8 { rex |= 1 }
+	needRex, high := rex != 0, false
+	for _, r := range in.byteRegs {
+		if r.size != 1 { continue }
+		if r.high { high = true } else if r.num >= 4 { needRex = true }
+	}
+	if needRex && high { return nil, fmt.Errorf("%%ah, %%bh, %%ch and %%dh cannot be used in this instruction") }
+
+	s := &stmt{}
+	s.bytes = append(s.bytes, in.prefix...)
+	if needRex { s.bytes = append(s.bytes, 0x40|rex) }
+	s.bytes = append(s.bytes, in.opcode...)
+	if in.plusReg != nil { s.bytes[len(s.bytes)-1] += in.plusReg.num & 7 }
+	ripAt := -1
+	if rm != nil {
+		reg := (in.reg & 7) << 3
+		switch {
+		case rm.isReg():
+			s.bytes = append(s.bytes, 0xC0|reg|rm.reg.num&7)
+		case rm.rip:
+			s.bytes = append(s.bytes, reg|5)
+			ripAt = len(s.bytes)
+			s.bytes = append(s.bytes, 0, 0, 0, 0)
+		case rm.base == nil:
+			// An absolute address, or one with an index but no base, has a 32-bit displacement
+			index := byte(4)
+			if rm.index != nil { index = rm.index.num & 7 }
+			s.bytes = append(s.bytes, reg|4, scaleBits(rm.scale)|index<<3|5)
+			if err := s.disp32(rm.disp, elf.R_X86_64_32S); err != nil { return nil, err }
+		default:
+			base := rm.base.num & 7
+			mod := byte(0x80)
+			switch {
+			case rm.disp.sym != "":
+			case rm.disp.off == 0 && base != 5: mod = 0
+			case rm.disp.off == int64(int8(rm.disp.off)): mod = 0x40
+			}
+			if rm.index != nil || base == 4 {
+				index := byte(4)
+				if rm.index != nil { index = rm.index.num & 7 }
+				s.bytes = append(s.bytes, mod|reg|4, scaleBits(rm.scale)|index<<3|base)
+			} else {
+				s.bytes = append(s.bytes, mod|reg|base)
+			}
+			switch mod {
+			case 0x40: s.bytes = append(s.bytes, byte(rm.disp.off))
+			case 0x80: if err := s.disp32(rm.disp, elf.R_X86_64_32S); err != nil { return nil, err }
+			}
+		}
+	}
+	if in.imm != nil {
+		if in.imm.sym != "" {
+			s.fixups = append(s.fixups, fixup{at: len(s.bytes), size: in.immSize, typ: in.immType, val: *in.imm})
+			s.bytes = append(s.bytes, make([]byte, in.immSize)...)
+		} else {
+			// Like the GNU assembler, an immediate too wide for its operand is truncated to it
+			s.bytes = binary.LittleEndian.AppendUint64(s.bytes, uint64(in.imm.off))[:len(s.bytes)+in.immSize]
+		}
+	}
+	if ripAt >= 0 {
+		typ := uint32(elf.R_X86_64_PC32)
+		if rm.plt { typ = elf.R_X86_64_PLT32 }
+		s.fixups = append(s.fixups, fixup{at: ripAt, size: 4, typ: typ, val: expr{rm.disp.sym, rm.disp.off - int64(len(s.bytes)-ripAt)}})
+		if rm.disp.sym == "" { return nil, fmt.Errorf("%%rip-relative operands need a symbol") }
+	}
+	return s, nil
+}
+
+func (s *stmt) disp32(disp expr, typ uint32) error {
+	if disp.sym != "" {
+		s.fixups = append(s.fixups, fixup{at: len(s.bytes), size: 4, typ: typ, val: disp})
+		s.bytes = append(s.bytes, 0, 0, 0, 0)
+		return nil
+	}
+	if disp.off != int64(int32(disp.off)) { return fmt.Errorf("displacement %d out of range", disp.off) }
+	s.bytes = binary.LittleEndian.AppendUint32(s.bytes, uint32(disp.off))
+	return nil
+}
+
+func scaleBits(scale int) byte { return map[int]byte{1: 0, 2: 0x40, 4: 0x80, 8: 0xC0}[scale] }
+
+// encode encodes a branch, with a zero displacement that is filled in once it is laid out
+func (b *branch) encode() []byte {
+	switch {
+	case !b.long && b.cc < 0: return []byte{0xEB, 0}
+	case !b.long: return []byte{0x70 + byte(b.cc), 0}
+	case b.cc < 0: return []byte{0xE9, 0, 0, 0, 0}
+	}
+	return []byte{0x0F, 0x80 + byte(b.cc), 0, 0, 0, 0}
+}
+
+func gprs(ops []operand) []reg {
+	var regs []reg
+	for _, o := range ops {
+		if o.isGPR() { regs = append(regs, o.reg) }
+	}
+	return regs
+}
+
+// opSize is the size an instruction works on: its suffix, or else that of its general purpose registers
+func opSize(suffix int, ops []operand) (int, error) {
+	size := suffix
+	for _, r := range gprs(ops) {
+		if size == 0 { size = r.size }
+	}
+	if size == 0 { return 0, fmt.Errorf("operand size is ambiguous; add a suffix") }
+	return size, nil
+}
+
+// sized fills in the operand size prefix of in, and REX.W
+func (in *inst) sized(size int) *inst {
+	switch size {
+	case 2: in.prefix = append([]byte{0x66}, in.prefix...)
+	case 8: in.w = true
+	}
+	return in
+}
+
+// checkRegs makes sure the general purpose registers of ops, all but those of the indices in skip, are of size
+func checkRegs(size int, ops []operand, skip ...int) error {
+	for i, o := range ops {
+		if !o.isGPR() || contains(skip, i) { continue }
+		if o.reg.size != size { return fmt.Errorf("register of the wrong size for a %d-byte operation", size) }
+	}
+	return nil
+}
+
+func contains(list []int, v int) bool {
+	for _, x := range list {
+		if x == v { return true }
+	}
+	return false
+}
+
+func immOf(o operand) *expr { e := o.imm; return &e }
+
+func ptr(o operand) *operand { return &o }
+
+// aluOps are the arithmetic instructions that share their encodings, with the opcode extension of each
+var aluOps = map[string]uint8{"add": 0, "or": 1, "adc": 2, "sbb": 3, "and": 4, "sub": 5, "xor": 6, "cmp": 7}
+
+// unaryOps are the instructions of the F6/F7 group, on one r/m operand
+var unaryOps = map[string]uint8{"not": 2, "neg": 3, "mul": 4, "div": 6, "idiv": 7}
+
+var shiftOps = map[string]uint8{"rol": 0, "ror": 1, "rcl": 2, "rcr": 3, "shl": 4, "sal": 4, "shr": 5, "sar": 7}
+
+// extendOps are the moves that sign or zero extend, with their source and destination sizes and opcode
+var extendOps = map[string]struct {
+	from, to int
+	opcode   []byte
+}{
+	"movzbw": {1, 2, []byte{0x0F, 0xB6}}, "movzbl": {1, 4, []byte{0x0F, 0xB6}}, "movzbq": {1, 8, []byte{0x0F, 0xB6}},
+	"movzwl": {2, 4, []byte{0x0F, 0xB7}}, "movzwq": {2, 8, []byte{0x0F, 0xB7}},
+	"movsbw": {1, 2, []byte{0x0F, 0xBE}}, "movsbl": {1, 4, []byte{0x0F, 0xBE}}, "movsbq": {1, 8, []byte{0x0F, 0xBE}},
+	"movswl": {2, 4, []byte{0x0F, 0xBF}}, "movswq": {2, 8, []byte{0x0F, 0xBF}},
+	"movslq": {4, 8, []byte{0x63}},
+}
+
+// fixedOps are the instructions without operands
+var fixedOps = map[string][]byte{
+	"ret": {0xC3}, "leave": {0xC9}, "nop": {0x90}, "hlt": {0xF4}, "ud2": {0x0F, 0x0B}, "int3": {0xCC},
+	"syscall": {0x0F, 0x05}, "endbr64": {0xF3, 0x0F, 0x1E, 0xFA}, "pause": {0xF3, 0x90}, "cld": {0xFC}, "std": {0xFD},
+	"cqto": {0x48, 0x99}, "cqo": {0x48, 0x99}, "cltd": {0x99}, "cdq": {0x99}, "cltq": {0x48, 0x98}, "cdqe": {0x48, 0x98},
+	"cwtl": {0x98}, "cwde": {0x98}, "mfence": {0x0F, 0xAE, 0xF0}, "lfence": {0x0F, 0xAE, 0xE8}, "sfence": {0x0F, 0xAE, 0xF8},
+	"movsb": {0xA4}, "movsw": {0x66, 0xA5}, "movsl": {0xA5}, "movsq": {0x48, 0xA5},
+	"stosb": {0xAA}, "stosw": {0x66, 0xAB}, "stosl": {0xAB}, "stosq": {0x48, 0xAB},
+}
+
+// sseOps are the scalar and packed SSE instructions from an xmm register or memory to an xmm register, with their
+// mandatory prefix and opcode; the moves also have a store form
+var sseOps = map[string]struct {
+	prefix byte
+	opcode byte
+	store  byte
+}{
+	"movss": {0xF3, 0x10, 0x11}, "movsd": {0xF2, 0x10, 0x11}, "movaps": {0, 0x28, 0x29}, "movapd": {0x66, 0x28, 0x29},
+	"movups": {0, 0x10, 0x11}, "movupd": {0x66, 0x10, 0x11}, "movdqa": {0x66, 0x6F, 0x7F}, "movdqu": {0xF3, 0x6F, 0x7F},
+	"addss": {0xF3, 0x58, 0}, "addsd": {0xF2, 0x58, 0}, "subss": {0xF3, 0x5C, 0}, "subsd": {0xF2, 0x5C, 0},
+	"mulss": {0xF3, 0x59, 0}, "mulsd": {0xF2, 0x59, 0}, "divss": {0xF3, 0x5E, 0}, "divsd": {0xF2, 0x5E, 0},
+	"sqrtss": {0xF3, 0x51, 0}, "sqrtsd": {0xF2, 0x51, 0}, "minss": {0xF3, 0x5D, 0}, "minsd": {0xF2, 0x5D, 0},
+	"maxss": {0xF3, 0x5F, 0}, "maxsd": {0xF2, 0x5F, 0},
+	"xorps": {0, 0x57, 0}, "xorpd": {0x66, 0x57, 0}, "andps": {0, 0x54, 0}, "andpd": {0x66, 0x54, 0},
+	"andnps": {0, 0x55, 0}, "andnpd": {0x66, 0x55, 0}, "orps": {0, 0x56, 0}, "orpd": {0x66, 0x56, 0}, "pxor": {0x66, 0xEF, 0},
+	"ucomiss": {0, 0x2E, 0}, "ucomisd": {0x66, 0x2E, 0}, "comiss": {0, 0x2F, 0}, "comisd": {0x66, 0x2F, 0},
+	"cvtss2sd": {0xF3, 0x5A, 0}, "cvtsd2ss": {0xF2, 0x5A, 0},
+}
+
+// instruction encodes the instruction op with its operands in AT&T order, source first
+func (a *assembler) instruction(op string, ops []operand) (*stmt, error) {
+	if in, ok, err := a.conditional(op, ops); ok || err != nil {
+		if err != nil || in == nil { return in, err }
+		return in, nil
+	}
+	if s, ok, err := sse(op, ops); ok { return s, err }
+	if b, ok := fixedOps[op]; ok {
+		if len(ops) > 0 { return nil, fmt.Errorf("%s takes no operands", op) }
+		return &stmt{bytes: append([]byte(nil), b...)}, nil
+	}
+	if ext, ok := extendOps[op]; ok { return extend(ext.from, ext.to, ext.opcode, ops) }
+
+	// Try the mnemonic as it is, then without a size suffix
+	base, suffix := op, 0
+	if !knownBase(base) && len(op) > 1 {
+		if size, ok := suffixSizes[op[len(op)-1]]; ok && knownBase(op[:len(op)-1]) { base, suffix = op[:len(op)-1], size }
+	}
+	if !knownBase(base) { return nil, fmt.Errorf("unsupported instruction %s", op) }
+	return a.general(base, suffix, ops)
+}
+
+func knownBase(op string) bool {
+	if _, ok := aluOps[op]; ok { return true }
+	if _, ok := unaryOps[op]; ok { return true }
+	if _, ok := shiftOps[op]; ok { return true }
+	if _, ok := fixedOps[op]; ok { return true }
+	switch op {
+	case "mov", "movabs", "lea", "test", "imul", "inc", "dec", "push", "pop", "xchg", "call", "jmp", "movzx", "movsx", "movsxd":
+		return true
+	}
+	return false
+}
+
+func count(ops []operand, n int, op string) error {
+	if len(ops) != n { return fmt.Errorf("%s takes %d operands", op, n) }
+	return nil
+}
+
+// conditional encodes jcc, setcc and cmovcc
+func (a *assembler) conditional(op string, ops []operand) (*stmt, bool, error) {
+	switch {
+	case strings.HasPrefix(op, "j") && op != "jmp" && op != "jmpq":
+		cc, ok := conditions[op[1:]]
+		if !ok { return nil, false, nil }
+		if err := count(ops, 1, op); err != nil { return nil, true, err }
+		if !ops[0].isMem() || ops[0].base != nil || ops[0].index != nil || ops[0].rip || ops[0].star || ops[0].disp.sym == "" {
+			return nil, true, fmt.Errorf("%s needs a label", op)
+		}
+		return &stmt{branch: &branch{cc: cc, target: ops[0].disp}}, true, nil
+	case strings.HasPrefix(op, "set"):
+		cc, ok := conditions[strings.TrimSuffix(op[3:], "b")]
+		if c, exact := conditions[op[3:]]; exact { cc, ok = c, true }
+		if !ok { return nil, false, nil }
+		if err := count(ops, 1, op); err != nil { return nil, true, err }
+		if !ops[0].isRM() || ops[0].isGPR() && ops[0].reg.size != 1 { return nil, true, fmt.Errorf("%s needs a byte register or memory", op) }
+		in := &inst{opcode: []byte{0x0F, 0x90 + byte(cc)}, rm: ptr(ops[0]), byteRegs: gprs(ops)}
+		s, err := in.encode()
+		return s, true, err
+	case strings.HasPrefix(op, "cmov"):
+		rest, suffix := op[4:], 0
+		cc, ok := conditions[rest]
+		if !ok && len(rest) > 1 {
+			if size, sok := suffixSizes[rest[len(rest)-1]]; sok {
+				cc, ok = conditions[rest[:len(rest)-1]]
+				suffix = size
+			}
+		}
+		if !ok { return nil, false, nil }
+		if err := count(ops, 2, op); err != nil { return nil, true, err }
+		if !ops[0].isRM() || !ops[1].isGPR() { return nil, true, fmt.Errorf("%s needs a register destination", op) }
+		size, err := opSize(suffix, ops)
+		if err == nil { err = checkRegs(size, ops) }
+		if err != nil { return nil, true, err }
+		in := (&inst{opcode: []byte{0x0F, 0x40 + byte(cc)}, reg: ops[1].reg.num, rm: ptr(ops[0])}).sized(size)
+		s, err := in.encode()
+		return s, true, err
+	}
+	return nil, false, nil
+}
+
+func extend(from, to int, opcode []byte, ops []operand) (*stmt, error) {
+	if len(ops) != 2 || !ops[0].isRM() || !ops[1].isGPR() { return nil, fmt.Errorf("sign and zero extensions go from a register or memory to a register") }
+	if ops[0].isGPR() && ops[0].reg.size != from || ops[1].reg.size != to { return nil, fmt.Errorf("register of the wrong size for the extension") }
+	in := (&inst{opcode: opcode, reg: ops[1].reg.num, rm: ptr(ops[0]), byteRegs: gprs(ops)}).sized(to)
+	return in.encode()
+}
+
+// general encodes the integer instructions, of size suffix when their mnemonic has one
+func (a *assembler) general(op string, suffix int, ops []operand) (*stmt, error) {
+	if b, ok := fixedOps[op]; ok {
+		if op == "ret" && len(ops) == 1 && ops[0].isImm() {
+			in := &inst{opcode: []byte{0xC2}, imm: immOf(ops[0]), immSize: 2}
+			return in.encode()
+		}
+		if len(ops) > 0 { return nil, fmt.Errorf("%s takes no operands", op) }
+		return &stmt{bytes: append([]byte(nil), b...)}, nil
+	}
+	switch op {
+	case "call", "jmp":
+		if err := count(ops, 1, op); err != nil { return nil, err }
+		o := ops[0]
+		if o.star || o.isReg() {
+			if o.isReg() && o.reg.size != 8 { return nil, fmt.Errorf("%s needs a 64-bit register", op) }
+			ext := map[string]uint8{"call": 2, "jmp": 4}[op]
+			in := &inst{opcode: []byte{0xFF}, reg: ext, rm: &o}
+			return in.encode()
+		}
+		if !o.isMem() || o.base != nil || o.index != nil || o.rip || o.disp.sym == "" { return nil, fmt.Errorf("%s needs a label", op) }
+		if op == "jmp" { return &stmt{branch: &branch{cc: -1, target: o.disp}}, nil }
+		return &stmt{bytes: []byte{0xE8, 0, 0, 0, 0}, fixups: []fixup{{at: 1, size: 4, typ: elf.R_X86_64_PLT32, val: expr{o.disp.sym, o.disp.off - 4}}}}, nil
+	case "push", "pop":
+		if err := count(ops, 1, op); err != nil { return nil, err }
+		o := ops[0]
+		switch {
+		case o.isGPR():
+			if o.reg.size != 8 { return nil, fmt.Errorf("%s needs a 64-bit register", op) }
+			opcode := map[string]byte{"push": 0x50, "pop": 0x58}[op]
+			return (&inst{opcode: []byte{opcode}, plusReg: &o.reg}).encode()
+		case o.isMem():
+			if op == "push" { return (&inst{opcode: []byte{0xFF}, reg: 6, rm: &o}).encode() }
+			return (&inst{opcode: []byte{0x8F}, reg: 0, rm: &o}).encode()
+		case op == "push" && o.imm.sym == "" && o.imm.off == int64(int8(o.imm.off)):
+			return (&inst{opcode: []byte{0x6A}, imm: immOf(o), immSize: 1}).encode()
+		case op == "push":
+			return (&inst{opcode: []byte{0x68}, imm: immOf(o), immSize: 4, immType: elf.R_X86_64_32S}).encode()
+		}
+		return nil, fmt.Errorf("cannot pop into an immediate")
+	}
+
+	size, err := opSize(suffix, ops)
+	if err != nil { return nil, err }
+	byteRegs := gprs(ops)
+	switch op {
+	case "movzx", "movsx", "movsxd":
+		if len(ops) != 2 || !ops[1].isGPR() { return nil, fmt.Errorf("%s needs a register destination", op) }
+		from := suffix
+		if ops[0].isGPR() { from = ops[0].reg.size }
+		if op == "movsxd" { from = 4 }
+		name := map[string]string{"movzx": "movz", "movsx": "movs", "movsxd": "movs"}[op] + string("?bw?l"[from]) + string("??w?l???q"[ops[1].reg.size])
+		ext, ok := extendOps[name]
+		if !ok { return nil, fmt.Errorf("unsupported extension %s", op) }
+		return extend(ext.from, ext.to, ext.opcode, ops)
+	case "lea":
+		if err := count(ops, 2, op); err != nil { return nil, err }
+		if !ops[0].isMem() || !ops[1].isGPR() { return nil, fmt.Errorf("lea goes from memory to a register") }
+		size = ops[1].reg.size
+		if suffix != 0 && suffix != size { return nil, fmt.Errorf("register of the wrong size for lea") }
+		return (&inst{opcode: []byte{0x8D}, reg: ops[1].reg.num, rm: ptr(ops[0])}).sized(size).encode()
+	}
+	if err := checkRegs(size, ops, shiftCountIndex(op, ops)...); err != nil { return nil, err }
+
+	wide := byte(1)
+	if size == 1 { wide = 0 }
+	immSize := min(size, 4)
+	switch {
+	case op == "mov" || op == "movabs":
+		if err := count(ops, 2, op); err != nil { return nil, err }
+		src, dst := ops[0], ops[1]
+		switch {
+		case src.isImm() && dst.isGPR():
+			e := src.imm
+			switch {
+			case op == "movabs" || size == 8 && e.sym == "" && e.off != int64(int32(e.off)):
+				if size != 8 { return nil, fmt.Errorf("movabs needs a 64-bit register") }
+				return (&inst{w: true, opcode: []byte{0xB8}, plusReg: &dst.reg, imm: &e, immSize: 8, immType: elf.R_X86_64_64}).encode()
+			case size == 8:
+				return (&inst{w: true, opcode: []byte{0xC7}, rm: &dst, imm: &e, immSize: 4, immType: elf.R_X86_64_32S}).encode()
+			case size == 1:
+				return (&inst{opcode: []byte{0xB0}, plusReg: &dst.reg, imm: &e, immSize: 1, byteRegs: byteRegs}).encode()
+			}
+			return (&inst{opcode: []byte{0xB8}, plusReg: &dst.reg, imm: &e, immSize: immSize, immType: elf.R_X86_64_32}).sized(size).encode()
+		case src.isImm() && dst.isMem():
+			typ := uint32(elf.R_X86_64_32)
+			if size == 8 { typ = elf.R_X86_64_32S }
+			return (&inst{opcode: []byte{0xC6 + wide}, rm: &dst, imm: immOf(src), immSize: immSize, immType: typ}).sized(size).encode()
+		case src.isGPR() && dst.isRM():
+			return (&inst{opcode: []byte{0x88 + wide}, reg: src.reg.num, rm: &dst, byteRegs: byteRegs}).sized(size).encode()
+		case src.isMem() && dst.isGPR():
+			return (&inst{opcode: []byte{0x8A + wide}, reg: dst.reg.num, rm: &src, byteRegs: byteRegs}).sized(size).encode()
+		}
+		return nil, fmt.Errorf("unsupported operands for %s", op)
+	case op == "test":
+		if err := count(ops, 2, op); err != nil { return nil, err }
+		src, dst := ops[0], ops[1]
+		switch {
+		case src.isImm() && dst.isGPR() && dst.reg.num == 0:
+			return (&inst{opcode: []byte{0xA8 + wide}, imm: immOf(src), immSize: immSize, immType: elf.R_X86_64_32S}).sized(size).encode()
+		case src.isImm() && dst.isRM():
+			return (&inst{opcode: []byte{0xF6 + wide}, reg: 0, rm: &dst, imm: immOf(src), immSize: immSize, immType: elf.R_X86_64_32S}).sized(size).encode()
+		case src.isGPR() && dst.isRM():
+			return (&inst{opcode: []byte{0x84 + wide}, reg: src.reg.num, rm: &dst, byteRegs: byteRegs}).sized(size).encode()
+		case src.isMem() && dst.isGPR():
+			return (&inst{opcode: []byte{0x84 + wide}, reg: dst.reg.num, rm: &src, byteRegs: byteRegs}).sized(size).encode()
+		}
+		return nil, fmt.Errorf("unsupported operands for test")
+	case op == "xchg":
+		if err := count(ops, 2, op); err != nil { return nil, err }
+		r, m := ops[0], ops[1]
+		if !r.isGPR() { r, m = m, r }
+		if !r.isGPR() || !m.isRM() { return nil, fmt.Errorf("xchg needs a register") }
+		if m.isGPR() && m.reg.num == 0 { r, m = m, r }
+		if size > 1 && m.isGPR() && r.reg.num == 0 && !(size == 4 && m.reg.num == 0) {
+			// The exchanges with the accumulator are one byte, but for %eax with itself, which would be nop
+			return (&inst{opcode: []byte{0x90}, plusReg: &m.reg}).sized(size).encode()
+		}
+		return (&inst{opcode: []byte{0x86 + wide}, reg: r.reg.num, rm: &m, byteRegs: byteRegs}).sized(size).encode()
+	case op == "imul" && len(ops) > 1:
+		if len(ops) == 2 && ops[0].isImm() { ops = []operand{ops[0], ops[1], ops[1]} }
+		if len(ops) == 2 {
+			if !ops[0].isRM() || !ops[1].isGPR() || size == 1 { return nil, fmt.Errorf("unsupported operands for imul") }
+			return (&inst{opcode: []byte{0x0F, 0xAF}, reg: ops[1].reg.num, rm: ptr(ops[1-1])}).sized(size).encode()
+		}
+		if len(ops) != 3 || !ops[0].isImm() || !ops[1].isRM() || !ops[2].isGPR() || size == 1 { return nil, fmt.Errorf("unsupported operands for imul") }
+		if e := ops[0].imm; e.sym == "" && e.off == int64(int8(e.off)) {
+			return (&inst{opcode: []byte{0x6B}, reg: ops[2].reg.num, rm: ptr(ops[1]), imm: &e, immSize: 1}).sized(size).encode()
+		}
+		return (&inst{opcode: []byte{0x69}, reg: ops[2].reg.num, rm: ptr(ops[1]), imm: immOf(ops[0]), immSize: immSize, immType: elf.R_X86_64_32S}).sized(size).encode()
+	case op == "imul" || op == "inc" || op == "dec" || unaryOps[op] > 0:
+		if err := count(ops, 1, op); err != nil { return nil, err }
+		if !ops[0].isRM() { return nil, fmt.Errorf("%s needs a register or memory", op) }
+		if op == "inc" || op == "dec" {
+			return (&inst{opcode: []byte{0xFE + wide}, reg: map[string]uint8{"inc": 0, "dec": 1}[op], rm: ptr(ops[0]), byteRegs: byteRegs}).sized(size).encode()
+		}
+		ext := unaryOps[op]
+		if op == "imul" { ext = 5 }
+		return (&inst{opcode: []byte{0xF6 + wide}, reg: ext, rm: ptr(ops[0]), byteRegs: byteRegs}).sized(size).encode()
+	}
+	if ext, ok := shiftOps[op]; ok {
+		dst := ops[len(ops)-1]
+		if len(ops) < 1 || len(ops) > 2 || !dst.isRM() { return nil, fmt.Errorf("unsupported operands for %s", op) }
+		in := &inst{reg: ext, rm: &dst, byteRegs: byteRegs}
+		switch {
+		case len(ops) == 1 || ops[0].isImm() && ops[0].imm.sym == "" && ops[0].imm.off == 1: in.opcode = []byte{0xD0 + wide}
+		case ops[0].isImm():
+			in.opcode, in.imm, in.immSize = []byte{0xC0 + wide}, immOf(ops[0]), 1
+		case ops[0].isGPR() && ops[0].reg.num == 1 && ops[0].reg.size == 1 && !ops[0].reg.high:
+			in.opcode, in.byteRegs = []byte{0xD2 + wide}, gprs(ops[1:])
+		default: return nil, fmt.Errorf("shift counts are an immediate or %%cl")
+		}
+		return in.sized(size).encode()
+	}
+	if ext, ok := aluOps[op]; ok {
+		if err := count(ops, 2, op); err != nil { return nil, err }
+		src, dst := ops[0], ops[1]
+		switch {
+		case src.isImm() && dst.isRM():
+			typ := uint32(elf.R_X86_64_32)
+			if size == 8 { typ = elf.R_X86_64_32S }
+			e := src.imm
+			if size > 1 && e.sym == "" && e.off == int64(int8(e.off)) {
+				return (&inst{opcode: []byte{0x83}, reg: ext, rm: &dst, imm: &e, immSize: 1, byteRegs: byteRegs}).sized(size).encode()
+			}
+			if size == 4 && e.sym == "" && e.off > 0x7FFFFFFF && e.off <= 0xFFFFFFFF { e.off = int64(int32(e.off)) }
+			if dst.isGPR() && dst.reg.num == 0 {
+				// The accumulator has a shorter form without a ModRM byte
+				return (&inst{opcode: []byte{ext<<3 + 4 + wide}, imm: &e, immSize: immSize, immType: typ}).sized(size).encode()
+			}
+			return (&inst{opcode: []byte{0x80 + wide}, reg: ext, rm: &dst, imm: &e, immSize: immSize, immType: typ, byteRegs: byteRegs}).sized(size).encode()
+		case src.isGPR() && dst.isRM():
+			return (&inst{opcode: []byte{ext<<3 + wide}, reg: src.reg.num, rm: &dst, byteRegs: byteRegs}).sized(size).encode()
+		case src.isMem() && dst.isGPR():
+			return (&inst{opcode: []byte{ext<<3 + 2 + wide}, reg: dst.reg.num, rm: &src, byteRegs: byteRegs}).sized(size).encode()
+		}
+		return nil, fmt.Errorf("unsupported operands for %s", op)
+	}
+	return nil, fmt.Errorf("unsupported instruction %s", op)
+}
+
+// shiftCountIndex leaves out %cl, the count of a shift, from the registers that must be of the operation's size
+func shiftCountIndex(op string, ops []operand) []int {
+	if _, ok := shiftOps[op]; ok && len(ops) == 2 { return []int{0} }
+	return nil
+}
+
+// sse encodes the SSE instructions, and the moves and conversions between SSE and general purpose registers
+func sse(op string, ops []operand) (*stmt, bool, error) {
+	if e, ok := sseOps[op]; ok {
+		if e.store == 0 || op == "movsd" || op == "movss" {
+			if (op == "movsd" || op == "movss") && len(ops) == 0 { return nil, false, nil } // the string instructions
+		}
+		if err := count(ops, 2, op); err != nil { return nil, true, err }
+		var prefix []byte
+		if e.prefix != 0 { prefix = []byte{e.prefix} }
+		src, dst := ops[0], ops[1]
+		switch {
+		case src.isXMMRM() && dst.isXMM():
+			s, err := (&inst{prefix: prefix, opcode: []byte{0x0F, e.opcode}, reg: dst.reg.num, rm: &src}).encode()
+			return s, true, err
+		case e.store != 0 && src.isXMM() && dst.isMem():
+			s, err := (&inst{prefix: prefix, opcode: []byte{0x0F, e.store}, reg: src.reg.num, rm: &dst}).encode()
+			return s, true, err
+		}
+		return nil, true, fmt.Errorf("unsupported operands for %s", op)
+	}
+	switch {
+	case op == "movq" || op == "movd":
+		if len(ops) != 2 || !ops[0].isXMM() && !ops[1].isXMM() { return nil, false, nil }
+		src, dst := ops[0], ops[1]
+		wide := op == "movq"
+		var in *inst
+		switch {
+		case src.isXMM() && dst.isXMM() && wide: in = &inst{prefix: []byte{0xF3}, opcode: []byte{0x0F, 0x7E}, reg: dst.reg.num, rm: &src}
+		case dst.isXMM() && src.isMem() && wide: in = &inst{prefix: []byte{0xF3}, opcode: []byte{0x0F, 0x7E}, reg: dst.reg.num, rm: &src}
+		case src.isXMM() && dst.isMem() && wide: in = &inst{prefix: []byte{0x66}, opcode: []byte{0x0F, 0xD6}, reg: src.reg.num, rm: &dst}
+		case dst.isXMM() && src.isRM(): in = &inst{prefix: []byte{0x66}, w: wide, opcode: []byte{0x0F, 0x6E}, reg: dst.reg.num, rm: &src}
+		case src.isXMM() && dst.isRM(): in = &inst{prefix: []byte{0x66}, w: wide, opcode: []byte{0x0F, 0x7E}, reg: src.reg.num, rm: &dst}
+		default: return nil, true, fmt.Errorf("unsupported operands for %s", op)
+		}
+		size := map[bool]int{true: 8, false: 4}[wide]
+		if err := checkRegs(size, ops); err != nil { return nil, true, err }
+		s, err := in.encode()
+		return s, true, err
+	}
+	// cvtsi2ss, cvtsi2sd, and the conversions back, truncating or not, with an optional l or q suffix
+	for _, name := range []string{"cvtsi2ss", "cvtsi2sd", "cvttss2si", "cvttsd2si", "cvtss2si", "cvtsd2si"} {
+		rest, ok := strings.CutPrefix(op, name)
+		if !ok || len(rest) > 1 { continue }
+		suffix := 0
+		if rest != "" {
+			size, ok := suffixSizes[rest[0]]
+			if !ok || size < 4 { continue }
+			suffix = size
+		}
+		if err := count(ops, 2, op); err != nil { return nil, true, err }
+		src, dst := ops[0], ops[1]
+		prefix := byte(0xF3)
+		if strings.Contains(name, "sd") { prefix = 0xF2 }
+		var in *inst
+		if strings.HasPrefix(name, "cvtsi2") {
+			if !src.isRM() || !dst.isXMM() { return nil, true, fmt.Errorf("%s goes from a general purpose register or memory to an xmm register", op) }
+			in = &inst{prefix: []byte{prefix}, opcode: []byte{0x0F, 0x2A}, reg: dst.reg.num, rm: &src}
+		} else {
+			if !src.isXMMRM() || !dst.isGPR() { return nil, true, fmt.Errorf("%s goes from an xmm register or memory to a general purpose register", op) }
+			opcode := byte(0x2D)
+			if strings.HasPrefix(name, "cvtt") { opcode = 0x2C }
+			in = &inst{prefix: []byte{prefix}, opcode: []byte{0x0F, opcode}, reg: dst.reg.num, rm: &src}
+		}
+		size := suffix
+		if size == 0 {
+			size = 4
+			if regs := gprs(ops); len(regs) > 0 { size = regs[0].size }
+		}
+		if size != 4 && size != 8 { return nil, true, fmt.Errorf("%s needs a 32 or 64-bit operand", op) }
+		if err := checkRegs(size, ops); err != nil { return nil, true, err }
+		in.w = size == 8
+		s, err := in.encode()
+		return s, true, err
+	}
+	return nil, false, nil
+}
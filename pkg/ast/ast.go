@@ -25,6 +25,8 @@ const (
 	AddressOf
 	Ternary
 	Subscript
+	Slice
+	Len
 	AutoAlloc
 	MemberAccess
 	TypeCast
@@ -39,6 +41,8 @@ const (
 	ExtrnDecl
 	If
 	While
+	For
+	DoWhile
 	Return
 	Block
 	Goto
@@ -47,6 +51,7 @@ const (
 	Default
 	Break
 	Continue
+	Defer
 	Label
 	AsmStmt
 	Directive
@@ -68,6 +73,7 @@ const (
 	TYPE_VOID
 	TYPE_ARRAY
 	TYPE_STRUCT
+	TYPE_UNION // a struct whose fields all start at offset 0
 	TYPE_ENUM
 	TYPE_BOOL
 	TYPE_FLOAT
@@ -75,6 +81,8 @@ const (
 	TYPE_NIL
 	TYPE_LITERAL_INT
 	TYPE_LITERAL_FLOAT
+	TYPE_FUNC  // a pointer to a function, Base being its result
+	TYPE_SLICE // a pointer to the first of a number of elements of Base and that number, laid out as SliceHeader
 )
 
 type BxType struct {
@@ -86,8 +94,13 @@ type BxType struct {
 	StructTag   string
 	Fields      []*Node
 	EnumMembers []*Node
+	Params      []*BxType // of a function, followed by varargs when Variadic
+	Variadic    bool
 }
 
+// HasFields reports whether t is a struct or a union
+func (t *BxType) HasFields() bool { return t != nil && (t.Kind == TYPE_STRUCT || t.Kind == TYPE_UNION) }
+
 var (
 	TypeInt          = &BxType{Kind: TYPE_PRIMITIVE, Name: "int"}
 	TypeUint         = &BxType{Kind: TYPE_PRIMITIVE, Name: "uint"}
@@ -112,6 +125,12 @@ var (
 	TypeLiteralFloat = &BxType{Kind: TYPE_LITERAL_FLOAT, Name: "float"}
 )
 
+// SliceHeader is the struct a slice is laid out and passed as
+var SliceHeader = &BxType{Kind: TYPE_STRUCT, Name: "__gbc_slice", Fields: []*Node{
+	NewVarDecl(token.Token{}, "ptr", &BxType{Kind: TYPE_POINTER, Base: TypeVoid}, nil, nil, false, false, false),
+	NewVarDecl(token.Token{}, "len", TypeInt, nil, nil, false, false, false),
+}}
+
 type NumberNode struct{ Value int64 }
 type FloatNumberNode struct{ Value float64 }
 type StringNode struct{ Value string }
@@ -126,6 +145,8 @@ type IndirectionNode struct{ Expr *Node }
 type AddressOfNode struct{ LValue *Node }
 type TernaryNode struct{ Cond, ThenExpr, ElseExpr *Node }
 type SubscriptNode struct{ Array, Index *Node }
+type SliceNode struct{ Expr, Low, High *Node } // Expr[Low:High], either bound being optional
+type LenNode struct{ Expr *Node }
 type MemberAccessNode struct{ Expr, Member *Node }
 type TypeCastNode struct { Expr *Node; TargetType *BxType }
 type TypeOfNode struct{ Expr *Node }
@@ -160,6 +181,9 @@ type EnumDeclNode struct { Name string; Members []*Node }
 type ExtrnDeclNode struct { Names []*Node; ReturnType *BxType }
 type IfNode struct{ Cond, ThenBody, ElseBody *Node }
 type WhileNode struct{ Cond, Body *Node }
+// ForNode is `for (Init; Cond; Post) Body`, where Init is a statement and any of the three may be nil
+type ForNode struct{ Init, Cond, Post, Body *Node }
+type DoWhileNode struct{ Body, Cond *Node }
 type ReturnNode struct{ Expr *Node }
 type BlockNode struct { Stmts []*Node; IsSynthetic bool }
 type GotoNode struct{ Label string }
@@ -168,8 +192,11 @@ type CaseNode struct { Values []*Node; Body *Node }
 type DefaultNode struct{ Body *Node }
 type BreakNode struct{}
 type ContinueNode struct{}
+type DeferNode struct{ Expr *Node }
 type LabelNode struct { Name string; Stmt *Node }
-type AsmStmtNode struct{ Code string }
+type AsmStmtNode struct { Code string; Operands []AsmOperand; Clobbers []string }
+// AsmOperand binds an expression to an `__asm__` statement; Dir is "in", "out" or "inout"
+type AsmOperand struct { Dir string; Expr *Node }
 type DirectiveNode struct{ Name string }
 
 func newNode(tok token.Token, nodeType NodeType, data interface{}, children ...*Node) *Node {
@@ -225,6 +252,12 @@ func NewTernary(tok token.Token, cond, thenExpr, elseExpr *Node) *Node {
 func NewSubscript(tok token.Token, array, index *Node) *Node {
 	return newNode(tok, Subscript, SubscriptNode{Array: array, Index: index}, array, index)
 }
+func NewSlice(tok token.Token, expr, low, high *Node) *Node {
+	return newNode(tok, Slice, SliceNode{Expr: expr, Low: low, High: high}, expr, low, high)
+}
+func NewLen(tok token.Token, expr *Node) *Node {
+	return newNode(tok, Len, LenNode{Expr: expr}, expr)
+}
 func NewMemberAccess(tok token.Token, expr, member *Node) *Node {
 	return newNode(tok, MemberAccess, MemberAccessNode{Expr: expr, Member: member}, expr, member)
 }
@@ -309,6 +342,12 @@ func NewIf(tok token.Token, cond, thenBody, elseBody *Node) *Node {
 func NewWhile(tok token.Token, cond, body *Node) *Node {
 	return newNode(tok, While, WhileNode{Cond: cond, Body: body}, cond, body)
 }
+func NewFor(tok token.Token, init, cond, post, body *Node) *Node {
+	return newNode(tok, For, ForNode{Init: init, Cond: cond, Post: post, Body: body}, init, cond, post, body)
+}
+func NewDoWhile(tok token.Token, body, cond *Node) *Node {
+	return newNode(tok, DoWhile, DoWhileNode{Body: body, Cond: cond}, body, cond)
+}
 func NewReturn(tok token.Token, expr *Node) *Node {
 	return newNode(tok, Return, ReturnNode{Expr: expr}, expr)
 }
@@ -337,11 +376,18 @@ func NewDefault(tok token.Token, body *Node) *Node {
 }
 func NewBreak(tok token.Token) *Node    { return newNode(tok, Break, BreakNode{}) }
 func NewContinue(tok token.Token) *Node { return newNode(tok, Continue, ContinueNode{}) }
+func NewDefer(tok token.Token, expr *Node) *Node {
+	return newNode(tok, Defer, DeferNode{Expr: expr}, expr)
+}
 func NewLabel(tok token.Token, name string, stmt *Node) *Node {
 	return newNode(tok, Label, LabelNode{Name: name, Stmt: stmt}, stmt)
 }
-func NewAsmStmt(tok token.Token, code string) *Node {
-	return newNode(tok, AsmStmt, AsmStmtNode{Code: code})
+func NewAsmStmt(tok token.Token, code string, operands []AsmOperand, clobbers []string) *Node {
+	node := newNode(tok, AsmStmt, AsmStmtNode{Code: code, Operands: operands, Clobbers: clobbers})
+	for _, op := range operands {
+		op.Expr.Parent = node
+	}
+	return node
 }
 func NewDirective(tok token.Token, name string) *Node {
 	return newNode(tok, Directive, DirectiveNode{Name: name})
@@ -370,6 +416,10 @@ func FoldConstants(node *Node) *Node {
 		d.ThenExpr = FoldConstants(d.ThenExpr)
 		d.ElseExpr = FoldConstants(d.ElseExpr)
 		node.Data = d
+	case ForNode:
+		d.Init, d.Cond, d.Post, d.Body = FoldConstants(d.Init), FoldConstants(d.Cond), FoldConstants(d.Post), FoldConstants(d.Body)
+		node.Data = d
+	case DoWhileNode: d.Body = FoldConstants(d.Body); d.Cond = FoldConstants(d.Cond); node.Data = d
 	}
 
 	switch node.Type {
@@ -447,10 +497,22 @@ func TypeToString(t *BxType) string {
 		sb.WriteString("*")
 		sb.WriteString(TypeToString(t.Base))
 	case TYPE_ARRAY:
+		// An array is written with its size when it is a number, apart from a slice of the same elements
+		sb.WriteString("[")
+		if t.ArraySize != nil {
+			if size, ok := t.ArraySize.Data.(NumberNode); ok { fmt.Fprintf(&sb, "%d", size.Value) }
+		}
+		sb.WriteString("]")
+		sb.WriteString(TypeToString(t.Base))
+	case TYPE_SLICE:
 		sb.WriteString("[]")
 		sb.WriteString(TypeToString(t.Base))
-	case TYPE_STRUCT:
-		sb.WriteString("struct ")
+	case TYPE_STRUCT, TYPE_UNION:
+		if t.Kind == TYPE_UNION {
+			sb.WriteString("union ")
+		} else {
+			sb.WriteString("struct ")
+		}
 		if t.Name != "" {
 			sb.WriteString(t.Name)
 		} else if t.StructTag != "" {
@@ -471,6 +533,18 @@ func TypeToString(t *BxType) string {
 		sb.WriteString("untyped")
 	case TYPE_NIL:
 		sb.WriteString("nil")
+	case TYPE_FUNC:
+		sb.WriteString(TypeToString(t.Base))
+		sb.WriteString(" (*)(")
+		for i, param := range t.Params {
+			if i > 0 { sb.WriteString(", ") }
+			sb.WriteString(TypeToString(param))
+		}
+		if t.Variadic {
+			if len(t.Params) > 0 { sb.WriteString(", ") }
+			sb.WriteString("...")
+		}
+		sb.WriteString(")")
 	default:
 		sb.WriteString(fmt.Sprintf("<unknown_type_kind_%d>", t.Kind))
 	}
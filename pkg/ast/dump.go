@@ -0,0 +1,128 @@
+package ast
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/token"
+)
+
+var nodeTypeNames = [...]string{
+	Number: "Number", FloatNumber: "FloatNumber", String: "String", Ident: "Ident", Nil: "Nil",
+	Assign: "Assign", MultiAssign: "MultiAssign", BinaryOp: "BinaryOp", UnaryOp: "UnaryOp", PostfixOp: "PostfixOp",
+	FuncCall: "FuncCall", Indirection: "Indirection", AddressOf: "AddressOf", Ternary: "Ternary",
+	Subscript: "Subscript", Slice: "Slice", Len: "Len", AutoAlloc: "AutoAlloc", MemberAccess: "MemberAccess", TypeCast: "TypeCast",
+	TypeOf: "TypeOf", StructLiteral: "StructLiteral", ArrayLiteral: "ArrayLiteral", FuncDecl: "FuncDecl",
+	VarDecl: "VarDecl", MultiVarDecl: "MultiVarDecl", TypeDecl: "TypeDecl", EnumDecl: "EnumDecl",
+	ExtrnDecl: "ExtrnDecl", If: "If", While: "While", For: "For", DoWhile: "DoWhile", Return: "Return", Block: "Block", Goto: "Goto",
+	Switch: "Switch", Case: "Case", Default: "Default", Break: "Break", Continue: "Continue", Defer: "Defer", Label: "Label",
+	AsmStmt: "AsmStmt", Directive: "Directive",
+}
+
+func (t NodeType) String() string {
+	if t >= 0 && int(t) < len(nodeTypeNames) { return nodeTypeNames[t] }
+	return fmt.Sprintf("NodeType(%d)", int(t))
+}
+
+var opStrings = map[token.Type]string{
+	token.Eq: "=", token.Define: ":=",
+	token.PlusEq: "+=", token.MinusEq: "-=", token.StarEq: "*=", token.SlashEq: "/=", token.RemEq: "%=",
+	token.AndEq: "&=", token.OrEq: "|=", token.XorEq: "^=", token.ShlEq: "<<=", token.ShrEq: ">>=",
+	token.EqPlus: "=+", token.EqMinus: "=-", token.EqStar: "=*", token.EqSlash: "=/", token.EqRem: "=%",
+	token.EqAnd: "=&", token.EqOr: "=|", token.EqXor: "=^", token.EqShl: "=<<", token.EqShr: "=>>",
+	token.Plus: "+", token.Minus: "-", token.Star: "*", token.Slash: "/", token.Rem: "%",
+	token.And: "&", token.Or: "|", token.Xor: "^", token.Shl: "<<", token.Shr: ">>",
+	token.EqEq: "==", token.Neq: "!=", token.Lt: "<", token.Gt: ">", token.Gte: ">=", token.Lte: "<=",
+	token.AndAnd: "&&", token.OrOr: "||", token.Not: "!", token.Complement: "~", token.Inc: "++", token.Dec: "--",
+}
+
+// Dump writes node and everything below it to w as an indented tree, one node per line, followed by the type
+// the type checker gave it if any
+func Dump(w io.Writer, node *Node) { dump(w, node, 0) }
+
+func dump(w io.Writer, node *Node, depth int) {
+	if node == nil { return }
+	fmt.Fprintf(w, "%s%s", strings.Repeat("  ", depth), node.Type)
+
+	var children []*Node
+	switch d := node.Data.(type) {
+	case NumberNode: fmt.Fprintf(w, " %d", d.Value)
+	case FloatNumberNode: fmt.Fprintf(w, " %g", d.Value)
+	case StringNode: fmt.Fprintf(w, " %q", d.Value)
+	case IdentNode: fmt.Fprintf(w, " %s", d.Name)
+	case AssignNode:
+		fmt.Fprintf(w, " %s", opStrings[d.Op])
+		children = []*Node{d.Lhs, d.Rhs}
+	case MultiAssignNode:
+		fmt.Fprintf(w, " %s", opStrings[d.Op])
+		children = append(append(children, d.Lhs...), d.Rhs...)
+	case BinaryOpNode:
+		fmt.Fprintf(w, " %s", opStrings[d.Op])
+		children = []*Node{d.Left, d.Right}
+	case UnaryOpNode:
+		fmt.Fprintf(w, " %s", opStrings[d.Op])
+		children = []*Node{d.Expr}
+	case PostfixOpNode:
+		fmt.Fprintf(w, " %s", opStrings[d.Op])
+		children = []*Node{d.Expr}
+	case IndirectionNode: children = []*Node{d.Expr}
+	case AddressOfNode: children = []*Node{d.LValue}
+	case TernaryNode: children = []*Node{d.Cond, d.ThenExpr, d.ElseExpr}
+	case SubscriptNode: children = []*Node{d.Array, d.Index}
+	case SliceNode: children = []*Node{d.Expr, d.Low, d.High}
+	case LenNode: children = []*Node{d.Expr}
+	case MemberAccessNode: children = []*Node{d.Expr, d.Member}
+	case TypeCastNode:
+		fmt.Fprintf(w, " (%s)", TypeToString(d.TargetType))
+		children = []*Node{d.Expr}
+	case TypeOfNode: children = []*Node{d.Expr}
+	case StructLiteralNode: children = append([]*Node{d.TypeNode}, d.Values...)
+	case ArrayLiteralNode: children = d.Values
+	case FuncCallNode: children = append([]*Node{d.FuncExpr}, d.Args...)
+	case AutoAllocNode: children = []*Node{d.Size}
+	case FuncDeclNode:
+		fmt.Fprintf(w, " %s", d.Name)
+		if d.ReturnType != nil { fmt.Fprintf(w, " returns %s", TypeToString(d.ReturnType)) }
+		children = append(append(children, d.Params...), d.Body)
+	case VarDeclNode:
+		fmt.Fprintf(w, " %s", d.Name)
+		if d.Type != nil { fmt.Fprintf(w, " %s", TypeToString(d.Type)) }
+		if d.IsVector { fmt.Fprint(w, " vector") }
+		children = append([]*Node{d.SizeExpr}, d.InitList...)
+	case MultiVarDeclNode: children = d.Decls
+	case TypeDeclNode: fmt.Fprintf(w, " %s = %s", d.Name, TypeToString(d.Type))
+	case EnumDeclNode:
+		fmt.Fprintf(w, " %s", d.Name)
+		children = d.Members
+	case ExtrnDeclNode: children = d.Names
+	case IfNode: children = []*Node{d.Cond, d.ThenBody, d.ElseBody}
+	case WhileNode: children = []*Node{d.Cond, d.Body}
+	case ForNode: children = []*Node{d.Init, d.Cond, d.Post, d.Body}
+	case DoWhileNode: children = []*Node{d.Body, d.Cond}
+	case ReturnNode: children = []*Node{d.Expr}
+	case DeferNode: children = []*Node{d.Expr}
+	case BlockNode: children = d.Stmts
+	case GotoNode: fmt.Fprintf(w, " %s", d.Label)
+	case SwitchNode: children = []*Node{d.Expr, d.Body}
+	case CaseNode: children = append(append(children, d.Values...), d.Body)
+	case DefaultNode: children = []*Node{d.Body}
+	case LabelNode:
+		fmt.Fprintf(w, " %s", d.Name)
+		children = []*Node{d.Stmt}
+	case AsmStmtNode:
+		fmt.Fprintf(w, " %q", d.Code)
+		for _, op := range d.Operands {
+			fmt.Fprintf(w, " %s", op.Dir)
+			children = append(children, op.Expr)
+		}
+		if len(d.Clobbers) > 0 { fmt.Fprintf(w, " clobber%q", d.Clobbers) }
+	case DirectiveNode: fmt.Fprintf(w, " %q", d.Name)
+	}
+	if node.Typ != nil { fmt.Fprintf(w, " : %s", TypeToString(node.Typ)) }
+	fmt.Fprintln(w)
+
+	for _, child := range children {
+		dump(w, child, depth+1)
+	}
+}
@@ -83,6 +83,12 @@ type Flag struct {
 	Value        Value
 	DefValue     string
 	ExpectedType string
+	Changed      bool // whether the command line set it
+}
+
+func (f *Flag) set(s string) error {
+	f.Changed = true
+	return f.Value.Set(s)
 }
 
 type FlagGroup struct {
@@ -208,12 +214,12 @@ func (f *FlagSet) Parse(arguments []string) error {
 			if ok {
 				parts := strings.SplitN(arg[1:], "=", 2)
 				if len(parts) == 2 {
-					if err := flag.Value.Set(parts[1]); err != nil {
+					if err := flag.set(parts[1]); err != nil {
 						return err
 					}
 				} else {
 					if _, isBool := flag.Value.(*boolValue); isBool {
-						if err := flag.Value.Set(""); err != nil {
+						if err := flag.set(""); err != nil {
 							return err
 						}
 					} else {
@@ -221,7 +227,7 @@ func (f *FlagSet) Parse(arguments []string) error {
 							return fmt.Errorf("flag needs an argument: -%s", name)
 						}
 						i++
-						if err := flag.Value.Set(arguments[i]); err != nil {
+						if err := flag.set(arguments[i]); err != nil {
 							return err
 						}
 					}
@@ -247,22 +253,22 @@ func (f *FlagSet) parseLongFlag(arg string, arguments []string, i *int) error {
 		return fmt.Errorf("unknown flag: --%s", name)
 	}
 	if len(parts) == 2 {
-		return flag.Value.Set(parts[1])
+		return flag.set(parts[1])
 	}
 	if _, isBool := flag.Value.(*boolValue); isBool {
-		return flag.Value.Set("")
+		return flag.set("")
 	}
 	if *i+1 >= len(arguments) {
 		return fmt.Errorf("flag needs an argument: --%s", name)
 	}
 	*i++
-	return flag.Value.Set(arguments[*i])
+	return flag.set(arguments[*i])
 }
 
 func (f *FlagSet) parseShortFlag(arg string, arguments []string, i *int) error {
 	for prefix, flag := range f.specialPrefix {
 		if strings.HasPrefix(arg, "-"+prefix) && len(arg) > len(prefix)+1 {
-			return flag.Value.Set(arg[len(prefix)+1:])
+			return flag.set(arg[len(prefix)+1:])
 		}
 	}
 
@@ -272,7 +278,7 @@ func (f *FlagSet) parseShortFlag(arg string, arguments []string, i *int) error {
 		return fmt.Errorf("unknown shorthand flag: -%s", shorthand)
 	}
 	if _, isBool := flag.Value.(*boolValue); isBool {
-		return flag.Value.Set("")
+		return flag.set("")
 	}
 	value := arg[2:]
 	if value == "" {
@@ -282,7 +288,7 @@ func (f *FlagSet) parseShortFlag(arg string, arguments []string, i *int) error {
 		*i++
 		value = arguments[*i]
 	}
-	return flag.Value.Set(value)
+	return flag.set(value)
 }
 
 type App struct {
@@ -307,6 +313,12 @@ func (f *FlagSet) Lookup(name string) *Flag {
 	return f.flags[name]
 }
 
+// Changed tells whether the command line set the flag called name
+func (f *FlagSet) Changed(name string) bool {
+	flag, ok := f.flags[name]
+	return ok && flag.Changed
+}
+
 func (a *App) Run(arguments []string) error {
 	help := false
 	a.FlagSet.Bool(&help, "help", "h", false, "Display this information")
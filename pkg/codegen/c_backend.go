@@ -0,0 +1,969 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/ast"
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// The C backend lowers the IR to C99 that any C compiler can build: words are intptr_t, every temporary is a
+// local variable, OpAlloc is a local array, blocks are labels reached with goto and phis are copies made on the
+// edges into their block. Memory is only touched through memcpy, so the program may pun it as freely as on QBE
+// No C library header is included, since B programs and libb define functions named like libc ones
+
+type cBackend struct {
+	out       *strings.Builder
+	prog      *ir.Program
+	cfg       *config.Config
+	currentFn *ir.Func
+	temps     map[tempName]ir.Type // type of each temporary of the current function
+	allocs    map[*ir.Instruction]string
+	phis      map[string][]*ir.Instruction // phis of each block of the current function, by label
+	targets   map[string]bool              // labels of the current function that are jumped to
+	externs   map[string]ir.Type           // functions called but not defined, by return type
+	externRet map[string]*ir.StructLayout  // the struct those of them that return one by value return
+	structs   map[string]string            // C types of the structs passed by value, by their fields
+	rets      map[*ir.Instruction]string   // the local each call of the current function returns a struct to
+	lastLine  int
+}
+
+type tempName struct {
+	name string
+	id   int
+}
+
+func NewCBackend() Backend { return &cBackend{} }
+
+func init() {
+	Register(BackendInfo{
+		Name: "c", Description: "C99, compiled by the host cc", New: NewCBackend,
+		Triples:      true,
+		WordSizes:    []int{4, 8},
+		Capabilities: Capabilities{Floats: true, Asm: "gas", AsmStmt: true, Varargs: true, Libc: true, PIE: true},
+	})
+}
+
+func (b *cBackend) Generate(prog *ir.Program, cfg *config.Config) (*bytes.Buffer, error) {
+	source, err := b.GenerateIR(prog, cfg)
+	if err != nil { return nil, err }
+
+	asm, err := b.compileC(source)
+	if err != nil { return nil, err }
+	return bytes.NewBufferString(asm), nil
+}
+
+func (b *cBackend) GenerateIR(prog *ir.Program, cfg *config.Config) (string, error) {
+	var cBuilder strings.Builder
+	b.out = &cBuilder
+	b.prog = prog
+	b.cfg = cfg
+	b.lastLine = 0
+
+	b.gen()
+
+	return cBuilder.String(), nil
+}
+
+// compileC turns the C source into assembly with the host C compiler, to be linked like the other backends' output
+func (b *cBackend) compileC(source string) (string, error) {
+	cFile, err := os.CreateTemp("", "gbc-main-*.c")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file for C source: %w", err)
+	}
+	defer os.Remove(cFile.Name())
+	if _, err := cFile.WriteString(source); err != nil {
+		return "", fmt.Errorf("failed to write to temp file for C source: %w", err)
+	}
+	cFile.Close()
+
+	asmFile, err := os.CreateTemp("", "gbc-main-*.s")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file for assembly: %w", err)
+	}
+	asmFile.Close()
+	defer os.Remove(asmFile.Name())
+
+	args := []string{"-std=c99", "-O2", "-w", "-S", "-o", asmFile.Name(), cFile.Name()}
+	if b.cfg.DebugInfo { args[1] = "-O0"; args = append(args, "-g") }
+	cmd := exec.Command("cc", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("cc command failed: %w\n--- C source ---\n%s\n--- Output ---\n%s", err, source, string(output))
+	}
+
+	asmBytes, err := os.ReadFile(asmFile.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to read temporary assembly file: %w", err)
+	}
+	return string(asmBytes), nil
+}
+
+const cPrelude = `#include <stddef.h>
+#include <stdint.h>
+
+#if defined(__GNUC__)
+#define GBC_ALIGN(n) __attribute__((aligned(n)))
+#define gbc_memcpy __builtin_memcpy
+#define gbc_alloca __builtin_alloca
+#define gbc_fmod __builtin_fmod
+#define GBC_STR(x) #x
+#define GBC_XSTR(x) GBC_STR(x)
+#define GBC_ASM(name) __asm__(GBC_XSTR(__USER_LABEL_PREFIX__) name)
+#else
+#define GBC_ASM(name)
+#if __STDC_VERSION__ >= 201112L
+#define GBC_ALIGN(n) _Alignas(n)
+#else
+#define GBC_ALIGN(n)
+#endif
+#if defined(_MSC_VER)
+#include <malloc.h>
+#define gbc_alloca _alloca
+#else
+#include <alloca.h>
+#define gbc_alloca alloca
+#endif
+double fmod(double, double);
+#define gbc_fmod fmod
+static void *gbc_memcpy(void *dst, const void *src, size_t n) {
+	unsigned char *d = dst;
+	const unsigned char *s = src;
+	while (n--) *d++ = *s++;
+	return dst;
+}
+#endif
+
+#define GBC_LOAD(name, T) static inline T gbc_ld_##name(intptr_t p) { T v; gbc_memcpy(&v, (void *)p, sizeof v); return v; }
+#define GBC_STORE(name, T) static inline void gbc_st_##name(intptr_t p, T v) { gbc_memcpy((void *)p, &v, sizeof v); }
+GBC_LOAD(sb, int8_t) GBC_LOAD(ub, uint8_t) GBC_LOAD(sh, int16_t) GBC_LOAD(uh, uint16_t)
+GBC_LOAD(w, int32_t) GBC_LOAD(l, int64_t) GBC_LOAD(p, intptr_t) GBC_LOAD(s, float) GBC_LOAD(d, double)
+GBC_STORE(b, uint8_t) GBC_STORE(h, uint16_t) GBC_STORE(w, int32_t) GBC_STORE(l, int64_t) GBC_STORE(p, intptr_t)
+GBC_STORE(s, float) GBC_STORE(d, double)
+
+/* Reinterpret the bits of a value as another type of the same size */
+static inline int64_t gbc_d2l(double v) { int64_t r; gbc_memcpy(&r, &v, sizeof r); return r; }
+static inline double gbc_l2d(int64_t v) { double r; gbc_memcpy(&r, &v, sizeof r); return r; }
+static inline int32_t gbc_s2w(float v) { int32_t r; gbc_memcpy(&r, &v, sizeof r); return r; }
+static inline float gbc_w2s(int32_t v) { float r; gbc_memcpy(&r, &v, sizeof r); return r; }
+`
+
+func (b *cBackend) gen() {
+	b.out.WriteString("/* Generated by gbc */\n")
+	b.out.WriteString(cPrelude)
+
+	b.collectExterns()
+	b.genStructTypes()
+	b.genStrings()
+	b.genDataTypes()
+	b.genDeclarations()
+	for _, g := range b.prog.Globals {
+		b.genGlobal(g)
+	}
+	for _, fn := range b.prog.Funcs {
+		b.genFunc(fn)
+	}
+	b.genMain()
+}
+
+// cKeywords are the names a B program may use that C reserves, along with those of the prelude's types
+var cKeywords = map[string]bool{
+	"auto": true, "break": true, "case": true, "char": true, "const": true, "continue": true, "default": true,
+	"do": true, "double": true, "else": true, "enum": true, "extern": true, "float": true, "for": true, "goto": true,
+	"if": true, "inline": true, "int": true, "long": true, "register": true, "restrict": true, "return": true,
+	"short": true, "signed": true, "sizeof": true, "static": true, "struct": true, "switch": true, "typedef": true,
+	"union": true, "unsigned": true, "void": true, "volatile": true, "while": true, "_Bool": true, "_Complex": true,
+	"_Imaginary": true, "size_t": true, "ptrdiff_t": true, "wchar_t": true, "intptr_t": true, "uintptr_t": true,
+	"int8_t": true, "uint8_t": true, "int16_t": true, "uint16_t": true, "int32_t": true, "uint32_t": true,
+	"int64_t": true, "uint64_t": true, "alloca": true, "fmod": true,
+}
+
+// ident is the C name of a global symbol; main becomes gbc_main, called from the C main
+func (b *cBackend) ident(name string) string {
+	if name == "main" { return "gbc_main" }
+	if cKeywords[name] { return name + "_" }
+	return safeCName(name)
+}
+
+// linkName keeps the symbol of name when ident had to rename it, so that it links against other objects
+func (b *cBackend) linkName(name string) string {
+	if name == "main" || b.ident(name) == name { return "" }
+	return fmt.Sprintf(" GBC_ASM(%s)", strconv.Quote(name))
+}
+
+func safeCName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' { return r }
+		return '_'
+	}, name)
+}
+
+func (b *cBackend) isData(name string) bool {
+	for _, g := range b.prog.Globals {
+		if g.Name == name { return true }
+	}
+	return false
+}
+
+// collectExterns finds the functions used but not defined by the program, with the type they return
+// An extrn that is only ever loaded from is a variable, declared by genDeclarations
+func (b *cBackend) collectExterns() {
+	b.externs = make(map[string]ir.Type)
+	b.externRet = make(map[string]*ir.StructLayout)
+	for _, name := range b.prog.ExtrnFuncs {
+		b.externs[name] = ir.TypeNone
+	}
+	called := make(map[string]bool)
+	for _, fn := range b.prog.Funcs {
+		for _, block := range fn.Blocks {
+			for _, instr := range block.Instructions {
+				for i, arg := range instr.Args {
+					g, ok := arg.(*ir.Global)
+					if !ok { continue }
+					isCall := i == 0 && instr.Op == ir.OpCall
+					if isCall { called[g.Name] = true }
+					if isCall && instr.RetStruct != nil { b.externRet[g.Name] = instr.RetStruct }
+					if _, known := b.externs[g.Name]; !known || (isCall && b.externs[g.Name] == ir.TypeNone) {
+						typ := ir.TypeNone
+						if isCall { typ = instr.Typ }
+						b.externs[g.Name] = typ
+					}
+				}
+			}
+		}
+	}
+	for name := range b.externs {
+		if _, isString := b.prog.IsStringLabel(name); isString || b.isData(name) || b.prog.FindFunc(name) != nil || b.prog.ExtrnVars[name] && !called[name] {
+			delete(b.externs, name)
+		}
+	}
+}
+
+// genStructTypes defines a C struct for each struct the program passes or returns by value, with the fields it
+// flattens to, for the C compiler to pass it by the calling convention of the target
+func (b *cBackend) genStructTypes() {
+	b.structs = make(map[string]string)
+	var layouts []*ir.StructLayout
+	for _, fn := range b.prog.Funcs {
+		layouts = append(layouts, fn.RetStruct)
+		for _, p := range fn.Params {
+			layouts = append(layouts, p.Struct)
+		}
+		for _, block := range fn.Blocks {
+			for _, instr := range block.Instructions {
+				layouts = append(layouts, instr.RetStruct)
+				layouts = append(layouts, instr.ArgStructs...)
+			}
+		}
+	}
+	for _, layout := range layouts {
+		if layout == nil { continue }
+		decl := b.structDecl(layout.Type)
+		if _, defined := b.structs[decl]; defined { continue }
+		keyword, body, _ := strings.Cut(decl, " ")
+		name := fmt.Sprintf("%s gbc_s%d", keyword, len(b.structs))
+		if len(b.structs) == 0 { b.out.WriteString("\n/* --- Structs Passed by Value --- */\n") }
+		fmt.Fprintf(b.out, "%s %s;\n", name, body)
+		b.structs[decl] = name
+	}
+}
+
+// structDecl declares a struct or union in C as the program lays it out, with its members numbered, so that the C
+// compiler passes it by value as the C ABI of the target does
+func (b *cBackend) structDecl(t *ast.BxType) string {
+	keyword := "struct"
+	if t.Kind == ast.TYPE_UNION { keyword = "union" }
+	var fields strings.Builder
+	for i, field := range t.Fields {
+		fmt.Fprintf(&fields, " %s;", b.memberDecl(field.Data.(ast.VarDeclNode).Type, fmt.Sprintf("f%d", i)))
+	}
+	return keyword + " {" + fields.String() + " }"
+}
+
+func (b *cBackend) memberDecl(t *ast.BxType, name string) string {
+	t = b.prog.ResolveType(t)
+	switch {
+	case t.HasFields(): return b.structDecl(t) + " " + name
+	case t != nil && t.Kind == ast.TYPE_SLICE: return b.structDecl(ast.SliceHeader) + " " + name
+	case t != nil && t.Kind == ast.TYPE_ARRAY && t.ArraySize != nil:
+		if n, ok := ast.FoldConstants(t.ArraySize).Data.(ast.NumberNode); ok { return b.memberDecl(t.Base, fmt.Sprintf("%s[%d]", name, n.Value)) }
+	}
+	return b.dataType(ir.DataItem{Typ: ir.GetType(t, b.prog.WordSize)}) + " " + name
+}
+
+// structType is the C type genStructTypes defined for a struct
+func (b *cBackend) structType(s *ir.StructLayout) string { return b.structs[b.structDecl(s.Type)] }
+
+func (b *cBackend) genStrings() {
+	if len(b.prog.Strings) == 0 { return }
+	labels := make([]string, 0, len(b.prog.Strings))
+	values := make(map[string]string, len(b.prog.Strings))
+	for s, label := range b.prog.Strings {
+		labels = append(labels, label)
+		values[label] = s
+	}
+	sort.Strings(labels)
+
+	b.out.WriteString("\n/* --- String Literals --- */\n")
+	for _, label := range labels {
+		fmt.Fprintf(b.out, "static char gbc_%s[] = %s;\n", safeCName(label), cQuote(values[label]))
+	}
+}
+
+// cQuote writes s as a C string literal, escaping everything but printable ASCII, and '?' against trigraphs
+func cQuote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\' || c == '?': sb.WriteByte('\\'); sb.WriteByte(c)
+		case c == '\n': sb.WriteString("\\n")
+		case c == '\t': sb.WriteString("\\t")
+		case c >= 0x20 && c < 0x7f: sb.WriteByte(c)
+		default: fmt.Fprintf(&sb, "\\%03o", c)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// genDataTypes declares every global as a packed struct with a field per data item, so that it is laid out as
+// QBE lays out data, then declares the globals themselves so that initializers can refer to any of them
+func (b *cBackend) genDataTypes() {
+	if len(b.prog.Globals) == 0 { return }
+	b.out.WriteString("\n/* --- Global Variables --- */\n#pragma pack(push, 1)\n")
+	for _, g := range b.prog.Globals {
+		fmt.Fprintf(b.out, "struct gbc_%s {", b.ident(g.Name))
+		for i, item := range g.Items {
+			if item.Count > 0 {
+				fmt.Fprintf(b.out, " unsigned char z%d[%d];", i, b.zeroSize(item))
+			} else {
+				fmt.Fprintf(b.out, " %s f%d;", b.dataType(item), i)
+			}
+		}
+		b.out.WriteString(" };\n")
+	}
+	b.out.WriteString("#pragma pack(pop)\n")
+	for _, g := range b.prog.Globals {
+		fmt.Fprintf(b.out, "%sstatic struct gbc_%s %s;\n", b.align(g), b.ident(g.Name), b.ident(g.Name))
+	}
+}
+
+func (b *cBackend) zeroSize(item ir.DataItem) int64 {
+	if item.Typ == ir.TypeB { return int64(item.Count) }
+	return int64(item.Count) * ir.SizeOfType(item.Typ, b.prog.WordSize)
+}
+
+// dataType is the C type of an initialized data item; addresses need a pointer type to be constant in C
+func (b *cBackend) dataType(item ir.DataItem) string {
+	if _, isAddr := item.Value.(*ir.Global); isAddr { return "void *" }
+	switch item.Typ {
+	case ir.TypeB, ir.TypeSB, ir.TypeUB: return "uint8_t"
+	case ir.TypeH, ir.TypeSH, ir.TypeUH: return "uint16_t"
+	}
+	return b.cType(item.Typ)
+}
+
+func (b *cBackend) align(g *ir.Data) string {
+	if g.Align <= 1 { return "" }
+	return fmt.Sprintf("GBC_ALIGN(%d) ", g.Align)
+}
+
+// genDeclarations declares the extrn variables and functions the program uses and prototypes its own functions
+func (b *cBackend) genDeclarations() {
+	var names []string
+	for name := range b.prog.ExtrnVars {
+		if _, isFunc := b.externs[name]; !isFunc && !b.isData(name) && b.prog.FindFunc(name) == nil { names = append(names, name) }
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		b.out.WriteString("\n/* --- External Variables --- */\n")
+		for _, name := range names {
+			fmt.Fprintf(b.out, "extern intptr_t %s%s;\n", b.ident(name), b.linkName(name))
+		}
+	}
+
+	names = names[:0]
+	for name := range b.externs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		// Declared without a prototype, so that arguments are passed as to a variadic function
+		b.out.WriteString("\n/* --- External Functions --- */\n")
+		for _, name := range names {
+			ret := b.returnType(b.externs[name])
+			if s := b.externRet[name]; s != nil { ret = b.structType(s) }
+			fmt.Fprintf(b.out, "%s %s()%s;\n", ret, b.ident(name), b.linkName(name))
+		}
+	}
+
+	if len(b.prog.Funcs) > 0 {
+		b.out.WriteString("\n/* --- Functions --- */\n")
+		for _, fn := range b.prog.Funcs {
+			fmt.Fprintf(b.out, "%s%s;\n", b.signature(fn), b.linkName(fn.Name))
+		}
+	}
+}
+
+func (b *cBackend) returnType(t ir.Type) string {
+	if t == ir.TypeNone { return "intptr_t" }
+	return b.cType(t)
+}
+
+func (b *cBackend) signature(fn *ir.Func) string {
+	ret := "void"
+	if fn.ReturnType != ir.TypeNone { ret = b.cType(fn.ReturnType) }
+	if fn.RetStruct != nil { ret = b.structType(fn.RetStruct) }
+	var params []string
+	for _, p := range fn.Params {
+		if p.Struct != nil {
+			params = append(params, fmt.Sprintf("%s %s_s", b.structType(p.Struct), b.value(p.Val)))
+			continue
+		}
+		params = append(params, fmt.Sprintf("%s %s", b.cType(p.Typ), b.value(p.Val)))
+	}
+	if fn.HasVarargs { params = append(params, "...") }
+	if len(params) == 0 { params = []string{"void"} }
+	return fmt.Sprintf("%s %s(%s)", ret, b.ident(fn.Name), strings.Join(params, ", "))
+}
+
+func (b *cBackend) genGlobal(g *ir.Data) {
+	fmt.Fprintf(b.out, "%sstatic struct gbc_%s %s = {", b.align(g), b.ident(g.Name), b.ident(g.Name))
+	for i, item := range g.Items {
+		if i > 0 { b.out.WriteString(",") }
+		if item.Count > 0 {
+			b.out.WriteString(" {0}")
+			continue
+		}
+		b.out.WriteString(" ")
+		if glob, isAddr := item.Value.(*ir.Global); isAddr {
+			b.out.WriteString(b.address(glob.Name, "void *"))
+		} else {
+			b.out.WriteString(b.value(item.Value))
+		}
+	}
+	b.out.WriteString(" };\n")
+}
+
+// address is the address of a global symbol as a constant of type t
+func (b *cBackend) address(name, t string) string {
+	if _, isString := b.prog.IsStringLabel(name); isString { return fmt.Sprintf("(%s)gbc_%s", t, safeCName(name)) }
+	return fmt.Sprintf("(%s)&%s", t, b.ident(name))
+}
+
+// cType is the C type of a temporary, a parameter or a data item of type t
+// Sub-word values are held in full words, as QBE holds them
+func (b *cBackend) cType(t ir.Type) string {
+	switch t {
+	case ir.TypeW: return "int32_t"
+	case ir.TypeL: return "int64_t"
+	case ir.TypeS: return "float"
+	case ir.TypeD: return "double"
+	}
+	return "intptr_t"
+}
+
+func (b *cBackend) unsignedType(t ir.Type) string {
+	switch t {
+	case ir.TypeW: return "uint32_t"
+	case ir.TypeL: return "uint64_t"
+	}
+	return "uintptr_t"
+}
+
+// bits is the width of the integers of type t once they are held in a temporary
+func (b *cBackend) bits(t ir.Type) int {
+	switch t {
+	case ir.TypeW: return 32
+	case ir.TypeL: return 64
+	}
+	return b.prog.WordSize * 8
+}
+
+func (b *cBackend) genFunc(fn *ir.Func) {
+	b.currentFn = fn
+	b.temps = make(map[tempName]ir.Type)
+	b.allocs = make(map[*ir.Instruction]string)
+	b.phis = make(map[string][]*ir.Instruction)
+	b.targets = make(map[string]bool)
+	b.rets = make(map[*ir.Instruction]string)
+
+	var allocs []string
+	for _, p := range fn.Params {
+		b.defineTemp(p.Val, p.Typ)
+	}
+	for _, block := range fn.Blocks {
+		for _, instr := range block.Instructions {
+			if instr.Result != nil { b.defineTemp(instr.Result, resultType(instr, b.prog.WordSize)) }
+			switch instr.Op {
+			case ir.OpAsm:
+				for _, op := range instr.Asm.Operands {
+					b.defineTemp(op.Out, ir.GetType(nil, b.prog.WordSize))
+				}
+			case ir.OpAlloc:
+				if size, ok := instr.Args[0].(*ir.Const); ok {
+					name := fmt.Sprintf("gbc_a%d", len(b.allocs))
+					b.allocs[instr] = name
+					allocs = append(allocs, fmt.Sprintf("\t%sunsigned char %s[%d];\n", b.align(&ir.Data{Align: instr.Align}), name, max(size.Value, 1)))
+				}
+			case ir.OpCall:
+				if instr.RetStruct != nil {
+					name := fmt.Sprintf("gbc_r%d", len(b.rets))
+					b.rets[instr] = name
+					allocs = append(allocs, fmt.Sprintf("\t%s %s;\n", b.structType(instr.RetStruct), name))
+				}
+			case ir.OpPhi: b.phis[block.Label.Name] = append(b.phis[block.Label.Name], instr)
+			case ir.OpJmp: b.targets[instr.Args[0].String()] = true
+			case ir.OpJnz: b.targets[instr.Args[1].String()], b.targets[instr.Args[2].String()] = true, true
+			}
+		}
+	}
+
+	fmt.Fprintf(b.out, "\n%s {\n", b.signature(fn))
+	b.out.WriteString(strings.Join(allocs, ""))
+	b.genTempDecls(fn)
+	for _, p := range fn.Params {
+		if p.Struct != nil { fmt.Fprintf(b.out, "\t%s = (intptr_t)&%s_s;\n", b.value(p.Val), b.value(p.Val)) }
+	}
+
+	for i, block := range fn.Blocks {
+		if b.targets[block.Label.Name] { fmt.Fprintf(b.out, "%s:;\n", b.label(block.Label.Name)) }
+		terminated := false
+		for _, instr := range block.Instructions {
+			if instr.Op == ir.OpPhi { continue }
+			b.genInstr(block, instr)
+			if instr.Op == ir.OpJmp || instr.Op == ir.OpJnz || instr.Op == ir.OpRet {
+				terminated = true
+				break
+			}
+		}
+		// A block without a jump falls through to the next, or returns from the last
+		if !terminated {
+			if i+1 < len(fn.Blocks) {
+				b.genPhiMoves(block, fn.Blocks[i+1].Label.Name, "\t")
+			} else if fn.ReturnType == ir.TypeNone {
+				b.out.WriteString("\treturn;\n")
+			} else if fn.RetStruct != nil {
+				fmt.Fprintf(b.out, "\treturn (%s){0};\n", b.structType(fn.RetStruct))
+			} else {
+				b.out.WriteString("\treturn 0;\n")
+			}
+		}
+	}
+	b.out.WriteString("}\n")
+}
+
+// resultType is the type of the value an instruction leaves in its result
+// Comparisons yield a word, and sub-word loads are extended to one as on QBE
+func resultType(instr *ir.Instruction, wordSize int) ir.Type {
+	switch {
+	case instr.Op >= ir.OpCEq && instr.Op <= ir.OpCGe: return ir.GetType(nil, wordSize)
+	case instr.Op == ir.OpLoad && ir.SizeOfType(instr.Typ, wordSize) < 4: return ir.GetType(nil, wordSize)
+	}
+	return instr.Typ
+}
+
+func (b *cBackend) defineTemp(v ir.Value, t ir.Type) {
+	tmp, ok := v.(*ir.Temporary)
+	if !ok || tmp == nil { return }
+	key := tempName{tmp.Name, tmp.ID}
+	if _, defined := b.temps[key]; !defined { b.temps[key] = t }
+}
+
+// genTempDecls declares the temporaries of fn that are not parameters, grouped by type, and a shadow for each
+// phi result that edges into its block write first
+func (b *cBackend) genTempDecls(fn *ir.Func) {
+	params := make(map[string]bool)
+	for _, p := range fn.Params {
+		params[b.value(p.Val)] = p.Struct == nil
+	}
+	byType := make(map[string][]string)
+	for key, t := range b.temps {
+		name := b.value(&ir.Temporary{Name: key.name, ID: key.id})
+		if params[name] { continue }
+		byType[b.cType(t)] = append(byType[b.cType(t)], name)
+	}
+	for _, phis := range b.phis {
+		for _, phi := range phis {
+			cType := b.cType(b.typeOf(phi.Result))
+			byType[cType] = append(byType[cType], b.value(phi.Result)+"_phi")
+		}
+	}
+	cTypes := make([]string, 0, len(byType))
+	for t := range byType {
+		cTypes = append(cTypes, t)
+	}
+	sort.Strings(cTypes)
+	for _, t := range cTypes {
+		names := byType[t]
+		sort.Strings(names)
+		fmt.Fprintf(b.out, "\t%s %s;\n", t, strings.Join(names, ", "))
+	}
+}
+
+func (b *cBackend) label(name string) string { return "L_" + safeCName(name) }
+
+// genPhiMoves copies the values the phis of block to take on the edge from block from, in two steps so that
+// phis reading each other see the values from before the edge
+func (b *cBackend) genPhiMoves(from *ir.BasicBlock, to, indent string) {
+	phis := b.phis[to]
+	if len(phis) == 0 { return }
+	for _, phi := range phis {
+		for i := 0; i+1 < len(phi.Args); i += 2 {
+			if phi.Args[i].String() == from.Label.Name {
+				fmt.Fprintf(b.out, "%s%s_phi = %s;\n", indent, b.value(phi.Result), b.operand(phi.Args[i+1], b.typeOf(phi.Result)))
+				break
+			}
+		}
+	}
+	for _, phi := range phis {
+		fmt.Fprintf(b.out, "%s%s = %s_phi;\n", indent, b.value(phi.Result), b.value(phi.Result))
+	}
+}
+
+func (b *cBackend) genJump(from *ir.BasicBlock, to, indent string) {
+	b.genPhiMoves(from, to, indent)
+	fmt.Fprintf(b.out, "%sgoto %s;\n", indent, b.label(to))
+}
+
+func (b *cBackend) genInstr(block *ir.BasicBlock, instr *ir.Instruction) {
+	if b.cfg.DebugInfo && instr.Pos.Line > 0 && instr.Pos.Line != b.lastLine {
+		if name := util.SourceFileName(instr.Pos.FileIndex); name != "" {
+			fmt.Fprintf(b.out, "#line %d %s\n", instr.Pos.Line, strconv.Quote(name))
+			b.lastLine = instr.Pos.Line
+		}
+	}
+
+	args, typ := instr.Args, instr.Typ
+	switch instr.Op {
+	case ir.OpJmp:
+		b.genJump(block, args[0].String(), "\t")
+		return
+	case ir.OpJnz:
+		fmt.Fprintf(b.out, "\tif (%s) {\n", b.operand(args[0], ir.TypeNone))
+		b.genJump(block, args[1].String(), "\t\t")
+		b.out.WriteString("\t}\n")
+		b.genJump(block, args[2].String(), "\t")
+		return
+	case ir.OpRet:
+		if s := b.currentFn.RetStruct; s != nil {
+			if c, ok := args[0].(*ir.Const); ok && c.Value == 0 {
+				fmt.Fprintf(b.out, "\treturn (%s){0};\n", b.structType(s))
+			} else {
+				fmt.Fprintf(b.out, "\treturn *(%s *)%s;\n", b.structType(s), b.operand(args[0], ir.TypePtr))
+			}
+		} else if len(args) == 0 || args[0] == nil || b.currentFn.ReturnType == ir.TypeNone {
+			b.out.WriteString("\treturn;\n")
+		} else {
+			fmt.Fprintf(b.out, "\treturn %s;\n", b.operand(args[0], b.currentFn.ReturnType))
+		}
+		return
+	case ir.OpStore:
+		fmt.Fprintf(b.out, "\tgbc_st_%s(%s, %s);\n", storeSuffix(typ), b.operand(args[1], ir.TypePtr), b.operand(args[0], typ))
+		return
+	case ir.OpBlit:
+		size := fmt.Sprint(ir.SizeOfType(typ, b.prog.WordSize))
+		if len(args) > 2 { size = b.operand(args[2], ir.TypePtr) }
+		fmt.Fprintf(b.out, "\tgbc_memcpy((void *)%s, (void *)%s, %s);\n", b.operand(args[1], ir.TypePtr), b.operand(args[0], ir.TypePtr), size)
+		return
+	case ir.OpAsm:
+		b.genAsm(instr)
+		return
+	}
+
+	var expr string
+	switch instr.Op {
+	case ir.OpAlloc:
+		if name, ok := b.allocs[instr]; ok {
+			expr = "(intptr_t)" + name
+		} else {
+			expr = fmt.Sprintf("(intptr_t)gbc_alloca(%s)", b.operand(args[0], ir.TypePtr))
+		}
+	case ir.OpLoad: expr = fmt.Sprintf("gbc_ld_%s(%s)", loadSuffix(typ), b.operand(args[0], ir.TypePtr))
+	case ir.OpCall: expr = b.call(instr)
+
+	case ir.OpAdd, ir.OpSub, ir.OpMul, ir.OpAnd, ir.OpOr, ir.OpXor, ir.OpShl, ir.OpShr, ir.OpDiv, ir.OpRem:
+		expr = b.arith(instr)
+	case ir.OpAddF, ir.OpSubF, ir.OpMulF, ir.OpDivF:
+		op := map[ir.Op]string{ir.OpAddF: "+", ir.OpSubF: "-", ir.OpMulF: "*", ir.OpDivF: "/"}[instr.Op]
+		expr = fmt.Sprintf("%s %s %s", b.operand(args[0], typ), op, b.operand(args[1], typ))
+	case ir.OpRemF: expr = fmt.Sprintf("gbc_fmod(%s, %s)", b.operand(args[0], typ), b.operand(args[1], typ))
+	case ir.OpNegF: expr = "-" + b.operand(args[0], typ)
+
+	case ir.OpCEq, ir.OpCNeq, ir.OpCLt, ir.OpCGt, ir.OpCLe, ir.OpCGe: expr = b.compare(instr)
+
+	case ir.OpExtSB: expr = "(int8_t)" + b.operand(args[0], ir.TypeNone)
+	case ir.OpExtUB: expr = "(uint8_t)" + b.operand(args[0], ir.TypeNone)
+	case ir.OpExtSH: expr = "(int16_t)" + b.operand(args[0], ir.TypeNone)
+	case ir.OpExtUH: expr = "(uint16_t)" + b.operand(args[0], ir.TypeNone)
+	case ir.OpExtSW: expr = "(int32_t)" + b.operand(args[0], ir.TypeNone)
+	case ir.OpExtUW: expr = "(uint32_t)" + b.operand(args[0], ir.TypeNone)
+	case ir.OpTrunc: expr = b.narrow(typ) + b.operand(args[0], ir.TypeNone)
+	case ir.OpCast: expr = b.operand(args[0], typ)
+
+	case ir.OpFToSI, ir.OpFToUI:
+		cast := map[bool]string{true: "(int64_t)", false: "(uint64_t)"}[instr.Op == ir.OpFToSI]
+		if typ == ir.TypeW { cast = map[bool]string{true: "(int32_t)", false: "(uint32_t)"}[instr.Op == ir.OpFToSI] }
+		expr = cast + b.operand(args[0], ir.TypeD)
+	case ir.OpSWToF: expr = fmt.Sprintf("(%s)(int32_t)%s", b.cType(typ), b.operand(args[0], ir.TypeNone))
+	case ir.OpUWToF: expr = fmt.Sprintf("(%s)(uint32_t)%s", b.cType(typ), b.operand(args[0], ir.TypeNone))
+	case ir.OpSLToF: expr = fmt.Sprintf("(%s)(int64_t)%s", b.cType(typ), b.operand(args[0], ir.TypeNone))
+	case ir.OpULToF: expr = fmt.Sprintf("(%s)(uint64_t)%s", b.cType(typ), b.operand(args[0], ir.TypeNone))
+	case ir.OpFToF:
+		// An operand of unknown type holds the other precision
+		from := b.typeOf(args[0])
+		if !isFloatIR(from) {
+			from = ir.TypeS
+			if typ == ir.TypeS { from = ir.TypeD }
+		}
+		expr = fmt.Sprintf("(%s)%s", b.cType(typ), b.operand(args[0], from))
+	default:
+		util.Error(instr.Pos, "internal: C backend cannot lower IR operation %d", instr.Op)
+	}
+
+	if instr.Result == nil {
+		fmt.Fprintf(b.out, "\t%s;\n", expr)
+		return
+	}
+	fmt.Fprintf(b.out, "\t%s = %s;\n", b.value(instr.Result), expr)
+}
+
+// genAsm writes an `__asm__` statement as an extended asm statement of GCC. The outputs are numbered before the
+// inputs there, and an inout operand is an output the input is copied to first
+func (b *cBackend) genAsm(instr *ir.Instruction) {
+	asm := instr.Asm
+	index := make([]int, len(asm.Operands))
+	var outs, ins, clobbers []string
+	for i, op := range asm.Operands {
+		if op.Out == nil { continue }
+		index[i] = len(outs)
+		constraint := "=&r"
+		if op.In != nil {
+			constraint = "+&r"
+			fmt.Fprintf(b.out, "\t%s = %s;\n", b.value(op.Out), b.operand(op.In, ir.TypeNone))
+		}
+		outs = append(outs, fmt.Sprintf("\"%s\"(%s)", constraint, b.value(op.Out)))
+	}
+	for i, op := range asm.Operands {
+		if op.In == nil || op.Out != nil { continue }
+		index[i] = len(outs) + len(ins)
+		ins = append(ins, fmt.Sprintf("\"r\"((intptr_t)%s)", b.operand(op.In, ir.TypeNone)))
+	}
+	for _, clobber := range asm.Clobbers {
+		clobbers = append(clobbers, cQuote(strings.TrimPrefix(clobber, "%")))
+	}
+	// '{', '|' and '}' pick between the assembler dialects of x86
+	escape := strings.NewReplacer("%", "%%")
+	if b.cfg.GOARCH == "amd64" || b.cfg.GOARCH == "386" { escape = strings.NewReplacer("%", "%%", "{", "%{", "|", "%|", "}", "%}") }
+	template := asm.Expand(func(n int) string { return "%" + strconv.Itoa(index[n]) }, escape.Replace)
+	fmt.Fprintf(b.out, "\t__asm__ __volatile__(%s : %s : %s : %s);\n", cQuote(template), strings.Join(outs, ", "), strings.Join(ins, ", "), strings.Join(clobbers, ", "))
+}
+
+func loadSuffix(t ir.Type) string {
+	switch t {
+	case ir.TypeSB: return "sb"
+	case ir.TypeB, ir.TypeUB: return "ub"
+	case ir.TypeSH: return "sh"
+	case ir.TypeH, ir.TypeUH: return "uh"
+	}
+	return storeSuffix(t)
+}
+
+func storeSuffix(t ir.Type) string {
+	switch t {
+	case ir.TypeB, ir.TypeSB, ir.TypeUB: return "b"
+	case ir.TypeH, ir.TypeSH, ir.TypeUH: return "h"
+	case ir.TypeW: return "w"
+	case ir.TypeL: return "l"
+	case ir.TypeS: return "s"
+	case ir.TypeD: return "d"
+	}
+	return "p"
+}
+
+// narrow is the cast that truncates a word to type t and extends it back, as results of sub-word type are
+func (b *cBackend) narrow(t ir.Type) string {
+	switch t {
+	case ir.TypeW: return "(int32_t)"
+	case ir.TypeSB: return "(int8_t)"
+	case ir.TypeB, ir.TypeUB: return "(uint8_t)"
+	case ir.TypeSH: return "(int16_t)"
+	case ir.TypeH, ir.TypeUH: return "(uint16_t)"
+	}
+	return ""
+}
+
+// arith lowers integer arithmetic, wrapping on overflow; shr is a logical shift
+func (b *cBackend) arith(instr *ir.Instruction) string {
+	t := instr.Typ
+	l, r := b.operand(instr.Args[0], ir.TypeNone), b.operand(instr.Args[1], ir.TypeNone)
+	sType, uType := b.cType(t), b.unsignedType(t)
+	switch instr.Op {
+	case ir.OpDiv: return fmt.Sprintf("(%s)%s / (%s)%s", sType, l, sType, r)
+	case ir.OpRem: return fmt.Sprintf("(%s)%s %% (%s)%s", sType, l, sType, r)
+	case ir.OpShl, ir.OpShr:
+		op := map[ir.Op]string{ir.OpShl: "<<", ir.OpShr: ">>"}[instr.Op]
+		return fmt.Sprintf("(%s)((%s)%s %s (%s & %d))", sType, uType, l, op, r, b.bits(t)-1)
+	}
+	op := map[ir.Op]string{ir.OpAdd: "+", ir.OpSub: "-", ir.OpMul: "*", ir.OpAnd: "&", ir.OpOr: "|", ir.OpXor: "^"}[instr.Op]
+	return fmt.Sprintf("(%s)((%s)%s %s (%s)%s)", sType, uType, l, op, uType, r)
+}
+
+// compare lowers a comparison of two operands of its operand type, which defaults to that of the operands
+func (b *cBackend) compare(instr *ir.Instruction) string {
+	l, r := instr.Args[0], instr.Args[1]
+	t := instr.OperandType
+	if t == ir.TypeNone {
+		t = b.typeOf(l)
+		if isFloatIR(b.typeOf(r)) { t = b.typeOf(r) }
+	}
+	op := map[ir.Op]string{ir.OpCEq: "==", ir.OpCNeq: "!=", ir.OpCLt: "<", ir.OpCGt: ">", ir.OpCLe: "<=", ir.OpCGe: ">="}[instr.Op]
+	if isFloatIR(t) { return fmt.Sprintf("%s %s %s", b.operand(l, t), op, b.operand(r, t)) }
+	cast := "(" + b.cType(t) + ")"
+	if t != ir.TypeW { cast = "(" + b.cType(ir.GetType(nil, b.prog.WordSize)) + ")" }
+	return fmt.Sprintf("%s%s %s %s%s", cast, b.operand(l, t), op, cast, b.operand(r, t))
+}
+
+// call lowers a call; arguments of sub-word type are extended to a word as QBE passes them
+// Functions of the program are called through their prototype, or through a pointer of the type the arguments
+// imply when their number differs; other functions are called as variadic ones
+func (b *cBackend) call(instr *ir.Instruction) string {
+	callee := instr.Args[0]
+	args := make([]string, len(instr.Args)-1)
+	argTypes := make([]string, len(args))
+	for i, arg := range instr.Args[1:] {
+		t := b.typeOf(arg)
+		if i < len(instr.ArgTypes) && instr.ArgTypes[i] != ir.TypeNone { t = instr.ArgTypes[i] }
+		if i < len(instr.ArgStructs) && instr.ArgStructs[i] != nil {
+			argTypes[i] = b.structType(instr.ArgStructs[i])
+			args[i] = fmt.Sprintf("*(%s *)%s", argTypes[i], b.operand(arg, ir.TypePtr))
+		} else if isFloatIR(t) {
+			args[i], argTypes[i] = b.operand(arg, t), b.cType(t)
+		} else if _, isAddr := arg.(*ir.Global); isAddr {
+			args[i], argTypes[i] = b.operand(arg, t), b.cType(ir.TypePtr)
+		} else {
+			args[i], argTypes[i] = "(intptr_t)"+b.narrow(t)+b.operand(arg, t), b.cType(ir.TypePtr)
+		}
+	}
+	retType := b.returnType(instr.Typ)
+	if instr.RetStruct != nil { retType = b.structType(instr.RetStruct) }
+
+	var fnExpr string
+	if g, ok := callee.(*ir.Global); ok {
+		fnExpr = b.ident(g.Name)
+		if fn := b.prog.FindFunc(g.Name); fn != nil && !fn.HasVarargs && len(fn.Params) != len(args) {
+			types := argTypes
+			if len(types) == 0 { types = []string{"void"} }
+			ret := "void"
+			if fn.ReturnType != ir.TypeNone { ret = b.cType(fn.ReturnType) }
+			if fn.RetStruct != nil { ret = b.structType(fn.RetStruct) }
+			fnExpr = fmt.Sprintf("((%s (*)(%s))%s)", ret, strings.Join(types, ", "), fnExpr)
+		}
+	} else if sig := instr.Sig; sig != nil && (!sig.Variadic || len(sig.Params) > 0) {
+		// A pointer with a signature is called through its prototype, so that its floats are not promoted
+		types := argTypes
+		if sig.Variadic {
+			n := min(len(sig.Params), len(argTypes))
+			types = append(argTypes[:n:n], "...")
+		}
+		if len(types) == 0 { types = []string{"void"} }
+		fnExpr = fmt.Sprintf("((%s (*)(%s))%s)", retType, strings.Join(types, ", "), b.operand(callee, ir.TypePtr))
+	} else {
+		fnExpr = fmt.Sprintf("((%s (*)())%s)", retType, b.operand(callee, ir.TypePtr))
+	}
+
+	call := fmt.Sprintf("%s(%s)", fnExpr, strings.Join(args, ", "))
+	if ret, ok := b.rets[instr]; ok { return fmt.Sprintf("(%s = %s, (intptr_t)&%s)", ret, call, ret) }
+	if instr.Result != nil { return b.narrow(instr.Typ) + call }
+	return call
+}
+
+func isFloatIR(t ir.Type) bool { return t == ir.TypeS || t == ir.TypeD }
+
+// typeOf is the type of a value: that of its temporary, or a word for integer constants and addresses
+func (b *cBackend) typeOf(v ir.Value) ir.Type {
+	switch val := v.(type) {
+	case *ir.Temporary:
+		if t, ok := b.temps[tempName{val.Name, val.ID}]; ok { return t }
+	case *ir.FloatConst:
+		if val.Typ == ir.TypeS { return ir.TypeS }
+		return ir.TypeD
+	case *ir.Global: return ir.TypePtr
+	case *ir.CastValue: return b.typeOf(val.Value)
+	}
+	return ir.TypeNone
+}
+
+// operand is a value used as type want: floats convert between precisions, while integers used as floats and
+// floats used as integers keep their bits, as QBE does; integers convert implicitly
+func (b *cBackend) operand(v ir.Value, want ir.Type) string {
+	have, s := b.typeOf(v), b.value(v)
+	switch {
+	case isFloatIR(want) && isFloatIR(have): return s
+	case want == ir.TypeD: return fmt.Sprintf("gbc_l2d(%s)", s)
+	case want == ir.TypeS: return fmt.Sprintf("gbc_w2s(%s)", s)
+	case have == ir.TypeD: return fmt.Sprintf("gbc_d2l(%s)", s)
+	case have == ir.TypeS: return fmt.Sprintf("gbc_s2w(%s)", s)
+	}
+	return s
+}
+
+func (b *cBackend) value(v ir.Value) string {
+	switch val := v.(type) {
+	case nil: return "0"
+	case *ir.Const:
+		switch {
+		case val.Value == math.MinInt64: return "(-INT64_C(9223372036854775807) - 1)"
+		case val.Value < math.MinInt32 || val.Value > math.MaxInt32: return fmt.Sprintf("INT64_C(%d)", val.Value)
+		case val.Value < 0: return fmt.Sprintf("(%d)", val.Value)
+		}
+		return fmt.Sprintf("%d", val.Value)
+	case *ir.FloatConst:
+		f := val.Value
+		switch {
+		case math.IsNaN(f): return "(0.0 / 0.0)"
+		case math.IsInf(f, 1): return "(1.0 / 0.0)"
+		case math.IsInf(f, -1): return "(-1.0 / 0.0)"
+		}
+		bitSize := 64
+		if val.Typ == ir.TypeS { bitSize = 32 }
+		s := strconv.FormatFloat(f, 'g', -1, bitSize)
+		if !strings.ContainsAny(s, ".e") { s += ".0" }
+		if bitSize == 32 { s += "f" }
+		if f < 0 { s = "(" + s + ")" }
+		return s
+	case *ir.Global: return b.address(val.Name, "intptr_t")
+	case *ir.Temporary:
+		safeName := safeCName(val.Name)
+		if val.ID == -1 { return "v_" + safeName }
+		if safeName != "" { return fmt.Sprintf("t_%s_%d", safeName, val.ID) }
+		return fmt.Sprintf("t%d", val.ID)
+	case *ir.CastValue: return b.value(val.Value)
+	case *ir.Label: return b.label(val.Name)
+	}
+	return "0"
+}
+
+// genMain gives C the main it expects, calling the program's
+func (b *cBackend) genMain() {
+	fn := b.prog.FindFunc("main")
+	if fn == nil { return }
+	args := []string{"(intptr_t)argc", "(intptr_t)argv"}
+	if len(fn.Params) < len(args) { args = args[:len(fn.Params)] }
+	b.out.WriteString("\nint main(int argc, char **argv) {\n")
+	if fn.ReturnType == ir.TypeNone {
+		fmt.Fprintf(b.out, "\tgbc_main(%s);\n\treturn 0;\n}\n", strings.Join(args, ", "))
+		return
+	}
+	fmt.Fprintf(b.out, "\treturn (int)gbc_main(%s);\n}\n", strings.Join(args, ", "))
+}
@@ -51,6 +51,18 @@ type Context struct {
 	isTypedPass      bool
 	cfg              *config.Config
 	switchCaseLabels map[*ast.Node]*ir.Label
+	currentPos       token.Token
+	pendingChecks    map[config.Feature]bool
+	funcChecks       map[config.Feature]bool
+	usedHooks        []string
+	funcInstr        funcInstrumentation
+	profFuncs        []string
+	runtimeGlobals   map[string]bool
+	coverPoints      []coverPoint
+	coverBlock       *ir.BasicBlock
+	defers           []deferred
+	deferExit        *ir.Label
+	deferRet         ir.Value
 }
 
 func NewContext(cfg *config.Config) *Context {
@@ -61,6 +73,7 @@ func NewContext(cfg *config.Config) *Context {
 			ExtrnVars:     make(map[string]bool),
 			WordSize:      cfg.WordSize,
 			GlobalSymbols: make(map[string]*ast.Node),
+			Types:         make(map[string]*ast.BxType),
 		},
 		currentScope:     newScope(nil),
 		wordSize:         cfg.WordSize,
@@ -68,6 +81,7 @@ func NewContext(cfg *config.Config) *Context {
 		isTypedPass:      cfg.IsFeatureEnabled(config.FeatTyped),
 		cfg:              cfg,
 		switchCaseLabels: make(map[*ast.Node]*ir.Label),
+		pendingChecks:    make(map[config.Feature]bool),
 	}
 }
 
@@ -146,6 +160,8 @@ func (ctx *Context) startBlock(label *ir.Label) {
 
 func (ctx *Context) addInstr(instr *ir.Instruction) {
 	if ctx.currentBlock == nil { ctx.startBlock(ctx.newLabel()) }
+	if ctx.currentBlock != ctx.coverBlock { ctx.genCoverageCounter(instr.Op) }
+	if instr.Pos.Line == 0 { instr.Pos = ctx.currentPos }
 	ctx.currentBlock.Instructions = append(ctx.currentBlock.Instructions, instr)
 }
 
@@ -191,6 +207,8 @@ func (ctx *Context) getSizeof(typ *ast.BxType) int64 {
 			}
 		}
 		return elemSize * arrayLen
+	case ast.TYPE_SLICE:
+		return ctx.getSizeof(ast.SliceHeader)
 	case ast.TYPE_PRIMITIVE, ast.TYPE_LITERAL_INT:
 		resolver := ir.NewTypeSizeResolver(ctx.wordSize)
 		if size := resolver.GetTypeSize(typ.Name); size > 0 {
@@ -224,6 +242,14 @@ func (ctx *Context) getSizeof(typ *ast.BxType) int64 {
 			maxAlign = 1
 		}
 		return util.AlignUp(totalSize, maxAlign)
+	case ast.TYPE_UNION:
+		var maxSize, maxAlign int64 = 0, 1
+		for _, field := range typ.Fields {
+			fieldType := field.Data.(ast.VarDeclNode).Type
+			maxSize = max(maxSize, ctx.getSizeof(fieldType))
+			maxAlign = max(maxAlign, ctx.getAlignof(fieldType))
+		}
+		return util.AlignUp(maxSize, maxAlign)
 	}
 	return int64(ctx.wordSize)
 }
@@ -231,7 +257,7 @@ func (ctx *Context) getSizeof(typ *ast.BxType) int64 {
 func (ctx *Context) getAlignof(typ *ast.BxType) int64 {
 	if typ == nil { return int64(ctx.wordSize) }
 
-	if (typ.Kind == ast.TYPE_PRIMITIVE || typ.Kind == ast.TYPE_STRUCT) && typ.Name != "" {
+	if (typ.Kind == ast.TYPE_PRIMITIVE || typ.HasFields()) && typ.Name != "" {
 		if sym := ctx.findTypeSymbol(typ.Name); sym != nil {
 			if sym.BxType != typ { return ctx.getAlignof(sym.BxType) }
 		}
@@ -242,8 +268,9 @@ func (ctx *Context) getAlignof(typ *ast.BxType) int64 {
 	case ast.TYPE_VOID: return 1
 	case ast.TYPE_POINTER: return int64(ctx.wordSize)
 	case ast.TYPE_ARRAY: return ctx.getAlignof(typ.Base)
+	case ast.TYPE_SLICE: return ctx.getAlignof(ast.SliceHeader)
 	case ast.TYPE_PRIMITIVE, ast.TYPE_FLOAT, ast.TYPE_ENUM, ast.TYPE_LITERAL_INT, ast.TYPE_LITERAL_FLOAT: return ctx.getSizeof(typ)
-	case ast.TYPE_STRUCT:
+	case ast.TYPE_STRUCT, ast.TYPE_UNION:
 		var maxAlign int64 = 1
 		for _, field := range typ.Fields {
 			fieldAlign := ctx.getAlignof(field.Data.(ast.VarDeclNode).Type)
@@ -254,6 +281,57 @@ func (ctx *Context) getAlignof(typ *ast.BxType) int64 {
 	return int64(ctx.wordSize)
 }
 
+// resolveStruct is the struct or union a type names, nil if it is neither. A slice is its header
+func (ctx *Context) resolveStruct(typ *ast.BxType) *ast.BxType {
+	if typ == nil { return nil }
+	if typ.Kind == ast.TYPE_SLICE { return ast.SliceHeader }
+	if (!typ.HasFields() || len(typ.Fields) == 0) && typ.Name != "" {
+		if sym := ctx.findTypeSymbol(typ.Name); sym != nil && sym.BxType != typ { return ctx.resolveStruct(sym.BxType) }
+	}
+	if typ.HasFields() { return typ }
+	return nil
+}
+
+// resolveFunc returns the type of the pointer to a function typ is or names, nil if it is neither
+func (ctx *Context) resolveFunc(typ *ast.BxType) *ast.BxType {
+	if typ != nil && typ.Kind == ast.TYPE_PRIMITIVE && typ.Name != "" {
+		if sym := ctx.findTypeSymbol(typ.Name); sym != nil && sym.BxType != typ { return ctx.resolveFunc(sym.BxType) }
+	}
+	if typ != nil && typ.Kind == ast.TYPE_FUNC { return typ }
+	return nil
+}
+
+// structLayout describes the struct typ is for passing it by value, nil if typ is not a struct
+func (ctx *Context) structLayout(typ *ast.BxType) *ir.StructLayout {
+	structType := ctx.resolveStruct(typ)
+	if structType == nil { return nil }
+	layout := &ir.StructLayout{Type: structType, Size: ctx.getSizeof(structType), Align: ctx.getAlignof(structType)}
+
+	var flatten func(t *ast.BxType, base int64)
+	flatten = func(t *ast.BxType, base int64) {
+		if st := ctx.resolveStruct(t); st != nil {
+			var offset int64
+			for _, field := range st.Fields {
+				fieldType := field.Data.(ast.VarDeclNode).Type
+				offset = util.AlignUp(offset, ctx.getAlignof(fieldType))
+				flatten(fieldType, base+offset)
+				if st.Kind == ast.TYPE_STRUCT { offset += ctx.getSizeof(fieldType) }
+			}
+			return
+		}
+		if t != nil && t.Kind == ast.TYPE_ARRAY {
+			elemSize := ctx.getSizeof(t.Base)
+			for i := int64(0); elemSize > 0 && i < ctx.getSizeof(t)/elemSize; i++ {
+				flatten(t.Base, base+i*elemSize)
+			}
+			return
+		}
+		layout.Fields = append(layout.Fields, ir.StructField{Offset: base, Typ: ir.GetType(t, ctx.wordSize)})
+	}
+	flatten(structType, 0)
+	return layout
+}
+
 func (ctx *Context) GenerateIR(root *ast.Node) (*ir.Program, string) {
 	ctx.collectGlobals(root)
 	ctx.collectStrings(root)
@@ -261,6 +339,9 @@ func (ctx *Context) GenerateIR(root *ast.Node) (*ir.Program, string) {
 		ctx.findByteArrays(root)
 	}
 	ctx.codegenStmt(root)
+	ctx.genInstrumentationRuntime()
+	ctx.genCoverageRuntime()
+	ctx.genRuntimeHooks()
 
 	ctx.prog.BackendTempCount = ctx.tempCount
 	return ctx.prog, ctx.inlineAsm
@@ -292,6 +373,12 @@ func walkAST(node *ast.Node, visitor func(n *ast.Node)) {
 	case ast.SubscriptNode:
 		walkAST(d.Array, visitor)
 		walkAST(d.Index, visitor)
+	case ast.SliceNode:
+		walkAST(d.Expr, visitor)
+		walkAST(d.Low, visitor)
+		walkAST(d.High, visitor)
+	case ast.LenNode:
+		walkAST(d.Expr, visitor)
 	case ast.FuncCallNode:
 		walkAST(d.FuncExpr, visitor)
 		for _, arg := range d.Args {
@@ -315,8 +402,18 @@ func walkAST(node *ast.Node, visitor func(n *ast.Node)) {
 	case ast.WhileNode:
 		walkAST(d.Cond, visitor)
 		walkAST(d.Body, visitor)
+	case ast.ForNode:
+		walkAST(d.Init, visitor)
+		walkAST(d.Cond, visitor)
+		walkAST(d.Post, visitor)
+		walkAST(d.Body, visitor)
+	case ast.DoWhileNode:
+		walkAST(d.Body, visitor)
+		walkAST(d.Cond, visitor)
 	case ast.ReturnNode:
 		walkAST(d.Expr, visitor)
+	case ast.DeferNode:
+		walkAST(d.Expr, visitor)
 	case ast.BlockNode:
 		for _, s := range d.Stmts {
 			walkAST(s, visitor)
@@ -333,6 +430,10 @@ func walkAST(node *ast.Node, visitor func(n *ast.Node)) {
 		walkAST(d.Body, visitor)
 	case ast.LabelNode:
 		walkAST(d.Stmt, visitor)
+	case ast.AsmStmtNode:
+		for _, op := range d.Operands {
+			walkAST(op.Expr, visitor)
+		}
 	}
 }
 
@@ -398,6 +499,7 @@ func (ctx *Context) collectGlobals(node *ast.Node) {
 		d := node.Data.(ast.TypeDeclNode)
 		if ctx.findSymbolInCurrentScope(d.Name) == nil {
 			ctx.addSymbol(d.Name, symType, d.Type, false, node)
+			ctx.prog.Types[d.Name] = d.Type
 		}
 	case ast.EnumDecl:
 		d := node.Data.(ast.EnumDeclNode)
@@ -466,6 +568,14 @@ func (ctx *Context) collectStrings(root *ast.Node) {
 	})
 }
 
+// isAggregate reports whether a value of typ is the address of its storage: a struct, a union or an array of
+// known size, such as a row of a two-dimensional array or an array field
+func (ctx *Context) isAggregate(typ *ast.BxType) bool {
+	if typ == nil { return false }
+	if typ.Kind == ast.TYPE_ARRAY { return typ.ArraySize != nil }
+	return ctx.resolveStruct(typ) != nil
+}
+
 func (ctx *Context) genLoad(addr ir.Value, typ *ast.BxType) ir.Value {
 	res := ctx.newTemp()
 	loadType := ir.GetType(typ, ctx.wordSize)
@@ -498,6 +608,7 @@ func (ctx *Context) codegenMemberAccessAddr(node *ast.Node) ir.Value {
 	var structAddr ir.Value
 	if structType.Kind == ast.TYPE_POINTER {
 		structAddr, _ = ctx.codegenExpr(d.Expr)
+		ctx.genNilCheck(node.Tok, structAddr)
 	} else {
 		// Check if this is a struct parameter (which is passed as pointer)
 		if d.Expr.Type == ast.Ident {
@@ -506,16 +617,7 @@ func (ctx *Context) codegenMemberAccessAddr(node *ast.Node) ir.Value {
 				// Check if this is a function parameter that has struct type
 				isStructParam := false
 				if sym.Node != nil && sym.Node.Parent != nil && sym.Node.Parent.Type == ast.FuncDecl {
-					// Resolve the struct type
-					paramStructType := structType
-					if paramStructType != nil && paramStructType.Kind != ast.TYPE_STRUCT && paramStructType.Name != "" {
-						if typeSym := ctx.findTypeSymbol(paramStructType.Name); typeSym != nil && typeSym.BxType.Kind == ast.TYPE_STRUCT {
-							paramStructType = typeSym.BxType
-						}
-					}
-					if paramStructType != nil && paramStructType.Kind == ast.TYPE_STRUCT {
-						isStructParam = true
-					}
+					isStructParam = ctx.resolveStruct(structType) != nil
 				}
 
 				if isStructParam {
@@ -537,13 +639,8 @@ func (ctx *Context) codegenMemberAccessAddr(node *ast.Node) ir.Value {
 		baseType = baseType.Base
 	}
 
-	if baseType.Kind != ast.TYPE_STRUCT && baseType.Name != "" {
-		if sym := ctx.findTypeSymbol(baseType.Name); sym != nil && sym.BxType.Kind == ast.TYPE_STRUCT {
-			baseType = sym.BxType
-		}
-	}
-
-	if baseType.Kind != ast.TYPE_STRUCT {
+	if st := ctx.resolveStruct(baseType); st != nil { baseType = st }
+	if !baseType.HasFields() {
 		util.Error(node.Tok, "internal: member access on non-struct type '%s'", baseType.Name)
 		return nil
 	}
@@ -562,7 +659,8 @@ func (ctx *Context) codegenMemberAccessAddr(node *ast.Node) ir.Value {
 			found = true
 			break
 		}
-		offset += ctx.getSizeof(fieldData.Type)
+		// Every field of a union is at offset 0
+		if baseType.Kind == ast.TYPE_STRUCT { offset += ctx.getSizeof(fieldData.Type) }
 	}
 
 	if !found {
@@ -604,13 +702,14 @@ func (ctx *Context) codegenLvalue(node *ast.Node) ir.Value {
 		return sym.IRVal
 	case ast.Indirection:
 		res, _ := ctx.codegenExpr(node.Data.(ast.IndirectionNode).Expr)
+		ctx.genNilCheck(node.Tok, res)
 		return res
 	case ast.Subscript:
 		return ctx.codegenSubscriptAddr(node)
 	case ast.MemberAccess:
 		return ctx.codegenMemberAccessAddr(node)
 	case ast.FuncCall:
-		if node.Typ != nil && node.Typ.Kind == ast.TYPE_STRUCT {
+		if ctx.resolveStruct(node.Typ) != nil {
 			res, _ := ctx.codegenExpr(node)
 			return res
 		}
@@ -674,7 +773,12 @@ func (ctx *Context) codegenExpr(node *ast.Node) (result ir.Value, terminates boo
 		return ctx.codegenIndirection(node)
 	case ast.Subscript:
 		addr := ctx.codegenSubscriptAddr(node)
+		if ctx.isAggregate(node.Typ) { return addr, false }
 		return ctx.genLoad(addr, node.Typ), false
+	case ast.Slice:
+		return ctx.codegenSlice(node)
+	case ast.Len:
+		return ctx.codegenLen(node)
 	case ast.AddressOf:
 		return ctx.codegenAddressOf(node)
 	case ast.FuncCall:
@@ -696,6 +800,7 @@ func (ctx *Context) codegenExpr(node *ast.Node) (result ir.Value, terminates boo
 		if addr == nil {
 			return nil, true
 		}
+		if ctx.isAggregate(node.Typ) { return addr, false }
 		return ctx.genLoad(addr, node.Typ), false
 	}
 	util.Error(node.Tok, "Internal error: unhandled expression type in codegen: %v", node.Type)
@@ -706,6 +811,11 @@ func (ctx *Context) codegenStmt(node *ast.Node) (terminates bool) {
 	if node == nil {
 		return false
 	}
+	if node.Type != ast.Block && ctx.currentFunc != nil {
+		ctx.currentPos = node.Tok
+		// Code following a compound statement, like the join block of an if, belongs to that statement
+		defer func() { ctx.currentPos = node.Tok }()
+	}
 	switch node.Type {
 	case ast.Block:
 		isRealBlock := !node.Data.(ast.BlockNode).IsSynthetic
@@ -741,7 +851,13 @@ func (ctx *Context) codegenStmt(node *ast.Node) (terminates bool) {
 			ctx.codegenVarDecl(decl)
 		}
 		return false
-	case ast.TypeDecl, ast.Directive:
+	case ast.TypeDecl:
+		return false
+	case ast.Directive:
+		ctx.applyCheckDirective(node)
+		return false
+	case ast.AsmStmt:
+		ctx.codegenAsmStmt(node)
 		return false
 	case ast.EnumDecl:
 		// Process enum members as global variable declarations
@@ -761,10 +877,17 @@ func (ctx *Context) codegenStmt(node *ast.Node) (terminates bool) {
 		return false
 	case ast.Return:
 		return ctx.codegenReturn(node)
+	case ast.Defer:
+		ctx.codegenDefer(node)
+		return false
 	case ast.If:
 		return ctx.codegenIf(node)
 	case ast.While:
 		return ctx.codegenWhile(node)
+	case ast.For:
+		return ctx.codegenFor(node)
+	case ast.DoWhile:
+		return ctx.codegenDoWhile(node)
 	case ast.Switch:
 		return ctx.codegenSwitch(node)
 	case ast.Label:
@@ -871,6 +994,10 @@ func (ctx *Context) codegenSwitch(node *ast.Node) bool {
 			findCasesRecursive(data.ElseBody)
 		case ast.WhileNode:
 			findCasesRecursive(data.Body)
+		case ast.ForNode:
+			findCasesRecursive(data.Body)
+		case ast.DoWhileNode:
+			findCasesRecursive(data.Body)
 		case ast.LabelNode:
 			findCasesRecursive(data.Stmt)
 		case ast.CaseNode:
@@ -972,6 +1099,11 @@ func (ctx *Context) findAllAutosInFunc(node *ast.Node, autoVars *[]autoVarInfo,
 		ctx.findAllAutosInFunc(d.ElseBody, autoVars, definedNames)
 	case ast.WhileNode:
 		ctx.findAllAutosInFunc(d.Body, autoVars, definedNames)
+	case ast.ForNode:
+		ctx.findAllAutosInFunc(d.Init, autoVars, definedNames)
+		ctx.findAllAutosInFunc(d.Body, autoVars, definedNames)
+	case ast.DoWhileNode:
+		ctx.findAllAutosInFunc(d.Body, autoVars, definedNames)
 	case ast.BlockNode:
 		for _, s := range d.Stmts {
 			ctx.findAllAutosInFunc(s, autoVars, definedNames)
@@ -993,6 +1125,7 @@ func (ctx *Context) findAllAutosInFunc(node *ast.Node, autoVars *[]autoVarInfo,
 
 func (ctx *Context) codegenFuncDecl(node *ast.Node) {
 	d := node.Data.(ast.FuncDeclNode)
+	ctx.funcChecks, ctx.pendingChecks = ctx.pendingChecks, make(map[config.Feature]bool)
 	if d.Body != nil && d.Body.Type == ast.AsmStmt {
 		asmCode := d.Body.Data.(ast.AsmStmtNode).Code
 		ctx.inlineAsm += fmt.Sprintf(".globl %s\n%s:\n\t%s\n", d.Name, d.Name, asmCode)
@@ -1006,12 +1139,13 @@ func (ctx *Context) codegenFuncDecl(node *ast.Node) {
 	fn := &ir.Func{
 		Name: d.Name, ReturnType: irReturnType, AstReturnType: d.ReturnType,
 		HasVarargs: d.HasVarargs, AstParams: d.Params, Node: node,
+		RetStruct: ctx.structLayout(d.ReturnType),
 	}
 	ctx.prog.Funcs = append(ctx.prog.Funcs, fn)
 
-	prevFunc := ctx.currentFunc
-	ctx.currentFunc = fn
-	defer func() { ctx.currentFunc = prevFunc }()
+	prevFunc, prevPos := ctx.currentFunc, ctx.currentPos
+	ctx.currentFunc, ctx.currentPos = fn, node.Tok
+	defer func() { ctx.currentFunc, ctx.currentPos = prevFunc, prevPos }()
 
 	ctx.enterScope()
 	defer ctx.exitScope()
@@ -1030,9 +1164,10 @@ func (ctx *Context) codegenFuncDecl(node *ast.Node) {
 		}
 		paramVal := &ir.Temporary{Name: name, ID: i}
 		fn.Params = append(fn.Params, &ir.Param{
-			Name: name,
-			Typ:  ir.GetType(typ, ctx.wordSize),
-			Val:  paramVal,
+			Name:   name,
+			Typ:    ir.GetType(typ, ctx.wordSize),
+			Val:    paramVal,
+			Struct: ctx.structLayout(typ),
 		})
 	}
 
@@ -1080,6 +1215,7 @@ func (ctx *Context) codegenFuncDecl(node *ast.Node) {
 			Args:   []ir.Value{&ir.Const{Value: totalFrameSize}},
 			Align:  ctx.stackAlign,
 		})
+		fn.Frame = framePtr
 	}
 
 	var currentOffset int64
@@ -1111,6 +1247,12 @@ func (ctx *Context) codegenFuncDecl(node *ast.Node) {
 		sym := ctx.addSymbol(name, symVar, typ, isVec, local.Node)
 		sym.StackOffset = currentOffset
 
+		irLocal := &ir.Local{
+			Name: name, Offset: currentOffset, Size: local.Size, AstType: typ,
+			IsVector: isVec, Tok: local.Node.Tok,
+		}
+		fn.Locals = append(fn.Locals, irLocal)
+
 		addr := ctx.newTemp()
 		ctx.addInstr(&ir.Instruction{
 			Op:     ir.OpAdd,
@@ -1130,6 +1272,7 @@ func (ctx *Context) codegenFuncDecl(node *ast.Node) {
 			}
 
 			if origParamIndex != -1 {
+				irLocal.ArgIndex = origParamIndex + 1
 				paramVal := fn.Params[origParamIndex].Val
 				ctx.genStore(sym.IRVal, paramVal, typ)
 			}
@@ -1148,9 +1291,15 @@ func (ctx *Context) codegenFuncDecl(node *ast.Node) {
 		currentOffset += local.Size
 	}
 
+	ctx.genDeferFlags(d.Body)
+	ctx.genFuncPrologue(d.Name)
 	bodyTerminates := ctx.codegenStmt(d.Body)
 
-	if !bodyTerminates {
+	if ctx.deferExit != nil {
+		if !bodyTerminates { ctx.genDeferReturn(&ir.Const{Value: 0}) }
+		ctx.genDeferExit()
+	} else if !bodyTerminates {
+		ctx.genFuncEpilogue()
 		if d.ReturnType != nil && d.ReturnType.Kind == ast.TYPE_VOID {
 			ctx.addInstr(&ir.Instruction{Op: ir.OpRet})
 		} else {
@@ -1263,17 +1412,10 @@ func (ctx *Context) codegenLocalVarDecl(d ast.VarDeclNode, sym *symbol) {
 		sym.BxType = varType
 	}
 
-	// Resolve named struct types to their actual definitions
-	if varType != nil && varType.Kind != ast.TYPE_STRUCT && varType.Name != "" {
-		if typeSym := ctx.findTypeSymbol(varType.Name); typeSym != nil && typeSym.BxType.Kind == ast.TYPE_STRUCT {
-			varType = typeSym.BxType
-		}
-	}
-
-	if varType != nil && varType.Kind == ast.TYPE_STRUCT {
+	if structType := ctx.resolveStruct(varType); structType != nil {
 		rvalPtr, _ := ctx.codegenExpr(initExpr)
 		lvalAddr := sym.IRVal
-		size := ctx.getSizeof(varType)
+		size := ctx.getSizeof(structType)
 		ctx.addInstr(&ir.Instruction{
 			Op:   ir.OpBlit,
 			Args: []ir.Value{rvalPtr, lvalAddr, &ir.Const{Value: size}},
@@ -1291,10 +1433,11 @@ func (ctx *Context) codegenGlobalVarDecl(d ast.VarDeclNode, sym *symbol) {
 		AstType: d.Type,
 	}
 
-	if d.Type != nil && d.Type.Kind == ast.TYPE_STRUCT && len(d.InitList) == 0 {
-		structSize := ctx.getSizeof(d.Type)
-		if structSize > 0 {
-			globalData.Items = append(globalData.Items, ir.DataItem{Typ: ir.TypeB, Count: int(structSize)})
+	isNestedArray := d.Type != nil && d.Type.Kind == ast.TYPE_ARRAY && ctx.isAggregate(d.Type.Base)
+	if (ctx.resolveStruct(d.Type) != nil || isNestedArray) && len(d.InitList) == 0 {
+		size := ctx.getSizeof(d.Type)
+		if size > 0 {
+			globalData.Items = append(globalData.Items, ir.DataItem{Typ: ir.TypeB, Count: int(size)})
 		}
 		if len(globalData.Items) > 0 {
 			ctx.prog.Globals = append(ctx.prog.Globals, globalData)
@@ -1302,6 +1445,12 @@ func (ctx *Context) codegenGlobalVarDecl(d ast.VarDeclNode, sym *symbol) {
 		return
 	}
 
+	if ctx.resolveSlice(d.Type) != nil && len(d.InitList) > 0 {
+		globalData.Items = ctx.codegenGlobalSlice(globalData.Name, d.InitList[0])
+		ctx.prog.Globals = append(ctx.prog.Globals, globalData)
+		return
+	}
+
 	isUntypedStringVec := d.IsVector && (d.Type == nil || d.Type.Kind == ast.TYPE_UNTYPED) &&
 		len(d.InitList) == 1 && d.InitList[0].Type == ast.String
 
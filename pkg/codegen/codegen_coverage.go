@@ -0,0 +1,104 @@
+package codegen
+
+import (
+	"path/filepath"
+
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// CoverageFileName is the file -Fcoverage programs append their counters to at exit
+// Every run writes CoverageHeader followed by one `file line count` line per basic block
+const CoverageFileName = "gbc.cov"
+
+// CoverageHeader starts the records of a single run in a coverage file
+const CoverageHeader = "# gbc coverage v1"
+
+// coverPoint is the source location a basic block counter is keyed to
+type coverPoint struct {
+	file string
+	line int
+}
+
+// genCoverageCounter increments the counter of the current block, keyed to the statement being generated
+// It is called from addInstr for the first instruction of every block
+func (ctx *Context) genCoverageCounter(op ir.Op) {
+	if !ctx.cfg.IsFeatureEnabled(config.FeatCoverage) || ctx.currentFunc == nil || isRuntimeFunc(ctx.currentFunc.Name) { return }
+	// Phis must stay at the top of the block and blocks holding a lone jump are not statements
+	if op == ir.OpPhi || op == ir.OpJmp || ctx.currentPos.Line <= 0 { return }
+	ctx.coverBlock = ctx.currentBlock
+
+	file := util.SourceFileName(ctx.currentPos.FileIndex)
+	if abs, err := filepath.Abs(file); err == nil { file = abs }
+	index := int64(len(ctx.coverPoints))
+	ctx.coverPoints = append(ctx.coverPoints, coverPoint{file: file, line: ctx.currentPos.Line})
+
+	addr := ctx.wordOp(ir.OpAdd, &ir.Global{Name: "__gbc_cov_counters"}, &ir.Const{Value: index * int64(ctx.wordSize)})
+	ctx.genStore(addr, ctx.wordOp(ir.OpAdd, ctx.genLoad(addr, nil), &ir.Const{Value: 1}), nil)
+}
+
+// skipCoverage keeps the current block, one the compiler adds for no statement of the program, from getting a
+// counter
+func (ctx *Context) skipCoverage() { ctx.coverBlock = ctx.currentBlock }
+
+// genCoverageRuntime emits the counter tables and __gbc_cov_dump, which appends them to CoverageFileName
+func (ctx *Context) genCoverageRuntime() {
+	if !ctx.cfg.IsFeatureEnabled(config.FeatCoverage) { return }
+	wordType := ir.GetType(nil, ctx.wordSize)
+	count := int64(len(ctx.coverPoints))
+
+	files := &ir.Data{Name: "__gbc_cov_files", Align: ctx.wordSize}
+	lines := &ir.Data{Name: "__gbc_cov_lines", Align: ctx.wordSize}
+	counters := &ir.Data{Name: "__gbc_cov_counters", Align: ctx.wordSize, Items: []ir.DataItem{{Typ: wordType, Count: int(count) + 1}}}
+	for _, p := range ctx.coverPoints {
+		files.Items = append(files.Items, ir.DataItem{Typ: ir.TypePtr, Value: ctx.addString(p.file)})
+		lines.Items = append(lines.Items, ir.DataItem{Typ: wordType, Value: &ir.Const{Value: int64(p.line)}})
+	}
+	// Keep the tables non-empty so every backend emits them
+	files.Items = append(files.Items, ir.DataItem{Typ: ir.TypePtr, Value: &ir.Const{Value: 0}})
+	lines.Items = append(lines.Items, ir.DataItem{Typ: wordType, Value: &ir.Const{Value: 0}})
+	ctx.prog.Globals = append(ctx.prog.Globals, files, lines, counters)
+
+	fn := &ir.Func{Name: "__gbc_cov_dump", ReturnType: wordType}
+	ctx.prog.Funcs = append(ctx.prog.Funcs, fn)
+	ctx.currentFunc, ctx.currentBlock = fn, nil
+	ctx.startBlock(&ir.Label{Name: "start"})
+
+	indexSlot := ctx.newTemp()
+	ctx.addInstr(&ir.Instruction{Op: ir.OpAlloc, Typ: wordType, Result: indexSlot, Args: []ir.Value{&ir.Const{Value: int64(ctx.wordSize)}}, Align: ctx.stackAlign})
+	file := ctx.callWord("fopen", ctx.addString(CoverageFileName), ctx.addString("a"))
+
+	openedL, loopL, bodyL, closeL, doneL := ctx.newLabel(), ctx.newLabel(), ctx.newLabel(), ctx.newLabel(), ctx.newLabel()
+	isNull := ctx.newTemp()
+	ctx.addInstr(&ir.Instruction{Op: ir.OpCEq, Typ: wordType, OperandType: wordType, Result: isNull, Args: []ir.Value{file, &ir.Const{Value: 0}}})
+	ctx.addInstr(&ir.Instruction{Op: ir.OpJnz, Args: []ir.Value{isNull, doneL, openedL}})
+
+	ctx.startBlock(openedL)
+	ctx.callWord("fprintf", file, ctx.addString(CoverageHeader+"\n"))
+	ctx.genStore(indexSlot, &ir.Const{Value: 0}, nil)
+	ctx.addInstr(&ir.Instruction{Op: ir.OpJmp, Args: []ir.Value{loopL}})
+
+	ctx.startBlock(loopL)
+	index := ctx.genLoad(indexSlot, nil)
+	inRange := ctx.newTemp()
+	ctx.addInstr(&ir.Instruction{Op: ir.OpCLt, Typ: wordType, OperandType: wordType, Result: inRange, Args: []ir.Value{index, &ir.Const{Value: count}}})
+	ctx.addInstr(&ir.Instruction{Op: ir.OpJnz, Args: []ir.Value{inRange, bodyL, closeL}})
+
+	ctx.startBlock(bodyL)
+	offset := ctx.wordOp(ir.OpMul, index, &ir.Const{Value: int64(ctx.wordSize)})
+	name := ctx.genLoad(ctx.wordOp(ir.OpAdd, &ir.Global{Name: files.Name}, offset), nil)
+	line := ctx.genLoad(ctx.wordOp(ir.OpAdd, &ir.Global{Name: lines.Name}, offset), nil)
+	hits := ctx.genLoad(ctx.wordOp(ir.OpAdd, &ir.Global{Name: counters.Name}, offset), nil)
+	ctx.callWord("fprintf", file, ctx.addString("%s %ld %ld\n"), name, line, hits)
+	ctx.genStore(indexSlot, ctx.wordOp(ir.OpAdd, index, &ir.Const{Value: 1}), nil)
+	ctx.addInstr(&ir.Instruction{Op: ir.OpJmp, Args: []ir.Value{loopL}})
+
+	ctx.startBlock(closeL)
+	ctx.callWord("fclose", file)
+	ctx.addInstr(&ir.Instruction{Op: ir.OpJmp, Args: []ir.Value{doneL}})
+
+	ctx.startBlock(doneL)
+	ctx.addInstr(&ir.Instruction{Op: ir.OpRet, Args: []ir.Value{&ir.Const{Value: 0}}})
+	ctx.currentFunc, ctx.currentBlock = nil, nil
+}
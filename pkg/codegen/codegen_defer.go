@@ -0,0 +1,107 @@
+package codegen
+
+import (
+	"github.com/xplshn/gbc/pkg/ast"
+	"github.com/xplshn/gbc/pkg/ir"
+)
+
+// A defer statement arms a flag in the frame, cleared on entry to its function. In a function that has any, every
+// return stores its value and jumps to a common exit, which runs the expressions of the armed statements, the
+// last in the function first, and returns. A deferred expression thus runs at most once per call, however
+// control reached its statement or left its block, goto included
+
+// deferred is a defer statement of the function being generated
+type deferred struct {
+	node  *ast.Node
+	flag  ir.Value
+	scope *scope // where the statement is, to resolve the names of its expression
+}
+
+// deferRetType is how the common exit keeps the value returned: an integer narrower than a word is kept widened,
+// as a return passes it
+func (ctx *Context) deferRetType() ir.Type {
+	if typ := ctx.currentFunc.ReturnType; typ == ir.TypeS || typ == ir.TypeD { return typ }
+	return ir.GetType(nil, ctx.wordSize)
+}
+
+// genDeferFlags clears a flag for every defer statement of body and sets up the common exit if there are any
+func (ctx *Context) genDeferFlags(body *ast.Node) {
+	ctx.defers, ctx.deferExit, ctx.deferRet = nil, nil, nil
+	wordType := ir.GetType(nil, ctx.wordSize)
+	walkAST(body, func(n *ast.Node) {
+		if n.Type != ast.Defer { return }
+		flag := ctx.newTemp()
+		ctx.addInstr(&ir.Instruction{Op: ir.OpAlloc, Typ: wordType, Result: flag, Args: []ir.Value{&ir.Const{Value: int64(ctx.wordSize)}}, Align: ctx.wordSize})
+		ctx.genStore(flag, &ir.Const{Value: 0}, nil)
+		ctx.defers = append(ctx.defers, deferred{node: n, flag: flag})
+	})
+	if len(ctx.defers) == 0 { return }
+
+	ctx.deferExit = ctx.newLabel()
+	if ctx.currentFunc.ReturnType != ir.TypeNone {
+		// A struct returned is kept by the address of its copy
+		size := ir.SizeOfType(ctx.deferRetType(), ctx.wordSize)
+		ctx.deferRet = ctx.newTemp()
+		ctx.addInstr(&ir.Instruction{Op: ir.OpAlloc, Typ: wordType, Result: ctx.deferRet, Args: []ir.Value{&ir.Const{Value: size}}, Align: int(size)})
+	}
+}
+
+// codegenDefer arms the flag of a defer statement
+func (ctx *Context) codegenDefer(node *ast.Node) {
+	for i := range ctx.defers {
+		if ctx.defers[i].node == node {
+			ctx.defers[i].scope = ctx.currentScope
+			ctx.genStore(ctx.defers[i].flag, &ir.Const{Value: 1}, nil)
+			return
+		}
+	}
+}
+
+// genDeferReturn leaves the function with retVal through the common exit, copying a struct returned so that
+// deferred expressions cannot change it
+func (ctx *Context) genDeferReturn(retVal ir.Value) {
+	if rs := ctx.currentFunc.RetStruct; rs != nil {
+		saved := ctx.newTemp()
+		ctx.addInstr(&ir.Instruction{Op: ir.OpAlloc, Typ: ir.GetType(nil, ctx.wordSize), Result: saved, Args: []ir.Value{&ir.Const{Value: rs.Size}}, Align: int(rs.Align)})
+		ctx.addInstr(&ir.Instruction{Op: ir.OpBlit, Args: []ir.Value{retVal, saved, &ir.Const{Value: rs.Size}}})
+		retVal = saved
+	}
+	if ctx.deferRet != nil {
+		ctx.addInstr(&ir.Instruction{Op: ir.OpStore, Typ: ctx.deferRetType(), Args: []ir.Value{retVal, ctx.deferRet}})
+	}
+	ctx.addInstr(&ir.Instruction{Op: ir.OpJmp, Args: []ir.Value{ctx.deferExit}})
+	ctx.currentBlock = nil
+}
+
+// genDeferExit is the common exit: it runs the deferred expressions whose statements were reached, the last in
+// the function first, and returns the value stored by the return that jumped there
+func (ctx *Context) genDeferExit() {
+	// Only the deferred expressions are statements of the program: the blocks testing the flags and returning
+	// get no coverage counter
+	ctx.startBlock(ctx.deferExit)
+	ctx.skipCoverage()
+	prevScope, prevPos := ctx.currentScope, ctx.currentPos
+	for i := len(ctx.defers) - 1; i >= 0; i-- {
+		d := ctx.defers[i]
+		if d.scope == nil { continue }
+		runL, nextL := ctx.newLabel(), ctx.newLabel()
+		armed := ctx.genLoad(d.flag, nil)
+		ctx.addInstr(&ir.Instruction{Op: ir.OpJnz, Args: []ir.Value{armed, runL, nextL}})
+		ctx.startBlock(runL)
+		ctx.currentScope, ctx.currentPos = d.scope, d.node.Tok
+		ctx.codegenExpr(d.node.Data.(ast.DeferNode).Expr)
+		ctx.addInstr(&ir.Instruction{Op: ir.OpJmp, Args: []ir.Value{nextL}})
+		ctx.currentScope, ctx.currentPos = prevScope, prevPos
+		ctx.startBlock(nextL)
+		ctx.skipCoverage()
+	}
+
+	var retVal ir.Value
+	if ctx.deferRet != nil {
+		retVal = ctx.newTemp()
+		ctx.addInstr(&ir.Instruction{Op: ir.OpLoad, Typ: ctx.deferRetType(), Result: retVal, Args: []ir.Value{ctx.deferRet}})
+	}
+	ctx.genFuncEpilogue()
+	ctx.addInstr(&ir.Instruction{Op: ir.OpRet, Args: []ir.Value{retVal}})
+	ctx.currentBlock = nil
+}
@@ -53,7 +53,9 @@ func (ctx *Context) codegenIdent(node *ast.Node) (ir.Value, bool) {
 		return sym.IRVal, false
 	}
 
-	if sym.BxType != nil && sym.BxType.Kind == ast.TYPE_STRUCT {
+	// A slice parameter holds the address of the header it was passed, as a struct one does
+	isParam := sym.Node != nil && sym.Node.Parent != nil && sym.Node.Parent.Type == ast.FuncDecl
+	if sym.BxType.HasFields() || (ctx.resolveSlice(sym.BxType) != nil && !isParam) {
 		return sym.IRVal, false
 	}
 
@@ -95,20 +97,18 @@ func (ctx *Context) getActualOperandType(node *ast.Node) ir.Type {
 func (ctx *Context) codegenAssign(node *ast.Node) (ir.Value, bool) {
 	d := node.Data.(ast.AssignNode)
 
-	// Resolve named struct types to their actual definitions
-	lhsType := d.Lhs.Typ
-	if lhsType != nil && lhsType.Kind != ast.TYPE_STRUCT && lhsType.Name != "" {
-		if typeSym := ctx.findTypeSymbol(lhsType.Name); typeSym != nil && typeSym.BxType.Kind == ast.TYPE_STRUCT {
-			lhsType = typeSym.BxType
-		}
-	}
-
-	if lhsType != nil && lhsType.Kind == ast.TYPE_STRUCT {
+	if lhsType := ctx.resolveStruct(d.Lhs.Typ); lhsType != nil {
 		if d.Op != token.Eq {
 			util.Error(node.Tok, "Compound assignment operators are not supported for structs")
 			return nil, false
 		}
-		lvalAddr := ctx.codegenLvalue(d.Lhs)
+		// The value of a struct is its address, which a parameter holds rather than is
+		var lvalAddr ir.Value
+		if d.Lhs.Type == ast.Ident {
+			lvalAddr, _ = ctx.codegenExpr(d.Lhs)
+		} else {
+			lvalAddr = ctx.codegenLvalue(d.Lhs)
+		}
 		rvalPtr, _ := ctx.codegenExpr(d.Rhs)
 		size := ctx.getSizeof(lhsType)
 		ctx.addInstr(&ir.Instruction{
@@ -144,7 +144,7 @@ func (ctx *Context) codegenAssign(node *ast.Node) (ir.Value, bool) {
 		rhsVal, _ := ctx.codegenExpr(d.Rhs)
 		op, typ := getBinaryOpAndType(d.Op, d.Lhs.Typ, ctx.wordSize)
 		rval = ctx.newTemp()
-		ctx.addInstr(&ir.Instruction{Op: op, Typ: typ, Result: rval, Args: []ir.Value{currentLvalVal, rhsVal}})
+		ctx.addArithInstr(node.Tok, d.Lhs.Typ, &ir.Instruction{Op: op, Typ: typ, Result: rval, Args: []ir.Value{currentLvalVal, rhsVal}})
 	}
 
 	ctx.genStore(lvalAddr, rval, d.Lhs.Typ)
@@ -333,7 +333,7 @@ func (ctx *Context) codegenBinaryOp(node *ast.Node) (ir.Value, bool) {
 		operandIrType = resultIrType
 	}
 
-	ctx.addInstr(&ir.Instruction{
+	ctx.addArithInstr(node.Tok, node.Typ, &ir.Instruction{
 		Op:          op,
 		Typ:         resultIrType,
 		OperandType: operandIrType,
@@ -355,7 +355,7 @@ func (ctx *Context) codegenUnaryOp(node *ast.Node) (ir.Value, bool) {
 		if isFloat {
 			ctx.addInstr(&ir.Instruction{Op: ir.OpNegF, Typ: valType, Result: res, Args: []ir.Value{val}})
 		} else {
-			ctx.addInstr(&ir.Instruction{Op: ir.OpSub, Typ: valType, Result: res, Args: []ir.Value{&ir.Const{Value: 0}, val}})
+			ctx.addArithInstr(node.Tok, d.Expr.Typ, &ir.Instruction{Op: ir.OpSub, Typ: valType, Result: res, Args: []ir.Value{&ir.Const{Value: 0}, val}})
 		}
 	case token.Plus: return val, false
 	case token.Not:
@@ -375,7 +375,7 @@ func (ctx *Context) codegenUnaryOp(node *ast.Node) (ir.Value, bool) {
 		if isFloat {
 			oneConst = &ir.FloatConst{Value: 1.0, Typ: valType}
 		}
-		ctx.addInstr(&ir.Instruction{Op: op, Typ: valType, Result: res, Args: []ir.Value{currentVal, oneConst}})
+		ctx.addArithInstr(node.Tok, d.Expr.Typ, &ir.Instruction{Op: op, Typ: valType, Result: res, Args: []ir.Value{currentVal, oneConst}})
 		ctx.genStore(lvalAddr, res, d.Expr.Typ)
 	default:
 		util.Error(node.Tok, "Unsupported unary operator")
@@ -402,7 +402,7 @@ func (ctx *Context) codegenPostfixOp(node *ast.Node) (ir.Value, bool) {
 		oneConst = &ir.FloatConst{Value: 1.0, Typ: valType}
 	}
 
-	ctx.addInstr(&ir.Instruction{Op: op, Typ: valType, Result: newVal, Args: []ir.Value{res, oneConst}})
+	ctx.addArithInstr(node.Tok, d.Expr.Typ, &ir.Instruction{Op: op, Typ: valType, Result: newVal, Args: []ir.Value{res, oneConst}})
 	ctx.genStore(lvalAddr, newVal, d.Expr.Typ)
 	return res, false
 }
@@ -410,16 +410,10 @@ func (ctx *Context) codegenPostfixOp(node *ast.Node) (ir.Value, bool) {
 func (ctx *Context) codegenIndirection(node *ast.Node) (ir.Value, bool) {
 	exprNode := node.Data.(ast.IndirectionNode).Expr
 	addr, _ := ctx.codegenExpr(exprNode)
+	ctx.genNilCheck(node.Tok, addr)
+	if ctx.resolveFunc(exprNode.Typ) != nil { return addr, false }
 
-	// Resolve named struct types to their actual definitions
-	nodeType := node.Typ
-	if nodeType != nil && nodeType.Kind != ast.TYPE_STRUCT && nodeType.Name != "" {
-		if typeSym := ctx.findTypeSymbol(nodeType.Name); typeSym != nil && typeSym.BxType.Kind == ast.TYPE_STRUCT {
-			nodeType = typeSym.BxType
-		}
-	}
-
-	if nodeType != nil && nodeType.Kind == ast.TYPE_STRUCT {
+	if ctx.resolveStruct(node.Typ) != nil {
 		return addr, false
 	}
 
@@ -437,9 +431,21 @@ func (ctx *Context) codegenSubscriptAddr(node *ast.Node) ir.Value {
 	arrayPtr, _ := ctx.codegenExpr(d.Array)
 	indexVal, _ := ctx.codegenExpr(d.Index)
 
+	if slice := ctx.resolveSlice(d.Array.Typ); slice != nil {
+		header := arrayPtr
+		arrayPtr, indexVal = ctx.genLoad(header, nil), ctx.widenToWord(indexVal, d.Index.Typ)
+		if ctx.checkEnabled(config.FeatBoundsCheck) { ctx.genBoundsCheck(node.Tok, indexVal, nil, ctx.sliceLen(header)) }
+	} else if ctx.checkEnabled(config.FeatBoundsCheck) {
+		if length, ok := ctx.knownLength(d.Array); ok {
+			ctx.genBoundsCheck(node.Tok, indexVal, d.Index.Typ, &ir.Const{Value: length})
+		}
+	}
+
 	var scale int64 = int64(ctx.wordSize)
 	if d.Array.Typ != nil {
-		if d.Array.Typ.Kind == ast.TYPE_POINTER || d.Array.Typ.Kind == ast.TYPE_ARRAY {
+		if slice := ctx.resolveSlice(d.Array.Typ); slice != nil && slice.Base != nil {
+			scale = ctx.getSizeof(slice.Base)
+		} else if d.Array.Typ.Kind == ast.TYPE_POINTER || d.Array.Typ.Kind == ast.TYPE_ARRAY {
 			if d.Array.Typ.Base != nil {
 				scale = ctx.getSizeof(d.Array.Typ.Base)
 			}
@@ -493,15 +499,20 @@ func (ctx *Context) codegenFuncCall(node *ast.Node) (ir.Value, bool) {
 	d := node.Data.(ast.FuncCallNode)
 	if d.FuncExpr.Type == ast.Ident {
 		name := d.FuncExpr.Data.(ast.IdentNode).Name
-		if sym := ctx.findSymbol(name); sym != nil && sym.Type == symVar && !sym.IsVector {
+		if sym := ctx.findSymbol(name); sym != nil && sym.Type == symVar && !sym.IsVector && ctx.resolveFunc(sym.BxType) == nil {
 			util.Error(d.FuncExpr.Tok, "'%s' is a variable but is used as a function", name)
 		}
 	}
 
 	funcVal, _ := ctx.codegenExpr(d.FuncExpr)
+	_, isDirect := funcVal.(*ir.Global)
+	if !isDirect {
+		ctx.genNilCheck(d.FuncExpr.Tok, funcVal)
+	}
 
 	// Get function signature for type checking
 	var expectedParamTypes []*ast.BxType
+	var definedParams []*ast.Node
 	isVariadic := false
 
 	if d.FuncExpr.Type == ast.Ident {
@@ -510,6 +521,7 @@ func (ctx *Context) codegenFuncCall(node *ast.Node) (ir.Value, bool) {
 			if sym.Node != nil {
 				if fd, ok := sym.Node.Data.(ast.FuncDeclNode); ok {
 					isVariadic = fd.HasVarargs
+					if fd.Body != nil { definedParams = fd.Params }
 					// Extract parameter types
 					for _, param := range fd.Params {
 						// Handle both typed parameters (VarDeclNode) and untyped parameters (IdentNode)
@@ -526,10 +538,31 @@ func (ctx *Context) codegenFuncCall(node *ast.Node) (ir.Value, bool) {
 		}
 	}
 
+	// A call through a pointer to a function follows the signature of the pointer
+	var sig *ir.Signature
+	if funcType := ctx.resolveFunc(d.FuncExpr.Typ); funcType != nil && !isDirect {
+		expectedParamTypes, isVariadic = funcType.Params, funcType.Variadic
+		sig = &ir.Signature{Result: ir.GetType(funcType.Base, ctx.wordSize), Variadic: funcType.Variadic}
+		for _, param := range funcType.Params {
+			sig.Params = append(sig.Params, ir.GetType(param, ctx.wordSize))
+		}
+	}
+
 	argVals := make([]ir.Value, len(d.Args))
 	argTypes := make([]ir.Type, len(d.Args))
+	var argStructs []*ir.StructLayout
 	for i := len(d.Args) - 1; i >= 0; i-- {
 		argVals[i], _ = ctx.codegenExpr(d.Args[i])
+		// A function of the program takes a struct by value only for a parameter declared as one, and its address otherwise
+		layout := ctx.structLayout(d.Args[i].Typ)
+		if layout != nil && i < len(definedParams) {
+			if param, ok := definedParams[i].Data.(ast.VarDeclNode); !ok || ctx.resolveStruct(param.Type) == nil { layout = nil }
+		}
+		if layout != nil && sig != nil && i < len(expectedParamTypes) && ctx.resolveStruct(expectedParamTypes[i]) == nil { layout = nil }
+		if layout != nil {
+			if argStructs == nil { argStructs = make([]*ir.StructLayout, len(d.Args)) }
+			argStructs[i] = layout
+		}
 
 		// For typed functions with known parameter types, use the expected type
 		var expectedArgType *ast.BxType
@@ -587,18 +620,23 @@ func (ctx *Context) codegenFuncCall(node *ast.Node) (ir.Value, bool) {
 	isStmt := node.Parent != nil && node.Parent.Type == ast.Block
 	var res ir.Value
 	returnType := ir.GetType(node.Typ, ctx.wordSize)
+	retStruct := ctx.structLayout(node.Typ)
 	callArgs := append([]ir.Value{funcVal}, argVals...)
 
-	if !isStmt && returnType != ir.TypeNone {
+	// A struct is returned to memory of the caller even when the call is a statement
+	if (!isStmt && returnType != ir.TypeNone) || retStruct != nil {
 		res = ctx.newTemp()
 	}
 
 	ctx.addInstr(&ir.Instruction{
-		Op:       ir.OpCall,
-		Typ:      returnType,
-		Result:   res,
-		Args:     callArgs,
-		ArgTypes: argTypes,
+		Op:         ir.OpCall,
+		Typ:        returnType,
+		Result:     res,
+		Args:       callArgs,
+		ArgTypes:   argTypes,
+		ArgStructs: argStructs,
+		RetStruct:  retStruct,
+		Sig:        sig,
 	})
 
 	return res, false
@@ -733,7 +771,7 @@ func (ctx *Context) codegenAutoAlloc(node *ast.Node) (ir.Value, bool) {
 func (ctx *Context) codegenStructLiteral(node *ast.Node) (ir.Value, bool) {
 	d := node.Data.(ast.StructLiteralNode)
 	structType := node.Typ
-	if structType == nil || structType.Kind != ast.TYPE_STRUCT {
+	if !structType.HasFields() {
 		util.Error(node.Tok, "internal: struct literal has invalid type")
 		return nil, false
 	}
@@ -762,9 +800,8 @@ func (ctx *Context) codegenStructLiteral(node *ast.Node) (ir.Value, bool) {
 				Result: fieldAddr,
 				Args:   []ir.Value{structPtr, &ir.Const{Value: currentOffset}},
 			})
-			val, _ := ctx.codegenExpr(valNode)
-			ctx.genStore(fieldAddr, val, field.Type)
-			currentOffset += ctx.getSizeof(field.Type)
+			ctx.genFieldStore(fieldAddr, valNode, field.Type)
+			if structType.Kind == ast.TYPE_STRUCT { currentOffset += ctx.getSizeof(field.Type) }
 		}
 	} else {
 		fieldOffsets := make(map[string]int64)
@@ -776,7 +813,7 @@ func (ctx *Context) codegenStructLiteral(node *ast.Node) (ir.Value, bool) {
 			currentOffset = util.AlignUp(currentOffset, fieldAlign)
 			fieldOffsets[fieldData.Name] = currentOffset
 			fieldTypes[fieldData.Name] = fieldData.Type
-			currentOffset += ctx.getSizeof(fieldData.Type)
+			if structType.Kind == ast.TYPE_STRUCT { currentOffset += ctx.getSizeof(fieldData.Type) }
 		}
 
 		for i, nameNode := range d.Names {
@@ -794,14 +831,32 @@ func (ctx *Context) codegenStructLiteral(node *ast.Node) (ir.Value, bool) {
 				Args:   []ir.Value{structPtr, &ir.Const{Value: offset}},
 			})
 
-			val, _ := ctx.codegenExpr(d.Values[i])
-			ctx.genStore(fieldAddr, val, fieldTypes[fieldName])
+			ctx.genFieldStore(fieldAddr, d.Values[i], fieldTypes[fieldName])
 		}
 	}
 
 	return structPtr, false
 }
 
+// genFieldStore stores the value of a struct literal for a field at addr, copying a struct or a slice whole
+func (ctx *Context) genFieldStore(addr ir.Value, node *ast.Node, fieldType *ast.BxType) {
+	if st := ctx.resolveStruct(fieldType); st != nil {
+		val, _ := ctx.codegenExpr(node)
+		ctx.addInstr(&ir.Instruction{Op: ir.OpBlit, Args: []ir.Value{val, addr, &ir.Const{Value: ctx.getSizeof(st)}}})
+		return
+	}
+	ctx.genStore(addr, ctx.codegenFieldValue(node, fieldType), fieldType)
+}
+
+// codegenFieldValue is the value of a struct literal for a field, with a float literal in the precision of the field
+func (ctx *Context) codegenFieldValue(node *ast.Node, fieldType *ast.BxType) ir.Value {
+	val, _ := ctx.codegenExpr(node)
+	if fc, ok := val.(*ir.FloatConst); ok && ctx.isFloatType(fieldType) {
+		return &ir.FloatConst{Value: fc.Value, Typ: ir.GetType(fieldType, ctx.wordSize)}
+	}
+	return val
+}
+
 func (ctx *Context) codegenArrayLiteral(node *ast.Node) (ir.Value, bool) {
 	d := node.Data.(ast.ArrayLiteralNode)
 
@@ -810,6 +865,8 @@ func (ctx *Context) codegenArrayLiteral(node *ast.Node) (ir.Value, bool) {
 	elemSize := ctx.getSizeof(elemType)
 	elemAlign := ctx.getAlignof(elemType)
 	arraySize := int64(len(d.Values)) * elemSize
+	// nil given for a slice is one of no elements
+	if len(d.Values) == 0 { return ctx.newSlice(&ir.Const{Value: 0}, &ir.Const{Value: 0}), false }
 
 	// Allocate memory for the array
 	arrayPtr := ctx.newTemp()
@@ -835,7 +892,7 @@ func (ctx *Context) codegenArrayLiteral(node *ast.Node) (ir.Value, bool) {
 		ctx.genStore(elemAddr, val, elemType)
 	}
 
-	return arrayPtr, false
+	return ctx.newSlice(arrayPtr, &ir.Const{Value: int64(len(d.Values))}), false
 }
 
 func (ctx *Context) codegenReturn(node *ast.Node) bool {
@@ -846,6 +903,11 @@ func (ctx *Context) codegenReturn(node *ast.Node) bool {
 	} else if ctx.currentFunc != nil && ctx.currentFunc.ReturnType != ir.TypeNone {
 		retVal = &ir.Const{Value: 0}
 	}
+	if ctx.deferExit != nil {
+		ctx.genDeferReturn(retVal)
+		return true
+	}
+	ctx.genFuncEpilogue()
 	ctx.addInstr(&ir.Instruction{Op: ir.OpRet, Args: []ir.Value{retVal}})
 	ctx.currentBlock = nil
 	return true
@@ -904,6 +966,66 @@ func (ctx *Context) codegenWhile(node *ast.Node) bool {
 	return false
 }
 
+// codegenFor generates `for (init; cond; post) body`, where continue goes to post
+func (ctx *Context) codegenFor(node *ast.Node) bool {
+	d := node.Data.(ast.ForNode)
+	startL, bodyL, postL, endL := ctx.newLabel(), ctx.newLabel(), ctx.newLabel(), ctx.newLabel()
+
+	ctx.enterScope()
+	defer ctx.exitScope()
+	ctx.codegenStmt(d.Init)
+
+	oldBreak, oldContinue := ctx.breakLabel, ctx.continueLabel
+	ctx.breakLabel, ctx.continueLabel = endL, postL
+	defer func() { ctx.breakLabel, ctx.continueLabel = oldBreak, oldContinue }()
+
+	ctx.addInstr(&ir.Instruction{Op: ir.OpJmp, Args: []ir.Value{startL}})
+	ctx.startBlock(startL)
+	if d.Cond != nil {
+		ctx.codegenLogicalCond(d.Cond, bodyL, endL)
+	} else {
+		ctx.addInstr(&ir.Instruction{Op: ir.OpJmp, Args: []ir.Value{bodyL}})
+	}
+
+	ctx.startBlock(bodyL)
+	bodyTerminates := ctx.codegenStmt(d.Body)
+	if !bodyTerminates {
+		ctx.addInstr(&ir.Instruction{Op: ir.OpJmp, Args: []ir.Value{postL}})
+	}
+
+	ctx.startBlock(postL)
+	if d.Post != nil {
+		ctx.codegenExpr(d.Post)
+	}
+	ctx.addInstr(&ir.Instruction{Op: ir.OpJmp, Args: []ir.Value{startL}})
+
+	ctx.startBlock(endL)
+	return false
+}
+
+// codegenDoWhile generates `do body while (cond);`, where continue goes to the condition
+func (ctx *Context) codegenDoWhile(node *ast.Node) bool {
+	d := node.Data.(ast.DoWhileNode)
+	bodyL, condL, endL := ctx.newLabel(), ctx.newLabel(), ctx.newLabel()
+
+	oldBreak, oldContinue := ctx.breakLabel, ctx.continueLabel
+	ctx.breakLabel, ctx.continueLabel = endL, condL
+	defer func() { ctx.breakLabel, ctx.continueLabel = oldBreak, oldContinue }()
+
+	ctx.addInstr(&ir.Instruction{Op: ir.OpJmp, Args: []ir.Value{bodyL}})
+	ctx.startBlock(bodyL)
+	bodyTerminates := ctx.codegenStmt(d.Body)
+	if !bodyTerminates {
+		ctx.addInstr(&ir.Instruction{Op: ir.OpJmp, Args: []ir.Value{condL}})
+	}
+
+	ctx.startBlock(condL)
+	ctx.codegenLogicalCond(d.Cond, bodyL, endL)
+
+	ctx.startBlock(endL)
+	return false
+}
+
 func getBinaryOpAndType(op token.Type, resultAstType *ast.BxType, wordSize int) (ir.Op, ir.Type) {
 	if resultAstType != nil && (resultAstType.Kind == ast.TYPE_FLOAT || resultAstType.Kind == ast.TYPE_LITERAL_FLOAT) {
 		typ := ir.GetType(resultAstType, wordSize)
@@ -970,3 +1092,58 @@ func (ctx *Context) codegenTypeOf(node *ast.Node) (ir.Value, bool) {
 	// Add the string to the string table and return a reference to it
 	return ctx.addString(typeStr), false
 }
+
+// codegenAsmStmt lowers an `__asm__` statement inside a function to an OpAsm. Its inputs are widened to words,
+// and its outputs are stored to their l-values, evaluated before it runs, once it has
+func (ctx *Context) codegenAsmStmt(node *ast.Node) {
+	d := node.Data.(ast.AsmStmtNode)
+	asm := &ir.InlineAsm{Template: d.Code, Clobbers: d.Clobbers}
+	addrs := make([]ir.Value, len(d.Operands))
+	for i, op := range d.Operands {
+		typ := op.Expr.Typ
+		if ctx.isFloatType(typ) || typ.HasFields() || (op.Dir != "in" && typ != nil && typ.Kind == ast.TYPE_ARRAY) {
+			util.Error(op.Expr.Tok, "Operands of '__asm__' must be integers or pointers, not '%s'", ast.TypeToString(typ))
+			asm.Operands = append(asm.Operands, ir.AsmOperand{In: &ir.Const{}})
+			continue
+		}
+		var operand ir.AsmOperand
+		if op.Dir == "in" {
+			val, _ := ctx.codegenExpr(op.Expr)
+			operand.In = ctx.widenToWord(val, typ)
+		} else {
+			addrs[i] = ctx.codegenLvalue(op.Expr)
+			if op.Dir == "inout" { operand.In = ctx.widenToWord(ctx.genLoad(addrs[i], typ), typ) }
+			operand.Out = ctx.newTemp()
+		}
+		asm.Operands = append(asm.Operands, operand)
+	}
+	asm.Expand(func(n int) string {
+		if n >= len(d.Operands) { util.Error(node.Tok, "'__asm__' template refers to operand %%%d, which it does not have", n) }
+		return ""
+	}, func(s string) string { return s })
+
+	ctx.addInstr(&ir.Instruction{Op: ir.OpAsm, Typ: ir.GetType(nil, ctx.wordSize), Asm: asm})
+	for i, op := range asm.Operands {
+		if op.Out != nil { ctx.genStore(addrs[i], op.Out, d.Operands[i].Expr.Typ) }
+	}
+}
+
+// widenToWord extends a value of a sub-word integer type to a word
+func (ctx *Context) widenToWord(val ir.Value, typ *ast.BxType) ir.Value {
+	wordType, valType := ir.GetType(nil, ctx.wordSize), ir.GetType(typ, ctx.wordSize)
+	var op ir.Op
+	switch valType {
+	case ir.TypeB, ir.TypeUB: op = ir.OpExtUB
+	case ir.TypeSB: op = ir.OpExtSB
+	case ir.TypeH, ir.TypeUH: op = ir.OpExtUH
+	case ir.TypeSH: op = ir.OpExtSH
+	case ir.TypeW:
+		if wordType == ir.TypeW { return val }
+		op = ir.OpExtSW
+	default:
+		return val
+	}
+	res := ctx.newTemp()
+	ctx.addInstr(&ir.Instruction{Op: op, Typ: wordType, OperandType: valType, Result: res, Args: []ir.Value{val}})
+	return res
+}
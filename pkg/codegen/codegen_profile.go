@@ -0,0 +1,172 @@
+package codegen
+
+import (
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/token"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// ProfileFileName is the file written at exit by programs built with -Fprofile
+// Each line after the header holds `name calls self_usec total_usec`
+const ProfileFileName = "gbc.prof"
+
+// ProfileHeader is the first line of every profile file
+const ProfileHeader = "# gbc profile v1: name calls self_usec total_usec"
+
+// Hooks called on function entry and exit under -Finstrument-functions
+// Both take (fn, name); defining either one in the program replaces the default tracer
+const (
+	instrumentEnterHook = "__gbc_func_enter"
+	instrumentExitHook  = "__gbc_func_exit"
+)
+
+// funcInstrumentation holds the per-function state needed to emit epilogues
+type funcInstrumentation struct {
+	name       string
+	startTime  ir.Value // clock() at entry, nil when not profiling
+	outerChild ir.Value // caller's child time, saved at entry
+	instrument bool
+}
+
+func isRuntimeFunc(name string) bool { return strings.HasPrefix(name, "__gbc_") }
+
+// inLibrary tells whether tok is in a libb written in B, which the hooks may call themselves, as they do libc
+func (ctx *Context) inLibrary(tok token.Token) bool {
+	file := util.SourceFileName(tok.FileIndex)
+	for _, lib := range ctx.cfg.LibraryFiles {
+		if lib == file { return true }
+	}
+	return false
+}
+
+func (ctx *Context) wordGlobal(name string) *ir.Global {
+	if ctx.runtimeGlobals == nil { ctx.runtimeGlobals = make(map[string]bool) }
+	if !ctx.runtimeGlobals[name] {
+		ctx.runtimeGlobals[name] = true
+		wordType := ir.GetType(nil, ctx.wordSize)
+		ctx.prog.Globals = append(ctx.prog.Globals, &ir.Data{Name: name, Align: ctx.wordSize, Items: []ir.DataItem{{Typ: wordType, Count: 1}}})
+	}
+	return &ir.Global{Name: name}
+}
+
+func (ctx *Context) wordOp(op ir.Op, a, b ir.Value) ir.Value {
+	res := ctx.newTemp()
+	ctx.addInstr(&ir.Instruction{Op: op, Typ: ir.GetType(nil, ctx.wordSize), Result: res, Args: []ir.Value{a, b}})
+	return res
+}
+
+func (ctx *Context) callWord(fn string, args ...ir.Value) ir.Value {
+	res := ctx.newTemp()
+	wordType := ir.GetType(nil, ctx.wordSize)
+	argTypes := make([]ir.Type, len(args))
+	for i := range args { argTypes[i] = wordType }
+	ctx.addInstr(&ir.Instruction{Op: ir.OpCall, Typ: wordType, Result: res, Args: append([]ir.Value{&ir.Global{Name: fn}}, args...), ArgTypes: argTypes})
+	return res
+}
+
+// genFuncPrologue emits the -Fprofile and -Finstrument-functions entry code of the current function
+func (ctx *Context) genFuncPrologue(name string) {
+	ctx.funcInstr = funcInstrumentation{name: name}
+	if isRuntimeFunc(name) || ctx.inLibrary(ctx.currentPos) { return }
+
+	if name == "main" && ctx.cfg.IsFeatureEnabled(config.FeatCoverage) {
+		ctx.callWord("atexit", &ir.Global{Name: "__gbc_cov_dump"})
+	}
+
+	if ctx.cfg.IsFeatureEnabled(config.FeatProfile) {
+		if name == "main" {
+			ctx.callWord("atexit", &ir.Global{Name: "__gbc_prof_dump"})
+		}
+		calls := ctx.wordGlobal("__gbc_prof_calls_" + name)
+		ctx.genStore(calls, ctx.wordOp(ir.OpAdd, ctx.genLoad(calls, nil), &ir.Const{Value: 1}), nil)
+
+		// Time spent in callees is accumulated in __gbc_prof_child so that exits can compute self time
+		child := ctx.wordGlobal("__gbc_prof_child")
+		ctx.funcInstr.outerChild = ctx.genLoad(child, nil)
+		ctx.genStore(child, &ir.Const{Value: 0}, nil)
+		ctx.funcInstr.startTime = ctx.callWord("clock")
+		ctx.profFuncs = append(ctx.profFuncs, name)
+	}
+
+	if ctx.cfg.IsFeatureEnabled(config.FeatInstrumentFunctions) {
+		ctx.funcInstr.instrument = true
+		ctx.callWord(instrumentEnterHook, &ir.Global{Name: name}, ctx.addString(name))
+	}
+}
+
+// genFuncEpilogue emits the code that must run on every return path of the current function
+func (ctx *Context) genFuncEpilogue() {
+	fi := ctx.funcInstr
+	if fi.instrument {
+		ctx.callWord(instrumentExitHook, &ir.Global{Name: fi.name}, ctx.addString(fi.name))
+	}
+	if fi.startTime != nil {
+		elapsed := ctx.wordOp(ir.OpSub, ctx.callWord("clock"), fi.startTime)
+		child := ctx.wordGlobal("__gbc_prof_child")
+		self := ctx.wordGlobal("__gbc_prof_self_" + fi.name)
+		total := ctx.wordGlobal("__gbc_prof_total_" + fi.name)
+		ctx.genStore(self, ctx.wordOp(ir.OpAdd, ctx.genLoad(self, nil), ctx.wordOp(ir.OpSub, elapsed, ctx.genLoad(child, nil))), nil)
+		ctx.genStore(total, ctx.wordOp(ir.OpAdd, ctx.genLoad(total, nil), elapsed), nil)
+		ctx.genStore(child, ctx.wordOp(ir.OpAdd, fi.outerChild, elapsed), nil)
+	}
+}
+
+// genInstrumentationRuntime emits __gbc_prof_dump and the default tracing hooks
+func (ctx *Context) genInstrumentationRuntime() {
+	wordType := ir.GetType(nil, ctx.wordSize)
+	begin := func(name string, params ...string) *ir.Func {
+		fn := &ir.Func{Name: name, ReturnType: wordType}
+		for _, p := range params {
+			fn.Params = append(fn.Params, &ir.Param{Name: p, Typ: wordType, Val: &ir.Temporary{Name: p, ID: -1}})
+		}
+		ctx.prog.Funcs = append(ctx.prog.Funcs, fn)
+		ctx.currentFunc, ctx.currentBlock = fn, nil
+		ctx.startBlock(&ir.Label{Name: "start"})
+		return fn
+	}
+	end := func() {
+		ctx.addInstr(&ir.Instruction{Op: ir.OpRet, Args: []ir.Value{&ir.Const{Value: 0}}})
+		ctx.currentFunc, ctx.currentBlock = nil, nil
+	}
+
+	if ctx.cfg.IsFeatureEnabled(config.FeatProfile) {
+		begin("__gbc_prof_dump")
+		file := ctx.callWord("fopen", ctx.addString(ProfileFileName), ctx.addString("w"))
+		isNull, writeL, doneL := ctx.newTemp(), ctx.newLabel(), ctx.newLabel()
+		ctx.addInstr(&ir.Instruction{Op: ir.OpCEq, Typ: wordType, OperandType: wordType, Result: isNull, Args: []ir.Value{file, &ir.Const{Value: 0}}})
+		ctx.addInstr(&ir.Instruction{Op: ir.OpJnz, Args: []ir.Value{isNull, doneL, writeL}})
+		ctx.startBlock(writeL)
+		ctx.callWord("fprintf", file, ctx.addString(ProfileHeader+"\n"))
+		for _, name := range ctx.profFuncs {
+			calls := ctx.genLoad(ctx.wordGlobal("__gbc_prof_calls_" + name), nil)
+			self := ctx.genLoad(ctx.wordGlobal("__gbc_prof_self_" + name), nil)
+			total := ctx.genLoad(ctx.wordGlobal("__gbc_prof_total_" + name), nil)
+			ctx.callWord("fprintf", file, ctx.addString("%s %ld %ld %ld\n"), ctx.addString(name), calls, self, total)
+		}
+		ctx.callWord("fclose", file)
+		ctx.addInstr(&ir.Instruction{Op: ir.OpJmp, Args: []ir.Value{doneL}})
+		ctx.startBlock(doneL)
+		end()
+	}
+
+	if !ctx.cfg.IsFeatureEnabled(config.FeatInstrumentFunctions) { return }
+	// The default hooks print an indented call trace to stderr
+	depth := ctx.wordGlobal("__gbc_trace_depth")
+	if ctx.findSymbol(instrumentEnterHook) == nil {
+		fn := begin(instrumentEnterHook, "fn", "name")
+		d := ctx.genLoad(depth, nil)
+		ctx.callWord("dprintf", &ir.Const{Value: 2}, ctx.addString("%*s-> %s\n"), ctx.wordOp(ir.OpMul, d, &ir.Const{Value: 2}), ctx.addString(""), fn.Params[1].Val)
+		ctx.genStore(depth, ctx.wordOp(ir.OpAdd, d, &ir.Const{Value: 1}), nil)
+		end()
+	}
+	if ctx.findSymbol(instrumentExitHook) == nil {
+		fn := begin(instrumentExitHook, "fn", "name")
+		d := ctx.wordOp(ir.OpSub, ctx.genLoad(depth, nil), &ir.Const{Value: 1})
+		ctx.genStore(depth, d, nil)
+		ctx.callWord("dprintf", &ir.Const{Value: 2}, ctx.addString("%*s<- %s\n"), ctx.wordOp(ir.OpMul, d, &ir.Const{Value: 2}), ctx.addString(""), fn.Params[1].Val)
+		end()
+	}
+}
@@ -0,0 +1,262 @@
+package codegen
+
+import (
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/ast"
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/token"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// runtimeHook describes a failure handler that is synthesized into the program on first use
+// Every hook takes (file, line) followed by params, flushes stdio, prints format to stderr and then
+// aborts (exitCode < 0) or exits with exitCode
+type runtimeHook struct {
+	feature  config.Feature
+	params   []string
+	format   string
+	exitCode int64
+}
+
+// hookStdio are the functions the hooks print through, from the C library or, on backends without one, libb
+var hookStdio = []string{"fflush", "dprintf"}
+
+// NilExitCode is the exit status of programs stopped by a -Fcheck-nil trap
+const NilExitCode = 97
+
+var runtimeHooks = map[string]runtimeHook{
+	"__gbc_bounds_fail":   {config.FeatBoundsCheck, []string{"index", "len"}, "%s:%ld: index %ld out of range [0,%ld)\n", -1},
+	"__gbc_slice_fail":    {config.FeatBoundsCheck, []string{"low", "high", "len"}, "%s:%ld: slice bounds [%ld:%ld] out of range [0,%ld]\n", -1},
+	"__gbc_nil_fail":      {config.FeatCheckNil, nil, "%s:%ld: nil pointer dereference\n", NilExitCode},
+	"__gbc_overflow_fail": {config.FeatTrapv, nil, "%s:%ld: integer overflow\n", -1},
+	"__gbc_div_fail":      {config.FeatCheckDiv, nil, "%s:%ld: integer division by zero\n", -1},
+}
+
+// checkDirectiveNames maps the names accepted by `// [b]: check:` to the features they toggle
+var checkDirectiveNames = map[string]config.Feature{
+	"bounds":   config.FeatBoundsCheck,
+	"nil":      config.FeatCheckNil,
+	"overflow": config.FeatTrapv,
+	"div":      config.FeatCheckDiv,
+}
+
+// applyCheckDirective records a `// [b]: check: name no-name ...` directive for the next function
+func (ctx *Context) applyCheckDirective(node *ast.Node) {
+	ApplyCheckDirective(node, ctx.pendingChecks)
+}
+
+// ApplyCheckDirective sets the features toggled by a `// [b]: check:` directive in checks
+// Other directives are ignored
+func ApplyCheckDirective(node *ast.Node, checks map[config.Feature]bool) {
+	value := node.Data.(ast.DirectiveNode).Name
+	if !strings.HasPrefix(value, "check:") { return }
+
+	names := strings.FieldsFunc(strings.TrimPrefix(value, "check:"), func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	for _, name := range names {
+		enabled := !strings.HasPrefix(name, "no-")
+		ft, ok := checkDirectiveNames[strings.TrimPrefix(name, "no-")]
+		if !ok {
+			util.Error(node.Tok, "Unknown check '%s' in directive", name)
+		}
+		checks[ft] = enabled
+	}
+}
+
+// checkEnabled reports whether a runtime check feature applies to the current function
+// A libb written in B is never checked: the hooks call it to report, and it may rely on wrapping arithmetic
+func (ctx *Context) checkEnabled(ft config.Feature) bool {
+	if ctx.inLibrary(ctx.currentPos) { return false }
+	if enabled, ok := ctx.funcChecks[ft]; ok { return enabled }
+	return ctx.cfg.IsFeatureEnabled(ft)
+}
+
+// genRuntimeCheck branches to a call of hook when failCond is non-zero
+func (ctx *Context) genRuntimeCheck(failCond ir.Value, tok token.Token, hook string, args []ir.Value, argTypes []ir.Type) {
+	failL, okL := ctx.newLabel(), ctx.newLabel()
+	ctx.addInstr(&ir.Instruction{Op: ir.OpJnz, Args: []ir.Value{failCond, failL, okL}})
+
+	ctx.startBlock(failL)
+	wordType := ir.GetType(nil, ctx.wordSize)
+	fileName := filepath.Base(util.SourceFileName(tok.FileIndex))
+	callArgs := append([]ir.Value{&ir.Global{Name: hook}, ctx.addString(fileName), &ir.Const{Value: int64(tok.Line)}}, args...)
+	callArgTypes := append([]ir.Type{ir.TypePtr, wordType}, argTypes...)
+	ctx.addInstr(&ir.Instruction{Op: ir.OpCall, Typ: wordType, Args: callArgs, ArgTypes: callArgTypes})
+	ctx.addInstr(&ir.Instruction{Op: ir.OpJmp, Args: []ir.Value{okL}})
+
+	ctx.startBlock(okL)
+	ctx.useRuntimeHook(hook)
+}
+
+func (ctx *Context) useRuntimeHook(hook string) {
+	for _, name := range ctx.usedHooks {
+		if name == hook { return }
+	}
+	ctx.usedHooks = append(ctx.usedHooks, hook)
+}
+
+// genRuntimeHooks emits the bodies of all hooks referenced by the program
+func (ctx *Context) genRuntimeHooks() {
+	wordType := ir.GetType(nil, ctx.wordSize)
+	for _, name := range ctx.usedHooks {
+		hook := runtimeHooks[name]
+		fn := &ir.Func{Name: name, ReturnType: wordType}
+		ctx.prog.Funcs = append(ctx.prog.Funcs, fn)
+		ctx.currentFunc, ctx.currentBlock = fn, nil
+		ctx.startBlock(&ir.Label{Name: "start"})
+
+		// Flush buffered program output so it is not lost when the hook aborts
+		ctx.addInstr(&ir.Instruction{Op: ir.OpCall, Typ: wordType, Args: []ir.Value{&ir.Global{Name: hookStdio[0]}, &ir.Const{Value: 0}}, ArgTypes: []ir.Type{ir.TypePtr}})
+
+		printArgs := []ir.Value{&ir.Global{Name: hookStdio[1]}, &ir.Const{Value: 2}, ctx.addString(hook.format)}
+		printTypes := []ir.Type{wordType, ir.TypePtr}
+		for _, param := range append([]string{"file", "line"}, hook.params...) {
+			typ := wordType
+			if param == "file" { typ = ir.TypePtr }
+			val := &ir.Temporary{Name: param, ID: -1}
+			fn.Params = append(fn.Params, &ir.Param{Name: param, Typ: typ, Val: val})
+			printArgs = append(printArgs, val)
+			printTypes = append(printTypes, typ)
+		}
+		ctx.addInstr(&ir.Instruction{Op: ir.OpCall, Typ: wordType, Args: printArgs, ArgTypes: printTypes})
+
+		if hook.exitCode < 0 {
+			ctx.addInstr(&ir.Instruction{Op: ir.OpCall, Typ: wordType, Args: []ir.Value{&ir.Global{Name: "abort"}}})
+		} else {
+			ctx.addInstr(&ir.Instruction{Op: ir.OpCall, Typ: wordType, Args: []ir.Value{&ir.Global{Name: "exit"}, &ir.Const{Value: hook.exitCode}}, ArgTypes: []ir.Type{wordType}})
+		}
+		ctx.addInstr(&ir.Instruction{Op: ir.OpRet, Args: []ir.Value{&ir.Const{Value: 0}}})
+	}
+	ctx.currentFunc, ctx.currentBlock = nil, nil
+}
+
+// knownLength returns the element count of an indexed expression when it is fixed at compile time
+func (ctx *Context) knownLength(arrayNode *ast.Node) (int64, bool) {
+	if t := arrayNode.Typ; t != nil && t.Kind == ast.TYPE_ARRAY && t.ArraySize != nil {
+		return ctx.evalConstExpr(t.ArraySize)
+	}
+	if arrayNode.Type != ast.Ident { return 0, false }
+
+	sym := ctx.findSymbol(arrayNode.Data.(ast.IdentNode).Name)
+	if sym == nil || sym.Type != symVar || sym.Node == nil || sym.Node.Type != ast.VarDecl { return 0, false }
+	if sym.Node.Parent != nil && sym.Node.Parent.Type == ast.FuncDecl { return 0, false } // parameters decay to pointers
+
+	decl := sym.Node.Data.(ast.VarDeclNode)
+	if decl.Type != nil && decl.Type.Kind == ast.TYPE_ARRAY && decl.Type.ArraySize != nil {
+		return ctx.evalConstExpr(decl.Type.ArraySize)
+	}
+	if !decl.IsVector { return 0, false }
+	if decl.SizeExpr != nil { return ctx.evalConstExpr(decl.SizeExpr) }
+	if len(decl.InitList) > 0 && decl.InitList[0].Type != ast.String { return int64(len(decl.InitList)), true }
+	return 0, false
+}
+
+// genBoundsCheck traps unless 0 <= index < length
+func (ctx *Context) genBoundsCheck(tok token.Token, index ir.Value, indexType *ast.BxType, length ir.Value) {
+	wordType := ir.GetType(nil, ctx.wordSize)
+	operandType := ir.GetType(indexType, ctx.wordSize)
+
+	isNeg, isPastEnd, outOfRange := ctx.newTemp(), ctx.newTemp(), ctx.newTemp()
+	ctx.addInstr(&ir.Instruction{Op: ir.OpCLt, Typ: wordType, OperandType: operandType, Result: isNeg, Args: []ir.Value{index, &ir.Const{Value: 0}}})
+	ctx.addInstr(&ir.Instruction{Op: ir.OpCGe, Typ: wordType, OperandType: operandType, Result: isPastEnd, Args: []ir.Value{index, length}})
+	ctx.addInstr(&ir.Instruction{Op: ir.OpOr, Typ: wordType, Result: outOfRange, Args: []ir.Value{isNeg, isPastEnd}})
+
+	ctx.genRuntimeCheck(outOfRange, tok, "__gbc_bounds_fail", []ir.Value{index, length}, []ir.Type{operandType, wordType})
+}
+
+// genNilCheck traps if ptr is zero
+func (ctx *Context) genNilCheck(tok token.Token, ptr ir.Value) {
+	if !ctx.checkEnabled(config.FeatCheckNil) { return }
+	wordType := ir.GetType(nil, ctx.wordSize)
+	isNil := ctx.newTemp()
+	ctx.addInstr(&ir.Instruction{Op: ir.OpCEq, Typ: wordType, OperandType: wordType, Result: isNil, Args: []ir.Value{ptr, &ir.Const{Value: 0}}})
+	ctx.genRuntimeCheck(isNil, tok, "__gbc_nil_fail", nil, nil)
+}
+
+// isCheckedIntType reports whether arithmetic of typ is covered by -Ftrapv and -Fcheck-div,
+// which is the case for signed integers and untyped words that lower to w or l, or to h on 16-bit targets
+func (ctx *Context) isCheckedIntType(astType *ast.BxType, typ ir.Type) bool {
+	if typ != ir.TypeW && typ != ir.TypeL && typ != ir.GetType(nil, ctx.wordSize) { return false }
+	if astType == nil { return true }
+	switch astType.Kind {
+	case ast.TYPE_UNTYPED, ast.TYPE_LITERAL_INT, ast.TYPE_ENUM:
+		return true
+	case ast.TYPE_PRIMITIVE:
+		return !strings.HasPrefix(astType.Name, "uint") && astType.Name != "byte" && astType.Name != "bool"
+	}
+	return false
+}
+
+// addArithInstr adds an OpAdd/OpSub/OpMul/OpDiv/OpRem instruction, surrounded by the
+// overflow and division checks enabled for the current function
+func (ctx *Context) addArithInstr(tok token.Token, astType *ast.BxType, instr *ir.Instruction) {
+	trapv, checkDiv := ctx.checkEnabled(config.FeatTrapv), ctx.checkEnabled(config.FeatCheckDiv)
+	if (!trapv && !checkDiv) || !ctx.isCheckedIntType(astType, instr.Typ) {
+		ctx.addInstr(instr)
+		return
+	}
+
+	typ := instr.Typ
+	l, r := instr.Args[0], instr.Args[1]
+	minValue := int64(math.MinInt64)
+	switch typ {
+	case ir.TypeW: minValue = math.MinInt32
+	case ir.TypeH: minValue = math.MinInt16
+	}
+
+	// cmp and bin emit a comparison or bitwise op of type typ and return its result
+	cmp := func(op ir.Op, a, b ir.Value) ir.Value {
+		res := ctx.newTemp()
+		ctx.addInstr(&ir.Instruction{Op: op, Typ: typ, OperandType: typ, Result: res, Args: []ir.Value{a, b}})
+		return res
+	}
+	bin := func(op ir.Op, a, b ir.Value) ir.Value {
+		res := ctx.newTemp()
+		ctx.addInstr(&ir.Instruction{Op: op, Typ: typ, Result: res, Args: []ir.Value{a, b}})
+		return res
+	}
+
+	isDiv := instr.Op == ir.OpDiv || instr.Op == ir.OpRem
+	if isDiv {
+		// Both checks must run before the division, which would otherwise raise SIGFPE
+		if checkDiv {
+			ctx.genRuntimeCheck(cmp(ir.OpCEq, r, &ir.Const{Value: 0}), tok, "__gbc_div_fail", nil, nil)
+		}
+		if trapv {
+			minByMinusOne := bin(ir.OpAnd, cmp(ir.OpCEq, l, &ir.Const{Value: minValue}), cmp(ir.OpCEq, r, &ir.Const{Value: -1}))
+			ctx.genRuntimeCheck(minByMinusOne, tok, "__gbc_overflow_fail", nil, nil)
+		}
+		ctx.addInstr(instr)
+		return
+	}
+
+	ctx.addInstr(instr)
+	if !trapv { return }
+
+	res := instr.Result
+	var overflow ir.Value
+	switch instr.Op {
+	case ir.OpAdd:
+		// Overflow iff both operands differ in sign from the result
+		overflow = cmp(ir.OpCLt, bin(ir.OpAnd, bin(ir.OpXor, l, res), bin(ir.OpXor, r, res)), &ir.Const{Value: 0})
+	case ir.OpSub:
+		// Overflow iff the operands differ in sign and the result differs from l
+		overflow = cmp(ir.OpCLt, bin(ir.OpAnd, bin(ir.OpXor, l, r), bin(ir.OpXor, l, res)), &ir.Const{Value: 0})
+	case ir.OpMul:
+		// Overflow iff res / l != r, computed with l replaced by 1 when it is 0 or -1 so the
+		// division itself cannot trap; l == -1 only overflows for r == MIN
+		lIsZero, lIsMinusOne := cmp(ir.OpCEq, l, &ir.Const{Value: 0}), cmp(ir.OpCEq, l, &ir.Const{Value: -1})
+		special := bin(ir.OpOr, lIsZero, lIsMinusOne)
+		safeL := bin(ir.OpAdd, l, bin(ir.OpMul, special, bin(ir.OpSub, &ir.Const{Value: 1}, l)))
+		mismatch := cmp(ir.OpCNeq, bin(ir.OpDiv, res, safeL), r)
+		overflow = bin(ir.OpOr,
+			bin(ir.OpAnd, mismatch, bin(ir.OpXor, special, &ir.Const{Value: 1})),
+			bin(ir.OpAnd, lIsMinusOne, cmp(ir.OpCEq, r, &ir.Const{Value: minValue})))
+	default:
+		return
+	}
+	ctx.genRuntimeCheck(overflow, tok, "__gbc_overflow_fail", nil, nil)
+}
@@ -0,0 +1,155 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/xplshn/gbc/pkg/ast"
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// A slice is the address of its header, an ast.SliceHeader holding a pointer to its first element and its
+// length, so that it is stored, passed and returned as a struct. Slicing and array literals make a new header in
+// the frame of the function
+
+// resolveSlice is the slice type typ is or names, nil if it is neither
+func (ctx *Context) resolveSlice(typ *ast.BxType) *ast.BxType {
+	if typ != nil && typ.Kind == ast.TYPE_PRIMITIVE && typ.Name != "" {
+		if sym := ctx.findTypeSymbol(typ.Name); sym != nil && sym.BxType != typ { return ctx.resolveSlice(sym.BxType) }
+	}
+	if typ != nil && typ.Kind == ast.TYPE_SLICE { return typ }
+	return nil
+}
+
+// sliceLen loads the length of the slice whose header is at header
+func (ctx *Context) sliceLen(header ir.Value) ir.Value {
+	wordType := ir.GetType(nil, ctx.wordSize)
+	addr := ctx.newTemp()
+	ctx.addInstr(&ir.Instruction{Op: ir.OpAdd, Typ: wordType, Result: addr, Args: []ir.Value{header, &ir.Const{Value: int64(ctx.wordSize)}}})
+	return ctx.genLoad(addr, nil)
+}
+
+// newSlice makes a header in the frame for length elements at ptr
+func (ctx *Context) newSlice(ptr, length ir.Value) ir.Value {
+	wordType := ir.GetType(nil, ctx.wordSize)
+	header, lenAddr := ctx.newTemp(), ctx.newTemp()
+	ctx.addInstr(&ir.Instruction{
+		Op:     ir.OpAlloc,
+		Typ:    wordType,
+		Result: header,
+		Args:   []ir.Value{&ir.Const{Value: ctx.getSizeof(ast.SliceHeader)}},
+		Align:  int(ctx.getAlignof(ast.SliceHeader)),
+	})
+	ctx.genStore(header, ptr, nil)
+	ctx.addInstr(&ir.Instruction{Op: ir.OpAdd, Typ: wordType, Result: lenAddr, Args: []ir.Value{header, &ir.Const{Value: int64(ctx.wordSize)}}})
+	ctx.genStore(lenAddr, length, nil)
+	return header
+}
+
+// sliceOperand returns the address of the first element of what is sliced and how many there are, nil for a
+// pointer, which does not know
+func (ctx *Context) sliceOperand(node *ast.Node) (ptr, length ir.Value) {
+	val, _ := ctx.codegenExpr(node)
+	if ctx.resolveSlice(node.Typ) != nil { return ctx.genLoad(val, nil), ctx.sliceLen(val) }
+	if node.Type == ast.String { return val, &ir.Const{Value: int64(len(node.Data.(ast.StringNode).Value))} }
+	if n, ok := ctx.knownLength(node); ok { return val, &ir.Const{Value: n} }
+	return val, nil
+}
+
+// codegenSlice makes the slice expr[low:high], checking 0 <= low <= high <= len(expr) under -Fbounds-check
+func (ctx *Context) codegenSlice(node *ast.Node) (ir.Value, bool) {
+	d := node.Data.(ast.SliceNode)
+	wordType := ir.GetType(nil, ctx.wordSize)
+	ptr, length := ctx.sliceOperand(d.Expr)
+
+	var low, high ir.Value = &ir.Const{Value: 0}, length
+	if d.Low != nil {
+		val, _ := ctx.codegenExpr(d.Low)
+		low = ctx.widenToWord(val, d.Low.Typ)
+	}
+	if d.High != nil {
+		val, _ := ctx.codegenExpr(d.High)
+		high = ctx.widenToWord(val, d.High.Typ)
+	}
+	if length == nil { length = high }
+
+	if ctx.checkEnabled(config.FeatBoundsCheck) {
+		isNeg, isReversed, isPastEnd, isBad, outOfRange := ctx.newTemp(), ctx.newTemp(), ctx.newTemp(), ctx.newTemp(), ctx.newTemp()
+		ctx.addInstr(&ir.Instruction{Op: ir.OpCLt, Typ: wordType, OperandType: wordType, Result: isNeg, Args: []ir.Value{low, &ir.Const{Value: 0}}})
+		ctx.addInstr(&ir.Instruction{Op: ir.OpCGt, Typ: wordType, OperandType: wordType, Result: isReversed, Args: []ir.Value{low, high}})
+		ctx.addInstr(&ir.Instruction{Op: ir.OpCGt, Typ: wordType, OperandType: wordType, Result: isPastEnd, Args: []ir.Value{high, length}})
+		ctx.addInstr(&ir.Instruction{Op: ir.OpOr, Typ: wordType, Result: isBad, Args: []ir.Value{isNeg, isReversed}})
+		ctx.addInstr(&ir.Instruction{Op: ir.OpOr, Typ: wordType, Result: outOfRange, Args: []ir.Value{isBad, isPastEnd}})
+		ctx.genRuntimeCheck(outOfRange, node.Tok, "__gbc_slice_fail", []ir.Value{low, high, length}, []ir.Type{wordType, wordType, wordType})
+	}
+
+	elemPtr, newLen := ptr, ctx.newTemp()
+	if c, ok := low.(*ir.Const); !ok || c.Value != 0 {
+		offset := low
+		if size := ctx.getSizeof(ctx.resolveSlice(node.Typ).Base); size != 1 {
+			offset = ctx.newTemp()
+			ctx.addInstr(&ir.Instruction{Op: ir.OpMul, Typ: wordType, Result: offset, Args: []ir.Value{low, &ir.Const{Value: size}}})
+		}
+		elemPtr = ctx.newTemp()
+		ctx.addInstr(&ir.Instruction{Op: ir.OpAdd, Typ: wordType, Result: elemPtr, Args: []ir.Value{ptr, offset}})
+	}
+	ctx.addInstr(&ir.Instruction{Op: ir.OpSub, Typ: wordType, Result: newLen, Args: []ir.Value{high, low}})
+	return ctx.newSlice(elemPtr, newLen), false
+}
+
+// codegenLen is the length of a slice, or that of an array, which is known
+func (ctx *Context) codegenLen(node *ast.Node) (ir.Value, bool) {
+	expr := node.Data.(ast.LenNode).Expr
+	if ctx.resolveSlice(expr.Typ) == nil {
+		if n, ok := ctx.knownLength(expr); ok { return &ir.Const{Value: n}, false }
+	}
+	header, _ := ctx.codegenExpr(expr)
+	return ctx.sliceLen(header), false
+}
+
+// codegenGlobalSlice is the header of a global slice initialized with init, which is a string, the start of a
+// global array up to a constant bound, nil or an array literal of constants
+func (ctx *Context) codegenGlobalSlice(name string, init *ast.Node) []ir.DataItem {
+	// The length is given as a pointer too, since backends lay out the items of a global as an array of one type
+	header := func(ptr ir.Value, length int64) []ir.DataItem {
+		return []ir.DataItem{{Typ: ir.TypePtr, Value: ptr}, {Typ: ir.TypePtr, Value: &ir.Const{Value: length}}}
+	}
+
+	if init.Type == ast.ArrayLiteral {
+		d := init.Data.(ast.ArrayLiteralNode)
+		if len(d.Values) == 0 { return header(&ir.Const{Value: 0}, 0) }
+		elems := &ir.Data{Name: fmt.Sprintf("__gbc_elems_%s", name), Align: int(ctx.getAlignof(d.ElementType)), AstType: d.ElementType}
+		for _, v := range d.Values {
+			val := ctx.codegenGlobalConst(v)
+			itemType := ir.GetType(d.ElementType, ctx.wordSize)
+			if _, ok := val.(*ir.Global); ok { itemType = ir.TypePtr }
+			elems.Items = append(elems.Items, ir.DataItem{Typ: itemType, Value: val})
+		}
+		ctx.prog.Globals = append(ctx.prog.Globals, elems)
+		return header(&ir.Global{Name: elems.Name}, int64(len(d.Values)))
+	}
+
+	if init.Type == ast.Slice {
+		d := init.Data.(ast.SliceNode)
+		var length int64
+		ok := true
+		switch {
+		case d.Expr.Type == ast.String: length = int64(len(d.Expr.Data.(ast.StringNode).Value))
+		case d.Expr.Type == ast.Ident: length, ok = ctx.knownLength(d.Expr)
+		default: ok = false
+		}
+		high := length
+		if ok && d.Low != nil {
+			low, isConst := ctx.evalConstExpr(d.Low)
+			ok = isConst && low == 0
+		}
+		if ok && d.High != nil { high, ok = ctx.evalConstExpr(d.High) }
+		if ok {
+			if high < 0 || high > length { util.Error(init.Tok, "Slice bounds [0:%d] out of range [0,%d]", high, length) }
+			return header(ctx.codegenGlobalConst(d.Expr), high)
+		}
+	}
+	util.Error(init.Tok, "Global slice initializer must be a string, a global array sliced from 0 to a constant, nil or an array literal of constants")
+	return nil
+}
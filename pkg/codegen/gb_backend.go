@@ -0,0 +1,989 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/sm83"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// The gb backend lowers the IR to assembly for the SM83 CPU of the Game Boy, which cmd/gbc assembles with
+// pkg/sm83 into a 32 KiB ROM-only cartridge. Words are 16 bits, and functions follow the convention of the
+// `__asm__` functions of lib/b/gb.b: the arguments are pushed on the hardware stack, the last first, the caller
+// pops them, and the result comes back in HL; every register is the caller's to save
+// Every temporary is a word in the frame of its function on the hardware stack, reached relative to SP; word
+// parameters are read where the caller pushed them, and autos follow the temporaries
+// Code, strings and the font live in ROM, where no function or string straddles the two banks; globals live in
+// WRAM, copied there from their image in ROM at startup, with the heap after them
+// The runtime draws what putchar writes on a tile console, and sends it through the serial port too, which is
+// how pkg/sm83 captures it; getchar reads the joypad and exit halts the CPU with the status in A
+
+const gbHeader = `__row = $FF80 ; console cursor and scrolling
+__col = $FF81
+__lines = $FF82
+__cnt = $FF83 ; scratch for the runtime
+__sgna = $FF84
+__sgnq = $FF85
+`
+
+// gbRuntime holds the routines the generated code calls, and the routines each of them needs in turn
+var gbRuntime = map[string]retroRoutine{
+	"__icall": {code: `__icall:
+	JP HL
+`},
+	// HL = HL * DE
+	"__mul": {code: `__mul:
+	LD B,H
+	LD C,L
+	LD HL,0
+	LD A,16
+@__mul_bit:
+	ADD HL,HL
+	SLA E
+	RL D
+	JR NC,@__mul_next
+	ADD HL,BC
+@__mul_next:
+	DEC A
+	JR NZ,@__mul_bit
+	RET
+`},
+	// HL, DE = HL / DE, HL % DE as unsigned numbers, restoring the remainder in BC after each step; a remainder
+	// that overflowed into a 17th bit is always larger than the divisor
+	"__udiv": {code: `__udiv:
+	LD BC,0
+	LD A,16
+	LDH (__cnt),A
+@__udiv_bit:
+	ADD HL,HL
+	RL C
+	RL B
+	JR C,@__udiv_force
+	LD A,C
+	SUB E
+	LD C,A
+	LD A,B
+	SBC D
+	LD B,A
+	JR NC,@__udiv_one
+	LD A,C
+	ADD E
+	LD C,A
+	LD A,B
+	ADC D
+	LD B,A
+	JR @__udiv_next
+@__udiv_force:
+	LD A,C
+	SUB E
+	LD C,A
+	LD A,B
+	SBC D
+	LD B,A
+@__udiv_one:
+	INC L
+@__udiv_next:
+	LDH A,(__cnt)
+	DEC A
+	LDH (__cnt),A
+	JR NZ,@__udiv_bit
+	LD D,B
+	LD E,C
+	RET
+`},
+	// HL, DE = HL / DE, HL % DE, truncating towards zero
+	"__div": {uses: []string{"__udiv", "__neghl"}, code: `__div:
+	LD A,H
+	LDH (__sgna),A
+	XOR D
+	LDH (__sgnq),A
+	BIT 7,H
+	CALL NZ,__neghl
+	BIT 7,D
+	JR Z,@__div_b
+	LD A,E
+	CPL
+	LD E,A
+	LD A,D
+	CPL
+	LD D,A
+	INC DE
+@__div_b:
+	CALL __udiv
+	LDH A,(__sgnq)
+	BIT 7,A
+	CALL NZ,__neghl
+	LDH A,(__sgna)
+	BIT 7,A
+	RET Z
+	LD A,E
+	CPL
+	LD E,A
+	LD A,D
+	CPL
+	LD D,A
+	INC DE
+	RET
+`},
+	"__neghl": {code: `__neghl:
+	LD A,L
+	CPL
+	LD L,A
+	LD A,H
+	CPL
+	LD H,A
+	INC HL
+	RET
+`},
+	// HL <<= E and HL >>= E, by the low four bits of E
+	"__shl": {code: `__shl:
+	LD A,E
+	AND 15
+	RET Z
+@__shl_bit:
+	ADD HL,HL
+	DEC A
+	JR NZ,@__shl_bit
+	RET
+`},
+	"__shr": {code: `__shr:
+	LD A,E
+	AND 15
+	RET Z
+@__shr_bit:
+	SRL H
+	RR L
+	DEC A
+	JR NZ,@__shr_bit
+	RET
+`},
+}
+
+// gbSystem is the startup code and the routines behind putchar, getchar and exit in lib/b/gb.b, which every
+// program gets; __start is entered with the LCD on, and turns it off to load the font
+const gbSystem = `
+__start:
+	DI
+	LD SP,$%04X
+@__start_vblank:
+	LDH A,($44)
+	CP 144
+	JR C,@__start_vblank
+	XOR A
+	LDH ($40),A
+	LDH ($42),A
+	LDH ($43),A
+	LDH (__row),A
+	LDH (__col),A
+	LDH (__lines),A
+	LD HL,__font
+	LD DE,$8200
+	LD B,96
+@__start_glyph:
+	XOR A
+	LD (DE),A
+	INC DE
+	LD (DE),A
+	INC DE
+	LD C,5
+@__start_row:
+	LD A,(HL+)
+	LD (DE),A
+	INC DE
+	LD (DE),A
+	INC DE
+	DEC C
+	JR NZ,@__start_row
+	XOR A
+	LD C,4
+@__start_pad:
+	LD (DE),A
+	INC DE
+	DEC C
+	JR NZ,@__start_pad
+	DEC B
+	JR NZ,@__start_glyph
+	LD HL,$9800
+	LD BC,$0400
+@__start_clear:
+	LD A,32
+	LD (HL+),A
+	DEC BC
+	LD A,B
+	OR C
+	JR NZ,@__start_clear
+	LD A,$E4
+	LDH ($47),A
+	LD A,$80
+	LDH ($68),A
+	LD HL,@__start_palette
+	LD B,8
+@__start_color:
+	LD A,(HL+)
+	LDH ($69),A
+	DEC B
+	JR NZ,@__start_color
+	LD A,$91
+	LDH ($40),A
+	LD HL,__data_load
+	LD DE,__data_start
+	LD BC,__data_end-__data_start
+@__start_copy:
+	LD A,B
+	OR C
+	JR Z,@__start_main
+	LD A,(HL+)
+	LD (DE),A
+	INC DE
+	DEC BC
+	JR @__start_copy
+@__start_palette:
+	.byte $FF, $7F, $94, $52, $4A, $29, $00, $00
+@__start_main:
+`
+
+const gbConsole = `
+__exit:
+	LD HL,SP+2
+	DI
+	XOR A
+	LDH ($FF),A
+	LD A,(HL)
+	HALT
+@__exit_hang:
+	JR @__exit_hang
+
+__putchar:
+	LD HL,SP+2
+	LD A,(HL)
+	LDH ($01),A
+	LD A,$81
+	LDH ($02),A
+	LD A,(HL)
+	CP 10
+	JR Z,@__putchar_newline
+	LD C,A
+	LDH A,(__col)
+	CP 20
+	JR C,@__putchar_tile
+	PUSH BC
+	CALL __newline
+	POP BC
+@__putchar_tile:
+	CALL __cursor
+	CALL __vram_wait
+	LD (HL),C
+	LDH A,(__col)
+	INC A
+	LDH (__col),A
+	JR @__putchar_done
+@__putchar_newline:
+	CALL __newline
+@__putchar_done:
+	LD HL,SP+2
+	LD L,(HL)
+	LD H,0
+	RET
+
+; HL = the address in the tile map of the cursor
+__cursor:
+	LDH A,(__row)
+	LD L,A
+	LD H,0
+	ADD HL,HL
+	ADD HL,HL
+	ADD HL,HL
+	ADD HL,HL
+	ADD HL,HL
+	LDH A,(__col)
+	ADD A,L
+	LD L,A
+	LD A,H
+	ADD A,$98
+	LD H,A
+	RET
+
+; Moves the cursor to the start of the next row of the map, which it clears, scrolling once the screen is full
+__newline:
+	XOR A
+	LDH (__col),A
+	LDH A,(__row)
+	INC A
+	AND 31
+	LDH (__row),A
+	CALL __cursor
+	LD B,32
+@__newline_clear:
+	CALL __vram_wait
+	LD A,32
+	LD (HL+),A
+	DEC B
+	JR NZ,@__newline_clear
+	LDH A,(__lines)
+	CP 17
+	JR NC,@__newline_scroll
+	INC A
+	LDH (__lines),A
+	RET
+@__newline_scroll:
+	LDH A,($42)
+	ADD A,8
+	LDH ($42),A
+	RET
+
+; Waits until VRAM can be written, which it can for long enough after STAT leaves mode 3
+__vram_wait:
+	LDH A,($41)
+	AND 2
+	JR NZ,__vram_wait
+	RET
+
+; A = the buttons pressed in the high nibble, and the d-pad in the low one
+__joypad:
+	LD A,$20
+	LDH ($00),A
+	LDH A,($00)
+	LDH A,($00)
+	CPL
+	AND $0F
+	LD C,A
+	LD A,$10
+	LDH ($00),A
+	LDH A,($00)
+	LDH A,($00)
+	CPL
+	AND $0F
+	SWAP A
+	OR C
+	LD C,A
+	LD A,$30
+	LDH ($00),A
+	LD A,C
+	RET
+
+; Waits for a press and its release, returning the character of its lowest button, or -1 for Start+Select
+__getchar:
+	CALL __joypad
+	AND A
+	JR NZ,__getchar
+@__getchar_press:
+	CALL __joypad
+	AND A
+	JR Z,@__getchar_press
+	LD B,A
+@__getchar_release:
+	CALL __joypad
+	AND A
+	JR NZ,@__getchar_release
+	LD A,B
+	CP $C0
+	JR Z,@__getchar_eof
+	LD HL,@__getchar_keys
+@__getchar_bit:
+	RRA
+	JR C,@__getchar_found
+	INC HL
+	JR @__getchar_bit
+@__getchar_found:
+	LD L,(HL)
+	LD H,0
+	RET
+@__getchar_eof:
+	LD HL,-1
+	RET
+@__getchar_keys:
+	.byte "rludab \n"
+`
+
+// gbFont is the console font from ' ' to DEL, three pixels wide and five high: each glyph is five rows of three
+// bits, written as octal digits with the leftmost pixel in the highest bit
+var gbFont = strings.Fields(`
+00000 22202 55000 57575 36363 51245 25353 22000 12221 42224 05250 02720 00024 00700 00002 11244
+75557 26227 71747 71717 55711 74717 74757 71111 75757 75717 02020 02024 12421 07070 42124 71202
+25743 25755 65656 34443 65556 74647 74644 34553 55755 72227 11153 55655 44447 57755 65555 25552
+65644 25573 65655 34216 72222 55557 55552 55775 55255 55222 71247 64446 44211 31113 25000 00007
+42000 03553 44656 03443 11353 03743 12722 03536 44655 20222 10116 45655 62227 07755 06555 02552
+06564 03531 06544 03616 27221 05557 05552 05577 05255 05316 07247 32623 22222 62326 03600 77777
+`)
+
+type gbBackend struct {
+	retroBackend
+	size  int64 // of the frame of the function being lowered
+	depth int64 // bytes pushed since, while a call passes its arguments
+}
+
+func NewGBBackend() Backend {
+	b := &gbBackend{}
+	b.retroBackend = retroBackend{target: b, name: "gb", routines: gbRuntime}
+	return b
+}
+
+func init() {
+	Register(BackendInfo{
+		Name: "gb", Description: "a Game Boy Color cartridge", New: NewGBBackend,
+		Targets:       []config.SubTarget{{Name: "sm83-unknown-gb", GOOS: "gb", GOARCH: "sm83"}},
+		DefaultTarget: func(string, string) string { return "sm83-unknown-gb" },
+		WordSizes:     []int{2},
+		Capabilities:  Capabilities{Asm: "sm83"},
+	})
+}
+
+func (b *gbBackend) Generate(prog *ir.Program, cfg *config.Config) (*bytes.Buffer, error) {
+	text, err := b.GenerateIR(prog, cfg)
+	if err != nil { return nil, err }
+	return bytes.NewBufferString(text), nil
+}
+
+// GenerateIR writes the assembly, which is all the gb backend has to show
+func (b *gbBackend) GenerateIR(prog *ir.Program, cfg *config.Config) (string, error) {
+	main, err := b.begin(prog, cfg)
+	if err != nil { return "", err }
+
+	b.out.WriteString("; Generated by gbc for the Game Boy\n")
+	b.out.WriteString(gbHeader)
+	b.genCartridgeHeader()
+	b.genStart(main)
+	for _, fn := range b.prog.Funcs {
+		if err := b.genFunc(fn); err != nil { return "", err }
+	}
+	b.genRuntime()
+	if err := b.genData(); err != nil { return "", err }
+	return b.out.String(), nil
+}
+
+func (b *gbBackend) label(name string) { fmt.Fprintf(b.out, "%s:\n", name) }
+
+func (b *gbBackend) newLabel() string {
+	b.labels++
+	return fmt.Sprintf("@%d", b.labels)
+}
+
+// genCartridgeHeader writes the header at $0100 the boot ROM checks, for a CGB-compatible ROM-only cartridge;
+// the assembler fills in the checksums
+func (b *gbBackend) genCartridgeHeader() {
+	b.ins(".org $0100")
+	b.ins("NOP")
+	b.ins("JP __start")
+	logo := make([]string, len(sm83.Logo))
+	for i, c := range sm83.Logo {
+		logo[i] = fmt.Sprintf("$%02X", c)
+	}
+	for i := 0; i < len(logo); i += 16 {
+		b.ins(".byte %s", strings.Join(logo[i:i+16], ", "))
+	}
+	b.ins(`.byte "GBC"`)
+	b.ins(".fill 12")
+	b.ins(".byte $80 ; works on the CGB and the DMG")
+	b.ins(".byte 0, 0, 0, 0, 0, 0, 1, 0, 0 ; licensee, SGB, ROM only, 32 KiB, no RAM, overseas, licensee, version")
+	b.ins(".byte 0 ; header checksum")
+	b.ins(".word 0 ; global checksum")
+}
+
+// genStart sets up the machine, calls main with the argc and argv of a program named "gb", and exits with its result
+func (b *gbBackend) genStart(main *ir.Func) {
+	fmt.Fprintf(b.out, gbSystem, sm83.StackTop)
+	if len(main.Params) > 1 {
+		b.ins("LD HL,@__start_argv")
+		b.ins("PUSH HL")
+		b.ins("LD HL,1")
+		b.ins("PUSH HL")
+	}
+	b.ins("CALL main")
+	b.ins("PUSH HL")
+	b.ins("CALL __exit")
+	b.label("@__start_argv")
+	b.ins(".word @__start_name, 0")
+	b.label("@__start_name")
+	b.ins(`.byte "gb", 0`)
+	b.out.WriteString(gbConsole)
+}
+
+// genRuntime writes the runtime routines used, and the font of the console
+func (b *gbBackend) genRuntime() {
+	b.retroBackend.genRuntime()
+	b.out.WriteString("\n")
+	b.label("__font")
+	for _, glyph := range gbFont {
+		rows := make([]string, len(glyph))
+		for i, c := range glyph {
+			// Two columns in from the left of the tile
+			rows[i] = fmt.Sprintf("$%02X", (c-'0')<<3)
+		}
+		b.ins(".byte %s", strings.Join(rows, ", "))
+	}
+}
+
+// genData writes the strings to ROM, and the globals and extrn variables to the data section, ending at __heap
+func (b *gbBackend) genData() error {
+	b.genStrings()
+	b.out.WriteString("\n\t.section data\n")
+	if err := b.genGlobals(); err != nil { return err }
+	b.genExtrnVars("__heap")
+	b.label("__heap")
+	// The inline assembly the driver appends after this is code, so it goes back to ROM
+	b.out.WriteString("\n\t.section rom\n")
+	return nil
+}
+
+func (b *gbBackend) genBytes(data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), 16)
+		parts := make([]string, n)
+		for i, c := range data[:n] {
+			parts[i] = fmt.Sprintf("%d", c)
+		}
+		b.ins(".byte %s", strings.Join(parts, ", "))
+		data = data[n:]
+	}
+}
+
+func (b *gbBackend) genFill(size int64) { b.ins(".fill %d", size) }
+
+func (b *gbBackend) genAddr(name string) { b.ins(".word %s", name) }
+
+// check rejects values the gb backend has no room for in its 16-bit registers
+func (b *gbBackend) check(t ir.Type) {
+	switch {
+	case isFloatIR(t): util.Error(b.pos, "floating-point is not supported by the gb backend")
+	case b.width(t) > 2: util.Error(b.pos, "integers wider than 16 bits are not supported by the gb backend")
+	}
+}
+
+// frameAddr points HL at the frame byte at off, past whatever a call in progress has pushed
+func (b *gbBackend) frameAddr(off int64) {
+	off += b.depth
+	if off <= 127 {
+		b.ins("LD HL,SP+%d", off)
+		return
+	}
+	b.ins("LD HL,%d", off)
+	b.ins("ADD HL,SP")
+}
+
+// load sets the register pair rr, HL or DE, to v; loading DE from the frame goes through HL, so an operation
+// loads DE first
+func (b *gbBackend) load(v ir.Value, rr string) {
+	switch val := v.(type) {
+	case *ir.Const:
+		b.ins("LD %s,%d", rr, int16(val.Value))
+		return
+	case *ir.Global:
+		b.ins("LD %s,%s", rr, val.Name)
+		return
+	case *ir.CastValue:
+		b.load(val.Value, rr)
+		return
+	case *ir.FloatConst: util.Error(b.pos, "floating-point is not supported by the gb backend")
+	case *ir.Temporary:
+		if off, ok := b.slots[tempName{val.Name, val.ID}]; ok {
+			b.frameAddr(off)
+			if rr == "HL" {
+				b.ins("LD A,(HL+)")
+				b.ins("LD H,(HL)")
+				b.ins("LD L,A")
+			} else {
+				b.ins("LD E,(HL)")
+				b.ins("INC HL")
+				b.ins("LD D,(HL)")
+			}
+			return
+		}
+	}
+	b.ins("LD %s,0", rr)
+}
+
+// store sets the temporary r to HL
+func (b *gbBackend) store(r ir.Value) {
+	tmp, ok := r.(*ir.Temporary)
+	if !ok || tmp == nil { return }
+	if off, ok := b.slots[tempName{tmp.Name, tmp.ID}]; ok { b.storeAt(off) }
+}
+
+// storeAt sets the frame word at off to HL
+func (b *gbBackend) storeAt(off int64) {
+	b.ins("LD D,H")
+	b.ins("LD E,L")
+	b.frameAddr(off)
+	b.ins("LD (HL),E")
+	b.ins("INC HL")
+	b.ins("LD (HL),D")
+}
+
+// extend makes HL a value of type t, extending L if t is a byte
+func (b *gbBackend) extend(t ir.Type) {
+	if b.width(t) != 1 { return }
+	if !signedType(t) {
+		b.ins("LD H,0")
+		return
+	}
+	b.ins("LD A,L")
+	b.ins("ADD A,A")
+	b.ins("SBC A")
+	b.ins("LD H,A")
+}
+
+func (b *gbBackend) genFunc(fn *ir.Func) error {
+	b.beginFunc(fn)
+	b.depth = 0
+
+	// The temporaries, then the autos; word parameters stay where the caller pushed them, past the return address
+	end := int64(0)
+	incoming := make(map[tempName]int64)
+	define := func(v ir.Value, t ir.Type) {
+		tmp, ok := v.(*ir.Temporary)
+		if !ok || tmp == nil { return }
+		key := tempName{tmp.Name, tmp.ID}
+		if _, defined := b.temps[key]; defined { return }
+		b.check(t)
+		b.temps[key] = t
+		b.slots[key] = end
+		end += 2
+	}
+	for k, p := range fn.Params {
+		if tmp, ok := p.Val.(*ir.Temporary); ok && b.width(p.Typ) == 2 {
+			key := tempName{tmp.Name, tmp.ID}
+			b.temps[key] = p.Typ
+			incoming[key] = int64(2 + 2*k)
+			continue
+		}
+		define(p.Val, p.Typ)
+	}
+	for _, block := range fn.Blocks {
+		for _, instr := range block.Instructions {
+			b.pos = instr.Pos
+			define(instr.Result, resultType(instr, b.prog.WordSize))
+			if instr.Op == ir.OpPhi {
+				tmp := instr.Result.(*ir.Temporary)
+				b.phis[block.Label.Name] = append(b.phis[block.Label.Name], instr)
+				b.shadows[tempName{tmp.Name, tmp.ID}] = end
+				end += 2
+			}
+		}
+	}
+	for _, block := range fn.Blocks {
+		for _, instr := range block.Instructions {
+			if instr.Op != ir.OpAlloc { continue }
+			size, ok := instr.Args[0].(*ir.Const)
+			if !ok { util.Error(instr.Pos, "autos of a size known only at run time are not supported by the gb backend") }
+			b.frame[instr] = end
+			end += size.Value
+		}
+	}
+	if end > 0x7FFF { return fmt.Errorf("the frame of '%s' is larger than 32 KiB", fn.Name) }
+	b.size = end
+	for key, off := range incoming {
+		b.slots[key] = end + off
+	}
+
+	b.out.WriteString("\n")
+	b.label(fn.Name)
+	b.genPrologue()
+	b.genBlocks()
+	b.genEpilogue()
+	return nil
+}
+
+func (b *gbBackend) blockLabel(name string) string { return "@" + b.fn.Name + "." + name }
+
+func (b *gbBackend) genBlockLabel(name string) { b.label(b.blockLabel(name)) }
+
+// addSP moves SP by n, keeping HL
+func (b *gbBackend) addSP(n int64) {
+	switch {
+	case n == 0:
+	case n >= -128 && n <= 127: b.ins("ADD SP,%d", n)
+	default:
+		b.ins("LD D,H")
+		b.ins("LD E,L")
+		b.ins("LD HL,%d", n)
+		b.ins("ADD HL,SP")
+		b.ins("LD SP,HL")
+		b.ins("LD H,D")
+		b.ins("LD L,E")
+	}
+}
+
+// genPrologue makes room for the frame, and copies byte parameters to slots of their own, extended
+func (b *gbBackend) genPrologue() {
+	b.addSP(-b.size)
+	for k, p := range b.fn.Params {
+		tmp, ok := p.Val.(*ir.Temporary)
+		if !ok || b.width(p.Typ) == 2 { continue }
+		if _, ok := b.slots[tempName{tmp.Name, tmp.ID}]; !ok { continue }
+		b.frameAddr(b.size + int64(2+2*k))
+		b.ins("LD L,(HL)")
+		b.extend(p.Typ)
+		b.store(p.Val)
+	}
+}
+
+// genEpilogue drops the frame and returns the value left in HL
+func (b *gbBackend) genEpilogue() {
+	b.label(b.blockLabel("ret"))
+	b.addSP(b.size)
+	b.ins("RET")
+}
+
+func (b *gbBackend) genReturn(v ir.Value) {
+	if v == nil || b.fn.ReturnType == ir.TypeNone {
+		b.ins("LD HL,0")
+	} else {
+		b.load(v, "HL")
+	}
+	b.ins("JP %s", b.blockLabel("ret"))
+}
+
+func (b *gbBackend) genPhiOut(phi *ir.Temporary, v ir.Value) {
+	b.load(v, "HL")
+	b.storeAt(b.shadows[tempName{phi.Name, phi.ID}])
+}
+
+func (b *gbBackend) genPhiIn(phi *ir.Temporary) {
+	b.frameAddr(b.shadows[tempName{phi.Name, phi.ID}])
+	b.ins("LD A,(HL+)")
+	b.ins("LD H,(HL)")
+	b.ins("LD L,A")
+	b.store(phi)
+}
+
+func (b *gbBackend) genJumpTo(block string) { b.ins("JP %s", b.blockLabel(block)) }
+
+// gbBitwise holds the operation of A with a register that each bitwise operation applies byte by byte
+var gbBitwise = map[ir.Op]string{ir.OpAnd: "AND", ir.OpOr: "OR", ir.OpXor: "XOR"}
+
+// gbCalls holds the runtime routine of each operation it does
+var gbCalls = map[ir.Op]string{ir.OpMul: "__mul", ir.OpDiv: "__div", ir.OpRem: "__div", ir.OpShl: "__shl", ir.OpShr: "__shr"}
+
+func (b *gbBackend) genInstr(block *ir.BasicBlock, instr *ir.Instruction) {
+	args, typ := instr.Args, instr.Typ
+	b.pos = instr.Pos
+	switch instr.Op {
+	case ir.OpJmp: b.genJump(block, args[0].String(), true)
+	case ir.OpJnz:
+		if c, ok := args[0].(*ir.Const); ok {
+			to := args[2].String()
+			if c.Value != 0 { to = args[1].String() }
+			b.genJump(block, to, true)
+			return
+		}
+		then := b.newLabel()
+		b.load(args[0], "HL")
+		b.ins("LD A,H")
+		b.ins("OR L")
+		b.ins("JP NZ,%s", then)
+		b.genJump(block, args[2].String(), false)
+		b.label(then)
+		b.genJump(block, args[1].String(), true)
+	case ir.OpRet:
+		var v ir.Value
+		if len(args) > 0 { v = args[0] }
+		b.genReturn(v)
+
+	case ir.OpAlloc:
+		b.frameAddr(b.frame[instr])
+		b.store(instr.Result)
+	case ir.OpLoad:
+		b.check(typ)
+		b.load(args[0], "HL")
+		if b.width(typ) == 1 {
+			b.ins("LD L,(HL)")
+			b.extend(typ)
+		} else {
+			b.ins("LD A,(HL+)")
+			b.ins("LD H,(HL)")
+			b.ins("LD L,A")
+		}
+		b.store(instr.Result)
+	case ir.OpStore:
+		b.check(typ)
+		b.load(args[0], "DE")
+		b.load(args[1], "HL")
+		b.ins("LD (HL),E")
+		if b.width(typ) != 1 {
+			b.ins("INC HL")
+			b.ins("LD (HL),D")
+		}
+	case ir.OpBlit:
+		if len(args) > 2 {
+			b.load(args[2], "DE")
+		} else {
+			b.ins("LD DE,%d", ir.SizeOfType(typ, b.prog.WordSize))
+		}
+		b.ins("LD B,D")
+		b.ins("LD C,E")
+		b.load(args[1], "DE")
+		b.load(args[0], "HL")
+		b.genBlit()
+	case ir.OpCall: b.genCall(instr)
+
+	case ir.OpAdd:
+		b.check(typ)
+		if c, ok := args[1].(*ir.Const); ok && (c.Value == 1 || c.Value == -1) {
+			b.load(args[0], "HL")
+			b.ins(map[bool]string{true: "INC HL", false: "DEC HL"}[c.Value == 1])
+		} else {
+			b.load(args[1], "DE")
+			b.load(args[0], "HL")
+			b.ins("ADD HL,DE")
+		}
+		b.extend(typ)
+		b.store(instr.Result)
+	case ir.OpSub, ir.OpAnd, ir.OpOr, ir.OpXor:
+		b.check(typ)
+		b.load(args[1], "DE")
+		b.load(args[0], "HL")
+		lo, hi := gbBitwise[instr.Op], gbBitwise[instr.Op]
+		if instr.Op == ir.OpSub { lo, hi = "SUB", "SBC" }
+		b.ins("LD A,L")
+		b.ins("%s E", lo)
+		b.ins("LD L,A")
+		b.ins("LD A,H")
+		b.ins("%s D", hi)
+		b.ins("LD H,A")
+		b.extend(typ)
+		b.store(instr.Result)
+	case ir.OpShl, ir.OpShr:
+		b.check(typ)
+		if c, ok := args[1].(*ir.Const); ok && c.Value >= 0 && c.Value < 8 {
+			b.load(args[0], "HL")
+			for i := int64(0); i < c.Value; i++ {
+				if instr.Op == ir.OpShl {
+					b.ins("ADD HL,HL")
+				} else {
+					b.ins("SRL H")
+					b.ins("RR L")
+				}
+			}
+		} else {
+			b.load(args[1], "DE")
+			b.load(args[0], "HL")
+			b.use(gbCalls[instr.Op])
+			b.ins("CALL %s", gbCalls[instr.Op])
+		}
+		b.extend(typ)
+		b.store(instr.Result)
+	case ir.OpMul, ir.OpDiv, ir.OpRem:
+		b.check(typ)
+		b.load(args[1], "DE")
+		b.load(args[0], "HL")
+		b.use(gbCalls[instr.Op])
+		b.ins("CALL %s", gbCalls[instr.Op])
+		if instr.Op == ir.OpRem {
+			b.ins("LD H,D")
+			b.ins("LD L,E")
+		}
+		b.extend(typ)
+		b.store(instr.Result)
+
+	case ir.OpCEq, ir.OpCNeq, ir.OpCLt, ir.OpCGt, ir.OpCLe, ir.OpCGe:
+		b.genCompare(instr)
+
+	case ir.OpExtSB, ir.OpExtUB:
+		b.load(args[0], "HL")
+		b.extend(map[ir.Op]ir.Type{ir.OpExtSB: ir.TypeSB, ir.OpExtUB: ir.TypeUB}[instr.Op])
+		b.store(instr.Result)
+	case ir.OpExtSH, ir.OpExtUH, ir.OpExtSW, ir.OpExtUW, ir.OpTrunc, ir.OpCast:
+		b.check(typ)
+		b.load(args[0], "HL")
+		b.extend(typ)
+		b.store(instr.Result)
+
+	case ir.OpAddF, ir.OpSubF, ir.OpMulF, ir.OpDivF, ir.OpRemF, ir.OpNegF, ir.OpFToSI, ir.OpFToUI,
+		ir.OpSWToF, ir.OpUWToF, ir.OpSLToF, ir.OpULToF, ir.OpFToF:
+		util.Error(instr.Pos, "floating-point is not supported by the gb backend")
+	default:
+		util.Error(instr.Pos, "internal: gb backend cannot lower IR operation %d", instr.Op)
+	}
+}
+
+// genBlit copies BC bytes from HL to DE
+func (b *gbBackend) genBlit() {
+	loop, done := b.newLabel(), b.newLabel()
+	b.label(loop)
+	b.ins("LD A,B")
+	b.ins("OR C")
+	b.ins("JP Z,%s", done)
+	b.ins("LD A,(HL+)")
+	b.ins("LD (DE),A")
+	b.ins("INC DE")
+	b.ins("DEC BC")
+	b.ins("JP %s", loop)
+	b.label(done)
+}
+
+// genCompare sets the result to 0 or 1 from the carry flag, without branching: equality tests whether the
+// bytes of x ^ y are all zero, and x < y as signed numbers is x < y unsigned with their sign bits flipped
+func (b *gbBackend) genCompare(instr *ir.Instruction) {
+	args := instr.Args
+	if t := instr.OperandType; t != ir.TypeNone { b.check(t) }
+	x, y := args[0], args[1]
+	switch instr.Op {
+	case ir.OpCEq, ir.OpCNeq:
+		b.load(y, "DE")
+		b.load(x, "HL")
+		b.ins("LD A,L")
+		b.ins("XOR E")
+		b.ins("LD L,A")
+		b.ins("LD A,H")
+		b.ins("XOR D")
+		b.ins("OR L")
+		if instr.Op == ir.OpCEq {
+			b.ins("SUB 1")
+		} else {
+			b.ins("ADD A,$FF")
+		}
+	default:
+		// x > y is y < x, and x <= y and x >= y are the negations of y < x and x < y
+		if instr.Op == ir.OpCGt || instr.Op == ir.OpCLe { x, y = y, x }
+		b.load(y, "DE")
+		b.load(x, "HL")
+		b.ins("LD A,D")
+		b.ins("XOR $80")
+		b.ins("LD D,A")
+		b.ins("LD A,H")
+		b.ins("XOR $80")
+		b.ins("LD H,A")
+		b.ins("LD A,L")
+		b.ins("SUB E")
+		b.ins("LD A,H")
+		b.ins("SBC D")
+		if instr.Op == ir.OpCLe || instr.Op == ir.OpCGe { b.ins("CCF") }
+	}
+	b.ins("SBC A")
+	b.ins("AND 1")
+	b.ins("LD L,A")
+	b.ins("LD H,0")
+	b.store(instr.Result)
+}
+
+// genCall pushes the arguments, the last first, and calls the callee, through __icall when it is not a label or
+// a constant address; the arguments are popped with the result in HL
+func (b *gbBackend) genCall(instr *ir.Instruction) {
+	args := instr.Args[1:]
+	for k := len(args) - 1; k >= 0; k-- {
+		if k < len(instr.ArgTypes) && isFloatIR(instr.ArgTypes[k]) {
+			util.Error(instr.Pos, "floating-point is not supported by the gb backend")
+		}
+		b.load(args[k], "HL")
+		b.ins("PUSH HL")
+		b.depth += 2
+	}
+	switch val := instr.Args[0].(type) {
+	case *ir.Global: b.ins("CALL %s", val.Name)
+	case *ir.Const: b.ins("CALL $%04X", uint16(val.Value))
+	default:
+		b.load(instr.Args[0], "HL")
+		b.use("__icall")
+		b.ins("CALL __icall")
+	}
+	b.addSP(b.depth)
+	b.depth = 0
+	if instr.Result != nil {
+		b.extend(instr.Typ)
+		b.store(instr.Result)
+	}
+}
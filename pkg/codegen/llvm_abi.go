@@ -0,0 +1,223 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/ir"
+)
+
+// Structs passed and returned by value are lowered here by the C calling convention of the target, which LLVM
+// leaves to its front ends. x86-64 follows the System V ABI and AArch64 the AAPCS64; any other target passes
+// them on the stack with byval and returns them through an sret pointer, as i386 does
+
+// llvmPass is how a struct travels to or from a function
+type llvmPass struct {
+	regs     []string // the types of the registers it is split across, when it travels in registers
+	indirect bool     // an argument the caller copies, passed by the address of the copy
+}
+
+func (p llvmPass) inMemory() bool { return len(p.regs) == 0 && !p.indirect }
+
+// llvmArgRegs counts the argument registers of a call left, on x86-64 where a struct that does not fit in them
+// goes on the stack as a whole
+type llvmArgRegs struct {
+	arch       string
+	ints, sses int
+}
+
+func (b *llvmBackend) abiArch() string {
+	triple := b.cfg.BackendTarget
+	if strings.Contains(triple, "windows") || strings.Contains(triple, "win32") { return "" }
+	switch strings.SplitN(triple, "-", 2)[0] {
+	case "x86_64", "amd64": return "x86_64"
+	case "aarch64", "arm64": return "aarch64"
+	}
+	return ""
+}
+
+func (b *llvmBackend) newArgRegs(sret bool) *llvmArgRegs {
+	regs := &llvmArgRegs{arch: b.abiArch(), ints: 6, sses: 8}
+	if sret { regs.ints-- }
+	return regs
+}
+
+// scalar takes the register of an argument that is not a struct
+func (r *llvmArgRegs) scalar(llvmType string) {
+	if llvmType == "float" || llvmType == "double" {
+		r.sses--
+	} else {
+		r.ints--
+	}
+}
+
+// arg is how the struct s is passed as the next argument
+func (r *llvmArgRegs) arg(s *ir.StructLayout) llvmPass {
+	switch r.arch {
+	case "x86_64":
+		regs := sysvEightbytes(s)
+		ints, sses := 0, 0
+		for _, reg := range regs {
+			if strings.HasPrefix(reg, "i") { ints++ } else { sses++ }
+		}
+		if regs == nil || ints > r.ints || sses > r.sses { return llvmPass{} }
+		r.ints, r.sses = r.ints-ints, r.sses-sses
+		return llvmPass{regs: regs}
+	case "aarch64":
+		if elem, n := aapcsHFA(s); n > 0 { return llvmPass{regs: []string{fmt.Sprintf("[%d x %s]", n, elem)}} }
+		switch {
+		case s.Size > 16: return llvmPass{indirect: true}
+		case s.Size > 8: return llvmPass{regs: []string{"[2 x i64]"}}
+		}
+		return llvmPass{regs: []string{"i64"}}
+	}
+	return llvmPass{}
+}
+
+// retPass is how the struct s is returned
+func (b *llvmBackend) retPass(s *ir.StructLayout) llvmPass {
+	switch b.abiArch() {
+	case "x86_64": return llvmPass{regs: sysvEightbytes(s)}
+	case "aarch64":
+		if elem, n := aapcsHFA(s); n > 0 { return llvmPass{regs: []string{"{ " + strings.Repeat(elem+", ", n-1) + elem + " }"}} }
+		switch {
+		case s.Size > 16: return llvmPass{}
+		case s.Size > 8: return llvmPass{regs: []string{"[2 x i64]"}}
+		}
+		return llvmPass{regs: []string{"i64"}}
+	}
+	return llvmPass{}
+}
+
+// sysvEightbytes classifies each eightbyte of s as SSE when it holds only floats and INTEGER otherwise, giving
+// the register type of each, or nil when s is passed in memory
+func sysvEightbytes(s *ir.StructLayout) []string {
+	if s.Size > 16 || s.Size == 0 { return nil }
+	var regs []string
+	for start := int64(0); start < s.Size; start += 8 {
+		end := min(s.Size, start+8)
+		sse, fields, double, high := true, 0, false, false
+		for _, f := range s.Fields {
+			if f.Offset < start || f.Offset >= end { continue }
+			if !isFloatIR(f.Typ) { sse = false }
+			fields++
+			double = double || f.Typ == ir.TypeD
+			high = high || f.Offset >= start+4
+		}
+		// The overlapping fields of a union are classified together, a double taking the whole eightbyte
+		switch {
+		case !sse || fields == 0: regs = append(regs, fmt.Sprintf("i%d", 8*(end-start)))
+		case double: regs = append(regs, "double")
+		case high: regs = append(regs, "<2 x float>")
+		default: regs = append(regs, "float")
+		}
+	}
+	return regs
+}
+
+// aapcsHFA is the float type and count of the fields of s when it is a homogeneous floating-point aggregate
+func aapcsHFA(s *ir.StructLayout) (string, int) {
+	n := len(s.Fields)
+	if n == 0 || n > 4 || !isFloatIR(s.Fields[0].Typ) { return "", 0 }
+	for _, f := range s.Fields {
+		if f.Typ != s.Fields[0].Typ { return "", 0 }
+	}
+	// Members of a union share the elements they overlap
+	size := ir.SizeOfType(s.Fields[0].Typ, 8)
+	n = int(s.Size / size)
+	if s.Fields[0].Typ == ir.TypeS { return "float", n }
+	return "double", n
+}
+
+// llvmRegsType is the type the registers of a struct are loaded from and stored to as one value
+func llvmRegsType(regs []string) string {
+	if len(regs) == 1 { return regs[0] }
+	return "{ " + strings.Join(regs, ", ") + " }"
+}
+
+// llvmBytes is the array type of the memory of s, for byval and sret
+func llvmBytes(s *ir.StructLayout) string { return fmt.Sprintf("[%d x i8]", s.Size) }
+
+// entryAlloca reserves size bytes in the entry block of the current function, so that a call in a loop does not
+// grow the stack, and returns their address as an i8*
+func (b *llvmBackend) entryAlloca(name string, size, align int64) string {
+	if name == "" { name = b.newBackendTemp() }
+	fmt.Fprintf(b.entry, "\t%s = alloca i8, i64 %d, align %d\n", name, size, max(align, 8))
+	b.tempTypes[name] = "i8*"
+	return name
+}
+
+// regsSize is the size of the memory the registers of a struct are stored to, at least that of s
+func regsSize(s *ir.StructLayout) int64 { return (s.Size + 15) &^ 15 }
+
+func (b *llvmBackend) memcpy(dst, src string, size int64) {
+	fmt.Fprintf(b.out, "\tcall void @llvm.memcpy.p0i8.p0i8.i64(i8* %s, i8* %s, i64 %d, i1 false)\n", dst, src, size)
+}
+
+// loadRegs loads the registers a struct at addr travels in
+func (b *llvmBackend) loadRegs(addr string, s *ir.StructLayout, regs []string) []string {
+	buf := b.entryAlloca("", regsSize(s), s.Align)
+	b.memcpy(buf, addr, s.Size)
+	typ := llvmRegsType(regs)
+	ptr := b.newBackendTemp()
+	fmt.Fprintf(b.out, "\t%s = bitcast i8* %s to %s*\n", ptr, buf, typ)
+	if len(regs) == 1 {
+		val := b.newBackendTemp()
+		fmt.Fprintf(b.out, "\t%s = load %s, %s* %s\n", val, typ, typ, ptr)
+		return []string{val}
+	}
+	var vals []string
+	for i, reg := range regs {
+		field, val := b.newBackendTemp(), b.newBackendTemp()
+		fmt.Fprintf(b.out, "\t%s = getelementptr %s, %s* %s, i32 0, i32 %d\n", field, typ, typ, ptr, i)
+		fmt.Fprintf(b.out, "\t%s = load %s, %s* %s\n", val, reg, reg, field)
+		vals = append(vals, val)
+	}
+	return vals
+}
+
+// storeRegs stores the registers of a struct to the memory at addr, which has room for them
+func (b *llvmBackend) storeRegs(addr string, regs, vals []string) {
+	typ := llvmRegsType(regs)
+	ptr := b.newBackendTemp()
+	fmt.Fprintf(b.out, "\t%s = bitcast i8* %s to %s*\n", ptr, addr, typ)
+	if len(regs) == 1 {
+		fmt.Fprintf(b.out, "\tstore %s %s, %s* %s\n", typ, vals[0], typ, ptr)
+		return
+	}
+	for i, reg := range regs {
+		field := b.newBackendTemp()
+		fmt.Fprintf(b.out, "\t%s = getelementptr %s, %s* %s, i32 0, i32 %d\n", field, typ, typ, ptr, i)
+		fmt.Fprintf(b.out, "\tstore %s %s, %s* %s\n", reg, vals[i], reg, field)
+	}
+}
+
+// byvalParam is the parameter attributes of a struct in memory: byval for an argument, sret for the result
+func byvalParam(s *ir.StructLayout, attr string) string {
+	return fmt.Sprintf("%s* %s(%s) align %d", llvmBytes(s), attr, llvmBytes(s), max(s.Align, 8))
+}
+
+// genStructRet returns the struct at the address of a return, through the sret pointer or in registers. A
+// function that falls off its end returns a zeroed struct
+func (b *llvmBackend) genStructRet(instr *ir.Instruction) {
+	s := b.currentFn.RetStruct
+	pass := b.retPass(s)
+	var addr string
+	if c, ok := instr.Args[0].(*ir.Const); !ok || c.Value != 0 { addr = b.prepareArg(instr.Args[0], "i8*") }
+	if pass.inMemory() {
+		if addr != "" {
+			sret := b.newBackendTemp()
+			fmt.Fprintf(b.out, "\t%s = bitcast %s* %%.sret to i8*\n", sret, llvmBytes(s))
+			b.memcpy(sret, addr, s.Size)
+		}
+		b.out.WriteString("\tret void\n")
+		return
+	}
+	typ := llvmRegsType(pass.regs)
+	if addr == "" {
+		fmt.Fprintf(b.out, "\tret %s zeroinitializer\n", typ)
+		return
+	}
+	val := b.loadRegs(addr, s, []string{typ})[0]
+	fmt.Fprintf(b.out, "\tret %s %s\n", typ, val)
+}
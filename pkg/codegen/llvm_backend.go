@@ -6,6 +6,7 @@ import (
 	"math"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -22,22 +23,35 @@ type llvmBackend struct {
 	tempTypes   map[string]string  // maps temp name to LLVM type
 	tempIRTypes map[string]ir.Type // maps temp name to IR type
 	funcSigs    map[string]string
+	structRets  map[string]*ir.StructLayout // structs the functions the program does not define return by value
 	currentFn   *ir.Func
+	dbg         *llvmDebugInfo
+	entry       *strings.Builder // allocas and the copies of struct parameters at the start of the current function
 }
 
 func NewLLVMBackend() Backend { return &llvmBackend{} }
 
+func init() {
+	Register(BackendInfo{
+		Name: "llvm", Description: "LLVM IR, compiled by llc", New: NewLLVMBackend,
+		Triples:      true,
+		WordSizes:    []int{4, 8},
+		Capabilities: Capabilities{Floats: true, Asm: "gas", AsmStmt: true, Varargs: true, Libc: true},
+	})
+}
+
+// Generate compiles the program to an object file for the target
 func (b *llvmBackend) Generate(prog *ir.Program, cfg *config.Config) (*bytes.Buffer, error) {
 	llvmIR, err := b.GenerateIR(prog, cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	asm, err := b.compileLLVMIR(llvmIR)
+	obj, err := CompileLLVM(llvmIR, cfg, "obj")
 	if err != nil {
 		return nil, err
 	}
-	return bytes.NewBufferString(asm), nil
+	return bytes.NewBuffer(obj), nil
 }
 
 func (b *llvmBackend) GenerateIR(prog *ir.Program, cfg *config.Config) (string, error) {
@@ -49,45 +63,133 @@ func (b *llvmBackend) GenerateIR(prog *ir.Program, cfg *config.Config) (string,
 	b.tempTypes = make(map[string]string)
 	b.tempIRTypes = make(map[string]ir.Type)
 	b.funcSigs = make(map[string]string)
+	b.structRets = make(map[string]*ir.StructLayout)
+	b.dbg = nil
+	if cfg.DebugInfo {
+		b.dbg = newLLVMDebugInfo(cfg.WordSize)
+	}
 
 	b.gen()
 
 	return llvmIRBuilder.String(), nil
 }
 
-func (b *llvmBackend) compileLLVMIR(llvmIR string) (string, error) {
+// llvmDataLayout is the data layout LLVM uses for triple, or "" for the targets it is not known for here, which
+// llc then fills in
+func llvmDataLayout(triple string) string {
+	arch := strings.SplitN(triple, "-", 2)[0]
+	mangling := "e"
+	switch {
+	case strings.Contains(triple, "darwin") || strings.Contains(triple, "macos") || strings.Contains(triple, "ios"): mangling = "o"
+	case strings.Contains(triple, "windows") && arch == "x86_64": mangling = "w"
+	case strings.Contains(triple, "windows"): mangling = "x"
+	}
+	switch arch {
+	case "x86_64", "amd64":
+		return "e-m:" + mangling + "-p270:32:32-p271:32:32-p272:64:64-i64:64-f80:128-n8:16:32:64-S128"
+	case "i386", "i486", "i586", "i686":
+		return "e-m:" + mangling + "-p:32:32-p270:32:32-p271:32:32-p272:64:64-f64:32:64-f80:32-n8:16:32-S128"
+	case "aarch64", "arm64":
+		if mangling == "o" { return "e-m:o-i64:64-i128:128-n32:64-S128" }
+		return "e-m:" + mangling + "-i8:8:32-i16:16:32-i64:64-i128:128-n32:64-S128"
+	case "riscv64":
+		return "e-m:e-p:64:64-i64:64-i128:128-n64-S128"
+	case "wasm32":
+		return "e-m:e-p:32:32-i64:64-n32:64-S128"
+	}
+	return ""
+}
+
+// LLVMModuleAsm turns the `__asm__` functions of a program into module-level assembly, so that they are compiled
+// into the same object as the rest
+func LLVMModuleAsm(asm string) string {
+	if strings.TrimSpace(asm) == "" { return "" }
+	var sb strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(asm, "\n"), "\n") {
+		line = strings.NewReplacer(`\`, `\5C`, `"`, `\22`).Replace(line)
+		fmt.Fprintf(&sb, "module asm \"%s\"\n", line)
+	}
+	return sb.String()
+}
+
+// llvmOptLevel is the optimization level of cfg, -O2 unless asked otherwise or, for debug information, -O0
+func llvmOptLevel(cfg *config.Config) string {
+	switch {
+	case cfg.OptLevel != "": return "-O" + cfg.OptLevel
+	case cfg.DebugInfo: return "-O0"
+	}
+	return "-O2"
+}
+
+// CompileLLVM compiles a module of LLVM IR to an object, for filetype "obj", or to assembly, for "asm", with llc,
+// or with clang when there is no llc
+func CompileLLVM(llvmIR string, cfg *config.Config, filetype string) ([]byte, error) {
+	var tool string
+	var args []string
+	if llc, err := exec.LookPath("llc"); err == nil {
+		tool, args = llc, []string{llvmOptLevel(cfg), "-filetype=" + filetype}
+		if cfg.CPU != "" { args = append(args, "-mcpu="+cfg.CPU) }
+	} else if clang, err := exec.LookPath("clang"); err == nil {
+		// clang takes the CPU as -march on x86, and as -mcpu elsewhere
+		tool, args = clang, []string{llvmOptLevel(cfg), "-Wno-override-module", "-target", cfg.BackendTarget}
+		if filetype == "obj" { args = append(args, "-c") } else { args = append(args, "-S") }
+		if arch := strings.SplitN(cfg.BackendTarget, "-", 2)[0]; cfg.CPU != "" && (arch == "x86_64" || strings.HasPrefix(arch, "i")) {
+			args = append(args, "-march="+cfg.CPU)
+		} else if cfg.CPU != "" {
+			args = append(args, "-mcpu="+cfg.CPU)
+		}
+		args = append(args, "-x", "ir")
+	} else {
+		return nil, fmt.Errorf("the llvm backend needs llc or clang to compile LLVM IR, and neither is in PATH")
+	}
+
 	llFile, err := os.CreateTemp("", "gbc-main-*.ll")
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file for LLVM IR: %w", err)
+		return nil, fmt.Errorf("failed to create temp file for LLVM IR: %w", err)
 	}
 	defer os.Remove(llFile.Name())
 	if _, err := llFile.WriteString(llvmIR); err != nil {
-		return "", fmt.Errorf("failed to write to temp file for LLVM IR: %w", err)
+		return nil, fmt.Errorf("failed to write to temp file for LLVM IR: %w", err)
 	}
 	llFile.Close()
 
-	asmFile, err := os.CreateTemp("", "gbc-main-*.s")
+	outFile, err := os.CreateTemp("", "gbc-main-*.o")
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file for assembly: %w", err)
+		return nil, fmt.Errorf("failed to create temp file for %s output: %w", filepath.Base(tool), err)
 	}
-	asmFile.Close()
-	defer os.Remove(asmFile.Name())
+	outFile.Close()
+	defer os.Remove(outFile.Name())
 
-	cmd := exec.Command("llc", "-O2", "-o", asmFile.Name(), llFile.Name())
+	cmd := exec.Command(tool, append(args, "-o", outFile.Name(), llFile.Name())...)
 	if output, err := cmd.CombinedOutput(); err != nil {
-		return "", fmt.Errorf("llc command failed: %w\n--- LLVM IR ---\n%s\n--- Output ---\n%s", err, llvmIR, string(output))
+		return nil, fmt.Errorf("%s command failed: %w\n--- LLVM IR ---\n%s\n--- Output ---\n%s", filepath.Base(tool), err, llvmIR, string(output))
 	}
+	return os.ReadFile(outFile.Name())
+}
 
-	asmBytes, err := os.ReadFile(asmFile.Name())
+// LLVMBitcode assembles a module of LLVM IR into bitcode with llvm-as
+func LLVMBitcode(llvmIR string) ([]byte, error) {
+	if _, err := exec.LookPath("llvm-as"); err != nil {
+		return nil, fmt.Errorf("--emit=llvm-bc needs llvm-as, which is not in PATH")
+	}
+	cmd := exec.Command("llvm-as", "-o", "-", "-")
+	cmd.Stdin = strings.NewReader(llvmIR)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	bc, err := cmd.Output()
 	if err != nil {
-		return "", fmt.Errorf("failed to read temporary assembly file: %w", err)
+		return nil, fmt.Errorf("llvm-as command failed: %w\n--- Output ---\n%s", err, stderr.String())
 	}
-	return string(asmBytes), nil
+	return bc, nil
 }
 
 func (b *llvmBackend) gen() {
 	fmt.Fprintf(b.out, "; Generated by gbc\n")
-	fmt.Fprintf(b.out, "target triple = \"%s\"\n\n", b.cfg.BackendTarget)
+	triple := b.cfg.BackendTarget
+	if layout := llvmDataLayout(triple); layout != "" {
+		fmt.Fprintf(b.out, "target datalayout = \"%s\"\n", layout)
+	}
+	fmt.Fprintf(b.out, "target triple = \"%s\"\n\n", triple)
 
 	b.genDeclarations()
 	b.genStrings()
@@ -96,14 +198,33 @@ func (b *llvmBackend) gen() {
 	for _, fn := range b.prog.Funcs {
 		b.genFunc(fn)
 	}
+
+	if b.dbg != nil {
+		b.dbg.emit(b.out)
+	}
 }
 
-func (b *llvmBackend) getFuncSig(name string) (retType string) { return b.wordType }
+func (b *llvmBackend) getFuncSig(name string) (retType string) {
+	if fn := b.prog.FindFunc(name); fn != nil { return b.formatType(fn.ReturnType) }
+	return b.wordType
+}
+
+// externFuncType is the type of a function the program does not define, which takes varargs after the sret
+// pointer of a struct it returns in memory
+func (b *llvmBackend) externFuncType(name string) string {
+	s := b.structRets[name]
+	if s == nil { return b.getFuncSig(name) + " (...)" }
+	if pass := b.retPass(s); !pass.inMemory() { return llvmRegsType(pass.regs) + " (...)" }
+	return fmt.Sprintf("void (%s*, ...)", llvmBytes(s))
+}
 
 func (b *llvmBackend) genDeclarations() {
 	knownExternals := make(map[string]bool)
 
 	b.out.WriteString("declare void @llvm.memcpy.p0i8.p0i8.i64(i8*, i8*, i64, i1)\n")
+	if b.dbg != nil {
+		b.out.WriteString("declare void @llvm.dbg.declare(metadata, metadata, metadata)\n")
+	}
 
 	if len(b.prog.ExtrnVars) > 0 {
 		b.out.WriteString("; --- External Variables ---\n")
@@ -132,6 +253,7 @@ func (b *llvmBackend) genDeclarations() {
 				if instr.Op == ir.OpCall {
 					if g, ok := instr.Args[0].(*ir.Global); ok {
 						potentialFuncs[g.Name] = true
+						if instr.RetStruct != nil { b.structRets[g.Name] = instr.RetStruct }
 					}
 				}
 			}
@@ -154,11 +276,11 @@ func (b *llvmBackend) genDeclarations() {
 		b.out.WriteString("; --- External Functions ---\n")
 		sort.Strings(funcsToDeclare)
 		for _, name := range funcsToDeclare {
-			retType := b.getFuncSig(name)
-
 			// All external functions are declared as varargs
 			// The linker will handle the correct resolution
-			sig := fmt.Sprintf("declare %s @%s(...)\n", retType, name)
+			funcType := b.externFuncType(name)
+			paren := strings.Index(funcType, " (")
+			sig := fmt.Sprintf("declare %s @%s%s\n", funcType[:paren], name, funcType[paren+1:])
 
 			b.out.WriteString(sig)
 			b.funcSigs[name] = sig
@@ -264,6 +386,10 @@ func (b *llvmBackend) genGlobals() {
 func (b *llvmBackend) formatGlobalInitializerValue(v ir.Value, targetType string) string {
 	switch val := v.(type) {
 	case *ir.Const:
+		if strings.HasSuffix(targetType, "*") {
+			if val.Value == 0 { return "null" }
+			return fmt.Sprintf("inttoptr (%s %d to %s)", b.wordType, val.Value, targetType)
+		}
 		return fmt.Sprintf("%d", val.Value)
 	case *ir.FloatConst:
 		if targetType == "float" {
@@ -283,6 +409,10 @@ func (b *llvmBackend) formatGlobalInitializerValue(v ir.Value, targetType string
 			return gep
 		}
 		sourceType := b.getType(val)
+		if b.prog.FindFunc(val.Name) != nil || b.funcSigs[val.Name] != "" {
+			sourceType = b.funcPtrType(val.Name)
+			if !strings.HasSuffix(targetType, "*") { return fmt.Sprintf("ptrtoint (%s @%s to %s)", sourceType, val.Name, targetType) }
+		}
 		if !strings.HasSuffix(sourceType, "*") {
 			sourceType += "*"
 		}
@@ -302,16 +432,26 @@ func (b *llvmBackend) genFunc(fn *ir.Func) {
 	}
 	b.tempTypes = globalTypes
 
-	retTypeStr := b.formatType(fn.ReturnType)
+	b.entry = &strings.Builder{}
+	retTypeStr := b.funcRetType(fn)
 	var params []string
+	if fn.RetStruct != nil && b.retPass(fn.RetStruct).inMemory() {
+		params = append(params, byvalParam(fn.RetStruct, "noalias sret")+" %.sret")
+	}
+	regs := b.newArgRegs(len(params) > 0)
 	for _, p := range fn.Params {
 		pName := b.formatValue(p.Val)
+		if p.Struct != nil {
+			params = append(params, b.structParam(pName, p.Struct, regs.arg(p.Struct)))
+			continue
+		}
 		pType := b.formatType(p.Typ)
 		if fn.Name == "main" && p.Name == "argv" {
 			pType = "i8**"
 		}
 		params = append(params, fmt.Sprintf("%s %s", pType, pName))
 		b.tempTypes[pName] = pType
+		regs.scalar(pType)
 	}
 	paramStr := strings.Join(params, ", ")
 	if fn.HasVarargs {
@@ -321,18 +461,60 @@ func (b *llvmBackend) genFunc(fn *ir.Func) {
 		paramStr += "..."
 	}
 
-	fmt.Fprintf(b.out, "define %s @%s(%s) {\n", retTypeStr, fn.Name, paramStr)
+	dbgAttachment := ""
+	if b.dbg != nil {
+		if sp := b.dbg.beginFunc(fn); sp >= 0 {
+			dbgAttachment = " !dbg " + b.dbg.ref(sp)
+		}
+	}
+
+	out := b.out
+	var body strings.Builder
+	b.out = &body
 	for i, block := range fn.Blocks {
-		labelName := block.Label.Name
-		if i == 0 {
-			labelName = "entry"
+		if i > 0 {
+			fmt.Fprintf(b.out, "%s:\n", block.Label.Name)
 		}
-		fmt.Fprintf(b.out, "%s:\n", labelName)
 		b.genBlock(block)
 	}
+	b.out = out
+
+	fmt.Fprintf(b.out, "define %s @%s(%s)%s {\nentry:\n", retTypeStr, fn.Name, paramStr, dbgAttachment)
+	b.out.WriteString(b.entry.String())
+	b.out.WriteString(body.String())
 	b.out.WriteString("}\n")
 }
 
+// funcRetType is the LLVM return type of a function of the program
+func (b *llvmBackend) funcRetType(fn *ir.Func) string {
+	if fn.RetStruct == nil { return b.formatType(fn.ReturnType) }
+	if pass := b.retPass(fn.RetStruct); !pass.inMemory() { return llvmRegsType(pass.regs) }
+	return "void"
+}
+
+// structParam declares a struct parameter passed by value and makes name the address of the struct in the entry
+// of the function
+func (b *llvmBackend) structParam(name string, s *ir.StructLayout, pass llvmPass) string {
+	b.tempTypes[name] = "i8*"
+	switch {
+	case pass.indirect: return "i8* " + name
+	case pass.inMemory():
+		fmt.Fprintf(b.entry, "\t%s = bitcast %s* %s.byval to i8*\n", name, llvmBytes(s), name)
+		return byvalParam(s, "byval") + " " + name + ".byval"
+	}
+	var params, vals []string
+	for i, reg := range pass.regs {
+		vals = append(vals, fmt.Sprintf("%s.r%d", name, i))
+		params = append(params, reg+" "+vals[i])
+	}
+	b.entryAlloca(name, regsSize(s), s.Align)
+	out := b.out
+	b.out = b.entry
+	b.storeRegs(name, pass.regs, vals)
+	b.out = out
+	return strings.Join(params, ", ")
+}
+
 func (b *llvmBackend) genBlock(block *ir.BasicBlock) {
 	var deferredCasts []string
 	phiEndIndex := 0
@@ -361,7 +543,39 @@ func (b *llvmBackend) genBlock(block *ir.BasicBlock) {
 	}
 
 	for _, instr := range block.Instructions[phiEndIndex:] {
+		b.genInstrWithLoc(instr)
+	}
+}
+
+// genInstrWithLoc generates instr and, under -g, tags every emitted line with its source location
+func (b *llvmBackend) genInstrWithLoc(instr *ir.Instruction) {
+	if b.dbg == nil || b.dbg.subprog < 0 {
 		b.genInstr(instr)
+		return
+	}
+
+	line, col := instr.Pos.Line, instr.Pos.Column
+	if line <= 0 {
+		line, col = b.currentFn.Node.Tok.Line, b.currentFn.Node.Tok.Column
+	}
+
+	out := b.out
+	var instrText strings.Builder
+	b.out = &instrText
+	b.genInstr(instr)
+	b.out = out
+	b.out.WriteString(b.dbg.attachLocation(instrText.String(), b.dbg.location(line, col)))
+}
+
+// genDebugDeclares describes each local of the current function as an offset into its frame
+func (b *llvmBackend) genDebugDeclares(frame string) {
+	for _, local := range b.currentFn.Locals {
+		expr := "!DIExpression()"
+		if local.Offset != 0 {
+			expr = fmt.Sprintf("!DIExpression(DW_OP_plus_uconst, %d)", local.Offset)
+		}
+		variable := b.dbg.localVar(local)
+		fmt.Fprintf(b.out, "\tcall void @llvm.dbg.declare(metadata i8* %s, metadata %s, metadata %s)\n", frame, b.dbg.ref(variable), expr)
 	}
 }
 
@@ -386,6 +600,9 @@ func (b *llvmBackend) genInstr(instr *ir.Instruction) {
 		sizeVal := b.prepareArg(instr.Args[0], b.wordType)
 		fmt.Fprintf(b.out, "%s = alloca i8, %s %s, align %d\n", resultName, b.wordType, sizeVal, align)
 		b.tempTypes[resultName] = "i8*"
+		if b.dbg != nil && b.dbg.subprog >= 0 && instr.Result == b.currentFn.Frame {
+			b.genDebugDeclares(resultName)
+		}
 
 	case ir.OpLoad:
 		valType := b.formatType(instr.Typ)
@@ -460,6 +677,9 @@ func (b *llvmBackend) genInstr(instr *ir.Instruction) {
 	case ir.OpCall:
 		b.genCall(instr)
 
+	case ir.OpAsm:
+		b.genAsm(instr)
+
 	case ir.OpJmp:
 		fmt.Fprintf(b.out, "br label %%%s\n", instr.Args[0].String())
 
@@ -468,7 +688,9 @@ func (b *llvmBackend) genInstr(instr *ir.Instruction) {
 		fmt.Fprintf(b.out, "br i1 %s, label %%%s, label %%%s\n", condVal, instr.Args[1].String(), instr.Args[2].String())
 
 	case ir.OpRet:
-		if len(instr.Args) > 0 && instr.Args[0] != nil {
+		if b.currentFn.RetStruct != nil {
+			b.genStructRet(instr)
+		} else if len(instr.Args) > 0 && instr.Args[0] != nil {
 			retType := b.formatType(b.currentFn.ReturnType)
 			var retVal string
 			if c, ok := instr.Args[0].(*ir.Const); ok && c.Value == 0 && strings.HasSuffix(retType, "*") {
@@ -552,6 +774,17 @@ func (b *llvmBackend) genInstr(instr *ir.Instruction) {
 	case ir.OpSub, ir.OpSubF, ir.OpMul, ir.OpMulF, ir.OpDiv, ir.OpDivF, ir.OpRem, ir.OpRemF, ir.OpAnd, ir.OpOr, ir.OpXor, ir.OpShl, ir.OpShr:
 		opStr, _ := b.formatOp(instr.Op)
 		valType := b.formatType(instr.Typ)
+		if strings.HasSuffix(valType, "*") {
+			// Arithmetic on pointers is done on words, like genAdd does
+			lhs := b.prepareArg(instr.Args[0], b.wordType)
+			rhs := b.prepareArg(instr.Args[1], b.wordType)
+			resultInt := b.newBackendTemp()
+			fmt.Fprintf(b.out, "%s = %s %s %s, %s\n", resultInt, opStr, b.wordType, lhs, rhs)
+			b.tempTypes[resultInt] = b.wordType
+			fmt.Fprintf(b.out, "\t%s = inttoptr %s %s to %s\n", resultName, b.wordType, resultInt, valType)
+			b.tempTypes[resultName] = valType
+			break
+		}
 		lhs := b.prepareArg(instr.Args[0], valType)
 		rhs := b.prepareArg(instr.Args[1], valType)
 		fmt.Fprintf(b.out, "%s = %s %s %s, %s\n", resultName, opStr, valType, lhs, rhs)
@@ -635,6 +868,17 @@ func (b *llvmBackend) genInstr(instr *ir.Instruction) {
 	default:
 		opStr, _ := b.formatOp(instr.Op)
 		valType := b.formatType(instr.Typ)
+		if strings.HasSuffix(valType, "*") {
+			// Arithmetic on pointers is done on words, like genAdd does
+			lhs := b.prepareArg(instr.Args[0], b.wordType)
+			rhs := b.prepareArg(instr.Args[1], b.wordType)
+			resultInt := b.newBackendTemp()
+			fmt.Fprintf(b.out, "%s = %s %s %s, %s\n", resultInt, opStr, b.wordType, lhs, rhs)
+			b.tempTypes[resultInt] = b.wordType
+			fmt.Fprintf(b.out, "\t%s = inttoptr %s %s to %s\n", resultName, b.wordType, resultInt, valType)
+			b.tempTypes[resultName] = valType
+			break
+		}
 		lhs := b.prepareArg(instr.Args[0], valType)
 		rhs := b.prepareArg(instr.Args[1], valType)
 		fmt.Fprintf(b.out, "%s = %s %s %s, %s\n", resultName, opStr, valType, lhs, rhs)
@@ -811,9 +1055,39 @@ func (b *llvmBackend) genCall(instr *ir.Instruction) {
 		}
 	}
 
-	var argParts []string
+	var calleeFn *ir.Func
+	if g, ok := callee.(*ir.Global); ok { calleeFn = b.prog.FindFunc(g.Name) }
+	// A call through a pointer with a known signature passes the parameters of the signature as they are
+	// declared and promotes its varargs, as a call to an external function does
+	sig := instr.Sig
+	if sig != nil { retType = b.formatType(sig.Result) }
+	isFixed := func(i int) bool { return sig != nil && i < len(sig.Params) }
+
+	// A struct returned in memory is written to the result, whose address goes first
+	var argParts, fixedTypes []string
+	sret := instr.RetStruct != nil && b.retPass(instr.RetStruct).inMemory()
+	if instr.RetStruct != nil {
+		retType = "void"
+		if !sret { retType = llvmRegsType(b.retPass(instr.RetStruct).regs) }
+		b.entryAlloca(resultName, regsSize(instr.RetStruct), instr.RetStruct.Align)
+	}
+	if sret {
+		ptr := b.newBackendTemp()
+		fmt.Fprintf(b.out, "%s = bitcast i8* %s to %s*\n", ptr, resultName, llvmBytes(instr.RetStruct))
+		argParts = append(argParts, byvalParam(instr.RetStruct, "sret")+" "+ptr)
+		fixedTypes = append(fixedTypes, llvmBytes(instr.RetStruct)+"*")
+	}
+
+	regs := b.newArgRegs(sret)
 	for i, arg := range instr.Args[1:] {
+		if i < len(instr.ArgStructs) && instr.ArgStructs[i] != nil {
+			pass := regs.arg(instr.ArgStructs[i])
+			argParts = append(argParts, b.structArg(arg, instr.ArgStructs[i], pass))
+			if isFixed(i) { fixedTypes = append(fixedTypes, structArgTypes(instr.ArgStructs[i], pass)...) }
+			continue
+		}
 		targetType := b.wordType
+		promote := isExternalFunc || (sig != nil && !isFixed(i))
 
 		// Determine the source type of the argument
 		sourceType := b.getType(arg)
@@ -827,7 +1101,7 @@ func (b *llvmBackend) genCall(instr *ir.Instruction) {
 			// - float -> double
 			// - small integers (i8, i16) -> word type (int promotion)
 			// - preserve pointers and larger types
-			if isExternalFunc {
+			if promote {
 				if requestedType == "float" {
 					targetType = "double"
 				} else if requestedType == "i8" || requestedType == "i16" {
@@ -840,7 +1114,7 @@ func (b *llvmBackend) genCall(instr *ir.Instruction) {
 			}
 		} else {
 			// No explicit ArgTypes, infer from the argument and apply C standard promotions for external functions
-			if isExternalFunc {
+			if promote {
 				if sourceType == "float" {
 					targetType = "double"
 				} else if sourceType == "i8" || sourceType == "i16" {
@@ -859,42 +1133,159 @@ func (b *llvmBackend) genCall(instr *ir.Instruction) {
 			}
 		}
 
+		// The parameters of a function defined here have the types it was defined with
+		if calleeFn != nil && i < len(calleeFn.Params) {
+			targetType = b.formatType(calleeFn.Params[i].Typ)
+			if calleeFn.Name == "main" && calleeFn.Params[i].Name == "argv" { targetType = "i8**" }
+		}
+		if isFixed(i) {
+			targetType = b.formatType(sig.Params[i])
+			fixedTypes = append(fixedTypes, targetType)
+		}
+
 		valStr := b.prepareArg(arg, targetType)
 		argParts = append(argParts, fmt.Sprintf("%s %s", targetType, valStr))
+		regs.scalar(targetType)
 	}
 
+	// Calls through the varargs declarations and function pointers spell out the function type, which
+	// LLVM before opaque pointers needs to tell the arguments from the parameters. A pointer without a
+	// signature is called as if its function took varargs
+	callType := retType
+	fnType := fmt.Sprintf("%s (%s)", retType, strings.Join(append(fixedTypes, "..."), ", "))
+	if sig != nil && !sig.Variadic { fnType = fmt.Sprintf("%s (%s)", retType, strings.Join(fixedTypes, ", ")) }
 	if _, isGlobal := callee.(*ir.Global); !isGlobal {
-		funcPtrType := fmt.Sprintf("%s (...)*", retType)
-		calleeStr = b.prepareArg(callee, funcPtrType)
+		calleeStr = b.prepareArg(callee, fnType+"*")
+		callType = fnType
+	} else if isExternalFunc {
+		callType = fnType
 	}
 
-	callStr := fmt.Sprintf("call %s %s(%s)", retType, calleeStr, strings.Join(argParts, ", "))
+	callStr := fmt.Sprintf("call %s %s(%s)", callType, calleeStr, strings.Join(argParts, ", "))
 
-	if resultName != "" && retType != "void" {
+	switch {
+	case instr.RetStruct != nil && !sret:
+		val := b.newBackendTemp()
+		fmt.Fprintf(b.out, "%s = %s\n", val, callStr)
+		b.storeRegs(resultName, []string{retType}, []string{val})
+	case resultName != "" && retType != "void":
 		fmt.Fprintf(b.out, "%s = %s\n", resultName, callStr)
 		b.tempTypes[resultName] = retType
-	} else {
+	default:
 		fmt.Fprintf(b.out, "%s\n", callStr)
 	}
 }
 
+// structArgTypes are the types of the parameters a struct argument takes up
+func structArgTypes(s *ir.StructLayout, pass llvmPass) []string {
+	switch {
+	case pass.indirect: return []string{"i8*"}
+	case pass.inMemory(): return []string{llvmBytes(s) + "*"}
+	}
+	return pass.regs
+}
+
+// structArg passes the struct at the address arg as it travels to a function
+func (b *llvmBackend) structArg(arg ir.Value, s *ir.StructLayout, pass llvmPass) string {
+	addr := b.prepareArg(arg, "i8*")
+	switch {
+	case pass.indirect:
+		copied := b.entryAlloca("", s.Size, s.Align)
+		b.memcpy(copied, addr, s.Size)
+		return "i8* " + copied
+	case pass.inMemory():
+		ptr := b.newBackendTemp()
+		fmt.Fprintf(b.out, "\t%s = bitcast i8* %s to %s*\n", ptr, addr, llvmBytes(s))
+		return byvalParam(s, "byval") + " " + ptr
+	}
+	var parts []string
+	for i, val := range b.loadRegs(addr, s, pass.regs) {
+		parts = append(parts, pass.regs[i]+" "+val)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// genAsm lowers an `__asm__` statement to a call of inline assembly. Its outputs come first, as the fields of
+// the result, then its inputs, with the input of an inout operand tied to its output. No output shares a
+// register with an input, as with the other backends
+func (b *llvmBackend) genAsm(instr *ir.Instruction) {
+	asm := instr.Asm
+	index := make([]int, len(asm.Operands))
+	var outs []ir.Value
+	var constraints, args []string
+	for i, op := range asm.Operands {
+		if op.Out == nil { continue }
+		index[i] = len(outs)
+		outs = append(outs, op.Out)
+		constraints = append(constraints, "=&r")
+	}
+	for i, op := range asm.Operands {
+		if op.In == nil { continue }
+		if op.Out != nil {
+			constraints = append(constraints, strconv.Itoa(index[i]))
+		} else {
+			index[i] = len(constraints)
+			constraints = append(constraints, "r")
+		}
+		args = append(args, fmt.Sprintf("%s %s", b.wordType, b.prepareArg(op.In, b.wordType)))
+	}
+	arch := strings.SplitN(b.cfg.BackendTarget, "-", 2)[0]
+	isX86 := arch == "x86_64" || arch == "i386" || arch == "i686"
+	for _, clobber := range asm.Clobbers {
+		clobber = strings.TrimPrefix(clobber, "%")
+		if isX86 && clobber == "cc" { continue }
+		constraints = append(constraints, "~{"+clobber+"}")
+	}
+	if isX86 { constraints = append(constraints, "~{dirflag}", "~{fpsr}", "~{flags}") }
+
+	template := asm.Expand(func(n int) string { return "$" + strconv.Itoa(index[n]) },
+		func(s string) string { return strings.ReplaceAll(s, "$", "$$") })
+	template = strings.NewReplacer(`\`, `\5C`, `"`, `\22`, "\n", `\0A`, "\t", `\09`).Replace(template)
+
+	retType := "void"
+	switch {
+	case len(outs) == 1: retType = b.wordType
+	case len(outs) > 1: retType = "{" + strings.TrimSuffix(strings.Repeat(b.wordType+", ", len(outs)), ", ") + "}"
+	}
+	call := fmt.Sprintf("call %s asm sideeffect \"%s\", \"%s\"(%s)", retType, template, strings.Join(constraints, ","), strings.Join(args, ", "))
+	switch len(outs) {
+	case 0: fmt.Fprintf(b.out, "%s\n", call)
+	case 1: fmt.Fprintf(b.out, "%s = %s\n", b.formatValue(outs[0]), call)
+	default:
+		result := b.newBackendTemp()
+		fmt.Fprintf(b.out, "%s = %s\n", result, call)
+		for i, out := range outs {
+			fmt.Fprintf(b.out, "\t%s = extractvalue %s %s, %d\n", b.formatValue(out), retType, result, i)
+		}
+	}
+	for _, out := range outs {
+		b.tempTypes[b.formatValue(out)] = b.wordType
+	}
+}
+
 func (b *llvmBackend) prepareArg(v ir.Value, targetType string) string {
 	valStr := b.formatValue(v)
 	if g, ok := v.(*ir.Global); ok {
 		isFunc := b.prog.FindFunc(g.Name) != nil || b.funcSigs[g.Name] != ""
 		if isFunc {
 			if strings.HasPrefix(targetType, "i") && !strings.HasSuffix(targetType, "*") {
-				funcSig := b.getFuncSig(g.Name) + " (...)*"
 				castTemp := b.newBackendTemp()
-				fmt.Fprintf(b.out, "\t%s = ptrtoint %s @%s to %s\n", castTemp, funcSig, g.Name, targetType)
+				fmt.Fprintf(b.out, "\t%s = ptrtoint %s @%s to %s\n", castTemp, b.funcPtrType(g.Name), g.Name, targetType)
 				b.tempTypes[castTemp] = targetType
 				return castTemp
 			}
+			if ptrType := b.funcPtrType(g.Name); targetType != ptrType && strings.HasSuffix(targetType, "*") {
+				return fmt.Sprintf("bitcast (%s @%s to %s)", ptrType, g.Name, targetType)
+			}
 			return "@" + g.Name
 		}
 	}
 
-	if _, ok := v.(*ir.Const); ok {
+	if c, ok := v.(*ir.Const); ok {
+		if strings.HasSuffix(targetType, "*") {
+			if c.Value == 0 { return "null" }
+			return fmt.Sprintf("inttoptr (%s %s to %s)", b.wordType, valStr, targetType)
+		}
 		return valStr
 	}
 	if _, ok := v.(*ir.FloatConst); ok {
@@ -916,6 +1307,29 @@ func (b *llvmBackend) prepareArg(v ir.Value, targetType string) string {
 	return castTemp
 }
 
+// funcPtrType returns the pointer type of a function symbol, using the real signature for functions defined in the module
+func (b *llvmBackend) funcPtrType(name string) string {
+	fn := b.prog.FindFunc(name)
+	if fn == nil {
+		return b.externFuncType(name) + "*"
+	}
+	var types []string
+	if fn.RetStruct != nil && b.retPass(fn.RetStruct).inMemory() { types = append(types, llvmBytes(fn.RetStruct)+"*") }
+	regs := b.newArgRegs(len(types) > 0)
+	for _, p := range fn.Params {
+		if p.Struct != nil {
+			types = append(types, structArgTypes(p.Struct, regs.arg(p.Struct))...)
+			continue
+		}
+		pType := b.formatType(p.Typ)
+		if fn.Name == "main" && p.Name == "argv" { pType = "i8**" }
+		types = append(types, pType)
+		regs.scalar(pType)
+	}
+	if fn.HasVarargs { types = append(types, "...") }
+	return fmt.Sprintf("%s (%s)*", b.funcRetType(fn), strings.Join(types, ", "))
+}
+
 func (b *llvmBackend) formatCast(sourceName, targetName, sourceType, targetType string) string {
 	return b.formatCastWithSignedness(sourceName, targetName, sourceType, targetType, ir.TypeNone)
 }
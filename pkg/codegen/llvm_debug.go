@@ -0,0 +1,179 @@
+package codegen
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/ast"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// llvmDebugInfo accumulates the metadata nodes emitted for `-g`
+// Node i in nodes is printed as !i at the end of the module
+type llvmDebugInfo struct {
+	nodes    []string
+	files    map[int]int
+	types    map[string]int
+	cu       int
+	subType  int
+	subprog  int
+	locs     map[[2]int]int
+	wordSize int
+}
+
+func newLLVMDebugInfo(wordSize int) *llvmDebugInfo {
+	d := &llvmDebugInfo{files: make(map[int]int), types: make(map[string]int), wordSize: wordSize, cu: -1}
+	d.subType = d.add("!DISubroutineType(types: %s)", d.ref(d.add("!{}")))
+	return d
+}
+
+func (d *llvmDebugInfo) add(format string, args ...interface{}) int {
+	d.nodes = append(d.nodes, fmt.Sprintf(format, args...))
+	return len(d.nodes) - 1
+}
+
+func (d *llvmDebugInfo) ref(id int) string { return fmt.Sprintf("!%d", id) }
+
+func (d *llvmDebugInfo) file(fileIndex int) int {
+	if id, ok := d.files[fileIndex]; ok { return id }
+	name := util.SourceFileName(fileIndex)
+	if name == "" { name = "<unknown>" }
+	dir := "."
+	if abs, err := filepath.Abs(name); err == nil { dir = filepath.Dir(abs) }
+	id := d.add("!DIFile(filename: %q, directory: %q)", filepath.Base(name), dir)
+	d.files[fileIndex] = id
+	if d.cu < 0 {
+		d.cu = d.add("distinct !DICompileUnit(language: DW_LANG_C99, file: %s, producer: \"gbc\", isOptimized: false, runtimeVersion: 0, emissionKind: FullDebug)", d.ref(id))
+	}
+	return id
+}
+
+// beginFunc creates the DISubprogram for fn and returns its id, or -1 if fn has no source node
+func (d *llvmDebugInfo) beginFunc(fn *ir.Func) int {
+	d.locs = make(map[[2]int]int)
+	d.subprog = -1
+	if fn.Node == nil { return -1 }
+	tok := fn.Node.Tok
+	f := d.file(tok.FileIndex)
+	d.subprog = d.add("distinct !DISubprogram(name: %q, scope: %s, file: %s, line: %d, type: %s, scopeLine: %d, spFlags: DISPFlagDefinition, unit: %s)",
+		fn.Name, d.ref(f), d.ref(f), tok.Line, d.ref(d.subType), tok.Line, d.ref(d.cu))
+	return d.subprog
+}
+
+func (d *llvmDebugInfo) location(line, col int) int {
+	key := [2]int{line, col}
+	if id, ok := d.locs[key]; ok { return id }
+	id := d.add("!DILocation(line: %d, column: %d, scope: %s)", line, col, d.ref(d.subprog))
+	d.locs[key] = id
+	return id
+}
+
+func (d *llvmDebugInfo) localVar(local *ir.Local) int {
+	f := d.file(local.Tok.FileIndex)
+	typ := d.localType(local)
+	argStr := ""
+	if local.ArgIndex > 0 { argStr = fmt.Sprintf("arg: %d, ", local.ArgIndex) }
+	return d.add("!DILocalVariable(name: %q, %sscope: %s, file: %s, line: %d, type: %s)",
+		local.Name, argStr, d.ref(d.subprog), d.ref(f), local.Tok.Line, d.ref(typ))
+}
+
+func (d *llvmDebugInfo) localType(local *ir.Local) int {
+	if local.IsVector && (local.AstType == nil || local.AstType.Kind == ast.TYPE_UNTYPED) {
+		return d.pointerTo(d.basicType("int", d.wordSize, "DW_ATE_signed"))
+	}
+	if t := d.typeOf(local.AstType); t >= 0 { return t }
+	// Fall back to an opaque byte array covering the slot
+	return d.arrayOf(d.basicType("byte", 1, "DW_ATE_unsigned_char"), local.Size)
+}
+
+// typeOf maps a Bx type to a DIType, returning -1 when its layout is unknown to the backend
+func (d *llvmDebugInfo) typeOf(t *ast.BxType) int {
+	if t == nil { return d.basicType("int", d.wordSize, "DW_ATE_signed") }
+	switch t.Kind {
+	case ast.TYPE_UNTYPED, ast.TYPE_LITERAL_INT, ast.TYPE_ENUM:
+		return d.basicType("int", d.wordSize, "DW_ATE_signed")
+	case ast.TYPE_LITERAL_FLOAT:
+		return d.basicType("float", d.wordSize, "DW_ATE_float")
+	case ast.TYPE_BOOL:
+		return d.basicType("bool", 1, "DW_ATE_boolean")
+	case ast.TYPE_POINTER:
+		if t.Base == nil || t.Base.Kind == ast.TYPE_VOID { return d.pointerTo(-1) }
+		return d.pointerTo(d.typeOf(t.Base))
+	case ast.TYPE_ARRAY:
+		elem := d.typeOf(t.Base)
+		if elem < 0 || t.ArraySize == nil { return -1 }
+		folded := ast.FoldConstants(t.ArraySize)
+		if folded.Type != ast.Number { return -1 }
+		return d.arrayOf(elem, folded.Data.(ast.NumberNode).Value)
+	case ast.TYPE_PRIMITIVE, ast.TYPE_FLOAT:
+		size := int(ir.NewTypeSizeResolver(d.wordSize).GetTypeSize(t.Name))
+		if size == 0 { return -1 }
+		switch {
+		case t.Kind == ast.TYPE_FLOAT: return d.basicType(t.Name, size, "DW_ATE_float")
+		case t.Name == "bool": return d.basicType(t.Name, size, "DW_ATE_boolean")
+		case t.Name == "byte" || t.Name == "uint8": return d.basicType(t.Name, size, "DW_ATE_unsigned_char")
+		case t.Name == "int8": return d.basicType(t.Name, size, "DW_ATE_signed_char")
+		case strings.HasPrefix(t.Name, "uint"): return d.basicType(t.Name, size, "DW_ATE_unsigned")
+		default: return d.basicType(t.Name, size, "DW_ATE_signed")
+		}
+	}
+	return -1
+}
+
+func (d *llvmDebugInfo) basicType(name string, size int, encoding string) int {
+	key := fmt.Sprintf("basic:%s:%d", name, size)
+	if id, ok := d.types[key]; ok { return id }
+	id := d.add("!DIBasicType(name: %q, size: %d, encoding: %s)", name, size*8, encoding)
+	d.types[key] = id
+	return id
+}
+
+func (d *llvmDebugInfo) pointerTo(base int) int {
+	key := fmt.Sprintf("ptr:%d", base)
+	if id, ok := d.types[key]; ok { return id }
+	baseStr := "null"
+	if base >= 0 { baseStr = d.ref(base) }
+	id := d.add("!DIDerivedType(tag: DW_TAG_pointer_type, baseType: %s, size: %d)", baseStr, d.wordSize*8)
+	d.types[key] = id
+	return id
+}
+
+func (d *llvmDebugInfo) arrayOf(elem int, count int64) int {
+	key := fmt.Sprintf("array:%d:%d", elem, count)
+	if id, ok := d.types[key]; ok { return id }
+	subrange := d.add("!DISubrange(count: %d)", count)
+	elements := d.add("!{%s}", d.ref(subrange))
+	id := d.add("!DICompositeType(tag: DW_TAG_array_type, baseType: %s, elements: %s)", d.ref(elem), d.ref(elements))
+	d.types[key] = id
+	return id
+}
+
+// attachLocation appends a !dbg attachment to every instruction line in text
+func (d *llvmDebugInfo) attachLocation(text string, loc int) string {
+	lines := strings.SplitAfter(text, "\n")
+	var sb strings.Builder
+	for _, line := range lines {
+		body := strings.TrimRight(line, "\n")
+		if strings.TrimSpace(body) == "" {
+			sb.WriteString(line)
+			continue
+		}
+		sb.WriteString(body)
+		fmt.Fprintf(&sb, ", !dbg %s", d.ref(loc))
+		if strings.HasSuffix(line, "\n") { sb.WriteString("\n") }
+	}
+	return sb.String()
+}
+
+func (d *llvmDebugInfo) emit(out *strings.Builder) {
+	if d.cu < 0 { return }
+	version := d.add("!{i32 7, !\"Dwarf Version\", i32 4}")
+	debugVersion := d.add("!{i32 2, !\"Debug Info Version\", i32 3}")
+	fmt.Fprintf(out, "\n!llvm.dbg.cu = !{%s}\n", d.ref(d.cu))
+	fmt.Fprintf(out, "!llvm.module.flags = !{%s, %s}\n\n", d.ref(version), d.ref(debugVersion))
+	for i, node := range d.nodes {
+		fmt.Fprintf(out, "!%d = %s\n", i, node)
+	}
+}
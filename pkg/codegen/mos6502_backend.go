@@ -0,0 +1,886 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/mos6502"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// The 6502 backend lowers the IR to assembly for the MOS 6502, which cmd/gbc assembles with pkg/mos6502 into a
+// raw image started at mos6502.LoadAddr. Words are 16 bits, and functions follow the convention of the
+// `__asm__` functions of lib/b/6502.b: the first argument and the result travel in A (low) and Y (high), the
+// others are pushed on the hardware stack, the last first, and the caller pops them
+// Every temporary lives in the frame of its function on a software stack growing down from mos6502.ArgsAddr,
+// reached through the frame pointer in zero page; autos follow the temporaries
+// Multiplication, division and shifts call runtime routines working on operands of any width in zero page
+
+const mos6502Header = `__ptr = $00 ; scratch pointer, shared with lib/b/6502.b
+__fp = $02
+__sp = $04
+__ptr2 = $06
+__ret = $08
+__tmp = $0A
+__call = $0C
+__cnt = $0E
+__wid = $0F
+__sgna = $10
+__sgnq = $11
+__t0 = $18
+__t1 = $20
+__t2 = $28
+__t3 = $30
+__page = $38 ; pointers to the second and later 256 bytes of the frame
+`
+
+// mos6502Pages is how many 256 byte pages of temporaries a frame may have
+const mos6502Pages = 8
+
+// mos6502Runtime holds the routines the generated code calls, and the routines each of them needs in turn
+var mos6502Runtime = map[string]retroRoutine{
+	"__icall": {code: `__icall:
+	JMP (__call)
+`},
+	// __t2 = __t0 * __t1, in __wid bytes
+	"__mul": {code: `__mul:
+	LDX #0
+	TXA
+__mul_clear:
+	STA __t2,X
+	INX
+	CPX __wid
+	BNE __mul_clear
+	LDA __wid
+	ASL A
+	ASL A
+	ASL A
+	STA __cnt
+__mul_bit:
+	LDX __wid
+	DEX
+	LSR __t1,X
+	LDY __wid
+	DEY
+	BEQ __mul_test
+__mul_shift:
+	DEX
+	ROR __t1,X
+	DEY
+	BNE __mul_shift
+__mul_test:
+	BCC __mul_next
+	CLC
+	LDX #0
+	LDY __wid
+__mul_add:
+	LDA __t2,X
+	ADC __t0,X
+	STA __t2,X
+	INX
+	DEY
+	BNE __mul_add
+__mul_next:
+	ASL __t0
+	LDX #1
+	LDY __wid
+	DEY
+	BEQ __mul_done
+__mul_rol:
+	ROL __t0,X
+	INX
+	DEY
+	BNE __mul_rol
+__mul_done:
+	DEC __cnt
+	BNE __mul_bit
+	RTS
+`},
+	// __t0, __t2 = __t0 / __t1, __t0 % __t1 as unsigned numbers of __wid bytes
+	"__udiv": {code: `__udiv:
+	LDX #0
+	TXA
+__udiv_clear:
+	STA __t2,X
+	INX
+	CPX __wid
+	BNE __udiv_clear
+	LDA __wid
+	ASL A
+	ASL A
+	ASL A
+	STA __cnt
+__udiv_bit:
+	ASL __t0
+	LDX #1
+	LDY __wid
+	DEY
+	BEQ __udiv_rem
+__udiv_rol:
+	ROL __t0,X
+	INX
+	DEY
+	BNE __udiv_rol
+__udiv_rem:
+	LDX #0
+	LDY __wid
+__udiv_rol2:
+	ROL __t2,X
+	INX
+	DEY
+	BNE __udiv_rol2
+	LDA #0
+	ROL A
+	STA __tmp
+	SEC
+	LDX #0
+	LDY __wid
+__udiv_sub:
+	LDA __t2,X
+	SBC __t1,X
+	STA __t3,X
+	INX
+	DEY
+	BNE __udiv_sub
+	LDA __tmp
+	SBC #0
+	BCC __udiv_next
+	LDX #0
+	LDY __wid
+__udiv_keep:
+	LDA __t3,X
+	STA __t2,X
+	INX
+	DEY
+	BNE __udiv_keep
+	INC __t0
+__udiv_next:
+	DEC __cnt
+	BNE __udiv_bit
+	RTS
+`},
+	// __t0, __t2 = __t0 / __t1, __t0 % __t1, truncating towards zero
+	"__div": {uses: []string{"__udiv", "__neg"}, code: `__div:
+	LDX __wid
+	DEX
+	LDA __t0,X
+	STA __sgna
+	EOR __t1,X
+	STA __sgnq
+	LDA __sgna
+	BPL __div_a
+	LDX #__t0
+	JSR __neg
+__div_a:
+	LDX __wid
+	DEX
+	LDA __t1,X
+	BPL __div_b
+	LDX #__t1
+	JSR __neg
+__div_b:
+	JSR __udiv
+	LDA __sgnq
+	BPL __div_q
+	LDX #__t0
+	JSR __neg
+__div_q:
+	LDA __sgna
+	BPL __div_r
+	LDX #__t2
+	JSR __neg
+__div_r:
+	RTS
+`},
+	// Negates the __wid bytes in zero page from X
+	"__neg": {code: `__neg:
+	LDY __wid
+	SEC
+__neg_byte:
+	LDA #0
+	SBC $00,X
+	STA $00,X
+	INX
+	DEY
+	BNE __neg_byte
+	RTS
+`},
+	// __t0 <<= __t1 and __t0 >>= __t1, in __wid bytes, by the low byte of __t1
+	"__shl": {code: `__shl:
+	LDA __t1
+	BEQ __shl_done
+	STA __cnt
+__shl_bit:
+	ASL __t0
+	LDX #1
+	LDY __wid
+	DEY
+	BEQ __shl_next
+__shl_rol:
+	ROL __t0,X
+	INX
+	DEY
+	BNE __shl_rol
+__shl_next:
+	DEC __cnt
+	BNE __shl_bit
+__shl_done:
+	RTS
+`},
+	"__shr": {code: `__shr:
+	LDA __t1
+	BEQ __shr_done
+	STA __cnt
+__shr_bit:
+	LDX __wid
+	DEX
+	LSR __t0,X
+	LDY __wid
+	DEY
+	BEQ __shr_next
+__shr_ror:
+	DEX
+	ROR __t0,X
+	DEY
+	BNE __shr_ror
+__shr_next:
+	DEC __cnt
+	BNE __shr_bit
+__shr_done:
+	RTS
+`},
+	// Copies __t1 bytes from (__ptr) to (__ptr2)
+	"__blit": {code: `__blit:
+	LDY #0
+__blit_byte:
+	LDA __t1
+	ORA __t1+1
+	BEQ __blit_done
+	LDA (__ptr),Y
+	STA (__ptr2),Y
+	INY
+	BNE __blit_count
+	INC __ptr+1
+	INC __ptr2+1
+__blit_count:
+	LDA __t1
+	BNE __blit_low
+	DEC __t1+1
+__blit_low:
+	DEC __t1
+	JMP __blit_byte
+__blit_done:
+	RTS
+`},
+}
+
+type mos6502Backend struct {
+	retroBackend
+	pages int // of the frame of the function being lowered, after the first
+}
+
+func NewMOS6502Backend() Backend {
+	b := &mos6502Backend{}
+	b.retroBackend = retroBackend{target: b, name: "6502", routines: mos6502Runtime}
+	return b
+}
+
+func init() {
+	Register(BackendInfo{
+		Name: "6502", Description: "a raw 6502 image loaded at $8000", New: NewMOS6502Backend,
+		Targets:       []config.SubTarget{{Name: "6502-unknown-none", GOOS: "none", GOARCH: "6502"}},
+		DefaultTarget: func(string, string) string { return "6502-unknown-none" },
+		WordSizes:     []int{2},
+		Capabilities:  Capabilities{Asm: "6502"},
+	})
+}
+
+func (b *mos6502Backend) Generate(prog *ir.Program, cfg *config.Config) (*bytes.Buffer, error) {
+	text, err := b.GenerateIR(prog, cfg)
+	if err != nil { return nil, err }
+	return bytes.NewBufferString(text), nil
+}
+
+// GenerateIR writes the assembly, which is all the 6502 backend has to show
+func (b *mos6502Backend) GenerateIR(prog *ir.Program, cfg *config.Config) (string, error) {
+	main, err := b.begin(prog, cfg)
+	if err != nil { return "", err }
+
+	b.out.WriteString("; Generated by gbc for the MOS 6502\n")
+	b.out.WriteString(mos6502Header)
+	b.genStart(main)
+	for _, fn := range b.prog.Funcs {
+		if err := b.genFunc(fn); err != nil { return "", err }
+	}
+	b.genRuntime()
+	if err := b.genData(); err != nil { return "", err }
+	return b.out.String(), nil
+}
+
+func (b *mos6502Backend) label(name string) { fmt.Fprintf(b.out, "%s:\n", name) }
+
+func (b *mos6502Backend) newLabel() string {
+	b.labels++
+	return fmt.Sprintf("@%d", b.labels)
+}
+
+// genStart calls main with the argc and argv the emulator leaves at mos6502.ArgsAddr, then exits with its result
+func (b *mos6502Backend) genStart(main *ir.Func) {
+	fmt.Fprintf(b.out, "\t.org $%04X\n", mos6502.LoadAddr)
+	b.label("__start")
+	b.ins("LDX #$FF")
+	b.ins("TXS")
+	b.ins("LDA #<$%04X", mos6502.ArgsAddr)
+	b.ins("STA __sp")
+	b.ins("LDA #>$%04X", mos6502.ArgsAddr)
+	b.ins("STA __sp+1")
+	if len(main.Params) > 1 {
+		b.ins("LDA #>$%04X", mos6502.ArgsAddr+2)
+		b.ins("PHA")
+		b.ins("LDA #<$%04X", mos6502.ArgsAddr+2)
+		b.ins("PHA")
+	}
+	b.ins("LDA $%04X", mos6502.ArgsAddr)
+	b.ins("LDY $%04X", mos6502.ArgsAddr+1)
+	b.ins("JSR main")
+	b.ins("JSR $%04X", mos6502.ExitAddr)
+}
+
+func (b *mos6502Backend) genBytes(data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), 16)
+		parts := make([]string, n)
+		for i, c := range data[:n] {
+			parts[i] = fmt.Sprintf("%d", c)
+		}
+		b.ins(".byte %s", strings.Join(parts, ", "))
+		data = data[n:]
+	}
+}
+
+func (b *mos6502Backend) genFill(size int64) { b.ins(".fill %d", size) }
+
+func (b *mos6502Backend) genAddr(name string) { b.ins(".word %s", name) }
+
+// slot is the frame offset and size of the temporary v holds
+func (b *mos6502Backend) slot(v ir.Value) (int64, int, bool) {
+	if c, ok := v.(*ir.CastValue); ok { return b.slot(c.Value) }
+	tmp, ok := v.(*ir.Temporary)
+	if !ok || tmp == nil { return 0, 0, false }
+	key := tempName{tmp.Name, tmp.ID}
+	off, ok := b.slots[key]
+	if !ok { return 0, 0, false }
+	return off, b.slotSize(b.temps[key]), true
+}
+
+func (b *mos6502Backend) slotSize(t ir.Type) int { return max(b.width(t), b.prog.WordSize) }
+
+// frameOp applies mn to the frame byte at off, through the frame pointer or that of its page
+func (b *mos6502Backend) frameOp(mn string, off int64) {
+	ptr := "__fp"
+	if page := off >> 8; page > 0 { ptr = fmt.Sprintf("__page+%d", 2*(page-1)) }
+	b.ins("LDY #%d", off&0xFF)
+	b.ins("%s (%s),Y", mn, ptr)
+}
+
+// extend turns the byte in A into the byte above it in a value extended with or without its sign
+func (b *mos6502Backend) extend(signed bool) {
+	if !signed {
+		b.ins("LDA #0")
+		return
+	}
+	done := b.newLabel()
+	b.ins("ORA #$7F")
+	b.ins("BMI %s", done)
+	b.ins("LDA #0")
+	b.label(done)
+}
+
+// imm is the immediate operand for byte i of a constant or an address, or "" for any other value
+func (b *mos6502Backend) imm(v ir.Value, i int) string {
+	switch val := v.(type) {
+	case *ir.Const: return fmt.Sprintf("#$%02X", byte(val.Value>>(8*min(i, 7))))
+	case *ir.Global:
+		switch i {
+		case 0: return "#<" + val.Name
+		case 1: return "#>" + val.Name
+		}
+		return "#0"
+	case *ir.CastValue: return b.imm(val.Value, i)
+	case *ir.FloatConst: util.Error(b.pos, "floating-point is not supported by the 6502 backend")
+	}
+	return ""
+}
+
+// lda loads byte i of v into A
+func (b *mos6502Backend) lda(v ir.Value, i int) {
+	if imm := b.imm(v, i); imm != "" {
+		b.ins("LDA %s", imm)
+		return
+	}
+	off, size, ok := b.slot(v)
+	if !ok {
+		b.ins("LDA #0")
+		return
+	}
+	if i < size {
+		b.frameOp("LDA", off+int64(i))
+		return
+	}
+	b.frameOp("LDA", off+int64(size-1))
+	b.extend(signedType(b.typeOf(v)))
+}
+
+// operand returns an emitter applying an instruction to byte i of v, as a source beside A in an operation n
+// bytes wide; a temporary narrower than that is extended into zp first
+func (b *mos6502Backend) operand(v ir.Value, n int, zp string) func(mn string, i int) {
+	if _, size, ok := b.slot(v); ok && size < n {
+		b.toZP(v, zp, n)
+		return func(mn string, i int) { b.ins("%s %s+%d", mn, zp, i) }
+	}
+	return func(mn string, i int) {
+		if imm := b.imm(v, i); imm != "" {
+			b.ins("%s %s", mn, imm)
+		} else if off, _, ok := b.slot(v); ok {
+			b.frameOp(mn, off+int64(i))
+		} else {
+			b.ins("%s #0", mn)
+		}
+	}
+}
+
+func (b *mos6502Backend) toZP(v ir.Value, zp string, n int) {
+	for i := 0; i < n; i++ {
+		b.lda(v, i)
+		b.ins("STA %s+%d", zp, i)
+	}
+}
+
+// store sets the temporary r to the n bytes byteAt leaves in A, extending them over the rest of its slot
+func (b *mos6502Backend) store(r ir.Value, n int, signed bool, byteAt func(i int)) {
+	off, size, ok := b.slot(r)
+	if !ok { return }
+	for i := 0; i < n && i < size; i++ {
+		byteAt(i)
+		b.frameOp("STA", off+int64(i))
+	}
+	if n < size {
+		b.extend(signed)
+		for i := n; i < size; i++ {
+			b.frameOp("STA", off+int64(i))
+		}
+	}
+}
+
+func (b *mos6502Backend) newSlot(end *int64, t ir.Type) int64 {
+	size := int64(b.slotSize(t))
+	// A slot never straddles two pages, which are reached through different pointers
+	if *end&0xFF+size > 0x100 { *end = (*end + 0xFF) &^ 0xFF }
+	off := *end
+	*end += size
+	return off
+}
+
+func (b *mos6502Backend) genFunc(fn *ir.Func) error {
+	b.beginFunc(fn)
+
+	// The saved frame pointer, then the temporaries, then the autos
+	end := int64(2)
+	define := func(v ir.Value, t ir.Type) {
+		tmp, ok := v.(*ir.Temporary)
+		if !ok || tmp == nil { return }
+		key := tempName{tmp.Name, tmp.ID}
+		if _, defined := b.slots[key]; defined { return }
+		if isFloatIR(t) { util.Error(b.pos, "floating-point is not supported by the 6502 backend") }
+		b.temps[key] = t
+		b.slots[key] = b.newSlot(&end, t)
+	}
+	for _, p := range fn.Params {
+		define(p.Val, p.Typ)
+	}
+	for _, block := range fn.Blocks {
+		for _, instr := range block.Instructions {
+			define(instr.Result, resultType(instr, b.prog.WordSize))
+			if instr.Op == ir.OpPhi {
+				tmp := instr.Result.(*ir.Temporary)
+				key := tempName{tmp.Name, tmp.ID}
+				b.phis[block.Label.Name] = append(b.phis[block.Label.Name], instr)
+				b.shadows[key] = b.newSlot(&end, b.temps[key])
+			}
+		}
+	}
+	b.pages = int((end - 1) >> 8)
+	if b.pages >= mos6502Pages { return fmt.Errorf("function '%s' needs more than %d bytes of temporaries", fn.Name, mos6502Pages*256) }
+	for _, block := range fn.Blocks {
+		for _, instr := range block.Instructions {
+			if instr.Op != ir.OpAlloc { continue }
+			if size, ok := instr.Args[0].(*ir.Const); ok {
+				b.frame[instr] = end
+				end += size.Value
+			}
+		}
+	}
+	if end > 0xFFFF { return fmt.Errorf("the frame of '%s' is larger than 64 KiB", fn.Name) }
+
+	b.out.WriteString("\n")
+	b.label(fn.Name)
+	b.genPrologue(end)
+	b.genBlocks()
+	b.genEpilogue(end)
+	return nil
+}
+
+func (b *mos6502Backend) blockLabel(name string) string { return "@" + b.fn.Name + "." + name }
+
+func (b *mos6502Backend) genBlockLabel(name string) { b.label(b.blockLabel(name)) }
+
+// genPrologue pushes a frame of size bytes on the software stack, saving the frame pointer of the caller in its
+// first word, and stores the parameters in their slots
+func (b *mos6502Backend) genPrologue(size int64) {
+	b.ins("STA __ret")
+	b.ins("STY __ret+1")
+	b.ins("SEC")
+	b.ins("LDA __sp")
+	b.ins("SBC #<%d", size)
+	b.ins("STA __ptr")
+	b.ins("LDA __sp+1")
+	b.ins("SBC #>%d", size)
+	b.ins("STA __ptr+1")
+	b.ins("LDY #0")
+	b.ins("LDA __fp")
+	b.ins("STA (__ptr),Y")
+	b.ins("INY")
+	b.ins("LDA __fp+1")
+	b.ins("STA (__ptr),Y")
+	b.ins("LDA __ptr")
+	b.ins("STA __fp")
+	b.ins("STA __sp")
+	b.ins("LDA __ptr+1")
+	b.ins("STA __fp+1")
+	b.ins("STA __sp+1")
+	b.genPages()
+
+	if len(b.fn.Params) > 1 { b.ins("TSX") }
+	for k, p := range b.fn.Params {
+		n := min(b.width(p.Typ), 2)
+		b.store(p.Val, n, signedType(p.Typ), func(i int) {
+			if k == 0 {
+				b.ins("LDA __ret+%d", i)
+			} else {
+				// Past the return address, the arguments from the second on
+				b.ins("LDA $%04X,X", 0x103+2*(k-1)+i)
+			}
+		})
+	}
+}
+
+// genPages points the page pointers at the pages of the frame after the first
+func (b *mos6502Backend) genPages() {
+	for p := 1; p <= b.pages; p++ {
+		b.ins("LDA __fp")
+		b.ins("STA __page+%d", 2*(p-1))
+		b.ins("LDA __fp+1")
+		b.ins("CLC")
+		b.ins("ADC #%d", p)
+		b.ins("STA __page+%d", 2*(p-1)+1)
+	}
+}
+
+// genEpilogue pops the frame, and any autos allocated since, and returns the value left in __ret
+func (b *mos6502Backend) genEpilogue(size int64) {
+	b.label(b.blockLabel("ret"))
+	b.ins("CLC")
+	b.ins("LDA __fp")
+	b.ins("ADC #<%d", size)
+	b.ins("STA __sp")
+	b.ins("LDA __fp+1")
+	b.ins("ADC #>%d", size)
+	b.ins("STA __sp+1")
+	b.ins("LDY #0")
+	b.ins("LDA (__fp),Y")
+	b.ins("TAX")
+	b.ins("INY")
+	b.ins("LDA (__fp),Y")
+	b.ins("STA __fp+1")
+	b.ins("STX __fp")
+	b.ins("LDA __ret")
+	b.ins("LDY __ret+1")
+	b.ins("RTS")
+}
+
+func (b *mos6502Backend) genReturn(v ir.Value) {
+	for i := 0; i < 2; i++ {
+		if v == nil || b.fn.ReturnType == ir.TypeNone {
+			b.ins("LDA #0")
+		} else {
+			b.lda(v, i)
+		}
+		b.ins("STA __ret+%d", i)
+	}
+	b.ins("JMP %s", b.blockLabel("ret"))
+}
+
+func (b *mos6502Backend) genPhiOut(phi *ir.Temporary, v ir.Value) {
+	key := tempName{phi.Name, phi.ID}
+	for j := 0; j < b.slotSize(b.temps[key]); j++ {
+		b.lda(v, j)
+		b.frameOp("STA", b.shadows[key]+int64(j))
+	}
+}
+
+func (b *mos6502Backend) genPhiIn(phi *ir.Temporary) {
+	key := tempName{phi.Name, phi.ID}
+	for j := 0; j < b.slotSize(b.temps[key]); j++ {
+		b.frameOp("LDA", b.shadows[key]+int64(j))
+		b.frameOp("STA", b.slots[key]+int64(j))
+	}
+}
+
+func (b *mos6502Backend) genJumpTo(block string) { b.ins("JMP %s", b.blockLabel(block)) }
+
+var mos6502Arith = map[ir.Op]string{ir.OpAdd: "ADC", ir.OpSub: "SBC", ir.OpAnd: "AND", ir.OpOr: "ORA", ir.OpXor: "EOR"}
+
+// mos6502Calls holds the runtime routine of each operation it does, and where it leaves the result
+var mos6502Calls = map[ir.Op][2]string{
+	ir.OpMul: {"__mul", "__t2"}, ir.OpDiv: {"__div", "__t0"}, ir.OpRem: {"__div", "__t2"},
+	ir.OpShl: {"__shl", "__t0"}, ir.OpShr: {"__shr", "__t0"},
+}
+
+func (b *mos6502Backend) genInstr(block *ir.BasicBlock, instr *ir.Instruction) {
+	args, typ := instr.Args, instr.Typ
+	b.pos = instr.Pos
+	switch instr.Op {
+	case ir.OpJmp: b.genJump(block, args[0].String(), true)
+	case ir.OpJnz:
+		if c, ok := args[0].(*ir.Const); ok {
+			to := args[2].String()
+			if c.Value != 0 { to = args[1].String() }
+			b.genJump(block, to, true)
+			return
+		}
+		n := 2
+		if _, size, ok := b.slot(args[0]); ok { n = size }
+		cond := b.operand(args[0], n, "__t0")
+		cond("LDA", 0)
+		for i := 1; i < n; i++ {
+			cond("ORA", i)
+		}
+		then := b.newLabel()
+		b.ins("BNE %s", then)
+		b.genJump(block, args[2].String(), false)
+		b.label(then)
+		b.genJump(block, args[1].String(), true)
+	case ir.OpRet:
+		var v ir.Value
+		if len(args) > 0 { v = args[0] }
+		b.genReturn(v)
+
+	case ir.OpAlloc:
+		if off, ok := b.frame[instr]; ok {
+			b.ins("CLC")
+			b.store(instr.Result, 2, false, func(i int) {
+				b.ins("LDA __fp+%d", i)
+				b.ins("ADC #%s%d", []string{"<", ">"}[i], off)
+			})
+			return
+		}
+		size := b.operand(args[0], 2, "__t0")
+		b.ins("SEC")
+		for i := 0; i < 2; i++ {
+			b.ins("LDA __sp+%d", i)
+			size("SBC", i)
+			b.ins("STA __sp+%d", i)
+		}
+		b.store(instr.Result, 2, false, func(i int) { b.ins("LDA __sp+%d", i) })
+	case ir.OpLoad:
+		n := b.width(typ)
+		at := b.address(args[0])
+		b.store(instr.Result, n, signedType(typ), func(i int) { at("LDA", i) })
+	case ir.OpStore:
+		at := b.address(args[1])
+		for i := 0; i < b.width(typ); i++ {
+			b.lda(args[0], i)
+			at("STA", i)
+		}
+	case ir.OpBlit:
+		b.toZP(args[0], "__ptr", 2)
+		b.toZP(args[1], "__ptr2", 2)
+		if len(args) > 2 {
+			b.toZP(args[2], "__t1", 2)
+		} else {
+			b.toZP(&ir.Const{Value: ir.SizeOfType(typ, b.prog.WordSize)}, "__t1", 2)
+		}
+		b.use("__blit")
+		b.ins("JSR __blit")
+	case ir.OpCall: b.genCall(instr)
+
+	case ir.OpAdd, ir.OpSub, ir.OpAnd, ir.OpOr, ir.OpXor:
+		n := b.width(typ)
+		y := b.operand(args[1], n, "__t1")
+		switch instr.Op {
+		case ir.OpAdd: b.ins("CLC")
+		case ir.OpSub: b.ins("SEC")
+		}
+		b.store(instr.Result, n, signedType(typ), func(i int) {
+			b.lda(args[0], i)
+			y(mos6502Arith[instr.Op], i)
+		})
+	case ir.OpMul, ir.OpDiv, ir.OpRem, ir.OpShl, ir.OpShr:
+		n := b.width(typ)
+		call := mos6502Calls[instr.Op]
+		b.toZP(args[0], "__t0", n)
+		b.toZP(args[1], "__t1", n)
+		b.ins("LDA #%d", n)
+		b.ins("STA __wid")
+		b.use(call[0])
+		b.ins("JSR %s", call[0])
+		b.store(instr.Result, n, signedType(typ), func(i int) { b.ins("LDA %s+%d", call[1], i) })
+
+	case ir.OpCEq, ir.OpCNeq, ir.OpCLt, ir.OpCGt, ir.OpCLe, ir.OpCGe:
+		b.genCompare(instr)
+
+	case ir.OpExtSB, ir.OpExtUB, ir.OpExtSH, ir.OpExtUH, ir.OpExtSW, ir.OpExtUW:
+		from := map[ir.Op]int{ir.OpExtSB: 1, ir.OpExtUB: 1, ir.OpExtSH: 2, ir.OpExtUH: 2, ir.OpExtSW: 4, ir.OpExtUW: 4}[instr.Op]
+		signed := instr.Op == ir.OpExtSB || instr.Op == ir.OpExtSH || instr.Op == ir.OpExtSW
+		b.store(instr.Result, from, signed, func(i int) { b.lda(args[0], i) })
+	case ir.OpTrunc:
+		b.store(instr.Result, b.width(typ), typ == ir.TypeSB || typ == ir.TypeSH || typ == ir.TypeW, func(i int) { b.lda(args[0], i) })
+	case ir.OpCast:
+		b.store(instr.Result, b.width(typ), signedType(typ), func(i int) { b.lda(args[0], i) })
+
+	case ir.OpAddF, ir.OpSubF, ir.OpMulF, ir.OpDivF, ir.OpRemF, ir.OpNegF, ir.OpFToSI, ir.OpFToUI,
+		ir.OpSWToF, ir.OpUWToF, ir.OpSLToF, ir.OpULToF, ir.OpFToF:
+		util.Error(instr.Pos, "floating-point is not supported by the 6502 backend")
+	default:
+		util.Error(instr.Pos, "internal: 6502 backend cannot lower IR operation %d", instr.Op)
+	}
+}
+
+// address returns an emitter applying an instruction to byte i at the address v holds: directly at a label or a
+// constant address, or through __ptr
+func (b *mos6502Backend) address(v ir.Value) func(mn string, i int) {
+	switch val := v.(type) {
+	case *ir.Global: return func(mn string, i int) { b.ins("%s %s+%d", mn, val.Name, i) }
+	case *ir.Const: return func(mn string, i int) { b.ins("%s $%04X", mn, uint16(val.Value)+uint16(i)) }
+	case *ir.CastValue: return b.address(val.Value)
+	}
+	b.toZP(v, "__ptr", 2)
+	return func(mn string, i int) {
+		b.ins("LDY #%d", i)
+		b.ins("%s (__ptr),Y", mn)
+	}
+}
+
+// genCompare compares as signed numbers: x < y is the sign of x - y, corrected on overflow
+func (b *mos6502Backend) genCompare(instr *ir.Instruction) {
+	args := instr.Args
+	t := instr.OperandType
+	if t == ir.TypeNone {
+		t = b.typeOf(args[0])
+		if b.width(b.typeOf(args[1])) > b.width(t) { t = b.typeOf(args[1]) }
+	}
+	if isFloatIR(t) { util.Error(instr.Pos, "floating-point is not supported by the 6502 backend") }
+	n := b.width(t)
+	yes, done := b.newLabel(), b.newLabel()
+
+	switch instr.Op {
+	case ir.OpCEq, ir.OpCNeq:
+		y := b.operand(args[1], n, "__t1")
+		for i := 0; i < n; i++ {
+			b.lda(args[0], i)
+			y("CMP", i)
+			b.ins("BNE %s", yes)
+		}
+		b.ins("LDA #%d", map[bool]int{true: 1, false: 0}[instr.Op == ir.OpCEq])
+		b.ins("JMP %s", done)
+		b.label(yes)
+		b.ins("LDA #%d", map[bool]int{true: 0, false: 1}[instr.Op == ir.OpCEq])
+	default:
+		x, yv := args[0], args[1]
+		if instr.Op == ir.OpCGt || instr.Op == ir.OpCLe { x, yv = yv, x }
+		y := b.operand(yv, n, "__t1")
+		b.ins("SEC")
+		for i := 0; i < n; i++ {
+			b.lda(x, i)
+			y("SBC", i)
+		}
+		less := instr.Op == ir.OpCLt || instr.Op == ir.OpCGt
+		overflow := b.newLabel()
+		b.ins("BVC %s", overflow)
+		b.ins("EOR #$80")
+		b.label(overflow)
+		b.ins("BMI %s", yes)
+		b.ins("LDA #%d", map[bool]int{true: 0, false: 1}[less])
+		b.ins("JMP %s", done)
+		b.label(yes)
+		b.ins("LDA #%d", map[bool]int{true: 1, false: 0}[less])
+	}
+	b.label(done)
+	b.store(instr.Result, 1, false, func(int) {})
+}
+
+// genCall passes the first argument in A and Y and pushes the others, the last first, calling through __icall
+// when the callee is not a label or a constant address
+func (b *mos6502Backend) genCall(instr *ir.Instruction) {
+	args := instr.Args[1:]
+	for i, arg := range args {
+		if t := b.typeOf(arg); isFloatIR(t) || i < len(instr.ArgTypes) && isFloatIR(instr.ArgTypes[i]) {
+			util.Error(instr.Pos, "floating-point is not supported by the 6502 backend")
+		}
+	}
+
+	callee := ""
+	switch val := instr.Args[0].(type) {
+	case *ir.Global: callee = val.Name
+	case *ir.Const: callee = fmt.Sprintf("$%04X", uint16(val.Value))
+	default:
+		b.toZP(instr.Args[0], "__call", 2)
+		b.use("__icall")
+		callee = "__icall"
+	}
+
+	for k := len(args) - 1; k >= 1; k-- {
+		b.lda(args[k], 1)
+		b.ins("PHA")
+		b.lda(args[k], 0)
+		b.ins("PHA")
+	}
+	if len(args) > 0 {
+		if hi := b.imm(args[0], 1); hi != "" {
+			b.ins("LDY %s", hi)
+			b.ins("LDA %s", b.imm(args[0], 0))
+		} else {
+			b.lda(args[0], 0)
+			b.ins("STA __tmp")
+			b.lda(args[0], 1)
+			b.ins("TAY")
+			b.ins("LDA __tmp")
+		}
+	}
+	b.ins("JSR %s", callee)
+
+	if instr.Result != nil {
+		b.ins("STA __ret")
+		b.ins("STY __ret+1")
+	}
+	if pushed := 2 * max(len(args)-1, 0); pushed > 6 {
+		b.ins("TSX")
+		b.ins("TXA")
+		b.ins("CLC")
+		b.ins("ADC #%d", pushed)
+		b.ins("TAX")
+		b.ins("TXS")
+	} else {
+		for i := 0; i < pushed; i++ {
+			b.ins("PLA")
+		}
+	}
+	b.genPages()
+	if instr.Result != nil {
+		n := min(b.width(instr.Typ), 2)
+		b.store(instr.Result, n, signedType(instr.Typ), func(i int) { b.ins("LDA __ret+%d", i) })
+	}
+}
@@ -0,0 +1,182 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// QBE has no inline assembly, so each `__asm__` statement becomes a helper written out after the assembly QBE
+// generates. The function spills the inputs of the statement to a block of words in its frame and calls the
+// helper with the address of the block. The helper loads the inputs to registers, runs the statement and stores
+// its outputs back into the block, from which the function reloads them
+
+// qbeAsmArch is what the helpers need to know of the registers and instructions of a target
+type qbeAsmArch struct {
+	regs    []string          // given to the operands in this order; the last one holds the block on entry
+	saved   []string          // preserved across calls, saved by a helper that clobbers them
+	aliases map[string]string // other names of the registers, as clobbers may name them
+	prefix  string            // of the registers in the assembly
+	push    func(reg string) string
+	pop     func(reg string) string
+	load    func(reg, base string, off int) string
+	store   func(reg, base string, off int) string
+}
+
+var qbeAsmArchs = map[string]*qbeAsmArch{
+	"amd64": {
+		regs:   []string{"rax", "rcx", "rdx", "rsi", "r8", "r9", "r10", "r11", "rdi"},
+		saved:  []string{"rbx", "rbp", "r12", "r13", "r14", "r15"},
+		prefix: "%",
+		aliases: map[string]string{
+			"eax": "rax", "ecx": "rcx", "edx": "rdx", "esi": "rsi", "edi": "rdi", "ebx": "rbx", "ebp": "rbp",
+			"r8d": "r8", "r9d": "r9", "r10d": "r10", "r11d": "r11", "r12d": "r12", "r13d": "r13", "r14d": "r14", "r15d": "r15",
+		},
+		push:  func(reg string) string { return "pushq %" + reg },
+		pop:   func(reg string) string { return "popq %" + reg },
+		load:  func(reg, base string, off int) string { return fmt.Sprintf("movq %d(%%%s), %%%s", off, base, reg) },
+		store: func(reg, base string, off int) string { return fmt.Sprintf("movq %%%s, %d(%%%s)", reg, off, base) },
+	},
+	"arm64": {
+		regs: []string{"x9", "x10", "x11", "x12", "x13", "x14", "x15", "x1", "x2", "x3", "x4", "x5", "x6", "x7", "x8", "x0"},
+		saved: []string{"x19", "x20", "x21", "x22", "x23", "x24", "x25", "x26", "x27", "x28", "x29", "x30"},
+		aliases: map[string]string{"fp": "x29", "lr": "x30"},
+		push:  func(reg string) string { return fmt.Sprintf("str %s, [sp, #-16]!", reg) },
+		pop:   func(reg string) string { return fmt.Sprintf("ldr %s, [sp], #16", reg) },
+		load:  func(reg, base string, off int) string { return fmt.Sprintf("ldr %s, [%s, #%d]", reg, base, off) },
+		store: func(reg, base string, off int) string { return fmt.Sprintf("str %s, [%s, #%d]", reg, base, off) },
+	},
+	"rv64": {
+		regs: []string{"t0", "t1", "t2", "t3", "t4", "t5", "t6", "a1", "a2", "a3", "a4", "a5", "a6", "a7", "a0"},
+		saved: []string{"s0", "s1", "s2", "s3", "s4", "s5", "s6", "s7", "s8", "s9", "s10", "s11", "ra"},
+		aliases: map[string]string{
+			"x1": "ra", "x5": "t0", "x6": "t1", "x7": "t2", "x8": "s0", "fp": "s0", "x9": "s1", "x10": "a0", "x11": "a1",
+			"x12": "a2", "x13": "a3", "x14": "a4", "x15": "a5", "x16": "a6", "x17": "a7", "x18": "s2", "x19": "s3",
+			"x20": "s4", "x21": "s5", "x22": "s6", "x23": "s7", "x24": "s8", "x25": "s9", "x26": "s10", "x27": "s11",
+			"x28": "t3", "x29": "t4", "x30": "t5", "x31": "t6",
+		},
+		push:  func(reg string) string { return fmt.Sprintf("addi sp, sp, -16\n\tsd %s, 0(sp)", reg) },
+		pop:   func(reg string) string { return fmt.Sprintf("ld %s, 0(sp)\n\taddi sp, sp, 16", reg) },
+		load:  func(reg, base string, off int) string { return fmt.Sprintf("ld %s, %d(%s)", reg, off, base) },
+		store: func(reg, base string, off int) string { return fmt.Sprintf("sd %s, %d(%s)", reg, off, base) },
+	},
+}
+
+// asmBlockSize is the size of the block the `__asm__` statements of fn spill to, 0 if it has none
+func asmBlockSize(fn *ir.Func) int {
+	size := 0
+	for _, block := range fn.Blocks {
+		for _, instr := range block.Instructions {
+			if instr.Op == ir.OpAsm && 8*len(instr.Asm.Operands) > size { size = 8 * len(instr.Asm.Operands) }
+		}
+	}
+	return size
+}
+
+// genAsm spills the inputs of an `__asm__` statement, calls its helper and reloads the outputs
+func (b *qbeBackend) genAsm(instr *ir.Instruction) {
+	name := fmt.Sprintf("__gbc_asm%d", len(b.asmHelpers))
+	b.asmHelpers = append(b.asmHelpers, b.asmHelper(name, instr))
+
+	slot := func(i int) string {
+		if i == 0 { return "%asm_block" }
+		temp := fmt.Sprintf("%%asm_%d", b.extCounter)
+		b.extCounter++
+		fmt.Fprintf(b.out, "\t%s =l add %%asm_block, %d\n", temp, 8*i)
+		return temp
+	}
+	for i, op := range instr.Asm.Operands {
+		if op.In != nil { fmt.Fprintf(b.out, "\tstorel %s, %s\n", b.formatValue(op.In), slot(i)) }
+	}
+	fmt.Fprintf(b.out, "\tcall $%s(l %%asm_block)\n", name)
+	for i, op := range instr.Asm.Operands {
+		if op.Out != nil { fmt.Fprintf(b.out, "\t%s =l loadl %s\n", b.formatValue(op.Out), slot(i)) }
+	}
+}
+
+// asmHelper writes the helper that runs an `__asm__` statement on the block of its operands
+func (b *qbeBackend) asmHelper(name string, instr *ir.Instruction) string {
+	archName, _, _ := strings.Cut(b.target, "_")
+	arch := qbeAsmArchs[archName]
+	if arch == nil {
+		util.Error(instr.Pos, "'__asm__' statements are not supported on the QBE target '%s'", b.target)
+		return ""
+	}
+	asm := instr.Asm
+	clobbered := make(map[string]bool)
+	for _, clobber := range asm.Clobbers {
+		reg := strings.TrimPrefix(clobber, "%")
+		if alias, ok := arch.aliases[reg]; ok { reg = alias }
+		if archName == "arm64" && strings.HasPrefix(reg, "w") { reg = "x" + reg[1:] }
+		clobbered[reg] = true
+	}
+
+	// Every operand gets a register of its own, from those the statement does not clobber
+	var free []string
+	for _, reg := range arch.regs {
+		if !clobbered[reg] { free = append(free, reg) }
+	}
+	if len(asm.Operands) > len(free) {
+		util.Error(instr.Pos, "'__asm__' statement has %d operands, but only %d registers are free for them", len(asm.Operands), len(free))
+		return ""
+	}
+	regs := free[:len(asm.Operands)]
+	outputs := make(map[string]bool)
+	for i, op := range asm.Operands {
+		if op.Out != nil { outputs[regs[i]] = true }
+	}
+	// The block is reloaded after the statement into a register that holds no output
+	base := ""
+	for _, reg := range arch.regs {
+		if !outputs[reg] {
+			base = reg
+			break
+		}
+	}
+	if base == "" {
+		util.Error(instr.Pos, "'__asm__' statement has too many outputs")
+		return ""
+	}
+
+	var sb strings.Builder
+	symbol := name
+	if strings.HasSuffix(b.target, "_apple") { symbol = "_" + name }
+	fmt.Fprintf(&sb, "\n.text\n.p2align 2\n%s:\n", symbol)
+	var saved []string
+	for _, reg := range arch.saved {
+		if clobbered[reg] {
+			saved = append(saved, reg)
+			fmt.Fprintf(&sb, "\t%s\n", arch.push(reg))
+		}
+	}
+	block := arch.regs[len(arch.regs)-1]
+	fmt.Fprintf(&sb, "\t%s\n", arch.push(block))
+	// The operand given the register of the block is loaded last
+	last := -1
+	for i, op := range asm.Operands {
+		if op.In == nil { continue }
+		if regs[i] == block {
+			last = i
+			continue
+		}
+		fmt.Fprintf(&sb, "\t%s\n", arch.load(regs[i], block, 8*i))
+	}
+	if last >= 0 { fmt.Fprintf(&sb, "\t%s\n", arch.load(block, block, 8*last)) }
+
+	code := asm.Expand(func(n int) string { return arch.prefix + regs[n] }, func(s string) string { return s })
+	for _, line := range strings.Split(code, "\n") {
+		fmt.Fprintf(&sb, "\t%s\n", strings.TrimSpace(line))
+	}
+
+	fmt.Fprintf(&sb, "\t%s\n", arch.pop(base))
+	for i, op := range asm.Operands {
+		if op.Out != nil { fmt.Fprintf(&sb, "\t%s\n", arch.store(regs[i], base, 8*i)) }
+	}
+	for i := len(saved) - 1; i >= 0; i-- {
+		fmt.Fprintf(&sb, "\t%s\n", arch.pop(saved[i]))
+	}
+	sb.WriteString("\tret\n")
+	return sb.String()
+}
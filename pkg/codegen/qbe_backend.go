@@ -3,11 +3,14 @@ package codegen
 import (
 	"bytes"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/xplshn/gbc/pkg/ast"
 	"github.com/xplshn/gbc/pkg/config"
 	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/token"
+	"github.com/xplshn/gbc/pkg/util"
 	"modernc.org/libqbe"
 )
 
@@ -17,10 +20,29 @@ type qbeBackend struct{
 	currentFn   *ir.Func
 	structTypes map[string]bool
 	extCounter  int
+	debug       bool
+	lastLine    int
+	target      string
+	asmHelpers  []string // the helpers of the `__asm__` statements, see qbe_asm.go
+	asmBlock    int      // the size of the block the `__asm__` statements of currentFn spill to
 }
 
 func NewQBEBackend() Backend { return &qbeBackend{structTypes: make(map[string]bool)} }
 
+func init() {
+	Register(BackendInfo{
+		Name: "qbe", Description: "QBE, through modernc.org/libqbe (default)", New: NewQBEBackend,
+		Targets: []config.SubTarget{
+			{Name: "amd64_sysv", GOARCH: "amd64"}, {Name: "amd64_apple", GOOS: "darwin", GOARCH: "amd64"},
+			{Name: "arm64", GOARCH: "arm64"}, {Name: "arm64_apple", GOOS: "darwin", GOARCH: "arm64"},
+			{Name: "rv64", GOARCH: "riscv64"},
+		},
+		DefaultTarget: libqbe.DefaultTarget,
+		WordSizes:     []int{8},
+		Capabilities:  Capabilities{Floats: true, Asm: "gas", AsmStmt: true, Varargs: true, Libc: true},
+	})
+}
+
 func (b *qbeBackend) Generate(prog *ir.Program, cfg *config.Config) (*bytes.Buffer, error) {
 	qbeIR, err := b.GenerateIR(prog, cfg)
 	if err != nil { return nil, err }
@@ -28,6 +50,9 @@ func (b *qbeBackend) Generate(prog *ir.Program, cfg *config.Config) (*bytes.Buff
 	var asmBuf bytes.Buffer
 	err = libqbe.Main(cfg.BackendTarget, "input.ssa", strings.NewReader(qbeIR), &asmBuf, nil)
 	if err != nil { return nil, fmt.Errorf("\n--- QBE Compilation Failed ---\nGenerated IR:\n%s\n\nlibqbe error: %w", qbeIR, err) }
+	for _, helper := range b.asmHelpers {
+		asmBuf.WriteString(helper)
+	}
 	return &asmBuf, nil
 }
 
@@ -35,6 +60,9 @@ func (b *qbeBackend) GenerateIR(prog *ir.Program, cfg *config.Config) (string, e
 	var qbeIRBuilder strings.Builder
 	b.out = &qbeIRBuilder
 	b.prog = prog
+	b.debug = cfg.DebugInfo
+	b.target = cfg.BackendTarget
+	b.asmHelpers = nil
 
 	b.gen()
 
@@ -71,28 +99,42 @@ func (b *qbeBackend) gen() {
 	}
 }
 
+// formatFieldType is the QBE type of a member of an aggregate type, with the count of an array, false while it is
+// a struct or union not defined yet
 func (b *qbeBackend) formatFieldType(t *ast.BxType) (string, bool) {
+	t = b.prog.ResolveType(t)
 	if t == nil { return b.formatType(ir.GetType(nil, b.prog.WordSize)), true }
 	switch t.Kind {
-	case ast.TYPE_STRUCT:
-		if t.Name != "" {
-			if _, defined := b.structTypes[t.Name]; defined { return ":" + t.Name, true }
-		}
+	case ast.TYPE_STRUCT, ast.TYPE_UNION:
+		if b.structTypes[t.Name] { return ":" + t.Name, true }
 		return "", false
-	case ast.TYPE_POINTER, ast.TYPE_ARRAY: return b.formatType(ir.GetType(nil, b.prog.WordSize)), true
+	case ast.TYPE_SLICE: return b.formatFieldType(ast.SliceHeader)
+	case ast.TYPE_ARRAY:
+		count := int64(1)
+		for ; t != nil && t.Kind == ast.TYPE_ARRAY; t = b.prog.ResolveType(t.Base) {
+			if t.ArraySize == nil { return b.formatType(ir.GetType(nil, b.prog.WordSize)), true }
+			if n, ok := ast.FoldConstants(t.ArraySize).Data.(ast.NumberNode); ok { count *= n.Value }
+		}
+		elem, ok := b.formatFieldType(t)
+		return fmt.Sprintf("%s %d", elem, count), ok
+	case ast.TYPE_POINTER: return b.formatType(ir.GetType(nil, b.prog.WordSize)), true
 	default: return b.formatType(ir.GetType(t, b.prog.WordSize)), true
 	}
 }
 
+// genStructTypes defines the aggregate types of the structs and unions the program uses, each after those of its
+// members. A union has a member list per field, all starting at offset 0
 func (b *qbeBackend) genStructTypes() {
 	allStructs := make(map[string]*ast.BxType)
 
 	var collect func(t *ast.BxType)
 	collect = func(t *ast.BxType) {
+		t = b.prog.ResolveType(t)
 		if t == nil {
 			return
 		}
-		if t.Kind == ast.TYPE_STRUCT {
+		if t.Kind == ast.TYPE_SLICE { t = ast.SliceHeader }
+		if t.HasFields() {
 			if _, exists := allStructs[t.Name]; !exists && t.Name != "" {
 				allStructs[t.Name] = t
 				for _, f := range t.Fields {
@@ -109,6 +151,18 @@ func (b *qbeBackend) genStructTypes() {
 	}
 	for _, f := range b.prog.Funcs {
 		collect(f.AstReturnType)
+		if f.RetStruct != nil { collect(f.RetStruct.Type) }
+		for _, p := range f.Params {
+			if p.Struct != nil { collect(p.Struct.Type) }
+		}
+		for _, block := range f.Blocks {
+			for _, instr := range block.Instructions {
+				if instr.RetStruct != nil { collect(instr.RetStruct.Type) }
+				for _, s := range instr.ArgStructs {
+					if s != nil { collect(s.Type) }
+				}
+			}
+		}
 		if f.AstParams != nil {
 			for _, pNode := range f.AstParams {
 				if pNode.Type == ast.VarDecl {
@@ -153,10 +207,15 @@ func (b *qbeBackend) genStructTypes() {
 				fieldTypes = append(fieldTypes, typeStr)
 			}
 
-			if canDefine {
+			if !canDefine {
+				continue
+			}
+			if typ.Kind == ast.TYPE_UNION {
+				fmt.Fprintf(b.out, "type :%s = { { %s } }\n", name, strings.Join(fieldTypes, " } { "))
+			} else {
 				fmt.Fprintf(b.out, "type :%s = { %s }\n", name, strings.Join(fieldTypes, ", "))
-				b.structTypes[name] = true
 			}
+			b.structTypes[name] = true
 		}
 	}
 }
@@ -188,8 +247,8 @@ func (b *qbeBackend) genGlobal(g *ir.Data) {
 func (b *qbeBackend) genFunc(fn *ir.Func) {
 	b.currentFn = fn
 	var retTypeStr string
-	if fn.AstReturnType != nil && fn.AstReturnType.Kind == ast.TYPE_STRUCT {
-		retTypeStr = " :" + fn.AstReturnType.Name
+	if fn.RetStruct != nil {
+		retTypeStr = " " + b.aggregateType(fn.RetStruct, fn.Node.Tok)
 	} else {
 		retTypeStr = b.formatType(fn.ReturnType)
 		if retTypeStr != "" {
@@ -197,6 +256,12 @@ func (b *qbeBackend) genFunc(fn *ir.Func) {
 		}
 	}
 
+	if b.debug && fn.Node != nil {
+		if name := util.SourceFileName(fn.Node.Tok.FileIndex); name != "" {
+			fmt.Fprintf(b.out, "\ndbgfile %s", strconv.Quote(name))
+		}
+	}
+
 	fmt.Fprintf(b.out, "\nexport function%s $%s(", retTypeStr, fn.Name)
 
 	for i, p := range fn.Params {
@@ -204,7 +269,9 @@ func (b *qbeBackend) genFunc(fn *ir.Func) {
 		if paramType == ir.TypeB || paramType == ir.TypeH {
 			paramType = ir.GetType(nil, b.prog.WordSize)
 		}
-		fmt.Fprintf(b.out, "%s %s", b.formatType(paramType), b.formatValue(p.Val))
+		typeStr := b.formatType(paramType)
+		if p.Struct != nil { typeStr = b.aggregateType(p.Struct, fn.Node.Tok) }
+		fmt.Fprintf(b.out, "%s %s", typeStr, b.formatValue(p.Val))
 		if i < len(fn.Params)-1 {
 			b.out.WriteString(", ")
 		}
@@ -218,6 +285,7 @@ func (b *qbeBackend) genFunc(fn *ir.Func) {
 	}
 	b.out.WriteString(") {\n")
 
+	b.asmBlock = asmBlockSize(fn)
 	for _, block := range fn.Blocks {
 		b.genBlock(block)
 	}
@@ -227,17 +295,30 @@ func (b *qbeBackend) genFunc(fn *ir.Func) {
 
 func (b *qbeBackend) genBlock(block *ir.BasicBlock) {
 	fmt.Fprintf(b.out, "@%s\n", block.Label.Name)
+	b.lastLine = 0
+	if block == b.currentFn.Blocks[0] && b.asmBlock > 0 {
+		fmt.Fprintf(b.out, "\t%%asm_block =l alloc8 %d\n", b.asmBlock)
+	}
 	for _, instr := range block.Instructions {
 		b.genInstr(instr)
 	}
 }
 
 func (b *qbeBackend) genInstr(instr *ir.Instruction) {
+	if b.debug && instr.Op != ir.OpPhi && instr.Pos.Line > 0 && instr.Pos.Line != b.lastLine {
+		fmt.Fprintf(b.out, "\tdbgloc %d, %d\n", instr.Pos.Line, instr.Pos.Column)
+		b.lastLine = instr.Pos.Line
+	}
+
 	if instr.Op == ir.OpCall {
 		b.out.WriteString("\t")
 		b.genCall(instr)
 		return
 	}
+	if instr.Op == ir.OpAsm {
+		b.genAsm(instr)
+		return
+	}
 
 	// Handle special case for byte arithmetic operations
 	isArithmetic := (instr.Op >= ir.OpAdd && instr.Op <= ir.OpShr) || (instr.Op >= ir.OpAddF && instr.Op <= ir.OpNegF)
@@ -397,15 +478,11 @@ func (b *qbeBackend) isSubWordType(t ir.Type) bool {
 
 func (b *qbeBackend) genCall(instr *ir.Instruction) {
 	callee := instr.Args[0]
-	calleeName := ""
-	if g, ok := callee.(*ir.Global); ok {
-		calleeName = g.Name
-	}
 
 	// Pre-generate all needed extension instructions
 	var processedArgs []struct {
 		value      string
-		targetType ir.Type
+		targetType string
 	}
 
 	for i, arg := range instr.Args[1:] {
@@ -416,6 +493,13 @@ func (b *qbeBackend) genCall(instr *ir.Instruction) {
 
 		argValue := b.formatValue(arg)
 		targetType := argType
+		if i < len(instr.ArgStructs) && instr.ArgStructs[i] != nil {
+			processedArgs = append(processedArgs, struct {
+				value      string
+				targetType string
+			}{argValue, b.aggregateType(instr.ArgStructs[i], instr.Pos)})
+			continue
+		}
 
 		// Promote sub-word types to target word size and generate extension if needed
 		if b.isSubWordType(argType) {
@@ -444,16 +528,15 @@ func (b *qbeBackend) genCall(instr *ir.Instruction) {
 
 		processedArgs = append(processedArgs, struct {
 			value      string
-			targetType ir.Type
-		}{argValue, targetType})
+			targetType string
+		}{argValue, b.formatType(targetType)})
 	}
 
 	// Generate result assignment if needed
 	if instr.Result != nil {
 		var retTypeStr string
-		calledFunc := b.prog.FindFunc(calleeName)
-		if calledFunc != nil && calledFunc.AstReturnType != nil && calledFunc.AstReturnType.Kind == ast.TYPE_STRUCT {
-			retTypeStr = " :" + calledFunc.AstReturnType.Name
+		if instr.RetStruct != nil {
+			retTypeStr = b.aggregateType(instr.RetStruct, instr.Pos)
 		} else {
 			retTypeStr = b.formatType(instr.Typ)
 		}
@@ -468,11 +551,21 @@ func (b *qbeBackend) genCall(instr *ir.Instruction) {
 		if i > 0 {
 			b.out.WriteString(", ")
 		}
-		fmt.Fprintf(b.out, "%s %s", b.formatType(arg.targetType), arg.value)
+		// The varargs of a call through a pointer to a variadic function follow `...`
+		if sig := instr.Sig; sig != nil && sig.Variadic && i == len(sig.Params) { b.out.WriteString("..., ") }
+		fmt.Fprintf(b.out, "%s %s", arg.targetType, arg.value)
 	}
 	b.out.WriteString(")\n")
 }
 
+// aggregateType is the QBE type of a struct passed or returned by value, with which QBE follows the C ABI
+func (b *qbeBackend) aggregateType(s *ir.StructLayout, pos token.Token) string {
+	if !b.structTypes[s.Type.Name] {
+		util.Error(pos, "struct '%s' cannot be passed by value on QBE", s.Type.Name)
+	}
+	return ":" + s.Type.Name
+}
+
 func (b *qbeBackend) formatValue(v ir.Value) string {
 	if v == nil {
 		return ""
@@ -0,0 +1,138 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/token"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// Capabilities are what a backend can compile, for the driver to reject what it cannot before generating code
+type Capabilities struct {
+	Floats  bool   // floating-point values
+	Asm     string // the syntax of `__asm__` bodies, "" when the backend takes none
+	AsmStmt bool   // `__asm__` statements with operands inside functions
+	Varargs bool   // variadic functions and calls to variadic C functions, such as printf, with the C calling convention
+	Libc    bool   // programs link the C library; runtime checks otherwise need the stdio functions of libb
+	PIE     bool   // position independent executables
+}
+
+// BackendInfo describes a backend: how to make one, the targets it generates code for and what it can compile
+type BackendInfo struct {
+	Name        string
+	Description string
+	New         func() Backend
+	// Targets are the targets `-t name/target` can name; a backend with Triples takes any target triple as well
+	Targets []config.SubTarget
+	Triples bool
+	// DefaultTarget is the target when -t names none, "" to build a triple for the host
+	DefaultTarget func(hostOS, hostArch string) string
+	WordSizes     []int
+	Capabilities
+}
+
+var registry []*BackendInfo
+
+// Register adds a backend to those the driver knows of
+func Register(info BackendInfo) {
+	if _, ok := LookupBackend(info.Name); ok { panic(fmt.Sprintf("codegen: backend %s registered twice", info.Name)) }
+	registry = append(registry, &info)
+}
+
+// LookupBackend finds a registered backend by name
+func LookupBackend(name string) (*BackendInfo, bool) {
+	for _, info := range registry {
+		if info.Name == name { return info, true }
+	}
+	return nil, false
+}
+
+// Backends lists the registered backends, in the order they registered in
+func Backends() []*BackendInfo { return registry }
+
+// LookupTargets gives config.SetTarget what it needs to know of a backend
+func LookupTargets(name string) (config.BackendTargets, bool) {
+	info, ok := LookupBackend(name)
+	if !ok { return nil, false }
+	return info, true
+}
+
+func (b *BackendInfo) SubTargets() []config.SubTarget { return b.Targets }
+func (b *BackendInfo) TakesTriples() bool             { return b.Triples }
+
+func (b *BackendInfo) Default(hostOS, hostArch string) string {
+	if b.DefaultTarget == nil { return "" }
+	return b.DefaultTarget(hostOS, hostArch)
+}
+
+// Check rejects the settings of cfg that b cannot compile with, before anything is parsed
+func (b *BackendInfo) Check(cfg *config.Config) error {
+	for _, arg := range cfg.LinkerArgs {
+		if !b.PIE && (arg == "-pie" || arg == "-static-pie") {
+			return fmt.Errorf("the '%s' backend cannot build position independent executables (%s)", b.Name, arg)
+		}
+	}
+	return nil
+}
+
+// CheckProgram rejects the floating-point code, the `__asm__` functions and statements and the variadic functions
+// of a program for a backend without them, and the runtime checks it cannot report, before it generates any code
+func (b *BackendInfo) CheckProgram(cfg *config.Config, prog *ir.Program, inlineAsm string) {
+	if b.Asm == "" && strings.TrimSpace(inlineAsm) != "" {
+		util.Error(token.Token{}, "inline assembly is not supported by the '%s' backend", b.Name)
+	}
+	if !b.Libc { b.checkHooks(cfg, prog) }
+	if !b.Varargs { b.checkVarargs(prog) }
+	if b.Floats && b.AsmStmt { return }
+	for _, g := range prog.Globals {
+		for _, item := range g.Items {
+			if _, ok := item.Value.(*ir.FloatConst); (ok || isFloatIR(item.Typ)) && !b.Floats {
+				util.Error(token.Token{}, "floating-point data in '%s' is not supported by the '%s' backend", g.Name, b.Name)
+			}
+		}
+	}
+	for _, fn := range prog.Funcs {
+		for _, block := range fn.Blocks {
+			for _, instr := range block.Instructions {
+				if instr.Op == ir.OpAsm && !b.AsmStmt {
+					util.Error(instr.Pos, "'__asm__' statements are not supported by the '%s' backend", b.Name)
+				}
+				if b.Floats { continue }
+				float := isFloatIR(instr.Typ) || isFloatIR(instr.OperandType)
+				for _, arg := range instr.Args {
+					if _, ok := arg.(*ir.FloatConst); ok { float = true }
+				}
+				if float { util.Error(instr.Pos, "floating-point is not supported by the '%s' backend", b.Name) }
+			}
+		}
+	}
+}
+
+// checkHooks rejects, for a backend without a C library, the runtime checks of a program that does not define the
+// stdio functions their hooks print through, as libb does
+func (b *BackendInfo) checkHooks(cfg *config.Config, prog *ir.Program) {
+	for _, fn := range prog.Funcs {
+		hook, ok := runtimeHooks[fn.Name]
+		if !ok { continue }
+		for _, name := range hookStdio {
+			if !prog.Defines(name) {
+				util.Error(token.Token{}, "-F%s reports through '%s', which the '%s' backend has no C library for; link libb with -lb", cfg.Features[hook.feature].Name, name, b.Name)
+			}
+		}
+	}
+}
+
+// checkVarargs rejects, for a backend without C varargs, the functions of a program declared with `...`, which
+// could not read their varargs. The functions of libb take their arguments as words, so printf defined there is
+// called like any other function
+func (b *BackendInfo) checkVarargs(prog *ir.Program) {
+	for _, fn := range prog.Funcs {
+		if !fn.HasVarargs { continue }
+		var tok token.Token
+		if fn.Node != nil { tok = fn.Node.Tok }
+		util.Error(tok, "variadic function '%s' is not supported by the '%s' backend, which has no C varargs", fn.Name, b.Name)
+	}
+}
@@ -0,0 +1,246 @@
+package codegen
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/token"
+)
+
+// The 6502, uxn and gb backends lower the IR the same way: every temporary has a slot in the frame of its
+// function, every phi a shadow slot the edges into its block go through, and the routines the generated code
+// calls are written out once after the functions. retroBackend holds what they share; each of them embeds it
+// and emits its own instructions and data directives through retroTarget
+
+// retroRoutine is a runtime routine of a retro backend, and the routines it needs in turn
+type retroRoutine struct {
+	code string
+	uses []string
+}
+
+// retroTarget is what a retro backend emits for itself
+type retroTarget interface {
+	label(name string)
+	genBytes(data []byte)
+	genFill(size int64)
+	genAddr(name string) // a word holding the address of name
+	genBlockLabel(name string)
+	genInstr(block *ir.BasicBlock, instr *ir.Instruction)
+	genReturn(v ir.Value)
+	genPhiOut(phi *ir.Temporary, v ir.Value) // copies v to the shadow of phi
+	genPhiIn(phi *ir.Temporary)              // copies the shadow of phi to its slot
+	genJumpTo(block string)
+}
+
+type retroBackend struct {
+	target    retroTarget
+	name      string // of the backend, for errors
+	routines  map[string]retroRoutine
+	bigEndian bool
+
+	prog    *ir.Program
+	cfg     *config.Config
+	out     *strings.Builder
+	labels  int
+	runtime map[string]bool
+
+	// The function being lowered
+	fn      *ir.Func
+	slots   map[tempName]int64
+	temps   map[tempName]ir.Type
+	frame   map[*ir.Instruction]int64
+	phis    map[string][]*ir.Instruction
+	shadows map[tempName]int64
+	next    string // label of the block after the current one
+	pos     token.Token
+}
+
+// begin starts the output for prog, with the copies of its structs passed by value made, returning its main
+// function
+func (b *retroBackend) begin(prog *ir.Program, cfg *config.Config) (*ir.Func, error) {
+	if prog.WordSize != 2 { return nil, fmt.Errorf("the %s backend needs 2-byte words, not %d", b.name, prog.WordSize) }
+	if prog.FindFunc("main") == nil { return nil, fmt.Errorf("program has no main function") }
+
+	b.prog, b.cfg = copyStructs(prog), cfg
+	b.out = &strings.Builder{}
+	b.runtime = make(map[string]bool)
+	return b.prog.FindFunc("main"), nil
+}
+
+// beginFunc starts lowering fn
+func (b *retroBackend) beginFunc(fn *ir.Func) {
+	b.fn = fn
+	b.slots = make(map[tempName]int64)
+	b.temps = make(map[tempName]ir.Type)
+	b.frame = make(map[*ir.Instruction]int64)
+	b.phis = make(map[string][]*ir.Instruction)
+	b.shadows = make(map[tempName]int64)
+	b.pos = token.Token{}
+	if fn.Node != nil { b.pos = fn.Node.Tok }
+}
+
+func (b *retroBackend) ins(format string, args ...any) { fmt.Fprintf(b.out, "\t"+format+"\n", args...) }
+
+func (b *retroBackend) use(routine string) {
+	if b.runtime[routine] { return }
+	b.runtime[routine] = true
+	for _, dep := range b.routines[routine].uses {
+		b.use(dep)
+	}
+}
+
+func (b *retroBackend) genRuntime() {
+	names := make([]string, 0, len(b.runtime))
+	for name := range b.runtime {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.out.WriteString("\n" + b.routines[name].code)
+	}
+}
+
+func (b *retroBackend) genData() error {
+	b.genStrings()
+	if err := b.genGlobals(); err != nil { return err }
+	b.genExtrnVars()
+	return nil
+}
+
+func (b *retroBackend) genStrings() {
+	labels := make([]string, 0, len(b.prog.Strings))
+	values := make(map[string]string, len(b.prog.Strings))
+	for s, label := range b.prog.Strings {
+		labels = append(labels, label)
+		values[label] = s
+	}
+	sort.Strings(labels)
+	b.out.WriteString("\n")
+	for _, label := range labels {
+		b.target.label(label)
+		b.target.genBytes(append([]byte(values[label]), 0))
+	}
+}
+
+func (b *retroBackend) genGlobals() error {
+	for _, g := range b.prog.Globals {
+		b.target.label(g.Name)
+		for _, item := range g.Items {
+			size := b.itemSize(item)
+			if item.Count > 0 {
+				b.target.genFill(size)
+				continue
+			}
+			switch v := item.Value.(type) {
+			case *ir.Const:
+				data := make([]byte, size)
+				for i := range data {
+					shift := i
+					if b.bigEndian { shift = int(size) - 1 - i }
+					data[i] = byte(v.Value >> (8 * min(shift, 7)))
+				}
+				b.target.genBytes(data)
+			case *ir.Global:
+				b.target.genAddr(v.Name)
+				if size > 2 { b.target.genFill(size - 2) }
+			case *ir.FloatConst: return fmt.Errorf("floating-point data in '%s' is not supported by the %s backend", g.Name, b.name)
+			default: b.target.genFill(size)
+			}
+		}
+	}
+	return nil
+}
+
+// genExtrnVars defines the extrn variables neither the program nor the backend, in own, defines
+func (b *retroBackend) genExtrnVars(own ...string) {
+	var vars []string
+	for name := range b.prog.ExtrnVars {
+		if b.prog.Defines(name) || slices.Contains(own, name) { continue }
+		vars = append(vars, name)
+	}
+	sort.Strings(vars)
+	for _, name := range vars {
+		// extrn variables the program does not define have nothing to bind to, and start out as 0
+		b.target.label(name)
+		b.target.genBytes([]byte{0, 0})
+	}
+}
+
+func (b *retroBackend) itemSize(item ir.DataItem) int64 {
+	if item.Count > 0 {
+		if item.Typ == ir.TypeB { return int64(item.Count) }
+		return int64(item.Count) * ir.SizeOfType(item.Typ, b.prog.WordSize)
+	}
+	return ir.SizeOfType(item.Typ, b.prog.WordSize)
+}
+
+// width is the size in bytes of values of type t
+func (b *retroBackend) width(t ir.Type) int {
+	if t == ir.TypeNone { return b.prog.WordSize }
+	return int(ir.SizeOfType(t, b.prog.WordSize))
+}
+
+// signedType tells whether a temporary of type t extends with its sign when read wider than its slot
+func signedType(t ir.Type) bool {
+	return t != ir.TypeB && t != ir.TypeUB && t != ir.TypeUH && t != ir.TypePtr
+}
+
+func (b *retroBackend) typeOf(v ir.Value) ir.Type {
+	switch val := v.(type) {
+	case *ir.Temporary:
+		if t, ok := b.temps[tempName{val.Name, val.ID}]; ok { return t }
+	case *ir.FloatConst: return ir.TypeD
+	case *ir.Global: return ir.TypePtr
+	case *ir.CastValue: return b.typeOf(val.Value)
+	}
+	return ir.TypeNone
+}
+
+// genBlocks lowers the blocks of the function
+func (b *retroBackend) genBlocks() {
+	for k, block := range b.fn.Blocks {
+		b.next = ""
+		if k+1 < len(b.fn.Blocks) { b.next = b.fn.Blocks[k+1].Label.Name }
+		b.target.genBlockLabel(block.Label.Name)
+		terminated := false
+		for _, instr := range block.Instructions {
+			if instr.Op == ir.OpPhi { continue }
+			b.target.genInstr(block, instr)
+			if instr.Op == ir.OpJmp || instr.Op == ir.OpJnz || instr.Op == ir.OpRet {
+				terminated = true
+				break
+			}
+		}
+		// A block without a jump falls through to the next, or returns from the last
+		if !terminated {
+			if b.next != "" {
+				b.genJump(block, b.next, true)
+			} else {
+				b.target.genReturn(nil)
+			}
+		}
+	}
+}
+
+// genJump goes from block from to the block labelled to, after copying the values its phis take on the edge
+// through their shadows, so that phis reading each other see the values from before the edge
+func (b *retroBackend) genJump(from *ir.BasicBlock, to string, last bool) {
+	phis := b.phis[to]
+	for _, phi := range phis {
+		for i := 0; i+1 < len(phi.Args); i += 2 {
+			if phi.Args[i].String() == from.Label.Name {
+				b.target.genPhiOut(phi.Result.(*ir.Temporary), phi.Args[i+1])
+				break
+			}
+		}
+	}
+	for _, phi := range phis {
+		b.target.genPhiIn(phi.Result.(*ir.Temporary))
+	}
+	if last && to == b.next { return }
+	b.target.genJumpTo(to)
+}
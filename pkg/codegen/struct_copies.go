@@ -0,0 +1,94 @@
+package codegen
+
+import (
+	"slices"
+
+	"github.com/xplshn/gbc/pkg/ir"
+)
+
+// The wasm, 6502, uxn and gb backends pass a struct by value as its address, as the IR does, with nothing of the
+// C calling convention to copy it. copyStructs makes those copies in the IR they lower instead: a caller passes
+// the address of a copy of every struct argument in its own frame, so that the callee cannot change the original,
+// and copies a struct returned into its frame before another call reuses the frame of the callee
+
+// copyStructs returns prog with the copies made around its calls, leaving prog as it is
+func copyStructs(prog *ir.Program) *ir.Program {
+	copied := *prog
+	copied.Funcs = make([]*ir.Func, len(prog.Funcs))
+	for i, fn := range prog.Funcs {
+		copied.Funcs[i] = copyFuncStructs(fn, prog.WordSize)
+	}
+	return &copied
+}
+
+func copyFuncStructs(fn *ir.Func, wordSize int) *ir.Func {
+	if !passesStructs(fn) { return fn }
+
+	// The temporaries of the copies are numbered after every one of fn
+	next := 0
+	number := func(v ir.Value) {
+		if tmp, ok := v.(*ir.Temporary); ok && tmp != nil { next = max(next, tmp.ID+1) }
+	}
+	for _, p := range fn.Params {
+		number(p.Val)
+	}
+	for _, block := range fn.Blocks {
+		for _, instr := range block.Instructions {
+			number(instr.Result)
+		}
+	}
+	newTemp := func() *ir.Temporary {
+		next++
+		return &ir.Temporary{ID: next - 1}
+	}
+
+	// genCopy copies the struct at src into a new slot of the frame, whose address is dst
+	var instrs []*ir.Instruction
+	genCopy := func(pos *ir.Instruction, s *ir.StructLayout, typ ir.Type, src ir.Value, dst *ir.Temporary) {
+		size := &ir.Const{Value: s.Size}
+		instrs = append(instrs,
+			&ir.Instruction{Op: ir.OpAlloc, Typ: typ, Result: dst, Args: []ir.Value{size}, Align: int(s.Align), Pos: pos.Pos},
+			&ir.Instruction{Op: ir.OpBlit, Args: []ir.Value{src, dst, size}, Pos: pos.Pos})
+	}
+
+	copied := *fn
+	copied.Blocks = make([]*ir.BasicBlock, len(fn.Blocks))
+	for i, block := range fn.Blocks {
+		instrs = nil
+		for _, instr := range block.Instructions {
+			if instr.Op != ir.OpCall || !callPassesStructs(instr) {
+				instrs = append(instrs, instr)
+				continue
+			}
+			call := *instr
+			call.Args = slices.Clone(instr.Args)
+			call.ArgStructs, call.RetStruct = nil, nil
+			for k, s := range instr.ArgStructs {
+				if s == nil { continue }
+				arg := newTemp()
+				genCopy(instr, s, ir.GetType(nil, wordSize), instr.Args[k+1], arg)
+				call.Args[k+1] = arg
+			}
+			instrs = append(instrs, &call)
+			if s, ret := instr.RetStruct, instr.Result; s != nil && ret != nil {
+				call.Result = newTemp()
+				genCopy(instr, s, instr.Typ, call.Result, ret.(*ir.Temporary))
+			}
+		}
+		copied.Blocks[i] = &ir.BasicBlock{Label: block.Label, Instructions: instrs}
+	}
+	return &copied
+}
+
+func passesStructs(fn *ir.Func) bool {
+	for _, block := range fn.Blocks {
+		for _, instr := range block.Instructions {
+			if instr.Op == ir.OpCall && callPassesStructs(instr) { return true }
+		}
+	}
+	return false
+}
+
+func callPassesStructs(instr *ir.Instruction) bool {
+	return instr.RetStruct != nil || slices.ContainsFunc(instr.ArgStructs, func(s *ir.StructLayout) bool { return s != nil })
+}
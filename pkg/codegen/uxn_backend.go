@@ -0,0 +1,469 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// The uxn backend lowers the IR to Uxntal for the Uxn virtual machine, which cmd/gbc assembles with pkg/uxn into
+// a ROM for Varvara. Words are 16 bits, the width of a short on the Uxn stacks, and functions follow the
+// convention of the `__asm__` functions of lib/b/uxn.b: JSR2 calls them with the arguments in the zero page from
+// __args, where they leave the result, and they return with JMP2r
+// Every temporary is a short in the frame of its function, on a software stack growing down from the top of
+// memory; an operation pushes its operands from the frame, applies the opcode and stores the result back
+
+const uxnHeader = `|00 $2 ( a vector returning with JMP2r on an empty return stack lands on this BRK )
+|02 @__sp $2
+|04 @__args ( arguments and results, shared with lib/b/uxn.b )
+|fe @__fp $2
+`
+
+// uxnMaxArgs is how many arguments fit in the zero page between __args and __fp
+const uxnMaxArgs = (0xFE - 0x04) / 2
+
+// uxnRuntime holds the routines the generated code calls, and the routines each of them needs in turn
+var uxnRuntime = map[string]retroRoutine{
+	"__abs": {code: `@__abs ( a* -- |a|* )
+	DUP2 #8000 LTH2 ?&done
+	#0000 SWP2 SUB2
+	&done JMP2r
+`},
+	// Division truncating towards zero, from that of unsigned numbers
+	"__div": {uses: []string{"__abs"}, code: `@__div ( a* b* -- a/b* )
+	OVR2 OVR2 EOR2 STH2
+	;__abs JSR2 SWP2 ;__abs JSR2 SWP2 DIV2
+	STH2r #8000 LTH2 ?&done
+	#0000 SWP2 SUB2
+	&done JMP2r
+`},
+	"__rem": {uses: []string{"__abs"}, code: `@__rem ( a* b* -- a%b* )
+	OVR2 STH2
+	;__abs JSR2 SWP2 ;__abs JSR2 SWP2
+	OVR2 OVR2 DIV2 MUL2 SUB2
+	STH2r #8000 LTH2 ?&done
+	#0000 SWP2 SUB2
+	&done JMP2r
+`},
+	"__blit": {code: `@__blit ( src* dst* n* -- )
+	&loop
+	ORAk ?&byte
+	POP2 POP2 POP2 JMP2r
+	&byte
+	#0001 SUB2 STH2
+	SWP2 LDAk STH INC2 SWP2 STHr
+	ROT ROT STAk ROT POP INC2
+	STH2r !&loop
+`},
+}
+
+type uxnBackend struct{ retroBackend }
+
+func NewUxnBackend() Backend {
+	b := &uxnBackend{}
+	// Uxn stores shorts big-endian
+	b.retroBackend = retroBackend{target: b, name: "uxn", routines: uxnRuntime, bigEndian: true}
+	return b
+}
+
+func init() {
+	Register(BackendInfo{
+		Name: "uxn", Description: "a Uxn ROM for the Varvara computer", New: NewUxnBackend,
+		Targets:       []config.SubTarget{{Name: "uxn-unknown-varvara", GOOS: "varvara", GOARCH: "uxn"}},
+		DefaultTarget: func(string, string) string { return "uxn-unknown-varvara" },
+		WordSizes:     []int{2},
+		Capabilities:  Capabilities{Asm: "uxntal"},
+	})
+}
+
+func (b *uxnBackend) Generate(prog *ir.Program, cfg *config.Config) (*bytes.Buffer, error) {
+	text, err := b.GenerateIR(prog, cfg)
+	if err != nil { return nil, err }
+	return bytes.NewBufferString(text), nil
+}
+
+// GenerateIR writes the Uxntal, which is all the uxn backend has to show
+func (b *uxnBackend) GenerateIR(prog *ir.Program, cfg *config.Config) (string, error) {
+	if _, err := b.begin(prog, cfg); err != nil { return "", err }
+
+	b.out.WriteString("( Generated by gbc for Uxn )\n\n")
+	b.out.WriteString(uxnHeader)
+	b.genStart()
+	for _, fn := range b.prog.Funcs {
+		if err := b.genFunc(fn); err != nil { return "", err }
+	}
+	b.genRuntime()
+	if err := b.genData(); err != nil { return "", err }
+	return b.out.String(), nil
+}
+
+func (b *uxnBackend) label(name string) { fmt.Fprintf(b.out, "@%s\n", name) }
+
+func (b *uxnBackend) newLabel() string {
+	b.labels++
+	return fmt.Sprintf(".%d", b.labels)
+}
+
+// genStart sets up the software stack and hands over to the _start of lib/b/uxn.b, which reads the arguments
+// from the console before calling main; without it, main runs with no arguments and its result is the status
+func (b *uxnBackend) genStart() {
+	b.out.WriteString("\n|0100\n@__start\n")
+	b.ins("#0000 .__sp STZ2")
+	if b.prog.FindFunc("_start") != nil {
+		b.ins(";_start JSR2")
+	} else {
+		b.ins(";main JSR2")
+		b.ins(".__args LDZ2 NIP #80 ORA #0f DEO")
+	}
+	b.ins("BRK")
+}
+
+func (b *uxnBackend) genBytes(data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), 16)
+		parts := make([]string, n)
+		for i, c := range data[:n] {
+			parts[i] = fmt.Sprintf("%02x", c)
+		}
+		b.ins("%s", strings.Join(parts, " "))
+		data = data[n:]
+	}
+}
+
+func (b *uxnBackend) genFill(size int64) { b.ins("$%x", size) }
+
+func (b *uxnBackend) genAddr(name string) { b.ins("=%s", name) }
+
+// check rejects values the uxn backend has no room for on its 16-bit stacks
+func (b *uxnBackend) check(t ir.Type) {
+	switch {
+	case isFloatIR(t): util.Error(b.pos, "floating-point is not supported by the uxn backend")
+	case b.width(t) > 2: util.Error(b.pos, "integers wider than 16 bits are not supported by the uxn backend")
+	}
+}
+
+// slot pushes the address of the frame slot at off
+func (b *uxnBackend) slot(off int64) {
+	if off == 0 {
+		b.ins(".__fp LDZ2")
+		return
+	}
+	b.ins(".__fp LDZ2 #%04x ADD2", uint16(off))
+}
+
+// push pushes v as a short
+func (b *uxnBackend) push(v ir.Value) {
+	switch val := v.(type) {
+	case *ir.Const: b.ins("#%04x", uint16(val.Value))
+	case *ir.Global: b.ins(";%s", val.Name)
+	case *ir.CastValue: b.push(val.Value)
+	case *ir.FloatConst: util.Error(b.pos, "floating-point is not supported by the uxn backend")
+	case *ir.Temporary:
+		if off, ok := b.slots[tempName{val.Name, val.ID}]; ok {
+			b.slot(off)
+			b.ins("LDA2")
+			return
+		}
+		b.ins("#0000")
+	default: b.ins("#0000")
+	}
+}
+
+// extend makes the short on the stack a value of type t, extending its low byte if t is a byte
+func (b *uxnBackend) extend(t ir.Type) {
+	if b.width(t) != 1 { return }
+	if signedType(t) {
+		b.ins("NIP DUP #07 SFT #ff MUL SWP")
+	} else {
+		b.ins("#00ff AND2")
+	}
+}
+
+// pop stores the short on the stack in the slot of the temporary r, or drops it
+func (b *uxnBackend) pop(r ir.Value) {
+	tmp, ok := r.(*ir.Temporary)
+	if !ok || tmp == nil {
+		b.ins("POP2")
+		return
+	}
+	off, ok := b.slots[tempName{tmp.Name, tmp.ID}]
+	if !ok {
+		b.ins("POP2")
+		return
+	}
+	b.slot(off)
+	b.ins("STA2")
+}
+
+func (b *uxnBackend) genFunc(fn *ir.Func) error {
+	b.beginFunc(fn)
+	if len(fn.Params) > uxnMaxArgs { return fmt.Errorf("function '%s' has more than %d parameters", fn.Name, uxnMaxArgs) }
+
+	// The saved frame pointer, then the temporaries, then the autos
+	end := int64(2)
+	define := func(v ir.Value, t ir.Type) {
+		tmp, ok := v.(*ir.Temporary)
+		if !ok || tmp == nil { return }
+		key := tempName{tmp.Name, tmp.ID}
+		if _, defined := b.slots[key]; defined { return }
+		b.check(t)
+		b.temps[key] = t
+		b.slots[key] = end
+		end += 2
+	}
+	for _, p := range fn.Params {
+		define(p.Val, p.Typ)
+	}
+	for _, block := range fn.Blocks {
+		for _, instr := range block.Instructions {
+			b.pos = instr.Pos
+			define(instr.Result, resultType(instr, b.prog.WordSize))
+			if instr.Op == ir.OpPhi {
+				tmp := instr.Result.(*ir.Temporary)
+				b.phis[block.Label.Name] = append(b.phis[block.Label.Name], instr)
+				b.shadows[tempName{tmp.Name, tmp.ID}] = end
+				end += 2
+			}
+		}
+	}
+	for _, block := range fn.Blocks {
+		for _, instr := range block.Instructions {
+			if instr.Op != ir.OpAlloc { continue }
+			if size, ok := instr.Args[0].(*ir.Const); ok {
+				b.frame[instr] = end
+				end += size.Value
+			}
+		}
+	}
+	if end > 0xFFFF { return fmt.Errorf("the frame of '%s' is larger than 64 KiB", fn.Name) }
+
+	b.out.WriteString("\n")
+	b.label(fn.Name)
+	b.genPrologue(end)
+	b.genBlocks()
+	b.genEpilogue(end)
+	return nil
+}
+
+func (b *uxnBackend) genBlockLabel(name string) { b.ins("&%s", name) }
+
+// genPrologue pushes a frame of size bytes on the software stack, saving the frame pointer of the caller in its
+// first short, and copies the parameters from the zero page to their slots
+func (b *uxnBackend) genPrologue(size int64) {
+	b.ins(".__sp LDZ2 #%04x SUB2", uint16(size))
+	b.ins(".__fp LDZ2 OVR2 STA2")
+	b.ins("DUP2 .__sp STZ2 .__fp STZ2")
+	for k, p := range b.fn.Params {
+		b.ins("#%02x LDZ2", 4+2*k)
+		b.extend(p.Typ)
+		b.pop(p.Val)
+	}
+}
+
+// genEpilogue pops the frame, and any autos allocated since, and returns to the caller with the result in __args
+func (b *uxnBackend) genEpilogue(size int64) {
+	b.ins("&.ret")
+	b.ins(".__fp LDZ2 DUP2 #%04x ADD2 .__sp STZ2", uint16(size))
+	b.ins("LDA2 .__fp STZ2")
+	b.ins("JMP2r")
+}
+
+func (b *uxnBackend) genReturn(v ir.Value) {
+	if v == nil || b.fn.ReturnType == ir.TypeNone {
+		b.ins("#0000")
+	} else {
+		b.push(v)
+	}
+	b.ins(".__args STZ2")
+	b.ins("!&.ret")
+}
+
+func (b *uxnBackend) genPhiOut(phi *ir.Temporary, v ir.Value) {
+	b.push(v)
+	b.slot(b.shadows[tempName{phi.Name, phi.ID}])
+	b.ins("STA2")
+}
+
+func (b *uxnBackend) genPhiIn(phi *ir.Temporary) {
+	b.slot(b.shadows[tempName{phi.Name, phi.ID}])
+	b.ins("LDA2")
+	b.pop(phi)
+}
+
+func (b *uxnBackend) genJumpTo(block string) { b.ins("!&%s", block) }
+
+var uxnArith = map[ir.Op]string{
+	ir.OpAdd: "ADD2", ir.OpSub: "SUB2", ir.OpMul: "MUL2", ir.OpAnd: "AND2", ir.OpOr: "ORA2", ir.OpXor: "EOR2",
+	// Shift amounts are a byte, the right shift in its low nibble and the left one in its high nibble
+	ir.OpShl: "NIP #40 SFT SFT2", ir.OpShr: "NIP #0f AND SFT2",
+	ir.OpDiv: ";__div JSR2", ir.OpRem: ";__rem JSR2",
+}
+
+func (b *uxnBackend) genInstr(block *ir.BasicBlock, instr *ir.Instruction) {
+	args, typ := instr.Args, instr.Typ
+	b.pos = instr.Pos
+	switch instr.Op {
+	case ir.OpJmp: b.genJump(block, args[0].String(), true)
+	case ir.OpJnz:
+		if c, ok := args[0].(*ir.Const); ok {
+			to := args[2].String()
+			if c.Value != 0 { to = args[1].String() }
+			b.genJump(block, to, true)
+			return
+		}
+		then := b.newLabel()
+		b.push(args[0])
+		b.ins("ORA ?&%s", then)
+		b.genJump(block, args[2].String(), false)
+		b.ins("&%s", then)
+		b.genJump(block, args[1].String(), true)
+	case ir.OpRet:
+		var v ir.Value
+		if len(args) > 0 { v = args[0] }
+		b.genReturn(v)
+
+	case ir.OpAlloc:
+		if off, ok := b.frame[instr]; ok {
+			b.slot(off)
+		} else {
+			b.ins(".__sp LDZ2")
+			b.push(args[0])
+			b.ins("SUB2 DUP2 .__sp STZ2")
+		}
+		b.pop(instr.Result)
+	case ir.OpLoad:
+		b.check(typ)
+		b.push(args[0])
+		if b.width(typ) == 1 {
+			b.ins("LDA #00 SWP")
+			b.extend(typ)
+		} else {
+			b.ins("LDA2")
+		}
+		b.pop(instr.Result)
+	case ir.OpStore:
+		b.check(typ)
+		b.push(args[0])
+		if b.width(typ) == 1 { b.ins("NIP") }
+		b.push(args[1])
+		if b.width(typ) == 1 {
+			b.ins("STA")
+		} else {
+			b.ins("STA2")
+		}
+	case ir.OpBlit:
+		b.push(args[0])
+		b.push(args[1])
+		if len(args) > 2 {
+			b.push(args[2])
+		} else {
+			b.push(&ir.Const{Value: ir.SizeOfType(typ, b.prog.WordSize)})
+		}
+		b.use("__blit")
+		b.ins(";__blit JSR2")
+	case ir.OpCall: b.genCall(instr)
+
+	case ir.OpAdd, ir.OpSub, ir.OpMul, ir.OpDiv, ir.OpRem, ir.OpAnd, ir.OpOr, ir.OpXor, ir.OpShl, ir.OpShr:
+		b.check(typ)
+		b.push(args[0])
+		b.push(args[1])
+		switch instr.Op {
+		case ir.OpDiv: b.use("__div")
+		case ir.OpRem: b.use("__rem")
+		}
+		b.ins("%s", uxnArith[instr.Op])
+		b.extend(typ)
+		b.pop(instr.Result)
+
+	case ir.OpCEq, ir.OpCNeq, ir.OpCLt, ir.OpCGt, ir.OpCLe, ir.OpCGe:
+		if t := instr.OperandType; t != ir.TypeNone { b.check(t) }
+		// Signed order is the unsigned order of the numbers with their sign bits flipped
+		signed := instr.Op != ir.OpCEq && instr.Op != ir.OpCNeq
+		for _, arg := range args[:2] {
+			b.push(arg)
+			if signed { b.ins("#8000 EOR2") }
+		}
+		b.ins("%s", map[ir.Op]string{
+			ir.OpCEq: "EQU2", ir.OpCNeq: "NEQ2", ir.OpCLt: "LTH2", ir.OpCGt: "GTH2", ir.OpCLe: "GTH2 #01 EOR", ir.OpCGe: "LTH2 #01 EOR",
+		}[instr.Op])
+		b.ins("#00 SWP")
+		b.pop(instr.Result)
+
+	case ir.OpExtSB, ir.OpExtUB:
+		b.push(args[0])
+		b.extend(map[ir.Op]ir.Type{ir.OpExtSB: ir.TypeSB, ir.OpExtUB: ir.TypeUB}[instr.Op])
+		b.pop(instr.Result)
+	case ir.OpExtSH, ir.OpExtUH, ir.OpExtSW, ir.OpExtUW, ir.OpTrunc, ir.OpCast:
+		b.check(typ)
+		b.push(args[0])
+		b.extend(typ)
+		b.pop(instr.Result)
+
+	case ir.OpAddF, ir.OpSubF, ir.OpMulF, ir.OpDivF, ir.OpRemF, ir.OpNegF, ir.OpFToSI, ir.OpFToUI,
+		ir.OpSWToF, ir.OpUWToF, ir.OpSLToF, ir.OpULToF, ir.OpFToF:
+		util.Error(instr.Pos, "floating-point is not supported by the uxn backend")
+	default:
+		util.Error(instr.Pos, "internal: uxn backend cannot lower IR operation %d", instr.Op)
+	}
+}
+
+// genCall stores the arguments in the zero page from __args and calls the callee with JSR2, pushing its address
+// from a temporary when it is not a label or a constant
+func (b *uxnBackend) genCall(instr *ir.Instruction) {
+	args := instr.Args[1:]
+	if len(args) > uxnMaxArgs { util.Error(instr.Pos, "the uxn backend passes at most %d arguments", uxnMaxArgs) }
+	for k, arg := range args {
+		if t := b.typeOf(arg); isFloatIR(t) || k < len(instr.ArgTypes) && isFloatIR(instr.ArgTypes[k]) {
+			util.Error(instr.Pos, "floating-point is not supported by the uxn backend")
+		}
+		b.push(arg)
+		b.ins("#%02x STZ2", 4+2*k)
+	}
+	switch val := instr.Args[0].(type) {
+	case *ir.Global: b.ins(";%s JSR2", val.Name)
+	default:
+		b.push(instr.Args[0])
+		b.ins("JSR2")
+	}
+	if instr.Result != nil {
+		b.ins(".__args LDZ2")
+		if b.width(instr.Typ) == 1 { b.extend(instr.Typ) }
+		b.pop(instr.Result)
+	}
+}
+
+// UxnInlineAsm rewrites the `__asm__` functions codegen collected, whose instructions are written in the style
+// of lib/b/uxn.b such as "lit 4" and "ldz2", as Uxntal to assemble after the output of the uxn backend
+func UxnInlineAsm(asm string) (string, error) {
+	var out strings.Builder
+	for _, line := range strings.Split(asm, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0 || fields[0] == ".globl":
+		case len(fields) == 1 && strings.HasSuffix(fields[0], ":"): fmt.Fprintf(&out, "\n@%s\n", strings.TrimSuffix(fields[0], ":"))
+		default:
+			mn := strings.ToLower(fields[0])
+			if len(mn) < 3 { return "", fmt.Errorf("bad Uxn instruction '%s'", line) }
+			// The opcode is upper case in Uxntal, and its modes lower case
+			mn = strings.ToUpper(mn[:3]) + mn[3:]
+			switch {
+			case len(fields) == 1: fmt.Fprintf(&out, "\t%s\n", mn)
+			case len(fields) == 2 && mn[:3] == "LIT":
+				n, err := strconv.ParseInt(fields[1], 0, 32)
+				if err != nil { return "", fmt.Errorf("bad operand in Uxn instruction '%s'", line) }
+				if strings.Contains(mn, "2") {
+					fmt.Fprintf(&out, "\t%s %04x\n", mn, uint16(n))
+				} else {
+					fmt.Fprintf(&out, "\t%s %02x\n", mn, byte(n))
+				}
+			default: return "", fmt.Errorf("bad Uxn instruction '%s': only lit takes an operand", line)
+			}
+		}
+	}
+	return out.String(), nil
+}
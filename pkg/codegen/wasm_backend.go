@@ -0,0 +1,1167 @@
+package codegen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/util"
+	"github.com/xplshn/gbc/pkg/wasm"
+)
+
+// The wasm backend lowers the IR to a WebAssembly module run through WASI: words are i64 and addresses are
+// offsets into linear memory, which holds the data, then the stack of autos, then the heap grown by sbrk
+// Blocks become the arms of a br_table in a loop, which a jump re-enters with the index of its target
+// putchar, getchar, exit, read, write and sbrk are defined by the module on top of WASI, along with __exit,
+// __write and __sbrk, which lib/b/wasm_wasi.b builds the rest of libb on whatever the program calls its own
+// Any other function the program leaves undefined is imported from "env"
+
+const (
+	wasmIovec     = 16 // scratch iovec, count and byte buffer of the runtime functions
+	wasmCount     = 24
+	wasmAux       = 32
+	wasmByte      = 40
+	wasmDataBase  = 1024
+	wasmStackSize = 8 << 20
+
+	wasmGlobalSP   = 0
+	wasmGlobalHeap = 1
+)
+
+var wasiImports = []struct {
+	name   string
+	params int
+}{{"fd_write", 4}, {"fd_read", 4}, {"proc_exit", 1}, {"args_sizes_get", 2}, {"args_get", 2}}
+
+// wasmBuiltins are the runtime functions the module defines when the program uses them without defining them
+var wasmBuiltins = map[string]func(b *wasmBackend){
+	"putchar": (*wasmBackend).genPutchar,
+	"getchar": (*wasmBackend).genGetchar,
+	"exit":    (*wasmBackend).genExit,
+	"write":   func(b *wasmBackend) { b.genTransfer("fd_write") },
+	"read":    func(b *wasmBackend) { b.genTransfer("fd_read") },
+	"sbrk":    (*wasmBackend).genSbrk,
+	"__exit":  (*wasmBackend).genExit,
+	"__write": func(b *wasmBackend) { b.genTransfer("fd_write") },
+	"__sbrk":  (*wasmBackend).genSbrk,
+}
+
+var wasmBuiltinParams = map[string]int{
+	"putchar": 1, "getchar": 0, "exit": 1, "write": 3, "read": 3, "sbrk": 1, "__exit": 1, "__write": 3, "__sbrk": 1,
+}
+
+type wasmBackend struct {
+	prog      *ir.Program
+	cfg       *config.Config
+	mod       *wasm.Module
+	funcs     map[string]uint32 // index of every function by name
+	sigs      map[string]wasm.FuncType
+	addrs     map[string]int64 // addresses of strings, data and extrn variables
+	slots     map[string]int64 // table slots of the functions whose address is taken
+	builtins  []string
+	thunks    []string
+	arity     int // parameters of every call through the table
+	stackBase int64
+
+	// The function being lowered
+	fn         *ir.Func
+	code       []wasm.Instr
+	locals     map[tempName]uint32
+	params     []wasm.ValType
+	localTypes []wasm.ValType
+	temps      map[tempName]ir.Type
+	phis       map[string][]*ir.Instruction
+	shadows    map[tempName]uint32
+	blocks     map[string]int
+	frame      map[*ir.Instruction]int64
+	pc, fp, sp uint32
+}
+
+func NewWasmBackend() Backend { return &wasmBackend{} }
+
+func init() {
+	Register(BackendInfo{
+		Name: "wasm", Description: "a WebAssembly module for WASI", New: NewWasmBackend,
+		Targets:       []config.SubTarget{{Name: "wasm32-unknown-wasi", GOOS: "wasi", GOARCH: "wasm"}},
+		DefaultTarget: func(string, string) string { return "wasm32-unknown-wasi" },
+		WordSizes:     []int{8},
+		Capabilities:  Capabilities{Floats: true},
+	})
+}
+
+func (b *wasmBackend) Generate(prog *ir.Program, cfg *config.Config) (*bytes.Buffer, error) {
+	if err := b.build(prog, cfg); err != nil { return nil, err }
+	return bytes.NewBuffer(b.mod.Encode()), nil
+}
+
+func (b *wasmBackend) GenerateIR(prog *ir.Program, cfg *config.Config) (string, error) {
+	if err := b.build(prog, cfg); err != nil { return "", err }
+	var sb strings.Builder
+	if err := b.mod.WriteWAT(&sb); err != nil { return "", err }
+	return sb.String(), nil
+}
+
+func (b *wasmBackend) build(prog *ir.Program, cfg *config.Config) error {
+	if prog.WordSize != 8 { return fmt.Errorf("the wasm backend needs 8-byte words, not %d", prog.WordSize) }
+	main := prog.FindFunc("main")
+	if main == nil { return fmt.Errorf("program has no main function") }
+
+	prog = copyStructs(prog)
+	main = prog.FindFunc("main")
+	b.prog, b.cfg = prog, cfg
+	b.mod = &wasm.Module{}
+	b.funcs = make(map[string]uint32)
+	b.sigs = make(map[string]wasm.FuncType)
+	b.addrs = make(map[string]int64)
+	b.slots = make(map[string]int64)
+	b.builtins = nil
+
+	b.declareFuncs(main)
+	b.layoutData()
+
+	for _, fn := range prog.Funcs {
+		b.genFunc(fn)
+	}
+	for _, name := range b.builtins {
+		b.startFunc(name)
+		wasmBuiltins[name](b)
+		b.finishFunc(name)
+	}
+	for _, name := range b.thunks {
+		b.genThunk(name)
+	}
+	b.genStart(main)
+
+	b.mod.Exports = append(b.mod.Exports, wasm.Export{Name: "memory", Kind: wasm.ExportMemory},
+		wasm.Export{Name: "_start", Kind: wasm.ExportFunc, Index: b.funcs["_start"]})
+	return nil
+}
+
+func wasmType(t ir.Type) wasm.ValType {
+	switch t {
+	case ir.TypeW: return wasm.I32
+	case ir.TypeS: return wasm.F32
+	case ir.TypeD: return wasm.F64
+	}
+	return wasm.I64
+}
+
+func isFloatWasm(t wasm.ValType) bool { return t == wasm.F32 || t == wasm.F64 }
+
+// funcSig is the signature of a function of the program; functions without a value return 0 all the same, so
+// that calls through pointers need only agree on the parameters
+func funcSig(fn *ir.Func) wasm.FuncType {
+	var ft wasm.FuncType
+	for _, p := range fn.Params {
+		ft.Params = append(ft.Params, wasmType(p.Typ))
+	}
+	ft.Results = []wasm.ValType{wasmType(fn.ReturnType)}
+	return ft
+}
+
+func wordSig(params int) wasm.FuncType {
+	ft := wasm.FuncType{Results: []wasm.ValType{wasm.I64}}
+	for i := 0; i < params; i++ {
+		ft.Params = append(ft.Params, wasm.I64)
+	}
+	return ft
+}
+
+// declareFuncs numbers the functions: the WASI imports, those of env, the program's, the builtins it uses, the
+// thunks and _start
+// Each function whose address is taken gets a table slot holding a thunk of arity words, which calls it with
+// as many arguments as it takes, so that calls through pointers may pass any number of them as B allows
+func (b *wasmBackend) declareFuncs(main *ir.Func) {
+	for _, imp := range wasiImports {
+		ft := wasm.FuncType{}
+		for i := 0; i < imp.params; i++ {
+			ft.Params = append(ft.Params, wasm.I32)
+		}
+		if imp.name != "proc_exit" { ft.Results = []wasm.ValType{wasm.I32} }
+		b.addImport("wasi_snapshot_preview1", imp.name, ft)
+	}
+
+	defined := make(map[string]bool)
+	for _, fn := range b.prog.Funcs {
+		defined[fn.Name] = true
+	}
+	var taken []string
+	b.thunks, b.arity = nil, 0
+	used := make(map[string]bool)
+	if len(main.Params) > 0 { used["__sbrk"] = true }
+	for _, fn := range b.prog.Funcs {
+		for _, block := range fn.Blocks {
+			for _, instr := range block.Instructions {
+				if instr.Op == ir.OpCall && !b.isDirect(instr.Args[0]) { b.arity = max(b.arity, len(instr.Args)-1) }
+				for i, arg := range instr.Args {
+					g, ok := arg.(*ir.Global)
+					if !ok || b.isDataName(g.Name) { continue }
+					isCall := i == 0 && instr.Op == ir.OpCall
+					if !isCall && b.prog.ExtrnVars[g.Name] && !defined[g.Name] { continue }
+					if !isCall { taken = append(taken, g.Name) }
+					if defined[g.Name] || used[g.Name] { continue }
+					used[g.Name] = true
+					if _, builtin := wasmBuiltins[g.Name]; builtin { continue }
+					// Anything else is imported, typed after its first use
+					ft := wasm.FuncType{Results: []wasm.ValType{wasm.I64}}
+					if isCall {
+						for j := range instr.Args[1:] {
+							t := b.argType(instr, j)
+							if !isFloatIR(t) { t = ir.TypeL }
+							ft.Params = append(ft.Params, wasmType(t))
+						}
+						ft.Results = []wasm.ValType{wasmType(instr.Typ)}
+					}
+					b.addImport("env", g.Name, ft)
+				}
+			}
+		}
+	}
+	for _, g := range b.prog.Globals {
+		for _, item := range g.Items {
+			if ref, ok := item.Value.(*ir.Global); ok && !b.isDataName(ref.Name) { taken = append(taken, ref.Name) }
+		}
+	}
+
+	for _, fn := range b.prog.Funcs {
+		b.addFunc(fn.Name, funcSig(fn))
+	}
+	for name := range wasmBuiltins {
+		if used[name] && !defined[name] { b.builtins = append(b.builtins, name) }
+	}
+	sort.Strings(b.builtins)
+	for _, name := range b.builtins {
+		b.addFunc(name, wordSig(wasmBuiltinParams[name]))
+	}
+
+	for _, name := range taken {
+		if _, ok := b.funcs[name]; ok { b.arity = max(b.arity, len(b.sigs[name].Params)) }
+	}
+	for _, name := range taken {
+		_, ok := b.funcs[name]
+		if _, seen := b.slots[name]; !ok || seen { continue }
+		b.thunks = append(b.thunks, name)
+		b.addFunc(name+".indirect", wordSig(b.arity))
+		b.mod.Table = append(b.mod.Table, b.funcs[name+".indirect"])
+		b.slots[name] = int64(len(b.mod.Table))
+	}
+	b.addFunc("_start", wasm.FuncType{})
+}
+
+// isDirect tells whether a call to callee names a function rather than going through a pointer
+func (b *wasmBackend) isDirect(callee ir.Value) bool {
+	g, ok := callee.(*ir.Global)
+	return ok && !b.isDataName(g.Name)
+}
+
+func (b *wasmBackend) addImport(module, name string, ft wasm.FuncType) {
+	b.funcs[name] = uint32(len(b.mod.Imports))
+	b.sigs[name] = ft
+	b.mod.Imports = append(b.mod.Imports, wasm.Import{Module: module, Name: name, Type: b.mod.TypeIndex(ft)})
+}
+
+func (b *wasmBackend) addFunc(name string, ft wasm.FuncType) {
+	b.funcs[name] = uint32(len(b.mod.Imports) + len(b.mod.Funcs))
+	b.sigs[name] = ft
+	b.mod.Funcs = append(b.mod.Funcs, &wasm.Func{Name: name, Type: b.mod.TypeIndex(ft)})
+}
+
+func (b *wasmBackend) isDataName(name string) bool {
+	if _, isString := b.prog.IsStringLabel(name); isString { return true }
+	for _, g := range b.prog.Globals {
+		if g.Name == name { return true }
+	}
+	return false
+}
+
+// layoutData places the strings, the data and the extrn variables from wasmDataBase, then the stack and the heap
+func (b *wasmBackend) layoutData() {
+	addr := int64(wasmDataBase)
+	labels := make([]string, 0, len(b.prog.Strings))
+	values := make(map[string]string, len(b.prog.Strings))
+	for s, label := range b.prog.Strings {
+		labels = append(labels, label)
+		values[label] = s
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		b.addrs[label] = addr
+		b.mod.Data = append(b.mod.Data, wasm.Data{Offset: uint32(addr), Bytes: append([]byte(values[label]), 0)})
+		addr += int64(len(values[label])) + 1
+	}
+
+	for _, g := range b.prog.Globals {
+		addr = util.AlignUp(addr, max(int64(g.Align), 1))
+		b.addrs[g.Name] = addr
+		addr += b.dataSize(g)
+	}
+	var vars []string
+	for name := range b.prog.ExtrnVars {
+		if _, defined := b.addrs[name]; !defined && b.prog.FindFunc(name) == nil { vars = append(vars, name) }
+	}
+	sort.Strings(vars)
+	for _, name := range vars {
+		// extrn variables the program does not define have nothing to bind to, and start out as 0
+		addr = util.AlignUp(addr, 8)
+		b.addrs[name] = addr
+		addr += 8
+	}
+
+	for _, g := range b.prog.Globals {
+		if data := b.dataBytes(g); data != nil {
+			b.mod.Data = append(b.mod.Data, wasm.Data{Offset: uint32(b.addrs[g.Name]), Bytes: data})
+		}
+	}
+
+	b.stackBase = util.AlignUp(addr, 16)
+	stackTop := b.stackBase + wasmStackSize
+	b.mod.Memory = uint32((stackTop + wasm.PageSize - 1) / wasm.PageSize)
+	b.mod.Globals = []wasm.Global{
+		{Name: "sp", Type: wasm.I64, Mutable: true, Init: uint64(stackTop)},
+		{Name: "heap", Type: wasm.I64, Mutable: true, Init: uint64(stackTop)},
+	}
+}
+
+func (b *wasmBackend) itemSize(item ir.DataItem) int64 {
+	if item.Count > 0 {
+		if item.Typ == ir.TypeB { return int64(item.Count) }
+		return int64(item.Count) * ir.SizeOfType(item.Typ, b.prog.WordSize)
+	}
+	return ir.SizeOfType(item.Typ, b.prog.WordSize)
+}
+
+func (b *wasmBackend) dataSize(g *ir.Data) int64 {
+	var size int64
+	for _, item := range g.Items {
+		size += b.itemSize(item)
+	}
+	return size
+}
+
+// dataBytes is the initial contents of g, or nil when it is all zero
+func (b *wasmBackend) dataBytes(g *ir.Data) []byte {
+	data := make([]byte, b.dataSize(g))
+	var off int64
+	nonZero := false
+	for _, item := range g.Items {
+		size := b.itemSize(item)
+		if item.Count == 0 {
+			var bits uint64
+			switch v := item.Value.(type) {
+			case *ir.Const: bits = uint64(v.Value)
+			case *ir.FloatConst:
+				if item.Typ == ir.TypeS { bits = uint64(math.Float32bits(float32(v.Value))) } else { bits = math.Float64bits(v.Value) }
+			case *ir.Global: bits = uint64(b.address(v.Name))
+			}
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], bits)
+			copy(data[off:off+size], buf[:size])
+			nonZero = nonZero || bits != 0
+		}
+		off += size
+	}
+	if !nonZero { return nil }
+	return data
+}
+
+// address is the value of a global symbol: the address of data, or the table slot of a function
+func (b *wasmBackend) address(name string) int64 {
+	if addr, ok := b.addrs[name]; ok { return addr }
+	return b.slots[name]
+}
+
+func (b *wasmBackend) emit(op wasm.Opcode, imm ...uint64) {
+	in := wasm.Instr{Op: op}
+	if len(imm) > 0 { in.Imm = imm[0] }
+	b.code = append(b.code, in)
+}
+
+func (b *wasmBackend) i32(v int64) { b.emit(wasm.OpI32Const, uint64(uint32(v))) }
+func (b *wasmBackend) i64(v int64) { b.emit(wasm.OpI64Const, uint64(v)) }
+
+func (b *wasmBackend) zero(t wasm.ValType) {
+	switch t {
+	case wasm.I32: b.emit(wasm.OpI32Const, 0)
+	case wasm.F32: b.emit(wasm.OpF32Const, 0)
+	case wasm.F64: b.emit(wasm.OpF64Const, 0)
+	default: b.emit(wasm.OpI64Const, 0)
+	}
+}
+
+func (b *wasmBackend) newLocal(t wasm.ValType) uint32 {
+	b.localTypes = append(b.localTypes, t)
+	return uint32(len(b.params) + len(b.localTypes) - 1)
+}
+
+func (b *wasmBackend) localType(idx uint32) wasm.ValType {
+	if int(idx) < len(b.params) { return b.params[idx] }
+	return b.localTypes[int(idx)-len(b.params)]
+}
+
+// convert turns the value on the stack from have to want: integers are extended or wrapped and floats change
+// precision, while integers used as floats and floats used as integers keep their bits, as on QBE
+func (b *wasmBackend) convert(have, want wasm.ValType) {
+	if have == want { return }
+	switch have {
+	case wasm.I32:
+		switch want {
+		case wasm.I64: b.emit(wasm.OpI64ExtendI32S)
+		case wasm.F32: b.emit(wasm.OpF32ReinterpretI32)
+		case wasm.F64: b.emit(wasm.OpI64ExtendI32S); b.emit(wasm.OpF64ReinterpretI64)
+		}
+	case wasm.I64:
+		switch want {
+		case wasm.I32: b.emit(wasm.OpI32WrapI64)
+		case wasm.F32: b.emit(wasm.OpI32WrapI64); b.emit(wasm.OpF32ReinterpretI32)
+		case wasm.F64: b.emit(wasm.OpF64ReinterpretI64)
+		}
+	case wasm.F32:
+		switch want {
+		case wasm.F64: b.emit(wasm.OpF64PromoteF32)
+		case wasm.I32: b.emit(wasm.OpI32ReinterpretF32)
+		case wasm.I64: b.emit(wasm.OpI32ReinterpretF32); b.emit(wasm.OpI64ExtendI32S)
+		}
+	case wasm.F64:
+		switch want {
+		case wasm.F32: b.emit(wasm.OpF32DemoteF64)
+		case wasm.I64: b.emit(wasm.OpI64ReinterpretF64)
+		case wasm.I32: b.emit(wasm.OpI64ReinterpretF64); b.emit(wasm.OpI32WrapI64)
+		}
+	}
+}
+
+// narrow truncates the i64 on the stack to type t and extends it back, as values of sub-word types are held
+func (b *wasmBackend) narrow(t ir.Type) {
+	switch t {
+	case ir.TypeW: b.emit(wasm.OpI64Extend32S)
+	case ir.TypeSB: b.emit(wasm.OpI64Extend8S)
+	case ir.TypeSH: b.emit(wasm.OpI64Extend16S)
+	case ir.TypeB, ir.TypeUB: b.i64(0xff); b.emit(wasm.OpI64And)
+	case ir.TypeH, ir.TypeUH: b.i64(0xffff); b.emit(wasm.OpI64And)
+	}
+}
+
+// typeOf is the type of a value: that of its temporary, or a word for integer constants and addresses
+func (b *wasmBackend) typeOf(v ir.Value) ir.Type {
+	switch val := v.(type) {
+	case *ir.Temporary:
+		if t, ok := b.temps[tempName{val.Name, val.ID}]; ok { return t }
+	case *ir.FloatConst:
+		if val.Typ == ir.TypeS { return ir.TypeS }
+		return ir.TypeD
+	case *ir.Global: return ir.TypePtr
+	case *ir.CastValue: return b.typeOf(val.Value)
+	}
+	return ir.TypeNone
+}
+
+func (b *wasmBackend) argType(instr *ir.Instruction, i int) ir.Type {
+	if i < len(instr.ArgTypes) && instr.ArgTypes[i] != ir.TypeNone { return instr.ArgTypes[i] }
+	return b.typeOf(instr.Args[i+1])
+}
+
+// push puts v on the stack as a value of type want
+func (b *wasmBackend) push(v ir.Value, want wasm.ValType) {
+	switch val := v.(type) {
+	case *ir.Const:
+		switch want {
+		case wasm.I32, wasm.F32: b.emit(map[wasm.ValType]wasm.Opcode{wasm.I32: wasm.OpI32Const, wasm.F32: wasm.OpF32Const}[want], uint64(uint32(val.Value)))
+		case wasm.F64: b.emit(wasm.OpF64Const, uint64(val.Value))
+		default: b.i64(val.Value)
+		}
+	case *ir.FloatConst:
+		f, have := val.Value, wasm.F64
+		if val.Typ == ir.TypeS { f, have = float64(float32(f)), wasm.F32 }
+		if isFloatWasm(want) { have = want }
+		if have == wasm.F32 {
+			b.emit(wasm.OpF32Const, uint64(math.Float32bits(float32(f))))
+		} else {
+			b.emit(wasm.OpF64Const, math.Float64bits(f))
+		}
+		b.convert(have, want)
+	case *ir.Global:
+		b.i64(b.address(val.Name))
+		b.convert(wasm.I64, want)
+	case *ir.Temporary:
+		idx, ok := b.locals[tempName{val.Name, val.ID}]
+		if !ok {
+			b.zero(want)
+			return
+		}
+		b.emit(wasm.OpLocalGet, uint64(idx))
+		b.convert(b.localType(idx), want)
+	case *ir.CastValue: b.push(val.Value, want)
+	default: b.zero(want)
+	}
+}
+
+// pushAddr puts the address v holds on the stack, as memory instructions take it
+func (b *wasmBackend) pushAddr(v ir.Value) { b.push(v, wasm.I32) }
+
+func (b *wasmBackend) setResult(instr *ir.Instruction, have wasm.ValType) {
+	if instr.Result == nil {
+		b.emit(wasm.OpDrop)
+		return
+	}
+	idx := b.locals[tempName{instr.Result.(*ir.Temporary).Name, instr.Result.(*ir.Temporary).ID}]
+	b.convert(have, b.localType(idx))
+	b.emit(wasm.OpLocalSet, uint64(idx))
+}
+
+func (b *wasmBackend) startFunc(name string) {
+	b.code = nil
+	b.localTypes = nil
+	b.params = b.sigs[name].Params
+}
+
+func (b *wasmBackend) finishFunc(name string) {
+	b.emit(wasm.OpEnd)
+	f := b.mod.Funcs[int(b.funcs[name])-len(b.mod.Imports)]
+	f.Locals, f.Body = b.localTypes, b.code
+}
+
+func (b *wasmBackend) genFunc(fn *ir.Func) {
+	b.fn = fn
+	b.startFunc(fn.Name)
+	b.locals = make(map[tempName]uint32)
+	b.temps = make(map[tempName]ir.Type)
+	b.phis = make(map[string][]*ir.Instruction)
+	b.shadows = make(map[tempName]uint32)
+	b.blocks = make(map[string]int)
+	b.frame = make(map[*ir.Instruction]int64)
+
+	for i, p := range fn.Params {
+		if tmp, ok := p.Val.(*ir.Temporary); ok {
+			b.locals[tempName{tmp.Name, tmp.ID}] = uint32(i)
+			b.temps[tempName{tmp.Name, tmp.ID}] = p.Typ
+		}
+	}
+	b.pc, b.fp, b.sp = b.newLocal(wasm.I32), b.newLocal(wasm.I64), b.newLocal(wasm.I64)
+
+	var frameSize int64
+	for i, block := range fn.Blocks {
+		b.blocks[block.Label.Name] = i
+		for _, instr := range block.Instructions {
+			if tmp, ok := instr.Result.(*ir.Temporary); ok && tmp != nil {
+				key := tempName{tmp.Name, tmp.ID}
+				if _, defined := b.locals[key]; !defined {
+					t := resultType(instr, b.prog.WordSize)
+					b.temps[key] = t
+					b.locals[key] = b.newLocal(wasmType(t))
+				}
+			}
+			switch instr.Op {
+			case ir.OpAlloc:
+				if size, ok := instr.Args[0].(*ir.Const); ok {
+					frameSize = util.AlignUp(frameSize, max(int64(instr.Align), 1))
+					b.frame[instr] = frameSize
+					frameSize += size.Value
+				}
+			case ir.OpPhi:
+				key := tempName{instr.Result.(*ir.Temporary).Name, instr.Result.(*ir.Temporary).ID}
+				b.phis[block.Label.Name] = append(b.phis[block.Label.Name], instr)
+				b.shadows[key] = b.newLocal(b.localType(b.locals[key]))
+			}
+		}
+	}
+	frameSize = util.AlignUp(frameSize, 16)
+
+	b.emit(wasm.OpGlobalGet, wasmGlobalSP)
+	b.emit(wasm.OpLocalSet, uint64(b.sp))
+	if frameSize > 0 {
+		b.emit(wasm.OpGlobalGet, wasmGlobalSP)
+		b.i64(frameSize)
+		b.emit(wasm.OpI64Sub)
+		b.emit(wasm.OpLocalTee, uint64(b.fp))
+		b.emit(wasm.OpGlobalSet, wasmGlobalSP)
+		b.checkStack(b.fp)
+	}
+
+	n := len(fn.Blocks)
+	b.emit(wasm.OpLoop, uint64(wasm.BlockEmpty))
+	for range fn.Blocks {
+		b.emit(wasm.OpBlock, uint64(wasm.BlockEmpty))
+	}
+	b.emit(wasm.OpLocalGet, uint64(b.pc))
+	table := wasm.Instr{Op: wasm.OpBrTable, Imm: uint64(n - 1)}
+	for i := 0; i < n; i++ {
+		table.Labels = append(table.Labels, uint32(i))
+	}
+	b.code = append(b.code, table)
+
+	for k, block := range fn.Blocks {
+		b.emit(wasm.OpEnd)
+		terminated := false
+		for _, instr := range block.Instructions {
+			if instr.Op == ir.OpPhi { continue }
+			b.genInstr(k, block, instr)
+			if instr.Op == ir.OpJmp || instr.Op == ir.OpJnz || instr.Op == ir.OpRet {
+				terminated = true
+				break
+			}
+		}
+		// A block without a jump falls through to the next, or returns from the last
+		if !terminated {
+			if k+1 < n {
+				b.genPhiMoves(block, fn.Blocks[k+1].Label.Name)
+			} else {
+				b.genReturn(nil)
+			}
+		}
+	}
+	b.emit(wasm.OpEnd)
+	b.emit(wasm.OpUnreachable)
+	b.finishFunc(fn.Name)
+}
+
+// checkStack traps when the stack pointer in local sp ran into the data below the stack
+func (b *wasmBackend) checkStack(sp uint32) {
+	b.emit(wasm.OpLocalGet, uint64(sp))
+	b.i64(b.stackBase)
+	b.emit(wasm.OpI64LtU)
+	b.emit(wasm.OpIf, uint64(wasm.BlockEmpty))
+	b.emit(wasm.OpUnreachable)
+	b.emit(wasm.OpEnd)
+}
+
+// genPhiMoves copies the values the phis of block to take on the edge from block from, through their shadows so
+// that phis reading each other see the values from before the edge
+func (b *wasmBackend) genPhiMoves(from *ir.BasicBlock, to string) {
+	phis := b.phis[to]
+	for _, phi := range phis {
+		key := tempName{phi.Result.(*ir.Temporary).Name, phi.Result.(*ir.Temporary).ID}
+		for i := 0; i+1 < len(phi.Args); i += 2 {
+			if phi.Args[i].String() == from.Label.Name {
+				b.push(phi.Args[i+1], b.localType(b.shadows[key]))
+				b.emit(wasm.OpLocalSet, uint64(b.shadows[key]))
+				break
+			}
+		}
+	}
+	for _, phi := range phis {
+		key := tempName{phi.Result.(*ir.Temporary).Name, phi.Result.(*ir.Temporary).ID}
+		b.emit(wasm.OpLocalGet, uint64(b.shadows[key]))
+		b.emit(wasm.OpLocalSet, uint64(b.locals[key]))
+	}
+}
+
+// genJump goes from block k, nested nest levels deep in its code, to the block labelled to
+func (b *wasmBackend) genJump(k, nest int, from *ir.BasicBlock, to string) {
+	b.genPhiMoves(from, to)
+	j := b.blocks[to]
+	if j == k+1 && nest == 0 { return }
+	b.i32(int64(j))
+	b.emit(wasm.OpLocalSet, uint64(b.pc))
+	b.emit(wasm.OpBr, uint64(len(b.fn.Blocks)-1-k+nest))
+}
+
+func (b *wasmBackend) genReturn(v ir.Value) {
+	ret := wasmType(b.fn.ReturnType)
+	if v == nil || b.fn.ReturnType == ir.TypeNone {
+		b.zero(ret)
+	} else {
+		b.push(v, ret)
+	}
+	b.emit(wasm.OpLocalGet, uint64(b.sp))
+	b.emit(wasm.OpGlobalSet, wasmGlobalSP)
+	b.emit(wasm.OpReturn)
+}
+
+var wasmLoads = map[ir.Type]wasm.Opcode{
+	ir.TypeSB: wasm.OpI64Load8S, ir.TypeB: wasm.OpI64Load8U, ir.TypeUB: wasm.OpI64Load8U,
+	ir.TypeSH: wasm.OpI64Load16S, ir.TypeH: wasm.OpI64Load16U, ir.TypeUH: wasm.OpI64Load16U,
+	ir.TypeW: wasm.OpI32Load, ir.TypeS: wasm.OpF32Load, ir.TypeD: wasm.OpF64Load,
+}
+
+var wasmStores = map[ir.Type]wasm.Opcode{
+	ir.TypeSB: wasm.OpI64Store8, ir.TypeB: wasm.OpI64Store8, ir.TypeUB: wasm.OpI64Store8,
+	ir.TypeSH: wasm.OpI64Store16, ir.TypeH: wasm.OpI64Store16, ir.TypeUH: wasm.OpI64Store16,
+	ir.TypeW: wasm.OpI32Store, ir.TypeS: wasm.OpF32Store, ir.TypeD: wasm.OpF64Store,
+}
+
+var wasmArith = map[ir.Op][2]wasm.Opcode{
+	ir.OpAdd: {wasm.OpI32Add, wasm.OpI64Add}, ir.OpSub: {wasm.OpI32Sub, wasm.OpI64Sub},
+	ir.OpMul: {wasm.OpI32Mul, wasm.OpI64Mul}, ir.OpDiv: {wasm.OpI32DivS, wasm.OpI64DivS},
+	ir.OpRem: {wasm.OpI32RemS, wasm.OpI64RemS}, ir.OpAnd: {wasm.OpI32And, wasm.OpI64And},
+	ir.OpOr: {wasm.OpI32Or, wasm.OpI64Or}, ir.OpXor: {wasm.OpI32Xor, wasm.OpI64Xor},
+	ir.OpShl: {wasm.OpI32Shl, wasm.OpI64Shl}, ir.OpShr: {wasm.OpI32ShrU, wasm.OpI64ShrU},
+}
+
+var wasmFloatArith = map[ir.Op][2]wasm.Opcode{
+	ir.OpAddF: {wasm.OpF32Add, wasm.OpF64Add}, ir.OpSubF: {wasm.OpF32Sub, wasm.OpF64Sub},
+	ir.OpMulF: {wasm.OpF32Mul, wasm.OpF64Mul}, ir.OpDivF: {wasm.OpF32Div, wasm.OpF64Div},
+}
+
+// wasmCompares holds the i32, i64, f32 and f64 instructions of each comparison
+var wasmCompares = map[ir.Op][4]wasm.Opcode{
+	ir.OpCEq:  {wasm.OpI32Eq, wasm.OpI64Eq, wasm.OpF32Eq, wasm.OpF64Eq},
+	ir.OpCNeq: {wasm.OpI32Ne, wasm.OpI64Ne, wasm.OpF32Ne, wasm.OpF64Ne},
+	ir.OpCLt:  {wasm.OpI32LtS, wasm.OpI64LtS, wasm.OpF32Lt, wasm.OpF64Lt},
+	ir.OpCGt:  {wasm.OpI32GtS, wasm.OpI64GtS, wasm.OpF32Gt, wasm.OpF64Gt},
+	ir.OpCLe:  {wasm.OpI32LeS, wasm.OpI64LeS, wasm.OpF32Le, wasm.OpF64Le},
+	ir.OpCGe:  {wasm.OpI32GeS, wasm.OpI64GeS, wasm.OpF32Ge, wasm.OpF64Ge},
+}
+
+func wasmVariant(t wasm.ValType) int {
+	switch t {
+	case wasm.I32: return 0
+	case wasm.F32: return 2
+	case wasm.F64: return 3
+	}
+	return 1
+}
+
+func (b *wasmBackend) genInstr(k int, block *ir.BasicBlock, instr *ir.Instruction) {
+	args, typ := instr.Args, instr.Typ
+	switch instr.Op {
+	case ir.OpJmp:
+		b.genJump(k, 0, block, args[0].String())
+	case ir.OpJnz:
+		b.push(args[0], wasm.I64)
+		b.emit(wasm.OpI64Eqz)
+		b.emit(wasm.OpIf, uint64(wasm.BlockEmpty))
+		b.genJump(k, 1, block, args[2].String())
+		b.emit(wasm.OpEnd)
+		b.genJump(k, 0, block, args[1].String())
+	case ir.OpRet:
+		var v ir.Value
+		if len(args) > 0 { v = args[0] }
+		b.genReturn(v)
+
+	case ir.OpAlloc:
+		if off, ok := b.frame[instr]; ok {
+			b.emit(wasm.OpLocalGet, uint64(b.fp))
+			b.i64(off)
+			b.emit(wasm.OpI64Add)
+		} else {
+			b.emit(wasm.OpGlobalGet, wasmGlobalSP)
+			b.push(args[0], wasm.I64)
+			b.i64(15)
+			b.emit(wasm.OpI64Add)
+			b.i64(-16)
+			b.emit(wasm.OpI64And)
+			b.emit(wasm.OpI64Sub)
+			b.emit(wasm.OpGlobalSet, wasmGlobalSP)
+			b.emit(wasm.OpGlobalGet, wasmGlobalSP)
+		}
+		b.setResult(instr, wasm.I64)
+	case ir.OpLoad:
+		b.pushAddr(args[0])
+		op, ok := wasmLoads[typ]
+		if !ok { op = wasm.OpI64Load }
+		b.emit(op)
+		have := wasmType(typ)
+		if ir.SizeOfType(typ, b.prog.WordSize) < 4 { have = wasm.I64 }
+		b.setResult(instr, have)
+	case ir.OpStore:
+		b.pushAddr(args[1])
+		op, ok := wasmStores[typ]
+		if !ok { op = wasm.OpI64Store }
+		want := wasmType(typ)
+		b.push(args[0], want)
+		b.emit(op)
+	case ir.OpBlit:
+		b.pushAddr(args[1])
+		b.pushAddr(args[0])
+		if len(args) > 2 {
+			b.push(args[2], wasm.I32)
+		} else {
+			b.i32(ir.SizeOfType(typ, b.prog.WordSize))
+		}
+		b.emit(wasm.OpMemoryCopy)
+	case ir.OpCall: b.genCall(instr)
+
+	case ir.OpAdd, ir.OpSub, ir.OpMul, ir.OpDiv, ir.OpRem, ir.OpAnd, ir.OpOr, ir.OpXor, ir.OpShl, ir.OpShr:
+		t := wasm.I64
+		if typ == ir.TypeW { t = wasm.I32 }
+		b.push(args[0], t)
+		b.push(args[1], t)
+		b.emit(wasmArith[instr.Op][wasmVariant(t)])
+		b.setResult(instr, t)
+	case ir.OpAddF, ir.OpSubF, ir.OpMulF, ir.OpDivF:
+		t := wasmType(typ)
+		b.push(args[0], t)
+		b.push(args[1], t)
+		b.emit(wasmFloatArith[instr.Op][wasmVariant(t)-2])
+		b.setResult(instr, t)
+	case ir.OpRemF:
+		// fmod as x - trunc(x/y)*y, in double precision
+		x, y := b.newLocal(wasm.F64), b.newLocal(wasm.F64)
+		b.push(args[0], wasm.F64)
+		b.emit(wasm.OpLocalTee, uint64(x))
+		b.push(args[1], wasm.F64)
+		b.emit(wasm.OpLocalTee, uint64(y))
+		b.emit(wasm.OpF64Div)
+		b.emit(wasm.OpF64Trunc)
+		b.emit(wasm.OpLocalGet, uint64(y))
+		b.emit(wasm.OpF64Mul)
+		b.emit(wasm.OpLocalGet, uint64(x))
+		b.emit(wasm.OpF64Sub)
+		b.emit(wasm.OpF64Neg)
+		b.setResult(instr, wasm.F64)
+	case ir.OpNegF:
+		t := wasmType(typ)
+		b.push(args[0], t)
+		b.emit(map[wasm.ValType]wasm.Opcode{wasm.F32: wasm.OpF32Neg, wasm.F64: wasm.OpF64Neg}[t])
+		b.setResult(instr, t)
+
+	case ir.OpCEq, ir.OpCNeq, ir.OpCLt, ir.OpCGt, ir.OpCLe, ir.OpCGe:
+		t := instr.OperandType
+		if t == ir.TypeNone {
+			t = b.typeOf(args[0])
+			if isFloatIR(b.typeOf(args[1])) { t = b.typeOf(args[1]) }
+		}
+		wt := wasmType(t)
+		b.push(args[0], wt)
+		b.push(args[1], wt)
+		b.emit(wasmCompares[instr.Op][wasmVariant(wt)])
+		b.emit(wasm.OpI64ExtendI32U)
+		b.setResult(instr, wasm.I64)
+
+	case ir.OpExtSB, ir.OpExtUB, ir.OpExtSH, ir.OpExtUH, ir.OpExtSW, ir.OpExtUW:
+		b.push(args[0], wasm.I64)
+		switch instr.Op {
+		case ir.OpExtSB: b.narrow(ir.TypeSB)
+		case ir.OpExtUB: b.narrow(ir.TypeUB)
+		case ir.OpExtSH: b.narrow(ir.TypeSH)
+		case ir.OpExtUH: b.narrow(ir.TypeUH)
+		case ir.OpExtSW: b.narrow(ir.TypeW)
+		case ir.OpExtUW:
+			b.i64(0xffffffff)
+			b.emit(wasm.OpI64And)
+		}
+		b.setResult(instr, wasm.I64)
+	case ir.OpTrunc:
+		b.push(args[0], wasm.I64)
+		b.narrow(typ)
+		b.setResult(instr, wasm.I64)
+	case ir.OpCast:
+		b.push(args[0], wasmType(typ))
+		b.setResult(instr, wasmType(typ))
+
+	case ir.OpFToSI, ir.OpFToUI:
+		b.push(args[0], wasm.F64)
+		signed := instr.Op == ir.OpFToSI
+		switch {
+		case typ == ir.TypeW && signed: b.emit(wasm.OpI32TruncSatF64S)
+		case typ == ir.TypeW: b.emit(wasm.OpI32TruncSatF64U)
+		case signed: b.emit(wasm.OpI64TruncSatF64S)
+		default: b.emit(wasm.OpI64TruncSatF64U)
+		}
+		t := wasm.I64
+		if typ == ir.TypeW { t = wasm.I32 }
+		b.setResult(instr, t)
+	case ir.OpSWToF, ir.OpUWToF, ir.OpSLToF, ir.OpULToF:
+		from := wasm.I64
+		if instr.Op == ir.OpSWToF || instr.Op == ir.OpUWToF { from = wasm.I32 }
+		b.push(args[0], from)
+		t := wasmType(typ)
+		ops := map[ir.Op][2]wasm.Opcode{
+			ir.OpSWToF: {wasm.OpF32ConvertI32S, wasm.OpF64ConvertI32S}, ir.OpUWToF: {wasm.OpF32ConvertI32U, wasm.OpF64ConvertI32U},
+			ir.OpSLToF: {wasm.OpF32ConvertI64S, wasm.OpF64ConvertI64S}, ir.OpULToF: {wasm.OpF32ConvertI64U, wasm.OpF64ConvertI64U},
+		}[instr.Op]
+		b.emit(ops[wasmVariant(t)-2])
+		b.setResult(instr, t)
+	case ir.OpFToF:
+		// An operand of unknown type holds the other precision
+		from := b.typeOf(args[0])
+		if !isFloatIR(from) {
+			from = ir.TypeS
+			if typ == ir.TypeS { from = ir.TypeD }
+		}
+		b.push(args[0], wasmType(from))
+		b.convert(wasmType(from), wasmType(typ))
+		b.setResult(instr, wasmType(typ))
+	default:
+		util.Error(instr.Pos, "internal: wasm backend cannot lower IR operation %d", instr.Op)
+	}
+}
+
+// toWord and fromWord pass a value of type t as a word through a thunk, single floats as doubles
+func (b *wasmBackend) toWord(t wasm.ValType) {
+	if t == wasm.F32 {
+		b.emit(wasm.OpF64PromoteF32)
+		t = wasm.F64
+	}
+	b.convert(t, wasm.I64)
+}
+
+func (b *wasmBackend) fromWord(t wasm.ValType) {
+	if t == wasm.F32 {
+		b.emit(wasm.OpF64ReinterpretI64)
+		b.emit(wasm.OpF32DemoteF64)
+		return
+	}
+	b.convert(wasm.I64, t)
+}
+
+func (b *wasmBackend) genThunk(name string) {
+	b.startFunc(name + ".indirect")
+	ft := b.sigs[name]
+	for i, param := range ft.Params {
+		b.emit(wasm.OpLocalGet, uint64(i))
+		b.fromWord(param)
+	}
+	b.emit(wasm.OpCall, uint64(b.funcs[name]))
+	if len(ft.Results) > 0 {
+		b.toWord(ft.Results[0])
+	} else {
+		b.i64(0)
+	}
+	b.finishFunc(name + ".indirect")
+}
+
+// genCall calls a function of the module directly, adapting the arguments to its parameters, or any other
+// function through the thunk in its table slot
+// Integer arguments are extended to a word, and floats passed for a word keep their bits as a double
+func (b *wasmBackend) genCall(instr *ir.Instruction) {
+	var ft wasm.FuncType
+	g, direct := instr.Args[0].(*ir.Global)
+	if direct { _, direct = b.funcs[g.Name] }
+	if direct {
+		ft = b.sigs[g.Name]
+	} else {
+		ft = wordSig(b.arity)
+	}
+
+	for i, param := range ft.Params {
+		if i+1 >= len(instr.Args) {
+			b.zero(param)
+			continue
+		}
+		arg, t := instr.Args[i+1], b.argType(instr, i)
+		switch {
+		case isFloatIR(t) && !isFloatWasm(param):
+			b.push(arg, wasm.F64)
+			b.convert(wasm.F64, param)
+		case !isFloatIR(t) && !isFloatWasm(param):
+			b.push(arg, wasm.I64)
+			b.narrow(t)
+			b.convert(wasm.I64, param)
+		default: b.push(arg, param)
+		}
+	}
+
+	if direct {
+		b.emit(wasm.OpCall, uint64(b.funcs[g.Name]))
+	} else {
+		b.pushAddr(instr.Args[0])
+		b.emit(wasm.OpCallIndirect, uint64(b.mod.TypeIndex(ft)))
+		if isFloatIR(instr.Typ) {
+			b.fromWord(wasmType(instr.Typ))
+			ft.Results = []wasm.ValType{wasmType(instr.Typ)}
+		}
+	}
+
+	have := wasm.I64
+	if len(ft.Results) > 0 { have = ft.Results[0] } else { b.i64(0) }
+	if instr.Result != nil && !isFloatIR(instr.Typ) && ir.SizeOfType(instr.Typ, b.prog.WordSize) < 8 && instr.Typ != ir.TypeNone {
+		b.convert(have, wasm.I64)
+		b.narrow(instr.Typ)
+		have = wasm.I64
+	}
+	b.setResult(instr, have)
+}
+
+// The runtime functions take and return words
+
+func (b *wasmBackend) store32(addr int64, push func()) {
+	b.i32(addr)
+	push()
+	b.emit(wasm.OpI32Store)
+}
+
+// genIovec points the scratch iovec at n bytes from buf
+func (b *wasmBackend) genIovec(buf, n func()) {
+	b.store32(wasmIovec, buf)
+	b.store32(wasmIovec+4, n)
+}
+
+func (b *wasmBackend) genPutchar() {
+	b.i32(wasmByte)
+	b.emit(wasm.OpLocalGet, 0)
+	b.emit(wasm.OpI64Store8)
+	b.genIovec(func() { b.i32(wasmByte) }, func() { b.i32(1) })
+	b.i32(1)
+	b.i32(wasmIovec)
+	b.i32(1)
+	b.i32(wasmCount)
+	b.emit(wasm.OpCall, uint64(b.funcs["fd_write"]))
+	b.emit(wasm.OpDrop)
+	b.emit(wasm.OpLocalGet, 0)
+}
+
+// genGetchar reads a byte of standard input, or returns -1 at its end
+func (b *wasmBackend) genGetchar() {
+	b.genIovec(func() { b.i32(wasmByte) }, func() { b.i32(1) })
+	b.i32(0)
+	b.i32(wasmIovec)
+	b.i32(1)
+	b.i32(wasmCount)
+	b.emit(wasm.OpCall, uint64(b.funcs["fd_read"]))
+	b.emit(wasm.OpDrop)
+	b.i32(wasmCount)
+	b.emit(wasm.OpI32Load)
+	b.emit(wasm.OpI32Eqz)
+	b.emit(wasm.OpIf, uint64(wasm.I64))
+	b.i64(-1)
+	b.emit(wasm.OpElse)
+	b.i32(wasmByte)
+	b.emit(wasm.OpI64Load8U)
+	b.emit(wasm.OpEnd)
+}
+
+func (b *wasmBackend) genExit() {
+	b.emit(wasm.OpLocalGet, 0)
+	b.emit(wasm.OpI32WrapI64)
+	b.emit(wasm.OpCall, uint64(b.funcs["proc_exit"]))
+	b.emit(wasm.OpUnreachable)
+}
+
+// genTransfer gives read(fd, buf, n) and write(fd, buf, n), returning the count transferred or -1
+func (b *wasmBackend) genTransfer(wasi string) {
+	b.genIovec(func() { b.emit(wasm.OpLocalGet, 1); b.emit(wasm.OpI32WrapI64) }, func() { b.emit(wasm.OpLocalGet, 2); b.emit(wasm.OpI32WrapI64) })
+	b.emit(wasm.OpLocalGet, 0)
+	b.emit(wasm.OpI32WrapI64)
+	b.i32(wasmIovec)
+	b.i32(1)
+	b.i32(wasmCount)
+	b.emit(wasm.OpCall, uint64(b.funcs[wasi]))
+	b.emit(wasm.OpIf, uint64(wasm.I64))
+	b.i64(-1)
+	b.emit(wasm.OpElse)
+	b.i32(wasmCount)
+	b.emit(wasm.OpI64Load32U)
+	b.emit(wasm.OpEnd)
+}
+
+// genSbrk moves the end of the heap by n bytes, growing memory as needed, and returns its old end or -1
+func (b *wasmBackend) genSbrk() {
+	old, end := b.newLocal(wasm.I64), b.newLocal(wasm.I64)
+	b.emit(wasm.OpGlobalGet, wasmGlobalHeap)
+	b.emit(wasm.OpLocalTee, uint64(old))
+	b.emit(wasm.OpLocalGet, 0)
+	b.emit(wasm.OpI64Add)
+	b.i64(7)
+	b.emit(wasm.OpI64Add)
+	b.i64(-8)
+	b.emit(wasm.OpI64And)
+	b.emit(wasm.OpLocalTee, uint64(end))
+	b.emit(wasm.OpMemorySize)
+	b.emit(wasm.OpI64ExtendI32U)
+	b.i64(16)
+	b.emit(wasm.OpI64Shl)
+	b.emit(wasm.OpI64GtU)
+	b.emit(wasm.OpIf, uint64(wasm.BlockEmpty))
+	b.emit(wasm.OpLocalGet, uint64(end))
+	b.i64(wasm.PageSize - 1)
+	b.emit(wasm.OpI64Add)
+	b.i64(16)
+	b.emit(wasm.OpI64ShrU)
+	b.emit(wasm.OpMemorySize)
+	b.emit(wasm.OpI64ExtendI32U)
+	b.emit(wasm.OpI64Sub)
+	b.emit(wasm.OpI32WrapI64)
+	b.emit(wasm.OpMemoryGrow)
+	b.i32(-1)
+	b.emit(wasm.OpI32Eq)
+	b.emit(wasm.OpIf, uint64(wasm.BlockEmpty))
+	b.i64(-1)
+	b.emit(wasm.OpReturn)
+	b.emit(wasm.OpEnd)
+	b.emit(wasm.OpEnd)
+	b.emit(wasm.OpLocalGet, uint64(end))
+	b.emit(wasm.OpGlobalSet, wasmGlobalHeap)
+	b.emit(wasm.OpLocalGet, uint64(old))
+}
+
+// genStart gives _start, which hands the command line to main as argc and a vector of words, and exits with
+// what main returns
+func (b *wasmBackend) genStart(main *ir.Func) {
+	b.startFunc("_start")
+	params := b.sigs["main"].Params
+	if len(params) > 0 {
+		argc, argv32, argv, i := b.newLocal(wasm.I64), b.newLocal(wasm.I64), b.newLocal(wasm.I64), b.newLocal(wasm.I64)
+		sbrk := func(size func()) {
+			size()
+			b.emit(wasm.OpCall, uint64(b.funcs["__sbrk"]))
+		}
+		b.i32(wasmCount)
+		b.i32(wasmAux)
+		b.emit(wasm.OpCall, uint64(b.funcs["args_sizes_get"]))
+		b.emit(wasm.OpDrop)
+		b.i32(wasmCount)
+		b.emit(wasm.OpI64Load32U)
+		b.emit(wasm.OpLocalSet, uint64(argc))
+		sbrk(func() { b.emit(wasm.OpLocalGet, uint64(argc)); b.i64(4); b.emit(wasm.OpI64Mul) })
+		b.emit(wasm.OpLocalTee, uint64(argv32))
+		b.emit(wasm.OpI32WrapI64)
+		sbrk(func() { b.i32(wasmAux); b.emit(wasm.OpI64Load32U) })
+		b.emit(wasm.OpI32WrapI64)
+		b.emit(wasm.OpCall, uint64(b.funcs["args_get"]))
+		b.emit(wasm.OpDrop)
+		sbrk(func() { b.emit(wasm.OpLocalGet, uint64(argc)); b.i64(1); b.emit(wasm.OpI64Add); b.i64(8); b.emit(wasm.OpI64Mul) })
+		b.emit(wasm.OpLocalSet, uint64(argv))
+
+		// Widen the pointers args_get wrote into words, ending with 0
+		b.emit(wasm.OpBlock, uint64(wasm.BlockEmpty))
+		b.emit(wasm.OpLoop, uint64(wasm.BlockEmpty))
+		b.emit(wasm.OpLocalGet, uint64(i))
+		b.emit(wasm.OpLocalGet, uint64(argc))
+		b.emit(wasm.OpI64GeU)
+		b.emit(wasm.OpBrIf, 1)
+		b.emit(wasm.OpLocalGet, uint64(argv))
+		b.emit(wasm.OpLocalGet, uint64(i))
+		b.i64(8)
+		b.emit(wasm.OpI64Mul)
+		b.emit(wasm.OpI64Add)
+		b.emit(wasm.OpI32WrapI64)
+		b.emit(wasm.OpLocalGet, uint64(argv32))
+		b.emit(wasm.OpLocalGet, uint64(i))
+		b.i64(4)
+		b.emit(wasm.OpI64Mul)
+		b.emit(wasm.OpI64Add)
+		b.emit(wasm.OpI32WrapI64)
+		b.emit(wasm.OpI64Load32U)
+		b.emit(wasm.OpI64Store)
+		b.emit(wasm.OpLocalGet, uint64(i))
+		b.i64(1)
+		b.emit(wasm.OpI64Add)
+		b.emit(wasm.OpLocalSet, uint64(i))
+		b.emit(wasm.OpBr, 0)
+		b.emit(wasm.OpEnd)
+		b.emit(wasm.OpEnd)
+		b.emit(wasm.OpLocalGet, uint64(argv))
+		b.emit(wasm.OpLocalGet, uint64(argc))
+		b.i64(8)
+		b.emit(wasm.OpI64Mul)
+		b.emit(wasm.OpI64Add)
+		b.emit(wasm.OpI32WrapI64)
+		b.i64(0)
+		b.emit(wasm.OpI64Store)
+
+		for j, param := range params {
+			switch j {
+			case 0: b.emit(wasm.OpLocalGet, uint64(argc))
+			case 1: b.emit(wasm.OpLocalGet, uint64(argv))
+			default: b.zero(param)
+			}
+			if j < 2 { b.convert(wasm.I64, param) }
+		}
+	}
+	b.emit(wasm.OpCall, uint64(b.funcs["main"]))
+	ret := b.sigs["main"].Results[0]
+	if main.ReturnType == ir.TypeNone {
+		b.emit(wasm.OpDrop)
+		b.i32(0)
+	} else {
+		b.convert(ret, wasm.I32)
+	}
+	b.emit(wasm.OpCall, uint64(b.funcs["proc_exit"]))
+	b.finishFunc("_start")
+}
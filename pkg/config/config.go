@@ -8,7 +8,6 @@ import (
 
 	"github.com/xplshn/gbc/pkg/cli"
 	"github.com/xplshn/gbc/pkg/token"
-	"modernc.org/libqbe"
 )
 
 type Feature int
@@ -28,9 +27,18 @@ const (
 	FeatStrictDecl
 	FeatNoDirectives
 	FeatContinue
+	FeatDefer
+	FeatCLoops
 	FeatFloat
 	FeatStrictTypes
 	FeatPromTypes
+	FeatBoundsCheck
+	FeatCheckNil
+	FeatTrapv
+	FeatCheckDiv
+	FeatProfile
+	FeatInstrumentFunctions
+	FeatCoverage
 	FeatCount
 )
 
@@ -82,6 +90,7 @@ var archTranslations = map[string]string{
 	"i386":    "386",
 	"i686":    "386",
 	"aarch64": "arm64",
+	"wasm32":  "wasm",
 }
 
 var archProperties = map[string]struct {
@@ -93,6 +102,10 @@ var archProperties = map[string]struct {
 	"386":     {WordSize: 4, StackAlignment: 8},
 	"arm":     {WordSize: 4, StackAlignment: 8},
 	"riscv64": {WordSize: 8, StackAlignment: 16},
+	"wasm":    {WordSize: 8, StackAlignment: 16},
+	"6502":    {WordSize: 2, StackAlignment: 1},
+	"uxn":     {WordSize: 2, StackAlignment: 1},
+	"sm83":    {WordSize: 2, StackAlignment: 1},
 }
 
 type Config struct {
@@ -104,7 +117,11 @@ type Config struct {
 	Target
 	LinkerArgs       []string
 	LibRequests      []string
+	LibraryFiles     []string // the files LibRequests resolved to, which are not instrumented
 	UserIncludePaths []string
+	DebugInfo        bool
+	OptLevel         string // -O, for the backends that optimize; "" for their default
+	CPU              string // -mcpu, the CPU the llvm backend generates code for
 }
 
 func NewConfig() *Config {
@@ -119,23 +136,32 @@ func NewConfig() *Config {
 	}
 
 	features := map[Feature]Info{
-		FeatExtrn:              {"extrn", true, "Allow the 'extrn' keyword"},
-		FeatAsm:                {"asm", true, "Allow `__asm__` blocks for inline assembly"},
-		FeatBEsc:               {"b-esc", false, "Recognize B-style '*' character escapes"},
-		FeatCEsc:               {"c-esc", true, "Recognize C-style '\\' character escapes"},
-		FeatBOps:               {"b-ops", false, "Recognize B-style assignment operators like '=+'"},
-		FeatCOps:               {"c-ops", true, "Recognize C-style assignment operators like '+='"},
-		FeatCComments:          {"c-comments", true, "Recognize C-style '//' line comments"},
-		FeatTyped:              {"typed", true, "Enable the Bx opt-in & backwards-compatible type system"},
-		FeatShortDecl:          {"short-decl", true, "Enable Bx-style short declaration `:=`"},
-		FeatBxDeclarations:     {"bx-decl", true, "Enable Bx-style `auto name = val` declarations"},
-		FeatAllowUninitialized: {"allow-uninitialized", true, "Allow declarations without an initializer (`var;` or `auto var;`)"},
-		FeatStrictDecl:         {"strict-decl", false, "Require all declarations to be initialized"},
-		FeatContinue:           {"continue", true, "Allow the Bx keyword `continue` to be used"},
-		FeatNoDirectives:       {"no-directives", false, "Disable `// [b]:` directives"},
-		FeatFloat:              {"float", true, "Enable support for floating-point numbers"},
-		FeatStrictTypes:        {"strict-types", false, "Disallow all incompatible type operations"},
-		FeatPromTypes:          {"prom-types", false, "Enable type promotions - promote untyped literals to compatible types"},
+		FeatExtrn:               {"extrn", true, "Allow the 'extrn' keyword"},
+		FeatAsm:                 {"asm", true, "Allow `__asm__` blocks for inline assembly"},
+		FeatBEsc:                {"b-esc", false, "Recognize B-style '*' character escapes"},
+		FeatCEsc:                {"c-esc", true, "Recognize C-style '\\' character escapes"},
+		FeatBOps:                {"b-ops", false, "Recognize B-style assignment operators like '=+'"},
+		FeatCOps:                {"c-ops", true, "Recognize C-style assignment operators like '+='"},
+		FeatCComments:           {"c-comments", true, "Recognize C-style '//' line comments"},
+		FeatTyped:               {"typed", true, "Enable the Bx opt-in & backwards-compatible type system"},
+		FeatShortDecl:           {"short-decl", true, "Enable Bx-style short declaration `:=`"},
+		FeatBxDeclarations:      {"bx-decl", true, "Enable Bx-style `auto name = val` declarations"},
+		FeatAllowUninitialized:  {"allow-uninitialized", true, "Allow declarations without an initializer (`var;` or `auto var;`)"},
+		FeatStrictDecl:          {"strict-decl", false, "Require all declarations to be initialized"},
+		FeatContinue:            {"continue", true, "Allow the Bx keyword `continue` to be used"},
+		FeatDefer:               {"defer", true, "Allow Bx `defer` statements, run when their function returns"},
+		FeatCLoops:              {"c-loops", true, "Allow C-style `for (init; cond; post)` and `do`-`while` loops"},
+		FeatNoDirectives:        {"no-directives", false, "Disable `// [b]:` directives"},
+		FeatFloat:               {"float", true, "Enable support for floating-point numbers"},
+		FeatStrictTypes:         {"strict-types", false, "Disallow all incompatible type operations"},
+		FeatPromTypes:           {"prom-types", false, "Enable type promotions - promote untyped literals to compatible types"},
+		FeatBoundsCheck:         {"bounds-check", false, "Trap on out-of-range subscripts of vectors and arrays with a known size"},
+		FeatCheckNil:            {"check-nil", false, "Trap on dereferences of and calls through nil pointers"},
+		FeatTrapv:               {"trapv", false, "Trap on signed integer overflow in arithmetic"},
+		FeatCheckDiv:            {"check-div", false, "Trap on integer division or remainder by zero"},
+		FeatProfile:             {"profile", false, "Count calls and time per function, written to 'gbc.prof' at exit"},
+		FeatCoverage:            {"coverage", false, "Count executions of every basic block, appended to 'gbc.cov' at exit"},
+		FeatInstrumentFunctions: {"instrument-functions", false, "Call __gbc_func_enter/__gbc_func_exit on every function entry and exit"},
 	}
 
 	warnings := map[Warning]Info{
@@ -169,7 +195,37 @@ func NewConfig() *Config {
 	return cfg
 }
 
-func (c *Config) SetTarget(hostOS, hostArch, targetFlag string) {
+// SubTarget is a target of a backend, as `-t backend/name` names it, with the GOOS and GOARCH it compiles for;
+// an empty GOOS is the host's
+type SubTarget struct {
+	Name   string
+	GOOS   string
+	GOARCH string
+}
+
+// BackendTargets is what SetTarget needs to know of a backend, which the registry of codegen provides
+type BackendTargets interface {
+	SubTargets() []SubTarget
+	TakesTriples() bool
+	Default(hostOS, hostArch string) string
+}
+
+// HostTriple is the target triple of the host, with the vendor and environment of its usual toolchain
+func HostTriple(hostOS, hostArch string) string {
+	arch := archTranslations[hostArch]
+	if arch == "" { arch = hostArch }
+	switch hostOS {
+	case "linux": return arch + "-unknown-linux-gnu"
+	case "darwin": return arch + "-apple-darwin"
+	case "windows": return arch + "-w64-windows-gnu"
+	default: return arch + "-unknown-" + hostOS
+	}
+}
+
+// SetTarget picks the backend and target targetFlag names, "backend/target", defaulting the target for the host.
+// lookup finds the backends, and a target is either one of a backend's sub-targets or, for those that take them,
+// a target triple
+func (c *Config) SetTarget(hostOS, hostArch, targetFlag string, lookup func(string) (BackendTargets, bool)) error {
 	c.GOOS, c.GOARCH, c.BackendName = hostOS, hostArch, "qbe"
 
 	if targetFlag != "" {
@@ -178,37 +234,32 @@ func (c *Config) SetTarget(hostOS, hostArch, targetFlag string) {
 		if len(parts) > 1 { c.BackendTarget = parts[1] }
 	}
 
-	validQBETargets := map[string]string{
-		"amd64_apple": "amd64", "amd64_sysv": "amd64", "arm64": "arm64",
-		"arm64_apple": "arm64", "rv64": "riscv64",
-	}
+	backend, ok := lookup(c.BackendName)
+	if !ok { return fmt.Errorf("unsupported backend '%s' (see --list-targets)", c.BackendName) }
 
-	if c.BackendName == "qbe" {
+	if c.BackendTarget == "" {
+		c.BackendTarget = backend.Default(hostOS, hostArch)
 		if c.BackendTarget == "" {
-			c.BackendTarget = libqbe.DefaultTarget(hostOS, hostArch)
-			fmt.Fprintf(os.Stderr, "gbc: info: no target specified, defaulting to host target '%s' for backend '%s'\n", c.BackendTarget, c.BackendName)
+			c.BackendTarget = HostTriple(hostOS, hostArch)
 		}
-		if goArch, ok := validQBETargets[c.BackendTarget]; ok {
+		fmt.Fprintf(os.Stderr, "gbc: info: no target specified, defaulting to '%s' for backend '%s'\n", c.BackendTarget, c.BackendName)
+	}
+
+	found := false
+	for _, sub := range backend.SubTargets() {
+		if sub.Name != c.BackendTarget { continue }
+		c.GOARCH, found = sub.GOARCH, true
+		if sub.GOOS != "" { c.GOOS = sub.GOOS }
+	}
+	if !found && !backend.TakesTriples() {
+		return fmt.Errorf("backend '%s' has no target '%s' (see --list-targets)", c.BackendName, c.BackendTarget)
+	}
+	if !found {
+		parts := strings.Split(c.BackendTarget, "-")
+		if goArch, ok := archTranslations[parts[0]]; ok {
 			c.GOARCH = goArch
 		} else {
-			fmt.Fprintf(os.Stderr, "gbc: warning: unsupported QBE target '%s', defaulting to GOARCH '%s'\n", c.BackendTarget, c.GOARCH)
-		}
-	} else {
-		if c.BackendTarget == "" {
-			tradArch := archTranslations[hostArch]
-			if tradArch == "" {
-				tradArch = hostArch
-			}
-			c.BackendTarget = fmt.Sprintf("%s-unknown-%s-unknown", tradArch, hostOS)
-			fmt.Fprintf(os.Stderr, "gbc: info: no target specified, defaulting to host target '%s' for backend '%s'\n", c.BackendTarget, c.BackendName)
-		}
-		parts := strings.Split(c.BackendTarget, "-")
-		if len(parts) > 0 {
-			if goArch, ok := archTranslations[parts[0]]; ok {
-				c.GOARCH = goArch
-			} else {
-				c.GOARCH = parts[0]
-			}
+			c.GOARCH = parts[0]
 		}
 		if len(parts) > 2 && parts[2] != "unknown" {
 			c.GOOS = parts[2]
@@ -224,6 +275,7 @@ func (c *Config) SetTarget(hostOS, hostArch, targetFlag string) {
 	}
 
 	fmt.Fprintf(os.Stderr, "gbc: info: using backend '%s' with target '%s' (GOOS=%s, GOARCH=%s)\n", c.BackendName, c.BackendTarget, c.GOOS, c.GOARCH)
+	return nil
 }
 
 func (c *Config) SetFeature(ft Feature, enabled bool) {
@@ -262,7 +314,11 @@ func (c *Config) ApplyStd(stdName string) error {
 		{FeatBxDeclarations, false, true}, {FeatStrictDecl, false, isPedantic},
 		{FeatContinue, false, true}, {FeatNoDirectives, false, false},
 		{FeatFloat, false, true}, {FeatStrictTypes, false, false},
-		{FeatPromTypes, false, false},
+		{FeatPromTypes, false, false}, {FeatBoundsCheck, false, false},
+		{FeatCheckNil, false, false}, {FeatTrapv, false, false},
+		{FeatCheckDiv, false, false}, {FeatProfile, false, false},
+		{FeatInstrumentFunctions, false, false}, {FeatCoverage, false, false},
+		{FeatDefer, false, true}, {FeatCLoops, false, true},
 	}
 
 	switch stdName {
@@ -352,6 +408,8 @@ func (c *Config) ProcessArgs(args []string) error {
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
 		switch {
+		case arg == "-g":
+			c.DebugInfo = true
 		case strings.HasPrefix(arg, "-l"):
 			c.LibRequests = append(c.LibRequests, strings.TrimPrefix(arg, "-l"))
 		case strings.HasPrefix(arg, "-L"):
@@ -0,0 +1,334 @@
+package elf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// EntrySymbol is where a linked executable starts
+const EntrySymbol = "_start"
+
+const (
+	baseAddr = 0x400000
+	pageSize = 0x1000
+
+	ptLoad     = 1
+	ptGNUStack = 0x6474E551
+
+	pfX = 1
+	pfW = 2
+	pfR = 4
+)
+
+// Defines tells whether one of objs defines the global symbol name
+func Defines(objs []*Object, name string) bool {
+	for _, o := range objs {
+		if sym := o.Lookup(name); sym != nil && sym.Defined() && (sym.Global || sym.Weak) { return true }
+	}
+	return false
+}
+
+// segment is one of the output sections, in a loadable segment of its own: .text, .rodata, .data, then .bss
+type segment struct {
+	name   string
+	flags  uint64
+	prot   uint32
+	inputs []*Section
+	align  uint64
+	addr   uint64
+	off    uint64
+	size   uint64
+	data   []byte
+}
+
+type linker struct {
+	segs    []*segment
+	addr    map[*Section]uint64
+	globals map[string]uint64
+	commons map[string]*Symbol
+}
+
+// classify picks the output section of an input section; sections that are not loaded are dropped
+func (l *linker) classify(sec *Section) *segment {
+	switch {
+	case !sec.alloc(): return nil
+	case sec.Flags&SHF_EXECINSTR != 0: return l.segs[0]
+	case sec.Flags&SHF_WRITE == 0: return l.segs[1]
+	case sec.Type == SHT_NOBITS: return l.segs[3]
+	}
+	return l.segs[2]
+}
+
+// Link links objs into a static executable for Linux on x86-64, loaded at 0x400000 and started at _start, with
+// nothing else to resolve symbols against: every symbol the objects reference must be defined by one of them
+func Link(objs []*Object) ([]byte, error) {
+	l := &linker{
+		segs: []*segment{
+			{name: ".text", flags: SHF_ALLOC | SHF_EXECINSTR, prot: pfR | pfX},
+			{name: ".rodata", flags: SHF_ALLOC, prot: pfR},
+			{name: ".data", flags: SHF_ALLOC | SHF_WRITE, prot: pfR | pfW},
+			{name: ".bss", flags: SHF_ALLOC | SHF_WRITE, prot: pfR | pfW},
+		},
+		addr:    make(map[*Section]uint64),
+		globals: make(map[string]uint64),
+		commons: make(map[string]*Symbol),
+	}
+	for _, o := range objs {
+		for _, sec := range o.Sections {
+			if seg := l.classify(sec); seg != nil { seg.inputs = append(seg.inputs, sec) }
+		}
+	}
+	if err := l.collectCommons(objs); err != nil { return nil, err }
+	l.layout()
+	if err := l.resolve(objs); err != nil { return nil, err }
+	entry, ok := l.globals[EntrySymbol]
+	if !ok { return nil, fmt.Errorf("elf: undefined entry symbol %s", EntrySymbol) }
+	for _, o := range objs {
+		if err := l.relocate(o); err != nil { return nil, err }
+	}
+	return l.write(entry), nil
+}
+
+// collectCommons gives every common symbol, the largest of those of a name, a place at the end of .bss
+func (l *linker) collectCommons(objs []*Object) error {
+	for _, o := range objs {
+		for _, sym := range o.Symbols {
+			if !sym.Common { continue }
+			if prev, ok := l.commons[sym.Name]; !ok || sym.Size > prev.Size { l.commons[sym.Name] = sym }
+		}
+	}
+	names := make([]string, 0, len(l.commons))
+	for name := range l.commons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sym := l.commons[name]
+		sec := &Section{Name: ".bss", Type: SHT_NOBITS, Flags: SHF_ALLOC | SHF_WRITE, Align: max(sym.Value, 1), Size: sym.Size}
+		l.segs[3].inputs = append(l.segs[3].inputs, sec)
+		l.commons[name] = &Symbol{Name: name, Section: sec, Global: true}
+	}
+	return nil
+}
+
+func alignUp(v, align uint64) uint64 {
+	if align <= 1 { return v }
+	return (v + align - 1) / align * align
+}
+
+// layout places the segments, each on a page of its own and at the same offset in the file and in memory, the
+// first one right after the headers it maps with it, and .bss in the same page as .data but in no part of the file
+func (l *linker) layout() {
+	off := uint64(ehdrSize + phdrSize*l.phnum())
+	for i, seg := range l.segs {
+		switch i {
+		case 0: seg.off, seg.addr = 0, baseAddr
+		case 3:
+			data := l.segs[2]
+			seg.off, seg.addr = data.off+data.size, data.addr+data.size
+		default:
+			off = alignUp(off, pageSize)
+			seg.off, seg.addr = off, baseAddr+off
+		}
+		pos := seg.addr
+		if i == 0 { pos += off }
+		seg.align = 1
+		for _, sec := range seg.inputs {
+			pos = alignUp(pos, max(sec.Align, 1))
+			seg.align = max(seg.align, sec.Align)
+			l.addr[sec] = pos
+			pos += sec.Len()
+		}
+		seg.size = pos - seg.addr
+		if i == 3 { continue }
+		seg.data = make([]byte, seg.size)
+		for _, sec := range seg.inputs {
+			if sec.Type != SHT_NOBITS { copy(seg.data[l.addr[sec]-seg.addr:], sec.Data) }
+		}
+		off = seg.off + seg.size
+	}
+}
+
+// used tells whether the segment of l.segs[i] is there at all: .text always is, with the headers, and .data is
+// whenever .bss is
+func (l *linker) used(i int) bool {
+	if i == 0 { return true }
+	segs := l.segs[i : i+1]
+	if i == 2 { segs = l.segs[2:4] }
+	for _, seg := range segs {
+		for _, sec := range seg.inputs {
+			if sec.Len() > 0 { return true }
+		}
+	}
+	return false
+}
+
+// phnum counts the program headers: the loadable segments, and the one asking for a stack that is not executable
+func (l *linker) phnum() int {
+	n := 1
+	for i := range l.segs[:3] {
+		if l.used(i) { n++ }
+	}
+	return n
+}
+
+// resolve gives every global symbol its address; a weak definition gives way to a strong one
+func (l *linker) resolve(objs []*Object) error {
+	weak := make(map[string]bool)
+	for name, sym := range l.commons {
+		l.globals[name] = l.addr[sym.Section]
+	}
+	for _, o := range objs {
+		for _, sym := range o.Symbols {
+			if !sym.Global && !sym.Weak || sym.Section == nil { continue }
+			addr := l.addr[sym.Section] + sym.Value
+			if _, dup := l.globals[sym.Name]; dup {
+				if sym.Weak { continue }
+				if !weak[sym.Name] {
+					if _, common := l.commons[sym.Name]; !common { return fmt.Errorf("elf: multiple definitions of '%s'", sym.Name) }
+				}
+			}
+			l.globals[sym.Name], weak[sym.Name] = addr, sym.Weak
+		}
+	}
+	var undefined []string
+	for _, o := range objs {
+		for _, sym := range o.Symbols {
+			if _, ok := l.globals[sym.Name]; ok || sym.Defined() || sym.Weak { continue }
+			undefined = append(undefined, sym.Name)
+		}
+	}
+	if len(undefined) > 0 {
+		sort.Strings(undefined)
+		return fmt.Errorf("elf: undefined symbols: %s", strings.Join(dedup(undefined), ", "))
+	}
+	return nil
+}
+
+func dedup(names []string) []string {
+	out := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] { out = append(out, name) }
+	}
+	return out
+}
+
+func (l *linker) symAddr(sym *Symbol) uint64 {
+	switch {
+	case sym.Type == STT_SECTION: return l.addr[sym.Section]
+	case !sym.Global && !sym.Weak && sym.Section != nil: return l.addr[sym.Section] + sym.Value
+	}
+	return l.globals[sym.Name] // 0 for an undefined weak symbol
+}
+
+func (l *linker) relocate(o *Object) error {
+	le := binary.LittleEndian
+	for _, sec := range o.Sections {
+		seg := l.classify(sec)
+		if seg == nil || len(sec.Relocs) == 0 { continue }
+		if sec.Type == SHT_NOBITS { return fmt.Errorf("elf: relocations in %s, which has no data", sec.Name) }
+		for _, r := range sec.Relocs {
+			p := l.addr[sec] + r.Offset
+			at := seg.data[p-seg.addr:]
+			v := int64(l.symAddr(r.Symbol)) + r.Addend
+			switch r.Type {
+			case R_X86_64_64: le.PutUint64(at, uint64(v))
+			case R_X86_64_PC32, R_X86_64_PLT32:
+				v -= int64(p)
+				if v != int64(int32(v)) { return fmt.Errorf("elf: relocation against '%s' out of range", r.Symbol.Name) }
+				le.PutUint32(at, uint32(v))
+			case R_X86_64_32:
+				if v != int64(uint32(v)) { return fmt.Errorf("elf: relocation against '%s' out of range", r.Symbol.Name) }
+				le.PutUint32(at, uint32(v))
+			case R_X86_64_32S:
+				if v != int64(int32(v)) { return fmt.Errorf("elf: relocation against '%s' out of range", r.Symbol.Name) }
+				le.PutUint32(at, uint32(v))
+			default: return fmt.Errorf("elf: unsupported relocation type %d in %s", r.Type, sec.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// write lays out the executable: the headers and the segments, then the symbol table of the globals and the
+// section headers, so that the usual tools can look into it
+func (l *linker) write(entry uint64) []byte {
+	le := binary.LittleEndian
+	var out bytes.Buffer
+	out.Write(make([]byte, ehdrSize))
+	for i, seg := range l.segs[:3] {
+		if !l.used(i) { continue }
+		memsz := seg.size
+		if i == 2 { memsz = l.segs[3].addr + l.segs[3].size - seg.addr }
+		out.Write(le.AppendUint32(nil, ptLoad))
+		out.Write(le.AppendUint32(nil, seg.prot))
+		for _, v := range []uint64{seg.off, seg.addr, seg.addr, seg.size, memsz, pageSize} {
+			out.Write(le.AppendUint64(nil, v))
+		}
+	}
+	out.Write(le.AppendUint32(nil, ptGNUStack))
+	out.Write(le.AppendUint32(nil, pfR|pfW))
+	for _, v := range []uint64{0, 0, 0, 0, 0, 16} {
+		out.Write(le.AppendUint64(nil, v))
+	}
+
+	shstr, str := newStrtab(), newStrtab()
+	headers := []shdr{{}}
+	shndx := make([]uint16, len(l.segs))
+	for i, seg := range l.segs {
+		if i < 3 && l.used(i) {
+			// The first segment starts with the headers, which are already written
+			for uint64(out.Len()) < seg.off {
+				out.WriteByte(0)
+			}
+			out.Write(seg.data[uint64(out.Len())-seg.off:])
+		}
+		if seg.size == 0 { continue }
+		h := shdr{name: shstr.add(seg.name), typ: SHT_PROGBITS, flags: seg.flags, addr: seg.addr, off: seg.off, size: seg.size, align: seg.align}
+		if i == 3 { h.typ = SHT_NOBITS }
+		if i == 0 && len(seg.inputs) > 0 {
+			// .text itself starts past the headers
+			start := l.addr[seg.inputs[0]]
+			h.addr, h.off, h.size = start, start-baseAddr, seg.addr+seg.size-start
+		}
+		shndx[i] = uint16(len(headers))
+		headers = append(headers, h)
+	}
+
+	names := make([]string, 0, len(l.globals))
+	for name := range l.globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var symtab bytes.Buffer
+	writeSym(&symtab, 0, 0, 0, 0, 0)
+	for _, name := range names {
+		addr, index := l.globals[name], uint16(shnAbs)
+		for i, seg := range l.segs {
+			if shndx[i] != 0 && addr >= seg.addr && addr < seg.addr+seg.size { index = shndx[i] }
+		}
+		writeSym(&symtab, str.add(name), stbGlobal<<4, index, addr, 0)
+	}
+	pad(&out, 8)
+	headers = append(headers, shdr{name: shstr.add(".symtab"), typ: SHT_SYMTAB, off: uint64(out.Len()), size: uint64(symtab.Len()),
+		link: uint32(len(headers) + 1), info: 1, align: 8, entsize: symSize})
+	out.Write(symtab.Bytes())
+	headers = append(headers, shdr{name: shstr.add(".strtab"), typ: SHT_STRTAB, off: uint64(out.Len()), size: uint64(str.Len()), align: 1})
+	out.Write(str.Bytes())
+	headers = append(headers, shdr{name: shstr.add(".shstrtab"), typ: SHT_STRTAB, off: uint64(out.Len()), size: uint64(shstr.Len()), align: 1})
+	out.Write(shstr.Bytes())
+	pad(&out, 8)
+	shoff := uint64(out.Len())
+	for i := range headers {
+		headers[i].write(&out)
+	}
+
+	var ehdr bytes.Buffer
+	writeEhdr(&ehdr, etExec, entry, ehdrSize, shoff, uint16(l.phnum()), uint16(len(headers)), uint16(len(headers)-1))
+	b := out.Bytes()
+	copy(b, ehdr.Bytes())
+	return b
+}
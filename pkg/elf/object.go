@@ -0,0 +1,296 @@
+// Package elf writes ELF64 relocatable objects for x86-64, and links them into static executables for Linux
+package elf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Section types and flags
+const (
+	SHT_PROGBITS = 1
+	SHT_SYMTAB   = 2
+	SHT_STRTAB   = 3
+	SHT_RELA     = 4
+	SHT_NOBITS   = 8
+
+	SHF_WRITE     = 0x1
+	SHF_ALLOC     = 0x2
+	SHF_EXECINSTR = 0x4
+	SHF_INFO_LINK = 0x40
+)
+
+// Symbol types
+const (
+	STT_NOTYPE  = 0
+	STT_OBJECT  = 1
+	STT_FUNC    = 2
+	STT_SECTION = 3
+)
+
+// Relocation types of x86-64
+const (
+	R_X86_64_64    = 1
+	R_X86_64_PC32  = 2
+	R_X86_64_PLT32 = 4
+	R_X86_64_32    = 10
+	R_X86_64_32S   = 11
+)
+
+const (
+	stbLocal  = 0
+	stbGlobal = 1
+	stbWeak   = 2
+
+	shnAbs    = 0xFFF1
+	shnCommon = 0xFFF2
+
+	etRel    = 1
+	etExec   = 2
+	emX86_64 = 62
+
+	ehdrSize = 64
+	phdrSize = 56
+	shdrSize = 64
+	symSize  = 24
+	relaSize = 24
+)
+
+// Object is a relocatable object: its sections, with the relocations against them, and its symbols
+type Object struct {
+	Sections    []*Section
+	Symbols     []*Symbol
+	sectionSyms map[*Section]*Symbol
+}
+
+// Section is a section of an object; a NOBITS one has a Size and no Data
+type Section struct {
+	Name   string
+	Type   uint32
+	Flags  uint64
+	Align  uint64
+	Data   []byte
+	Size   uint64
+	Relocs []Reloc
+}
+
+// Symbol is a symbol of an object, undefined when it has no Section and is not Common
+type Symbol struct {
+	Name    string
+	Section *Section
+	Value   uint64 // the alignment of a common symbol
+	Size    uint64
+	Type    uint8
+	Global  bool
+	Weak    bool
+	Common  bool
+}
+
+// Reloc asks for the value of Symbol plus Addend at Offset of its section, computed the way Type says
+type Reloc struct {
+	Offset uint64
+	Type   uint32
+	Symbol *Symbol
+	Addend int64
+}
+
+// Len is the size of a section, whether or not it has data
+func (s *Section) Len() uint64 {
+	if s.Type == SHT_NOBITS { return s.Size }
+	return uint64(len(s.Data))
+}
+
+func (s *Section) alloc() bool { return s.Flags&SHF_ALLOC != 0 }
+
+// Defined tells whether sym has a value in its object
+func (sym *Symbol) Defined() bool { return sym.Section != nil || sym.Common }
+
+// SectionSymbol is the symbol standing for the start of sec, which relocations against local labels use
+func (o *Object) SectionSymbol(sec *Section) *Symbol {
+	if o.sectionSyms == nil { o.sectionSyms = make(map[*Section]*Symbol) }
+	if sym, ok := o.sectionSyms[sec]; ok { return sym }
+	sym := &Symbol{Section: sec, Type: STT_SECTION}
+	o.sectionSyms[sec] = sym
+	return sym
+}
+
+// Lookup finds the named symbol of o, or returns nil
+func (o *Object) Lookup(name string) *Symbol {
+	for _, sym := range o.Symbols {
+		if sym.Name == name { return sym }
+	}
+	return nil
+}
+
+type strtab struct {
+	bytes.Buffer
+	offsets map[string]uint32
+}
+
+func newStrtab() *strtab {
+	t := &strtab{offsets: make(map[string]uint32)}
+	t.WriteByte(0)
+	return t
+}
+
+func (t *strtab) add(s string) uint32 {
+	if s == "" { return 0 }
+	if off, ok := t.offsets[s]; ok { return off }
+	off := uint32(t.Len())
+	t.WriteString(s)
+	t.WriteByte(0)
+	t.offsets[s] = off
+	return off
+}
+
+type shdr struct {
+	name                   uint32
+	typ                    uint32
+	flags, addr, off, size uint64
+	link, info             uint32
+	align, entsize         uint64
+}
+
+func (h *shdr) write(w *bytes.Buffer) {
+	le := binary.LittleEndian
+	w.Write(le.AppendUint32(nil, h.name))
+	w.Write(le.AppendUint32(nil, h.typ))
+	for _, v := range []uint64{h.flags, h.addr, h.off, h.size} {
+		w.Write(le.AppendUint64(nil, v))
+	}
+	w.Write(le.AppendUint32(nil, h.link))
+	w.Write(le.AppendUint32(nil, h.info))
+	w.Write(le.AppendUint64(nil, h.align))
+	w.Write(le.AppendUint64(nil, h.entsize))
+}
+
+func writeSym(w *bytes.Buffer, name uint32, info byte, shndx uint16, value, size uint64) {
+	le := binary.LittleEndian
+	w.Write(le.AppendUint32(nil, name))
+	w.WriteByte(info)
+	w.WriteByte(0)
+	w.Write(le.AppendUint16(nil, shndx))
+	w.Write(le.AppendUint64(nil, value))
+	w.Write(le.AppendUint64(nil, size))
+}
+
+func writeEhdr(w *bytes.Buffer, typ uint16, entry, phoff, shoff uint64, phnum, shnum, shstrndx uint16) {
+	le := binary.LittleEndian
+	w.Write([]byte{0x7F, 'E', 'L', 'F', 2, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	w.Write(le.AppendUint16(nil, typ))
+	w.Write(le.AppendUint16(nil, emX86_64))
+	w.Write(le.AppendUint32(nil, 1))
+	w.Write(le.AppendUint64(nil, entry))
+	w.Write(le.AppendUint64(nil, phoff))
+	w.Write(le.AppendUint64(nil, shoff))
+	w.Write(le.AppendUint32(nil, 0))
+	w.Write(le.AppendUint16(nil, ehdrSize))
+	w.Write(le.AppendUint16(nil, phdrSize))
+	w.Write(le.AppendUint16(nil, phnum))
+	w.Write(le.AppendUint16(nil, shdrSize))
+	w.Write(le.AppendUint16(nil, shnum))
+	w.Write(le.AppendUint16(nil, shstrndx))
+}
+
+func pad(w *bytes.Buffer, align uint64) {
+	for align > 1 && uint64(w.Len())%align != 0 {
+		w.WriteByte(0)
+	}
+}
+
+func symInfo(sym *Symbol) byte {
+	bind := byte(stbLocal)
+	switch {
+	case sym.Weak: bind = stbWeak
+	case sym.Global: bind = stbGlobal
+	}
+	return bind<<4 | sym.Type
+}
+
+// Bytes writes o as an ELF64 relocatable object: its sections, then one .rela section for each with relocations,
+// and the symbol table, whose local symbols, the section symbols first, come before the global ones
+func (o *Object) Bytes() ([]byte, error) {
+	shstr, str := newStrtab(), newStrtab()
+	index := make(map[*Section]int, len(o.Sections))
+	for i, sec := range o.Sections {
+		index[sec] = i + 1
+	}
+
+	// The symbol table: a section symbol for each section relocations need one for, the locals, then the rest
+	var syms []*Symbol
+	for _, sec := range o.Sections {
+		if sym, ok := o.sectionSyms[sec]; ok { syms = append(syms, sym) }
+	}
+	for _, sym := range o.Symbols {
+		if !sym.Global && !sym.Weak { syms = append(syms, sym) }
+	}
+	firstGlobal := len(syms) + 1
+	for _, sym := range o.Symbols {
+		if sym.Global || sym.Weak { syms = append(syms, sym) }
+	}
+	symIndex := make(map[*Symbol]int, len(syms))
+	var symtab bytes.Buffer
+	writeSym(&symtab, 0, 0, 0, 0, 0)
+	for i, sym := range syms {
+		symIndex[sym] = i + 1
+		shndx, value := uint16(0), sym.Value
+		switch {
+		case sym.Common: shndx = shnCommon
+		case sym.Section != nil: shndx = uint16(index[sym.Section])
+		}
+		writeSym(&symtab, str.add(sym.Name), symInfo(sym), shndx, value, sym.Size)
+	}
+
+	var out bytes.Buffer
+	out.Write(make([]byte, ehdrSize))
+	var headers []shdr
+	headers = append(headers, shdr{})
+	for _, sec := range o.Sections {
+		align := max(sec.Align, 1)
+		pad(&out, align)
+		h := shdr{name: shstr.add(sec.Name), typ: sec.Type, flags: sec.Flags, off: uint64(out.Len()), size: sec.Len(), align: align}
+		if sec.Type != SHT_NOBITS { out.Write(sec.Data) }
+		headers = append(headers, h)
+	}
+	symtabIndex := uint32(len(o.Sections) + 1)
+	for _, sec := range o.Sections {
+		if len(sec.Relocs) == 0 { continue }
+		symtabIndex++
+	}
+	for _, sec := range o.Sections {
+		if len(sec.Relocs) == 0 { continue }
+		pad(&out, 8)
+		h := shdr{name: shstr.add(".rela" + sec.Name), typ: SHT_RELA, flags: SHF_INFO_LINK, off: uint64(out.Len()),
+			link: symtabIndex, info: uint32(index[sec]), align: 8, entsize: relaSize}
+		for _, r := range sec.Relocs {
+			i, ok := symIndex[r.Symbol]
+			if !ok { return nil, fmt.Errorf("elf: relocation in %s against a symbol not in the object", sec.Name) }
+			out.Write(binary.LittleEndian.AppendUint64(nil, r.Offset))
+			out.Write(binary.LittleEndian.AppendUint64(nil, uint64(i)<<32|uint64(r.Type)))
+			out.Write(binary.LittleEndian.AppendUint64(nil, uint64(r.Addend)))
+		}
+		h.size = uint64(out.Len()) - h.off
+		headers = append(headers, h)
+	}
+	pad(&out, 8)
+	headers = append(headers, shdr{name: shstr.add(".symtab"), typ: SHT_SYMTAB, off: uint64(out.Len()), size: uint64(symtab.Len()),
+		link: symtabIndex + 1, info: uint32(firstGlobal), align: 8, entsize: symSize})
+	out.Write(symtab.Bytes())
+	headers = append(headers, shdr{name: shstr.add(".strtab"), typ: SHT_STRTAB, off: uint64(out.Len()), size: uint64(str.Len()), align: 1})
+	out.Write(str.Bytes())
+	shstrName := shstr.add(".shstrtab")
+	headers = append(headers, shdr{name: shstrName, typ: SHT_STRTAB, off: uint64(out.Len()), size: uint64(shstr.Len()), align: 1})
+	out.Write(shstr.Bytes())
+
+	pad(&out, 8)
+	shoff := uint64(out.Len())
+	for i := range headers {
+		headers[i].write(&out)
+	}
+	var ehdr bytes.Buffer
+	writeEhdr(&ehdr, etRel, 0, 0, shoff, 0, uint16(len(headers)), uint16(len(headers)-1))
+	b := out.Bytes()
+	copy(b, ehdr.Bytes())
+	return b, nil
+}
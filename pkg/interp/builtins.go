@@ -0,0 +1,371 @@
+package interp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/token"
+)
+
+// builtinFunc implements an external function in Go; floating-point arguments arrive as float64 bits
+type builtinFunc func(in *Interpreter, tok token.Token, args []int64) int64
+
+var builtins map[string]builtinFunc
+
+// externVars are the external variables a program may declare with extrn
+var externVars = map[string]int64{
+	"stdin":  fileBase,
+	"stdout": fileBase + 8,
+	"stderr": fileBase + 16,
+}
+
+func init() {
+	builtins = map[string]builtinFunc{
+		"putchar": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			c := arg(args, 0)
+			in.print(string([]byte{byte(c)}))
+			return c & 0xff
+		},
+		"getchar": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			in.syncOutput()
+			c, err := in.stdin.ReadByte()
+			if err != nil { return cInt(-1) }
+			return int64(c)
+		},
+		"printf": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			s := in.format(tok, arg(args, 0), args[min(1, len(args)):])
+			in.print(s)
+			return int64(len(s))
+		},
+		"fprintf": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			s := in.format(tok, arg(args, 1), args[min(2, len(args)):])
+			io.WriteString(in.file(tok, arg(args, 0)), s)
+			return int64(len(s))
+		},
+		"dprintf": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			s := in.format(tok, arg(args, 1), args[min(2, len(args)):])
+			io.WriteString(in.file(tok, fileBase+arg(args, 0)*8), s)
+			return int64(len(s))
+		},
+		"sprintf": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			s := in.format(tok, arg(args, 1), args[min(2, len(args)):])
+			in.blit(tok, arg(args, 0), in.stringAddr(s), int64(len(s))+1)
+			return int64(len(s))
+		},
+		"puts": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			in.print(in.cString(tok, arg(args, 0)) + "\n")
+			return 0
+		},
+		"fputs": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			io.WriteString(in.file(tok, arg(args, 1)), in.cString(tok, arg(args, 0)))
+			return 0
+		},
+		"fflush": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			in.stdout.Flush()
+			return 0
+		},
+		"exit": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			panic(exitRequest{int(arg(args, 0) & 0xff)})
+		},
+		"abort": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			// Like the C library's, abort says nothing; whatever is reported was printed by the program
+			in.fault(tok, sigABRT, "")
+			return 0
+		},
+		"char": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			return in.load(tok, arg(args, 0)+arg(args, 1), ir.TypeUB)
+		},
+		"lchar": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			in.store(tok, arg(args, 0)+arg(args, 1), ir.TypeB, arg(args, 2))
+			return arg(args, 2)
+		},
+		"strlen": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			return int64(len(in.cString(tok, arg(args, 0))))
+		},
+		"atoi": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			s := strings.TrimLeft(in.cString(tok, arg(args, 0)), " \t\n")
+			end := 0
+			for end < len(s) && (s[end] >= '0' && s[end] <= '9' || end == 0 && (s[end] == '-' || s[end] == '+')) {
+				end++
+			}
+			n, _ := strconv.ParseInt(s[:end], 10, 32)
+			return cInt(n)
+		},
+		"malloc": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			return in.malloc(arg(args, 0))
+		},
+		"calloc": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			return in.malloc(arg(args, 0) * arg(args, 1))
+		},
+		"realloc": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			old, size := arg(args, 0), arg(args, 1)
+			addr := in.malloc(size)
+			if old != 0 { in.blit(tok, addr, old, min(in.heap[old], size)) }
+			return addr
+		},
+		"free": func(in *Interpreter, tok token.Token, args []int64) int64 { return 0 },
+		"memset": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			dst, n := arg(args, 0), arg(args, 2)
+			b := in.mem.bytes(dst, n)
+			if b == nil && n > 0 { in.segfault(tok, dst) }
+			for i := range b {
+				b[i] = byte(arg(args, 1))
+			}
+			return dst
+		},
+		"memcpy": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			in.blit(tok, arg(args, 0), arg(args, 1), arg(args, 2))
+			return arg(args, 0)
+		},
+		"usleep": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			time.Sleep(time.Duration(arg(args, 0)) * time.Microsecond)
+			return 0
+		},
+		"memmove": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			in.blit(tok, arg(args, 0), arg(args, 1), arg(args, 2))
+			return arg(args, 0)
+		},
+		"strcpy": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			s := in.cString(tok, arg(args, 1))
+			in.blit(tok, arg(args, 0), arg(args, 1), int64(len(s))+1)
+			return arg(args, 0)
+		},
+		"strcmp": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			return cInt(int64(strings.Compare(in.cString(tok, arg(args, 0)), in.cString(tok, arg(args, 1)))))
+		},
+		"toupper": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			c := arg(args, 0)
+			if c >= 'a' && c <= 'z' { return c - 'a' + 'A' }
+			return c
+		},
+		"read": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			if arg(args, 0) != 0 { return -1 }
+			in.syncOutput()
+			b := in.mem.bytes(arg(args, 1), arg(args, 2))
+			if b == nil { in.segfault(tok, arg(args, 1)) }
+			// Like read(2) on a terminal or pipe, return what is available rather than waiting for a full buffer
+			n, err := in.stdin.Read(b)
+			if err != nil && err != io.EOF { return -1 }
+			return int64(n)
+		},
+		"write": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			w := in.file(tok, fileBase+arg(args, 0)*8)
+			b := in.mem.bytes(arg(args, 1), arg(args, 2))
+			if b == nil { in.segfault(tok, arg(args, 1)) }
+			n, _ := w.Write(b)
+			return int64(n)
+		},
+		"scanf": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			in.syncOutput()
+			return cInt(in.scan(tok, arg(args, 0), args[min(1, len(args)):]))
+		},
+		"time": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			now := time.Now().Unix()
+			if arg(args, 0) != 0 { in.store(tok, arg(args, 0), ir.TypeL, now) }
+			return now
+		},
+		"localtime": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			return in.localtime(time.Unix(in.load(tok, arg(args, 0), ir.TypeL), 0))
+		},
+		"rand": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			in.rand = in.rand*6364136223846793005 + 1442695040888963407
+			return int64(in.rand>>33) & 0x7fffffff
+		},
+		"srand": func(in *Interpreter, tok token.Token, args []int64) int64 {
+			in.rand = uint64(arg(args, 0))
+			return 0
+		},
+	}
+}
+
+// cInt is the word a B program sees for a C int result: the callee only sets the low half of the
+// return register, which the supported ABIs zero-extend, so that EOF reads as 4294967295 as it does compiled
+func cInt(v int64) int64 { return int64(uint32(v)) }
+
+func arg(args []int64, i int) int64 {
+	if i < len(args) { return args[i] }
+	return 0
+}
+
+// malloc hands out blocks of the heap aligned like glibc's, remembering their size for realloc
+func (in *Interpreter) malloc(size int64) int64 {
+	addr := in.mem.heap.alloc(max(size, 1), 2*in.ws)
+	in.heap[addr] = size
+	return addr
+}
+
+// localtime fills the static struct tm that localtime(3) returns a pointer to
+func (in *Interpreter) localtime(t time.Time) int64 {
+	if in.tm == 0 { in.tm = in.mem.heap.alloc(56, in.ws) }
+	_, offset := t.Zone()
+	fields := []int{t.Second(), t.Minute(), t.Hour(), t.Day(), int(t.Month()) - 1, t.Year() - 1900, int(t.Weekday()), t.YearDay() - 1, 0}
+	for i, f := range fields {
+		in.store(token.Token{}, in.tm+int64(i)*4, ir.TypeW, int64(f))
+	}
+	in.store(token.Token{}, in.tm+40, ir.TypeL, int64(offset))
+	return in.tm
+}
+
+// stdoutWriter buffers program output like C stdio: fully when stdout is a file or a pipe, by line when Interactive
+type stdoutWriter struct{ in *Interpreter }
+
+func (w stdoutWriter) Write(p []byte) (int, error) {
+	n, err := w.in.stdout.Write(p)
+	if w.in.Interactive && bytes.IndexByte(p, '\n') >= 0 { w.in.stdout.Flush() }
+	return n, err
+}
+
+func (in *Interpreter) print(s string) { io.WriteString(stdoutWriter{in}, s) }
+
+// syncOutput flushes pending output before the program waits for input or writes to stderr, as C stdio does for a
+// terminal; a compiled program writing to a pipe keeps it buffered, and so does the interpreter
+func (in *Interpreter) syncOutput() {
+	if in.Interactive { in.stdout.Flush() }
+}
+
+// file maps a stdio handle to the stream it stands for
+func (in *Interpreter) file(tok token.Token, handle int64) io.Writer {
+	switch handle {
+	case externVars["stdout"]: return stdoutWriter{in}
+	case externVars["stderr"]:
+		in.syncOutput()
+		return in.stderr
+	}
+	in.fault(tok, sigSEGV, "invalid stream 0x%x", handle)
+	return nil
+}
+
+// scan implements the subset of scanf that B programs use: %d, %s and %c, with whitespace skipping
+// It returns the number of conversions stored, or -1 if input ended before the first one
+func (in *Interpreter) scan(tok token.Token, fmtAddr int64, args []int64) int64 {
+	f := in.cString(tok, fmtAddr)
+	var count int64
+	skipSpace := func() {
+		for {
+			c, err := in.stdin.ReadByte()
+			if err != nil { return }
+			if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+				in.stdin.UnreadByte()
+				return
+			}
+		}
+	}
+	eof := func() bool {
+		_, err := in.stdin.Peek(1)
+		return err != nil
+	}
+
+	for i := 0; i < len(f); i++ {
+		switch c := f[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			skipSpace()
+			continue
+		case c != '%':
+			if b, err := in.stdin.ReadByte(); err != nil || b != c { return count }
+			continue
+		}
+		for i++; i < len(f) && strings.IndexByte("hlLqjzt", f[i]) >= 0; i++ {}
+		if i >= len(f) || len(args) == 0 { break }
+		dst := args[0]
+		if f[i] != 'c' { skipSpace() }
+		if eof() {
+			if count == 0 { return -1 }
+			return count
+		}
+		var word []byte
+		for !eof() {
+			b, _ := in.stdin.ReadByte()
+			if f[i] == 'c' {
+				word = append(word, b)
+				break
+			}
+			isDigit := b >= '0' && b <= '9' || len(word) == 0 && (b == '-' || b == '+')
+			if b == ' ' || b == '\t' || b == '\n' || b == '\r' || f[i] == 'd' && !isDigit {
+				in.stdin.UnreadByte()
+				break
+			}
+			word = append(word, b)
+		}
+		switch f[i] {
+		case 'd', 'i':
+			n, err := strconv.ParseInt(string(word), 10, 32)
+			if err != nil { return count }
+			in.store(tok, dst, ir.TypeW, n)
+		case 's':
+			b := in.mem.bytes(dst, int64(len(word))+1)
+			if b == nil { in.segfault(tok, dst) }
+			b[copy(b, word)] = 0
+		case 'c': in.store(tok, dst, ir.TypeB, int64(word[0]))
+		default: return count
+		}
+		args = args[1:]
+		count++
+	}
+	return count
+}
+
+// format expands a printf format string with C semantics
+func (in *Interpreter) format(tok token.Token, fmtAddr int64, args []int64) string {
+	f := in.cString(tok, fmtAddr)
+	var sb strings.Builder
+	next := func() int64 {
+		if len(args) == 0 { return 0 }
+		v := args[0]
+		args = args[1:]
+		return v
+	}
+
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			sb.WriteByte(f[i])
+			continue
+		}
+		start := i
+		for i++; i < len(f) && strings.IndexByte("-+ #0", f[i]) >= 0; i++ {}
+		spec := f[start:i]
+		for ; i < len(f) && (f[i] >= '0' && f[i] <= '9' || f[i] == '*' || f[i] == '.'); i++ {
+			if f[i] == '*' {
+				spec += strconv.FormatInt(next(), 10)
+			} else {
+				spec += string(f[i])
+			}
+		}
+		// Every argument is passed as a word, of which C reads only as many bytes as the length modifier says
+		mod := i
+		for ; i < len(f) && strings.IndexByte("hlLqjzt", f[i]) >= 0; i++ {}
+		if i >= len(f) {
+			sb.WriteString(f[start:])
+			break
+		}
+		bits := 64
+		switch f[mod:i] {
+		case "hh": bits = 8
+		case "h": bits = 16
+		case "": bits = 32
+		}
+		signed := func(v int64) int64 { return v << (64 - bits) >> (64 - bits) }
+		unsigned := func(v int64) uint64 { return uint64(v) << (64 - bits) >> (64 - bits) }
+
+		switch verb := f[i]; verb {
+		case '%': sb.WriteByte('%')
+		case 'd', 'i': fmt.Fprintf(&sb, spec+"d", signed(next()))
+		case 'u': fmt.Fprintf(&sb, spec+"d", unsigned(next()))
+		case 'x', 'X', 'o': fmt.Fprintf(&sb, spec+string(verb), unsigned(next()))
+		case 'c': fmt.Fprintf(&sb, strings.Split(spec, ".")[0]+"s", string([]byte{byte(next())}))
+		case 's': fmt.Fprintf(&sb, spec+"s", in.cString(tok, next()))
+		case 'p': fmt.Fprintf(&sb, "0x%x", uint64(next()))
+		case 'f', 'F', 'e', 'E': fmt.Fprintf(&sb, spec+string(verb), toFloat(next(), ir.TypeD))
+		case 'g', 'G':
+			// Go's %g prints the shortest representation where C defaults to six significant digits
+			if !strings.Contains(spec, ".") { spec += ".6" }
+			fmt.Fprintf(&sb, spec+string(verb), toFloat(next(), ir.TypeD))
+		default: sb.WriteString(f[start : i+1])
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,103 @@
+package interp
+
+import (
+	"math"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/ast"
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/token"
+)
+
+// checkEnabled reports whether a runtime check feature applies to the running function, honouring
+// `// [b]: check:` directives the way codegen does
+func (in *Interpreter) checkEnabled(ft config.Feature) bool {
+	if in.fn != nil {
+		if enabled, ok := in.fn.checks[ft]; ok { return enabled }
+	}
+	return in.cfg.IsFeatureEnabled(ft)
+}
+
+// trap stops the program like the runtime hooks of a checked build do: it aborts, or exits with status if one is given
+func (in *Interpreter) trap(tok token.Token, status int, format string, args ...interface{}) {
+	f := in.newFault(tok, sigABRT, format, args...)
+	if status != 0 { f.Signal, f.Status = 0, status }
+	// The hooks flush stdio before reporting
+	in.stdout.Flush()
+	panic(f)
+}
+
+// checkBounds traps if a subscript of an array whose length is known falls outside it
+func (in *Interpreter) checkBounds(node *ast.Node, index int64) {
+	d := node.Data.(ast.SubscriptNode)
+	if !in.checkEnabled(config.FeatBoundsCheck) { return }
+	if length, ok := in.knownLength(d.Array); ok { in.checkIndex(node, index, length) }
+}
+
+// checkIndex traps if the index of a subscript falls outside [0,length)
+func (in *Interpreter) checkIndex(node *ast.Node, index, length int64) {
+	d := node.Data.(ast.SubscriptNode)
+	if !in.checkEnabled(config.FeatBoundsCheck) { return }
+	if typ := in.irType(d.Index.Typ); typ == ir.TypeW { index = int64(int32(index)) }
+	if index < 0 || index >= length { in.trap(node.Tok, 0, "index %d out of range [0,%d)", index, length) }
+}
+
+// knownLength returns the element count of an indexed expression when it is fixed at compile time
+func (in *Interpreter) knownLength(array *ast.Node) (int64, bool) {
+	if t := array.Typ; t != nil && t.Kind == ast.TYPE_ARRAY && t.ArraySize != nil { return in.evalConst(t.ArraySize) }
+	if array.Type != ast.Ident { return 0, false }
+
+	sym := in.lookup(array.Data.(ast.IdentNode).Name)
+	// Parameters decay to pointers
+	if sym == nil || sym.kind != symVar || sym.isParam || sym.node == nil || sym.node.Type != ast.VarDecl { return 0, false }
+
+	d := sym.node.Data.(ast.VarDeclNode)
+	if d.Type != nil && d.Type.Kind == ast.TYPE_ARRAY && d.Type.ArraySize != nil { return in.evalConst(d.Type.ArraySize) }
+	if !d.IsVector { return 0, false }
+	if d.SizeExpr != nil { return in.evalConst(d.SizeExpr) }
+	if len(d.InitList) > 0 && d.InitList[0].Type != ast.String { return int64(len(d.InitList)), true }
+	return 0, false
+}
+
+// isCheckedIntType reports whether arithmetic of typ is covered by -Ftrapv and -Fcheck-div
+func isCheckedIntType(astType *ast.BxType, typ ir.Type) bool {
+	if typ != ir.TypeW && typ != ir.TypeL { return false }
+	if astType == nil { return true }
+	switch astType.Kind {
+	case ast.TYPE_UNTYPED, ast.TYPE_LITERAL_INT, ast.TYPE_ENUM: return true
+	case ast.TYPE_PRIMITIVE: return !strings.HasPrefix(astType.Name, "uint") && astType.Name != "byte" && astType.Name != "bool"
+	}
+	return false
+}
+
+// checkArith traps on the overflow or division by zero of l op r that -Ftrapv and -Fcheck-div catch
+func (in *Interpreter) checkArith(tok token.Token, op token.Type, typ *ast.BxType, l, r int64) {
+	resType := in.irType(typ)
+	trapv, checkDiv := in.checkEnabled(config.FeatTrapv), in.checkEnabled(config.FeatCheckDiv)
+	if (!trapv && !checkDiv) || !isCheckedIntType(typ, resType) { return }
+
+	minValue := int64(math.MinInt64)
+	if resType == ir.TypeW { l, r, minValue = int64(int32(l)), int64(int32(r)), math.MinInt32 }
+
+	var res int64
+	switch op {
+	case token.Slash, token.Rem:
+		if checkDiv && r == 0 { in.trap(tok, 0, "integer division by zero") }
+		if trapv && l == minValue && r == -1 { in.trap(tok, 0, "integer overflow") }
+		return
+	case token.Plus: res = l + r
+	case token.Minus: res = l - r
+	case token.Star: res = l * r
+	}
+
+	var overflow bool
+	switch {
+	// Both operands fit in 32 bits, so the 64-bit result is exact
+	case resType == ir.TypeW: overflow = res != int64(int32(res))
+	case op == token.Plus: overflow = (l^res)&(r^res) < 0
+	case op == token.Minus: overflow = (l^r)&(l^res) < 0
+	case op == token.Star: overflow = l != 0 && (res/l != r || l == -1 && r == minValue)
+	}
+	if trapv && overflow { in.trap(tok, 0, "integer overflow") }
+}
@@ -0,0 +1,493 @@
+package interp
+
+import (
+	"math"
+
+	"github.com/xplshn/gbc/pkg/ast"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/token"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// baseOps maps assignment operators to the binary operator they apply
+var baseOps = map[token.Type]token.Type{
+	token.PlusEq: token.Plus, token.EqPlus: token.Plus,
+	token.MinusEq: token.Minus, token.EqMinus: token.Minus,
+	token.StarEq: token.Star, token.EqStar: token.Star,
+	token.SlashEq: token.Slash, token.EqSlash: token.Slash,
+	token.RemEq: token.Rem, token.EqRem: token.Rem,
+	token.AndEq: token.And, token.EqAnd: token.And,
+	token.OrEq: token.Or, token.EqOr: token.Or,
+	token.XorEq: token.Xor, token.EqXor: token.Xor,
+	token.ShlEq: token.Shl, token.EqShl: token.Shl,
+	token.ShrEq: token.Shr, token.EqShr: token.Shr,
+}
+
+// eval computes the value of an expression as a word
+// Floating-point values are carried as their bit patterns: float32 in the low half, float64 in the whole word
+func (in *Interpreter) eval(node *ast.Node) int64 {
+	if node == nil { return 0 }
+	switch node.Type {
+	case ast.Number: return node.Data.(ast.NumberNode).Value
+	case ast.FloatNumber: return fromFloat(node.Data.(ast.FloatNumberNode).Value, floatIRType(in.irType(node.Typ)))
+	case ast.String: return in.stringAddr(node.Data.(ast.StringNode).Value)
+	case ast.Nil: return 0
+	case ast.Ident: return in.evalIdent(node)
+	case ast.Assign: return in.evalAssign(node)
+	case ast.MultiAssign:
+		d := node.Data.(ast.MultiAssignNode)
+		vals := make([]int64, len(d.Rhs))
+		for i, rhs := range d.Rhs {
+			vals[i] = in.eval(rhs)
+		}
+		var last int64
+		for i, lhs := range d.Lhs {
+			last = in.convert(vals[i], d.Rhs[i].Typ, lhs.Typ)
+			in.store(lhs.Tok, in.lvalue(lhs), in.irType(lhs.Typ), last)
+		}
+		return last
+	case ast.BinaryOp:
+		d := node.Data.(ast.BinaryOpNode)
+		switch d.Op {
+		case token.AndAnd: return b2i(in.eval(d.Left) != 0 && in.eval(d.Right) != 0)
+		case token.OrOr: return b2i(in.eval(d.Left) != 0 || in.eval(d.Right) != 0)
+		}
+		l := in.eval(d.Left)
+		r := in.eval(d.Right)
+		return in.binary(node.Tok, d.Op, node.Typ, l, d.Left.Typ, r, d.Right.Typ)
+	case ast.UnaryOp: return in.evalUnary(node)
+	case ast.PostfixOp:
+		d := node.Data.(ast.PostfixOpNode)
+		addr := in.lvalue(d.Expr)
+		typ := in.irType(d.Expr.Typ)
+		old := in.load(node.Tok, addr, typ)
+		in.store(node.Tok, addr, typ, in.step(node.Tok, d.Op, old, d.Expr.Typ))
+		return old
+	case ast.Indirection:
+		expr := node.Data.(ast.IndirectionNode).Expr
+		addr := in.eval(expr)
+		if in.structType(node.Typ) != nil { return addr }
+		if t := in.resolve(expr.Typ); t != nil && t.Kind == ast.TYPE_FUNC { return addr }
+		typ := node.Typ
+		if !in.typed && expr.Type == ast.Ident {
+			if sym := in.lookup(expr.Data.(ast.IdentNode).Name); sym != nil && sym.isByteArray { typ = ast.TypeByte }
+		}
+		return in.load(node.Tok, addr, in.irType(typ))
+	case ast.Subscript, ast.MemberAccess:
+		addr := in.lvalue(node)
+		if in.aggregate(node.Typ) { return addr }
+		return in.load(node.Tok, addr, in.irType(node.Typ))
+	case ast.Slice: return in.evalSlice(node)
+	case ast.Len: return in.evalLen(node)
+	case ast.AddressOf:
+		lval := node.Data.(ast.AddressOfNode).LValue
+		if lval.Type == ast.Ident {
+			name := lval.Data.(ast.IdentNode).Name
+			sym := in.lookup(name)
+			// External functions have no storage here, so their address is the one they are called through
+			if _, isVar := externVars[name]; sym == nil || sym.kind == symFunc || sym.kind == symExtrn && !isVar {
+				return in.lookupFunc(name).addr
+			}
+			if sym.typ != nil && sym.typ.Kind == ast.TYPE_ARRAY { return in.symAddr(sym) }
+			if sym.isVector { return in.identValue(lval.Tok, sym) }
+		}
+		return in.lvalue(lval)
+	case ast.FuncCall: return in.evalCall(node)
+	case ast.TypeCast:
+		d := node.Data.(ast.TypeCastNode)
+		return in.cast(in.eval(d.Expr), d.Expr.Typ, d.TargetType)
+	case ast.TypeOf:
+		expr := node.Data.(ast.TypeOfNode).Expr
+		in.eval(expr)
+		typ := expr.Typ
+		if typ == nil { typ = ast.TypeUntyped }
+		return in.stringAddr(ast.TypeToString(typ))
+	case ast.Ternary:
+		d := node.Data.(ast.TernaryNode)
+		branch := d.ElseExpr
+		if in.eval(d.Cond) != 0 { branch = d.ThenExpr }
+		v := in.eval(branch)
+		if in.irType(branch.Typ) != in.irType(node.Typ) { v = in.convert(v, branch.Typ, node.Typ) }
+		return v
+	case ast.AutoAlloc:
+		size := in.eval(node.Data.(ast.AutoAllocNode).Size)
+		return in.stackAlloc(node.Tok, size*in.ws, int64(in.cfg.StackAlignment))
+	case ast.StructLiteral: return in.evalStructLiteral(node)
+	case ast.ArrayLiteral:
+		d := node.Data.(ast.ArrayLiteralNode)
+		// nil given for a slice is one of no elements
+		if len(d.Values) == 0 { return in.newSlice(node.Tok, 0, 0) }
+		size := in.sizeof(d.ElementType)
+		base := in.stackAlloc(node.Tok, int64(len(d.Values))*size, in.alignof(d.ElementType))
+		for i, v := range d.Values {
+			in.store(v.Tok, base+int64(i)*size, in.irType(d.ElementType), in.eval(v))
+		}
+		return in.newSlice(node.Tok, base, int64(len(d.Values)))
+	}
+	util.Error(node.Tok, "Internal error: unhandled expression type in interpreter: %v", node.Type)
+	return 0
+}
+
+// lookup resolves a name in the current function, then among the globals
+func (in *Interpreter) lookup(name string) *symbol {
+	if in.fn != nil {
+		if sym := in.fn.locals[name]; sym != nil { return sym }
+	}
+	return in.globals[name]
+}
+
+func (in *Interpreter) symAddr(sym *symbol) int64 {
+	if sym.isLocal { return in.fp + sym.addr }
+	return sym.addr
+}
+
+func (in *Interpreter) evalIdent(node *ast.Node) int64 {
+	name := node.Data.(ast.IdentNode).Name
+	sym := in.lookup(name)
+	if sym == nil || sym.kind != symVar {
+		if v, ok := externVars[name]; ok && (sym == nil || sym.kind == symExtrn) { return v }
+		return in.lookupFunc(name).addr
+	}
+	return in.identValue(node.Tok, sym)
+}
+
+// identValue is the value of a variable: the address of arrays and structs, the contents of anything else
+// Untyped local vectors and array parameters hold a pointer to their storage instead
+func (in *Interpreter) identValue(tok token.Token, sym *symbol) int64 {
+	addr := in.symAddr(sym)
+	if sym.isVector || (sym.typ != nil && sym.typ.Kind == ast.TYPE_ARRAY) {
+		if sym.isLocal && (sym.isParam || sym.isVector && isUntyped(sym.typ)) { return in.load(tok, addr, in.irType(sym.typ)) }
+		return addr
+	}
+	if in.structType(sym.typ) != nil {
+		if sym.isParam { return in.load(tok, addr, ir.TypePtr) }
+		return addr
+	}
+	return in.load(tok, addr, in.irType(sym.typ))
+}
+
+// lvalue returns the address an assignable expression designates
+func (in *Interpreter) lvalue(node *ast.Node) int64 {
+	switch node.Type {
+	case ast.Ident:
+		name := node.Data.(ast.IdentNode).Name
+		sym := in.lookup(name)
+		if sym == nil || sym.kind != symVar { in.fault(node.Tok, sigSEGV, "cannot assign to '%s'", name) }
+		return in.symAddr(sym)
+	case ast.Indirection: return in.eval(node.Data.(ast.IndirectionNode).Expr)
+	case ast.Subscript: return in.subscriptAddr(node)
+	case ast.MemberAccess: return in.memberAddr(node)
+	case ast.FuncCall:
+		if in.structType(node.Typ) != nil { return in.eval(node) }
+	}
+	util.Error(node.Tok, "Expression is not a valid l-value")
+	return 0
+}
+
+// subscriptAddr scales the index by the element size, or by one for untyped byte arrays
+func (in *Interpreter) subscriptAddr(node *ast.Node) int64 {
+	d := node.Data.(ast.SubscriptNode)
+	base := in.eval(d.Array)
+	index := in.eval(d.Index)
+	if slice := in.sliceType(d.Array.Typ); slice != nil {
+		ptr, length := in.sliceHeader(node.Tok, base)
+		in.checkIndex(node, index, length)
+		return ptr + index*max(in.sizeof(slice.Base), 1)
+	}
+	in.checkBounds(node, index)
+	scale := in.ws
+	if t := d.Array.Typ; t != nil {
+		if (t.Kind == ast.TYPE_POINTER || t.Kind == ast.TYPE_ARRAY) && t.Base != nil { scale = in.sizeof(t.Base) }
+	} else if !in.typed && d.Array.Type == ast.Ident {
+		if sym := in.lookup(d.Array.Data.(ast.IdentNode).Name); sym != nil && sym.isByteArray { scale = 1 }
+	}
+	return base + index*max(scale, 1)
+}
+
+// memberAddr returns the address of a struct member; struct parameters already hold a pointer
+func (in *Interpreter) memberAddr(node *ast.Node) int64 {
+	d := node.Data.(ast.MemberAccessNode)
+	typ := d.Expr.Typ
+	var sym *symbol
+	if d.Expr.Type == ast.Ident { sym = in.lookup(d.Expr.Data.(ast.IdentNode).Name) }
+	if typ == nil && sym != nil { typ = sym.typ }
+	if typ == nil { util.Error(node.Tok, "internal: cannot determine type of struct for member access") }
+
+	var base int64
+	if typ.Kind == ast.TYPE_POINTER {
+		base = in.eval(d.Expr)
+		typ = typ.Base
+	} else if sym != nil && sym.isParam && in.structType(typ) != nil {
+		base = in.load(node.Tok, in.symAddr(sym), ir.TypePtr)
+	} else {
+		base = in.lvalue(d.Expr)
+	}
+	st := in.structType(typ)
+	if st == nil { util.Error(node.Tok, "internal: member access on non-struct type '%s'", typ.Name) }
+	return base + in.fieldOffset(node, st, d.Member.Data.(ast.IdentNode).Name)
+}
+
+func (in *Interpreter) evalAssign(node *ast.Node) int64 {
+	d := node.Data.(ast.AssignNode)
+	if st := in.structType(d.Lhs.Typ); st != nil {
+		if d.Op != token.Eq { util.Error(node.Tok, "Compound assignment operators are not supported for structs") }
+		var dst int64
+		if d.Lhs.Type == ast.Ident {
+			dst = in.eval(d.Lhs)
+		} else {
+			dst = in.lvalue(d.Lhs)
+		}
+		in.blit(node.Tok, dst, in.eval(d.Rhs), in.sizeof(st))
+		return dst
+	}
+
+	addr := in.lvalue(d.Lhs)
+	typ := in.irType(d.Lhs.Typ)
+	var v int64
+	if d.Op == token.Eq {
+		v = in.convert(in.eval(d.Rhs), d.Rhs.Typ, d.Lhs.Typ)
+	} else {
+		cur := in.load(node.Tok, addr, typ)
+		v = in.binary(node.Tok, baseOps[d.Op], d.Lhs.Typ, cur, d.Lhs.Typ, in.eval(d.Rhs), d.Rhs.Typ)
+	}
+	in.store(node.Tok, addr, typ, v)
+	return v
+}
+
+func (in *Interpreter) evalUnary(node *ast.Node) int64 {
+	d := node.Data.(ast.UnaryOpNode)
+	if d.Op == token.Inc || d.Op == token.Dec {
+		addr := in.lvalue(d.Expr)
+		typ := in.irType(d.Expr.Typ)
+		v := in.step(node.Tok, d.Op, in.load(node.Tok, addr, typ), d.Expr.Typ)
+		in.store(node.Tok, addr, typ, v)
+		return v
+	}
+
+	v := in.eval(d.Expr)
+	switch d.Op {
+	case token.Minus:
+		if isFloat(d.Expr.Typ) {
+			t := floatIRType(in.irType(d.Expr.Typ))
+			return fromFloat(-toFloat(v, t), t)
+		}
+		return in.binary(node.Tok, token.Minus, d.Expr.Typ, 0, d.Expr.Typ, v, d.Expr.Typ)
+	case token.Plus: return v
+	case token.Not:
+		if isFloat(d.Expr.Typ) { return b2i(toFloat(v, floatIRType(in.irType(d.Expr.Typ))) == 0) }
+		return b2i(v == 0)
+	case token.Complement: return ^v
+	}
+	util.Error(node.Tok, "Unsupported unary operator")
+	return 0
+}
+
+// step applies ++ or -- to a value of type t
+func (in *Interpreter) step(tok token.Token, op token.Type, v int64, t *ast.BxType) int64 {
+	binOp := token.Plus
+	if op == token.Dec { binOp = token.Minus }
+	one := int64(1)
+	if isFloat(t) { one = fromFloat(1, floatIRType(in.irType(t))) }
+	return in.binary(tok, binOp, t, v, t, one, t)
+}
+
+func isComparison(op token.Type) bool {
+	switch op {
+	case token.EqEq, token.Neq, token.Lt, token.Gt, token.Lte, token.Gte: return true
+	}
+	return false
+}
+
+// binary applies op to l and r, computing in floating point when the result or a compared operand is a float
+func (in *Interpreter) binary(tok token.Token, op token.Type, typ *ast.BxType, l int64, lt *ast.BxType, r int64, rt *ast.BxType) int64 {
+	cmp := isComparison(op)
+	if isFloat(typ) || cmp && (isFloat(lt) || isFloat(rt)) {
+		fl, fr := in.asFloat(l, lt), in.asFloat(r, rt)
+		var res float64
+		switch op {
+		case token.EqEq: return b2i(fl == fr)
+		case token.Neq: return b2i(fl != fr)
+		case token.Lt: return b2i(fl < fr)
+		case token.Gt: return b2i(fl > fr)
+		case token.Lte: return b2i(fl <= fr)
+		case token.Gte: return b2i(fl >= fr)
+		case token.Plus: res = fl + fr
+		case token.Minus: res = fl - fr
+		case token.Star: res = fl * fr
+		case token.Slash: res = fl / fr
+		case token.Rem: res = math.Mod(fl, fr)
+		default: util.Error(tok, "Invalid operator for floating-point operands")
+		}
+		return fromFloat(res, floatIRType(in.irType(typ)))
+	}
+
+	resType := in.irType(typ)
+	narrow := ir.SizeOfType(resType, int(in.ws)) < 8
+	if op == token.Plus || op == token.Minus || op == token.Star || op == token.Slash || op == token.Rem {
+		in.checkArith(tok, op, typ, l, r)
+	}
+	var res int64
+	switch op {
+	case token.EqEq: return b2i(l == r)
+	case token.Neq: return b2i(l != r)
+	case token.Lt: return b2i(l < r)
+	case token.Gt: return b2i(l > r)
+	case token.Lte: return b2i(l <= r)
+	case token.Gte: return b2i(l >= r)
+	case token.Plus: res = l + r
+	case token.Minus: res = l - r
+	case token.Star: res = l * r
+	case token.And: res = l & r
+	case token.Or: res = l | r
+	case token.Xor: res = l ^ r
+	case token.Shl: res = l << uint64(r&63)
+	case token.Shr:
+		// The QBE backend shifts logically
+		if narrow { return int64(int32(uint32(l) >> uint64(r&31))) }
+		return int64(uint64(l) >> uint64(r&63))
+	case token.Slash, token.Rem:
+		if r == 0 { in.fault(tok, sigFPE, "integer division by zero") }
+		if r == -1 && (l == math.MinInt64 || narrow && l == math.MinInt32) { in.fault(tok, sigFPE, "integer overflow") }
+		if op == token.Slash {
+			res = l / r
+		} else {
+			res = l % r
+		}
+	default:
+		util.Error(tok, "Invalid binary operator")
+	}
+	if narrow { return int64(int32(res)) }
+	return res
+}
+
+func (in *Interpreter) asFloat(v int64, t *ast.BxType) float64 {
+	if isFloat(t) { return toFloat(v, floatIRType(in.irType(t))) }
+	return float64(v)
+}
+
+// convert turns an integer into a float where a float is expected, and resizes floats
+func (in *Interpreter) convert(v int64, from, to *ast.BxType) int64 {
+	if !isFloat(to) || from == nil { return v }
+	toType := floatIRType(in.irType(to))
+	if isInteger(from) { return fromFloat(float64(v), toType) }
+	if fromType := floatIRType(in.irType(from)); isFloat(from) && fromType != toType { return fromFloat(toFloat(v, fromType), toType) }
+	return v
+}
+
+// cast implements an explicit type conversion
+func (in *Interpreter) cast(v int64, from, to *ast.BxType) int64 {
+	fromType, toType := in.irType(from), in.irType(to)
+	if fromType == toType { return v }
+	switch {
+	case isInteger(from) && isFloat(to): return fromFloat(float64(v), floatIRType(toType))
+	case isFloat(from) && isFloat(to): return fromFloat(toFloat(v, floatIRType(fromType)), floatIRType(toType))
+	case isFloat(from) && isInteger(to): return truncate(int64(toFloat(v, floatIRType(fromType))), toType)
+	case isInteger(from) && isInteger(to): return truncate(v, toType)
+	}
+	return v
+}
+
+// truncate reduces v to the width of an integer type, extending it back the way a load would
+func truncate(v int64, t ir.Type) int64 {
+	switch t {
+	case ir.TypeSB: return int64(int8(v))
+	case ir.TypeB, ir.TypeUB: return int64(uint8(v))
+	case ir.TypeSH: return int64(int16(v))
+	case ir.TypeH, ir.TypeUH: return int64(uint16(v))
+	case ir.TypeW: return int64(int32(v))
+	}
+	return v
+}
+
+func (in *Interpreter) evalStructLiteral(node *ast.Node) int64 {
+	d := node.Data.(ast.StructLiteralNode)
+	st := in.structType(node.Typ)
+	if st == nil { util.Error(node.Tok, "internal: struct literal has invalid type") }
+	base := in.stackAlloc(node.Tok, in.sizeof(st), in.alignof(st))
+
+	offsets := make(map[string]int64)
+	types := make(map[string]*ast.BxType)
+	var names []string
+	var off int64
+	for _, field := range st.Fields {
+		fd := field.Data.(ast.VarDeclNode)
+		off = util.AlignUp(off, in.alignof(fd.Type))
+		offsets[fd.Name], types[fd.Name] = off, fd.Type
+		names = append(names, fd.Name)
+		if st.Kind == ast.TYPE_STRUCT { off += in.sizeof(fd.Type) }
+	}
+	for i, v := range d.Values {
+		name := names[min(i, len(names)-1)]
+		if d.Names != nil { name = d.Names[i].Data.(ast.IdentNode).Name }
+		if fst := in.structType(types[name]); fst != nil {
+			in.blit(v.Tok, base+offsets[name], in.eval(v), in.sizeof(fst))
+			continue
+		}
+		in.store(v.Tok, base+offsets[name], in.irType(types[name]), in.convert(in.eval(v), v.Typ, types[name]))
+	}
+	return base
+}
+
+// evalCall evaluates the arguments right to left and calls the function the callee expression designates
+func (in *Interpreter) evalCall(node *ast.Node) int64 {
+	d := node.Data.(ast.FuncCallNode)
+	target := in.eval(d.FuncExpr)
+	fn := in.byAddr[target]
+	if fn == nil { in.segfault(d.FuncExpr.Tok, target) }
+
+	var paramTypes []*ast.BxType
+	variadic := fn.body() == nil
+	if fn.node != nil {
+		fd := fn.node.Data.(ast.FuncDeclNode)
+		variadic = variadic || fd.HasVarargs
+		for _, p := range fd.Params {
+			if pd, ok := p.Data.(ast.VarDeclNode); ok { paramTypes = append(paramTypes, pd.Type) }
+		}
+	}
+
+	args := make([]int64, len(d.Args))
+	sp := in.sp
+	for i := len(d.Args) - 1; i >= 0; i-- {
+		arg := d.Args[i]
+		args[i] = in.eval(arg)
+		argType := in.irType(arg.Typ)
+		if i < len(paramTypes) && isFloat(paramTypes[i]) && isFloat(arg.Typ) {
+			args[i] = in.convert(args[i], arg.Typ, paramTypes[i])
+			argType = in.irType(paramTypes[i])
+		}
+		// C varargs promote float to double
+		if variadic && argType == ir.TypeS { args[i] = fromFloat(toFloat(args[i], ir.TypeS), ir.TypeD) }
+		// The callee gets a copy of a struct argument, freed with the other copies once it returns
+		if st := in.structType(arg.Typ); st != nil && (i >= len(paramTypes) || in.structType(paramTypes[i]) != nil) {
+			size := in.sizeof(st)
+			addr := in.stackAlloc(arg.Tok, size, in.ws)
+			in.blit(arg.Tok, addr, args[i], size)
+			args[i] = addr
+		}
+	}
+	ret := in.call(node.Tok, fn, args)
+	in.sp = sp
+	if st := in.structType(node.Typ); st != nil && ret != 0 { ret = in.keepStruct(node.Tok, ret, in.sizeof(st), in.ws) }
+	return ret
+}
+
+func b2i(b bool) int64 {
+	if b { return 1 }
+	return 0
+}
+
+// floatIRType picks the float type a value of IR type t is carried as
+func floatIRType(t ir.Type) ir.Type {
+	if t == ir.TypeS { return ir.TypeS }
+	return ir.TypeD
+}
+
+func toFloat(v int64, t ir.Type) float64 {
+	if t == ir.TypeS { return float64(math.Float32frombits(uint32(v))) }
+	return math.Float64frombits(uint64(v))
+}
+
+func fromFloat(f float64, t ir.Type) int64 {
+	if t == ir.TypeS { return int64(math.Float32bits(float32(f))) }
+	return int64(math.Float64bits(f))
+}
@@ -0,0 +1,404 @@
+package interp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/ast"
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/token"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// ctl is how a statement finished
+type ctl int
+
+const (
+	ctlNext ctl = iota
+	ctlBreak
+	ctlContinue
+	ctlReturn
+	ctlGoto
+)
+
+// function is a callable: a B function with its frame layout or its IR, or a builtin
+type function struct {
+	name     string
+	addr     int64
+	node     *ast.Node
+	builtin  builtinFunc
+	prepared bool
+	locals   map[string]*symbol
+	params   []*symbol
+	autos    []*symbol
+	frame    int64
+	labels   map[string]*ast.Node
+	parents  map[*ast.Node]*ast.Node
+	cases    map[*ast.Node][]*ast.Node
+	defers   []*ast.Node
+	checks   map[config.Feature]bool
+	code     *vmFunc
+}
+
+// body returns the statements of a B function, or nil for builtins and functions written in assembly
+func (fn *function) body() *ast.Node {
+	if fn.node == nil { return nil }
+	body := fn.node.Data.(ast.FuncDeclNode).Body
+	if body == nil || body.Type == ast.AsmStmt { return nil }
+	return body
+}
+
+// lookupFunc returns the callable for name, creating an unresolved one so that it has an address
+func (in *Interpreter) lookupFunc(name string) *function {
+	if fn := in.funcs[name]; fn != nil { return fn }
+	fn := &function{name: name, addr: funcBase + int64(len(in.funcs))*16, builtin: builtins[name]}
+	in.funcs[name] = fn
+	in.byAddr[fn.addr] = fn
+	return fn
+}
+
+// prepare lays out the frame of fn the way codegenFuncDecl does: parameters in reverse order, then
+// every auto of the body in reverse order of appearance, one slot per name
+func (in *Interpreter) prepare(fn *function) {
+	fn.prepared = true
+	d := fn.node.Data.(ast.FuncDeclNode)
+	fn.locals = make(map[string]*symbol)
+	fn.labels = make(map[string]*ast.Node)
+	fn.parents = make(map[*ast.Node]*ast.Node)
+	fn.cases = make(map[*ast.Node][]*ast.Node)
+
+	for i, p := range d.Params {
+		sym := &symbol{isLocal: true, isParam: true, node: p}
+		if d.IsTyped {
+			pd := p.Data.(ast.VarDeclNode)
+			sym.name, sym.typ = pd.Name, pd.Type
+		} else {
+			sym.name = p.Data.(ast.IdentNode).Name
+			sym.isVector = d.Name == "main" && i == 1
+		}
+		fn.params = append(fn.params, sym)
+		fn.locals[sym.name] = sym
+	}
+
+	var autos []*symbol
+	var sizes []int64
+	var findAutos func(n *ast.Node)
+	findAutos = func(n *ast.Node) {
+		if n == nil { return }
+		if n.Type == ast.VarDecl {
+			vd := n.Data.(ast.VarDeclNode)
+			if fn.locals[vd.Name] == nil {
+				sym := &symbol{name: vd.Name, typ: vd.Type, node: n, isLocal: true, isVector: vd.IsVector}
+				fn.locals[vd.Name] = sym
+				autos = append(autos, sym)
+				sizes = append(sizes, in.autoSize(n))
+			}
+		}
+		for _, child := range stmtChildren(n) {
+			findAutos(child)
+		}
+	}
+	findAutos(d.Body)
+
+	var offset int64
+	for i := len(fn.params) - 1; i >= 0; i-- {
+		fn.params[i].addr = offset
+		offset += in.ws
+	}
+	for i := len(autos) - 1; i >= 0; i-- {
+		autos[i].addr = offset
+		offset += sizes[i]
+	}
+	fn.autos = autos
+	fn.frame = offset
+
+	// An untyped auto takes the type of its initializer, which codegen records when it reaches the declaration
+	for _, sym := range autos {
+		vd := sym.node.Data.(ast.VarDeclNode)
+		if isUntyped(sym.typ) && !vd.IsVector && len(vd.InitList) == 1 && vd.InitList[0].Typ != nil {
+			sym.typ = vd.InitList[0].Typ
+		}
+	}
+
+	var index func(n, parent *ast.Node)
+	index = func(n, parent *ast.Node) {
+		if n == nil { return }
+		fn.parents[n] = parent
+		switch n.Type {
+		case ast.Label: fn.labels[n.Data.(ast.LabelNode).Name] = n
+		case ast.Switch: fn.cases[n] = switchCases(n)
+		case ast.Defer: fn.defers = append(fn.defers, n)
+		}
+		for _, child := range stmtChildren(n) {
+			index(child, n)
+		}
+	}
+	index(d.Body, nil)
+}
+
+// autoSize is the frame slot size codegen's findAllAutosInFunc gives a local declaration
+func (in *Interpreter) autoSize(node *ast.Node) int64 {
+	d := node.Data.(ast.VarDeclNode)
+	if !isUntyped(d.Type) { return in.sizeof(d.Type) }
+	if !d.IsVector { return in.ws }
+	var words int64
+	switch {
+	case d.SizeExpr != nil:
+		folded := ast.FoldConstants(d.SizeExpr)
+		if folded.Type != ast.Number { util.Error(node.Tok, "Local vector size must be a constant expression") }
+		words = folded.Data.(ast.NumberNode).Value
+	case len(d.InitList) == 1 && d.InitList[0].Type == ast.String:
+		words = (int64(len(d.InitList[0].Data.(ast.StringNode).Value)) + in.ws) / in.ws
+	default:
+		words = int64(len(d.InitList))
+	}
+	return in.ws + words*in.ws
+}
+
+// switchCases lists the case and default labels belonging to a switch, not to switches nested in it
+func switchCases(node *ast.Node) []*ast.Node {
+	var cases []*ast.Node
+	var find func(n *ast.Node)
+	find = func(n *ast.Node) {
+		if n == nil || (n.Type == ast.Switch && n != node) { return }
+		if n.Type == ast.Case || n.Type == ast.Default { cases = append(cases, n) }
+		if n.Type == ast.MultiVarDecl { return }
+		for _, child := range stmtChildren(n) {
+			find(child)
+		}
+	}
+	find(node.Data.(ast.SwitchNode).Body)
+	return cases
+}
+
+// call runs fn with args in a fresh frame and returns its result
+func (in *Interpreter) call(tok token.Token, fn *function, args []int64) int64 {
+	body := fn.body()
+	if body == nil {
+		if fn.builtin != nil { return fn.builtin(in, tok, args) }
+		in.fault(tok, sigSEGV, "call of undefined function '%s'", fn.name)
+	}
+	if !fn.prepared { in.prepare(fn) }
+
+	prevFn, prevFp, prevSp, prevArmed := in.fn, in.fp, in.sp, in.armed
+	defer func() { in.fn, in.fp, in.sp, in.armed = prevFn, prevFp, prevSp, prevArmed }()
+	in.armed = nil
+
+	fp := in.stackAlloc(tok, fn.frame, int64(in.cfg.StackAlignment))
+	for i, p := range fn.params {
+		var v int64
+		if i < len(args) { v = args[i] }
+		in.store(tok, fp+p.addr, in.irType(p.typ), v)
+	}
+	for _, a := range fn.autos {
+		if a.isVector && isUntyped(a.typ) { in.store(tok, fp+a.addr, ir.TypePtr, fp+a.addr+in.ws) }
+	}
+	in.fn, in.fp = fn, fp
+
+	instrument := in.cfg.IsFeatureEnabled(config.FeatInstrumentFunctions) && !strings.HasPrefix(fn.name, "__gbc_")
+	if instrument { in.traceHook(tok, instrumentEnterHook, fn) }
+	ret := in.run(tok, fn, body)
+	if instrument { in.traceHook(tok, instrumentExitHook, fn) }
+	return ret
+}
+
+// run executes the body of the current function until it returns, then its deferred expressions
+func (in *Interpreter) run(tok token.Token, fn *function, body *ast.Node) int64 {
+	for {
+		var ret int64
+		switch in.exec(body) {
+		case ctlReturn:
+			ret = in.retVal
+			// A struct returned is copied, so that deferred expressions cannot change it
+			if st := in.structType(fn.node.Data.(ast.FuncDeclNode).ReturnType); st != nil && len(fn.defers) > 0 {
+				ret = in.stackAlloc(tok, in.sizeof(st), in.alignof(st))
+				in.blit(tok, ret, in.retVal, in.sizeof(st))
+			}
+		case ctlGoto:
+			target := fn.labels[in.gotoLabel]
+			if target == nil { in.fault(tok, sigSEGV, "goto undefined label '%s'", in.gotoLabel) }
+			in.seekTo(target)
+			continue
+		}
+		in.runDeferred(fn)
+		return ret
+	}
+}
+
+// runDeferred evaluates the expressions of the defer statements of fn reached in this call, the last in the
+// function first, each once however often its statement was reached, as codegen's genDeferExit does
+func (in *Interpreter) runDeferred(fn *function) {
+	for i := len(fn.defers) - 1; i >= 0; i-- {
+		if in.armed[fn.defers[i]] { in.eval(fn.defers[i].Data.(ast.DeferNode).Expr) }
+	}
+}
+
+// Hooks called on function entry and exit under -Finstrument-functions, as in compiled programs
+const (
+	instrumentEnterHook = "__gbc_func_enter"
+	instrumentExitHook  = "__gbc_func_exit"
+)
+
+// traceHook calls the program's definition of hook for fn, or prints the default indented call trace
+func (in *Interpreter) traceHook(tok token.Token, hook string, fn *function) {
+	if h := in.funcs[hook]; h != nil && h.body() != nil {
+		in.call(tok, h, []int64{fn.addr, in.stringAddr(fn.name)})
+		return
+	}
+	in.syncOutput()
+	if hook == instrumentEnterHook {
+		fmt.Fprintf(in.stderr, "%*s-> %s\n", in.traceDepth*2, "", fn.name)
+		in.traceDepth++
+		return
+	}
+	in.traceDepth--
+	fmt.Fprintf(in.stderr, "%*s<- %s\n", in.traceDepth*2, "", fn.name)
+}
+
+// seekTo makes exec skip forward to target, entering only the statements that enclose it
+func (in *Interpreter) seekTo(target *ast.Node) {
+	in.seek, in.seekPath = target, make(map[*ast.Node]bool)
+	for n := target; n != nil; n = in.fn.parents[n] {
+		in.seekPath[n] = true
+	}
+}
+
+// exec runs a statement
+// While a seek is pending, statements that do not enclose the target are skipped and the enclosing ones are
+// entered without evaluating their conditions, which is how goto and switch reach labels in nested blocks
+func (in *Interpreter) exec(node *ast.Node) ctl {
+	if node == nil { return ctlNext }
+	if in.seek != nil {
+		if node == in.seek {
+			in.seek, in.seekPath = nil, nil
+		} else if !in.seekPath[node] {
+			return ctlNext
+		}
+	}
+	seeking := in.seek != nil
+
+	switch node.Type {
+	case ast.Block:
+		for _, stmt := range node.Data.(ast.BlockNode).Stmts {
+			if c := in.exec(stmt); c != ctlNext { return c }
+		}
+	case ast.VarDecl:
+		in.initLocal(node)
+	case ast.MultiVarDecl:
+		for _, decl := range node.Data.(ast.MultiVarDeclNode).Decls {
+			in.initLocal(decl)
+		}
+	case ast.If:
+		d := node.Data.(ast.IfNode)
+		if seeking && in.seekPath[d.ThenBody] || !seeking && in.eval(d.Cond) != 0 { return in.exec(d.ThenBody) }
+		return in.exec(d.ElseBody)
+	case ast.While:
+		d := node.Data.(ast.WhileNode)
+		for seeking || in.eval(d.Cond) != 0 {
+			seeking = false
+			switch c := in.exec(d.Body); c {
+			case ctlBreak: return ctlNext
+			case ctlReturn, ctlGoto: return c
+			}
+		}
+	case ast.For:
+		d := node.Data.(ast.ForNode)
+		if c := in.exec(d.Init); c != ctlNext { return c }
+		for seeking || d.Cond == nil || in.eval(d.Cond) != 0 {
+			seeking = false
+			switch c := in.exec(d.Body); c {
+			case ctlBreak: return ctlNext
+			case ctlReturn, ctlGoto: return c
+			}
+			if d.Post != nil { in.eval(d.Post) }
+		}
+	case ast.DoWhile:
+		d := node.Data.(ast.DoWhileNode)
+		for {
+			switch c := in.exec(d.Body); c {
+			case ctlBreak: return ctlNext
+			case ctlReturn, ctlGoto: return c
+			}
+			if in.eval(d.Cond) == 0 { return ctlNext }
+		}
+	case ast.Switch:
+		d := node.Data.(ast.SwitchNode)
+		if !seeking {
+			target := in.findCase(node, in.eval(d.Expr))
+			if target == nil { return ctlNext }
+			in.seekTo(target)
+		}
+		if c := in.exec(d.Body); c != ctlBreak { return c }
+	case ast.Label: return in.exec(node.Data.(ast.LabelNode).Stmt)
+	case ast.Case: return in.exec(node.Data.(ast.CaseNode).Body)
+	case ast.Default: return in.exec(node.Data.(ast.DefaultNode).Body)
+	case ast.Goto:
+		in.gotoLabel = node.Data.(ast.GotoNode).Label
+		return ctlGoto
+	case ast.Defer:
+		if in.armed == nil { in.armed = make(map[*ast.Node]bool) }
+		in.armed[node] = true
+	case ast.Break: return ctlBreak
+	case ast.Continue: return ctlContinue
+	case ast.Return:
+		in.retVal = 0
+		if expr := node.Data.(ast.ReturnNode).Expr; expr != nil { in.retVal = in.eval(expr) }
+		return ctlReturn
+	case ast.AsmStmt:
+		in.fault(node.Tok, sigSEGV, "inline assembly cannot be interpreted")
+	case ast.FuncDecl, ast.TypeDecl, ast.EnumDecl, ast.ExtrnDecl, ast.Directive:
+	default:
+		in.eval(node)
+	}
+	return ctlNext
+}
+
+// findCase returns the case of a switch matching v, its default, or nil
+func (in *Interpreter) findCase(node *ast.Node, v int64) *ast.Node {
+	var def *ast.Node
+	for _, c := range in.fn.cases[node] {
+		if c.Type == ast.Default {
+			def = c
+			continue
+		}
+		for _, value := range c.Data.(ast.CaseNode).Values {
+			if in.eval(value) == v { return c }
+		}
+	}
+	return def
+}
+
+// initLocal runs the initializer of a local declaration
+func (in *Interpreter) initLocal(node *ast.Node) {
+	d := node.Data.(ast.VarDeclNode)
+	if len(d.InitList) == 0 { return }
+	sym := in.fn.locals[d.Name]
+
+	if d.IsVector || (d.Type != nil && d.Type.Kind == ast.TYPE_ARRAY) {
+		base := in.identValue(node.Tok, sym)
+		if len(d.InitList) == 1 && d.InitList[0].Type == ast.String {
+			s := d.InitList[0].Data.(ast.StringNode).Value
+			in.blit(node.Tok, base, in.stringAddr(s), int64(len(s))+1)
+			return
+		}
+		elemType, stride := ir.GetType(nil, int(in.ws)), in.ws
+		if d.Type != nil && d.Type.Kind == ast.TYPE_ARRAY && d.Type.Base != nil {
+			elemType, stride = in.irType(d.Type.Base), in.sizeof(d.Type.Base)
+		}
+		for i, init := range d.InitList {
+			in.store(init.Tok, base+int64(i)*stride, elemType, in.eval(init))
+		}
+		return
+	}
+
+	init := d.InitList[0]
+	varType := d.Type
+	if init.Typ != nil && (d.IsDefine || isUntyped(varType)) { varType = init.Typ }
+	addr := in.fp + sym.addr
+	if st := in.structType(varType); st != nil {
+		in.blit(node.Tok, addr, in.eval(init), in.sizeof(st))
+		return
+	}
+	in.store(node.Tok, addr, in.irType(varType), in.convert(in.eval(init), init.Typ, varType))
+}
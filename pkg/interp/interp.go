@@ -0,0 +1,624 @@
+// Package interp runs B programs by walking their type-checked AST, or by executing the IR codegen produces
+// Memory is a flat, byte-addressed store laid out the way codegen lays out data, frames, vector dope
+// words and structs, so an interpreted program observes the same word size and layouts as a compiled one
+package interp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"path/filepath"
+
+	"github.com/xplshn/gbc/pkg/ast"
+	"github.com/xplshn/gbc/pkg/codegen"
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/token"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// Signals a compiled program would die from; a Fault exits with 128 plus the signal number
+const (
+	sigABRT = 6
+	sigFPE  = 8
+	sigSEGV = 11
+)
+
+// Fault is a runtime error that stops the interpreted program
+// Faults raised by runtime checks that exit instead of signalling have no Signal and carry their exit Status
+type Fault struct {
+	Pos    string
+	Msg    string
+	Signal int
+	Status int
+}
+
+func (f *Fault) Error() string {
+	if f.Pos == "" { return f.Msg }
+	return f.Pos + ": " + f.Msg
+}
+
+// ExitCode is the status a shell would report for a native program killed by the same signal
+func (f *Fault) ExitCode() int {
+	if f.Signal == 0 { return f.Status }
+	return 128 + f.Signal
+}
+
+// exitRequest unwinds the interpreter when the program calls exit
+type exitRequest struct{ code int }
+
+type symKind int
+
+const (
+	symVar symKind = iota
+	symFunc
+	symExtrn
+)
+
+type symbol struct {
+	name        string
+	kind        symKind
+	typ         *ast.BxType
+	node        *ast.Node
+	addr        int64 // absolute for globals, frame offset for locals
+	isLocal     bool
+	isParam     bool
+	isVector    bool
+	isByteArray bool
+}
+
+// Interpreter runs one program
+// Interactive makes program output line-buffered, as C stdio makes it when stdout is a terminal
+type Interpreter struct {
+	Interactive bool
+
+	cfg     *config.Config
+	ws      int64
+	typed   bool
+	mem     *memory
+	globals map[string]*symbol
+	types   map[string]*ast.BxType
+	funcs   map[string]*function
+	byAddr  map[int64]*function
+	strings map[string]int64
+	offsets map[*ast.Node]int64
+
+	fn        *function
+	fp, sp    int64
+	retVal    int64
+	gotoLabel string
+	armed     map[*ast.Node]bool // defer statements reached in the current call
+	seek      *ast.Node
+	seekPath  map[*ast.Node]bool
+
+	stdin  *bufio.Reader
+	stdout *bufio.Writer
+	out    io.Writer
+	stderr io.Writer
+	heap   map[int64]int64
+	tm     int64
+	rand   uint64
+
+	pendingChecks map[config.Feature]bool
+	traceDepth    int
+
+	irGlobals map[string]int64
+}
+
+// Configure gives cfg the machine properties of the interpreter, which otherwise come from a backend target
+func Configure(cfg *config.Config) {
+	cfg.BackendName, cfg.BackendTarget = "interp", ""
+	cfg.WordSize, cfg.StackAlignment = 8, 16
+}
+
+// New creates an interpreter for programs built with cfg, wired to the given standard streams
+func New(cfg *config.Config, stdin io.Reader, stdout, stderr io.Writer) *Interpreter {
+	return &Interpreter{
+		cfg:     cfg,
+		ws:      int64(cfg.WordSize),
+		typed:   cfg.IsFeatureEnabled(config.FeatTyped),
+		mem:     newMemory(),
+		globals: make(map[string]*symbol),
+		types:   make(map[string]*ast.BxType),
+		funcs:   make(map[string]*function),
+		byAddr:  make(map[int64]*function),
+		strings: make(map[string]int64),
+		offsets: make(map[*ast.Node]int64),
+		stdin:   bufio.NewReader(stdin),
+		stdout:  bufio.NewWriter(stdout),
+		out:     stdout,
+		stderr:  stderr,
+		heap:    make(map[int64]int64),
+		pendingChecks: make(map[config.Feature]bool),
+		rand:    1,
+	}
+}
+
+// Run executes main with the given argv and returns its exit status
+// A *Fault is returned when the program crashes, in which case the status is meaningless
+func (in *Interpreter) Run(root *ast.Node, args []string) (status int, err error) {
+	defer in.finish(&status, &err)
+
+	in.collectGlobals(root)
+	if !in.typed { in.findByteArrays(root) }
+	in.layoutGlobals(root)
+
+	main := in.funcs["main"]
+	if main == nil || main.body() == nil {
+		return 0, &Fault{Msg: "program has no main function", Signal: sigSEGV}
+	}
+
+	in.sp = stackBase
+	argv := in.mem.data.alloc(int64(len(args)+1)*in.ws, in.ws)
+	for i, a := range args {
+		in.store(token.Token{}, argv+int64(i)*in.ws, ir.TypePtr, in.stringAddr(a))
+	}
+	ret := in.call(main.node.Tok, main, []int64{int64(len(args)), argv})
+	return int(ret & 0xff), nil
+}
+
+// Exit is returned by Call when the program calls exit
+type Exit struct{ Status int }
+
+func (e *Exit) Error() string { return fmt.Sprintf("exit status %d", e.Status) }
+
+// Load adds the declarations in root to the program, replacing earlier definitions of the same names, so that a
+// session can grow a program one input at a time and run its functions with Call
+func (in *Interpreter) Load(root *ast.Node) {
+	// Declarations that fail to load leave the earlier ones in place
+	saved := maps.Clone(in.globals)
+	defer func() {
+		if r := recover(); r != nil {
+			in.globals = saved
+			panic(r)
+		}
+	}()
+	in.collectGlobals(root)
+	if !in.typed { in.findByteArrays(root) }
+	in.layoutGlobals(root)
+	if in.sp == 0 { in.sp = stackBase }
+}
+
+// Call runs the function name of a loaded program with args and returns its result
+// Program output is flushed before it returns; a program that calls exit returns an *Exit
+func (in *Interpreter) Call(name string, args ...int64) (ret int64, err error) {
+	status := -1
+	defer func() {
+		if status >= 0 && err == nil { err = &Exit{Status: status} }
+	}()
+	defer in.finish(&status, &err)
+
+	fn := in.funcs[name]
+	if fn == nil || fn.body() == nil { return 0, &Fault{Msg: fmt.Sprintf("call of undefined function '%s'", name), Signal: sigSEGV} }
+	return in.call(fn.node.Tok, fn, args), nil
+}
+
+// finish turns the way the program stopped into its exit status or fault, and flushes its output
+func (in *Interpreter) finish(status *int, err *error) {
+	switch r := recover().(type) {
+	case nil:
+	case exitRequest: *status = r.code
+	case *Fault:
+		// A compiled program killed by a signal loses the output still buffered by stdio
+		if r.Signal != 0 { in.stdout.Reset(in.out) }
+		*err = r
+	default: panic(r)
+	}
+	in.stdout.Flush()
+}
+
+// fault stops the program with a runtime error reported at tok
+func (in *Interpreter) fault(tok token.Token, signal int, format string, args ...interface{}) {
+	panic(in.newFault(tok, signal, format, args...))
+}
+
+func (in *Interpreter) newFault(tok token.Token, signal int, format string, args ...interface{}) *Fault {
+	f := &Fault{Msg: fmt.Sprintf(format, args...), Signal: signal}
+	if name := util.SourceFileName(tok.FileIndex); name != "" && tok.Line > 0 {
+		f.Pos = fmt.Sprintf("%s:%d", filepath.Base(name), tok.Line)
+	}
+	return f
+}
+
+// segfault reports an access to unmapped memory, which -Fcheck-nil turns into its trap for nil pointers
+func (in *Interpreter) segfault(tok token.Token, addr int64) {
+	if addr >= 0 && addr < nullGuard {
+		if in.checkEnabled(config.FeatCheckNil) { in.trap(tok, codegen.NilExitCode, "nil pointer dereference") }
+		in.fault(tok, sigSEGV, "nil pointer dereference")
+	}
+	in.fault(tok, sigSEGV, "invalid memory address 0x%x", addr)
+}
+
+// collectGlobals registers the top-level symbols of the program, mirroring codegen's collectGlobals
+func (in *Interpreter) collectGlobals(node *ast.Node) {
+	if node == nil { return }
+	switch node.Type {
+	case ast.Block:
+		for _, stmt := range node.Data.(ast.BlockNode).Stmts {
+			in.collectGlobals(stmt)
+		}
+	case ast.VarDecl:
+		d := node.Data.(ast.VarDeclNode)
+		in.globals[d.Name] = &symbol{name: d.Name, kind: symVar, typ: d.Type, node: node, isVector: d.IsVector}
+	case ast.MultiVarDecl:
+		for _, decl := range node.Data.(ast.MultiVarDeclNode).Decls {
+			in.collectGlobals(decl)
+		}
+	case ast.Directive: codegen.ApplyCheckDirective(node, in.pendingChecks)
+	case ast.FuncDecl:
+		d := node.Data.(ast.FuncDeclNode)
+		in.globals[d.Name] = &symbol{name: d.Name, kind: symFunc, typ: d.ReturnType, node: node}
+		checks := in.pendingChecks
+		in.pendingChecks = make(map[config.Feature]bool)
+		// Functions written in assembly leave the name to a builtin of the same name, if any
+		if fn := in.lookupFunc(d.Name); fn.builtin == nil || (d.Body != nil && d.Body.Type != ast.AsmStmt) {
+			fn.node, fn.builtin, fn.checks, fn.prepared = node, nil, checks, false
+		}
+	case ast.ExtrnDecl:
+		for _, nameNode := range node.Data.(ast.ExtrnDeclNode).Names {
+			name := nameNode.Data.(ast.IdentNode).Name
+			if in.globals[name] == nil {
+				in.globals[name] = &symbol{name: name, kind: symExtrn, typ: ast.TypeUntyped, node: nameNode}
+			}
+		}
+	case ast.TypeDecl:
+		d := node.Data.(ast.TypeDeclNode)
+		if in.types[d.Name] == nil { in.types[d.Name] = d.Type }
+	case ast.EnumDecl:
+		d := node.Data.(ast.EnumDeclNode)
+		if in.types[d.Name] == nil {
+			in.types[d.Name] = &ast.BxType{Kind: ast.TYPE_ENUM, Name: d.Name, EnumMembers: d.Members, Base: ast.TypeInt}
+		}
+		for _, member := range d.Members {
+			in.collectGlobals(member)
+		}
+	}
+}
+
+// findByteArrays marks untyped globals that hold strings, whose subscripts address bytes instead of words
+func (in *Interpreter) findByteArrays(root *ast.Node) {
+	for changed := true; changed; {
+		changed = false
+		walk(root, func(n *ast.Node) {
+			switch n.Type {
+			case ast.VarDecl:
+				d := n.Data.(ast.VarDeclNode)
+				if d.IsVector && len(d.InitList) == 1 && d.InitList[0].Type == ast.String {
+					if sym := in.globals[d.Name]; sym != nil && !sym.isByteArray {
+						sym.isByteArray, changed = true, true
+					}
+				}
+			case ast.Assign:
+				d := n.Data.(ast.AssignNode)
+				if d.Lhs.Type != ast.Ident { return }
+				lhs := in.globals[d.Lhs.Data.(ast.IdentNode).Name]
+				if lhs == nil || lhs.isByteArray { return }
+				isByteArray := d.Rhs.Type == ast.String
+				if d.Rhs.Type == ast.Ident {
+					rhs := in.globals[d.Rhs.Data.(ast.IdentNode).Name]
+					isByteArray = rhs != nil && rhs.isByteArray
+				}
+				if isByteArray { lhs.isByteArray, changed = true, true }
+			}
+		})
+	}
+}
+
+// layoutGlobals allocates and initializes the data of every global variable in declaration order
+func (in *Interpreter) layoutGlobals(root *ast.Node) {
+	var visit func(n *ast.Node)
+	visit = func(n *ast.Node) {
+		switch n.Type {
+		case ast.Block:
+			for _, stmt := range n.Data.(ast.BlockNode).Stmts {
+				visit(stmt)
+			}
+		case ast.MultiVarDecl:
+			for _, decl := range n.Data.(ast.MultiVarDeclNode).Decls {
+				visit(decl)
+			}
+		case ast.EnumDecl:
+			for _, member := range n.Data.(ast.EnumDeclNode).Members {
+				visit(member)
+			}
+		case ast.VarDecl:
+			if sym := in.globals[n.Data.(ast.VarDeclNode).Name]; sym != nil && sym.node == n {
+				in.layoutGlobal(sym)
+			}
+		}
+	}
+	visit(root)
+}
+
+func (in *Interpreter) layoutGlobal(sym *symbol) {
+	d := sym.node.Data.(ast.VarDeclNode)
+	align := in.alignof(d.Type)
+	if in.sliceType(d.Type) != nil && len(d.InitList) > 0 {
+		in.layoutGlobalSlice(sym, d.InitList[0])
+		return
+	}
+	if st := in.structType(d.Type); st != nil && len(d.InitList) == 0 {
+		sym.addr = in.mem.data.alloc(in.sizeof(st), align)
+		return
+	}
+
+	elemType := ir.GetType(d.Type, int(in.ws))
+	if d.IsVector && isUntyped(d.Type) && len(d.InitList) == 1 && d.InitList[0].Type == ast.String {
+		elemType = ir.TypeB
+	} else if d.Type != nil && d.Type.Kind == ast.TYPE_ARRAY {
+		elemType = ir.GetType(d.Type.Base, int(in.ws))
+	}
+
+	var sizeNode *ast.Node
+	if d.Type != nil && d.Type.Kind == ast.TYPE_ARRAY {
+		sizeNode = d.Type.ArraySize
+	} else if d.IsVector {
+		sizeNode = d.SizeExpr
+	}
+	count := int64(len(d.InitList))
+	if sizeNode != nil {
+		val, ok := in.evalConst(sizeNode)
+		if !ok { util.Error(sizeNode.Tok, "Global array size must be a constant expression") }
+		count = val
+	}
+	if count == 0 && !d.IsVector && len(d.InitList) == 0 { count = 1 }
+
+	// Initializers that are addresses take a full pointer, the rest take one element each
+	elemSize := ir.SizeOfType(elemType, int(in.ws))
+	values := make([]int64, len(d.InitList))
+	types := make([]ir.Type, len(d.InitList))
+	var size int64
+	for i, init := range d.InitList {
+		var isAddr bool
+		values[i], isAddr = in.globalConst(init, elemType)
+		types[i] = elemType
+		if isAddr { types[i] = ir.TypePtr }
+		size += ir.SizeOfType(types[i], int(in.ws))
+	}
+	if count > int64(len(d.InitList)) { size += (count - int64(len(d.InitList))) * elemSize }
+
+	sym.addr = in.mem.data.alloc(size, align)
+	offset := sym.addr
+	for i := range values {
+		in.store(d.InitList[i].Tok, offset, types[i], values[i])
+		offset += ir.SizeOfType(types[i], int(in.ws))
+	}
+}
+
+// globalConst evaluates a global initializer, reporting whether the result is an address
+func (in *Interpreter) globalConst(node *ast.Node, elemType ir.Type) (int64, bool) {
+	folded := ast.FoldConstants(node)
+	switch folded.Type {
+	case ast.Number: return folded.Data.(ast.NumberNode).Value, false
+	case ast.FloatNumber: return fromFloat(folded.Data.(ast.FloatNumberNode).Value, floatIRType(ir.GetType(folded.Typ, int(in.ws)))), false
+	case ast.String: return in.stringAddr(folded.Data.(ast.StringNode).Value), true
+	case ast.Nil: return 0, false
+	case ast.Ident:
+		if val, ok := in.evalConst(folded); ok { return val, false }
+		return in.globalAddr(folded), true
+	case ast.AddressOf:
+		lval := folded.Data.(ast.AddressOfNode).LValue
+		if lval.Type != ast.Ident { util.Error(lval.Tok, "Global initializer must be the address of a global symbol") }
+		return in.globalAddr(lval), true
+	}
+	util.Error(node.Tok, "Global initializer must be a constant expression")
+	return 0, false
+}
+
+// globalAddr is the address of a global variable or function, which may not be laid out yet
+func (in *Interpreter) globalAddr(ident *ast.Node) int64 {
+	name := ident.Data.(ast.IdentNode).Name
+	sym := in.globals[name]
+	if sym == nil { util.Error(ident.Tok, "Undefined symbol '%s' in global initializer", name) }
+	if sym.kind != symVar { return in.lookupFunc(name).addr }
+	if sym.addr == 0 { in.layoutGlobal(sym) }
+	return sym.addr
+}
+
+// evalConst folds node to an integer, following single-valued globals the way enum constants are defined
+func (in *Interpreter) evalConst(node *ast.Node) (int64, bool) {
+	if node == nil { return 0, false }
+	folded := ast.FoldConstants(node)
+	switch folded.Type {
+	case ast.Number: return folded.Data.(ast.NumberNode).Value, true
+	case ast.Ident:
+		sym := in.globals[folded.Data.(ast.IdentNode).Name]
+		if sym != nil && sym.node != nil && sym.node.Type == ast.VarDecl {
+			if d := sym.node.Data.(ast.VarDeclNode); len(d.InitList) == 1 && d.InitList[0] != node {
+				return in.evalConst(d.InitList[0])
+			}
+		}
+	}
+	return 0, false
+}
+
+// resolve replaces a named type by its definition
+func (in *Interpreter) resolve(t *ast.BxType) *ast.BxType {
+	if t != nil && (t.Kind == ast.TYPE_PRIMITIVE || t.HasFields()) && t.Name != "" {
+		if def := in.types[t.Name]; def != nil && def != t { return def }
+	}
+	return t
+}
+
+// structType returns the struct or union definition t names, or nil if t is neither. A slice is its header
+func (in *Interpreter) structType(t *ast.BxType) *ast.BxType {
+	t = in.resolve(t)
+	if t != nil && t.Kind == ast.TYPE_SLICE { return ast.SliceHeader }
+	if t.HasFields() { return t }
+	return nil
+}
+
+// aggregate reports whether the value of an expression of type t is its address, as that of a struct or of an
+// array nested in another or in a struct is
+func (in *Interpreter) aggregate(t *ast.BxType) bool {
+	if t != nil && t.Kind == ast.TYPE_ARRAY { return t.ArraySize != nil }
+	return in.structType(t) != nil
+}
+
+func (in *Interpreter) sizeof(t *ast.BxType) int64 {
+	if isUntyped(t) { return in.ws }
+	switch t.Kind {
+	case ast.TYPE_VOID: return 0
+	case ast.TYPE_POINTER: return in.ws
+	case ast.TYPE_ARRAY:
+		n := int64(1)
+		if t.ArraySize != nil {
+			val, ok := in.evalConst(t.ArraySize)
+			if !ok { util.Error(t.ArraySize.Tok, "Array size must be a constant expression") }
+			n = val
+		}
+		return in.sizeof(t.Base) * n
+	case ast.TYPE_SLICE: return in.sizeof(ast.SliceHeader)
+	case ast.TYPE_PRIMITIVE, ast.TYPE_LITERAL_INT:
+		if size := ir.NewTypeSizeResolver(int(in.ws)).GetTypeSize(t.Name); size > 0 { return size }
+		if def := in.types[t.Name]; def != nil && def != t { return in.sizeof(def) }
+		return in.ws
+	case ast.TYPE_ENUM: return in.sizeof(ast.TypeInt)
+	case ast.TYPE_LITERAL_FLOAT: return in.ws
+	case ast.TYPE_FLOAT: return ir.NewTypeSizeResolver(int(in.ws)).GetTypeSize(t.Name)
+	case ast.TYPE_STRUCT:
+		var size, maxAlign int64 = 0, 1
+		for _, field := range t.Fields {
+			ft := field.Data.(ast.VarDeclNode).Type
+			align := in.alignof(ft)
+			maxAlign = max(maxAlign, align)
+			size = util.AlignUp(size, align) + in.sizeof(ft)
+		}
+		return util.AlignUp(size, maxAlign)
+	case ast.TYPE_UNION:
+		var size, maxAlign int64 = 0, 1
+		for _, field := range t.Fields {
+			ft := field.Data.(ast.VarDeclNode).Type
+			size, maxAlign = max(size, in.sizeof(ft)), max(maxAlign, in.alignof(ft))
+		}
+		return util.AlignUp(size, maxAlign)
+	}
+	return in.ws
+}
+
+func (in *Interpreter) alignof(t *ast.BxType) int64 {
+	if isUntyped(t) { return in.ws }
+	if def := in.resolve(t); def != t { return in.alignof(def) }
+	switch t.Kind {
+	case ast.TYPE_VOID: return 1
+	case ast.TYPE_POINTER: return in.ws
+	case ast.TYPE_ARRAY: return in.alignof(t.Base)
+	case ast.TYPE_SLICE: return in.alignof(ast.SliceHeader)
+	case ast.TYPE_PRIMITIVE, ast.TYPE_FLOAT, ast.TYPE_ENUM, ast.TYPE_LITERAL_INT, ast.TYPE_LITERAL_FLOAT: return max(in.sizeof(t), 1)
+	case ast.TYPE_STRUCT, ast.TYPE_UNION:
+		maxAlign := int64(1)
+		for _, field := range t.Fields {
+			maxAlign = max(maxAlign, in.alignof(field.Data.(ast.VarDeclNode).Type))
+		}
+		return maxAlign
+	}
+	return in.ws
+}
+
+// fieldOffset returns the offset of a struct member, caching it on the member access node
+func (in *Interpreter) fieldOffset(node *ast.Node, st *ast.BxType, member string) int64 {
+	if off, ok := in.offsets[node]; ok { return off }
+	var off int64
+	for _, field := range st.Fields {
+		fd := field.Data.(ast.VarDeclNode)
+		off = util.AlignUp(off, in.alignof(fd.Type))
+		if fd.Name == member {
+			in.offsets[node] = off
+			return off
+		}
+		if st.Kind == ast.TYPE_STRUCT { off += in.sizeof(fd.Type) }
+	}
+	util.Error(node.Tok, "internal: could not find member '%s'", member)
+	return 0
+}
+
+func (in *Interpreter) irType(t *ast.BxType) ir.Type { return ir.GetType(t, int(in.ws)) }
+
+func isUntyped(t *ast.BxType) bool { return t == nil || t.Kind == ast.TYPE_UNTYPED }
+
+func isFloat(t *ast.BxType) bool {
+	return t != nil && (t.Kind == ast.TYPE_FLOAT || t.Kind == ast.TYPE_LITERAL_FLOAT)
+}
+
+func isInteger(t *ast.BxType) bool {
+	return t != nil && (t.Kind == ast.TYPE_PRIMITIVE || t.Kind == ast.TYPE_LITERAL_INT || t.Kind == ast.TYPE_ENUM)
+}
+
+// walk visits node and every node below it
+func walk(node *ast.Node, visit func(n *ast.Node)) {
+	if node == nil { return }
+	visit(node)
+	switch d := node.Data.(type) {
+	case ast.AssignNode:
+		walk(d.Lhs, visit)
+		walk(d.Rhs, visit)
+	case ast.MultiAssignNode:
+		for _, n := range append(append([]*ast.Node{}, d.Lhs...), d.Rhs...) {
+			walk(n, visit)
+		}
+	case ast.BinaryOpNode:
+		walk(d.Left, visit)
+		walk(d.Right, visit)
+	case ast.UnaryOpNode: walk(d.Expr, visit)
+	case ast.PostfixOpNode: walk(d.Expr, visit)
+	case ast.IndirectionNode: walk(d.Expr, visit)
+	case ast.AddressOfNode: walk(d.LValue, visit)
+	case ast.TernaryNode:
+		walk(d.Cond, visit)
+		walk(d.ThenExpr, visit)
+		walk(d.ElseExpr, visit)
+	case ast.SubscriptNode:
+		walk(d.Array, visit)
+		walk(d.Index, visit)
+	case ast.SliceNode:
+		walk(d.Expr, visit)
+		walk(d.Low, visit)
+		walk(d.High, visit)
+	case ast.LenNode: walk(d.Expr, visit)
+	case ast.FuncCallNode:
+		walk(d.FuncExpr, visit)
+		for _, arg := range d.Args {
+			walk(arg, visit)
+		}
+	case ast.VarDeclNode:
+		for _, init := range d.InitList {
+			walk(init, visit)
+		}
+		walk(d.SizeExpr, visit)
+	case ast.ReturnNode: walk(d.Expr, visit)
+	case ast.DeferNode: walk(d.Expr, visit)
+	case ast.IfNode: walk(d.Cond, visit)
+	case ast.WhileNode: walk(d.Cond, visit)
+	case ast.ForNode:
+		walk(d.Cond, visit)
+		walk(d.Post, visit)
+	case ast.DoWhileNode: walk(d.Cond, visit)
+	case ast.SwitchNode: walk(d.Expr, visit)
+	case ast.CaseNode:
+		for _, v := range d.Values {
+			walk(v, visit)
+		}
+	}
+	for _, child := range stmtChildren(node) {
+		walk(child, visit)
+	}
+}
+
+// stmtChildren returns the statements nested directly in node
+func stmtChildren(node *ast.Node) []*ast.Node {
+	switch d := node.Data.(type) {
+	case ast.BlockNode: return d.Stmts
+	case ast.MultiVarDeclNode: return d.Decls
+	case ast.FuncDeclNode: return []*ast.Node{d.Body}
+	case ast.IfNode: return []*ast.Node{d.ThenBody, d.ElseBody}
+	case ast.WhileNode: return []*ast.Node{d.Body}
+	case ast.ForNode: return []*ast.Node{d.Init, d.Body}
+	case ast.DoWhileNode: return []*ast.Node{d.Body}
+	case ast.SwitchNode: return []*ast.Node{d.Body}
+	case ast.CaseNode: return []*ast.Node{d.Body}
+	case ast.DefaultNode: return []*ast.Node{d.Body}
+	case ast.LabelNode: return []*ast.Node{d.Stmt}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package interp
+
+import (
+	"encoding/binary"
+
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/token"
+)
+
+// Address space of an interpreted program
+// Everything below nullGuard faults, which catches nil dereferences. Functions and stdio handles are given
+// addresses inside the guard so they compare like pointers but can never be read through
+const (
+	funcBase   = 0x1000
+	fileBase   = 0x800
+	nullGuard  = 0x10000
+	heapBase   = 1 << 36
+	stackBase  = 1 << 40
+	stackLimit = 8 << 20
+	pageSize   = 4 << 10
+	heapChunk  = 128 << 10
+)
+
+// segment is a region of the address space that is mapped in whole chunks as it grows, the way the loader maps
+// pages and brk hands memory to a C allocator, so small overruns of an object read and write spare memory
+// instead of faulting, as they would in a compiled program
+type segment struct {
+	base  int64
+	chunk int64
+	top   int64
+	buf   []byte
+}
+
+// alloc reserves size zeroed bytes in the segment
+func (s *segment) alloc(size, align int64) int64 {
+	if align < 1 { align = 1 }
+	off := (s.top + align - 1) &^ (align - 1)
+	s.top = off + size
+	if mapped := (s.top + s.chunk - 1) / s.chunk * s.chunk; mapped > int64(len(s.buf)) {
+		s.buf = append(s.buf, make([]byte, mapped-int64(len(s.buf)))...)
+	}
+	return s.base + off
+}
+
+// bytes returns the size bytes at addr, or nil if any of them is unmapped
+func (s *segment) bytes(addr, size int64) []byte {
+	off := addr - s.base
+	if off < 0 || size < 0 || off+size > int64(len(s.buf)) { return nil }
+	return s.buf[off : off+size]
+}
+
+// memory holds the data segment, which grows upwards from nullGuard, the heap and a fixed-size stack
+type memory struct {
+	data  segment
+	heap  segment
+	stack segment
+}
+
+func newMemory() *memory {
+	return &memory{
+		data:  segment{base: nullGuard, chunk: pageSize},
+		heap:  segment{base: heapBase, chunk: heapChunk},
+		stack: segment{base: stackBase, chunk: stackLimit, buf: make([]byte, stackLimit)},
+	}
+}
+
+func (m *memory) bytes(addr, size int64) []byte {
+	switch {
+	case addr >= stackBase: return m.stack.bytes(addr, size)
+	case addr >= heapBase: return m.heap.bytes(addr, size)
+	}
+	return m.data.bytes(addr, size)
+}
+
+// load reads a value of type typ, extending it to a word the way the QBE backend does
+func (in *Interpreter) load(tok token.Token, addr int64, typ ir.Type) int64 {
+	size := ir.SizeOfType(typ, int(in.ws))
+	b := in.mem.bytes(addr, size)
+	if b == nil { in.segfault(tok, addr) }
+	switch typ {
+	case ir.TypeSB: return int64(int8(b[0]))
+	case ir.TypeB, ir.TypeUB: return int64(b[0])
+	case ir.TypeSH: return int64(int16(binary.LittleEndian.Uint16(b)))
+	case ir.TypeH, ir.TypeUH: return int64(binary.LittleEndian.Uint16(b))
+	case ir.TypeW: return int64(int32(binary.LittleEndian.Uint32(b)))
+	case ir.TypeS: return int64(binary.LittleEndian.Uint32(b))
+	}
+	if size == 4 { return int64(int32(binary.LittleEndian.Uint32(b))) }
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+// store writes the low bytes of v as a value of type typ
+func (in *Interpreter) store(tok token.Token, addr int64, typ ir.Type, v int64) {
+	size := ir.SizeOfType(typ, int(in.ws))
+	b := in.mem.bytes(addr, size)
+	if b == nil { in.segfault(tok, addr) }
+	switch size {
+	case 1: b[0] = byte(v)
+	case 2: binary.LittleEndian.PutUint16(b, uint16(v))
+	case 4: binary.LittleEndian.PutUint32(b, uint32(v))
+	default: binary.LittleEndian.PutUint64(b, uint64(v))
+	}
+}
+
+// blit copies size bytes from src to dst
+func (in *Interpreter) blit(tok token.Token, dst, src, size int64) {
+	if size <= 0 { return }
+	from, to := in.mem.bytes(src, size), in.mem.bytes(dst, size)
+	if from == nil { in.segfault(tok, src) }
+	if to == nil { in.segfault(tok, dst) }
+	copy(to, from)
+}
+
+// keepStruct copies the struct a call returned at addr, in the frame of the callee that the next call reuses, to
+// the frame of the caller
+func (in *Interpreter) keepStruct(tok token.Token, addr, size, align int64) int64 {
+	b := in.mem.bytes(addr, size)
+	if b == nil { in.segfault(tok, addr) }
+	saved := append([]byte(nil), b...)
+	addr = in.stackAlloc(tok, size, align)
+	copy(in.mem.bytes(addr, size), saved)
+	return addr
+}
+
+// cString reads the NUL-terminated string at addr
+func (in *Interpreter) cString(tok token.Token, addr int64) string {
+	var out []byte
+	for {
+		b := in.mem.bytes(addr, 1)
+		if b == nil { in.segfault(tok, addr) }
+		if b[0] == 0 { return string(out) }
+		out = append(out, b[0])
+		addr++
+	}
+}
+
+// stackAlloc reserves size zeroed bytes on the stack of the current call
+func (in *Interpreter) stackAlloc(tok token.Token, size, align int64) int64 {
+	if align < 1 { align = 1 }
+	addr := (in.sp + align - 1) &^ (align - 1)
+	b := in.mem.stack.bytes(addr, size)
+	if b == nil { in.fault(tok, sigSEGV, "stack overflow") }
+	clear(b)
+	in.sp = addr + size
+	return addr
+}
+
+// stringAddr returns the address of the interned, NUL-terminated copy of s
+func (in *Interpreter) stringAddr(s string) int64 {
+	if addr, ok := in.strings[s]; ok { return addr }
+	addr := in.mem.data.alloc(int64(len(s))+1, 1)
+	copy(in.mem.bytes(addr, int64(len(s))), s)
+	in.strings[s] = addr
+	return addr
+}
@@ -0,0 +1,107 @@
+package interp
+
+import (
+	"github.com/xplshn/gbc/pkg/ast"
+	"github.com/xplshn/gbc/pkg/config"
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/token"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// A slice is the address of its header, laid out as ast.SliceHeader: a pointer to its first element, then its length
+
+// sliceType returns the slice type t is or names, or nil if it is neither
+func (in *Interpreter) sliceType(t *ast.BxType) *ast.BxType {
+	if t = in.resolve(t); t != nil && t.Kind == ast.TYPE_SLICE { return t }
+	return nil
+}
+
+// sliceHeader reads the pointer and the length of the slice whose header is at addr
+func (in *Interpreter) sliceHeader(tok token.Token, addr int64) (ptr, length int64) {
+	return in.load(tok, addr, ir.TypePtr), in.load(tok, addr+in.ws, in.irType(ast.TypeInt))
+}
+
+// newSlice makes a header on the stack for length elements at ptr
+func (in *Interpreter) newSlice(tok token.Token, ptr, length int64) int64 {
+	addr := in.stackAlloc(tok, in.sizeof(ast.SliceHeader), in.alignof(ast.SliceHeader))
+	in.store(tok, addr, ir.TypePtr, ptr)
+	in.store(tok, addr+in.ws, in.irType(ast.TypeInt), length)
+	return addr
+}
+
+// evalSlice makes expr[low:high], trapping under -Fbounds-check unless 0 <= low <= high <= len(expr)
+func (in *Interpreter) evalSlice(node *ast.Node) int64 {
+	d := node.Data.(ast.SliceNode)
+	ptr, length, known := in.eval(d.Expr), int64(0), true
+	switch {
+	case in.sliceType(d.Expr.Typ) != nil: ptr, length = in.sliceHeader(node.Tok, ptr)
+	case d.Expr.Type == ast.String: length = int64(len(d.Expr.Data.(ast.StringNode).Value))
+	default: length, known = in.knownLength(d.Expr)
+	}
+
+	low, high := int64(0), length
+	if d.Low != nil { low = in.eval(d.Low) }
+	if d.High != nil { high = in.eval(d.High) }
+	if !known { length = high }
+	if in.checkEnabled(config.FeatBoundsCheck) && (low < 0 || low > high || high > length) {
+		in.trap(node.Tok, 0, "slice bounds [%d:%d] out of range [0,%d]", low, high, length)
+	}
+	return in.newSlice(node.Tok, ptr+low*in.sizeof(in.sliceType(node.Typ).Base), high-low)
+}
+
+// evalLen is the length of a slice, or that of an array, which is known
+func (in *Interpreter) evalLen(node *ast.Node) int64 {
+	expr := node.Data.(ast.LenNode).Expr
+	if in.sliceType(expr.Typ) == nil {
+		if n, ok := in.knownLength(expr); ok { return n }
+	}
+	_, length := in.sliceHeader(node.Tok, in.eval(expr))
+	return length
+}
+
+// layoutGlobalSlice lays out a global slice initialized with init, which is a string, the start of a global
+// array up to a constant bound, nil or an array literal of constants
+func (in *Interpreter) layoutGlobalSlice(sym *symbol, init *ast.Node) {
+	sym.addr = in.mem.data.alloc(in.sizeof(ast.SliceHeader), in.alignof(ast.SliceHeader))
+	header := func(ptr, length int64) {
+		in.store(init.Tok, sym.addr, ir.TypePtr, ptr)
+		in.store(init.Tok, sym.addr+in.ws, in.irType(ast.TypeInt), length)
+	}
+
+	if init.Type == ast.ArrayLiteral {
+		d := init.Data.(ast.ArrayLiteralNode)
+		if len(d.Values) == 0 { return }
+		elemType, size := in.irType(d.ElementType), in.sizeof(d.ElementType)
+		elems := in.mem.data.alloc(int64(len(d.Values))*size, in.alignof(d.ElementType))
+		for i, v := range d.Values {
+			val, _ := in.globalConst(v, elemType)
+			in.store(v.Tok, elems+int64(i)*size, elemType, val)
+		}
+		header(elems, int64(len(d.Values)))
+		return
+	}
+
+	if init.Type == ast.Slice {
+		d := init.Data.(ast.SliceNode)
+		var length int64
+		ok := true
+		switch d.Expr.Type {
+		case ast.String: length = int64(len(d.Expr.Data.(ast.StringNode).Value))
+		case ast.Ident: length, ok = in.knownLength(d.Expr)
+		default: ok = false
+		}
+		high := length
+		if ok && d.Low != nil {
+			low, isConst := in.evalConst(d.Low)
+			ok = isConst && low == 0
+		}
+		if ok && d.High != nil { high, ok = in.evalConst(d.High) }
+		if ok {
+			if high < 0 || high > length { util.Error(init.Tok, "Slice bounds [0:%d] out of range [0,%d]", high, length) }
+			ptr, _ := in.globalConst(d.Expr, ir.TypePtr)
+			header(ptr, high)
+			return
+		}
+	}
+	util.Error(init.Tok, "Global slice initializer must be a string, a global array sliced from 0 to a constant, nil or an array literal of constants")
+}
@@ -0,0 +1,110 @@
+package interp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xplshn/gbc/pkg/ast"
+	"github.com/xplshn/gbc/pkg/token"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// Longest string and number of elements FormatValue shows before eliding the rest
+const (
+	maxShownString   = 256
+	maxShownElements = 16
+)
+
+// FormatValue renders v, a value of type t as Call returns it, the way a B programmer would write it: numbers
+// in decimal, strings quoted, structs, fixed-size arrays and slices by their contents read from memory
+func (in *Interpreter) FormatValue(v int64, t *ast.BxType) (s string) {
+	// Pointers may point anywhere; what cannot be read is shown as an address
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*Fault); !ok { panic(r) }
+			s = fmt.Sprintf("0x%x", uint64(v))
+		}
+	}()
+	return in.formatValue(v, t)
+}
+
+func (in *Interpreter) formatValue(v int64, t *ast.BxType) string {
+	t = in.resolve(t)
+	if isUntyped(t) { return strconv.FormatInt(v, 10) }
+	switch t.Kind {
+	case ast.TYPE_FLOAT, ast.TYPE_LITERAL_FLOAT:
+		return strconv.FormatFloat(toFloat(v, floatIRType(in.irType(t))), 'g', -1, 64)
+	case ast.TYPE_BOOL: return strconv.FormatBool(v != 0)
+	case ast.TYPE_NIL: return "nil"
+	case ast.TYPE_POINTER:
+		if v == 0 { return "nil" }
+		if t.Name == "string" || t.Base != nil && t.Base.Kind == ast.TYPE_PRIMITIVE && t.Base.Name == "byte" {
+			return in.formatString(v)
+		}
+		return fmt.Sprintf("0x%x", uint64(v))
+	case ast.TYPE_FUNC:
+		if v == 0 { return "nil" }
+		return fmt.Sprintf("0x%x", uint64(v))
+	case ast.TYPE_STRUCT, ast.TYPE_UNION:
+		var sb strings.Builder
+		var off int64
+		sb.WriteString("{")
+		for i, field := range t.Fields {
+			fd := field.Data.(ast.VarDeclNode)
+			off = util.AlignUp(off, in.alignof(fd.Type))
+			if i > 0 { sb.WriteString(", ") }
+			fmt.Fprintf(&sb, "%s: %s", fd.Name, in.formatValue(in.loadValue(v+off, fd.Type), fd.Type))
+			if t.Kind == ast.TYPE_STRUCT { off += in.sizeof(fd.Type) }
+		}
+		sb.WriteString("}")
+		return sb.String()
+	case ast.TYPE_ARRAY:
+		n, ok := in.evalConst(t.ArraySize)
+		if !ok { return fmt.Sprintf("0x%x", uint64(v)) }
+		return in.formatElems(v, n, t.Base)
+	case ast.TYPE_SLICE:
+		ptr, n := in.sliceHeader(token.Token{}, v)
+		return in.formatElems(ptr, n, t.Base)
+	}
+
+	size := in.sizeof(t)
+	if strings.HasPrefix(t.Name, "uint") || t.Name == "byte" {
+		return strconv.FormatUint(uint64(v)<<(64-8*size)>>(64-8*size), 10)
+	}
+	return strconv.FormatInt(v<<(64-8*size)>>(64-8*size), 10)
+}
+
+// formatElems renders the n elements of type elem at addr
+func (in *Interpreter) formatElems(addr, n int64, elem *ast.BxType) string {
+	var sb strings.Builder
+	sb.WriteString("[")
+	stride := in.sizeof(elem)
+	for i := int64(0); i < n; i++ {
+		if i > 0 { sb.WriteString(", ") }
+		if i == maxShownElements {
+			sb.WriteString("...")
+			break
+		}
+		sb.WriteString(in.formatValue(in.loadValue(addr+i*stride, elem), elem))
+	}
+	sb.WriteString("]")
+	return sb.String()
+}
+
+// loadValue reads a value of type t stored at addr; aggregates are represented by their address
+func (in *Interpreter) loadValue(addr int64, t *ast.BxType) int64 {
+	if r := in.resolve(t); r != nil && (r.HasFields() || r.Kind == ast.TYPE_ARRAY || r.Kind == ast.TYPE_SLICE) { return addr }
+	return in.load(token.Token{}, addr, in.irType(t))
+}
+
+func (in *Interpreter) formatString(addr int64) string {
+	var out []byte
+	for len(out) < maxShownString {
+		b := in.mem.bytes(addr+int64(len(out)), 1)
+		if b == nil { in.segfault(token.Token{}, addr) }
+		if b[0] == 0 { return strconv.Quote(string(out)) }
+		out = append(out, b[0])
+	}
+	return strconv.Quote(string(out)) + "..."
+}
@@ -0,0 +1,483 @@
+package interp
+
+import (
+	"math"
+	"sort"
+
+	"github.com/xplshn/gbc/pkg/ir"
+	"github.com/xplshn/gbc/pkg/token"
+	"github.com/xplshn/gbc/pkg/util"
+)
+
+// The IR virtual machine runs the ir.Program codegen produces, without a backend, so that a program behaving
+// differently compiled and on the VM points at the backend, and one misbehaving on both points at the front end
+// It shares the address space, stdio and builtins of the AST interpreter; extrn functions without a body in the
+// program, including those written in assembly, are served by the builtin of the same name
+
+// vmFunc is an ir.Func resolved for execution: temporaries are numbered registers and labels are block indices
+type vmFunc struct {
+	name   string
+	ret    ir.Type
+	blocks []*vmBlock
+	regs   []ir.Type // type of the value each register holds
+	params []int
+}
+
+type vmBlock struct {
+	phis   []*vmInstr
+	instrs []*vmInstr
+}
+
+type vmInstr struct {
+	*ir.Instruction
+	result  int // register written, or -1
+	args    []operand
+	targets []int // successors of a jump, or the predecessor each phi argument comes from
+}
+
+// operand is a register, or an immediate when reg is negative
+type operand struct {
+	reg int
+	imm int64
+	typ ir.Type
+}
+
+type tempKey struct {
+	name string
+	id   int
+}
+
+// RunIR executes the main function of prog with the given argv and returns its exit status
+// A *Fault is returned when the program crashes, in which case the status is meaningless
+func (in *Interpreter) RunIR(prog *ir.Program, args []string) (status int, err error) {
+	defer in.finish(&status, &err)
+
+	in.layoutData(prog)
+	for _, f := range prog.Funcs {
+		fn := in.lookupFunc(f.Name)
+		fn.builtin, fn.code = nil, in.compile(f)
+	}
+
+	main := in.funcs["main"]
+	if main == nil || main.code == nil {
+		return 0, &Fault{Msg: "program has no main function", Signal: sigSEGV}
+	}
+
+	in.sp = stackBase
+	argv := in.mem.data.alloc(int64(len(args)+1)*in.ws, in.ws)
+	for i, a := range args {
+		in.store(token.Token{}, argv+int64(i)*in.ws, ir.TypePtr, in.stringAddr(a))
+	}
+	ret := in.callIR(token.Token{}, main, []int64{int64(len(args)), argv})
+	return int(ret & 0xff), nil
+}
+
+// layoutData places the globals and string literals of prog in the data segment and fills them in
+// Addresses are assigned before any item is written, since items may refer to globals defined after them
+func (in *Interpreter) layoutData(prog *ir.Program) {
+	in.irGlobals = make(map[string]int64)
+	for _, g := range prog.Globals {
+		var size int64
+		for _, item := range g.Items {
+			itemSize := ir.SizeOfType(item.Typ, int(in.ws))
+			if item.Count > 0 { itemSize *= int64(item.Count) }
+			size += itemSize
+		}
+		align := int64(g.Align)
+		if align == 0 { align = in.ws }
+		in.irGlobals[g.Name] = in.mem.data.alloc(size, align)
+	}
+
+	labels := make([]string, 0, len(prog.Strings))
+	values := make(map[string]string, len(prog.Strings))
+	for s, label := range prog.Strings {
+		labels = append(labels, label)
+		values[label] = s
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		s := values[label]
+		addr := in.mem.data.alloc(int64(len(s))+1, 1)
+		copy(in.mem.bytes(addr, int64(len(s))), s)
+		in.irGlobals[label] = addr
+	}
+
+	// extrn variables not defined by the program are the C library's, such as the stdio handles
+	for name := range prog.ExtrnVars {
+		if _, ok := in.irGlobals[name]; ok { continue }
+		addr := in.mem.data.alloc(in.ws, in.ws)
+		in.store(token.Token{}, addr, ir.TypePtr, externVars[name])
+		in.irGlobals[name] = addr
+	}
+
+	for _, g := range prog.Globals {
+		addr := in.irGlobals[g.Name]
+		for _, item := range g.Items {
+			size := ir.SizeOfType(item.Typ, int(in.ws))
+			if item.Count > 0 {
+				addr += size * int64(item.Count)
+				continue
+			}
+			o := in.resolveOperand(item.Value, nil)
+			in.store(token.Token{}, addr, item.Typ, convertFloat(o.imm, o.typ, item.Typ))
+			addr += size
+		}
+	}
+}
+
+// globalAddrIR is the address of a global symbol of the IR: data, a string literal or a function
+func (in *Interpreter) globalAddrIR(name string) int64 {
+	if addr, ok := in.irGlobals[name]; ok { return addr }
+	return in.lookupFunc(name).addr
+}
+
+// compile resolves the temporaries and labels of f
+func (in *Interpreter) compile(f *ir.Func) *vmFunc {
+	code := &vmFunc{name: f.Name, ret: f.ReturnType}
+	regs := make(map[tempKey]int)
+	define := func(v ir.Value, typ ir.Type) int {
+		t, ok := v.(*ir.Temporary)
+		if !ok || t == nil { return -1 }
+		key := tempKey{t.Name, t.ID}
+		if r, ok := regs[key]; ok { return r }
+		regs[key] = len(code.regs)
+		code.regs = append(code.regs, typ)
+		return regs[key]
+	}
+
+	for _, p := range f.Params {
+		code.params = append(code.params, define(p.Val, p.Typ))
+	}
+	blockIndex := make(map[string]int)
+	for i, b := range f.Blocks {
+		blockIndex[b.Label.Name] = i
+		for _, instr := range b.Instructions {
+			if instr.Result != nil { define(instr.Result, resultType(instr, int(in.ws))) }
+		}
+	}
+
+	target := func(instr *ir.Instruction, v ir.Value) int {
+		i, ok := blockIndex[v.String()]
+		if !ok { util.Error(instr.Pos, "internal: jump to undefined block '%s' in '%s'", v.String(), f.Name) }
+		return i
+	}
+
+	reg := regsOf(code, regs)
+	for _, b := range f.Blocks {
+		block := &vmBlock{}
+		for _, instr := range b.Instructions {
+			vi := &vmInstr{Instruction: instr, result: define(instr.Result, resultType(instr, int(in.ws)))}
+			switch instr.Op {
+			case ir.OpJmp: vi.targets = []int{target(instr, instr.Args[0])}
+			case ir.OpJnz:
+				vi.args = []operand{in.resolveOperand(instr.Args[0], reg)}
+				vi.targets = []int{target(instr, instr.Args[1]), target(instr, instr.Args[2])}
+			case ir.OpPhi:
+				for i := 0; i+1 < len(instr.Args); i += 2 {
+					vi.targets = append(vi.targets, target(instr, instr.Args[i]))
+					vi.args = append(vi.args, in.resolveOperand(instr.Args[i+1], reg))
+				}
+			default:
+				for _, arg := range instr.Args {
+					vi.args = append(vi.args, in.resolveOperand(arg, reg))
+				}
+			}
+			if instr.Op == ir.OpPhi {
+				block.phis = append(block.phis, vi)
+			} else {
+				block.instrs = append(block.instrs, vi)
+			}
+		}
+		code.blocks = append(code.blocks, block)
+	}
+	return code
+}
+
+// regsOf looks up the register of a temporary of code, with its type
+func regsOf(code *vmFunc, regs map[tempKey]int) func(t *ir.Temporary) (int, ir.Type) {
+	return func(t *ir.Temporary) (int, ir.Type) {
+		r, ok := regs[tempKey{t.Name, t.ID}]
+		if !ok { return -1, ir.TypeNone }
+		return r, code.regs[r]
+	}
+}
+
+// resolveOperand turns an IR value into a register or an immediate; globals become their addresses
+func (in *Interpreter) resolveOperand(v ir.Value, reg func(t *ir.Temporary) (int, ir.Type)) operand {
+	switch val := v.(type) {
+	case nil: return operand{reg: -1}
+	case *ir.Const: return operand{reg: -1, imm: val.Value}
+	case *ir.FloatConst:
+		typ := floatIRType(val.Typ)
+		return operand{reg: -1, imm: fromFloat(val.Value, typ), typ: typ}
+	case *ir.Global: return operand{reg: -1, imm: in.globalAddrIR(val.Name), typ: ir.TypePtr}
+	case *ir.CastValue: return in.resolveOperand(val.Value, reg)
+	case *ir.Temporary:
+		if reg != nil {
+			if r, typ := reg(val); r >= 0 { return operand{reg: r, typ: typ} }
+		}
+		util.Error(token.Token{}, "internal: use of undefined temporary '%s'", val.Name)
+	}
+	util.Error(token.Token{}, "internal: label '%s' used as a value", v.String())
+	return operand{}
+}
+
+// resultType is the type of the value an instruction leaves in its result
+// Comparisons yield a word, and sub-word loads are extended to one as the backends do
+func resultType(instr *ir.Instruction, wordSize int) ir.Type {
+	switch {
+	case instr.Op >= ir.OpCEq && instr.Op <= ir.OpCGe: return ir.GetType(nil, wordSize)
+	case instr.Op == ir.OpLoad && ir.SizeOfType(instr.Typ, wordSize) < 4: return ir.GetType(nil, wordSize)
+	}
+	return instr.Typ
+}
+
+func (o *operand) get(regs []int64) int64 {
+	if o.reg < 0 { return o.imm }
+	return regs[o.reg]
+}
+
+// float reads the operand as a floating-point value, taking untyped immediates as the bits of a typ
+func (o *operand) float(regs []int64, typ ir.Type) float64 {
+	if o.typ == ir.TypeS || o.typ == ir.TypeD { typ = o.typ }
+	return toFloat(o.get(regs), typ)
+}
+
+func isFloatType(t ir.Type) bool { return t == ir.TypeS || t == ir.TypeD }
+
+// convertFloat converts a floating-point value between single and double precision; other values pass through
+func convertFloat(v int64, from, to ir.Type) int64 {
+	if !isFloatType(from) || !isFloatType(to) || from == to { return v }
+	return fromFloat(toFloat(v, from), to)
+}
+
+// extend widens a value of type t to a word the way call arguments and results are passed
+func extend(v int64, t ir.Type) int64 {
+	switch t {
+	case ir.TypeW: return int64(int32(v))
+	case ir.TypeSB: return int64(int8(v))
+	case ir.TypeB, ir.TypeUB: return int64(uint8(v))
+	case ir.TypeSH: return int64(int16(v))
+	case ir.TypeH, ir.TypeUH: return int64(uint16(v))
+	}
+	return v
+}
+
+// callIR runs fn, a function of the program or a builtin, with args
+func (in *Interpreter) callIR(tok token.Token, fn *function, args []int64) int64 {
+	code := fn.code
+	if code == nil {
+		if fn.builtin != nil { return fn.builtin(in, tok, args) }
+		in.fault(tok, sigSEGV, "call of undefined function '%s'", fn.name)
+	}
+
+	regs := make([]int64, len(code.regs))
+	for i, r := range code.params {
+		if i < len(args) { regs[r] = args[i] }
+	}
+	prevSp := in.sp
+	ret := in.execIR(code, regs)
+	in.sp = prevSp
+	return ret
+}
+
+// execIR runs the blocks of code from the first until one returns; a block without a jump falls through
+func (in *Interpreter) execIR(code *vmFunc, regs []int64) int64 {
+	block, prev := 0, -1
+	phiVals := make([]int64, 0, 4)
+	for block < len(code.blocks) {
+		b := code.blocks[block]
+		// Phis read the values live at the end of the predecessor, so all are evaluated before any is written
+		phiVals = phiVals[:0]
+		for _, phi := range b.phis {
+			var v int64
+			for i, from := range phi.targets {
+				if from == prev {
+					v = phi.args[i].get(regs)
+					break
+				}
+			}
+			phiVals = append(phiVals, v)
+		}
+		for i, phi := range b.phis {
+			regs[phi.result] = phiVals[i]
+		}
+
+		prev, block = block, block+1
+		for _, instr := range b.instrs {
+			switch instr.Op {
+			case ir.OpJmp:
+				block = instr.targets[0]
+			case ir.OpJnz:
+				block = instr.targets[1]
+				if instr.args[0].get(regs) != 0 { block = instr.targets[0] }
+			case ir.OpRet:
+				if len(instr.args) == 0 { return 0 }
+				return convertFloat(instr.args[0].get(regs), instr.args[0].typ, code.ret)
+			default:
+				v := in.execInstr(instr, regs)
+				if instr.result >= 0 { regs[instr.result] = v }
+				continue
+			}
+			break
+		}
+	}
+	return 0
+}
+
+// execInstr evaluates an instruction that does not transfer control and returns its result
+func (in *Interpreter) execInstr(instr *vmInstr, regs []int64) int64 {
+	tok, typ, args := instr.Pos, instr.Typ, instr.args
+	switch instr.Op {
+	case ir.OpAlloc:
+		align := int64(instr.Align)
+		if align == 0 { align = int64(in.cfg.StackAlignment) }
+		return in.stackAlloc(tok, args[0].get(regs), align)
+	case ir.OpLoad: return in.load(tok, args[0].get(regs), typ)
+	case ir.OpStore:
+		in.store(tok, args[1].get(regs), typ, convertFloat(args[0].get(regs), args[0].typ, typ))
+		return 0
+	case ir.OpBlit:
+		size := ir.SizeOfType(typ, int(in.ws))
+		if len(args) > 2 { size = args[2].get(regs) }
+		in.blit(tok, args[1].get(regs), args[0].get(regs), size)
+		return 0
+	case ir.OpCall:
+		fn := in.byAddr[args[0].get(regs)]
+		if fn == nil { in.segfault(tok, args[0].get(regs)) }
+		callArgs := make([]int64, len(args)-1)
+		sp := in.sp
+		for i := range callArgs {
+			callArgs[i] = args[i+1].get(regs)
+			if i < len(instr.ArgTypes) { callArgs[i] = extend(callArgs[i], instr.ArgTypes[i]) }
+			// A struct is passed by value, as a copy in the frame of the caller
+			if i < len(instr.ArgStructs) && instr.ArgStructs[i] != nil {
+				s := instr.ArgStructs[i]
+				addr := in.stackAlloc(tok, s.Size, s.Align)
+				in.blit(tok, addr, callArgs[i], s.Size)
+				callArgs[i] = addr
+			}
+		}
+		ret := in.callIR(tok, fn, callArgs)
+		in.sp = sp
+		if s := instr.RetStruct; s != nil && ret != 0 { ret = in.keepStruct(tok, ret, s.Size, s.Align) }
+		return extend(ret, typ)
+	case ir.OpAsm:
+		in.fault(tok, sigSEGV, "inline assembly cannot be interpreted")
+
+	case ir.OpAddF, ir.OpSubF, ir.OpMulF, ir.OpDivF, ir.OpRemF:
+		l, r := args[0].float(regs, typ), args[1].float(regs, typ)
+		var res float64
+		switch instr.Op {
+		case ir.OpAddF: res = l + r
+		case ir.OpSubF: res = l - r
+		case ir.OpMulF: res = l * r
+		case ir.OpDivF: res = l / r
+		case ir.OpRemF: res = math.Mod(l, r)
+		}
+		return fromFloat(res, floatIRType(typ))
+	case ir.OpNegF: return fromFloat(-args[0].float(regs, typ), floatIRType(typ))
+
+	case ir.OpCEq, ir.OpCNeq, ir.OpCLt, ir.OpCGt, ir.OpCLe, ir.OpCGe: return in.compareIR(instr, regs)
+
+	case ir.OpExtSB: return int64(int8(args[0].get(regs)))
+	case ir.OpExtUB: return int64(uint8(args[0].get(regs)))
+	case ir.OpExtSH: return int64(int16(args[0].get(regs)))
+	case ir.OpExtUH: return int64(uint16(args[0].get(regs)))
+	case ir.OpExtSW: return int64(int32(args[0].get(regs)))
+	case ir.OpExtUW: return int64(uint32(args[0].get(regs)))
+	case ir.OpTrunc: return extend(args[0].get(regs), typ)
+	case ir.OpCast: return args[0].get(regs)
+
+	case ir.OpFToSI:
+		f := args[0].float(regs, ir.TypeD)
+		if typ == ir.TypeW { return int64(int32(f)) }
+		return int64(f)
+	case ir.OpFToUI:
+		f := args[0].float(regs, ir.TypeD)
+		if typ == ir.TypeW { return int64(uint32(f)) }
+		return int64(uint64(f))
+	case ir.OpSWToF: return fromFloat(float64(int32(args[0].get(regs))), floatIRType(typ))
+	case ir.OpUWToF: return fromFloat(float64(uint32(args[0].get(regs))), floatIRType(typ))
+	case ir.OpSLToF: return fromFloat(float64(args[0].get(regs)), floatIRType(typ))
+	case ir.OpULToF: return fromFloat(float64(uint64(args[0].get(regs))), floatIRType(typ))
+	case ir.OpFToF:
+		// An operand of unknown type holds the other precision
+		from := args[0].typ
+		if !isFloatType(from) {
+			from = ir.TypeS
+			if typ == ir.TypeS { from = ir.TypeD }
+		}
+		return fromFloat(toFloat(args[0].get(regs), from), floatIRType(typ))
+	}
+	return in.arithIR(instr, args[0].get(regs), args[1].get(regs))
+}
+
+// arithIR evaluates integer arithmetic with the width of its type
+// Words wrap at 32 bits; sub-word types are computed in a full word, as the QBE backend promotes them
+func (in *Interpreter) arithIR(instr *vmInstr, l, r int64) int64 {
+	narrow := instr.Typ == ir.TypeW
+	var res int64
+	switch instr.Op {
+	case ir.OpAdd: res = l + r
+	case ir.OpSub: res = l - r
+	case ir.OpMul: res = l * r
+	case ir.OpAnd: res = l & r
+	case ir.OpOr: res = l | r
+	case ir.OpXor: res = l ^ r
+	case ir.OpShl:
+		if narrow { return int64(int32(uint32(l) << uint64(r&31))) }
+		res = l << uint64(r&63)
+	case ir.OpShr:
+		// shr is a logical shift
+		if narrow { return int64(int32(uint32(l) >> uint64(r&31))) }
+		return int64(uint64(l) >> uint64(r&63))
+	case ir.OpDiv, ir.OpRem:
+		if narrow { l, r = int64(int32(l)), int64(int32(r)) }
+		if r == 0 { in.fault(instr.Pos, sigFPE, "integer division by zero") }
+		if r == -1 && (l == math.MinInt64 || narrow && l == math.MinInt32) { in.fault(instr.Pos, sigFPE, "integer overflow") }
+		if instr.Op == ir.OpDiv {
+			res = l / r
+		} else {
+			res = l % r
+		}
+	default:
+		util.Error(instr.Pos, "internal: unsupported IR operation %d", instr.Op)
+	}
+	if narrow { return int64(int32(res)) }
+	return res
+}
+
+// compareIR evaluates a comparison of two operands of its operand type, which defaults to that of the operands
+func (in *Interpreter) compareIR(instr *vmInstr, regs []int64) int64 {
+	l, r := &instr.args[0], &instr.args[1]
+	typ := instr.OperandType
+	if typ == ir.TypeNone {
+		typ = l.typ
+		if isFloatType(r.typ) { typ = r.typ }
+	}
+
+	var lt, eq bool
+	switch {
+	case isFloatType(typ):
+		lf, rf := l.float(regs, typ), r.float(regs, typ)
+		lt, eq = lf < rf, lf == rf
+		// Comparisons with NaN are false, except for inequality
+		if lf != lf || rf != rf { return b2i(instr.Op == ir.OpCNeq) }
+	case typ == ir.TypeW:
+		lv, rv := int32(l.get(regs)), int32(r.get(regs))
+		lt, eq = lv < rv, lv == rv
+	default:
+		lv, rv := l.get(regs), r.get(regs)
+		lt, eq = lv < rv, lv == rv
+	}
+
+	switch instr.Op {
+	case ir.OpCEq: return b2i(eq)
+	case ir.OpCNeq: return b2i(!eq)
+	case ir.OpCLt: return b2i(lt)
+	case ir.OpCGt: return b2i(!lt && !eq)
+	case ir.OpCLe: return b2i(lt || eq)
+	}
+	return b2i(!lt)
+}
@@ -1,7 +1,11 @@
 package ir
 
 import (
+	"strconv"
+	"strings"
+
 	"github.com/xplshn/gbc/pkg/ast"
+	"github.com/xplshn/gbc/pkg/token"
 )
 
 type Op int
@@ -53,6 +57,7 @@ const (
 	OpRet
 	OpCall
 	OpPhi
+	OpAsm
 )
 
 type Type int
@@ -104,12 +109,38 @@ type Func struct {
 	AstParams     []*ast.Node
 	ReturnType    Type
 	AstReturnType *ast.BxType
+	RetStruct     *StructLayout // of the struct the function returns by value, nil if it returns none
 	HasVarargs    bool
 	Blocks        []*BasicBlock
 	Node          *ast.Node
+	Frame         Value    // result of the frame OpAlloc, nil if the function has no locals
+	Locals        []*Local // params and autos living in Frame, used for debug info
+}
+
+// Param is a parameter of a function. Val of a struct passed by value holds the address of a copy of it
+type Param struct{ Name string; Typ Type; Val Value; Struct *StructLayout }
+
+// StructLayout is a struct passed or returned by value, described for the backends to lower it by the C calling
+// convention of their target. Fields are its scalars, with those of nested structs and arrays flattened into it
+type StructLayout struct {
+	Type   *ast.BxType
+	Size   int64
+	Align  int64
+	Fields []StructField
 }
 
-type Param struct{ Name string; Typ Type; Val Value }
+type StructField struct{ Offset int64; Typ Type }
+
+// Local is a named slot inside a function's stack frame
+type Local struct {
+	Name     string
+	Offset   int64
+	Size     int64
+	AstType  *ast.BxType
+	IsVector bool
+	ArgIndex int // 1-based position for parameters, 0 for autos
+	Tok      token.Token
+}
 
 type BasicBlock struct{ Label *Label; Instructions []*Instruction }
 
@@ -121,8 +152,35 @@ type Instruction struct {
 	Args        []Value
 	ArgTypes    []Type
 	Align       int
+	Pos         token.Token // source position of the statement that produced it
+	Asm         *InlineAsm  // the `__asm__` statement of an OpAsm
+	// The structs an OpCall passes and returns by value, nil for the other arguments. Such an argument is the
+	// address of the struct, and so is the result
+	ArgStructs []*StructLayout
+	RetStruct  *StructLayout
+	// Sig is the signature of the function an OpCall calls through a pointer, nil when it is not known
+	Sig *Signature
 }
 
+// Signature is the type of a function: its parameters, then its varargs when Variadic, and its result
+type Signature struct {
+	Params   []Type
+	Result   Type
+	Variadic bool
+}
+
+// InlineAsm is an `__asm__` statement inside a function. Its Template names the operands %0, %1, ... in the order
+// they were written, and %% is a literal %
+type InlineAsm struct {
+	Template string
+	Operands []AsmOperand
+	Clobbers []string
+}
+
+// AsmOperand is a word going into the assembly, one coming out of it, or both for the same register. In is nil
+// for an output, Out is the temporary an output is written to and nil for an input
+type AsmOperand struct{ In, Out Value }
+
 type Program struct {
 	Globals          []*Data
 	Strings          map[string]string
@@ -132,6 +190,7 @@ type Program struct {
 	WordSize         int
 	BackendTempCount int
 	GlobalSymbols    map[string]*ast.Node
+	Types            map[string]*ast.BxType // the types the program declares, by name
 }
 
 type Data struct {
@@ -150,7 +209,7 @@ func GetType(typ *ast.BxType, wordSize int) Type {
 	case ast.TYPE_LITERAL_INT: return typeFromSize(wordSize, false)
 	case ast.TYPE_LITERAL_FLOAT: return typeFromSize(wordSize, true)
 	case ast.TYPE_VOID: return TypeNone
-	case ast.TYPE_POINTER, ast.TYPE_ARRAY, ast.TYPE_STRUCT: return TypePtr
+	case ast.TYPE_POINTER, ast.TYPE_ARRAY, ast.TYPE_STRUCT, ast.TYPE_UNION, ast.TYPE_FUNC: return TypePtr
 	case ast.TYPE_ENUM: return typeFromSize(wordSize, false)
 	case ast.TYPE_FLOAT:
 		size := getTypeSizeByName(typ.Name, wordSize)
@@ -239,6 +298,14 @@ func (p *Program) FindFunc(name string) *Func {
 	return nil
 }
 
+// ResolveType replaces a named type by its declaration
+func (p *Program) ResolveType(t *ast.BxType) *ast.BxType {
+	if t != nil && (t.Kind == ast.TYPE_PRIMITIVE || t.HasFields()) && t.Name != "" {
+		if def := p.Types[t.Name]; def != nil && def != t { return p.ResolveType(def) }
+	}
+	return t
+}
+
 func (p *Program) FindFuncSymbol(name string) *ast.Node {
 	if p.GlobalSymbols != nil {
 		if node, ok := p.GlobalSymbols[name]; ok {
@@ -247,3 +314,45 @@ func (p *Program) FindFuncSymbol(name string) *ast.Node {
 	}
 	return nil
 }
+
+// Defines reports whether the program has a function, `__asm__` function or global variable called name
+func (p *Program) Defines(name string) bool {
+	if p.FindFunc(name) != nil || p.FindFuncSymbol(name) != nil { return true }
+	for _, g := range p.Globals {
+		if g.Name == name { return true }
+	}
+	return false
+}
+
+// Expand rewrites the template of a: each %N becomes operand(N), and the text around them goes through text,
+// with %% turned into a single %
+func (a *InlineAsm) Expand(operand func(n int) string, text func(s string) string) string {
+	var out, run strings.Builder
+	tpl := a.Template
+	for i := 0; i < len(tpl); i++ {
+		if tpl[i] != '%' || i+1 == len(tpl) {
+			run.WriteByte(tpl[i])
+			continue
+		}
+		if tpl[i+1] == '%' {
+			run.WriteByte('%')
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(tpl) && tpl[j] >= '0' && tpl[j] <= '9' {
+			j++
+		}
+		if j == i+1 {
+			run.WriteByte('%')
+			continue
+		}
+		n, _ := strconv.Atoi(tpl[i+1 : j])
+		out.WriteString(text(run.String()))
+		run.Reset()
+		out.WriteString(operand(n))
+		i = j - 1
+	}
+	out.WriteString(text(run.String()))
+	return out.String()
+}
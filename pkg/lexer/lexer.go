@@ -210,6 +210,13 @@ func (l *Lexer) lineCommentOrDirective(startPos, startCol, startLine int) (token
 	return token.Token{}, false
 }
 
+// gatedKeywords are only keywords while their feature is enabled, so that B programs may use them as names
+var gatedKeywords = map[token.Type]config.Feature{
+	token.Defer: config.FeatDefer,
+	token.For:   config.FeatCLoops,
+	token.Do:    config.FeatCLoops,
+}
+
 func (l *Lexer) identifierOrKeyword(startPos, startCol, startLine int) token.Token {
 	for unicode.IsLetter(l.peek()) || unicode.IsDigit(l.peek()) || l.peek() == '_' {
 		l.advance()
@@ -219,7 +226,8 @@ func (l *Lexer) identifierOrKeyword(startPos, startCol, startLine int) token.Tok
 
 	if tokType, isKeyword := token.KeywordMap[value]; isKeyword {
 		isTypedKeyword := tokType >= token.Void && tokType <= token.Any
-		if !isTypedKeyword || l.cfg.IsFeatureEnabled(config.FeatTyped) {
+		feat, isGated := gatedKeywords[tokType]
+		if (!isTypedKeyword || l.cfg.IsFeatureEnabled(config.FeatTyped)) && (!isGated || l.cfg.IsFeatureEnabled(feat)) {
 			tok.Type = tokType
 			tok.Value = ""
 		}
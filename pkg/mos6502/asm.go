@@ -0,0 +1,389 @@
+package mos6502
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Image is an assembled program: Bytes loaded from Origin, and the address of every label
+type Image struct {
+	Origin  uint16
+	Bytes   []byte
+	Symbols map[string]uint16
+}
+
+// SymbolAt names the address pc as the closest label at or before it, for error messages
+func (img *Image) SymbolAt(pc uint16) string {
+	best, at := "", -1
+	for name, addr := range img.Symbols {
+		if int(addr) <= int(pc) && (int(addr) > at || int(addr) == at && name < best) && !strings.HasPrefix(name, "@") {
+			best, at = name, int(addr)
+		}
+	}
+	if best == "" { return fmt.Sprintf("$%04X", pc) }
+	if int(pc) == at { return best }
+	return fmt.Sprintf("%s+%d", best, int(pc)-at)
+}
+
+// stmt is one line of the source: a label, then an instruction, a directive or an equate
+type stmt struct {
+	line    int
+	label   string
+	op      string // mnemonic or directive, upper case
+	args    []string
+	mode    Mode
+	operand string
+	addr    int
+}
+
+type assembler struct {
+	stmts   []*stmt
+	symbols map[string]int
+	pc      int
+	origin  int
+}
+
+// Assemble assembles src, whose lines are `label:`, instructions in the usual MOS syntax, `name = expr` and the
+// directives .org, .byte, .word and .fill; .globl and the other directives of other assemblers are ignored
+// Operands that are known and under $100 when first met use zero page addressing
+func Assemble(src string) (*Image, error) {
+	a := &assembler{symbols: make(map[string]int), origin: -1}
+	for i, text := range strings.Split(src, "\n") {
+		if err := a.parseLine(i+1, text); err != nil { return nil, err }
+	}
+	if err := a.layout(); err != nil { return nil, err }
+	return a.emit()
+}
+
+func (a *assembler) errorf(s *stmt, format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", s.line, fmt.Sprintf(format, args...))
+}
+
+func stripComment(text string) string {
+	quoted := byte(0)
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quoted != 0 && c == '\\': i++
+		case quoted != 0: if c == quoted { quoted = 0 }
+		case c == '"' || c == '\'': quoted = c
+		case c == ';': return text[:i]
+		case c == '/' && i+1 < len(text) && text[i+1] == '/': return text[:i]
+		}
+	}
+	return text
+}
+
+func isSymbolChar(c byte, first bool) bool {
+	return c == '_' || c == '.' || c == '@' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+// splitArgs splits a directive's operands at the commas outside quotes
+func splitArgs(text string) []string {
+	var args []string
+	start, quoted := 0, byte(0)
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quoted != 0 && c == '\\': i++
+		case quoted != 0: if c == quoted { quoted = 0 }
+		case c == '"' || c == '\'': quoted = c
+		case c == ',':
+			args = append(args, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(text[start:]); rest != "" || len(args) > 0 { args = append(args, rest) }
+	return args
+}
+
+func (a *assembler) parseLine(line int, text string) error {
+	text = strings.TrimSpace(stripComment(text))
+	for text != "" {
+		s := &stmt{line: line}
+		n := 0
+		for n < len(text) && isSymbolChar(text[n], n == 0) {
+			n++
+		}
+		rest := strings.TrimSpace(text[n:])
+		switch {
+		case n > 0 && strings.HasPrefix(rest, ":"):
+			s.label = text[:n]
+			a.stmts = append(a.stmts, s)
+			text = strings.TrimSpace(rest[1:])
+			continue
+		case n > 0 && strings.HasPrefix(rest, "=") && !strings.HasPrefix(rest, "=="):
+			s.label, s.op, s.args = text[:n], "=", []string{strings.TrimSpace(rest[1:])}
+		case n > 0:
+			s.op = strings.ToUpper(text[:n])
+			if strings.HasPrefix(s.op, ".") {
+				s.args = splitArgs(rest)
+			} else {
+				s.operand = rest
+			}
+		default: return fmt.Errorf("line %d: cannot parse %q", line, text)
+		}
+		a.stmts = append(a.stmts, s)
+		break
+	}
+	return nil
+}
+
+// layout assigns every statement its address and mode, defining the labels
+func (a *assembler) layout() error {
+	for _, s := range a.stmts {
+		s.addr = a.pc
+		if s.op == "" {
+			if _, dup := a.symbols[s.label]; dup { return a.errorf(s, "label %q defined twice", s.label) }
+			a.symbols[s.label] = a.pc
+			continue
+		}
+		size, err := a.size(s)
+		if err != nil { return err }
+		a.pc += size
+		if a.pc > 0x10000 { return a.errorf(s, "program does not fit in 64 KiB") }
+	}
+	if a.origin < 0 { a.origin = 0 }
+	return nil
+}
+
+func (a *assembler) size(s *stmt) (int, error) {
+	switch s.op {
+	case "=":
+		v, err := a.eval(s.args[0], true)
+		if err != nil { return 0, a.errorf(s, "%v", err) }
+		if _, dup := a.symbols[s.label]; dup { return 0, a.errorf(s, "symbol %q defined twice", s.label) }
+		a.symbols[s.label] = v
+		return 0, nil
+	case ".ORG":
+		if len(s.args) != 1 { return 0, a.errorf(s, ".org takes an address") }
+		v, err := a.eval(s.args[0], true)
+		if err != nil { return 0, a.errorf(s, "%v", err) }
+		if v < a.pc && a.origin >= 0 { return 0, a.errorf(s, ".org $%04X moves back from $%04X", v, a.pc) }
+		if a.origin < 0 { a.origin = v }
+		a.pc, s.addr = v, v
+		return 0, nil
+	case ".BYTE":
+		n := 0
+		for _, arg := range s.args {
+			if str, ok := unquote(arg, '"'); ok {
+				n += len(str)
+			} else {
+				n++
+			}
+		}
+		return n, nil
+	case ".WORD": return 2 * len(s.args), nil
+	case ".FILL":
+		if len(s.args) < 1 || len(s.args) > 2 { return 0, a.errorf(s, ".fill takes a count and an optional value") }
+		v, err := a.eval(s.args[0], true)
+		if err != nil { return 0, a.errorf(s, "%v", err) }
+		return v, nil
+	}
+	if strings.HasPrefix(s.op, ".") { return 0, nil }
+	if a.origin < 0 { a.origin = 0 }
+
+	modes, ok := opcodeModes[s.op]
+	if !ok { return 0, a.errorf(s, "unknown instruction %q", s.op) }
+	mode, operand, err := parseOperand(s.operand, modes)
+	if err != nil { return 0, a.errorf(s, "%s: %v", s.op, err) }
+	s.operand = operand
+	// Zero page is chosen only when the operand is known and small now, so that both passes agree
+	if zp, ok := map[Mode]Mode{Absolute: ZeroPage, AbsoluteX: ZeroPageX, AbsoluteY: ZeroPageY}[mode]; ok {
+		if _, has := modes[zp]; has {
+			if v, err := a.eval(operand, false); err == nil && v >= 0 && v < 0x100 { mode = zp }
+		}
+	}
+	if _, has := modes[mode]; !has { return 0, a.errorf(s, "%s has no such addressing mode", s.op) }
+	s.mode = mode
+	return mode.Size(), nil
+}
+
+// parseOperand finds the mode of an operand, and the expression in it
+func parseOperand(text string, modes map[Mode]byte) (Mode, string, error) {
+	if _, ok := modes[Relative]; ok { return Relative, text, nil }
+	upper := strings.ToUpper(strings.ReplaceAll(text, " ", ""))
+	switch {
+	case text == "":
+		if _, ok := modes[Accumulator]; ok { return Accumulator, "", nil }
+		return Implied, "", nil
+	case upper == "A":
+		if _, ok := modes[Accumulator]; ok { return Accumulator, "", nil }
+	case strings.HasPrefix(text, "#"): return Immediate, strings.TrimSpace(text[1:]), nil
+	case strings.HasPrefix(upper, "(") && strings.HasSuffix(upper, ",X)"):
+		return IndirectX, strings.TrimSpace(text[1:strings.LastIndex(text, ",")]), nil
+	case strings.HasPrefix(upper, "(") && strings.HasSuffix(upper, "),Y"):
+		return IndirectY, strings.TrimSpace(text[1:strings.LastIndex(text, ")")]), nil
+	case strings.HasPrefix(upper, "(") && strings.HasSuffix(upper, ")"):
+		return Indirect, strings.TrimSpace(text[1:strings.LastIndex(text, ")")]), nil
+	case strings.HasSuffix(upper, ",X"): return AbsoluteX, strings.TrimSpace(text[:strings.LastIndex(text, ",")]), nil
+	case strings.HasSuffix(upper, ",Y"): return AbsoluteY, strings.TrimSpace(text[:strings.LastIndex(text, ",")]), nil
+	}
+	return Absolute, text, nil
+}
+
+func unquote(text string, quote byte) (string, bool) {
+	if len(text) < 2 || text[0] != quote || text[len(text)-1] != quote { return "", false }
+	s, err := strconv.Unquote(`"` + strings.ReplaceAll(text[1:len(text)-1], `"`, `\"`) + `"`)
+	if err != nil { return text[1 : len(text)-1], true }
+	return s, true
+}
+
+// eval evaluates an expression: an optional < or > for its low or high byte, then numbers ($hex, %binary,
+// 0x hex, decimal or 'c'), symbols and * for the current address, added and subtracted
+// Without final, an undefined symbol is an error only in that its value is not known yet
+func (a *assembler) eval(text string, final bool) (int, error) {
+	text = strings.TrimSpace(text)
+	part := 0
+	if strings.HasPrefix(text, "<") || strings.HasPrefix(text, ">") {
+		part = map[byte]int{'<': 1, '>': 2}[text[0]]
+		text = strings.TrimSpace(text[1:])
+	}
+	if text == "" { return 0, fmt.Errorf("missing operand") }
+
+	total, sign, i := 0, 1, 0
+	for i < len(text) {
+		for i < len(text) && text[i] == ' ' {
+			i++
+		}
+		if i < len(text) && (text[i] == '-' || text[i] == '+') {
+			if text[i] == '-' { sign = -sign }
+			i++
+			continue
+		}
+		start := i
+		var v int
+		switch c := text[i]; {
+		case c == '*':
+			v = a.pc
+			i++
+		case c == '\'':
+			end := strings.IndexByte(text[i+1:], '\'')
+			if end < 0 { return 0, fmt.Errorf("unterminated character in %q", text) }
+			str, _ := unquote(text[i:i+end+2], '\'')
+			if len(str) != 1 { return 0, fmt.Errorf("bad character in %q", text) }
+			v = int(str[0])
+			i += end + 2
+		case c == '$' || c == '%' || c >= '0' && c <= '9':
+			i++
+			for i < len(text) && (isSymbolChar(text[i], false) && text[i] != '.') {
+				i++
+			}
+			n, err := parseNumber(text[start:i])
+			if err != nil { return 0, err }
+			v = n
+		case isSymbolChar(c, true):
+			for i < len(text) && isSymbolChar(text[i], false) {
+				i++
+			}
+			name := text[start:i]
+			sym, ok := a.symbols[name]
+			if !ok {
+				if final { return 0, fmt.Errorf("undefined symbol %q", name) }
+				return 0, fmt.Errorf("%q is not known yet", name)
+			}
+			v = sym
+		default: return 0, fmt.Errorf("cannot parse %q", text)
+		}
+		total += sign * v
+		sign = 1
+		for i < len(text) && text[i] == ' ' {
+			i++
+		}
+		if i < len(text) && text[i] != '+' && text[i] != '-' { return 0, fmt.Errorf("cannot parse %q", text) }
+	}
+	switch part {
+	case 1: return total & 0xFF, nil
+	case 2: return total >> 8 & 0xFF, nil
+	}
+	return total, nil
+}
+
+func parseNumber(text string) (int, error) {
+	base, digits := 10, text
+	switch {
+	case strings.HasPrefix(text, "$"): base, digits = 16, text[1:]
+	case strings.HasPrefix(text, "%"): base, digits = 2, text[1:]
+	case strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X"): base, digits = 16, text[2:]
+	}
+	n, err := strconv.ParseInt(digits, base, 64)
+	if err != nil { return 0, fmt.Errorf("bad number %q", text) }
+	return int(n), nil
+}
+
+func (a *assembler) emit() (*Image, error) {
+	img := &Image{Origin: uint16(a.origin), Symbols: make(map[string]uint16)}
+	for name, v := range a.symbols {
+		img.Symbols[name] = uint16(v)
+	}
+	put := func(addr int, bytes ...byte) {
+		off := addr - a.origin
+		for len(img.Bytes) < off+len(bytes) {
+			img.Bytes = append(img.Bytes, 0)
+		}
+		copy(img.Bytes[off:], bytes)
+	}
+
+	for _, s := range a.stmts {
+		a.pc = s.addr
+		switch s.op {
+		case "", "=", ".ORG": continue
+		case ".BYTE":
+			addr := s.addr
+			for _, arg := range s.args {
+				if str, ok := unquote(arg, '"'); ok {
+					put(addr, []byte(str)...)
+					addr += len(str)
+					continue
+				}
+				v, err := a.eval(arg, true)
+				if err != nil { return nil, a.errorf(s, "%v", err) }
+				if v < -0x80 || v > 0xFF { return nil, a.errorf(s, "byte value %d out of range", v) }
+				put(addr, byte(v))
+				addr++
+			}
+			continue
+		case ".WORD":
+			for i, arg := range s.args {
+				v, err := a.eval(arg, true)
+				if err != nil { return nil, a.errorf(s, "%v", err) }
+				put(s.addr+2*i, byte(v), byte(v>>8))
+			}
+			continue
+		case ".FILL":
+			n, _ := a.eval(s.args[0], true)
+			fill := 0
+			if len(s.args) > 1 {
+				v, err := a.eval(s.args[1], true)
+				if err != nil { return nil, a.errorf(s, "%v", err) }
+				fill = v
+			}
+			bytes := make([]byte, n)
+			for i := range bytes {
+				bytes[i] = byte(fill)
+			}
+			put(s.addr, bytes...)
+			continue
+		}
+		if strings.HasPrefix(s.op, ".") { continue }
+
+		op := opcodeModes[s.op][s.mode]
+		switch s.mode.Size() {
+		case 1: put(s.addr, op)
+		case 2:
+			v, err := a.eval(s.operand, true)
+			if err != nil { return nil, a.errorf(s, "%v", err) }
+			if s.mode == Relative {
+				v -= s.addr + 2
+				if v < -128 || v > 127 { return nil, a.errorf(s, "branch to %s is out of range", s.operand) }
+			} else if v < -0x80 || v > 0xFF {
+				return nil, a.errorf(s, "operand %s = %d does not fit in a byte", s.operand, v)
+			}
+			put(s.addr, op, byte(v))
+		case 3:
+			v, err := a.eval(s.operand, true)
+			if err != nil { return nil, a.errorf(s, "%v", err) }
+			put(s.addr, op, byte(v), byte(v>>8))
+		}
+	}
+	return img, nil
+}
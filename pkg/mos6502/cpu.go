@@ -0,0 +1,244 @@
+package mos6502
+
+import "fmt"
+
+// Status flags
+const (
+	FlagC byte = 1 << iota
+	FlagZ
+	FlagI
+	FlagD
+	FlagB
+	FlagU
+	FlagV
+	FlagN
+)
+
+// CPU is a 6502 with the whole 64 KiB address space as RAM
+type CPU struct {
+	A, X, Y, S, P byte
+	PC            uint16
+	Mem           [0x10000]byte
+	Steps         uint64 // instructions executed
+	fault         string
+}
+
+// Fault stops the CPU: an undocumented opcode, BRK, or a push or pull past the end of the hardware stack
+type Fault struct {
+	PC  uint16
+	Msg string
+}
+
+func (f *Fault) Error() string { return fmt.Sprintf("6502: %s at $%04X", f.Msg, f.PC) }
+
+// Reset clears the registers and sets PC to pc, with the stack empty
+func (c *CPU) Reset(pc uint16) {
+	c.A, c.X, c.Y, c.S, c.P = 0, 0, 0, 0xFF, FlagU|FlagI
+	c.PC = pc
+}
+
+func (c *CPU) read16(addr uint16) uint16 { return uint16(c.Mem[addr]) | uint16(c.Mem[addr+1])<<8 }
+
+// read16zp reads a pointer from the zero page, wrapping within it
+func (c *CPU) read16zp(addr byte) uint16 { return uint16(c.Mem[addr]) | uint16(c.Mem[addr+1])<<8 }
+
+func (c *CPU) push(v byte) {
+	c.Mem[0x100|uint16(c.S)] = v
+	c.S--
+	if c.S == 0xFF { c.fault = "hardware stack overflow" }
+}
+
+func (c *CPU) pull() byte {
+	if c.S == 0xFF { c.fault = "hardware stack underflow" }
+	c.S++
+	return c.Mem[0x100|uint16(c.S)]
+}
+
+func (c *CPU) push16(v uint16) {
+	c.push(byte(v >> 8))
+	c.push(byte(v))
+}
+
+func (c *CPU) pull16() uint16 {
+	lo := uint16(c.pull())
+	return lo | uint16(c.pull())<<8
+}
+
+func (c *CPU) flag(f byte, on bool) {
+	if on {
+		c.P |= f
+	} else {
+		c.P &^= f
+	}
+}
+
+func (c *CPU) setZN(v byte) {
+	c.flag(FlagZ, v == 0)
+	c.flag(FlagN, v&0x80 != 0)
+}
+
+// address is the effective address of the operand of the instruction at PC in mode m
+func (c *CPU) address(m Mode) uint16 {
+	pc := c.PC + 1
+	switch m {
+	case Immediate, Relative: return pc
+	case ZeroPage: return uint16(c.Mem[pc])
+	case ZeroPageX: return uint16(c.Mem[pc] + c.X)
+	case ZeroPageY: return uint16(c.Mem[pc] + c.Y)
+	case Absolute: return c.read16(pc)
+	case AbsoluteX: return c.read16(pc) + uint16(c.X)
+	case AbsoluteY: return c.read16(pc) + uint16(c.Y)
+	case Indirect:
+		// The NMOS 6502 never carries into the high byte of the pointer
+		ptr := c.read16(pc)
+		return uint16(c.Mem[ptr]) | uint16(c.Mem[ptr&0xFF00|uint16(byte(ptr)+1)])<<8
+	case IndirectX: return c.read16zp(c.Mem[pc] + c.X)
+	case IndirectY: return c.read16zp(c.Mem[pc]) + uint16(c.Y)
+	}
+	return 0
+}
+
+func (c *CPU) adc(v byte) {
+	carry := uint16(c.P & FlagC)
+	if c.P&FlagD != 0 {
+		lo := uint16(c.A&0x0F) + uint16(v&0x0F) + carry
+		if lo > 9 { lo += 6 }
+		hi := uint16(c.A>>4) + uint16(v>>4)
+		if lo > 0x0F { hi++ }
+		sum := uint16(c.A) + uint16(v) + carry
+		c.flag(FlagZ, byte(sum) == 0)
+		c.flag(FlagN, hi&8 != 0)
+		c.flag(FlagV, (c.A^v)&0x80 == 0 && (uint16(c.A)^hi<<4)&0x80 != 0)
+		if hi > 9 { hi += 6 }
+		c.flag(FlagC, hi > 0x0F)
+		c.A = byte(hi<<4 | lo&0x0F)
+		return
+	}
+	sum := uint16(c.A) + uint16(v) + carry
+	c.flag(FlagC, sum > 0xFF)
+	c.flag(FlagV, (c.A^v)&0x80 == 0 && (c.A^byte(sum))&0x80 != 0)
+	c.A = byte(sum)
+	c.setZN(c.A)
+}
+
+func (c *CPU) sbc(v byte) {
+	if c.P&FlagD != 0 {
+		borrow := int(1 - c.P&FlagC)
+		diff := uint16(c.A) - uint16(v) - uint16(borrow)
+		lo := int(c.A&0x0F) - int(v&0x0F) - borrow
+		hi := int(c.A>>4) - int(v>>4)
+		if lo < 0 {
+			lo -= 6
+			hi--
+		}
+		if hi < 0 { hi -= 6 }
+		c.flag(FlagC, diff < 0x100)
+		c.flag(FlagV, (c.A^v)&0x80 != 0 && (c.A^byte(diff))&0x80 != 0)
+		c.setZN(byte(diff))
+		c.A = byte(hi<<4 | lo&0x0F)
+		return
+	}
+	c.adc(^v)
+}
+
+func (c *CPU) compare(r, v byte) {
+	c.flag(FlagC, r >= v)
+	c.setZN(r - v)
+}
+
+// branch takes the relative branch whose offset is at addr
+func (c *CPU) branch(addr uint16, taken bool) {
+	if taken { c.PC += uint16(int8(c.Mem[addr])) }
+}
+
+// Step executes the instruction at PC
+func (c *CPU) Step() error {
+	pc := c.PC
+	op := opcodes[c.Mem[pc]]
+	if op.name == "" { return &Fault{pc, fmt.Sprintf("undocumented opcode $%02X", c.Mem[pc])} }
+	addr := c.address(op.mode)
+	c.PC += uint16(op.mode.Size())
+	c.Steps++
+
+	switch op.name {
+	case "LDA": c.A = c.Mem[addr]; c.setZN(c.A)
+	case "LDX": c.X = c.Mem[addr]; c.setZN(c.X)
+	case "LDY": c.Y = c.Mem[addr]; c.setZN(c.Y)
+	case "STA": c.Mem[addr] = c.A
+	case "STX": c.Mem[addr] = c.X
+	case "STY": c.Mem[addr] = c.Y
+	case "ADC": c.adc(c.Mem[addr])
+	case "SBC": c.sbc(c.Mem[addr])
+	case "AND": c.A &= c.Mem[addr]; c.setZN(c.A)
+	case "ORA": c.A |= c.Mem[addr]; c.setZN(c.A)
+	case "EOR": c.A ^= c.Mem[addr]; c.setZN(c.A)
+	case "CMP": c.compare(c.A, c.Mem[addr])
+	case "CPX": c.compare(c.X, c.Mem[addr])
+	case "CPY": c.compare(c.Y, c.Mem[addr])
+	case "BIT":
+		v := c.Mem[addr]
+		c.flag(FlagZ, c.A&v == 0)
+		c.flag(FlagN, v&0x80 != 0)
+		c.flag(FlagV, v&0x40 != 0)
+	case "ASL", "LSR", "ROL", "ROR":
+		v := c.A
+		if op.mode != Accumulator { v = c.Mem[addr] }
+		carry := c.P & FlagC
+		switch op.name {
+		case "ASL": c.flag(FlagC, v&0x80 != 0); v <<= 1
+		case "LSR": c.flag(FlagC, v&1 != 0); v >>= 1
+		case "ROL": c.flag(FlagC, v&0x80 != 0); v = v<<1 | carry
+		case "ROR": c.flag(FlagC, v&1 != 0); v = v>>1 | carry<<7
+		}
+		c.setZN(v)
+		if op.mode == Accumulator { c.A = v } else { c.Mem[addr] = v }
+	case "INC": c.Mem[addr]++; c.setZN(c.Mem[addr])
+	case "DEC": c.Mem[addr]--; c.setZN(c.Mem[addr])
+	case "INX": c.X++; c.setZN(c.X)
+	case "INY": c.Y++; c.setZN(c.Y)
+	case "DEX": c.X--; c.setZN(c.X)
+	case "DEY": c.Y--; c.setZN(c.Y)
+	case "TAX": c.X = c.A; c.setZN(c.X)
+	case "TAY": c.Y = c.A; c.setZN(c.Y)
+	case "TXA": c.A = c.X; c.setZN(c.A)
+	case "TYA": c.A = c.Y; c.setZN(c.A)
+	case "TSX": c.X = c.S; c.setZN(c.X)
+	case "TXS": c.S = c.X
+	case "PHA": c.push(c.A)
+	case "PHP": c.push(c.P | FlagB | FlagU)
+	case "PLA": c.A = c.pull(); c.setZN(c.A)
+	case "PLP": c.P = c.pull()&^FlagB | FlagU
+	case "CLC": c.P &^= FlagC
+	case "SEC": c.P |= FlagC
+	case "CLI": c.P &^= FlagI
+	case "SEI": c.P |= FlagI
+	case "CLD": c.P &^= FlagD
+	case "SED": c.P |= FlagD
+	case "CLV": c.P &^= FlagV
+	case "BPL": c.branch(addr, c.P&FlagN == 0)
+	case "BMI": c.branch(addr, c.P&FlagN != 0)
+	case "BVC": c.branch(addr, c.P&FlagV == 0)
+	case "BVS": c.branch(addr, c.P&FlagV != 0)
+	case "BCC": c.branch(addr, c.P&FlagC == 0)
+	case "BCS": c.branch(addr, c.P&FlagC != 0)
+	case "BNE": c.branch(addr, c.P&FlagZ == 0)
+	case "BEQ": c.branch(addr, c.P&FlagZ != 0)
+	case "JMP": c.PC = addr
+	case "JSR":
+		c.push16(c.PC - 1)
+		c.PC = addr
+	case "RTS": c.PC = c.pull16() + 1
+	case "RTI":
+		c.P = c.pull()&^FlagB | FlagU
+		c.PC = c.pull16()
+	case "NOP":
+	case "BRK": return &Fault{pc, "BRK"}
+	}
+
+	if c.fault != "" {
+		msg := c.fault
+		c.fault = ""
+		return &Fault{pc, msg}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Package mos6502 assembles and runs programs for the MOS 6502: a two-pass assembler for the textual assembly the
+// 6502 backend and `__asm__` functions write, and an emulator of the documented NMOS instruction set
+package mos6502
+
+// Mode is an addressing mode
+type Mode int
+
+const (
+	Implied Mode = iota
+	Accumulator
+	Immediate
+	ZeroPage
+	ZeroPageX
+	ZeroPageY
+	Absolute
+	AbsoluteX
+	AbsoluteY
+	Indirect
+	IndirectX
+	IndirectY
+	Relative
+)
+
+// Size is the length in bytes of an instruction in mode m
+func (m Mode) Size() int {
+	switch m {
+	case Implied, Accumulator: return 1
+	case Absolute, AbsoluteX, AbsoluteY, Indirect: return 3
+	}
+	return 2
+}
+
+type opcode struct {
+	name string
+	mode Mode
+}
+
+// group1 holds the modes of ORA, AND, EOR, ADC, STA, LDA, CMP and SBC, in the order of their opcodes below
+var group1 = []Mode{IndirectX, ZeroPage, Immediate, Absolute, IndirectY, ZeroPageX, AbsoluteY, AbsoluteX}
+
+// opcodeModes maps each mnemonic to its opcode in every mode it has
+var opcodeModes = map[string]map[Mode]byte{
+	"ASL": {Accumulator: 0x0A, ZeroPage: 0x06, ZeroPageX: 0x16, Absolute: 0x0E, AbsoluteX: 0x1E},
+	"LSR": {Accumulator: 0x4A, ZeroPage: 0x46, ZeroPageX: 0x56, Absolute: 0x4E, AbsoluteX: 0x5E},
+	"ROL": {Accumulator: 0x2A, ZeroPage: 0x26, ZeroPageX: 0x36, Absolute: 0x2E, AbsoluteX: 0x3E},
+	"ROR": {Accumulator: 0x6A, ZeroPage: 0x66, ZeroPageX: 0x76, Absolute: 0x6E, AbsoluteX: 0x7E},
+	"INC": {ZeroPage: 0xE6, ZeroPageX: 0xF6, Absolute: 0xEE, AbsoluteX: 0xFE},
+	"DEC": {ZeroPage: 0xC6, ZeroPageX: 0xD6, Absolute: 0xCE, AbsoluteX: 0xDE},
+	"BIT": {ZeroPage: 0x24, Absolute: 0x2C},
+	"CPX": {Immediate: 0xE0, ZeroPage: 0xE4, Absolute: 0xEC},
+	"CPY": {Immediate: 0xC0, ZeroPage: 0xC4, Absolute: 0xCC},
+	"LDX": {Immediate: 0xA2, ZeroPage: 0xA6, ZeroPageY: 0xB6, Absolute: 0xAE, AbsoluteY: 0xBE},
+	"LDY": {Immediate: 0xA0, ZeroPage: 0xA4, ZeroPageX: 0xB4, Absolute: 0xAC, AbsoluteX: 0xBC},
+	"STX": {ZeroPage: 0x86, ZeroPageY: 0x96, Absolute: 0x8E},
+	"STY": {ZeroPage: 0x84, ZeroPageX: 0x94, Absolute: 0x8C},
+	"JMP": {Absolute: 0x4C, Indirect: 0x6C},
+	"JSR": {Absolute: 0x20},
+}
+
+var impliedOps = map[string]byte{
+	"BRK": 0x00, "PHP": 0x08, "CLC": 0x18, "PLP": 0x28, "SEC": 0x38, "RTI": 0x40, "PHA": 0x48, "CLI": 0x58,
+	"RTS": 0x60, "PLA": 0x68, "SEI": 0x78, "DEY": 0x88, "TXA": 0x8A, "TYA": 0x98, "TXS": 0x9A, "TAY": 0xA8,
+	"TAX": 0xAA, "CLV": 0xB8, "TSX": 0xBA, "INY": 0xC8, "DEX": 0xCA, "CLD": 0xD8, "INX": 0xE8, "NOP": 0xEA,
+	"SED": 0xF8,
+}
+
+var branchOps = map[string]byte{
+	"BPL": 0x10, "BMI": 0x30, "BVC": 0x50, "BVS": 0x70, "BCC": 0x90, "BCS": 0xB0, "BNE": 0xD0, "BEQ": 0xF0,
+}
+
+// opcodes decodes every documented opcode
+var opcodes [256]opcode
+
+func init() {
+	for i, name := range []string{"ORA", "AND", "EOR", "ADC", "STA", "LDA", "CMP", "SBC"} {
+		modes := make(map[Mode]byte)
+		for j, mode := range group1 {
+			if name == "STA" && mode == Immediate { continue }
+			modes[mode] = byte(i<<5 | j<<2 | 1)
+		}
+		opcodeModes[name] = modes
+	}
+	for name, op := range impliedOps {
+		opcodeModes[name] = map[Mode]byte{Implied: op}
+	}
+	for name, op := range branchOps {
+		opcodeModes[name] = map[Mode]byte{Relative: op}
+	}
+	for name, modes := range opcodeModes {
+		for mode, op := range modes {
+			opcodes[op] = opcode{name, mode}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package mos6502
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// The memory map the 6502 backend and lib/b/6502.b assume
+const (
+	LoadAddr    = 0x8000 // where a program is loaded and started
+	PutcharAddr = 0xFFEF // JSR here writes the character in A
+	ExitAddr    = 0x0000 // JSR here ends the program with the status in A
+	ArgsAddr    = 0x7F00 // argc, then argv and its strings, placed by Run
+	ArgsEnd     = 0x8000
+)
+
+// Run loads the raw program image at LoadAddr and runs it until it calls ExitAddr, returning the status in A
+// The words at ArgsAddr are argc and argv, which point to the strings of args after them
+// Output written through PutcharAddr goes to stdout, without the '\r' printf puts before each '\n'
+func Run(image []byte, args []string, stdout io.Writer) (int, error) {
+	if len(image) > PutcharAddr-LoadAddr { return 0, fmt.Errorf("6502: program of %d bytes does not fit from $%04X", len(image), LoadAddr) }
+	cpu := &CPU{}
+	copy(cpu.Mem[LoadAddr:], image)
+	if err := placeArgs(cpu, args); err != nil { return 0, err }
+	cpu.Reset(LoadAddr)
+	// RTS from the hooks
+	cpu.Mem[PutcharAddr] = 0x60
+
+	out := bufio.NewWriter(stdout)
+	defer out.Flush()
+	for {
+		switch cpu.PC {
+		case ExitAddr: return int(cpu.A), nil
+		case PutcharAddr:
+			if cpu.A != '\r' { out.WriteByte(cpu.A) }
+		}
+		if err := cpu.Step(); err != nil { return 0, err }
+	}
+}
+
+func placeArgs(cpu *CPU, args []string) error {
+	put16 := func(addr, v int) {
+		cpu.Mem[addr] = byte(v)
+		cpu.Mem[addr+1] = byte(v >> 8)
+	}
+	put16(ArgsAddr, len(args))
+	vec := ArgsAddr + 2
+	str := vec + 2*(len(args)+1)
+	for _, arg := range args {
+		if str+len(arg)+1 > ArgsEnd { return fmt.Errorf("6502: arguments do not fit in the %d bytes from $%04X", ArgsEnd-ArgsAddr, ArgsAddr) }
+		put16(vec, str)
+		copy(cpu.Mem[str:], arg)
+		vec += 2
+		str += len(arg) + 1
+	}
+	put16(vec, 0)
+	return nil
+}
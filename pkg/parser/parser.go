@@ -19,6 +19,7 @@ type Parser struct {
 	cfg         *config.Config
 	isTypedPass bool
 	typeNames   map[string]bool
+	loopDepth   int
 }
 
 func NewParser(tokens []token.Token, cfg *config.Config) *Parser {
@@ -42,6 +43,20 @@ func NewParser(tokens []token.Token, cfg *config.Config) *Parser {
 	return p
 }
 
+// DeclareTypes makes the types declared in root known to the parser as if it had parsed them itself, so that a
+// program entered piece by piece can use the types declared by earlier pieces
+func (p *Parser) DeclareTypes(root *ast.Node) {
+	if !p.isTypedPass || root == nil || root.Type != ast.Block { return }
+	for _, stmt := range root.Data.(ast.BlockNode).Stmts {
+		switch d := stmt.Data.(type) {
+		case ast.TypeDeclNode:
+			p.typeNames[d.Name] = true
+			if d.Type != nil && d.Type.StructTag != "" { p.typeNames[d.Type.StructTag] = true }
+		case ast.EnumDeclNode: p.typeNames[d.Name] = true
+		}
+	}
+}
+
 func (p *Parser) advance() {
 	if p.pos < len(p.tokens) {
 		p.previous = p.current
@@ -76,7 +91,7 @@ func (p *Parser) expect(tokType token.Type, message string) {
 		p.advance()
 		return
 	}
-	util.Error(p.current, message)
+	util.Error(p.current, "%s", message)
 }
 
 func (p *Parser) isTypeName(name string) bool {
@@ -122,8 +137,10 @@ func (p *Parser) parseTopLevel() *ast.Node {
 		if strings.HasPrefix(directiveVal, "requires:") {
 			flagStr := strings.TrimSpace(strings.TrimPrefix(directiveVal, "requires:"))
 			if err := p.cfg.ProcessDirectiveFlags(flagStr, currentTok); err != nil {
-				util.Error(currentTok, err.Error())
+				util.Error(currentTok, "%s", err.Error())
 			}
+		} else if strings.HasPrefix(directiveVal, "check:") {
+			// Applies to the function that follows it, handled during codegen
 		} else {
 			util.Error(currentTok, "Unknown directive '[b]: %s'", directiveVal)
 		}
@@ -176,7 +193,7 @@ func (p *Parser) parseTopLevel() *ast.Node {
 			stmt = p.parseUntypedGlobalDefinition(identTok)
 		}
 	default:
-		if p.isTypedPass && (p.isBuiltinType(p.current) || p.check(token.Const) || p.isPointerTypeAhead()) {
+		if p.isTypedPass && (p.isBuiltinType(p.current) || p.check(token.Const) || p.isPointerTypeAhead() || p.isSliceTypeAhead()) {
 			stmt = p.parseTypedVarOrFuncDecl(true)
 		} else {
 			stmt = p.parseExpr()
@@ -289,6 +306,22 @@ func (p *Parser) isPointerTypeAhead() bool {
 	return p.isBuiltinType(p.current) || (p.check(token.Ident) && p.isTypeName(p.current.Value))
 }
 
+// isSliceTypeAhead checks if a declaration of a slice starts here, `[]T name` rather than the array literal `[]T{...}`
+func (p *Parser) isSliceTypeAhead() bool {
+	if !p.check(token.LBracket) || p.peek().Type != token.RBracket { return false }
+
+	originalPos, originalCurrent := p.pos, p.current
+	defer func() { p.pos, p.current = originalPos, originalCurrent }()
+
+	// Skip the brackets and stars of the type
+	for p.check(token.Star) || p.check(token.LBracket) || p.check(token.RBracket) {
+		p.advance()
+	}
+	if !p.isBuiltinType(p.current) && !(p.check(token.Ident) && p.isTypeName(p.current.Value)) { return false }
+	p.advance()
+	return p.check(token.Ident)
+}
+
 func (p *Parser) parseStmt() *ast.Node {
 	tok := p.current
 
@@ -312,7 +345,7 @@ func (p *Parser) parseStmt() *ast.Node {
 		return ast.NewLabel(tok, labelName, p.parseStmt())
 	}
 
-	if p.isTypedPass && (p.isBuiltinType(p.current) || (p.isTypeName(p.current.Value) && p.peek().Type != token.Define) || p.check(token.Const) || p.isPointerTypeAhead()) {
+	if p.isTypedPass && (p.isBuiltinType(p.current) || (p.isTypeName(p.current.Value) && p.peek().Type != token.Define) || p.check(token.Const) || p.isPointerTypeAhead() || p.isSliceTypeAhead()) {
 		return p.parseTypedVarOrFuncDecl(false)
 	}
 
@@ -331,8 +364,32 @@ func (p *Parser) parseStmt() *ast.Node {
 		p.expect(token.LParen, "Expected '(' after 'while'")
 		cond := p.parseExpr()
 		p.expect(token.RParen, "Expected ')' after while condition")
+		p.loopDepth++
 		body := p.parseStmt()
+		p.loopDepth--
 		return ast.NewWhile(tok, cond, body)
+	case p.match(token.For):
+		p.expect(token.LParen, "Expected '(' after 'for'")
+		init := p.parseStmt() // up to and including its ';'
+		var cond, post *ast.Node
+		if !p.check(token.Semi) { cond = p.parseExpr() }
+		p.expect(token.Semi, "Expected ';' after for condition")
+		if !p.check(token.RParen) { post = p.parseExpr() }
+		p.expect(token.RParen, "Expected ')' after for clauses")
+		p.loopDepth++
+		body := p.parseStmt()
+		p.loopDepth--
+		return ast.NewFor(tok, init, cond, post, body)
+	case p.match(token.Do):
+		p.loopDepth++
+		body := p.parseStmt()
+		p.loopDepth--
+		p.expect(token.While, "Expected 'while' after do body")
+		p.expect(token.LParen, "Expected '(' after 'while'")
+		cond := p.parseExpr()
+		p.expect(token.RParen, "Expected ')' after while condition")
+		p.expect(token.Semi, "Expected ';' after do-while statement")
+		return ast.NewDoWhile(tok, body, cond)
 	case p.match(token.Switch):
 		hasParen := p.match(token.LParen)
 		expr := p.parseExpr()
@@ -414,6 +471,13 @@ func (p *Parser) parseStmt() *ast.Node {
 		}
 		p.expect(token.Semi, "Expected ';' after 'continue'")
 		return ast.NewContinue(tok)
+	case p.match(token.Defer):
+		// A deferred expression runs at most once, when its function returns, so one per iteration cannot be had
+		if p.loopDepth > 0 { util.Error(tok, "'defer' is not allowed in a loop") }
+		expr := p.parseExpr()
+		p.expect(token.Semi, "Expected ';' after defer expression")
+		return ast.NewDefer(tok, expr)
+	case p.match(token.Asm): return p.parseAsmStmt(tok)
 	case p.match(token.Semi): return ast.NewBlock(tok, nil, true)
 	default:
 		if p.check(token.Ident) {
@@ -675,6 +739,8 @@ func (p *Parser) parseFuncDecl(returnType *ast.BxType, nameToken token.Token) *a
 		body = p.parseBlockStmt()
 	} else {
 		body = p.parseStmt()
+		// A body that is one `__asm__` statement is not an `__asm__` function
+		if body != nil && body.Type == ast.AsmStmt { body = ast.NewBlock(body.Tok, []*ast.Node{body}, false) }
 	}
 
 	if len(decls) > 0 {
@@ -718,7 +784,7 @@ func (p *Parser) parseAsmFuncDef(nameToken token.Token) *ast.Node {
 	}
 	p.expect(token.RParen, "Expected ')' to close '__asm__' block")
 	asmCode := strings.Join(codeParts, "\n")
-	body := ast.NewAsmStmt(asmTok, asmCode)
+	body := ast.NewAsmStmt(asmTok, asmCode, nil, nil)
 
 	if !p.check(token.LBrace) {
 		p.expect(token.Semi, "Expected ';' or '{' after '__asm__' definition")
@@ -729,6 +795,52 @@ func (p *Parser) parseAsmFuncDef(nameToken token.Token) *ast.Node {
 	return ast.NewFuncDecl(nameToken, nameToken.Value, nil, body, false, false, nil)
 }
 
+// parseAsmStmt parses an `__asm__` statement inside a function: its strings, then the operands bound to it with
+// out(lvalue), in(expr) and inout(lvalue), and the registers it clobbers with clobber("reg")
+func (p *Parser) parseAsmStmt(asmTok token.Token) *ast.Node {
+	if !p.cfg.IsFeatureEnabled(config.FeatAsm) {
+		util.Error(asmTok, "'__asm__' is disabled (-Fno-asm)")
+	}
+	p.expect(token.LParen, "Expected '(' after '__asm__'")
+	var codeParts []string
+	for p.check(token.String) {
+		codeParts = append(codeParts, p.current.Value)
+		p.advance()
+		if !p.match(token.Comma) { break }
+	}
+	if len(codeParts) == 0 {
+		util.Error(p.current, "Expected string literal in '__asm__' statement")
+	}
+
+	var operands []ast.AsmOperand
+	var clobbers []string
+	for !p.check(token.RParen) && !p.check(token.EOF) {
+		kindTok := p.current
+		p.expect(token.Ident, "Expected out(...), in(...), inout(...) or clobber(...) in '__asm__' statement")
+		p.expect(token.LParen, "Expected '(' after '"+kindTok.Value+"'")
+		switch kindTok.Value {
+		case "in", "out", "inout":
+			operands = append(operands, ast.AsmOperand{Dir: kindTok.Value, Expr: p.parseExpr()})
+		case "clobber":
+			for p.check(token.String) {
+				clobbers = append(clobbers, p.current.Value)
+				p.advance()
+				if !p.match(token.Comma) { break }
+			}
+		default:
+			util.Error(kindTok, "Unknown '__asm__' operand '%s'; expected out, in, inout or clobber", kindTok.Value)
+			for !p.check(token.RParen) && !p.check(token.EOF) {
+				p.advance()
+			}
+		}
+		p.expect(token.RParen, "Expected ')' after '__asm__' operand")
+		if !p.match(token.Comma) { break }
+	}
+	p.expect(token.RParen, "Expected ')' to close '__asm__' statement")
+	p.expect(token.Semi, "Expected ';' after '__asm__' statement")
+	return ast.NewAsmStmt(asmTok, strings.Join(codeParts, "\n"), operands, clobbers)
+}
+
 func (p *Parser) parseTypeDecl() *ast.Node {
 	typeTok := p.previous
 
@@ -736,7 +848,7 @@ func (p *Parser) parseTypeDecl() *ast.Node {
 		return p.parseEnumDef(typeTok)
 	}
 
-	if p.match(token.Struct) {
+	if p.match(token.Struct) || p.match(token.Union) {
 		underlyingType := p.parseStructDef()
 		var name string
 		if p.check(token.Ident) {
@@ -744,7 +856,7 @@ func (p *Parser) parseTypeDecl() *ast.Node {
 			p.advance()
 		} else {
 			if underlyingType.StructTag == "" {
-				util.Error(typeTok, "Typedef for anonymous struct must have a name")
+				util.Error(typeTok, "Typedef for anonymous %s must have a name", token.TypeStrings[p.previous.Type])
 				return nil
 			}
 			name = underlyingType.StructTag
@@ -767,8 +879,15 @@ func (p *Parser) parseTypeDecl() *ast.Node {
 		return nil
 	}
 
-	p.expect(token.Ident, "Expected new type name for alias")
-	nameToken := p.previous
+	// type int (*BinOp)(int, int); names the type of a pointer to a function
+	var nameToken token.Token
+	if p.isFuncPointerAhead() {
+		underlyingType, nameToken = p.parseFuncPointer(underlyingType)
+		if nameToken.Value == "" { util.Error(p.previous, "Expected new type name for alias") }
+	} else {
+		p.expect(token.Ident, "Expected new type name for alias")
+		nameToken = p.previous
+	}
 	name := nameToken.Value
 
 	if p.isTypeName(name) {
@@ -838,6 +957,12 @@ func (p *Parser) parseTypedVarOrFuncDecl(isTopLevel bool) *ast.Node {
 		return p.parseTypedExtrnDecl(startTok, declType)
 	}
 
+	if p.isFuncPointerAhead() {
+		funcType, nameToken := p.parseFuncPointer(declType)
+		if nameToken.Value == "" { util.Error(p.previous, "Expected the name of a function pointer after '*'") }
+		return p.parseTypedVarDeclBody(startTok, funcType, nameToken)
+	}
+
 	p.expect(token.Ident, "Expected identifier after type")
 	nameToken := p.previous
 
@@ -864,7 +989,17 @@ func (p *Parser) parseTypedVarDeclBody(startTok token.Token, declType *ast.BxTyp
 				sizeExpr = p.parseExpr()
 			}
 			p.expect(token.RBracket, "Expected ']' after array size")
-			finalType = &ast.BxType{Kind: ast.TYPE_ARRAY, Base: declType, ArraySize: sizeExpr, IsConst: declType.IsConst}
+			// In `int grid[10][20]` each further size makes the element an array, of rows laid out one after another
+			var dims []*ast.Node
+			for p.match(token.LBracket) {
+				dims = append(dims, p.parseExpr())
+				p.expect(token.RBracket, "Expected ']' after array size")
+			}
+			elemType := declType
+			for i := len(dims) - 1; i >= 0; i-- {
+				elemType = &ast.BxType{Kind: ast.TYPE_ARRAY, Base: elemType, ArraySize: dims[i], IsConst: declType.IsConst}
+			}
+			finalType = &ast.BxType{Kind: ast.TYPE_ARRAY, Base: elemType, ArraySize: sizeExpr, IsConst: declType.IsConst}
 		}
 
 		var initList []*ast.Node
@@ -908,16 +1043,27 @@ func (p *Parser) parseType() *ast.BxType {
         elemType := p.parseType()
         baseType = &ast.BxType{Kind: ast.TYPE_POINTER, Base: elemType}
     } else if p.match(token.LBracket) {
+        // [N]T is an array of N elements of T, []T a slice of them, which carries its length
+        var sizeExpr *ast.Node
+        if !p.check(token.RBracket) {
+            sizeExpr = p.parseExpr()
+        }
         p.expect(token.RBracket, "Expected ']' to complete array type specifier")
         elemType := p.parseType()
-        baseType = &ast.BxType{Kind: ast.TYPE_ARRAY, Base: elemType}
+        if sizeExpr == nil {
+            baseType = &ast.BxType{Kind: ast.TYPE_SLICE, Base: elemType}
+        } else {
+            baseType = &ast.BxType{Kind: ast.TYPE_ARRAY, Base: elemType, ArraySize: sizeExpr}
+        }
     } else {
         tok := p.current
-        if p.match(token.Struct) {
+        if p.match(token.Struct) || p.match(token.Union) {
             if p.check(token.Ident) && p.peek().Type != token.LBrace {
+                kind := ast.TYPE_STRUCT
+                if p.previous.Type == token.Union { kind = ast.TYPE_UNION }
                 tagName := p.current.Value
                 p.advance()
-                baseType = &ast.BxType{Kind: ast.TYPE_STRUCT, Name: tagName, StructTag: tagName}
+                baseType = &ast.BxType{Kind: kind, Name: tagName, StructTag: tagName}
             } else {
                 baseType = p.parseStructDef()
             }
@@ -963,12 +1109,17 @@ func (p *Parser) parseType() *ast.BxType {
             p.advance()
             baseType = &ast.BxType{Kind: ast.TYPE_PRIMITIVE, Name: typeName}
         } else {
-            util.Error(p.current, "Expected a type name, 'struct', 'enum', or '[]'")
+            util.Error(p.current, "Expected a type name, 'struct', 'union', 'enum', or '[]'")
             p.advance()
             return ast.TypeUntyped
         }
     }
 
+    // `int (*)(int, int)` is a pointer to a function, unnamed as in a parameter or a cast
+    if p.isFuncPointerAhead() && p.pos+2 < len(p.tokens) && p.tokens[p.pos+2].Type == token.RParen {
+        baseType, _ = p.parseFuncPointer(baseType)
+    }
+
     if isConst {
         newType := *baseType
         newType.IsConst = true
@@ -977,8 +1128,43 @@ func (p *Parser) parseType() *ast.BxType {
     return baseType
 }
 
+// isFuncPointerAhead checks for the `(*` that follows the result type of a pointer to a function
+func (p *Parser) isFuncPointerAhead() bool {
+	return p.isTypedPass && p.check(token.LParen) && p.peek().Type == token.Star
+}
+
+// parseFuncPointer parses the `(*name)(int, int)` after the result type of a pointer to a function, and returns
+// its type and its name, which is left out in a type that names no variable
+func (p *Parser) parseFuncPointer(result *ast.BxType) (*ast.BxType, token.Token) {
+	p.expect(token.LParen, "Expected '(' to start a function pointer")
+	p.expect(token.Star, "Expected '*' in a function pointer")
+	var name token.Token
+	if p.match(token.Ident) { name = p.previous }
+	p.expect(token.RParen, "Expected ')' after '*' of a function pointer")
+	p.expect(token.LParen, "Expected '(' before the parameter types of a function pointer")
+
+	funcType := &ast.BxType{Kind: ast.TYPE_FUNC, Base: result}
+	if p.check(token.Void) && p.peek().Type == token.RParen {
+		p.advance()
+	} else {
+		for !p.check(token.RParen) && !p.check(token.EOF) {
+			if p.match(token.Dots) {
+				funcType.Variadic = true
+				break
+			}
+			funcType.Params = append(funcType.Params, p.parseType())
+			if !p.match(token.Comma) { break }
+		}
+	}
+	p.expect(token.RParen, "Expected ')' after the parameter types of a function pointer")
+	return funcType, name
+}
+
+// parseStructDef parses the body of the struct or union whose keyword was just matched
 func (p *Parser) parseStructDef() *ast.BxType {
+	keyword := token.TypeStrings[p.previous.Type]
 	structType := &ast.BxType{Kind: ast.TYPE_STRUCT}
+	if p.previous.Type == token.Union { structType.Kind = ast.TYPE_UNION }
 
 	if p.check(token.Ident) {
 		structType.StructTag = p.current.Value
@@ -988,15 +1174,15 @@ func (p *Parser) parseStructDef() *ast.BxType {
 		p.advance()
 	}
 
-	p.expect(token.LBrace, "Expected '{' to open struct definition")
+	p.expect(token.LBrace, fmt.Sprintf("Expected '{' to open %s definition", keyword))
 
 	for !p.check(token.RBrace) && !p.check(token.EOF) {
 		var names []token.Token
-		p.expect(token.Ident, "Expected field name in struct")
+		p.expect(token.Ident, "Expected field name in "+keyword)
 		names = append(names, p.previous)
 
 		for p.match(token.Comma) {
-			if p.isBuiltinType(p.current) || p.isTypeName(p.current.Value) || p.check(token.LBracket) || p.check(token.Star) || p.check(token.Struct) {
+			if p.isBuiltinType(p.current) || p.isTypeName(p.current.Value) || p.check(token.LBracket) || p.check(token.Star) || p.check(token.Struct) || p.check(token.Union) {
 				p.pos--
 				p.current = p.tokens[p.pos-1]
 				break
@@ -1012,10 +1198,10 @@ func (p *Parser) parseStructDef() *ast.BxType {
 			structType.Fields = append(structType.Fields, fieldDecl)
 		}
 
-		p.expect(token.Semi, "Expected ';' after struct field declaration")
+		p.expect(token.Semi, fmt.Sprintf("Expected ';' after %s field declaration", keyword))
 	}
 
-	p.expect(token.RBrace, "Expected '}' to close struct definition")
+	p.expect(token.RBrace, fmt.Sprintf("Expected '}' to close %s definition", keyword))
 	if structType.StructTag != "" {
 		structType.Name = structType.StructTag
 	}
@@ -1281,7 +1467,20 @@ func (p *Parser) parsePostfixExpr() *ast.Node {
 			p.expect(token.RParen, "Expected ')' after function arguments")
 			expr = ast.NewFuncCall(tok, expr, args)
 		} else if p.match(token.LBracket) {
-			index := p.parseExpr()
+			// a[low:high] slices a, either bound being optional
+			var index *ast.Node
+			if !p.isTypedPass || !p.check(token.Colon) {
+				index = p.parseExpr()
+			}
+			if p.isTypedPass && p.match(token.Colon) {
+				var high *ast.Node
+				if !p.check(token.RBracket) {
+					high = p.parseExpr()
+				}
+				p.expect(token.RBracket, "Expected ']' after slice bounds")
+				expr = ast.NewSlice(tok, expr, index, high)
+				continue
+			}
 			p.expect(token.RBracket, "Expected ']' after array index")
 			expr = ast.NewSubscript(tok, expr, index)
 		} else if p.isTypedPass && p.match(token.Dot) {
@@ -0,0 +1,52 @@
+// Package runner runs programs built for a target with no host to run them on: a WebAssembly module on the
+// runtime of pkg/wasm, a raw 6502 image on the emulator of pkg/mos6502, a Uxn ROM on pkg/uxn, or a Game Boy
+// cartridge on pkg/sm83. `gbc run` and the re-executed modes of gtest both go through it
+package runner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/xplshn/gbc/pkg/mos6502"
+	"github.com/xplshn/gbc/pkg/sm83"
+	"github.com/xplshn/gbc/pkg/uxn"
+	"github.com/xplshn/gbc/pkg/wasm"
+)
+
+// Guess returns the target the program at path was built for, from its contents, or a .rom extension for uxn
+func Guess(path string, image []byte) string {
+	switch {
+	case wasm.IsModule(image): return "wasm"
+	case sm83.IsROM(image): return "gb"
+	case filepath.Ext(path) == ".rom": return "uxn"
+	}
+	return "6502"
+}
+
+// Run runs the program at path, built for target or guessed if target is "", with args and the standard
+// streams, returning its exit status. The error is for a program that cannot be read or a target that cannot
+// be run; a trap stands for the SIGABRT that would end a native program, so it is reported on stderr and the
+// status is 134
+func Run(target, path string, args []string) (int, error) {
+	image, err := os.ReadFile(path)
+	if err != nil { return 0, err }
+	if target == "" { target = Guess(path, image) }
+
+	argv := append([]string{path}, args...)
+	var status int
+	switch target {
+	case "wasm": status, err = wasm.Run(image, argv, os.Stdin, os.Stdout, os.Stderr)
+	case "6502": status, err = mos6502.Run(image, argv, os.Stdout)
+	// Varvara has no program name to pass, and lib/b/uxn.b makes up its own
+	case "uxn": status, err = uxn.Run(image, args, os.Stdin, os.Stdout, os.Stderr)
+	// The cartridge takes no arguments, and reads stdin as joypad presses
+	case "gb": status, err = sm83.Run(image, os.Stdin, os.Stdout)
+	default: return 0, fmt.Errorf("cannot run programs for target '%s'", target)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 134, nil
+	}
+	return status, nil
+}
@@ -0,0 +1,601 @@
+package sm83
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The memory map of a ROM-only cartridge, as the gb backend and the assembler lay it out
+const (
+	BankSize  = 0x4000 // ROM banks 0 and 1 are mapped one after the other from $0000
+	ROMSize   = 0x8000
+	WRAMStart = 0xC000 // where the data section runs, copied there from the end of the ROM by the startup code
+	StackTop  = 0xE000
+	MinStack  = 0x400 // bytes of WRAM the data section must leave to the stack
+)
+
+// Image is an assembled 32 KiB ROM, with the address of every label
+type Image struct {
+	Bytes   []byte
+	Symbols map[string]uint16
+}
+
+// SymbolAt names the address pc as the closest label at or before it, for error messages
+func (img *Image) SymbolAt(pc uint16) string {
+	best, at := "", -1
+	for name, addr := range img.Symbols {
+		if int(addr) <= int(pc) && (int(addr) > at || int(addr) == at && name < best) && isGlobalLabel(name) && int(addr) < ROMSize {
+			best, at = name, int(addr)
+		}
+	}
+	if best == "" { return fmt.Sprintf("$%04X", pc) }
+	if int(pc) == at { return best }
+	return fmt.Sprintf("%s+%d", best, int(pc)-at)
+}
+
+// isGlobalLabel tells labels that start a function or a datum from the local @labels within them
+func isGlobalLabel(name string) bool { return !strings.HasPrefix(name, "@") }
+
+type operandKind int
+
+const (
+	kindReg8   operandKind = iota // A B C D E H L
+	kindReg16                     // BC DE HL SP AF
+	kindCond                      // NZ Z NC; C is a register until an instruction reads it as a condition
+	kindInd                       // (BC) (DE) (HL) (HL+) (HL-) (C)
+	kindMem                       // (expr)
+	kindSPOff                     // SP+expr
+	kindImm
+)
+
+type operand struct {
+	kind operandKind
+	reg  string // register, pair or condition, upper case
+	expr string
+}
+
+// stmt is one line of the source: a label, then an instruction, a directive or an equate
+type stmt struct {
+	line     int
+	label    string
+	op       string // mnemonic or directive, upper case
+	args     []string
+	operands []operand
+	size     int
+	section  string
+	addr     int
+}
+
+type assembler struct {
+	stmts    []*stmt
+	symbols  map[string]int
+	romEnd   int
+	dataEnd  int
+	dataLoad int
+}
+
+// Assemble assembles src into a ROM-only cartridge. Its lines are `label:`, instructions in the usual Game Boy
+// syntax such as `LD A,(HL+)` and `LD HL,SP+4`, with the registers in upper case, `name = expr` and the
+// directives .org, .byte, .word, .fill and .section rom or data; .globl is ignored
+// Labels not starting with @ begin a chunk that is moved to bank 1 rather than straddle the two banks, and the
+// data section runs from WRAMStart with its image after the ROM section, between the labels __data_load,
+// __data_start and __data_end the assembler defines
+// The header checksum and the global checksum are filled in
+func Assemble(src string) (*Image, error) {
+	a := &assembler{symbols: make(map[string]int)}
+	for i, text := range strings.Split(src, "\n") {
+		if err := a.parseLine(i+1, text); err != nil { return nil, err }
+	}
+	if err := a.layout(); err != nil { return nil, err }
+	return a.emit()
+}
+
+func (a *assembler) errorf(s *stmt, format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", s.line, fmt.Sprintf(format, args...))
+}
+
+func stripComment(text string) string {
+	quoted := byte(0)
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quoted != 0 && c == '\\': i++
+		case quoted != 0: if c == quoted { quoted = 0 }
+		case c == '"' || c == '\'': quoted = c
+		case c == ';': return text[:i]
+		}
+	}
+	return text
+}
+
+func isSymbolChar(c byte, first bool) bool {
+	return c == '_' || c == '.' || c == '@' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+// splitArgs splits operands at the commas outside quotes
+func splitArgs(text string) []string {
+	var args []string
+	start, quoted := 0, byte(0)
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quoted != 0 && c == '\\': i++
+		case quoted != 0: if c == quoted { quoted = 0 }
+		case c == '"' || c == '\'': quoted = c
+		case c == ',':
+			args = append(args, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(text[start:]); rest != "" || len(args) > 0 { args = append(args, rest) }
+	return args
+}
+
+func (a *assembler) parseLine(line int, text string) error {
+	text = strings.TrimSpace(stripComment(text))
+	for text != "" {
+		s := &stmt{line: line}
+		n := 0
+		for n < len(text) && isSymbolChar(text[n], n == 0) {
+			n++
+		}
+		rest := strings.TrimSpace(text[n:])
+		switch {
+		case n > 0 && strings.HasPrefix(rest, ":"):
+			s.label = text[:n]
+			a.stmts = append(a.stmts, s)
+			text = strings.TrimSpace(rest[1:])
+			continue
+		case n > 0 && strings.HasPrefix(rest, "="):
+			s.label, s.op, s.args = text[:n], "=", []string{strings.TrimSpace(rest[1:])}
+		case n > 0:
+			s.op = strings.ToUpper(text[:n])
+			s.args = splitArgs(rest)
+			if !strings.HasPrefix(s.op, ".") {
+				for _, arg := range s.args {
+					s.operands = append(s.operands, parseOperand(arg))
+				}
+			}
+		default: return fmt.Errorf("line %d: cannot parse %q", line, text)
+		}
+		a.stmts = append(a.stmts, s)
+		break
+	}
+	return nil
+}
+
+// parseOperand classifies an operand; registers and conditions are upper case, leaving lower case names to labels
+func parseOperand(text string) operand {
+	u := strings.ReplaceAll(text, " ", "")
+	switch u {
+	case "A", "B", "C", "D", "E", "H", "L": return operand{kind: kindReg8, reg: u}
+	case "BC", "DE", "HL", "SP", "AF": return operand{kind: kindReg16, reg: u}
+	case "NZ", "Z", "NC": return operand{kind: kindCond, reg: u}
+	case "(BC)", "(DE)", "(HL)", "(C)": return operand{kind: kindInd, reg: u[1 : len(u)-1]}
+	case "(HL+)", "(HLI)": return operand{kind: kindInd, reg: "HL+"}
+	case "(HL-)", "(HLD)": return operand{kind: kindInd, reg: "HL-"}
+	}
+	switch {
+	case strings.HasPrefix(u, "SP+") || strings.HasPrefix(u, "SP-"): return operand{kind: kindSPOff, expr: u[2:]}
+	case strings.HasPrefix(u, "(") && strings.HasSuffix(u, ")"):
+		t := strings.TrimSpace(text)
+		return operand{kind: kindMem, expr: t[1 : len(t)-1]}
+	}
+	return operand{kind: kindImm, expr: text}
+}
+
+// layout sizes every statement, then gives it its address in its section, defining the labels
+func (a *assembler) layout() error {
+	for _, s := range a.stmts {
+		if err := a.size(s); err != nil { return err }
+	}
+
+	pcs := map[string]int{"rom": 0, "data": WRAMStart}
+	section := "rom"
+	for i, s := range a.stmts {
+		switch s.op {
+		case ".SECTION":
+			if len(s.args) != 1 { return a.errorf(s, ".section takes rom or data") }
+			section = strings.ToLower(s.args[0])
+			if _, ok := pcs[section]; !ok { return a.errorf(s, ".section takes rom or data") }
+		case ".ORG":
+			if section != "rom" { return a.errorf(s, ".org is only allowed in the rom section") }
+			v, err := a.eval(s.args[0], true)
+			if err != nil { return a.errorf(s, "%v", err) }
+			if v < pcs["rom"] { return a.errorf(s, ".org $%04X moves back from $%04X", v, pcs["rom"]) }
+			pcs["rom"] = v
+		case "":
+			if section == "rom" && isGlobalLabel(s.label) {
+				// A chunk that would straddle the banks starts bank 1 instead
+				pc, n := pcs["rom"], a.chunk(i)
+				if pc < BankSize && pc+n > BankSize && n <= BankSize { pcs["rom"] = BankSize }
+			}
+			if _, dup := a.symbols[s.label]; dup { return a.errorf(s, "label %q defined twice", s.label) }
+			a.symbols[s.label] = pcs[section]
+		}
+		s.section, s.addr = section, pcs[section]
+		pcs[section] += s.size
+	}
+
+	a.romEnd, a.dataEnd, a.dataLoad = pcs["rom"], pcs["data"], pcs["rom"]
+	if a.romEnd+a.dataEnd-WRAMStart > ROMSize {
+		return fmt.Errorf("program of %d bytes does not fit in the %d KiB of a ROM-only cartridge", a.romEnd+a.dataEnd-WRAMStart, ROMSize/1024)
+	}
+	if a.dataEnd > StackTop-MinStack { return fmt.Errorf("data of %d bytes leaves less than %d bytes of WRAM to the stack", a.dataEnd-WRAMStart, MinStack) }
+	a.symbols["__data_load"], a.symbols["__data_start"], a.symbols["__data_end"] = a.dataLoad, WRAMStart, a.dataEnd
+	return nil
+}
+
+// chunk is the size of what follows the label at i, up to the next global label or the end of the section
+func (a *assembler) chunk(i int) int {
+	n := 0
+	for _, s := range a.stmts[i+1:] {
+		if s.op == "" && isGlobalLabel(s.label) || s.op == ".SECTION" || s.op == ".ORG" { break }
+		n += s.size
+	}
+	return n
+}
+
+func (a *assembler) size(s *stmt) error {
+	switch s.op {
+	case "", ".SECTION", ".ORG", ".GLOBL": return nil
+	case "=":
+		v, err := a.eval(s.args[0], true)
+		if err != nil { return a.errorf(s, "%v", err) }
+		if _, dup := a.symbols[s.label]; dup { return a.errorf(s, "symbol %q defined twice", s.label) }
+		a.symbols[s.label] = v
+	case ".BYTE":
+		for _, arg := range s.args {
+			if str, ok := unquote(arg, '"'); ok {
+				s.size += len(str)
+			} else {
+				s.size++
+			}
+		}
+	case ".WORD": s.size = 2 * len(s.args)
+	case ".FILL":
+		if len(s.args) < 1 || len(s.args) > 2 { return a.errorf(s, ".fill takes a count and an optional value") }
+		v, err := a.eval(s.args[0], true)
+		if err != nil { return a.errorf(s, "%v", err) }
+		s.size = v
+	default:
+		if strings.HasPrefix(s.op, ".") { return a.errorf(s, "unknown directive %s", s.op) }
+		code, err := a.encode(s, false)
+		if err != nil { return a.errorf(s, "%v", err) }
+		s.size = len(code)
+	}
+	return nil
+}
+
+func unquote(text string, quote byte) (string, bool) {
+	if len(text) < 2 || text[0] != quote || text[len(text)-1] != quote { return "", false }
+	s, err := strconv.Unquote(`"` + strings.ReplaceAll(text[1:len(text)-1], `"`, `\"`) + `"`)
+	if err != nil { return text[1 : len(text)-1], true }
+	return s, true
+}
+
+// eval evaluates an expression: an optional < or > for its low or high byte, then numbers ($hex, %binary,
+// 0x hex, decimal or 'c') and symbols, added and subtracted
+func (a *assembler) eval(text string, final bool) (int, error) {
+	text = strings.TrimSpace(text)
+	part := 0
+	if strings.HasPrefix(text, "<") || strings.HasPrefix(text, ">") {
+		part = map[byte]int{'<': 1, '>': 2}[text[0]]
+		text = strings.TrimSpace(text[1:])
+	}
+	if text == "" { return 0, fmt.Errorf("missing operand") }
+
+	total, sign, i := 0, 1, 0
+	for i < len(text) {
+		for i < len(text) && text[i] == ' ' {
+			i++
+		}
+		if i < len(text) && (text[i] == '-' || text[i] == '+') {
+			if text[i] == '-' { sign = -sign }
+			i++
+			continue
+		}
+		start := i
+		var v int
+		switch c := text[i]; {
+		case c == '\'':
+			end := strings.IndexByte(text[i+1:], '\'')
+			if end < 0 { return 0, fmt.Errorf("unterminated character in %q", text) }
+			str, _ := unquote(text[i:i+end+2], '\'')
+			if len(str) != 1 { return 0, fmt.Errorf("bad character in %q", text) }
+			v = int(str[0])
+			i += end + 2
+		case c == '$' || c == '%' || c >= '0' && c <= '9':
+			i++
+			for i < len(text) && (isSymbolChar(text[i], false) && text[i] != '.') {
+				i++
+			}
+			n, err := parseNumber(text[start:i])
+			if err != nil { return 0, err }
+			v = n
+		case isSymbolChar(c, true):
+			for i < len(text) && isSymbolChar(text[i], false) {
+				i++
+			}
+			name := text[start:i]
+			sym, ok := a.symbols[name]
+			if !ok {
+				if final { return 0, fmt.Errorf("undefined symbol %q", name) }
+				return 0, fmt.Errorf("%q is not known yet", name)
+			}
+			v = sym
+		default: return 0, fmt.Errorf("cannot parse %q", text)
+		}
+		total += sign * v
+		sign = 1
+		for i < len(text) && text[i] == ' ' {
+			i++
+		}
+		if i < len(text) && text[i] != '+' && text[i] != '-' { return 0, fmt.Errorf("cannot parse %q", text) }
+	}
+	switch part {
+	case 1: return total & 0xFF, nil
+	case 2: return total >> 8 & 0xFF, nil
+	}
+	return total, nil
+}
+
+func parseNumber(text string) (int, error) {
+	base, digits := 10, text
+	switch {
+	case strings.HasPrefix(text, "$"): base, digits = 16, text[1:]
+	case strings.HasPrefix(text, "%"): base, digits = 2, text[1:]
+	case strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X"): base, digits = 16, text[2:]
+	}
+	n, err := strconv.ParseInt(digits, base, 64)
+	if err != nil { return 0, fmt.Errorf("bad number %q", text) }
+	return int(n), nil
+}
+
+var (
+	reg8Index  = map[string]byte{"B": 0, "C": 1, "D": 2, "E": 3, "H": 4, "L": 5, "A": 7}
+	reg16Index = map[string]byte{"BC": 0, "DE": 1, "HL": 2, "SP": 3}
+	condIndex  = map[string]byte{"NZ": 0, "Z": 1, "NC": 2, "C": 3}
+	aluIndex   = map[string]byte{"ADD": 0, "ADC": 1, "SUB": 2, "SBC": 3, "AND": 4, "XOR": 5, "OR": 6, "CP": 7}
+	cbIndex    = map[string]byte{"RLC": 0, "RRC": 1, "RL": 2, "RR": 3, "SLA": 4, "SRA": 5, "SWAP": 6, "SRL": 7}
+	bitIndex   = map[string]byte{"BIT": 0x40, "RES": 0x80, "SET": 0xC0}
+	implied    = map[string][]byte{
+		"NOP": {0x00}, "HALT": {0x76}, "STOP": {0x10, 0x00}, "DI": {0xF3}, "EI": {0xFB}, "RLCA": {0x07}, "RRCA": {0x0F},
+		"RLA": {0x17}, "RRA": {0x1F}, "DAA": {0x27}, "CPL": {0x2F}, "SCF": {0x37}, "CCF": {0x3F}, "RETI": {0xD9},
+	}
+)
+
+// r8 is the number of an operand in the register field of an opcode, with (HL) as 6
+func r8(o operand) (byte, bool) {
+	if o.kind == kindInd && o.reg == "HL" { return 6, true }
+	i, ok := reg8Index[o.reg]
+	return i, ok && o.kind == kindReg8
+}
+
+func cond(o operand) (byte, bool) {
+	i, ok := condIndex[o.reg]
+	return i, ok && (o.kind == kindCond || o.kind == kindReg8)
+}
+
+func is(o operand, kind operandKind, reg string) bool { return o.kind == kind && o.reg == reg }
+
+// encode assembles an instruction; before the labels are laid out, unknown symbols count as 0, which does not
+// change the size of any instruction
+func (a *assembler) encode(s *stmt, final bool) ([]byte, error) {
+	ops := s.operands
+	value := func(o operand) (int, error) {
+		v, err := a.eval(o.expr, final)
+		if err != nil && !final { return 0, nil }
+		return v, err
+	}
+	imm8 := func(o operand, code ...byte) ([]byte, error) {
+		v, err := value(o)
+		if err != nil { return nil, err }
+		if v < -0x80 || v > 0xFF { return nil, fmt.Errorf("%s = %d does not fit in a byte", o.expr, v) }
+		return append(code, byte(v)), nil
+	}
+	imm16 := func(o operand, code ...byte) ([]byte, error) {
+		v, err := value(o)
+		if err != nil { return nil, err }
+		if v < -0x8000 || v > 0xFFFF { return nil, fmt.Errorf("%s = %d does not fit in a word", o.expr, v) }
+		return append(code, byte(v), byte(v>>8)), nil
+	}
+	offset := func(o operand, code ...byte) ([]byte, error) {
+		v, err := value(o)
+		if err != nil { return nil, err }
+		if v < -0x80 || v > 0x7F { return nil, fmt.Errorf("offset %s = %d is out of range", o.expr, v) }
+		return append(code, byte(v)), nil
+	}
+
+	if code, ok := implied[s.op]; ok && len(ops) == 0 { return code, nil }
+	switch s.op {
+	case "LD": if len(ops) == 2 { return a.encodeLD(ops[0], ops[1], imm8, imm16, offset) }
+	case "LDH":
+		if len(ops) != 2 { break }
+		high := func(o operand, code byte) ([]byte, error) {
+			v, err := value(o)
+			if err != nil { return nil, err }
+			if v >= 0xFF00 { v -= 0xFF00 }
+			if v < 0 || v > 0xFF { return nil, fmt.Errorf("$%X is not in the high page", v) }
+			return []byte{code, byte(v)}, nil
+		}
+		switch {
+		case ops[0].kind == kindMem && is(ops[1], kindReg8, "A"): return high(ops[0], 0xE0)
+		case is(ops[0], kindReg8, "A") && ops[1].kind == kindMem: return high(ops[1], 0xF0)
+		case is(ops[0], kindInd, "C") && is(ops[1], kindReg8, "A"): return []byte{0xE2}, nil
+		case is(ops[0], kindReg8, "A") && is(ops[1], kindInd, "C"): return []byte{0xF2}, nil
+		}
+	case "PUSH", "POP":
+		if len(ops) != 1 || ops[0].kind != kindReg16 || ops[0].reg == "SP" { break }
+		i := reg16Index[ops[0].reg]
+		if ops[0].reg == "AF" { i = 3 }
+		if s.op == "PUSH" { return []byte{0xC5 | i<<4}, nil }
+		return []byte{0xC1 | i<<4}, nil
+	case "INC", "DEC":
+		if len(ops) != 1 { break }
+		dec := byte(0)
+		if s.op == "DEC" { dec = 1 }
+		if r, ok := r8(ops[0]); ok { return []byte{0x04 | r<<3 | dec}, nil }
+		if i, ok := reg16Index[ops[0].reg]; ok && ops[0].kind == kindReg16 { return []byte{0x03 | i<<4 | dec<<3}, nil }
+	case "ADD", "ADC", "SUB", "SBC", "AND", "XOR", "OR", "CP":
+		if s.op == "ADD" && len(ops) == 2 && is(ops[0], kindReg16, "HL") && ops[1].kind == kindReg16 {
+			if i, ok := reg16Index[ops[1].reg]; ok { return []byte{0x09 | i<<4}, nil }
+		}
+		if s.op == "ADD" && len(ops) == 2 && is(ops[0], kindReg16, "SP") && ops[1].kind == kindImm { return offset(ops[1], 0xE8) }
+		// The accumulator may be written out or left implicit
+		if len(ops) == 2 && is(ops[0], kindReg8, "A") { ops = ops[1:] }
+		if len(ops) != 1 { break }
+		op := aluIndex[s.op]
+		if r, ok := r8(ops[0]); ok { return []byte{0x80 | op<<3 | r}, nil }
+		if ops[0].kind == kindImm { return imm8(ops[0], 0xC6|op<<3) }
+	case "JP":
+		if len(ops) == 1 && (is(ops[0], kindReg16, "HL") || is(ops[0], kindInd, "HL")) { return []byte{0xE9}, nil }
+		if len(ops) == 1 && ops[0].kind == kindImm { return imm16(ops[0], 0xC3) }
+		if len(ops) == 2 && ops[1].kind == kindImm {
+			if cc, ok := cond(ops[0]); ok { return imm16(ops[1], 0xC2|cc<<3) }
+		}
+	case "JR":
+		rel := func(o operand, code byte) ([]byte, error) {
+			v, err := value(o)
+			if err != nil { return nil, err }
+			off := v - (s.addr + 2)
+			if final && (off < -0x80 || off > 0x7F) { return nil, fmt.Errorf("JR to %s is out of range", o.expr) }
+			return []byte{code, byte(off)}, nil
+		}
+		if len(ops) == 1 && ops[0].kind == kindImm { return rel(ops[0], 0x18) }
+		if len(ops) == 2 && ops[1].kind == kindImm {
+			if cc, ok := cond(ops[0]); ok { return rel(ops[1], 0x20|cc<<3) }
+		}
+	case "CALL":
+		if len(ops) == 1 && ops[0].kind == kindImm { return imm16(ops[0], 0xCD) }
+		if len(ops) == 2 && ops[1].kind == kindImm {
+			if cc, ok := cond(ops[0]); ok { return imm16(ops[1], 0xC4|cc<<3) }
+		}
+	case "RET":
+		if len(ops) == 0 { return []byte{0xC9}, nil }
+		if cc, ok := cond(ops[0]); ok && len(ops) == 1 { return []byte{0xC0 | cc<<3}, nil }
+	case "RST":
+		if len(ops) != 1 || ops[0].kind != kindImm { break }
+		v, err := value(ops[0])
+		if err != nil { return nil, err }
+		if v&^0x38 != 0 { return nil, fmt.Errorf("RST $%X is not one of $00, $08, ..., $38", v) }
+		return []byte{0xC7 | byte(v)}, nil
+	case "RLC", "RRC", "RL", "RR", "SLA", "SRA", "SWAP", "SRL":
+		if len(ops) != 1 { break }
+		if r, ok := r8(ops[0]); ok { return []byte{0xCB, cbIndex[s.op]<<3 | r}, nil }
+	case "BIT", "RES", "SET":
+		if len(ops) != 2 || ops[0].kind != kindImm { break }
+		v, err := value(ops[0])
+		if err != nil { return nil, err }
+		if v < 0 || v > 7 { return nil, fmt.Errorf("bit %d is not in a byte", v) }
+		if r, ok := r8(ops[1]); ok { return []byte{0xCB, bitIndex[s.op] | byte(v)<<3 | r}, nil }
+	default: return nil, fmt.Errorf("unknown instruction %s", s.op)
+	}
+	return nil, fmt.Errorf("bad operands for %s: %s", s.op, strings.Join(s.args, ", "))
+}
+
+func (a *assembler) encodeLD(dst, src operand, imm8, imm16, offset func(operand, ...byte) ([]byte, error)) ([]byte, error) {
+	d, dok := r8(dst)
+	sr, sok := r8(src)
+	srcA, dstA := is(src, kindReg8, "A"), is(dst, kindReg8, "A")
+	switch {
+	case dok && sok && !(d == 6 && sr == 6): return []byte{0x40 | d<<3 | sr}, nil
+	case dok && src.kind == kindImm: return imm8(src, 0x06|d<<3)
+	case dst.kind == kindReg16 && dst.reg != "AF" && src.kind == kindImm: return imm16(src, 0x01|reg16Index[dst.reg]<<4)
+	case dst.kind == kindInd && srcA:
+		switch dst.reg {
+		case "BC": return []byte{0x02}, nil
+		case "DE": return []byte{0x12}, nil
+		case "HL+": return []byte{0x22}, nil
+		case "HL-": return []byte{0x32}, nil
+		case "C": return []byte{0xE2}, nil
+		}
+	case dstA && src.kind == kindInd:
+		switch src.reg {
+		case "BC": return []byte{0x0A}, nil
+		case "DE": return []byte{0x1A}, nil
+		case "HL+": return []byte{0x2A}, nil
+		case "HL-": return []byte{0x3A}, nil
+		case "C": return []byte{0xF2}, nil
+		}
+	case dst.kind == kindMem && srcA: return imm16(operand{kind: kindImm, expr: dst.expr}, 0xEA)
+	case dstA && src.kind == kindMem: return imm16(operand{kind: kindImm, expr: src.expr}, 0xFA)
+	case dst.kind == kindMem && is(src, kindReg16, "SP"): return imm16(operand{kind: kindImm, expr: dst.expr}, 0x08)
+	case is(dst, kindReg16, "HL") && src.kind == kindSPOff: return offset(src, 0xF8)
+	case is(dst, kindReg16, "SP") && is(src, kindReg16, "HL"): return []byte{0xF9}, nil
+	}
+	return nil, fmt.Errorf("bad operands for LD")
+}
+
+func (a *assembler) emit() (*Image, error) {
+	img := &Image{Bytes: make([]byte, ROMSize), Symbols: make(map[string]uint16)}
+	for i := range img.Bytes {
+		img.Bytes[i] = 0xFF
+	}
+	for name, v := range a.symbols {
+		img.Symbols[name] = uint16(v)
+	}
+	// Data section bytes land in its image after the ROM section
+	put := func(s *stmt, off int, bytes ...byte) {
+		addr := s.addr + off
+		if s.section == "data" { addr += a.dataLoad - WRAMStart }
+		copy(img.Bytes[addr:], bytes)
+	}
+
+	for _, s := range a.stmts {
+		switch s.op {
+		case "", "=", ".ORG", ".SECTION", ".GLOBL": continue
+		case ".BYTE":
+			off := 0
+			for _, arg := range s.args {
+				if str, ok := unquote(arg, '"'); ok {
+					put(s, off, []byte(str)...)
+					off += len(str)
+					continue
+				}
+				v, err := a.eval(arg, true)
+				if err != nil { return nil, a.errorf(s, "%v", err) }
+				if v < -0x80 || v > 0xFF { return nil, a.errorf(s, "byte value %d out of range", v) }
+				put(s, off, byte(v))
+				off++
+			}
+		case ".WORD":
+			for i, arg := range s.args {
+				v, err := a.eval(arg, true)
+				if err != nil { return nil, a.errorf(s, "%v", err) }
+				put(s, 2*i, byte(v), byte(v>>8))
+			}
+		case ".FILL":
+			fill := 0
+			if len(s.args) > 1 {
+				v, err := a.eval(s.args[1], true)
+				if err != nil { return nil, a.errorf(s, "%v", err) }
+				fill = v
+			}
+			bytes := make([]byte, s.size)
+			for i := range bytes {
+				bytes[i] = byte(fill)
+			}
+			put(s, 0, bytes...)
+		default:
+			code, err := a.encode(s, true)
+			if err != nil { return nil, a.errorf(s, "%v", err) }
+			put(s, 0, code...)
+		}
+	}
+	fixChecksums(img.Bytes)
+	return img, nil
+}
+
+// fixChecksums fills in the header checksum at $014D, which the boot ROM checks, and the global one at $014E
+func fixChecksums(rom []byte) {
+	x := byte(0)
+	for _, c := range rom[0x134:0x14D] {
+		x = x - c - 1
+	}
+	rom[0x14D] = x
+	sum := uint16(0)
+	for i, c := range rom {
+		if i != 0x14E && i != 0x14F { sum += uint16(c) }
+	}
+	rom[0x14E], rom[0x14F] = byte(sum>>8), byte(sum)
+}
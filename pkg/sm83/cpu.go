@@ -0,0 +1,387 @@
+// Package sm83 implements the Sharp SM83 CPU of the Game Boy: an assembler for the assembly the gb backend of gbc
+// emits, making a 32 KiB ROM, and a headless Game Boy to run it without hardware, capturing what the program
+// prints through the serial port and showing the tile console it draws
+package sm83
+
+import "fmt"
+
+// Flags, in the high nibble of F
+const (
+	FlagC byte = 0x10
+	FlagH byte = 0x20
+	FlagN byte = 0x40
+	FlagZ byte = 0x80
+)
+
+// Bus is the memory map the CPU sees; Tick lets the rest of the machine catch up after every instruction
+type Bus interface {
+	Read(addr uint16) byte
+	Write(addr uint16, v byte)
+	Tick(cycles int)
+}
+
+// CPU is an SM83 with its registers; interrupts are not emulated, so IME only decides what HALT means
+type CPU struct {
+	A, F, B, C, D, E, H, L byte
+	SP, PC                 uint16
+	IME                    bool
+	Halted                 bool   // HALT ran with interrupts disabled, which stops the CPU for good
+	Steps                  uint64 // instructions executed
+	Bus                    Bus
+	cycles                 int
+}
+
+// Fault stops the CPU: an opcode the SM83 does not have, STOP, or HALT waiting on interrupts
+type Fault struct {
+	PC  uint16
+	Msg string
+}
+
+func (f *Fault) Error() string { return fmt.Sprintf("sm83: %s at $%04X", f.Msg, f.PC) }
+
+func (c *CPU) read(addr uint16) byte {
+	c.cycles += 4
+	return c.Bus.Read(addr)
+}
+
+func (c *CPU) write(addr uint16, v byte) {
+	c.cycles += 4
+	c.Bus.Write(addr, v)
+}
+
+func (c *CPU) fetch() byte {
+	v := c.read(c.PC)
+	c.PC++
+	return v
+}
+
+func (c *CPU) fetch16() uint16 {
+	lo := uint16(c.fetch())
+	return lo | uint16(c.fetch())<<8
+}
+
+func (c *CPU) push(v uint16) {
+	c.cycles += 4
+	c.SP--
+	c.write(c.SP, byte(v>>8))
+	c.SP--
+	c.write(c.SP, byte(v))
+}
+
+func (c *CPU) pop() uint16 {
+	lo := uint16(c.read(c.SP))
+	c.SP++
+	hi := uint16(c.read(c.SP))
+	c.SP++
+	return hi<<8 | lo
+}
+
+func (c *CPU) flag(f byte, on bool) {
+	if on {
+		c.F |= f
+	} else {
+		c.F &^= f
+	}
+}
+
+func (c *CPU) HL() uint16 { return uint16(c.H)<<8 | uint16(c.L) }
+func (c *CPU) BC() uint16 { return uint16(c.B)<<8 | uint16(c.C) }
+func (c *CPU) DE() uint16 { return uint16(c.D)<<8 | uint16(c.E) }
+
+func (c *CPU) setHL(v uint16) { c.H, c.L = byte(v>>8), byte(v) }
+
+// r8 reads the register numbered i in an opcode: B C D E H L (HL) A
+func (c *CPU) r8(i byte) byte {
+	switch i {
+	case 0: return c.B
+	case 1: return c.C
+	case 2: return c.D
+	case 3: return c.E
+	case 4: return c.H
+	case 5: return c.L
+	case 6: return c.read(c.HL())
+	}
+	return c.A
+}
+
+func (c *CPU) setR8(i, v byte) {
+	switch i {
+	case 0: c.B = v
+	case 1: c.C = v
+	case 2: c.D = v
+	case 3: c.E = v
+	case 4: c.H = v
+	case 5: c.L = v
+	case 6: c.write(c.HL(), v)
+	default: c.A = v
+	}
+}
+
+// r16 reads the register pair numbered i in an opcode: BC DE HL SP
+func (c *CPU) r16(i byte) uint16 {
+	switch i {
+	case 0: return c.BC()
+	case 1: return c.DE()
+	case 2: return c.HL()
+	}
+	return c.SP
+}
+
+func (c *CPU) setR16(i byte, v uint16) {
+	switch i {
+	case 0: c.B, c.C = byte(v>>8), byte(v)
+	case 1: c.D, c.E = byte(v>>8), byte(v)
+	case 2: c.setHL(v)
+	default: c.SP = v
+	}
+}
+
+// cond tells whether the condition numbered i in an opcode holds: NZ Z NC C
+func (c *CPU) cond(i byte) bool {
+	switch i {
+	case 0: return c.F&FlagZ == 0
+	case 1: return c.F&FlagZ != 0
+	case 2: return c.F&FlagC == 0
+	}
+	return c.F&FlagC != 0
+}
+
+// alu applies the operation numbered op in an opcode to A and v: ADD ADC SUB SBC AND XOR OR CP
+func (c *CPU) alu(op, v byte) {
+	carry := byte(0)
+	if c.F&FlagC != 0 && (op == 1 || op == 3) { carry = 1 }
+	a := c.A
+	var r byte
+	switch op {
+	case 0, 1:
+		sum := uint16(a) + uint16(v) + uint16(carry)
+		r = byte(sum)
+		c.F = 0
+		c.flag(FlagH, a&0x0F+v&0x0F+carry > 0x0F)
+		c.flag(FlagC, sum > 0xFF)
+	case 2, 3, 7:
+		diff := int(a) - int(v) - int(carry)
+		r = byte(diff)
+		c.F = FlagN
+		c.flag(FlagH, int(a&0x0F)-int(v&0x0F)-int(carry) < 0)
+		c.flag(FlagC, diff < 0)
+	case 4:
+		r = a & v
+		c.F = FlagH
+	case 5:
+		r = a ^ v
+		c.F = 0
+	case 6:
+		r = a | v
+		c.F = 0
+	}
+	c.flag(FlagZ, r == 0)
+	if op != 7 { c.A = r }
+}
+
+// addSP is SP plus the signed byte e, with the flags of ADD SP,e and LD HL,SP+e
+func (c *CPU) addSP(e byte) uint16 {
+	sp := c.SP
+	c.F = 0
+	c.flag(FlagH, sp&0x0F+uint16(e&0x0F) > 0x0F)
+	c.flag(FlagC, sp&0xFF+uint16(e) > 0xFF)
+	return sp + uint16(int8(e))
+}
+
+// Step executes the instruction at PC
+func (c *CPU) Step() error {
+	if c.Halted { return nil }
+	pc := c.PC
+	c.cycles = 0
+	op := c.fetch()
+	c.Steps++
+
+	switch {
+	case op == 0x00: // NOP
+	case op == 0x76: // HALT
+		if c.IME { return &Fault{pc, "HALT with interrupts enabled, which are not emulated"} }
+		c.Halted = true
+	case op >= 0x40 && op < 0x80: c.setR8(op>>3&7, c.r8(op&7))
+	case op >= 0x80 && op < 0xC0: c.alu(op>>3&7, c.r8(op&7))
+	case op&0xC7 == 0x06: c.setR8(op>>3&7, c.fetch())
+	case op&0xC7 == 0x04 || op&0xC7 == 0x05: // INC r, DEC r
+		r := op >> 3 & 7
+		v := c.r8(r)
+		if op&1 == 0 {
+			c.flag(FlagH, v&0x0F == 0x0F)
+			v++
+			c.F &^= FlagN
+		} else {
+			c.flag(FlagH, v&0x0F == 0)
+			v--
+			c.F |= FlagN
+		}
+		c.flag(FlagZ, v == 0)
+		c.setR8(r, v)
+	case op&0xCF == 0x01: c.setR16(op>>4, c.fetch16())
+	case op&0xCF == 0x03: // INC rr
+		c.setR16(op>>4, c.r16(op>>4)+1)
+		c.cycles += 4
+	case op&0xCF == 0x0B: // DEC rr
+		c.setR16(op>>4, c.r16(op>>4)-1)
+		c.cycles += 4
+	case op&0xCF == 0x09: // ADD HL,rr
+		hl, v := c.HL(), c.r16(op>>4)
+		c.F &^= FlagN
+		c.flag(FlagH, hl&0x0FFF+v&0x0FFF > 0x0FFF)
+		c.flag(FlagC, uint32(hl)+uint32(v) > 0xFFFF)
+		c.setHL(hl + v)
+		c.cycles += 4
+	case op&0xCF == 0xC1: // POP rr, with AF in place of SP
+		v := c.pop()
+		if op>>4&3 == 3 {
+			c.A, c.F = byte(v>>8), byte(v)&0xF0
+		} else {
+			c.setR16(op>>4&3, v)
+		}
+	case op&0xCF == 0xC5: // PUSH rr
+		v := uint16(c.A)<<8 | uint16(c.F)
+		if op>>4&3 != 3 { v = c.r16(op >> 4 & 3) }
+		c.push(v)
+	case op&0xE7 == 0x20 || op == 0x18: // JR cc,e and JR e
+		e := c.fetch()
+		if op == 0x18 || c.cond(op>>3&3) {
+			c.PC += uint16(int8(e))
+			c.cycles += 4
+		}
+	case op&0xE7 == 0xC2 || op == 0xC3: // JP cc,nn and JP nn
+		nn := c.fetch16()
+		if op == 0xC3 || c.cond(op>>3&3) {
+			c.PC = nn
+			c.cycles += 4
+		}
+	case op&0xE7 == 0xC4 || op == 0xCD: // CALL cc,nn and CALL nn
+		nn := c.fetch16()
+		if op == 0xCD || c.cond(op>>3&3) {
+			c.push(c.PC)
+			c.PC = nn
+		}
+	case op&0xE7 == 0xC0: // RET cc
+		c.cycles += 4
+		if c.cond(op >> 3 & 3) {
+			c.PC = c.pop()
+			c.cycles += 4
+		}
+	case op == 0xC9 || op == 0xD9: // RET, RETI
+		c.PC = c.pop()
+		c.cycles += 4
+		if op == 0xD9 { c.IME = true }
+	case op&0xC7 == 0xC7: // RST
+		c.push(c.PC)
+		c.PC = uint16(op & 0x38)
+	case op&0xC7 == 0xC6: c.alu(op>>3&7, c.fetch())
+	case op == 0xCB: c.prefixed()
+	default: return c.misc(pc, op)
+	}
+	c.Bus.Tick(c.cycles)
+	return nil
+}
+
+// misc executes the loads through pointers and the odd instructions that fit no pattern
+func (c *CPU) misc(pc uint16, op byte) error {
+	switch op {
+	case 0x02: c.write(c.BC(), c.A)
+	case 0x12: c.write(c.DE(), c.A)
+	case 0x22, 0x32: // LD (HL+),A and LD (HL-),A
+		hl := c.HL()
+		c.write(hl, c.A)
+		if op == 0x22 { c.setHL(hl + 1) } else { c.setHL(hl - 1) }
+	case 0x0A: c.A = c.read(c.BC())
+	case 0x1A: c.A = c.read(c.DE())
+	case 0x2A, 0x3A: // LD A,(HL+) and LD A,(HL-)
+		hl := c.HL()
+		c.A = c.read(hl)
+		if op == 0x2A { c.setHL(hl + 1) } else { c.setHL(hl - 1) }
+	case 0x08: // LD (nn),SP
+		nn := c.fetch16()
+		c.write(nn, byte(c.SP))
+		c.write(nn+1, byte(c.SP>>8))
+	case 0x07, 0x0F, 0x17, 0x1F: // RLCA, RRCA, RLA, RRA
+		c.A = c.rotate(op>>3, c.A)
+		c.F &^= FlagZ
+	case 0x27: // DAA
+		a := int(c.A)
+		if c.F&FlagN == 0 {
+			if c.F&FlagH != 0 || a&0x0F > 9 { a += 0x06 }
+			if c.F&FlagC != 0 || a > 0x9F { a += 0x60 }
+		} else {
+			if c.F&FlagH != 0 { a = (a - 6) & 0xFF }
+			if c.F&FlagC != 0 { a -= 0x60 }
+		}
+		c.F &^= FlagH | FlagZ
+		if a&0x100 != 0 { c.F |= FlagC }
+		c.A = byte(a)
+		c.flag(FlagZ, c.A == 0)
+	case 0x2F: // CPL
+		c.A = ^c.A
+		c.F |= FlagN | FlagH
+	case 0x37: c.F = c.F&FlagZ | FlagC
+	case 0x3F: c.F = c.F&(FlagZ|FlagC) ^ FlagC
+	case 0xE0: c.write(0xFF00|uint16(c.fetch()), c.A)
+	case 0xF0: c.A = c.read(0xFF00 | uint16(c.fetch()))
+	case 0xE2: c.write(0xFF00|uint16(c.C), c.A)
+	case 0xF2: c.A = c.read(0xFF00 | uint16(c.C))
+	case 0xEA: c.write(c.fetch16(), c.A)
+	case 0xFA: c.A = c.read(c.fetch16())
+	case 0xE8: // ADD SP,e
+		c.SP = c.addSP(c.fetch())
+		c.cycles += 8
+	case 0xF8: // LD HL,SP+e
+		c.setHL(c.addSP(c.fetch()))
+		c.cycles += 4
+	case 0xF9:
+		c.SP = c.HL()
+		c.cycles += 4
+	case 0xE9: c.PC = c.HL()
+	case 0xF3: c.IME = false
+	case 0xFB: c.IME = true
+	case 0x10: return &Fault{pc, "STOP"}
+	default: return &Fault{pc, fmt.Sprintf("no such opcode $%02X", op)}
+	}
+	c.Bus.Tick(c.cycles)
+	return nil
+}
+
+// rotate applies the rotation or shift numbered op in a CB opcode to v: RLC RRC RL RR SLA SRA SWAP SRL
+func (c *CPU) rotate(op, v byte) byte {
+	carry := c.F&FlagC != 0
+	var r byte
+	out := false
+	switch op {
+	case 0: r, out = v<<1|v>>7, v&0x80 != 0
+	case 1: r, out = v>>1|v<<7, v&1 != 0
+	case 2:
+		r, out = v<<1, v&0x80 != 0
+		if carry { r |= 1 }
+	case 3:
+		r, out = v>>1, v&1 != 0
+		if carry { r |= 0x80 }
+	case 4: r, out = v<<1, v&0x80 != 0
+	case 5: r, out = v>>1|v&0x80, v&1 != 0
+	case 6: r = v<<4 | v>>4
+	case 7: r, out = v>>1, v&1 != 0
+	}
+	c.F = 0
+	c.flag(FlagC, out)
+	c.flag(FlagZ, r == 0)
+	return r
+}
+
+func (c *CPU) prefixed() {
+	op := c.fetch()
+	r, bit := op&7, op>>3&7
+	v := c.r8(r)
+	switch op >> 6 {
+	case 0: c.setR8(r, c.rotate(bit, v))
+	case 1: // BIT
+		c.flag(FlagZ, v&(1<<bit) == 0)
+		c.F = c.F&^FlagN | FlagH
+	case 2: c.setR8(r, v&^(1<<bit))
+	case 3: c.setR8(r, v|1<<bit)
+	}
+}
@@ -0,0 +1,248 @@
+package sm83
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Logo is the Nintendo logo every cartridge header holds at $0104, which the boot ROM checks
+var Logo = []byte{
+	0xCE, 0xED, 0x66, 0x66, 0xCC, 0x0D, 0x00, 0x0B, 0x03, 0x73, 0x00, 0x83, 0x00, 0x0C, 0x00, 0x0D,
+	0x00, 0x08, 0x11, 0x1F, 0x88, 0x89, 0x00, 0x0E, 0xDC, 0xCC, 0x6E, 0xE6, 0xDD, 0xDD, 0xD9, 0x99,
+	0xBB, 0xBB, 0x67, 0x63, 0x6E, 0x0E, 0xEC, 0xCC, 0xDD, 0xDC, 0x99, 0x9F, 0xBB, 0xB9, 0x33, 0x3E,
+}
+
+// IsROM tells whether image is a Game Boy cartridge, by the logo in its header
+func IsROM(image []byte) bool { return len(image) >= 0x150 && bytes.Equal(image[0x104:0x134], Logo) }
+
+// Registers of the I/O page the machine emulates
+const (
+	RegP1   = 0xFF00
+	RegSB   = 0xFF01
+	RegSC   = 0xFF02
+	RegDIV  = 0xFF04
+	RegIF   = 0xFF0F
+	RegLCDC = 0xFF40
+	RegSTAT = 0xFF41
+	RegSCY  = 0xFF42
+	RegSCX  = 0xFF43
+	RegLY   = 0xFF44
+	RegIE   = 0xFFFF
+)
+
+// Joypad bits as getchar in the gb runtime reads them, the buttons in the high nibble and the d-pad in the low
+const (
+	PadRight = 1 << iota
+	PadLeft
+	PadUp
+	PadDown
+	PadA
+	PadB
+	PadSelect
+	PadStart
+)
+
+// padKeys are the bytes of input standing for each joypad bit; getchar returns them for the lowest bit pressed
+const padKeys = "rludab \n"
+
+// Holding time of each input, in polls of the joypad; a poll starts whenever the d-pad alone is selected in P1
+const padPolls = 16
+
+const (
+	dotsPerLine = 456
+	linesPerLCD = 154
+)
+
+// Machine is a headless Game Boy with a ROM-only cartridge: the CPU with its memory map, the LCD timing the
+// program sees through LY and STAT without drawing anything, the serial port, which prints what is sent through it,
+// and a joypad pressed from a stream of input
+type Machine struct {
+	CPU
+	rom        []byte
+	vram       [0x2000]byte
+	wram       [0x2000]byte
+	oam        [0xA0]byte
+	hram       [0x7F]byte
+	io         [0x80]byte
+	ie         byte
+	cycles     uint64
+	dots       int // since the LCD was last turned on
+	serial     io.Writer
+	input      *bufio.Reader
+	pad        byte // bits held in this phase of the input
+	polls      int  // of the joypad in this phase
+	holding    bool // whether this phase holds an input, or is the release after one
+}
+
+// NewMachine loads a 32 KiB ROM and sets the registers the way the CGB boot ROM leaves them; what the program
+// sends through the serial port goes to serial, and input becomes joypad presses, one byte of padKeys at a time
+// with anything else skipped, and Start+Select once it runs out
+func NewMachine(rom []byte, input io.Reader, serial io.Writer) (*Machine, error) {
+	if len(rom) != ROMSize { return nil, fmt.Errorf("sm83: ROM of %d bytes is not a %d KiB ROM-only cartridge", len(rom), ROMSize/1024) }
+	m := &Machine{rom: rom, serial: serial, input: bufio.NewReader(input)}
+	m.A, m.F, m.B, m.C, m.D, m.E, m.H, m.L = 0x11, 0x80, 0x00, 0x00, 0xFF, 0x56, 0x00, 0x0D
+	m.SP, m.PC = 0xFFFE, 0x0100
+	m.io[RegLCDC-0xFF00] = 0x91
+	m.io[RegP1-0xFF00] = 0xCF
+	m.Bus = m
+	return m, nil
+}
+
+// Run runs a ROM until it halts with interrupts disabled, which is how exit in the gb runtime ends it, returning the
+// status it left in A; the program's output is what it sends through the serial port
+func Run(rom []byte, stdin io.Reader, stdout io.Writer) (int, error) {
+	out := bufio.NewWriter(stdout)
+	defer out.Flush()
+	m, err := NewMachine(rom, stdin, out)
+	if err != nil { return 0, err }
+	if err := m.Run(); err != nil { return 0, err }
+	return int(m.A), nil
+}
+
+// Run steps the CPU until it halts
+func (m *Machine) Run() error {
+	for !m.Halted {
+		if err := m.Step(); err != nil { return err }
+	}
+	return nil
+}
+
+func (m *Machine) lcdOn() bool { return m.io[RegLCDC-0xFF00]&0x80 != 0 }
+
+func (m *Machine) ly() byte {
+	if !m.lcdOn() { return 0 }
+	return byte(m.dots / dotsPerLine % linesPerLCD)
+}
+
+// mode is the STAT mode of the LCD: 0 in HBlank, 1 in VBlank, 2 reading OAM and 3 drawing, when VRAM is locked
+func (m *Machine) mode() byte {
+	if !m.lcdOn() { return 0 }
+	dot := m.dots % dotsPerLine
+	switch {
+	case m.ly() >= 144: return 1
+	case dot < 80: return 2
+	case dot < 80+172: return 3
+	}
+	return 0
+}
+
+// Tick implements Bus, moving the LCD and DIV along
+func (m *Machine) Tick(cycles int) {
+	m.cycles += uint64(cycles)
+	if m.lcdOn() { m.dots = (m.dots + cycles) % (dotsPerLine * linesPerLCD) }
+}
+
+// Read implements Bus
+func (m *Machine) Read(addr uint16) byte {
+	switch {
+	case addr < 0x8000: return m.rom[addr]
+	case addr < 0xA000:
+		if m.mode() == 3 { return 0xFF }
+		return m.vram[addr-0x8000]
+	case addr < 0xC000: return 0xFF
+	case addr < 0xFE00: return m.wram[(addr-0xC000)&0x1FFF]
+	case addr < 0xFEA0: return m.oam[addr-0xFE00]
+	case addr < 0xFF00: return 0xFF
+	case addr == RegIE: return m.ie
+	case addr >= 0xFF80: return m.hram[addr-0xFF80]
+	}
+	switch addr {
+	case RegP1: return m.readPad()
+	case RegDIV: return byte(m.cycles >> 8)
+	case RegSTAT:
+		stat := m.io[RegSTAT-0xFF00]&0x78 | 0x80 | m.mode()
+		if m.ly() == m.io[0x45] { stat |= 0x04 }
+		return stat
+	case RegLY: return m.ly()
+	}
+	return m.io[addr-0xFF00]
+}
+
+// Write implements Bus; the ROM has no bank controller, so writes to it are ignored
+func (m *Machine) Write(addr uint16, v byte) {
+	switch {
+	case addr < 0x8000:
+	case addr < 0xA000: if m.mode() != 3 { m.vram[addr-0x8000] = v }
+	case addr < 0xC000:
+	case addr < 0xFE00: m.wram[(addr-0xC000)&0x1FFF] = v
+	case addr < 0xFEA0: m.oam[addr-0xFE00] = v
+	case addr < 0xFF00:
+	case addr == RegIE: m.ie = v
+	case addr >= 0xFF80: m.hram[addr-0xFF80] = v
+	default: m.writeIO(addr, v)
+	}
+}
+
+func (m *Machine) writeIO(addr uint16, v byte) {
+	switch addr {
+	case RegP1:
+		// Selecting the d-pad alone starts a poll
+		if v&0x30 == 0x20 { m.poll() }
+		m.io[0] = m.io[0]&0x0F | v&0x30
+		return
+	case RegSC:
+		// A transfer on the internal clock sends SB at once, with nothing on the other end
+		if v&0x81 == 0x81 {
+			m.serial.Write([]byte{m.io[RegSB-0xFF00]})
+			m.io[RegSB-0xFF00] = 0xFF
+			v &^= 0x80
+		}
+	case RegDIV: m.cycles &^= 0xFFFF
+	case RegLY: return
+	case RegLCDC:
+		if v&0x80 != 0 && !m.lcdOn() { m.dots = 0 }
+	}
+	m.io[addr-0xFF00] = v
+}
+
+func (m *Machine) readPad() byte {
+	sel := m.io[0] & 0x30
+	held := byte(0)
+	if sel&0x10 == 0 { held |= m.pad & 0x0F }
+	if sel&0x20 == 0 { held |= m.pad >> 4 }
+	return 0xC0 | sel | ^held&0x0F
+}
+
+// poll moves the input along: every input is held for padPolls polls, then released for as many
+func (m *Machine) poll() {
+	m.polls++
+	if m.polls < padPolls { return }
+	m.polls = 0
+	if m.holding {
+		m.holding, m.pad = false, 0
+		return
+	}
+	m.holding, m.pad = true, PadStart|PadSelect
+	for {
+		c, err := m.input.ReadByte()
+		if err != nil { break }
+		if i := strings.IndexByte(padKeys, c); i >= 0 {
+			m.pad = 1 << i
+			break
+		}
+	}
+}
+
+// Screen is the text on the tile console of the gb runtime: the 20x18 tiles the background shows, read as
+// characters by their tile numbers, with the trailing spaces of each line trimmed
+func (m *Machine) Screen() string {
+	var sb strings.Builder
+	scy := int(m.io[RegSCY-0xFF00]) / 8
+	scx := int(m.io[RegSCX-0xFF00]) / 8
+	base := 0x1800
+	if m.io[RegLCDC-0xFF00]&0x08 != 0 { base = 0x1C00 }
+	for row := 0; row < 18; row++ {
+		line := make([]byte, 20)
+		for col := range line {
+			c := m.vram[base+(scy+row)%32*32+(scx+col)%32]
+			if c < ' ' || c > '~' { c = ' ' }
+			line[col] = c
+		}
+		sb.WriteString(strings.TrimRight(string(line), " "))
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
@@ -22,11 +22,15 @@ const (
 	Default
 	Break
 	Continue
+	Defer
+	For
+	Do
 	Asm
 	Nil
 	Null
 	TypeKeyword
 	Struct
+	Union
 	Enum
 	Const
 	Void
@@ -120,11 +124,15 @@ var KeywordMap = map[string]Type{
 	"__asm__":  Asm,
 	"break":    Break,
 	"continue": Continue,
+	"defer":    Defer,
+	"for":      For,
+	"do":       Do,
 	"nil":      Nil,
 	"null":     Null,
 	"void":     Void,
 	"type":     TypeKeyword,
 	"struct":   Struct,
+	"union":    Union,
 	"enum":     Enum,
 	"const":    Const,
 	"bool":     Bool,
@@ -28,6 +28,8 @@ type TypeChecker struct {
 	cfg          *config.Config
 	resolving    map[*ast.BxType]bool
 	wordSize     int
+	// Redefine lets a global definition replace an earlier one, as a later input does in an interactive session
+	Redefine bool
 }
 
 func NewTypeChecker(cfg *config.Config) *TypeChecker {
@@ -98,7 +100,7 @@ func (tc *TypeChecker) addSymbol(node *ast.Node) *Symbol {
 
 	if existing := tc.findSymbol(name, isType); existing != nil && tc.currentScope == tc.globalScope {
 		isExistingExtrn := existing.Node != nil && existing.Node.Type == ast.ExtrnDecl
-		if !isExistingExtrn && !(existing.IsFunc && !isFunc && existing.Type.Kind == ast.TYPE_UNTYPED) {
+		if !isExistingExtrn && !tc.Redefine && !(existing.IsFunc && !isFunc && existing.Type.Kind == ast.TYPE_UNTYPED) {
 			util.Error(node.Tok, "Redefinition of '%s'", name)
 		}
 		existing.Type, existing.IsFunc, existing.IsType, existing.Node = typ, isFunc, isType, node
@@ -137,7 +139,7 @@ func (tc *TypeChecker) getAlignof(typ *ast.BxType) int64 {
 		return int64(tc.wordSize)
 	}
 
-	if (typ.Kind == ast.TYPE_PRIMITIVE || typ.Kind == ast.TYPE_STRUCT) && typ.Name != "" {
+	if (typ.Kind == ast.TYPE_PRIMITIVE || typ.HasFields()) && typ.Name != "" {
 		if sym := tc.findSymbol(typ.Name, true); sym != nil {
 			if sym.Type != typ {
 				return tc.getAlignof(sym.Type)
@@ -152,8 +154,9 @@ func (tc *TypeChecker) getAlignof(typ *ast.BxType) int64 {
 	case ast.TYPE_VOID: return 1
 	case ast.TYPE_POINTER: return int64(tc.wordSize)
 	case ast.TYPE_ARRAY: return tc.getAlignof(typ.Base)
+	case ast.TYPE_SLICE: return tc.getAlignof(ast.SliceHeader)
 	case ast.TYPE_PRIMITIVE, ast.TYPE_FLOAT, ast.TYPE_ENUM: return tc.getSizeof(typ)
-	case ast.TYPE_STRUCT:
+	case ast.TYPE_STRUCT, ast.TYPE_UNION:
 		var maxAlign int64 = 1
 		for _, field := range typ.Fields {
 			fieldAlign := tc.getAlignof(field.Data.(ast.VarDeclNode).Type)
@@ -184,6 +187,8 @@ func (tc *TypeChecker) getSizeof(typ *ast.BxType) int64 {
 			}
 		}
 		return elemSize * arrayLen
+	case ast.TYPE_SLICE:
+		return tc.getSizeof(ast.SliceHeader)
 	case ast.TYPE_PRIMITIVE, ast.TYPE_LITERAL_INT:
 		resolver := ir.NewTypeSizeResolver(tc.wordSize)
 		if size := resolver.GetTypeSize(typ.Name); size > 0 {
@@ -214,6 +219,15 @@ func (tc *TypeChecker) getSizeof(typ *ast.BxType) int64 {
 			maxAlign = 1
 		}
 		return util.AlignUp(totalSize, maxAlign)
+	case ast.TYPE_UNION:
+		// The fields overlap, so the union is as large as its largest field
+		var maxSize, maxAlign int64 = 0, 1
+		for _, field := range typ.Fields {
+			fieldType := field.Data.(ast.VarDeclNode).Type
+			maxSize = max(maxSize, tc.getSizeof(fieldType))
+			maxAlign = max(maxAlign, tc.getAlignof(fieldType))
+		}
+		return util.AlignUp(maxSize, maxAlign)
 	}
 	return int64(tc.wordSize)
 }
@@ -304,8 +318,22 @@ func (tc *TypeChecker) checkNode(node *ast.Node) {
 		d := node.Data.(ast.WhileNode)
 		tc.checkExprAsCondition(d.Cond)
 		tc.checkNode(d.Body)
+	case ast.For:
+		d := node.Data.(ast.ForNode)
+		tc.enterScope()
+		tc.checkNode(d.Init)
+		tc.checkExprAsCondition(d.Cond)
+		tc.checkExpr(d.Post)
+		tc.checkNode(d.Body)
+		tc.exitScope()
+	case ast.DoWhile:
+		d := node.Data.(ast.DoWhileNode)
+		tc.checkNode(d.Body)
+		tc.checkExprAsCondition(d.Cond)
 	case ast.Return:
 		tc.checkReturn(node)
+	case ast.Defer:
+		tc.checkExpr(node.Data.(ast.DeferNode).Expr)
 	case ast.Switch:
 		d := node.Data.(ast.SwitchNode)
 		tc.checkExpr(d.Expr)
@@ -321,7 +349,11 @@ func (tc *TypeChecker) checkNode(node *ast.Node) {
 		tc.checkNode(node.Data.(ast.LabelNode).Stmt)
 	case ast.ExtrnDecl:
 		tc.addSymbol(node)
-	case ast.TypeDecl, ast.EnumDecl, ast.Goto, ast.Break, ast.Continue, ast.AsmStmt, ast.Directive:
+	case ast.AsmStmt:
+		for _, op := range node.Data.(ast.AsmStmtNode).Operands {
+			tc.checkExpr(op.Expr)
+		}
+	case ast.TypeDecl, ast.EnumDecl, ast.Goto, ast.Break, ast.Continue, ast.Directive:
 	default:
 		if node.Type <= ast.StructLiteral {
 			tc.checkExpr(node)
@@ -348,7 +380,7 @@ func (tc *TypeChecker) checkFuncDecl(node *ast.Node) {
 func (tc *TypeChecker) checkVarDecl(node *ast.Node) {
 	d := node.Data.(ast.VarDeclNode)
 	if d.IsDefine {
-		if sym := tc.findSymbolInCurrentScope(d.Name, false); sym != nil {
+		if sym := tc.findSymbolInCurrentScope(d.Name, false); sym != nil && !(tc.Redefine && tc.currentScope == tc.globalScope) {
 			util.Error(node.Tok, "no new variables on left side of := (redeclaration of '%s')", d.Name)
 		} else {
 			tc.addSymbol(node)
@@ -370,7 +402,7 @@ func (tc *TypeChecker) checkVarDecl(node *ast.Node) {
 	if d.IsDefine && (d.Type == nil || d.Type.Kind == ast.TYPE_UNTYPED) {
 		if structTypeSym := tc.findSymbol(d.Name, true); structTypeSym != nil && structTypeSym.IsType {
 			structType := tc.resolveType(structTypeSym.Type)
-			if structType.Kind == ast.TYPE_STRUCT {
+			if structType.HasFields() {
 				var operandExpr *ast.Node
 				if initExpr.Type == ast.UnaryOp {
 					unaryOp := initExpr.Data.(ast.UnaryOpNode)
@@ -411,6 +443,11 @@ func (tc *TypeChecker) checkVarDecl(node *ast.Node) {
 	if initType == nil {
 		return
 	}
+	// A B vector is of words, whatever its first element is
+	if d.IsVector && (d.Type == nil || d.Type.Kind == ast.TYPE_UNTYPED) {
+		node.Typ = d.Type
+		return
+	}
 
 	if d.Type == nil || d.Type.Kind == ast.TYPE_UNTYPED {
 		d.Type = initType
@@ -433,6 +470,8 @@ func (tc *TypeChecker) checkVarDecl(node *ast.Node) {
 	}
 	if !tc.areTypesCompatible(d.Type, initType, initExpr) {
 		tc.typeErrorOrWarn(node.Tok, "Initializing variable of type '%s' with expression of incompatible type '%s'", ast.TypeToString(d.Type), ast.TypeToString(initType))
+	} else {
+		tc.toSlice(d.Type, initExpr)
 	}
 	node.Typ = d.Type
 }
@@ -489,6 +528,8 @@ func (tc *TypeChecker) checkReturn(node *ast.Node) {
 			util.Error(node.Tok, "Return with a value in function returning void")
 		} else if !tc.areTypesCompatible(retType, exprType, d.Expr) {
 			tc.typeErrorOrWarn(node.Tok, "Returning type '%s' is incompatible with function return type '%s'", ast.TypeToString(exprType), ast.TypeToString(retType))
+		} else {
+			tc.toSlice(retType, d.Expr)
 		}
 	}
 }
@@ -568,6 +609,8 @@ func (tc *TypeChecker) checkExpr(node *ast.Node) *ast.BxType {
 			if tc.isNumericType(lhsType) || lhsType.Kind == ast.TYPE_POINTER || lhsType.Kind == ast.TYPE_BOOL {
 				d.Rhs.Typ = lhsType
 			}
+		} else {
+			tc.toSlice(lhsType, d.Rhs)
 		}
 		typ = lhsType
 	case ast.BinaryOpNode:
@@ -622,7 +665,7 @@ func (tc *TypeChecker) checkExpr(node *ast.Node) *ast.BxType {
 			tc.typeErrorOrWarn(d.Index.Tok, "Array subscript is not an integer type ('%s')", ast.TypeToString(indexType))
 		}
 		resolvedArrayType := tc.resolveType(arrayType)
-		if resolvedArrayType.Kind == ast.TYPE_ARRAY || resolvedArrayType.Kind == ast.TYPE_POINTER {
+		if resolvedArrayType.Kind == ast.TYPE_ARRAY || resolvedArrayType.Kind == ast.TYPE_POINTER || resolvedArrayType.Kind == ast.TYPE_SLICE {
 			typ = resolvedArrayType.Base
 		} else if resolvedArrayType.Kind == ast.TYPE_UNTYPED || tc.isIntegerType(resolvedArrayType) {
 			promotedType := &ast.BxType{Kind: ast.TYPE_POINTER, Base: ast.TypeUntyped}
@@ -640,6 +683,8 @@ func (tc *TypeChecker) checkExpr(node *ast.Node) *ast.BxType {
 			util.Error(node.Tok, "Cannot subscript non-array/pointer type '%s'", ast.TypeToString(arrayType))
 			typ = ast.TypeUntyped
 		}
+	case ast.SliceNode:
+		typ = tc.checkSlice(node)
 	case ast.MemberAccessNode:
 		typ = tc.checkMemberAccess(node)
 	case ast.FuncCallNode:
@@ -651,6 +696,9 @@ func (tc *TypeChecker) checkExpr(node *ast.Node) *ast.BxType {
 		resolvedOpType := tc.resolveType(operandType)
 		if resolvedOpType.Kind == ast.TYPE_POINTER || resolvedOpType.Kind == ast.TYPE_ARRAY {
 			typ = resolvedOpType.Base
+		} else if resolvedOpType.Kind == ast.TYPE_FUNC {
+			// (*op)(a, b) calls the function op points to, as op(a, b) does
+			typ = operandType
 		} else if resolvedOpType.Kind == ast.TYPE_UNTYPED || tc.isIntegerType(resolvedOpType) {
 			promotedType := &ast.BxType{Kind: ast.TYPE_POINTER, Base: ast.TypeUntyped}
 			indirData.Expr.Typ = promotedType
@@ -686,11 +734,14 @@ func (tc *TypeChecker) checkExpr(node *ast.Node) *ast.BxType {
 		typ = ast.TypeNil
 	case ast.IdentNode:
 		if sym := tc.findSymbol(d.Name, false); sym != nil {
-			if node.Parent != nil && node.Parent.Type == ast.FuncCall && node.Parent.Data.(ast.FuncCallNode).FuncExpr == node && !sym.IsFunc {
+			isCallee := node.Parent != nil && node.Parent.Type == ast.FuncCall && node.Parent.Data.(ast.FuncCallNode).FuncExpr == node
+			if isCallee && !sym.IsFunc && tc.resolveType(sym.Type).Kind != ast.TYPE_FUNC {
 				sym.IsFunc, sym.Type = true, ast.TypeInt
 			}
 			t := sym.Type
-			if t != nil && t.Kind == ast.TYPE_ARRAY {
+			if fd, ok := funcDecl(sym); ok && fd.IsTyped && !isCallee {
+				typ = tc.funcType(fd)
+			} else if t != nil && t.Kind == ast.TYPE_ARRAY {
 				typ = &ast.BxType{Kind: ast.TYPE_POINTER, Base: t.Base, IsConst: t.IsConst}
 			} else {
 				typ = t
@@ -700,6 +751,16 @@ func (tc *TypeChecker) checkExpr(node *ast.Node) *ast.BxType {
 			sym := tc.addSymbol(ast.NewVarDecl(node.Tok, d.Name, ast.TypeUntyped, nil, nil, false, false, false))
 			typ = sym.Type
 		}
+	case ast.AddressOfNode:
+		typ = tc.checkExpr(d.LValue)
+		// The address of a typed value points to its type, so that indexing through `&matrix[0][0]` scales by the
+		// element and not the word. The address of a function is the pointer its name already is, and that of an
+		// untyped word is a word
+		if typ.Kind == ast.TYPE_UNTYPED {
+			typ = ast.TypeUntyped
+		} else if typ.Kind != ast.TYPE_FUNC || d.LValue.Type != ast.Ident {
+			typ = &ast.BxType{Kind: ast.TYPE_POINTER, Base: typ}
+		}
 	default:
 		typ = ast.TypeUntyped
 	}
@@ -707,12 +768,28 @@ func (tc *TypeChecker) checkExpr(node *ast.Node) *ast.BxType {
 	return typ
 }
 
+// funcDecl is the declaration of the function sym names, if it names one
+func funcDecl(sym *Symbol) (ast.FuncDeclNode, bool) {
+	if !sym.IsFunc || sym.Node == nil { return ast.FuncDeclNode{}, false }
+	fd, ok := sym.Node.Data.(ast.FuncDeclNode)
+	return fd, ok
+}
+
+// funcType is the type of a pointer to the typed function fd
+func (tc *TypeChecker) funcType(fd ast.FuncDeclNode) *ast.BxType {
+	typ := &ast.BxType{Kind: ast.TYPE_FUNC, Base: fd.ReturnType, Variadic: fd.HasVarargs}
+	for _, param := range fd.Params {
+		if p, ok := param.Data.(ast.VarDeclNode); ok { typ.Params = append(typ.Params, p.Type) }
+	}
+	return typ
+}
+
 func (tc *TypeChecker) findStructWithMember(memberName string) *ast.BxType {
 	for s := tc.currentScope; s != nil; s = s.Parent {
 		for sym := s.Symbols; sym != nil; sym = sym.Next {
 			if sym.IsType {
 				typ := tc.resolveType(sym.Type)
-				if typ.Kind == ast.TYPE_STRUCT {
+				if typ.HasFields() {
 					for _, field := range typ.Fields {
 						if field.Data.(ast.VarDeclNode).Name == memberName {
 							return typ
@@ -754,7 +831,7 @@ func (tc *TypeChecker) checkMemberAccess(node *ast.Node) *ast.BxType {
 		}
 	}
 
-	if resolvedStructType == nil || resolvedStructType.Kind != ast.TYPE_STRUCT {
+	if !resolvedStructType.HasFields() {
 		memberName := d.Member.Data.(ast.IdentNode).Name
 		util.Error(node.Tok, "request for member '%s' in non-struct type '%s'", memberName, ast.TypeToString(exprType))
 		return ast.TypeUntyped
@@ -808,6 +885,9 @@ func (tc *TypeChecker) checkFuncCall(node *ast.Node) *ast.BxType {
 			if arg.Type == ast.Ident {
 				if sym := tc.findSymbol(arg.Data.(ast.IdentNode).Name, true); sym != nil && sym.IsType {
 					targetType = sym.Type
+				} else if sym := tc.findSymbol(arg.Data.(ast.IdentNode).Name, false); sym != nil && sym.Type != nil && sym.Type.Kind == ast.TYPE_ARRAY && sym.Type.ArraySize != nil {
+					// An array is the size of all its elements, though its name decays to a pointer elsewhere
+					targetType = sym.Type
 				}
 			}
 			if targetType == nil {
@@ -820,6 +900,9 @@ func (tc *TypeChecker) checkFuncCall(node *ast.Node) *ast.BxType {
 			node.Type, node.Data, node.Typ = ast.Number, ast.NumberNode{Value: tc.getSizeof(targetType)}, ast.TypeInt
 			return ast.TypeInt
 		}
+		if name == "len" && tc.findSymbol(name, false) == nil {
+			return tc.checkLen(node)
+		}
 
 		if targetType := tc.typeFromName(name); targetType != nil {
 			if len(d.Args) != 1 {
@@ -871,12 +954,47 @@ func (tc *TypeChecker) checkFuncCall(node *ast.Node) *ast.BxType {
 		}
 	}
 
-	for _, arg := range d.Args {
-		tc.checkExpr(arg)
+	var params []*ast.Node
+	isDirect := false
+	if d.FuncExpr.Type == ast.Ident {
+		if sym := tc.findSymbol(d.FuncExpr.Data.(ast.IdentNode).Name, false); sym != nil && sym.IsFunc {
+			isDirect = true
+			if fd, ok := funcDecl(sym); ok { params = fd.Params }
+		}
+	}
+	// A call through a pointer to a function is checked against the signature of the pointer
+	if sig := tc.resolveType(funcExprType); !isDirect && sig.Kind == ast.TYPE_FUNC {
+		if len(d.Args) < len(sig.Params) || (len(d.Args) > len(sig.Params) && !sig.Variadic) {
+			util.Error(node.Tok, "Wrong number of arguments in call through '%s'. Expected %d, got %d", ast.TypeToString(funcExprType), len(sig.Params), len(d.Args))
+		}
+		for i, arg := range d.Args {
+			argType := tc.checkExpr(arg)
+			if i >= len(sig.Params) { continue }
+			if !tc.areTypesCompatible(sig.Params[i], argType, arg) {
+				tc.typeErrorOrWarn(arg.Tok, "Passing type '%s' to parameter %d of type '%s'", ast.TypeToString(argType), i+1, ast.TypeToString(sig.Params[i]))
+			} else {
+				tc.toSlice(sig.Params[i], arg)
+			}
+		}
+		funcExprType = sig.Base
+	}
+	for i, arg := range d.Args {
+		argType := tc.checkExpr(arg)
+		if i >= len(params) { continue }
+		// Structs and slices are passed by value, to parameters of the same type only
+		param, ok := params[i].Data.(ast.VarDeclNode)
+		if !ok { continue }
+		paramType, resolvedArg := tc.resolveType(param.Type), tc.resolveType(argType)
+		isStruct := paramType.HasFields() || resolvedArg.HasFields() || paramType.Kind == ast.TYPE_SLICE || resolvedArg.Kind == ast.TYPE_SLICE
+		if isStruct && !tc.areTypesCompatible(param.Type, argType, arg) {
+			tc.typeErrorOrWarn(arg.Tok, "Passing type '%s' to parameter '%s' of type '%s'", ast.TypeToString(argType), param.Name, ast.TypeToString(param.Type))
+		} else if isStruct {
+			tc.toSlice(param.Type, arg)
+		}
 	}
 
 	resolvedType := tc.resolveType(funcExprType)
-	if resolvedType != nil && resolvedType.Kind == ast.TYPE_STRUCT {
+	if resolvedType.HasFields() {
 		return resolvedType
 	}
 
@@ -899,13 +1017,18 @@ func (tc *TypeChecker) checkStructLiteral(node *ast.Node) *ast.BxType {
 	}
 
 	structType := tc.resolveType(sym.Type)
-	if structType.Kind != ast.TYPE_STRUCT {
+	if !structType.HasFields() {
 		util.Error(d.TypeNode.Tok, "'%s' is not a struct type", typeIdent.Name)
 		return ast.TypeUntyped
 	}
+	// The fields of a union share their storage, so a literal initializes one of them, the first unless named
+	if structType.Kind == ast.TYPE_UNION && len(d.Values) > 1 {
+		util.Error(node.Tok, "Too many initializers for union '%s'. Expected at most 1, got %d", typeIdent.Name, len(d.Values))
+		return structType
+	}
 
 	if d.Names == nil {
-		if len(d.Values) > 0 {
+		if len(d.Values) > 0 && structType.Kind == ast.TYPE_STRUCT {
 			if len(structType.Fields) > 0 {
 				firstFieldType := tc.resolveType(structType.Fields[0].Data.(ast.VarDeclNode).Type)
 				for i := 1; i < len(structType.Fields); i++ {
@@ -929,6 +1052,8 @@ func (tc *TypeChecker) checkStructLiteral(node *ast.Node) *ast.BxType {
 			valType := tc.checkExpr(valNode)
 			if !tc.areTypesCompatible(field.Type, valType, valNode) {
 				tc.typeErrorOrWarn(valNode.Tok, "Initializer for field '%s' has wrong type. Expected '%s', got '%s'", field.Name, ast.TypeToString(field.Type), ast.TypeToString(valType))
+			} else {
+				tc.toSlice(field.Type, valNode)
 			}
 		}
 	} else {
@@ -968,6 +1093,8 @@ func (tc *TypeChecker) checkStructLiteral(node *ast.Node) *ast.BxType {
 
 			if !tc.areTypesCompatible(fieldType, valType, valNode) {
 				tc.typeErrorOrWarn(valNode.Tok, "Initializer for field '%s' has wrong type. Expected '%s', got '%s'", fieldName, ast.TypeToString(fieldType), ast.TypeToString(valType))
+			} else {
+				tc.toSlice(fieldType, valNode)
 			}
 		}
 	}
@@ -978,8 +1105,8 @@ func (tc *TypeChecker) checkStructLiteral(node *ast.Node) *ast.BxType {
 func (tc *TypeChecker) checkArrayLiteral(node *ast.Node) *ast.BxType {
 	d := node.Data.(ast.ArrayLiteralNode)
 
-	// Create pointer type to element type (since array literals decay to pointers)
-	pointerType := &ast.BxType{Kind: ast.TYPE_POINTER, Base: d.ElementType}
+	// An array literal is a slice of its elements
+	sliceType := &ast.BxType{Kind: ast.TYPE_SLICE, Base: d.ElementType}
 
 	// Type check all the values
 	for i, valueNode := range d.Values {
@@ -990,7 +1117,81 @@ func (tc *TypeChecker) checkArrayLiteral(node *ast.Node) *ast.BxType {
 		}
 	}
 
-	return pointerType
+	return sliceType
+}
+
+// checkSlice types a[low:high] as a slice of the elements of a, which is a slice, an array, a string literal or a
+// pointer, the last needing high since nothing else says where its elements end
+func (tc *TypeChecker) checkSlice(node *ast.Node) *ast.BxType {
+	d := node.Data.(ast.SliceNode)
+	exprType := tc.resolveType(tc.checkExpr(d.Expr))
+	for _, bound := range []*ast.Node{d.Low, d.High} {
+		if bound == nil { continue }
+		if t := tc.checkExpr(bound); !tc.isIntegerType(t) {
+			tc.typeErrorOrWarn(bound.Tok, "Slice bound is not an integer type ('%s')", ast.TypeToString(t))
+		}
+	}
+	switch {
+	case exprType.Kind == ast.TYPE_SLICE:
+		return exprType
+	case d.Expr.Type == ast.String:
+		return &ast.BxType{Kind: ast.TYPE_SLICE, Base: ast.TypeByte}
+	case tc.arrayType(d.Expr) != nil:
+		return &ast.BxType{Kind: ast.TYPE_SLICE, Base: tc.arrayType(d.Expr).Base}
+	case exprType.Kind == ast.TYPE_POINTER:
+		if d.High == nil { util.Error(node.Tok, "Slice of pointer type '%s' needs an upper bound", ast.TypeToString(exprType)) }
+		return &ast.BxType{Kind: ast.TYPE_SLICE, Base: exprType.Base}
+	}
+	util.Error(node.Tok, "Cannot slice type '%s'", ast.TypeToString(exprType))
+	return ast.TypeUntyped
+}
+
+// checkLen types len(x), the number of elements of a slice, an array or a string literal
+func (tc *TypeChecker) checkLen(node *ast.Node) *ast.BxType {
+	d := node.Data.(ast.FuncCallNode)
+	if len(d.Args) != 1 {
+		util.Error(node.Tok, "len expects exactly one argument")
+		return ast.TypeInt
+	}
+	arg := d.Args[0]
+	argType := tc.resolveType(tc.checkExpr(arg))
+	switch {
+	case arg.Type == ast.String:
+		node.Type, node.Data = ast.Number, ast.NumberNode{Value: int64(len(arg.Data.(ast.StringNode).Value))}
+	case argType.Kind == ast.TYPE_SLICE || tc.arrayType(arg) != nil:
+		node.Type, node.Data = ast.Len, ast.LenNode{Expr: arg}
+	default:
+		util.Error(arg.Tok, "Invalid argument for len: type '%s' has no length", ast.TypeToString(argType))
+	}
+	node.Typ = ast.TypeInt
+	return ast.TypeInt
+}
+
+// arrayType is the type of the array node is or names, if its size is known. The name of an array decays to a
+// pointer, except that of a parameter which is one
+func (tc *TypeChecker) arrayType(node *ast.Node) *ast.BxType {
+	if t := tc.resolveType(node.Typ); t.Kind == ast.TYPE_ARRAY && t.ArraySize != nil { return t }
+	if node.Type != ast.Ident { return nil }
+	sym := tc.findSymbol(node.Data.(ast.IdentNode).Name, false)
+	if sym == nil || sym.Type == nil || sym.Type.Kind != ast.TYPE_ARRAY || sym.Type.ArraySize == nil { return nil }
+	if sym.Node != nil && sym.Node.Parent != nil && sym.Node.Parent.Type == ast.FuncDecl { return nil }
+	return sym.Type
+}
+
+// toSlice rewrites an array, a string literal or nil given where a slice of type target is expected into a slice
+// of all of it
+func (tc *TypeChecker) toSlice(target *ast.BxType, node *ast.Node) {
+	slice := tc.resolveType(target)
+	if node == nil || slice.Kind != ast.TYPE_SLICE || tc.resolveType(node.Typ).Kind == ast.TYPE_SLICE { return }
+	parent := node.Parent
+	if node.Type == ast.Nil {
+		*node = *ast.NewArrayLiteral(node.Tok, slice.Base, nil)
+	} else {
+		inner := *node
+		*node = *ast.NewSlice(node.Tok, &inner, nil, nil)
+		inner.Parent = node
+	}
+	node.Parent, node.Typ = parent, target
 }
 
 // getNodeName extracts a meaningful string representation from an AST node for error messages
@@ -1230,7 +1431,7 @@ func (tc *TypeChecker) areTypesCompatible(a, b *ast.BxType, bNode *ast.Node) boo
 	}
 
 	if b.Kind == ast.TYPE_LITERAL_INT {
-		return tc.isNumericType(a) || a.Kind == ast.TYPE_POINTER || a.Kind == ast.TYPE_BOOL
+		return tc.isNumericType(a) || a.Kind == ast.TYPE_POINTER || a.Kind == ast.TYPE_BOOL || a.Kind == ast.TYPE_FUNC
 	}
 	if b.Kind == ast.TYPE_LITERAL_FLOAT {
 		return tc.isFloatType(a)
@@ -1249,10 +1450,19 @@ func (tc *TypeChecker) areTypesCompatible(a, b *ast.BxType, bNode *ast.Node) boo
 	}
 
 	if resA.Kind == ast.TYPE_NIL {
-		return resB.Kind == ast.TYPE_POINTER || resB.Kind == ast.TYPE_ARRAY || resB.Kind == ast.TYPE_NIL
+		return resB.Kind == ast.TYPE_POINTER || resB.Kind == ast.TYPE_ARRAY || resB.Kind == ast.TYPE_NIL || resB.Kind == ast.TYPE_FUNC
 	}
 	if resB.Kind == ast.TYPE_NIL {
-		return resA.Kind == ast.TYPE_POINTER || resA.Kind == ast.TYPE_ARRAY
+		return resA.Kind == ast.TYPE_POINTER || resA.Kind == ast.TYPE_ARRAY || resA.Kind == ast.TYPE_FUNC || resA.Kind == ast.TYPE_SLICE
+	}
+	// A slice is made of another of the same elements, of an array of them, or of a string literal if they are bytes
+	if resA.Kind == ast.TYPE_SLICE {
+		switch {
+		case resB.Kind == ast.TYPE_SLICE: return tc.areTypesEqual(resA.Base, resB.Base)
+		case bNode != nil && bNode.Type == ast.String: return tc.areTypesEqual(resA.Base, ast.TypeByte)
+		case bNode != nil && tc.arrayType(bNode) != nil: return tc.areTypesEqual(resA.Base, tc.arrayType(bNode).Base)
+		}
+		return false
 	}
 
 	if resA.Kind == resB.Kind {
@@ -1267,8 +1477,10 @@ func (tc *TypeChecker) areTypesCompatible(a, b *ast.BxType, bNode *ast.Node) boo
 			return tc.areTypesCompatible(resA.Base, resB.Base, nil)
 		case ast.TYPE_ARRAY:
 			return tc.areTypesCompatible(resA.Base, resB.Base, nil)
-		case ast.TYPE_STRUCT:
+		case ast.TYPE_STRUCT, ast.TYPE_UNION:
 			return resA == resB || (resA.Name != "" && resA.Name == resB.Name)
+		case ast.TYPE_FUNC:
+			return tc.areTypesEqual(resA, resB)
 		case ast.TYPE_ENUM:
 			return true
 		default:
@@ -1278,6 +1490,10 @@ func (tc *TypeChecker) areTypesCompatible(a, b *ast.BxType, bNode *ast.Node) boo
 	if bNode != nil && bNode.Type == ast.Number && bNode.Data.(ast.NumberNode).Value == 0 && resA.Kind == ast.TYPE_POINTER && tc.isIntegerType(resB) {
 		return true
 	}
+	// An untyped address, such as that of an external function, converts to a pointer to a function
+	if (resA.Kind == ast.TYPE_FUNC && isOpaquePointer(resB)) || (isOpaquePointer(resA) && resB.Kind == ast.TYPE_FUNC) {
+		return true
+	}
 	if resA.Kind == ast.TYPE_POINTER && resB.Kind == ast.TYPE_ARRAY {
 		return tc.areTypesCompatible(resA.Base, resB.Base, nil)
 	}
@@ -1293,6 +1509,11 @@ func (tc *TypeChecker) areTypesCompatible(a, b *ast.BxType, bNode *ast.Node) boo
 	return false
 }
 
+// isOpaquePointer reports whether t points to void or to something of unknown type
+func isOpaquePointer(t *ast.BxType) bool {
+	return t.Kind == ast.TYPE_POINTER && (t.Base == nil || t.Base.Kind == ast.TYPE_VOID || t.Base.Kind == ast.TYPE_UNTYPED)
+}
+
 func (tc *TypeChecker) areTypesEqual(a, b *ast.BxType) bool {
 	if a == nil || b == nil {
 		return a == b
@@ -1302,10 +1523,18 @@ func (tc *TypeChecker) areTypesEqual(a, b *ast.BxType) bool {
 		return false
 	}
 	switch resA.Kind {
-	case ast.TYPE_POINTER, ast.TYPE_ARRAY:
+	case ast.TYPE_POINTER, ast.TYPE_ARRAY, ast.TYPE_SLICE:
 		return tc.areTypesEqual(resA.Base, resB.Base)
-	case ast.TYPE_STRUCT, ast.TYPE_ENUM, ast.TYPE_PRIMITIVE, ast.TYPE_FLOAT:
+	case ast.TYPE_STRUCT, ast.TYPE_UNION, ast.TYPE_ENUM, ast.TYPE_PRIMITIVE, ast.TYPE_FLOAT:
 		return resA.Name == resB.Name
+	case ast.TYPE_FUNC:
+		if len(resA.Params) != len(resB.Params) || resA.Variadic != resB.Variadic || !tc.areTypesEqual(resA.Base, resB.Base) {
+			return false
+		}
+		for i := range resA.Params {
+			if !tc.areTypesEqual(resA.Params[i], resB.Params[i]) { return false }
+		}
+		return true
 	default:
 		return true
 	}
@@ -1316,7 +1545,7 @@ func (tc *TypeChecker) resolveType(typ *ast.BxType) *ast.BxType {
 	if tc.resolving[typ] { return typ }
 	tc.resolving[typ] = true
 	defer func() { delete(tc.resolving, typ) }()
-	if (typ.Kind == ast.TYPE_PRIMITIVE || typ.Kind == ast.TYPE_STRUCT || typ.Kind == ast.TYPE_ENUM) && typ.Name != "" {
+	if (typ.Kind == ast.TYPE_PRIMITIVE || typ.HasFields() || typ.Kind == ast.TYPE_ENUM) && typ.Name != "" {
 		if sym := tc.findSymbol(typ.Name, true); sym != nil {
 			resolved := tc.resolveType(sym.Type)
 			if typ.IsConst {
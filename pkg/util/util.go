@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -24,8 +25,54 @@ type SourceFileRecord struct { Name string; Content []rune }
 
 var sourceFiles []SourceFileRecord
 
+// diagOut receives diagnostics; catching makes Error unwind to Catch instead of exiting
+var (
+	diagOut  io.Writer = os.Stderr
+	catching bool
+)
+
+// Abort is a fatal error reported while running under Catch
+type Abort struct{ Tok token.Token; Msg string }
+
+func (a *Abort) Error() string { return a.Msg }
+
+// Catch runs f and returns the first error it reports instead of exiting, so that an interactive session survives
+// its mistakes; diagnostics reported meanwhile are written to w
+func Catch(w io.Writer, f func()) (err *Abort) {
+	prevOut, prevCatching := diagOut, catching
+	diagOut, catching = w, true
+	defer func() {
+		diagOut, catching = prevOut, prevCatching
+		if r := recover(); r != nil {
+			abort, ok := r.(*Abort)
+			if !ok { panic(r) }
+			err = abort
+		}
+	}()
+	f()
+	return nil
+}
+
+// fail ends the compilation after an error
+func fail(tok token.Token, msg string) {
+	if catching { panic(&Abort{Tok: tok, Msg: msg}) }
+	os.Exit(1)
+}
+
 func SetSourceFiles(files []SourceFileRecord) { sourceFiles = files }
 
+// AddSourceFile registers one more source file for diagnostics and returns its file index
+func AddSourceFile(file SourceFileRecord) int {
+	sourceFiles = append(sourceFiles, file)
+	return len(sourceFiles) - 1
+}
+
+// SourceFileName returns the path a file index was read from, or "" if unknown
+func SourceFileName(fileIndex int) string {
+	if fileIndex < 0 || fileIndex >= len(sourceFiles) { return "" }
+	return sourceFiles[fileIndex].Name
+}
+
 func findFileAndLine(tok token.Token) (string, int, int) {
 	if tok.FileIndex < 0 || tok.FileIndex >= len(sourceFiles) {
 		return "<unknown>", tok.Line, tok.Column
@@ -39,7 +86,7 @@ func callerFile(skip int) string {
 	return filepath.Base(file)
 }
 
-func printSourceContext(stream *os.File, tok token.Token, isError bool, msg, caller string) {
+func printSourceContext(stream io.Writer, tok token.Token, isError bool, msg, caller string) {
 	if tok.FileIndex < 0 || tok.FileIndex >= len(sourceFiles) || tok.Line <= 0 {
 		return
 	}
@@ -118,16 +165,16 @@ func yellow(s string) string   { return colorYellow + s + colorReset }
 func Error(tok token.Token, format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
 	if tok.FileIndex < 0 || tok.FileIndex >= len(sourceFiles) || tok.Line <= 0 {
-		fmt.Fprintf(os.Stderr, "gbc: %serror:%s %s\n", colorRed, colorReset, msg)
-		os.Exit(1)
+		fmt.Fprintf(diagOut, "gbc: %serror:%s %s\n", colorRed, colorReset, msg)
+		fail(tok, msg)
 	}
 
 	filename, line, col := findFileAndLine(tok)
 	caller := callerFile(2)
 
-	fmt.Fprintf(os.Stderr, "%s:%d:%d: %serror%s:\n", filename, line, col, colorRed, colorReset)
-	printSourceContext(os.Stderr, tok, true, msg, caller)
-	os.Exit(1)
+	fmt.Fprintf(diagOut, "%s:%d:%d: %serror%s:\n", filename, line, col, colorRed, colorReset)
+	printSourceContext(diagOut, tok, true, msg, caller)
+	fail(tok, msg)
 }
 
 func Warn(cfg *config.Config, wt config.Warning, tok token.Token, format string, args ...interface{}) {
@@ -137,15 +184,15 @@ func Warn(cfg *config.Config, wt config.Warning, tok token.Token, format string,
 	msg := fmt.Sprintf(format, args...) + fmt.Sprintf(" [-W%s]", cfg.Warnings[wt].Name)
 
 	if tok.FileIndex < 0 || tok.FileIndex >= len(sourceFiles) || tok.Line <= 0 {
-		fmt.Fprintf(os.Stderr, "gbc: %swarning:%s %s\n", colorYellow, colorReset, msg)
+		fmt.Fprintf(diagOut, "gbc: %swarning:%s %s\n", colorYellow, colorReset, msg)
 		return
 	}
 
 	filename, line, col := findFileAndLine(tok)
 	caller := callerFile(2)
 
-	fmt.Fprintf(os.Stderr, "%s:%d:%d: %swarning%s:\n", filename, line, col, colorYellow, colorReset)
-	printSourceContext(os.Stderr, tok, false, msg, caller)
+	fmt.Fprintf(diagOut, "%s:%d:%d: %swarning%s:\n", filename, line, col, colorYellow, colorReset)
+	printSourceContext(diagOut, tok, false, msg, caller)
 }
 
 // AlignUp rounds n up to the next multiple of a
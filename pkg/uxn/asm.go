@@ -0,0 +1,207 @@
+package uxn
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ResetVector is where a ROM is loaded and started
+const ResetVector = 0x0100
+
+// ROM is an assembled program: Bytes loaded from ResetVector, and the address of every label
+type ROM struct {
+	Bytes   []byte
+	Symbols map[string]uint16
+}
+
+// token is one word of the source, with the scope its sublabels resolve in
+type token struct {
+	line  int
+	text  string
+	scope string
+}
+
+type assembler struct {
+	tokens  []token
+	symbols map[string]int
+	mem     []byte
+	end     int // one past the last byte written
+}
+
+// Assemble assembles src, written in the part of Uxntal without macros, lambdas or includes: opcodes with their
+// 2, k and r modes, raw hex bytes and shorts, "strings, the padding runes | and $, the labels @name and &sub,
+// and the references #, . , ; = - _ ! ? and a bare label, which calls it
+func Assemble(src string) (*ROM, error) {
+	a := &assembler{symbols: make(map[string]int), mem: make([]byte, 0x10000)}
+	if err := a.tokenize(src); err != nil { return nil, err }
+	// The size of every token is known before the labels it refers to, so a first pass finds the labels
+	for pass := 0; pass < 2; pass++ {
+		a.end = ResetVector
+		pc := 0
+		for _, t := range a.tokens {
+			at := pc
+			n, err := a.token(t, &pc, pass == 1)
+			if err != nil { return nil, err }
+			if n > 0 && at < ResetVector { return nil, fmt.Errorf("line %d: writing to the zero page with '%s'", t.line, t.text) }
+			if pc > 0x10000 { return nil, fmt.Errorf("line %d: program is larger than 64 KiB", t.line) }
+			if n > 0 { a.end = max(a.end, pc) }
+		}
+	}
+	symbols := make(map[string]uint16, len(a.symbols))
+	for name, addr := range a.symbols {
+		symbols[name] = uint16(addr)
+	}
+	return &ROM{Bytes: a.mem[ResetVector:a.end], Symbols: symbols}, nil
+}
+
+func (a *assembler) tokenize(src string) error {
+	scope, depth := "", 0
+	for i, text := range strings.Split(src, "\n") {
+		for _, word := range strings.Fields(text) {
+			switch {
+			case word == "(": depth++
+			case word == ")":
+				if depth == 0 { return fmt.Errorf("line %d: ')' outside a comment", i+1) }
+				depth--
+			case depth > 0 || word == "[" || word == "]":
+			default:
+				if word[0] == '@' { scope = word[1:] }
+				a.tokens = append(a.tokens, token{line: i + 1, text: word, scope: scope})
+			}
+		}
+	}
+	if depth > 0 { return fmt.Errorf("unterminated comment") }
+	return nil
+}
+
+// label resolves a reference: &name and /name are sublabels of the scope of t
+func (a *assembler) label(t token, name string) string {
+	if strings.HasPrefix(name, "&") || strings.HasPrefix(name, "/") { return t.scope + "/" + name[1:] }
+	return name
+}
+
+// token assembles t at *pc, writing its bytes only when emit is set, and returns how many bytes it wrote
+func (a *assembler) token(t token, pc *int, emit bool) (int, error) {
+	text := t.text
+	sigil, rest := text[0], text[1:]
+	put := func(bytes ...byte) int {
+		if emit {
+			for i, v := range bytes {
+				if *pc+i < len(a.mem) { a.mem[*pc+i] = v }
+			}
+		}
+		*pc += len(bytes)
+		return len(bytes)
+	}
+	// ref resolves a label, which on the first pass need not be defined yet
+	ref := func(name string) (int, error) {
+		addr, ok := a.symbols[a.label(t, name)]
+		if !ok && emit { return 0, fmt.Errorf("line %d: undefined label '%s'", t.line, name) }
+		return addr, nil
+	}
+	// rel is the offset from the end of a reference of size bytes at pc, plus the opcode before it
+	rel := func(name string, size int) (int, error) {
+		addr, err := ref(name)
+		return addr - (*pc + 1 + size), err
+	}
+
+	switch sigil {
+	case '|', '$':
+		n, err := strconv.ParseUint(rest, 16, 32)
+		if err != nil { return 0, fmt.Errorf("line %d: bad padding '%s'", t.line, text) }
+		if sigil == '|' {
+			*pc = int(n)
+		} else {
+			*pc += int(n)
+		}
+		return 0, nil
+	case '@', '&':
+		name := rest
+		if sigil == '&' { name = t.scope + "/" + rest }
+		if _, defined := a.symbols[name]; defined && !emit { return 0, fmt.Errorf("line %d: label '%s' is defined twice", t.line, name) }
+		a.symbols[name] = *pc
+		return 0, nil
+	case '#':
+		v, err := strconv.ParseUint(rest, 16, 16)
+		if err != nil || len(rest) != 2 && len(rest) != 4 { return 0, fmt.Errorf("line %d: bad literal '%s'", t.line, text) }
+		if len(rest) == 2 { return put(0x80, byte(v)), nil }
+		return put(0xA0, byte(v>>8), byte(v)), nil
+	case '.', '-':
+		addr, err := ref(rest)
+		if err != nil { return 0, err }
+		if addr > 0xFF && emit { return 0, fmt.Errorf("line %d: '%s' is not in the zero page", t.line, rest) }
+		if sigil == '-' { return put(byte(addr)), nil }
+		return put(0x80, byte(addr)), nil
+	case ',', '_':
+		size := 1
+		if sigil == ',' { size = 2 }
+		off, err := rel(rest, size)
+		if err != nil { return 0, err }
+		if (off < -128 || off > 127) && emit { return 0, fmt.Errorf("line %d: '%s' is too far for a relative reference", t.line, rest) }
+		if sigil == '_' { return put(byte(off)), nil }
+		return put(0x80, byte(off)), nil
+	case ';', '=':
+		addr, err := ref(rest)
+		if err != nil { return 0, err }
+		if sigil == '=' { return put(byte(addr>>8), byte(addr)), nil }
+		return put(0xA0, byte(addr>>8), byte(addr)), nil
+	case '!', '?':
+		off, err := rel(rest, 2)
+		if err != nil { return 0, err }
+		op := byte(0x40)
+		if sigil == '?' { op = 0x20 }
+		return put(op, byte(off>>8), byte(off)), nil
+	case '"': return put([]byte(rest)...), nil
+	case '%', '~', '{', '}': return 0, fmt.Errorf("line %d: '%s' is not supported", t.line, text)
+	}
+
+	if op, ok := opcode(text); ok { return put(op), nil }
+	if isHex(text) {
+		v, _ := strconv.ParseUint(text, 16, 16)
+		if len(text) == 2 { return put(byte(v)), nil }
+		return put(byte(v>>8), byte(v)), nil
+	}
+	// A bare label is a call to it
+	off, err := rel(text, 2)
+	if err != nil { return 0, err }
+	return put(0x60, byte(off>>8), byte(off)), nil
+}
+
+func isHex(s string) bool {
+	if len(s) != 2 && len(s) != 4 { return false }
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) { return false }
+	}
+	return true
+}
+
+// opcode parses a mnemonic with its modes, such as LDZ2 or JMP2r
+func opcode(s string) (byte, bool) {
+	if len(s) < 3 { return 0, false }
+	var op byte
+	found := false
+	for i, name := range opNames {
+		if name == s[:3] {
+			op, found = byte(i), true
+			break
+		}
+	}
+	switch s[:3] {
+	case "BRK": return 0x00, len(s) == 3
+	case "LIT":
+		op, found = 0x80, true
+	}
+	if !found { return 0, false }
+	for _, m := range s[3:] {
+		switch m {
+		case '2': op |= ModeShort
+		case 'r': op |= ModeReturn
+		case 'k':
+			if s[:3] == "LIT" { return 0, false }
+			op |= ModeKeep
+		default: return 0, false
+		}
+	}
+	return op, true
+}
@@ -0,0 +1,251 @@
+// Package uxn implements the Uxn virtual machine: an assembler for the subset of Uxntal the uxn backend of gbc
+// emits, and a CPU with the console of the Varvara computer to run the ROMs it makes without a Uxn emulator
+package uxn
+
+// Opcode names, by the low five bits of an instruction; BRK and the literals and immediate jumps share 0x00
+var opNames = [32]string{
+	"BRK", "INC", "POP", "NIP", "SWP", "ROT", "DUP", "OVR", "EQU", "NEQ", "GTH", "LTH", "JMP", "JCN", "JSR", "STH",
+	"LDZ", "STZ", "LDR", "STR", "LDA", "STA", "DEI", "DEO", "ADD", "SUB", "MUL", "DIV", "AND", "ORA", "EOR", "SFT",
+}
+
+// Mode bits of an instruction
+const (
+	ModeShort  byte = 0x20
+	ModeReturn byte = 0x40
+	ModeKeep   byte = 0x80
+)
+
+// Stack is one of the two 256 byte stacks of the CPU; its pointer wraps around instead of overflowing
+type Stack struct {
+	Dat [0x100]byte
+	Ptr byte
+}
+
+func (s *Stack) push(v uint16, short bool) {
+	if short {
+		s.Dat[s.Ptr] = byte(v >> 8)
+		s.Ptr++
+	}
+	s.Dat[s.Ptr] = byte(v)
+	s.Ptr++
+}
+
+// pop reads the value below *p, the working pointer of an instruction that may keep its operands
+func (s *Stack) pop(p *byte, short bool) uint16 {
+	*p--
+	v := uint16(s.Dat[*p])
+	if short {
+		*p--
+		v |= uint16(s.Dat[*p]) << 8
+	}
+	return v
+}
+
+// CPU is a Uxn with 64 KiB of memory and 256 device ports
+// DEO, if set, is called after every byte written to a port, with the byte already in Dev
+type CPU struct {
+	Mem      [0x10000]byte
+	Dev      [0x100]byte
+	WST, RST Stack
+	DEO      func(port byte)
+	Steps    uint64 // instructions executed
+	Halted   bool   // set by DEO to stop the CPU at once
+}
+
+func (c *CPU) peek(addr uint16, short bool) uint16 {
+	if short { return uint16(c.Mem[addr])<<8 | uint16(c.Mem[addr+1]) }
+	return uint16(c.Mem[addr])
+}
+
+func (c *CPU) poke(addr, v uint16, short bool) {
+	if short {
+		c.Mem[addr] = byte(v >> 8)
+		c.Mem[addr+1] = byte(v)
+		return
+	}
+	c.Mem[addr] = byte(v)
+}
+
+func (c *CPU) dei(port byte, short bool) uint16 {
+	if short { return uint16(c.Dev[port])<<8 | uint16(c.Dev[port+1]) }
+	return uint16(c.Dev[port])
+}
+
+func (c *CPU) deo(port byte, v uint16, short bool) {
+	if short {
+		c.Dev[port] = byte(v >> 8)
+		if c.DEO != nil { c.DEO(port) }
+		port++
+	}
+	c.Dev[port] = byte(v)
+	if c.DEO != nil { c.DEO(port) }
+}
+
+// Eval runs the vector at pc until it reaches BRK, or until a device halts the CPU
+func (c *CPU) Eval(pc uint16) {
+	for !c.Halted {
+		op := c.Mem[pc]
+		pc++
+		c.Steps++
+
+		switch op {
+		case 0x00: return
+		case 0x20, 0x40, 0x60: // JCI, JMI, JSI
+			off := c.peek(pc, true)
+			pc += 2
+			switch op {
+			case 0x20:
+				if c.WST.pop(&c.WST.Ptr, false) == 0 { continue }
+			case 0x60: c.RST.push(pc, true)
+			}
+			pc += off
+			continue
+		case 0x80, 0xA0, 0xC0, 0xE0: // LIT, LIT2, LITr, LIT2r
+			short := op&ModeShort != 0
+			s := &c.WST
+			if op&ModeReturn != 0 { s = &c.RST }
+			s.push(c.peek(pc, short), short)
+			pc++
+			if short { pc++ }
+			continue
+		}
+
+		short := op&ModeShort != 0
+		src, dst := &c.WST, &c.RST
+		if op&ModeReturn != 0 { src, dst = dst, src }
+		p := src.Ptr
+		commit := func() {
+			if op&ModeKeep == 0 { src.Ptr = p }
+		}
+
+		switch op & 0x1F {
+		case 0x01: // INC
+			a := src.pop(&p, short)
+			commit()
+			src.push(a+1, short)
+		case 0x02: // POP
+			src.pop(&p, short)
+			commit()
+		case 0x03: // NIP
+			b := src.pop(&p, short)
+			src.pop(&p, short)
+			commit()
+			src.push(b, short)
+		case 0x04: // SWP
+			b := src.pop(&p, short)
+			a := src.pop(&p, short)
+			commit()
+			src.push(b, short)
+			src.push(a, short)
+		case 0x05: // ROT
+			cc := src.pop(&p, short)
+			b := src.pop(&p, short)
+			a := src.pop(&p, short)
+			commit()
+			src.push(b, short)
+			src.push(cc, short)
+			src.push(a, short)
+		case 0x06: // DUP
+			a := src.pop(&p, short)
+			commit()
+			src.push(a, short)
+			src.push(a, short)
+		case 0x07: // OVR
+			b := src.pop(&p, short)
+			a := src.pop(&p, short)
+			commit()
+			src.push(a, short)
+			src.push(b, short)
+			src.push(a, short)
+		case 0x08, 0x09, 0x0A, 0x0B: // EQU, NEQ, GTH, LTH
+			b := src.pop(&p, short)
+			a := src.pop(&p, short)
+			commit()
+			var r bool
+			switch op & 0x1F {
+			case 0x08: r = a == b
+			case 0x09: r = a != b
+			case 0x0A: r = a > b
+			case 0x0B: r = a < b
+			}
+			if r { src.push(1, false) } else { src.push(0, false) }
+		case 0x0C, 0x0E: // JMP, JSR
+			a := src.pop(&p, short)
+			commit()
+			if op&0x1F == 0x0E { dst.push(pc, true) }
+			pc = jump(pc, a, short)
+		case 0x0D: // JCN
+			a := src.pop(&p, short)
+			cond := src.pop(&p, false)
+			commit()
+			if cond != 0 { pc = jump(pc, a, short) }
+		case 0x0F: // STH
+			a := src.pop(&p, short)
+			commit()
+			dst.push(a, short)
+		case 0x10: // LDZ
+			addr := src.pop(&p, false)
+			commit()
+			src.push(c.peek(addr, short), short)
+		case 0x11: // STZ
+			addr := src.pop(&p, false)
+			v := src.pop(&p, short)
+			commit()
+			c.poke(addr, v, short)
+		case 0x12: // LDR
+			addr := src.pop(&p, false)
+			commit()
+			src.push(c.peek(pc+uint16(int8(addr)), short), short)
+		case 0x13: // STR
+			addr := src.pop(&p, false)
+			v := src.pop(&p, short)
+			commit()
+			c.poke(pc+uint16(int8(addr)), v, short)
+		case 0x14: // LDA
+			addr := src.pop(&p, true)
+			commit()
+			src.push(c.peek(addr, short), short)
+		case 0x15: // STA
+			addr := src.pop(&p, true)
+			v := src.pop(&p, short)
+			commit()
+			c.poke(addr, v, short)
+		case 0x16: // DEI
+			port := src.pop(&p, false)
+			commit()
+			src.push(c.dei(byte(port), short), short)
+		case 0x17: // DEO
+			port := src.pop(&p, false)
+			v := src.pop(&p, short)
+			commit()
+			c.deo(byte(port), v, short)
+		case 0x1F: // SFT
+			sh := src.pop(&p, false)
+			a := src.pop(&p, short)
+			commit()
+			src.push(a>>(sh&0x0F)<<(sh>>4), short)
+		default: // ADD, SUB, MUL, DIV, AND, ORA, EOR
+			b := src.pop(&p, short)
+			a := src.pop(&p, short)
+			commit()
+			var r uint16
+			switch op & 0x1F {
+			case 0x18: r = a + b
+			case 0x19: r = a - b
+			case 0x1A: r = a * b
+			case 0x1B:
+				if b != 0 { r = a / b }
+			case 0x1C: r = a & b
+			case 0x1D: r = a | b
+			case 0x1E: r = a ^ b
+			}
+			src.push(r, short)
+		}
+	}
+}
+
+// jump is where JMP, JCN and JSR go: to an absolute address, or relative to pc by a signed byte
+func jump(pc, a uint16, short bool) uint16 {
+	if short { return a }
+	return pc + uint16(int8(a))
+}
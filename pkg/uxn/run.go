@@ -0,0 +1,79 @@
+package uxn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Ports of the System and Console devices of Varvara
+const (
+	PortState         = 0x0F // a non-zero byte written here ends the program, with the status in its low 7 bits
+	PortConsoleVector = 0x10
+	PortConsoleRead   = 0x12
+	PortConsoleType   = 0x17
+	PortConsoleWrite  = 0x18
+	PortConsoleError  = 0x19
+)
+
+// Console types, telling a console vector what the byte in PortConsoleRead is
+const (
+	ConsoleNone = iota
+	ConsoleStdin
+	ConsoleArgument
+	ConsoleArgumentSpacer
+	ConsoleArgumentEnd
+)
+
+// Run loads rom at ResetVector and runs it the way uxncli does: the reset vector first, then the console vector
+// with each byte of args, and then of stdin, until the program writes PortState or has no console vector left
+// The status is that written to PortState, or 0 if the program ends without writing it
+func Run(rom []byte, args []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if len(rom) > 0x10000-ResetVector { return 0, fmt.Errorf("uxn: ROM of %d bytes does not fit from $%04X", len(rom), ResetVector) }
+	cpu := &CPU{}
+	copy(cpu.Mem[ResetVector:], rom)
+
+	out, errOut := bufio.NewWriter(stdout), bufio.NewWriter(stderr)
+	defer out.Flush()
+	defer errOut.Flush()
+	cpu.DEO = func(port byte) {
+		switch port {
+		case PortState: cpu.Halted = cpu.Dev[PortState] != 0
+		case PortConsoleWrite: out.WriteByte(cpu.Dev[port])
+		case PortConsoleError:
+			out.Flush()
+			errOut.WriteByte(cpu.Dev[port])
+			errOut.Flush()
+		}
+	}
+	input := func(c byte, typ byte) {
+		vector := uint16(cpu.Dev[PortConsoleVector])<<8 | uint16(cpu.Dev[PortConsoleVector+1])
+		if vector == 0 || cpu.Halted { return }
+		cpu.Dev[PortConsoleRead], cpu.Dev[PortConsoleType] = c, typ
+		cpu.Eval(vector)
+	}
+
+	if len(args) > 0 { cpu.Dev[PortConsoleType] = ConsoleStdin }
+	cpu.Eval(ResetVector)
+	for i, arg := range args {
+		for _, c := range []byte(arg) {
+			input(c, ConsoleArgument)
+		}
+		if i+1 < len(args) {
+			input('\n', ConsoleArgumentSpacer)
+		} else {
+			input('\n', ConsoleArgumentEnd)
+		}
+	}
+
+	in := bufio.NewReader(stdin)
+	for !cpu.Halted && cpu.Dev[PortConsoleVector]|cpu.Dev[PortConsoleVector+1] != 0 {
+		c, err := in.ReadByte()
+		if err != nil {
+			input(0, ConsoleArgumentEnd)
+			break
+		}
+		input(c, ConsoleStdin)
+	}
+	return int(cpu.Dev[PortState] & 0x7F), nil
+}
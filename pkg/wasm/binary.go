@@ -0,0 +1,424 @@
+package wasm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var magic = []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+
+// IsModule reports whether b starts like a binary module
+func IsModule(b []byte) bool { return bytes.HasPrefix(b, magic[:4]) }
+
+const (
+	secType     = 1
+	secImport   = 2
+	secFunction = 3
+	secTable    = 4
+	secMemory   = 5
+	secGlobal   = 6
+	secExport   = 7
+	secElem     = 9
+	secCode     = 10
+	secData     = 11
+)
+
+type encoder struct{ bytes.Buffer }
+
+func (e *encoder) u32(v uint32) {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			e.WriteByte(b)
+			return
+		}
+		e.WriteByte(b | 0x80)
+	}
+}
+
+func (e *encoder) s64(v int64) {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 && b&0x40 == 0 || v == -1 && b&0x40 != 0 {
+			e.WriteByte(b)
+			return
+		}
+		e.WriteByte(b | 0x80)
+	}
+}
+
+func (e *encoder) name(s string) {
+	e.u32(uint32(len(s)))
+	e.WriteString(s)
+}
+
+func (e *encoder) section(id byte, body *encoder) {
+	e.WriteByte(id)
+	e.u32(uint32(body.Len()))
+	e.Write(body.Bytes())
+}
+
+func (e *encoder) instr(in Instr) {
+	if in.Op > 0xff {
+		e.WriteByte(0xfc)
+		e.u32(uint32(in.Op & 0xff))
+	} else {
+		e.WriteByte(byte(in.Op))
+	}
+	switch in.Op {
+	case OpBlock, OpLoop, OpIf: e.WriteByte(byte(in.Imm))
+	case OpBr, OpBrIf, OpCall, OpLocalGet, OpLocalSet, OpLocalTee, OpGlobalGet, OpGlobalSet: e.u32(uint32(in.Imm))
+	case OpBrTable:
+		e.u32(uint32(len(in.Labels)))
+		for _, l := range in.Labels {
+			e.u32(l)
+		}
+		e.u32(uint32(in.Imm))
+	case OpCallIndirect:
+		e.u32(uint32(in.Imm))
+		e.WriteByte(0)
+	case OpMemorySize, OpMemoryGrow, OpMemoryFill: e.WriteByte(0)
+	case OpMemoryCopy: e.Write([]byte{0, 0})
+	case OpI32Const: e.s64(int64(int32(in.Imm)))
+	case OpI64Const: e.s64(int64(in.Imm))
+	case OpF32Const: e.Write([]byte{byte(in.Imm), byte(in.Imm >> 8), byte(in.Imm >> 16), byte(in.Imm >> 24)})
+	case OpF64Const:
+		for i := 0; i < 8; i++ {
+			e.WriteByte(byte(in.Imm >> (8 * i)))
+		}
+	default:
+		if size := in.Op.memAccessSize(); size > 0 {
+			align := uint32(0)
+			for 1<<align < size { align++ }
+			e.u32(align)
+			e.u32(uint32(in.Imm))
+		}
+	}
+}
+
+// Encode writes m in the binary format
+func (m *Module) Encode() []byte {
+	var out encoder
+	out.Write(magic)
+
+	var sec encoder
+	sec.u32(uint32(len(m.Types)))
+	for _, t := range m.Types {
+		sec.WriteByte(0x60)
+		sec.u32(uint32(len(t.Params)))
+		for _, p := range t.Params {
+			sec.WriteByte(byte(p))
+		}
+		sec.u32(uint32(len(t.Results)))
+		for _, r := range t.Results {
+			sec.WriteByte(byte(r))
+		}
+	}
+	out.section(secType, &sec)
+
+	if len(m.Imports) > 0 {
+		sec = encoder{}
+		sec.u32(uint32(len(m.Imports)))
+		for _, imp := range m.Imports {
+			sec.name(imp.Module)
+			sec.name(imp.Name)
+			sec.WriteByte(0)
+			sec.u32(imp.Type)
+		}
+		out.section(secImport, &sec)
+	}
+
+	sec = encoder{}
+	sec.u32(uint32(len(m.Funcs)))
+	for _, f := range m.Funcs {
+		sec.u32(f.Type)
+	}
+	out.section(secFunction, &sec)
+
+	if len(m.Table) > 0 {
+		sec = encoder{}
+		sec.Write([]byte{1, 0x70, 0})
+		sec.u32(uint32(len(m.Table) + 1))
+		out.section(secTable, &sec)
+	}
+
+	sec = encoder{}
+	sec.Write([]byte{1, 0})
+	sec.u32(m.Memory)
+	out.section(secMemory, &sec)
+
+	if len(m.Globals) > 0 {
+		sec = encoder{}
+		sec.u32(uint32(len(m.Globals)))
+		for _, g := range m.Globals {
+			sec.WriteByte(byte(g.Type))
+			if g.Mutable { sec.WriteByte(1) } else { sec.WriteByte(0) }
+			sec.instr(Instr{Op: constOp(g.Type), Imm: g.Init})
+			sec.WriteByte(byte(OpEnd))
+		}
+		out.section(secGlobal, &sec)
+	}
+
+	sec = encoder{}
+	sec.u32(uint32(len(m.Exports)))
+	for _, e := range m.Exports {
+		sec.name(e.Name)
+		sec.WriteByte(e.Kind)
+		sec.u32(e.Index)
+	}
+	out.section(secExport, &sec)
+
+	if len(m.Table) > 0 {
+		sec = encoder{}
+		sec.Write([]byte{1, 0})
+		sec.instr(Instr{Op: OpI32Const, Imm: 1})
+		sec.WriteByte(byte(OpEnd))
+		sec.u32(uint32(len(m.Table)))
+		for _, idx := range m.Table {
+			sec.u32(idx)
+		}
+		out.section(secElem, &sec)
+	}
+
+	sec = encoder{}
+	sec.u32(uint32(len(m.Funcs)))
+	for _, f := range m.Funcs {
+		var body encoder
+		// Runs of locals of the same type are declared together
+		var runs [][2]uint32
+		for _, t := range f.Locals {
+			if n := len(runs); n > 0 && runs[n-1][1] == uint32(t) {
+				runs[n-1][0]++
+			} else {
+				runs = append(runs, [2]uint32{1, uint32(t)})
+			}
+		}
+		body.u32(uint32(len(runs)))
+		for _, r := range runs {
+			body.u32(r[0])
+			body.WriteByte(byte(r[1]))
+		}
+		for _, in := range f.Body {
+			body.instr(in)
+		}
+		sec.u32(uint32(body.Len()))
+		sec.Write(body.Bytes())
+	}
+	out.section(secCode, &sec)
+
+	if len(m.Data) > 0 {
+		sec = encoder{}
+		sec.u32(uint32(len(m.Data)))
+		for _, d := range m.Data {
+			sec.WriteByte(0)
+			sec.instr(Instr{Op: OpI32Const, Imm: uint64(d.Offset)})
+			sec.WriteByte(byte(OpEnd))
+			sec.u32(uint32(len(d.Bytes)))
+			sec.Write(d.Bytes)
+		}
+		out.section(secData, &sec)
+	}
+
+	return out.Bytes()
+}
+
+type decoder struct {
+	b   []byte
+	pos int
+}
+
+var errTruncated = errors.New("unexpected end of module")
+
+func (d *decoder) byte() byte {
+	if d.pos >= len(d.b) { panic(errTruncated) }
+	d.pos++
+	return d.b[d.pos-1]
+}
+
+func (d *decoder) u32() uint32 {
+	var v uint32
+	for shift := 0; ; shift += 7 {
+		b := d.byte()
+		v |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 { return v }
+		if shift > 28 { panic(errors.New("integer too long")) }
+	}
+}
+
+func (d *decoder) s64() int64 {
+	var v int64
+	shift := 0
+	for {
+		b := d.byte()
+		v |= int64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 { v |= -1 << shift }
+			return v
+		}
+		if shift > 63 { panic(errors.New("integer too long")) }
+	}
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.pos+n > len(d.b) { panic(errTruncated) }
+	d.pos += n
+	return d.b[d.pos-n : d.pos]
+}
+
+func (d *decoder) name() string { return string(d.bytes(int(d.u32()))) }
+
+func (d *decoder) instr() Instr {
+	in := Instr{Op: Opcode(d.byte())}
+	if in.Op == 0xfc { in.Op = 0xfc00 | Opcode(d.u32()) }
+	if _, ok := opNames[in.Op]; !ok { panic(fmt.Errorf("unsupported instruction 0x%x", uint16(in.Op))) }
+	switch in.Op {
+	case OpBlock, OpLoop, OpIf: in.Imm = uint64(d.byte())
+	case OpBr, OpBrIf, OpCall, OpLocalGet, OpLocalSet, OpLocalTee, OpGlobalGet, OpGlobalSet: in.Imm = uint64(d.u32())
+	case OpBrTable:
+		in.Labels = make([]uint32, d.u32())
+		for i := range in.Labels {
+			in.Labels[i] = d.u32()
+		}
+		in.Imm = uint64(d.u32())
+	case OpCallIndirect:
+		in.Imm = uint64(d.u32())
+		d.byte()
+	case OpMemorySize, OpMemoryGrow, OpMemoryFill: d.byte()
+	case OpMemoryCopy: d.bytes(2)
+	case OpI32Const: in.Imm = uint64(uint32(d.s64()))
+	case OpI64Const: in.Imm = uint64(d.s64())
+	case OpF32Const:
+		b := d.bytes(4)
+		in.Imm = uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24
+	case OpF64Const:
+		for i, b := range d.bytes(8) {
+			in.Imm |= uint64(b) << (8 * i)
+		}
+	default:
+		if in.Op.memAccessSize() > 0 {
+			d.u32()
+			in.Imm = uint64(d.u32())
+		}
+	}
+	return in
+}
+
+// constExpr reads an initializer made of a single constant
+func (d *decoder) constExpr() uint64 {
+	in := d.instr()
+	if in.Op != OpI32Const && in.Op != OpI64Const && in.Op != OpF32Const && in.Op != OpF64Const {
+		panic(fmt.Errorf("unsupported initializer %s", in.Op))
+	}
+	if d.byte() != byte(OpEnd) { panic(errors.New("initializer is not a single constant")) }
+	return in.Imm
+}
+
+// Decode reads a binary module, as long as it sticks to what Module can represent
+func Decode(b []byte) (m *Module, err error) {
+	if !bytes.HasPrefix(b, magic) { return nil, errors.New("not a WebAssembly module") }
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(error)
+			if !ok { panic(r) }
+			err = fmt.Errorf("malformed module: %w", e)
+		}
+	}()
+
+	m = &Module{}
+	d := &decoder{b: b, pos: len(magic)}
+	var funcTypes []uint32
+	for d.pos < len(d.b) {
+		id := d.byte()
+		size := int(d.u32())
+		end := d.pos + size
+		if end > len(d.b) { panic(errTruncated) }
+		switch id {
+		case secType:
+			for n := d.u32(); n > 0; n-- {
+				if d.byte() != 0x60 { panic(errors.New("bad function type")) }
+				var ft FuncType
+				for k := d.u32(); k > 0; k-- {
+					ft.Params = append(ft.Params, ValType(d.byte()))
+				}
+				for k := d.u32(); k > 0; k-- {
+					ft.Results = append(ft.Results, ValType(d.byte()))
+				}
+				m.Types = append(m.Types, ft)
+			}
+		case secImport:
+			for n := d.u32(); n > 0; n-- {
+				imp := Import{Module: d.name(), Name: d.name()}
+				if d.byte() != 0 { panic(fmt.Errorf("import %s.%s is not a function", imp.Module, imp.Name)) }
+				imp.Type = d.u32()
+				m.Imports = append(m.Imports, imp)
+			}
+		case secFunction:
+			for n := d.u32(); n > 0; n-- {
+				funcTypes = append(funcTypes, d.u32())
+			}
+		case secTable:
+			if d.u32() != 1 || d.byte() != 0x70 { panic(errors.New("unsupported table")) }
+			if d.byte()&1 != 0 { d.u32() }
+			d.u32()
+		case secMemory:
+			if d.u32() != 1 { panic(errors.New("unsupported number of memories")) }
+			if d.byte()&1 != 0 {
+				m.Memory = d.u32()
+				d.u32()
+			} else {
+				m.Memory = d.u32()
+			}
+		case secGlobal:
+			for n := d.u32(); n > 0; n-- {
+				g := Global{Type: ValType(d.byte()), Mutable: d.byte() == 1}
+				g.Init = d.constExpr()
+				m.Globals = append(m.Globals, g)
+			}
+		case secExport:
+			for n := d.u32(); n > 0; n-- {
+				m.Exports = append(m.Exports, Export{Name: d.name(), Kind: d.byte(), Index: d.u32()})
+			}
+		case secElem:
+			for n := d.u32(); n > 0; n-- {
+				if d.u32() != 0 { panic(errors.New("unsupported element segment")) }
+				if d.constExpr() != 1 { panic(errors.New("element segment does not start at 1")) }
+				for k := d.u32(); k > 0; k-- {
+					m.Table = append(m.Table, d.u32())
+				}
+			}
+		case secCode:
+			if int(d.u32()) != len(funcTypes) { panic(errors.New("function and code sections disagree")) }
+			for _, t := range funcTypes {
+				bodyEnd := int(d.u32())
+				bodyEnd += d.pos
+				f := &Func{Type: t}
+				for k := d.u32(); k > 0; k-- {
+					count, typ := d.u32(), ValType(d.byte())
+					for ; count > 0; count-- {
+						f.Locals = append(f.Locals, typ)
+					}
+				}
+				for d.pos < bodyEnd {
+					f.Body = append(f.Body, d.instr())
+				}
+				m.Funcs = append(m.Funcs, f)
+			}
+		case secData:
+			for n := d.u32(); n > 0; n-- {
+				if d.u32() != 0 { panic(errors.New("unsupported data segment")) }
+				offset := uint32(d.constExpr())
+				m.Data = append(m.Data, Data{Offset: offset, Bytes: d.bytes(int(d.u32()))})
+			}
+		}
+		// Custom sections and anything not read above are skipped
+		d.pos = end
+	}
+	for _, t := range funcTypes {
+		if int(t) >= len(m.Types) { return nil, errors.New("malformed module: function type out of range") }
+	}
+	return m, nil
+}
@@ -0,0 +1,489 @@
+package wasm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Trap is a runtime error of the running module
+type Trap struct{ Msg string }
+
+func (t *Trap) Error() string { return "wasm trap: " + t.Msg }
+
+func trap(format string, args ...any) { panic(&Trap{Msg: fmt.Sprintf(format, args...)}) }
+
+// exitStatus unwinds the module when it calls proc_exit
+type exitStatus struct{ code int }
+
+// maxCallDepth bounds recursion the way a native stack would
+const maxCallDepth = 1 << 16
+
+// Runtime is an instantiated module
+type Runtime struct {
+	mod     *Module
+	mem     []byte
+	globals []uint64
+	code    []*compiledFunc
+	hosts   []*hostFunc
+	stack   []uint64
+	depth   int
+
+	args   []string
+	stdin  *bufio.Reader
+	stdout *bufio.Writer
+	stderr io.Writer
+}
+
+type compiledFunc struct {
+	*Func
+	typ  FuncType
+	ends []int // index of the end of each block, loop and if, and of the if of each else
+	elses []int // index of the else of each if, or -1
+}
+
+type hostFunc struct {
+	typ FuncType
+	fn  func(rt *Runtime, args []uint64) uint64
+}
+
+type label struct {
+	pc     int // where a branch to the label goes
+	height int
+	arity  int
+	loop   bool
+}
+
+// Run decodes and instantiates a module, then calls its _start export with args as the command line of the
+// program, returning the status it exits with; traps and modules that cannot run are returned as errors
+func Run(module []byte, args []string, stdin io.Reader, stdout, stderr io.Writer) (code int, err error) {
+	m, err := Decode(module)
+	if err != nil { return 0, err }
+	rt, err := Instantiate(m, args, stdin, stdout, stderr)
+	if err != nil { return 0, err }
+	return rt.Start()
+}
+
+// Instantiate links the imports of m against WASI and initializes its memory, globals and table
+func Instantiate(m *Module, args []string, stdin io.Reader, stdout, stderr io.Writer) (*Runtime, error) {
+	rt := &Runtime{
+		mod: m, mem: make([]byte, int(m.Memory)*PageSize), args: args,
+		stdin: bufio.NewReader(stdin), stdout: bufio.NewWriter(stdout), stderr: stderr,
+	}
+	for _, imp := range m.Imports {
+		host, ok := wasiFuncs[imp.Name]
+		if imp.Module != "wasi_snapshot_preview1" || !ok { return nil, fmt.Errorf("unresolved import %s.%s", imp.Module, imp.Name) }
+		if !host.typ.equal(m.Types[imp.Type]) { return nil, fmt.Errorf("import %s.%s has the wrong type", imp.Module, imp.Name) }
+		rt.hosts = append(rt.hosts, host)
+	}
+	for _, g := range m.Globals {
+		rt.globals = append(rt.globals, g.Init)
+	}
+	for _, d := range m.Data {
+		if int(d.Offset)+len(d.Bytes) > len(rt.mem) { return nil, errors.New("data segment does not fit in memory") }
+		copy(rt.mem[d.Offset:], d.Bytes)
+	}
+	for _, idx := range m.Table {
+		if int(idx) >= len(m.Imports)+len(m.Funcs) { return nil, errors.New("table entry out of range") }
+	}
+	for _, f := range m.Funcs {
+		cf, err := compile(f, m.Types[f.Type])
+		if err != nil { return nil, err }
+		rt.code = append(rt.code, cf)
+	}
+	return rt, nil
+}
+
+// compile matches the blocks of f with their ends
+func compile(f *Func, typ FuncType) (*compiledFunc, error) {
+	cf := &compiledFunc{Func: f, typ: typ, ends: make([]int, len(f.Body)), elses: make([]int, len(f.Body))}
+	var open []int
+	for i, in := range f.Body {
+		cf.elses[i] = -1
+		switch in.Op {
+		case OpBlock, OpLoop, OpIf: open = append(open, i)
+		case OpElse:
+			if len(open) == 0 || f.Body[open[len(open)-1]].Op != OpIf { return nil, errors.New("else outside of if") }
+			cf.elses[open[len(open)-1]] = i
+		case OpEnd:
+			if len(open) == 0 {
+				if i != len(f.Body)-1 { return nil, errors.New("unbalanced end") }
+				continue
+			}
+			start := open[len(open)-1]
+			open = open[:len(open)-1]
+			cf.ends[start] = i
+			if e := cf.elses[start]; e >= 0 { cf.ends[e] = i }
+		}
+	}
+	if len(open) > 0 || len(f.Body) == 0 || f.Body[len(f.Body)-1].Op != OpEnd { return nil, errors.New("unterminated function body") }
+	return cf, nil
+}
+
+// Start calls the _start export and flushes the output of the module
+func (rt *Runtime) Start() (code int, err error) {
+	defer rt.stdout.Flush()
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case *exitStatus: code, err = e.code, nil
+			case *Trap: err = e
+			default: panic(r)
+			}
+		}
+	}()
+	for _, e := range rt.mod.Exports {
+		if e.Kind == ExportFunc && e.Name == "_start" {
+			rt.invoke(e.Index)
+			return 0, nil
+		}
+	}
+	return 0, errors.New("module has no _start function")
+}
+
+func (rt *Runtime) push(v uint64) { rt.stack = append(rt.stack, v) }
+
+func (rt *Runtime) pop() uint64 {
+	v := rt.stack[len(rt.stack)-1]
+	rt.stack = rt.stack[:len(rt.stack)-1]
+	return v
+}
+
+// addr checks that size bytes at the address on top of the stack plus offset are in memory
+func (rt *Runtime) addr(offset uint64, size int) int {
+	a := uint64(uint32(rt.pop())) + offset
+	if a+uint64(size) > uint64(len(rt.mem)) { trap("out of bounds memory access at 0x%x", a) }
+	return int(a)
+}
+
+func (rt *Runtime) checkRange(a, n uint32) {
+	if uint64(a)+uint64(n) > uint64(len(rt.mem)) { trap("out of bounds memory access at 0x%x", a) }
+}
+
+func b2u(b bool) uint64 {
+	if b { return 1 }
+	return 0
+}
+
+func f32(v uint64) float32  { return math.Float32frombits(uint32(v)) }
+func f64(v uint64) float64  { return math.Float64frombits(v) }
+func uf32(f float32) uint64 { return uint64(math.Float32bits(f)) }
+func uf64(f float64) uint64 { return math.Float64bits(f) }
+
+// truncSat converts f toward zero, saturating at lo and hi and taking NaN to zero as trunc_sat does
+func truncSat(f float64, lo, hi float64, min, max uint64, signed bool) uint64 {
+	switch {
+	case math.IsNaN(f): return 0
+	case f <= lo: return min
+	case f >= hi: return max
+	case signed: return uint64(int64(f))
+	}
+	return uint64(f)
+}
+
+// invoke calls function idx with its arguments on the stack, leaving its results there
+func (rt *Runtime) invoke(idx uint32) {
+	if int(idx) < len(rt.hosts) {
+		host := rt.hosts[idx]
+		n := len(host.typ.Params)
+		args := append([]uint64(nil), rt.stack[len(rt.stack)-n:]...)
+		rt.stack = rt.stack[:len(rt.stack)-n]
+		res := host.fn(rt, args)
+		if len(host.typ.Results) > 0 { rt.push(res) }
+		return
+	}
+
+	rt.depth++
+	if rt.depth > maxCallDepth { trap("call stack exhausted") }
+	defer func() { rt.depth-- }()
+
+	f := rt.code[int(idx)-len(rt.hosts)]
+	nParams := len(f.typ.Params)
+	locals := make([]uint64, nParams+len(f.Locals))
+	copy(locals, rt.stack[len(rt.stack)-nParams:])
+	rt.stack = rt.stack[:len(rt.stack)-nParams]
+
+	body := f.Body
+	labels := []label{{pc: len(body) - 1, height: len(rt.stack), arity: len(f.typ.Results)}}
+
+	// branch unwinds to the label depth levels out and returns where execution continues
+	branch := func(depth int) int {
+		l := labels[len(labels)-1-depth]
+		if l.loop {
+			rt.stack = rt.stack[:l.height]
+			labels = labels[:len(labels)-depth]
+			return l.pc + 1
+		}
+		copy(rt.stack[l.height:], rt.stack[len(rt.stack)-l.arity:])
+		rt.stack = rt.stack[:l.height+l.arity]
+		labels = labels[:len(labels)-1-depth]
+		return l.pc + 1
+	}
+
+	for pc := 0; ; {
+		in := &body[pc]
+		switch in.Op {
+		case OpUnreachable: trap("unreachable executed")
+		case OpNop:
+		case OpBlock, OpLoop:
+			arity := 0
+			if byte(in.Imm) != BlockEmpty && in.Op == OpBlock { arity = 1 }
+			if in.Op == OpLoop {
+				labels = append(labels, label{pc: pc, height: len(rt.stack), loop: true})
+			} else {
+				labels = append(labels, label{pc: f.ends[pc], height: len(rt.stack), arity: arity})
+			}
+		case OpIf:
+			arity := 0
+			if byte(in.Imm) != BlockEmpty { arity = 1 }
+			cond := uint32(rt.pop())
+			labels = append(labels, label{pc: f.ends[pc], height: len(rt.stack), arity: arity})
+			if cond == 0 {
+				if e := f.elses[pc]; e >= 0 {
+					pc = e + 1
+				} else {
+					pc = f.ends[pc]
+				}
+				continue
+			}
+		case OpElse:
+			pc = f.ends[pc]
+			continue
+		case OpEnd:
+			labels = labels[:len(labels)-1]
+			if len(labels) == 0 { return }
+		case OpBr:
+			if int(in.Imm) == len(labels)-1 { rt.ret(labels[0]); return }
+			pc = branch(int(in.Imm))
+			continue
+		case OpBrIf:
+			if uint32(rt.pop()) != 0 {
+				if int(in.Imm) == len(labels)-1 { rt.ret(labels[0]); return }
+				pc = branch(int(in.Imm))
+				continue
+			}
+		case OpBrTable:
+			i := uint32(rt.pop())
+			depth := int(in.Imm)
+			if int(i) < len(in.Labels) { depth = int(in.Labels[i]) }
+			if depth == len(labels)-1 { rt.ret(labels[0]); return }
+			pc = branch(depth)
+			continue
+		case OpReturn:
+			rt.ret(labels[0])
+			return
+		case OpCall: rt.invoke(uint32(in.Imm))
+		case OpCallIndirect:
+			i := uint32(rt.pop())
+			if i == 0 || int(i) > len(rt.mod.Table) { trap("indirect call to a null or out of range function %d", i) }
+			target := rt.mod.Table[i-1]
+			if !rt.mod.funcType(target).equal(rt.mod.Types[in.Imm]) { trap("indirect call to %s with the wrong signature", rt.mod.funcName(target)) }
+			rt.invoke(target)
+		case OpDrop: rt.pop()
+		case OpSelect:
+			c := uint32(rt.pop())
+			b, a := rt.pop(), rt.pop()
+			if c != 0 { rt.push(a) } else { rt.push(b) }
+		case OpLocalGet: rt.push(locals[in.Imm])
+		case OpLocalSet: locals[in.Imm] = rt.pop()
+		case OpLocalTee: locals[in.Imm] = rt.stack[len(rt.stack)-1]
+		case OpGlobalGet: rt.push(rt.globals[in.Imm])
+		case OpGlobalSet: rt.globals[in.Imm] = rt.pop()
+
+		case OpI32Load, OpF32Load: rt.push(uint64(binary.LittleEndian.Uint32(rt.mem[rt.addr(in.Imm, 4):])))
+		case OpI64Load, OpF64Load: rt.push(binary.LittleEndian.Uint64(rt.mem[rt.addr(in.Imm, 8):]))
+		case OpI32Load8S: rt.push(uint64(uint32(int8(rt.mem[rt.addr(in.Imm, 1)]))))
+		case OpI32Load8U, OpI64Load8U: rt.push(uint64(rt.mem[rt.addr(in.Imm, 1)]))
+		case OpI32Load16S: rt.push(uint64(uint32(int16(binary.LittleEndian.Uint16(rt.mem[rt.addr(in.Imm, 2):])))))
+		case OpI32Load16U, OpI64Load16U: rt.push(uint64(binary.LittleEndian.Uint16(rt.mem[rt.addr(in.Imm, 2):])))
+		case OpI64Load8S: rt.push(uint64(int8(rt.mem[rt.addr(in.Imm, 1)])))
+		case OpI64Load16S: rt.push(uint64(int16(binary.LittleEndian.Uint16(rt.mem[rt.addr(in.Imm, 2):]))))
+		case OpI64Load32S: rt.push(uint64(int32(binary.LittleEndian.Uint32(rt.mem[rt.addr(in.Imm, 4):]))))
+		case OpI64Load32U: rt.push(uint64(binary.LittleEndian.Uint32(rt.mem[rt.addr(in.Imm, 4):])))
+		case OpI32Store, OpF32Store, OpI64Store32:
+			v := rt.pop()
+			binary.LittleEndian.PutUint32(rt.mem[rt.addr(in.Imm, 4):], uint32(v))
+		case OpI64Store, OpF64Store:
+			v := rt.pop()
+			binary.LittleEndian.PutUint64(rt.mem[rt.addr(in.Imm, 8):], v)
+		case OpI32Store8, OpI64Store8:
+			v := rt.pop()
+			rt.mem[rt.addr(in.Imm, 1)] = byte(v)
+		case OpI32Store16, OpI64Store16:
+			v := rt.pop()
+			binary.LittleEndian.PutUint16(rt.mem[rt.addr(in.Imm, 2):], uint16(v))
+		case OpMemorySize: rt.push(uint64(len(rt.mem) / PageSize))
+		case OpMemoryGrow:
+			n := uint32(rt.pop())
+			old := len(rt.mem) / PageSize
+			if uint64(old)+uint64(n) > 65536 {
+				rt.push(uint64(uint32(0xffffffff)))
+			} else {
+				rt.mem = append(rt.mem, make([]byte, int(n)*PageSize)...)
+				rt.push(uint64(old))
+			}
+		case OpMemoryCopy:
+			n, src, dst := uint32(rt.pop()), uint32(rt.pop()), uint32(rt.pop())
+			rt.checkRange(src, n)
+			rt.checkRange(dst, n)
+			copy(rt.mem[dst:dst+n], rt.mem[src:src+n])
+		case OpMemoryFill:
+			n, v, dst := uint32(rt.pop()), byte(rt.pop()), uint32(rt.pop())
+			rt.checkRange(dst, n)
+			for i := range rt.mem[dst : dst+n] {
+				rt.mem[dst+uint32(i)] = v
+			}
+
+		case OpI32Const: rt.push(uint64(uint32(in.Imm)))
+		case OpI64Const, OpF32Const, OpF64Const: rt.push(in.Imm)
+
+		default:
+			rt.numeric(in.Op)
+		}
+		pc++
+	}
+}
+
+// ret moves the results of the function of the label fn down to where its frame started
+func (rt *Runtime) ret(fn label) {
+	copy(rt.stack[fn.height:], rt.stack[len(rt.stack)-fn.arity:])
+	rt.stack = rt.stack[:fn.height+fn.arity]
+}
+
+// numeric runs an instruction that only operates on the stack
+func (rt *Runtime) numeric(op Opcode) {
+	switch op {
+	case OpI32Eqz: rt.push(b2u(uint32(rt.pop()) == 0))
+	case OpI64Eqz: rt.push(b2u(rt.pop() == 0))
+	case OpI32WrapI64: rt.push(uint64(uint32(rt.pop())))
+	case OpI64ExtendI32S: rt.push(uint64(int32(rt.pop())))
+	case OpI64ExtendI32U: rt.push(uint64(uint32(rt.pop())))
+	case OpI32Extend8S: rt.push(uint64(uint32(int8(rt.pop()))))
+	case OpI32Extend16S: rt.push(uint64(uint32(int16(rt.pop()))))
+	case OpI64Extend8S: rt.push(uint64(int8(rt.pop())))
+	case OpI64Extend16S: rt.push(uint64(int16(rt.pop())))
+	case OpI64Extend32S: rt.push(uint64(int32(rt.pop())))
+	case OpF32Neg: rt.push(rt.pop() ^ 1<<31)
+	case OpF64Neg: rt.push(rt.pop() ^ 1<<63)
+	case OpF32Trunc: rt.push(uf32(float32(math.Trunc(float64(f32(rt.pop()))))))
+	case OpF64Trunc: rt.push(uf64(math.Trunc(f64(rt.pop()))))
+	case OpF32ConvertI32S: rt.push(uf32(float32(int32(rt.pop()))))
+	case OpF32ConvertI32U: rt.push(uf32(float32(uint32(rt.pop()))))
+	case OpF32ConvertI64S: rt.push(uf32(float32(int64(rt.pop()))))
+	case OpF32ConvertI64U: rt.push(uf32(float32(rt.pop())))
+	case OpF32DemoteF64: rt.push(uf32(float32(f64(rt.pop()))))
+	case OpF64ConvertI32S: rt.push(uf64(float64(int32(rt.pop()))))
+	case OpF64ConvertI32U: rt.push(uf64(float64(uint32(rt.pop()))))
+	case OpF64ConvertI64S: rt.push(uf64(float64(int64(rt.pop()))))
+	case OpF64ConvertI64U: rt.push(uf64(float64(rt.pop())))
+	case OpF64PromoteF32: rt.push(uf64(float64(f32(rt.pop()))))
+	case OpI32ReinterpretF32, OpF32ReinterpretI32: rt.push(uint64(uint32(rt.pop())))
+	case OpI64ReinterpretF64, OpF64ReinterpretI64:
+	case OpI32TruncSatF64S: rt.push(uint64(uint32(truncSat(f64(rt.pop()), math.MinInt32, 1<<31, 1<<31, 1<<31-1, true))))
+	case OpI32TruncSatF64U: rt.push(truncSat(f64(rt.pop()), 0, 1<<32, 0, 1<<32-1, false))
+	case OpI64TruncSatF64S: rt.push(truncSat(f64(rt.pop()), math.MinInt64, 1<<63, 1<<63, 1<<63-1, true))
+	case OpI64TruncSatF64U: rt.push(truncSat(f64(rt.pop()), 0, 1<<64, 0, 1<<64-1, false))
+	default:
+		b, a := rt.pop(), rt.pop()
+		rt.push(binaryOp(op, a, b))
+	}
+}
+
+func binaryOp(op Opcode, a, b uint64) uint64 {
+	a32, b32 := uint32(a), uint32(b)
+	switch op {
+	case OpI32Eq: return b2u(a32 == b32)
+	case OpI32Ne: return b2u(a32 != b32)
+	case OpI32LtS: return b2u(int32(a32) < int32(b32))
+	case OpI32LtU: return b2u(a32 < b32)
+	case OpI32GtS: return b2u(int32(a32) > int32(b32))
+	case OpI32GtU: return b2u(a32 > b32)
+	case OpI32LeS: return b2u(int32(a32) <= int32(b32))
+	case OpI32LeU: return b2u(a32 <= b32)
+	case OpI32GeS: return b2u(int32(a32) >= int32(b32))
+	case OpI32GeU: return b2u(a32 >= b32)
+	case OpI64Eq: return b2u(a == b)
+	case OpI64Ne: return b2u(a != b)
+	case OpI64LtS: return b2u(int64(a) < int64(b))
+	case OpI64LtU: return b2u(a < b)
+	case OpI64GtS: return b2u(int64(a) > int64(b))
+	case OpI64GtU: return b2u(a > b)
+	case OpI64LeS: return b2u(int64(a) <= int64(b))
+	case OpI64LeU: return b2u(a <= b)
+	case OpI64GeS: return b2u(int64(a) >= int64(b))
+	case OpI64GeU: return b2u(a >= b)
+	case OpF32Eq: return b2u(f32(a) == f32(b))
+	case OpF32Ne: return b2u(f32(a) != f32(b))
+	case OpF32Lt: return b2u(f32(a) < f32(b))
+	case OpF32Gt: return b2u(f32(a) > f32(b))
+	case OpF32Le: return b2u(f32(a) <= f32(b))
+	case OpF32Ge: return b2u(f32(a) >= f32(b))
+	case OpF64Eq: return b2u(f64(a) == f64(b))
+	case OpF64Ne: return b2u(f64(a) != f64(b))
+	case OpF64Lt: return b2u(f64(a) < f64(b))
+	case OpF64Gt: return b2u(f64(a) > f64(b))
+	case OpF64Le: return b2u(f64(a) <= f64(b))
+	case OpF64Ge: return b2u(f64(a) >= f64(b))
+
+	case OpI32Add: return uint64(a32 + b32)
+	case OpI32Sub: return uint64(a32 - b32)
+	case OpI32Mul: return uint64(a32 * b32)
+	case OpI32DivS:
+		if b32 == 0 { trap("integer divide by zero") }
+		if int32(a32) == math.MinInt32 && int32(b32) == -1 { trap("integer overflow") }
+		return uint64(uint32(int32(a32) / int32(b32)))
+	case OpI32DivU:
+		if b32 == 0 { trap("integer divide by zero") }
+		return uint64(a32 / b32)
+	case OpI32RemS:
+		if b32 == 0 { trap("integer divide by zero") }
+		if int32(b32) == -1 { return 0 }
+		return uint64(uint32(int32(a32) % int32(b32)))
+	case OpI32RemU:
+		if b32 == 0 { trap("integer divide by zero") }
+		return uint64(a32 % b32)
+	case OpI32And: return uint64(a32 & b32)
+	case OpI32Or: return uint64(a32 | b32)
+	case OpI32Xor: return uint64(a32 ^ b32)
+	case OpI32Shl: return uint64(a32 << (b32 & 31))
+	case OpI32ShrS: return uint64(uint32(int32(a32) >> (b32 & 31)))
+	case OpI32ShrU: return uint64(a32 >> (b32 & 31))
+	case OpI64Add: return a + b
+	case OpI64Sub: return a - b
+	case OpI64Mul: return a * b
+	case OpI64DivS:
+		if b == 0 { trap("integer divide by zero") }
+		if int64(a) == math.MinInt64 && int64(b) == -1 { trap("integer overflow") }
+		return uint64(int64(a) / int64(b))
+	case OpI64DivU:
+		if b == 0 { trap("integer divide by zero") }
+		return a / b
+	case OpI64RemS:
+		if b == 0 { trap("integer divide by zero") }
+		if int64(b) == -1 { return 0 }
+		return uint64(int64(a) % int64(b))
+	case OpI64RemU:
+		if b == 0 { trap("integer divide by zero") }
+		return a % b
+	case OpI64And: return a & b
+	case OpI64Or: return a | b
+	case OpI64Xor: return a ^ b
+	case OpI64Shl: return a << (b & 63)
+	case OpI64ShrS: return uint64(int64(a) >> (b & 63))
+	case OpI64ShrU: return a >> (b & 63)
+
+	case OpF32Add: return uf32(f32(a) + f32(b))
+	case OpF32Sub: return uf32(f32(a) - f32(b))
+	case OpF32Mul: return uf32(f32(a) * f32(b))
+	case OpF32Div: return uf32(f32(a) / f32(b))
+	case OpF64Add: return uf64(f64(a) + f64(b))
+	case OpF64Sub: return uf64(f64(a) - f64(b))
+	case OpF64Mul: return uf64(f64(a) * f64(b))
+	case OpF64Div: return uf64(f64(a) / f64(b))
+	}
+	trap("unsupported instruction %s", op)
+	return 0
+}
@@ -0,0 +1,119 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// WASI errno values
+const (
+	errnoSuccess = 0
+	errnoBadf    = 8
+	errnoFault   = 21
+	errnoIO      = 29
+)
+
+// wasiFuncs are the functions of wasi_snapshot_preview1 a module may import: the command line, the standard
+// streams and exiting
+var wasiFuncs = map[string]*hostFunc{
+	"args_sizes_get":    {FuncType{Params: []ValType{I32, I32}, Results: []ValType{I32}}, wasiArgsSizesGet},
+	"args_get":          {FuncType{Params: []ValType{I32, I32}, Results: []ValType{I32}}, wasiArgsGet},
+	"environ_sizes_get": {FuncType{Params: []ValType{I32, I32}, Results: []ValType{I32}}, wasiEnvironSizesGet},
+	"environ_get":       {FuncType{Params: []ValType{I32, I32}, Results: []ValType{I32}}, func(*Runtime, []uint64) uint64 { return errnoSuccess }},
+	"fd_write":          {FuncType{Params: []ValType{I32, I32, I32, I32}, Results: []ValType{I32}}, wasiFdWrite},
+	"fd_read":           {FuncType{Params: []ValType{I32, I32, I32, I32}, Results: []ValType{I32}}, wasiFdRead},
+	"proc_exit":         {FuncType{Params: []ValType{I32}}, wasiProcExit},
+}
+
+// span returns n bytes of memory at a, or nil when they are not all in memory
+func (rt *Runtime) span(a, n uint32) []byte {
+	if uint64(a)+uint64(n) > uint64(len(rt.mem)) { return nil }
+	return rt.mem[a : a+n]
+}
+
+func (rt *Runtime) putU32(a uint32, v uint32) bool {
+	b := rt.span(a, 4)
+	if b == nil { return false }
+	binary.LittleEndian.PutUint32(b, v)
+	return true
+}
+
+func wasiArgsSizesGet(rt *Runtime, args []uint64) uint64 {
+	size := 0
+	for _, a := range rt.args {
+		size += len(a) + 1
+	}
+	if !rt.putU32(uint32(args[0]), uint32(len(rt.args))) || !rt.putU32(uint32(args[1]), uint32(size)) { return errnoFault }
+	return errnoSuccess
+}
+
+func wasiArgsGet(rt *Runtime, args []uint64) uint64 {
+	argv, buf := uint32(args[0]), uint32(args[1])
+	for i, a := range rt.args {
+		dst := rt.span(buf, uint32(len(a)+1))
+		if dst == nil || !rt.putU32(argv+uint32(4*i), buf) { return errnoFault }
+		copy(dst, a)
+		dst[len(a)] = 0
+		buf += uint32(len(a) + 1)
+	}
+	return errnoSuccess
+}
+
+func wasiEnvironSizesGet(rt *Runtime, args []uint64) uint64 {
+	if !rt.putU32(uint32(args[0]), 0) || !rt.putU32(uint32(args[1]), 0) { return errnoFault }
+	return errnoSuccess
+}
+
+// iovecs returns the buffers of an array of n iovecs at a
+func (rt *Runtime) iovecs(a, n uint32) ([][]byte, bool) {
+	var bufs [][]byte
+	for i := uint32(0); i < n; i++ {
+		vec := rt.span(a+8*i, 8)
+		if vec == nil { return nil, false }
+		buf := rt.span(binary.LittleEndian.Uint32(vec), binary.LittleEndian.Uint32(vec[4:]))
+		if buf == nil { return nil, false }
+		bufs = append(bufs, buf)
+	}
+	return bufs, true
+}
+
+func wasiFdWrite(rt *Runtime, args []uint64) uint64 {
+	bufs, ok := rt.iovecs(uint32(args[1]), uint32(args[2]))
+	if !ok { return errnoFault }
+	var w io.Writer
+	switch args[0] {
+	case 1: w = rt.stdout
+	case 2:
+		// Standard error is not buffered, so what was printed before it comes out first
+		rt.stdout.Flush()
+		w = rt.stderr
+	default: return errnoBadf
+	}
+	total := 0
+	for _, buf := range bufs {
+		n, err := w.Write(buf)
+		total += n
+		if err != nil { return errnoIO }
+	}
+	if !rt.putU32(uint32(args[3]), uint32(total)) { return errnoFault }
+	return errnoSuccess
+}
+
+func wasiFdRead(rt *Runtime, args []uint64) uint64 {
+	if args[0] != 0 { return errnoBadf }
+	bufs, ok := rt.iovecs(uint32(args[1]), uint32(args[2]))
+	if !ok { return errnoFault }
+	// A prompt is seen before the program waits for its answer
+	rt.stdout.Flush()
+	total := 0
+	for _, buf := range bufs {
+		n, err := rt.stdin.Read(buf)
+		total += n
+		if err == io.EOF || n < len(buf) { break }
+		if err != nil { return errnoIO }
+	}
+	if !rt.putU32(uint32(args[3]), uint32(total)) { return errnoFault }
+	return errnoSuccess
+}
+
+func wasiProcExit(rt *Runtime, args []uint64) uint64 { panic(&exitStatus{code: int(int32(args[0]))}) }
@@ -0,0 +1,152 @@
+package wasm
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// WriteWAT writes m in the WebAssembly text format
+func (m *Module) WriteWAT(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString("(module\n")
+	for i, t := range m.Types {
+		fmt.Fprintf(&sb, "  (type $t%d (func%s))\n", i, watSignature(t))
+	}
+	for i, imp := range m.Imports {
+		fmt.Fprintf(&sb, "  (import %q %q (func $%s (type $t%d)))\n", imp.Module, imp.Name, m.funcName(uint32(i)), imp.Type)
+	}
+	if len(m.Table) > 0 {
+		fmt.Fprintf(&sb, "  (table %d funcref)\n  (elem (i32.const 1)", len(m.Table)+1)
+		for _, idx := range m.Table {
+			fmt.Fprintf(&sb, " $%s", m.funcName(idx))
+		}
+		sb.WriteString(")\n")
+	}
+	fmt.Fprintf(&sb, "  (memory %d)\n", m.Memory)
+	for i, g := range m.Globals {
+		typ := g.Type.String()
+		if g.Mutable { typ = "(mut " + typ + ")" }
+		fmt.Fprintf(&sb, "  (global $%s %s (%s))\n", globalName(g, i), typ, watInstr(m, Instr{Op: constOp(g.Type), Imm: g.Init}))
+	}
+	for _, e := range m.Exports {
+		switch e.Kind {
+		case ExportFunc: fmt.Fprintf(&sb, "  (export %q (func $%s))\n", e.Name, m.funcName(e.Index))
+		case ExportMemory: fmt.Fprintf(&sb, "  (export %q (memory %d))\n", e.Name, e.Index)
+		}
+	}
+	for _, d := range m.Data {
+		fmt.Fprintf(&sb, "  (data (i32.const %d) \"%s\")\n", d.Offset, watBytes(d.Bytes))
+	}
+	for i, f := range m.Funcs {
+		ft := m.Types[f.Type]
+		fmt.Fprintf(&sb, "  (func $%s (type $t%d)%s\n", m.funcName(uint32(len(m.Imports)+i)), f.Type, watSignature(ft))
+		if len(f.Locals) > 0 {
+			sb.WriteString("    (local")
+			for _, t := range f.Locals {
+				sb.WriteString(" " + t.String())
+			}
+			sb.WriteString(")\n")
+		}
+		depth := 2
+		for j, in := range f.Body {
+			if in.Op == OpEnd || in.Op == OpElse { depth-- }
+			// The final end closes the function itself
+			if j == len(f.Body)-1 && in.Op == OpEnd { break }
+			fmt.Fprintf(&sb, "%s%s\n", strings.Repeat("  ", depth), watInstr(m, in))
+			if in.Op == OpBlock || in.Op == OpLoop || in.Op == OpIf || in.Op == OpElse { depth++ }
+		}
+		sb.WriteString("  )\n")
+	}
+	sb.WriteString(")\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func globalName(g Global, i int) string {
+	if g.Name != "" { return g.Name }
+	return fmt.Sprintf("g%d", i)
+}
+
+func constOp(t ValType) Opcode {
+	switch t {
+	case I32: return OpI32Const
+	case F32: return OpF32Const
+	case F64: return OpF64Const
+	}
+	return OpI64Const
+}
+
+func watSignature(ft FuncType) string {
+	var sb strings.Builder
+	if len(ft.Params) > 0 {
+		sb.WriteString(" (param")
+		for _, t := range ft.Params {
+			sb.WriteString(" " + t.String())
+		}
+		sb.WriteString(")")
+	}
+	if len(ft.Results) > 0 {
+		sb.WriteString(" (result")
+		for _, t := range ft.Results {
+			sb.WriteString(" " + t.String())
+		}
+		sb.WriteString(")")
+	}
+	return sb.String()
+}
+
+func watBytes(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if c >= 0x20 && c < 0x7f && c != '"' && c != '\\' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "\\%02x", c)
+		}
+	}
+	return sb.String()
+}
+
+func watInstr(m *Module, in Instr) string {
+	name := in.Op.String()
+	switch in.Op {
+	case OpBlock, OpLoop, OpIf:
+		if byte(in.Imm) != BlockEmpty { return fmt.Sprintf("%s (result %s)", name, ValType(in.Imm)) }
+	case OpBr, OpBrIf, OpLocalGet, OpLocalSet, OpLocalTee, OpGlobalGet, OpGlobalSet:
+		return fmt.Sprintf("%s %d", name, in.Imm)
+	case OpBrTable:
+		var sb strings.Builder
+		sb.WriteString(name)
+		for _, l := range in.Labels {
+			fmt.Fprintf(&sb, " %d", l)
+		}
+		fmt.Fprintf(&sb, " %d", in.Imm)
+		return sb.String()
+	case OpCall: return fmt.Sprintf("%s $%s", name, m.funcName(uint32(in.Imm)))
+	case OpCallIndirect: return fmt.Sprintf("%s (type $t%d)", name, in.Imm)
+	case OpI32Const: return fmt.Sprintf("%s %d", name, int32(in.Imm))
+	case OpI64Const: return fmt.Sprintf("%s %d", name, int64(in.Imm))
+	case OpF32Const: return fmt.Sprintf("%s %s", name, watFloat(float64(math.Float32frombits(uint32(in.Imm))), uint64(in.Imm)&(1<<23-1), 32))
+	case OpF64Const: return fmt.Sprintf("%s %s", name, watFloat(math.Float64frombits(in.Imm), in.Imm&(1<<52-1), 64))
+	default:
+		if in.Op.memAccessSize() > 0 && in.Imm != 0 { return fmt.Sprintf("%s offset=%d", name, in.Imm) }
+	}
+	return name
+}
+
+// watFloat writes f exactly, as a hexadecimal float or with the payload of a NaN
+func watFloat(f float64, payload uint64, bitSize int) string {
+	switch {
+	case math.IsNaN(f):
+		sign := ""
+		if math.Signbit(f) { sign = "-" }
+		if bitSize == 32 && payload == 1<<22 || bitSize == 64 && payload == 1<<51 { return sign + "nan" }
+		return fmt.Sprintf("%snan:0x%x", sign, payload)
+	case math.IsInf(f, 1): return "inf"
+	case math.IsInf(f, -1): return "-inf"
+	}
+	return strconv.FormatFloat(f, 'x', -1, bitSize)
+}
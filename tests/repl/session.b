@@ -0,0 +1,13 @@
+x := 6;
+printf("%d\n", x * 7);
+x + 1;
+:type x * 2
+square(n) {
+	return (n * n);
+}
+square(x) - 1;
+counter 10;
+counter = counter + 5;
+counter;
+exit(3);
+printf("never\n");
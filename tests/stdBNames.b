@@ -0,0 +1,13 @@
+/* The words C loops and defer statements take are only keywords in Bx: a B program may use them as names */
+
+for(n) {
+    return (n * 2);
+}
+
+main() {
+    extrn printf;
+    auto do, defer;
+    do = for(3);
+    defer = for(do);
+    printf("%d %d*n", do, defer);
+}
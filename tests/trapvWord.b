@@ -0,0 +1,31 @@
+// Checked arithmetic traps at the limits of the word, whatever its size
+
+// [b]: check: overflow div
+checked_div(a, b) {
+    return (a / b);
+}
+
+// [b]: check: overflow
+checked_sub(a, b) {
+    return (a - b);
+}
+
+/* the largest word, found without overflowing */
+word_max() {
+    auto max;
+    max = 1;
+    while ((max << 1) > 0) max = max << 1;
+    return (max | max - 1);
+}
+
+main() {
+    extrn printf;
+    auto max, min;
+    max = word_max();
+    min = -max - 1;
+
+    printf("%d %d\n", checked_div(100, 7), checked_div(-100, 7));
+    printf("%d %d\n", checked_sub(min, -1) == -max, checked_div(min, 1) == min);
+    printf("%d\n", checked_div(min, -1)); // traps
+    printf("unreachable\n");
+}